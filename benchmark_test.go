@@ -144,7 +144,7 @@ func benchmarkProposeN(b *testing.B, sz int) {
 				atomic.StoreUint32(&total, 0)
 				q.get(false)
 			}
-			pp.applied(rs.key, rs.clientID, rs.seriesID, sm.Result{Value: 1}, false)
+			pp.applied(rs.key, rs.clientID, rs.seriesID, 0, sm.Result{Value: 1}, false)
 			rs.readyToRelease.set()
 			rs.Release()
 		}
@@ -395,6 +395,10 @@ type dummyTransportEvent struct{}
 
 func (d *dummyTransportEvent) ConnectionEstablished(addr string, snapshot bool) {}
 func (d *dummyTransportEvent) ConnectionFailed(addr string, snapshot bool)      {}
+func (d *dummyTransportEvent) AddressChanged(addr string,
+	previous []string, current []string) {
+}
+func (d *dummyTransportEvent) PeerHealthChanged(addr string, reachable bool) {}
 
 func benchmarkTransport(b *testing.B, sz int) {
 	b.ReportAllocs()
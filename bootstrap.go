@@ -0,0 +1,289 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"time"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/transport"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+var (
+	// ErrGossipNotEnabled indicates that the gossip service is not enabled on
+	// the NodeHost, see the AddressByNodeHostID field of config.NodeHostConfig
+	// for details.
+	ErrGossipNotEnabled = errors.New("gossip not enabled")
+	// ErrUnexpectedNodeHostCount indicates that more NodeHosts than expected are
+	// known by the gossip service.
+	ErrUnexpectedNodeHostCount = errors.New("unexpected number of NodeHosts")
+)
+
+var (
+	bootstrapPollInterval = 100 * time.Millisecond
+)
+
+// BootstrapPlan describes how the local node of a Raft cluster is going to be
+// bootstrapped by the BootstrapCoordinator.
+type BootstrapPlan struct {
+	// NodeID is the NodeID of the local node.
+	NodeID uint64
+	// Bootstrapper indicates whether the local node is the bootstrapper of the
+	// Raft cluster. The bootstrapper starts the Raft cluster as its only initial
+	// member and then adds all other members one by one.
+	Bootstrapper bool
+	// Members is the map of NodeID to NodeHostID values of all Raft cluster
+	// members once the bootstrap is completed.
+	Members map[uint64]string
+}
+
+// BootstrapCoordinator helps a set of freshly provisioned NodeHost instances
+// to agree on the initial membership of Raft clusters, saving applications
+// from specifying identical initialMembers maps on all NodeHosts.
+//
+// BootstrapCoordinator requires the gossip service to be enabled by setting
+// the AddressByNodeHostID field of config.NodeHostConfig to true. It waits
+// until the expected number of NodeHosts are known by the gossip service and
+// the set of known NodeHosts has remained unchanged for a configurable period
+// of time. NodeIDs are then deterministically assigned according to the
+// sorted NodeHostID values, one NodeHost is deterministically elected as the
+// bootstrapper of each Raft cluster. The bootstrapper starts the Raft cluster
+// with itself as the only initial member and adds all other NodeHosts as
+// regular members, all other NodeHosts start their nodes as joining nodes.
+// As there is only one initial member, conflicting initial memberships that
+// can break the quorum are not possible.
+//
+// Restarted nodes are started using their existing state in LogDB. Adding
+// members is idempotent, a restarted bootstrapper adds all members again so
+// the bootstrap is completed even when the bootstrapper failed before all
+// members were added. Members that have been added or removed are skipped.
+type BootstrapCoordinator struct {
+	nh           *NodeHost
+	registry     *transport.NodeHostIDRegistry
+	count        int
+	stablePeriod time.Duration
+}
+
+// NewBootstrapCoordinator creates a BootstrapCoordinator instance for the
+// specified NodeHost. count is the expected number of NodeHosts, the set of
+// known NodeHosts is considered as agreed after it remains unchanged for the
+// specified stablePeriod.
+func NewBootstrapCoordinator(nh *NodeHost,
+	count int, stablePeriod time.Duration) (*BootstrapCoordinator, error) {
+	r, ok := nh.nodes.(*transport.NodeHostIDRegistry)
+	if !ok {
+		return nil, ErrGossipNotEnabled
+	}
+	if count <= 0 {
+		return nil, ErrInvalidOperation
+	}
+	return &BootstrapCoordinator{
+		nh:           nh,
+		registry:     r,
+		count:        count,
+		stablePeriod: stablePeriod,
+	}, nil
+}
+
+// WaitForNodeHosts waits until the expected number of NodeHosts are known by
+// the gossip service and remained unchanged for the stable period. It returns
+// the sorted NodeHostID values of those NodeHosts.
+func (c *BootstrapCoordinator) WaitForNodeHosts(
+	ctx context.Context) ([]string, error) {
+	ticker := time.NewTicker(bootstrapPollInterval)
+	defer ticker.Stop()
+	var last []string
+	var since time.Time
+	for {
+		members := c.registry.Members()
+		if len(members) > c.count {
+			return nil, ErrUnexpectedNodeHostCount
+		}
+		if !stringsEqual(members, last) {
+			last = members
+			since = time.Now()
+		}
+		if len(last) == c.count && time.Since(since) >= c.stablePeriod {
+			return last, nil
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled {
+				return nil, ErrCanceled
+			}
+			return nil, ErrTimeout
+		case <-c.nh.stopper.ShouldStop():
+			return nil, ErrClosed
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetPlan returns the BootstrapPlan of the specified Raft cluster. It waits
+// for the agreement on the set of NodeHosts as described in WaitForNodeHosts.
+func (c *BootstrapCoordinator) GetPlan(ctx context.Context,
+	clusterID uint64) (BootstrapPlan, error) {
+	nhids, err := c.WaitForNodeHosts(ctx)
+	if err != nil {
+		return BootstrapPlan{}, err
+	}
+	return getBootstrapPlan(c.nh.ID(), clusterID, nhids), nil
+}
+
+// StartCluster bootstraps the specified Raft cluster backed by a regular state
+// machine. The ClusterID field of cfg must be set, its NodeID field is set by
+// the coordinator. StartCluster returns once the local node is started and,
+// for the bootstrapper, all other members have been added. Adding members is
+// retried according to the Retry field of config.ExpertConfig.
+func (c *BootstrapCoordinator) StartCluster(ctx context.Context,
+	create sm.CreateStateMachineFunc, cfg config.Config) error {
+	return c.start(ctx, cfg,
+		func(members map[uint64]Target, join bool, cfg config.Config) error {
+			return c.nh.StartCluster(members, join, create, cfg)
+		})
+}
+
+// StartConcurrentCluster is similar to the StartCluster method but it is used
+// to bootstrap a Raft cluster backed by a concurrent state machine.
+func (c *BootstrapCoordinator) StartConcurrentCluster(ctx context.Context,
+	create sm.CreateConcurrentStateMachineFunc, cfg config.Config) error {
+	return c.start(ctx, cfg,
+		func(members map[uint64]Target, join bool, cfg config.Config) error {
+			return c.nh.StartConcurrentCluster(members, join, create, cfg)
+		})
+}
+
+// StartOnDiskCluster is similar to the StartCluster method but it is used to
+// bootstrap a Raft cluster backed by an IOnDiskStateMachine.
+func (c *BootstrapCoordinator) StartOnDiskCluster(ctx context.Context,
+	create sm.CreateOnDiskStateMachineFunc, cfg config.Config) error {
+	return c.start(ctx, cfg,
+		func(members map[uint64]Target, join bool, cfg config.Config) error {
+			return c.nh.StartOnDiskCluster(members, join, create, cfg)
+		})
+}
+
+func (c *BootstrapCoordinator) start(ctx context.Context, cfg config.Config,
+	startFn func(map[uint64]Target, bool, config.Config) error) error {
+	plan, err := c.GetPlan(ctx, cfg.ClusterID)
+	if err != nil {
+		return err
+	}
+	if plan.NodeID == 0 {
+		return ErrUnexpectedNodeHostCount
+	}
+	cfg.NodeID = plan.NodeID
+	if c.nh.HasNodeInfo(cfg.ClusterID, cfg.NodeID) {
+		if err := startFn(nil, false, cfg); err != nil {
+			return err
+		}
+	} else if !plan.Bootstrapper {
+		return startFn(nil, true, cfg)
+	} else {
+		initialMembers := map[uint64]Target{plan.NodeID: c.nh.ID()}
+		if err := startFn(initialMembers, false, cfg); err != nil {
+			return err
+		}
+	}
+	if !plan.Bootstrapper {
+		return nil
+	}
+	return c.addMembers(ctx, cfg.ClusterID, plan)
+}
+
+func (c *BootstrapCoordinator) addMembers(ctx context.Context,
+	clusterID uint64, plan BootstrapPlan) error {
+	for nodeID := uint64(1); nodeID <= uint64(len(plan.Members)); nodeID++ {
+		if nodeID == plan.NodeID {
+			continue
+		}
+		if err := c.addMember(ctx,
+			clusterID, nodeID, plan.Members[nodeID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *BootstrapCoordinator) addMember(ctx context.Context,
+	clusterID uint64, nodeID uint64, target string) error {
+	r := newRetrier(c.nh.nhConfig.Expert.Retry, c.nh.stopper.ShouldStop())
+	return r.run(ctx, func(actx context.Context) error {
+		return c.tryAddMember(actx, clusterID, nodeID, target)
+	})
+}
+
+func (c *BootstrapCoordinator) tryAddMember(ctx context.Context,
+	clusterID uint64, nodeID uint64, target string) error {
+	m, err := c.nh.SyncGetClusterMembership(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.Nodes[nodeID]; ok {
+		return nil
+	}
+	if _, ok := m.Removed[nodeID]; ok {
+		return nil
+	}
+	return c.nh.SyncRequestAddNode(ctx,
+		clusterID, nodeID, target, m.ConfigChangeID)
+}
+
+// getBootstrapPlan assigns NodeIDs according to the order of the sorted
+// NodeHostID values, the bootstrapper is elected using the hash of the
+// clusterID so the bootstrapper role is spread across NodeHosts.
+func getBootstrapPlan(nhid string,
+	clusterID uint64, nhids []string) BootstrapPlan {
+	plan := BootstrapPlan{Members: make(map[uint64]string)}
+	for idx, v := range nhids {
+		nodeID := uint64(idx + 1)
+		plan.Members[nodeID] = v
+		if v == nhid {
+			plan.NodeID = nodeID
+		}
+	}
+	bootstrapper := getClusterHash(clusterID)%uint64(len(nhids)) + 1
+	plan.Bootstrapper = plan.NodeID == bootstrapper
+	return plan
+}
+
+// getClusterHash returns the hash value of the specified clusterID, it is used
+// to deterministically spread per cluster roles across NodeHosts.
+func getClusterHash(clusterID uint64) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], clusterID)
+	if _, err := h.Write(buf[:]); err != nil {
+		panic(err)
+	}
+	return h.Sum64()
+}
+
+func stringsEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
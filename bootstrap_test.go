@@ -0,0 +1,229 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/id"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+func TestGetBootstrapPlan(t *testing.T) {
+	nhids := []string{"nhid-1", "nhid-2", "nhid-3"}
+	bootstrappers := 0
+	for _, nhid := range nhids {
+		plan := getBootstrapPlan(nhid, 100, nhids)
+		if len(plan.Members) != 3 {
+			t.Fatalf("unexpected members %v", plan.Members)
+		}
+		if plan.Members[plan.NodeID] != nhid {
+			t.Errorf("unexpected node id %d", plan.NodeID)
+		}
+		if plan.Bootstrapper {
+			bootstrappers++
+		}
+	}
+	if bootstrappers != 1 {
+		t.Errorf("got %d bootstrappers, want 1", bootstrappers)
+	}
+	p1 := getBootstrapPlan("nhid-1", 100, nhids)
+	p2 := getBootstrapPlan("nhid-1", 100, nhids)
+	if p1.Bootstrapper != p2.Bootstrapper || p1.NodeID != p2.NodeID {
+		t.Errorf("plan is not deterministic")
+	}
+}
+
+func getGossipTestConfig(t *testing.T, fs vfs.IFS, dir string, addr string,
+	gossip string, seed string, nhid string) config.NodeHostConfig {
+	datadir := fs.PathJoin(singleNodeHostTestDir, dir)
+	v, err := id.ParseNodeHostID(nhid)
+	if err != nil {
+		t.Fatalf("failed to parse nhid")
+	}
+	return config.NodeHostConfig{
+		NodeHostDir:         datadir,
+		RTTMillisecond:      getRTTMillisecond(fs, datadir),
+		RaftAddress:         addr,
+		AddressByNodeHostID: true,
+		Gossip: config.GossipConfig{
+			BindAddress:      gossip,
+			AdvertiseAddress: gossip,
+			Seed:             []string{seed},
+		},
+		Expert: config.ExpertConfig{
+			FS:                      fs,
+			TestGossipProbeInterval: 50 * time.Millisecond,
+			TestNodeHostID:          v.Value(),
+		},
+	}
+}
+
+func TestBootstrapCoordinatorRequiresGossip(t *testing.T) {
+	tf := func(nh *NodeHost) {
+		if _, err := NewBootstrapCoordinator(nh,
+			1, time.Second); err != ErrGossipNotEnabled {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	runNodeHostTest(t, &testOption{defaultTestNode: true, tf: tf}, vfs.GetTestFS())
+}
+
+func TestBootstrapCoordinatorCanBootstrapCluster(t *testing.T) {
+	fs := vfs.GetTestFS()
+	os.RemoveAll(singleNodeHostTestDir)
+	defer os.RemoveAll(singleNodeHostTestDir)
+	nh1, err := NewNodeHost(getGossipTestConfig(t, fs, "nh1", nodeHostTestAddr1,
+		"127.0.0.1:25001", "127.0.0.1:25002", testNodeHostID1))
+	if err != nil {
+		t.Fatalf("failed to create nh, %v", err)
+	}
+	defer nh1.Stop()
+	nh2, err := NewNodeHost(getGossipTestConfig(t, fs, "nh2", nodeHostTestAddr2,
+		"127.0.0.1:25002", "127.0.0.1:25001", testNodeHostID2))
+	if err != nil {
+		t.Fatalf("failed to create nh, %v", err)
+	}
+	defer nh2.Stop()
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	rc := config.Config{
+		ClusterID:    1,
+		ElectionRTT:  3,
+		HeartbeatRTT: 1,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	errCh := make(chan error, 2)
+	for _, nh := range []*NodeHost{nh1, nh2} {
+		c, err := NewBootstrapCoordinator(nh, 2, 200*time.Millisecond)
+		if err != nil {
+			t.Fatalf("failed to create coordinator %v", err)
+		}
+		go func() {
+			errCh <- c.StartCluster(ctx, createSM, rc)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("failed to bootstrap %v", err)
+		}
+	}
+	waitForLeaderToBeElected(t, nh1, 1)
+	m, err := nh1.SyncGetClusterMembership(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to get membership %v", err)
+	}
+	if len(m.Nodes) != 2 ||
+		m.Nodes[1] != testNodeHostID1 || m.Nodes[2] != testNodeHostID2 {
+		t.Errorf("unexpected membership %v", m.Nodes)
+	}
+	session := nh2.GetNoOPSession(1)
+	pctx, pcancel := context.WithTimeout(context.Background(), lpto(nh2))
+	defer pcancel()
+	if _, err := nh2.SyncPropose(pctx, session, make([]byte, 0)); err != nil {
+		t.Errorf("failed to make proposal %v", err)
+	}
+}
+
+func TestRestartedBootstrapperAddsMissingMembers(t *testing.T) {
+	fs := vfs.GetTestFS()
+	os.RemoveAll(singleNodeHostTestDir)
+	defer os.RemoveAll(singleNodeHostTestDir)
+	configs := []config.NodeHostConfig{
+		getGossipTestConfig(t, fs, "nh1", nodeHostTestAddr1,
+			"127.0.0.1:25001", "127.0.0.1:25002", testNodeHostID1),
+		getGossipTestConfig(t, fs, "nh2", nodeHostTestAddr2,
+			"127.0.0.1:25002", "127.0.0.1:25001", testNodeHostID2),
+	}
+	nhs := make([]*NodeHost, 0)
+	for _, cfg := range configs {
+		nh, err := NewNodeHost(cfg)
+		if err != nil {
+			t.Fatalf("failed to create nh, %v", err)
+		}
+		nhs = append(nhs, nh)
+	}
+	defer func() {
+		for _, nh := range nhs {
+			nh.Stop()
+		}
+	}()
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	rc := config.Config{
+		ClusterID:    1,
+		ElectionRTT:  3,
+		HeartbeatRTT: 1,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c, err := NewBootstrapCoordinator(nhs[0], 2, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to create coordinator %v", err)
+	}
+	nhids, err := c.WaitForNodeHosts(ctx)
+	if err != nil {
+		t.Fatalf("failed to wait for nodehosts %v", err)
+	}
+	b := 0
+	plan := getBootstrapPlan(nhs[b].ID(), rc.ClusterID, nhids)
+	if !plan.Bootstrapper {
+		b = 1
+		plan = getBootstrapPlan(nhs[b].ID(), rc.ClusterID, nhids)
+	}
+	// the bootstrapper failed right after starting its node
+	bc := rc
+	bc.NodeID = plan.NodeID
+	members := map[uint64]Target{bc.NodeID: nhs[b].ID()}
+	if err := nhs[b].StartCluster(members, false, createSM, bc); err != nil {
+		t.Fatalf("failed to start cluster %v", err)
+	}
+	nhs[b].Stop()
+	nh, err := NewNodeHost(configs[b])
+	if err != nil {
+		t.Fatalf("failed to restart nh, %v", err)
+	}
+	nhs[b] = nh
+	errCh := make(chan error, 2)
+	for _, nh := range nhs {
+		c, err := NewBootstrapCoordinator(nh, 2, 200*time.Millisecond)
+		if err != nil {
+			t.Fatalf("failed to create coordinator %v", err)
+		}
+		go func() {
+			errCh <- c.StartCluster(ctx, createSM, rc)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("failed to bootstrap %v", err)
+		}
+	}
+	m, err := nhs[b].SyncGetClusterMembership(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to get membership %v", err)
+	}
+	if len(m.Nodes) != 2 {
+		t.Errorf("unexpected membership %v", m.Nodes)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/lni/dragonboat/v3/client"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+var (
+	// ErrInvalidResultType indicates that the query result returned by the
+	// state machine can not be stored into the specified result value.
+	ErrInvalidResultType = errors.New("invalid result type")
+)
+
+// Codec is the interface used by ClusterClient for marshaling proposals and
+// unmarshaling results returned by state machines.
+type Codec interface {
+	// Marshal returns the encoded form of v.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data and stores the result in the value pointed to by
+	// v.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is a Codec implementation based on the encoding/json package.
+type JSONCodec struct{}
+
+var _ Codec = JSONCodec{}
+
+// Marshal returns the JSON encoding of v.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal parses the JSON encoded data and stores the result in the value
+// pointed to by v.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ClusterClient is a typed wrapper of the SyncPropose and SyncRead methods of
+// NodeHost for a specific Raft cluster. It uses the specified Codec to marshal
+// proposals and to unmarshal results, saving applications from writing the
+// same encoding and decoding code around every request.
+//
+// As the module supports Go versions without type parameters, results are
+// stored into values pointed to by the result parameters in the same way as
+// the encoding/json package.
+type ClusterClient struct {
+	nh        *NodeHost
+	codec     Codec
+	clusterID uint64
+}
+
+// NewClusterClient creates a new ClusterClient instance for the specified
+// Raft cluster.
+func NewClusterClient(nh *NodeHost,
+	clusterID uint64, codec Codec) *ClusterClient {
+	return &ClusterClient{nh: nh, codec: codec, clusterID: clusterID}
+}
+
+// ClusterID returns the ID of the Raft cluster.
+func (c *ClusterClient) ClusterID() uint64 {
+	return c.clusterID
+}
+
+// SyncPropose marshals the specified cmd value and makes a synchronous
+// proposal using NodeHost.SyncPropose. When result is not nil and the Data
+// field of the returned sm.Result is not empty, the Data field is unmarshaled
+// into the value pointed to by result.
+func (c *ClusterClient) SyncPropose(ctx context.Context,
+	session *client.Session, cmd interface{},
+	result interface{}) (sm.Result, error) {
+	if session.ClusterID != c.clusterID {
+		return sm.Result{}, ErrInvalidSession
+	}
+	data, err := c.codec.Marshal(cmd)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	r, err := c.nh.SyncPropose(ctx, session, data)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	if result != nil && len(r.Data) > 0 {
+		if err := c.codec.Unmarshal(r.Data, result); err != nil {
+			return sm.Result{}, err
+		}
+	}
+	return r, nil
+}
+
+// SyncRead performs a linearizable read using NodeHost.SyncRead and stores the
+// query result into the value pointed to by result. Query results assignable
+// to the value pointed to by result are directly assigned, other query results
+// of the []byte type are unmarshaled using the Codec. ErrInvalidResultType is
+// returned when neither is possible.
+func (c *ClusterClient) SyncRead(ctx context.Context,
+	query interface{}, result interface{}) error {
+	v, err := c.nh.SyncRead(ctx, c.clusterID, query)
+	if err != nil {
+		return err
+	}
+	return c.setResult(v, result)
+}
+
+func (c *ClusterClient) setResult(v interface{}, result interface{}) error {
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrInvalidResultType
+	}
+	if v == nil {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+		return nil
+	}
+	vv := reflect.ValueOf(v)
+	if vv.Type().AssignableTo(rv.Elem().Type()) {
+		rv.Elem().Set(vv)
+		return nil
+	}
+	if data, ok := v.([]byte); ok {
+		return c.codec.Unmarshal(data, result)
+	}
+	return ErrInvalidResultType
+}
@@ -0,0 +1,135 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+type testCounterCmd struct {
+	Delta uint64
+}
+
+type testCounterResult struct {
+	Count uint64
+}
+
+type testCounterSM struct {
+	count uint64
+}
+
+func (s *testCounterSM) Update(data []byte) (sm.Result, error) {
+	var cmd testCounterCmd
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return sm.Result{}, err
+	}
+	s.count += cmd.Delta
+	result, err := json.Marshal(testCounterResult{Count: s.count})
+	if err != nil {
+		return sm.Result{}, err
+	}
+	return sm.Result{Value: s.count, Data: result}, nil
+}
+
+func (s *testCounterSM) Lookup(query interface{}) (interface{}, error) {
+	if _, ok := query.(string); ok {
+		return testCounterResult{Count: s.count}, nil
+	}
+	return json.Marshal(testCounterResult{Count: s.count})
+}
+
+func (s *testCounterSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return nil
+}
+
+func (s *testCounterSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return nil
+}
+
+func (s *testCounterSM) Close() error { return nil }
+
+func TestClusterClientSetResult(t *testing.T) {
+	c := NewClusterClient(nil, 1, JSONCodec{})
+	var r testCounterResult
+	if err := c.setResult(testCounterResult{Count: 2}, &r); err != nil {
+		t.Fatalf("failed to set result %v", err)
+	}
+	if r.Count != 2 {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if err := c.setResult([]byte(`{"Count":3}`), &r); err != nil {
+		t.Fatalf("failed to set result %v", err)
+	}
+	if r.Count != 3 {
+		t.Errorf("unexpected result %+v", r)
+	}
+	var data []byte
+	if err := c.setResult([]byte{1, 2}, &data); err != nil || len(data) != 2 {
+		t.Errorf("failed to set []byte result, %v", err)
+	}
+	if err := c.setResult(uint64(1), &r); err != ErrInvalidResultType {
+		t.Errorf("failed to return ErrInvalidResultType, got %v", err)
+	}
+	if err := c.setResult(uint64(1), r); err != ErrInvalidResultType {
+		t.Errorf("failed to return ErrInvalidResultType, got %v", err)
+	}
+}
+
+func TestClusterClientCanProposeAndRead(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		createSM: func(uint64, uint64) sm.IStateMachine {
+			return &testCounterSM{}
+		},
+		tf: func(nh *NodeHost) {
+			c := NewClusterClient(nh, 1, JSONCodec{})
+			cs := nh.GetNoOPSession(1)
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			var r testCounterResult
+			result, err := c.SyncPropose(ctx, cs, testCounterCmd{Delta: 5}, &r)
+			if err != nil {
+				t.Fatalf("failed to propose %v", err)
+			}
+			if result.Value != 5 || r.Count != 5 {
+				t.Errorf("unexpected result %+v, %+v", result, r)
+			}
+			var lr testCounterResult
+			if err := c.SyncRead(ctx, []byte("count"), &lr); err != nil {
+				t.Fatalf("failed to read %v", err)
+			}
+			if lr.Count != 5 {
+				t.Errorf("unexpected read result %+v", lr)
+			}
+			lr = testCounterResult{}
+			if err := c.SyncRead(ctx, "count", &lr); err != nil {
+				t.Fatalf("failed to read %v", err)
+			}
+			if lr.Count != 5 {
+				t.Errorf("unexpected read result %+v", lr)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
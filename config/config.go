@@ -19,14 +19,17 @@ configurations.
 package config
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lni/goutils/netutil"
@@ -48,6 +51,13 @@ const (
 	// don't change these, see the comments on ExpertConfig.
 	defaultExecShards  uint64 = 16
 	defaultLogDBShards uint64 = 16
+	// the default max duration to wait for the SnapshotSaveHook
+	defaultSnapshotSaveHookTimeout = 30 * time.Second
+	defaultDiskUsageReportInterval = time.Minute
+	// the default interval for sampling engine queue depths when auto scaling
+	defaultEngineAutoScaleInterval = time.Second
+	// the max number of concurrent connections used for sending a snapshot
+	maxParallelSnapshotStreams = 8
 )
 
 // CompressionType is the type of the compression.
@@ -60,6 +70,92 @@ const (
 	// Snappy is the CompressionType value used to indicate that google snappy
 	// is used for data compression.
 	Snappy CompressionType = pb.Snappy
+	// Zstd is the CompressionType value used to indicate that zstd is used for
+	// data compression. It is only supported for compressing snapshots.
+	Zstd CompressionType = pb.Zstd
+)
+
+// EntryCacheAdmissionPolicy is the policy used for admitting Raft log entries
+// into the LogDB entry read cache.
+type EntryCacheAdmissionPolicy uint8
+
+const (
+	// EntryCacheAdmitAll is the EntryCacheAdmissionPolicy value used to indicate
+	// that all entries read from the underlying Key-Value store are admitted.
+	EntryCacheAdmitAll EntryCacheAdmissionPolicy = iota
+	// EntryCacheAdmitOnSecondMiss is the EntryCacheAdmissionPolicy value used to
+	// indicate that an entry is only admitted when it is read from the
+	// underlying Key-Value store for the second time within a short period,
+	// protecting cached entries from being evicted by one-off large reads.
+	EntryCacheAdmitOnSecondMiss
+)
+
+// SnapshotStreamQueuePolicy is the policy used for outgoing snapshot streams
+// that can not be immediately started as the concurrency limits specified in
+// SnapshotStreamConfig have been reached.
+type SnapshotStreamQueuePolicy uint8
+
+const (
+	// RejectSnapshotStreams is the SnapshotStreamQueuePolicy value used to
+	// indicate that such snapshot streams should be rejected, the snapshot is
+	// sent again after the rejection is handled by the Raft protocol.
+	RejectSnapshotStreams SnapshotStreamQueuePolicy = iota
+	// QueueSnapshotStreams is the SnapshotStreamQueuePolicy value used to
+	// indicate that such snapshot streams should wait in a FIFO queue until
+	// they can be started.
+	QueueSnapshotStreams
+)
+
+// ChecksumMismatchPolicy is the policy used when the payload of a committed
+// Raft entry doesn't match its checksum.
+type ChecksumMismatchPolicy uint8
+
+const (
+	// HaltOnChecksumMismatch is the ChecksumMismatchPolicy value used to
+	// indicate that the node should fail as when its state machine panics, see
+	// PanicPolicy for details.
+	HaltOnChecksumMismatch ChecksumMismatchPolicy = iota
+	// RefuseApplyOnChecksumMismatch is the ChecksumMismatchPolicy value used to
+	// indicate that the node should stop applying entries while remaining a
+	// member of the Raft cluster, it keeps replicating the Raft log and voting
+	// in elections. Reads served by the node time out as it no longer applies
+	// entries. Entries are applied again once the node is restarted.
+	RefuseApplyOnChecksumMismatch
+)
+
+// ReadBacklogPolicy is the policy used for read requests made when the apply
+// backlog of the local node exceeds Config.ReadBacklogThreshold.
+type ReadBacklogPolicy uint8
+
+const (
+	// QueueReadsOnBacklog is the ReadBacklogPolicy value used to indicate that
+	// read requests should be queued behind the apply backlog as usual.
+	QueueReadsOnBacklog ReadBacklogPolicy = iota
+	// RejectReadsOnBacklog is the ReadBacklogPolicy value used to indicate that
+	// read requests should fail fast with the ErrApplyBacklog error.
+	RejectReadsOnBacklog
+	// StaleReadsOnBacklog is the ReadBacklogPolicy value used to indicate that
+	// read requests should be served from the current state of the local state
+	// machine without the linearizability guarantee, such reads are flagged as
+	// stale.
+	StaleReadsOnBacklog
+)
+
+// PanicPolicy is the policy used when the state machine of a Raft node panics.
+type PanicPolicy uint8
+
+const (
+	// CrashOnPanic is the PanicPolicy value used to indicate that panics raised
+	// by the state machine should crash the process as usual.
+	CrashOnPanic PanicPolicy = iota
+	// StopOnPanic is the PanicPolicy value used to indicate that panics raised
+	// by the state machine should be confined to the node, the node is stopped
+	// and a NodePanicked system event is published.
+	StopOnPanic
+	// RestartOnPanic is the PanicPolicy value used to indicate that the node
+	// should be stopped as in StopOnPanic and then automatically restarted
+	// after a backoff delay.
+	RestartOnPanic
 )
 
 // Config is used to configure Raft nodes.
@@ -68,6 +164,14 @@ type Config struct {
 	NodeID uint64
 	// ClusterID is the unique value used to identify a Raft cluster.
 	ClusterID uint64
+	// ClusterName is an optional human-readable name of the Raft cluster. When
+	// set, the name is registered on the NodeHost when the node is started and
+	// it can be resolved to ClusterID using NodeHost.GetClusterID. Names are
+	// propagated to other NodeHost instances via the gossip service when
+	// NodeHostConfig.AddressByNodeHostID is enabled. The name is also included
+	// in logs and raftio.LeaderInfo notifications. The same ClusterName is
+	// expected to be used by all nodes of the Raft cluster.
+	ClusterName string
 	// CheckQuorum specifies whether the leader node should periodically check
 	// non-leader node status and step down to become a follower node when it no
 	// longer has the quorum.
@@ -114,6 +218,13 @@ type Config struct {
 	// field to 0, users can still use NodeHost's RequestSnapshot or
 	// SyncRequestSnapshot methods to manually request snapshots.
 	SnapshotEntries uint64
+	// SnapshotInterval is the maximum amount of time between two snapshots. When
+	// set to a non-zero value, a snapshot is automatically requested once
+	// SnapshotInterval has elapsed since the last snapshot was created and new
+	// entries have been applied since then, allowing clusters with few writes to
+	// still produce recent recovery points. It is checked on each Raft tick and
+	// is independent from the entry count based SnapshotEntries policy.
+	SnapshotInterval time.Duration
 	// CompactionOverhead defines the number of most recent entries to keep after
 	// each Raft log compaction. Raft log compaction is performance automatically
 	// every time when a snapshot is created.
@@ -130,6 +241,42 @@ type Config struct {
 	// back to stream the full snapshot if any Raft log entry with index <= 9,500
 	// is required to be replicated.
 	CompactionOverhead uint64
+	// CheckpointEntries defines how often a lightweight apply checkpoint should
+	// be persisted between snapshots. When set to N, the applied index and the
+	// hash value returned by the state machine's GetHash method are recorded
+	// every time an entry with an index that is a multiple of N is applied. The
+	// most recent checkpoint is persisted to disk and verified again when the
+	// same entry is re-applied after a restart, mismatched hash values indicate
+	// that the state machine is not deterministic. Such divergence is recorded
+	// in the event journal and fails the node as an apply error.
+	//
+	// CheckpointEntries is only applicable to regular state machines that
+	// implement the statemachine.IHash interface. It is ignored for on disk state
+	// machines. The default value 0 disables apply checkpoints.
+	CheckpointEntries uint64
+	// EventJournalSize is the maximum number of significant events, e.g.
+	// elections, membership changes, snapshots, compactions and failures, to be
+	// kept in the on disk event journal of the node. The event journal is kept
+	// in the snapshot directory of the node, it can be read using
+	// NodeHost.GetEventJournal even after the node is stopped. At least the most
+	// recent EventJournalSize/2 events are always available. The default value
+	// 0 disables the event journal.
+	EventJournalSize uint64
+	// CommandCaptureFile is the path of the file used for recording every
+	// command applied into the state machine together with its index, session
+	// info and result. The final hash of state machines implementing the
+	// statemachine.IHash interface is also recorded when the node is stopped.
+	// The recorded commands can be replayed against a fresh state machine
+	// instance using the tools.ReplayCommandCapture function to check whether
+	// the state machine is deterministic, i.e. it always returns the same
+	// results and ends up in the same state.
+	//
+	// CommandCaptureFile is a testing mode expected to be used by state machine
+	// authors in CI, it is not for production use. The capture file is
+	// truncated every time the node is started, captures of nodes that
+	// recovered from snapshots can not be replayed. The default value "" disables
+	// command capture.
+	CommandCaptureFile string
 	// OrderedConfigChange determines whether Raft membership change is enforced
 	// with ordered config change ID.
 	OrderedConfigChange bool
@@ -145,13 +292,46 @@ type Config struct {
 	// proposal you are going to use.
 	MaxInMemLogSize uint64
 	// SnapshotCompressionType is the compression type to use for compressing
-	// generated snapshot data. No compression is used by default.
+	// generated and streamed snapshot data. No compression is used by default.
+	// The compression type is recorded in the snapshot header, snapshots are
+	// always decompressed using the recorded compression type. Zstd compressed
+	// snapshots can not be decompressed by NodeHost instances of earlier
+	// versions, Zstd should thus only be used once all NodeHost instances in
+	// the Raft cluster have been upgraded.
 	SnapshotCompressionType CompressionType
+	// SnapshotCompressionLevel is the compression level used when
+	// SnapshotCompressionType is Zstd. It follows the zstd convention of 1
+	// (fastest) to 22 (best compression), the default value 0 means the default
+	// level of the zstd encoder is used.
+	SnapshotCompressionLevel int
 	// EntryCompressionType is the compression type to use for compressing the
 	// payload of user proposals. When Snappy is used, the maximum proposal
 	// payload allowed is roughly limited to 3.42GBytes. No compression is used
 	// by default.
 	EntryCompressionType CompressionType
+	// EntryChecksum specifies whether to protect the payload of user proposals
+	// with a CRC32 checksum. The checksum is computed when the proposal is made
+	// and stored as a part of the Raft entry, it is verified again before the
+	// entry is applied into the state machine to detect corruptions introduced
+	// after the entry is written into the LogDB, e.g. caused by faulty memory or
+	// storage. Entries with checksum are always verified before being applied,
+	// regardless of the EntryChecksum value of the local node. A corrupted entry
+	// is never skipped or applied, on checksum mismatch a ChecksumMismatch
+	// system event is published and the node then acts according to
+	// ChecksumMismatchPolicy.
+	EntryChecksum bool
+	// ChecksumMismatchPolicy is the policy used when a checksum mismatch is
+	// detected. HaltOnChecksumMismatch is used by default.
+	ChecksumMismatchPolicy ChecksumMismatchPolicy
+	// EntryTimestamp determines whether the leader should record its wall clock
+	// time into entries appended to its log. The recorded timestamp is
+	// available to state machines as the Timestamp field of statemachine.Entry,
+	// it is 0 for entries appended when EntryTimestamp is not enabled on the
+	// leader. Timestamps never decrease while the same node remains the leader,
+	// there is no such guarantee across leader changes. All nodes in the Raft
+	// cluster must be running a version of Dragonboat that supports entry
+	// timestamps before EntryTimestamp is enabled. Default value is false.
+	EntryTimestamp bool
 	// DisableAutoCompactions disables auto compaction used for reclaiming Raft
 	// log entry storage spaces. By default, compaction request is issued every
 	// time when a snapshot is created, this helps to reclaim disk spaces as
@@ -159,6 +339,26 @@ type Config struct {
 	// disable such auto compactions and use NodeHost.RequestCompaction to
 	// manually request such compactions when necessary.
 	DisableAutoCompactions bool
+	// SnapshotRetentionCount is the number of most recent snapshots to retain
+	// when older snapshots are removed after a new snapshot is created. The
+	// default of 3 is used when SnapshotRetentionCount is 0 or smaller than 3.
+	// Together with SnapshotRetentionPeriod, it allows operators to keep earlier
+	// snapshot images around, e.g. for rolling back to an earlier state after a
+	// bad state machine deployment.
+	SnapshotRetentionCount uint64
+	// SnapshotRetentionPeriod is the duration for which snapshots are retained
+	// after they are created. Snapshots newer than SnapshotRetentionPeriod are
+	// not removed even when there are more than SnapshotRetentionCount
+	// snapshots. Setting SnapshotRetentionPeriod to 0 disables such time based
+	// retention.
+	SnapshotRetentionPeriod time.Duration
+	// SnapshotWarmUpBudget is the maximum amount of time the replica waits for
+	// the state machine to complete its warm-up after being recovered from a
+	// snapshot, it only applies to state machines that implement the
+	// statemachine.IWarmUp interface. The replica does not report itself as
+	// ready or serve reads until the warm-up is completed or the budget is
+	// exhausted. Setting SnapshotWarmUpBudget to 0 means there is no such limit.
+	SnapshotWarmUpBudget time.Duration
 	// IsObserver indicates whether this is an observer Raft node without voting
 	// power. Described as non-voting members in the section 4.2.1 of Diego
 	// Ongaro's thesis, observer nodes are usually used to allow a new node to
@@ -174,12 +374,70 @@ type Config struct {
 	//
 	// Witness support is currently experimental.
 	IsWitness bool
+	// EphemeralWitness indicates whether the witness node should keep its Raft
+	// state in a purely in-memory LogDB rather than the LogDB of the NodeHost,
+	// allowing cheap tie-breaker witness nodes to run in environments without
+	// durable disks. Setting this field is an explicit acknowledgement of the
+	// durability tradeoff - the term and vote of the witness are lost once the
+	// NodeHost is restarted, restarting the witness with the same NodeID can
+	// thus break the safety of Raft leader elections. A restarted ephemeral
+	// witness must be removed from the Raft cluster and added back as a new
+	// witness with a different NodeID. EphemeralWitness can only be set when
+	// IsWitness is set.
+	EphemeralWitness bool
 	// Quiesce specifies whether to let the Raft cluster enter quiesce mode when
 	// there is no cluster activity. Clusters in quiesce mode do not exchange
 	// heartbeat messages to minimize bandwidth consumption.
 	//
 	// Quiesce support is currently experimental.
 	Quiesce bool
+	// LatencyOptimized specifies whether the Raft cluster should be run in the
+	// latency optimized mode. In this mode, Raft updates of the cluster are not
+	// batched together with updates from other Raft clusters handled by the
+	// same execution shard, they are persisted using their own fsync and they
+	// never wait for the group commit delay configured by
+	// LogDBConfig.GroupCommitMaxDelay. It trades throughput for minimum commit
+	// latency and is designed for clusters handling rare but latency critical
+	// operations, e.g. locks or leadership metadata. The mode can be changed at
+	// runtime using NodeHost's SetLatencyOptimized method.
+	LatencyOptimized bool
+	// ReadBacklogThreshold is the number of committed but not yet applied
+	// entries on the local node above which the local node is considered as
+	// having an apply backlog. Read requests made when there is such backlog
+	// are handled according to the ReadBacklogPolicy field. Setting
+	// ReadBacklogThreshold to 0 disables such backlog check.
+	ReadBacklogThreshold uint64
+	// ReadBacklogPolicy is the policy used for read requests made when there is
+	// an apply backlog as defined by the ReadBacklogThreshold field. Read
+	// requests are queued behind the backlog by default, other policies allow
+	// them to fail fast or to be served as stale reads so read latency SLOs are
+	// not silently violated.
+	ReadBacklogPolicy ReadBacklogPolicy
+	// AllowNodeIDReuse allows the node to be started even when its NodeID is
+	// known to have been removed from the Raft cluster. Each NodeHost records
+	// NodeIDs removed from Raft clusters it hosts, starting a node with such a
+	// removed NodeID is refused by default as reusing NodeIDs breaks the safety
+	// of Raft. AllowNodeIDReuse should only be set by operators who are certain
+	// that the NodeID has never been used by any member of the Raft cluster.
+	AllowNodeIDReuse bool
+	// PanicPolicy is the policy used when the state machine of the node panics
+	// when applying entries or when saving or recovering snapshots. The process
+	// crashes by default, other policies confine the failure to the node by
+	// stopping it and optionally restarting it. The in-memory state of a
+	// stopped node is discarded, it is rebuilt from the latest snapshot and the
+	// Raft log when the node is restarted. Panics raised by Lookup requests are
+	// not confined, they are raised in the goroutine making the request.
+	PanicPolicy PanicPolicy
+	// PanicRestartBackoff is the delay before a node stopped by a panic is
+	// restarted when PanicPolicy is RestartOnPanic. The delay is doubled for
+	// each consecutive panic until it reaches MaxPanicRestartBackoff, it is
+	// reset once the node runs for MaxPanicRestartBackoff without panicking.
+	// The default of 1 second is used when PanicRestartBackoff is 0.
+	PanicRestartBackoff time.Duration
+	// MaxPanicRestartBackoff is the maximum delay before a node stopped by a
+	// panic is restarted. The default of 1 minute is used when
+	// MaxPanicRestartBackoff is 0.
+	MaxPanicRestartBackoff time.Duration
 }
 
 // Validate validates the Config instance and return an error when any member
@@ -205,19 +463,59 @@ func (c *Config) Validate() error {
 		return errors.New("MaxInMemLogSize is too small")
 	}
 	if c.SnapshotCompressionType != Snappy &&
+		c.SnapshotCompressionType != Zstd &&
 		c.SnapshotCompressionType != NoCompression {
 		return errors.New("unknown compression type")
 	}
+	if c.SnapshotCompressionLevel < 0 || c.SnapshotCompressionLevel > 22 {
+		return errors.New("invalid SnapshotCompressionLevel")
+	}
 	if c.EntryCompressionType != Snappy &&
 		c.EntryCompressionType != NoCompression {
 		return errors.New("unknown compression type")
 	}
+	if c.ChecksumMismatchPolicy > RefuseApplyOnChecksumMismatch {
+		return errors.New("unknown checksum mismatch policy")
+	}
+	if c.ReadBacklogPolicy != QueueReadsOnBacklog &&
+		c.ReadBacklogPolicy != RejectReadsOnBacklog &&
+		c.ReadBacklogPolicy != StaleReadsOnBacklog {
+		return errors.New("unknown read backlog policy")
+	}
+	if c.SnapshotRetentionPeriod < 0 {
+		return errors.New("invalid SnapshotRetentionPeriod")
+	}
+	if c.SnapshotWarmUpBudget < 0 {
+		return errors.New("invalid SnapshotWarmUpBudget")
+	}
 	if c.IsWitness && c.SnapshotEntries > 0 {
 		return errors.New("witness node can not take snapshot")
 	}
+	if c.SnapshotInterval < 0 {
+		return errors.New("invalid SnapshotInterval")
+	}
+	if c.IsWitness && c.SnapshotInterval > 0 {
+		return errors.New("witness node can not take snapshot")
+	}
+	if c.IsWitness && c.CheckpointEntries > 0 {
+		return errors.New("witness node can not have apply checkpoint")
+	}
 	if c.IsWitness && c.IsObserver {
 		return errors.New("witness node can not be an observer")
 	}
+	if c.EphemeralWitness && !c.IsWitness {
+		return errors.New("only witness node can be ephemeral")
+	}
+	if c.PanicPolicy > RestartOnPanic {
+		return errors.New("invalid PanicPolicy")
+	}
+	if c.PanicRestartBackoff < 0 || c.MaxPanicRestartBackoff < 0 {
+		return errors.New("invalid panic restart backoff")
+	}
+	if c.MaxPanicRestartBackoff > 0 &&
+		c.PanicRestartBackoff > c.MaxPanicRestartBackoff {
+		return errors.New("PanicRestartBackoff > MaxPanicRestartBackoff")
+	}
 	return nil
 }
 
@@ -242,7 +540,11 @@ type NodeHostConfig struct {
 	// protection to store such WAL data. Leave WALDir to have zero value will
 	// have everything stored in NodeHostDir.
 	WALDir string
-	// NodeHostDir is where everything else is stored.
+	// NodeHostDir is where everything else is stored. NodeHostDir and WALDir
+	// record the LogDB binary version and hard settings of the NodeHost that
+	// created them, directories created by any dragonboat v3 release using the
+	// same LogDB binary version can be opened as is. NodeHost refuses to open
+	// directories with an incompatible LogDB binary version.
 	NodeHostDir string
 	// RTTMillisecond defines the average Rround Trip Time (RTT) in milliseconds
 	// between two NodeHost instances. Such a RTT interval is internally used as
@@ -278,7 +580,8 @@ type NodeHostConfig struct {
 	//
 	// Enabling AddressByNodeHostID also enables the internal gossip service,
 	// NodeHostConfig.Gossip must be configured to control the behaviors of the
-	// gossip service.
+	// gossip service. The gossip service is not used when a custom node
+	// registry is specified in the Expert.NodeRegistryFactory field.
 	//
 	// Note that once enabled, the AddressByNodeHostID setting can not be later
 	// disabled after restarts.
@@ -294,6 +597,36 @@ type NodeHostConfig struct {
 	// interfaces. When hostname or domain name is used, it will be resolved to
 	// IPv4 addresses first and Dragonboat listens to all resolved IPv4 addresses.
 	ListenAddress string
+	// Listener is an optional net.Listener used by the built-in TCP transport
+	// module for accepting incoming connections instead of listening on the
+	// ListenAddress or RaftAddress. It allows the port to be shared with other
+	// services of the application, e.g. by using a connection multiplexer such
+	// as cmux to match and route Dragonboat connections to Listener. RaftAddress
+	// is still required to be the address other NodeHost instances can use to
+	// reach the Listener. The Listener is closed when the NodeHost is stopped.
+	// ListenAddress and Listener can not be set together.
+	Listener net.Listener
+	// DialContext is an optional function used by the transport module for
+	// establishing connections to remote NodeHost instances, e.g. to connect
+	// through SOCKS or HTTP proxies, to bind to specific source addresses or to
+	// obtain connections from application managed pools. The context passed to
+	// DialContext is canceled once the dial timeout is reached. When MutualTLS
+	// is enabled, TLS is established on top of the returned connection. The
+	// default net.Dialer is used when DialContext is not set.
+	DialContext DialContextFunc
+	// PeerAddressRefreshInterval is the interval between two DNS resolutions of
+	// the hostnames of connected remote NodeHost instances. When a hostname is
+	// resolved to different IP addresses, existing connections to it are closed
+	// so new connections are made to the new IP addresses and an AddressChanged
+	// event is published, see raftio.IAddressChangedListener for details.
+	// Hostnames are always resolved again when connecting to them failed. The
+	// default value 0 disables periodic resolutions.
+	PeerAddressRefreshInterval time.Duration
+	// PeerBackoff is the backoff configuration used for retrying connections to
+	// unreachable remote NodeHost instances. A PeerHealthChanged event is
+	// published when a remote NodeHost becomes unreachable or reachable again,
+	// see raftio.IPeerHealthListener for details.
+	PeerBackoff PeerBackoffConfig
 	// MutualTLS defines whether to use mutual TLS for authenticating servers
 	// and clients. Insecure communication is used when MutualTLS is set to
 	// False.
@@ -309,6 +642,14 @@ type NodeHostConfig struct {
 	// KeyFile is the path of the node key file. This field is ignored when
 	// MutualTLS is false.
 	KeyFile string
+	// CertificateProvider is the optional provider of the certificate and the
+	// certificate authorities used for mutual TLS, it allows certificates to be
+	// rotated without restarting the NodeHost, e.g. when certificates are
+	// issued by an external service. When it is not set, the certificate and
+	// certificate authorities are loaded from the CAFile, CertFile and KeyFile
+	// files, which are checked for updates when new connections are made. This
+	// field is ignored when MutualTLS is false.
+	CertificateProvider raftio.ICertificateProvider
 	// LogDBFactory is the factory function used for creating the Log DB instance
 	// used by NodeHost. The default zero value causes the default built-in RocksDB
 	// based Log DB implementation to be used.
@@ -336,6 +677,38 @@ type NodeHostConfig struct {
 	// used for testing purposes or for other advanced usages, Dragonboat
 	// applications are not required to explicitly set this field.
 	SystemEventListener raftio.ISystemEventListener
+	// SnapshotSaveHook is invoked after each successful snapshot save, before
+	// log entries are compacted and older snapshots are removed, allowing
+	// applications to publish snapshot images to external systems. Compaction
+	// and snapshot removal are delayed until the hook returns or the
+	// SnapshotSaveHookTimeout is reached. See the raftio.ISnapshotSaveHook
+	// definition for more details.
+	SnapshotSaveHook raftio.ISnapshotSaveHook
+	// SnapshotSaveHookTimeout is the maximum duration the SnapshotSaveHook is
+	// waited for. The default value of 30 seconds is used when it is 0.
+	SnapshotSaveHookTimeout time.Duration
+	// ConfigChangeHook is invoked on leader nodes for each membership change
+	// request before it is replicated, allowing the request to be vetoed or
+	// annotated. See the raftio.IConfigChangeHook definition for more details.
+	// Vetoes of requests made on other nodes are sent back to those nodes, all
+	// nodes of the Raft cluster must be running a version of Dragonboat that
+	// supports vetoed requests before ConfigChangeHook is set.
+	ConfigChangeHook raftio.IConfigChangeHook
+	// DiskUsageListener is periodically notified with the disk usage of the
+	// NodeHost, including LogDB, snapshot and temporary snapshot directories
+	// with breakdown per Raft node, allowing external disk managers to make
+	// informed decisions. The same information is available on demand using
+	// NodeHost's GetDiskUsage method.
+	DiskUsageListener raftio.IDiskUsageListener
+	// DiskUsageReportInterval is the interval between two disk usage reports
+	// made to the DiskUsageListener. The default value of 1 minute is used when
+	// it is 0.
+	DiskUsageReportInterval time.Duration
+	// TransportMetrics is the optional listener notified with per remote
+	// NodeHost metrics of the transport module, such as message send latency,
+	// send queue length, dropped messages, reconnections and in-flight snapshot
+	// bytes. See the raftio.ITransportMetrics definition for more details.
+	TransportMetrics raftio.ITransportMetrics
 	// MaxSendQueueSize is the maximum size in bytes of each send queue.
 	// Once the maximum size is reached, further replication messages will be
 	// dropped to restrict memory usage. When set to 0, it means the send queue
@@ -346,14 +719,80 @@ type NodeHostConfig struct {
 	// dropped to restrict memory usage. When set to 0, it means the queue size
 	// is unlimited.
 	MaxReceiveQueueSize uint64
+	// MessageBatch is the configuration used for coalescing Raft messages
+	// drained from send queues into message batches sent to remote NodeHost
+	// instances.
+	MessageBatch MessageBatchConfig
 	// MaxSnapshotSendBytesPerSecond defines how much snapshot data can be sent
-	// every second for all Raft clusters managed by the NodeHost instance.
-	// The default value 0 means there is no limit set for snapshot streaming.
+	// every second for all Raft clusters managed by the NodeHost instance. The
+	// limit is shared fairly among remote NodeHost instances receiving
+	// snapshots, regardless of how many snapshot streams each of them has. The
+	// default value 0 means there is no limit set for snapshot streaming.
 	MaxSnapshotSendBytesPerSecond uint64
+	// MaxSnapshotSendBytesPerSecondPerPeer defines how much snapshot data can be
+	// sent every second to each remote NodeHost instance. It applies in addition
+	// to MaxSnapshotSendBytesPerSecond. The default value 0 means there is no
+	// per remote NodeHost limit.
+	MaxSnapshotSendBytesPerSecondPerPeer uint64
+	// PeerSnapshotSendBytesPerSecond optionally overrides the
+	// MaxSnapshotSendBytesPerSecondPerPeer value for the specified remote
+	// NodeHost instances. It is keyed by the address of the remote NodeHost,
+	// the value 0 means there is no limit for the remote NodeHost.
+	PeerSnapshotSendBytesPerSecond map[string]uint64
 	// MaxSnapshotRecvBytesPerSecond defines how much snapshot data can be
 	// received each second for all Raft clusters managed by the NodeHost instance.
 	// The default value 0 means there is no limit for receiving snapshot data.
 	MaxSnapshotRecvBytesPerSecond uint64
+	// MaxSnapshotSaveBytesPerSecond defines how much snapshot data can be written
+	// to disk each second when saving snapshots for all Raft clusters managed by
+	// the NodeHost instance. It helps to prevent large snapshots from starving
+	// LogDB fsyncs on the same disk. The default value 0 means there is no limit.
+	MaxSnapshotSaveBytesPerSecond uint64
+	// MaxReceivedSnapshotWriteBytesPerSecond defines how much received snapshot
+	// data can be written to disk each second for all Raft clusters managed by
+	// the NodeHost instance. Different from MaxSnapshotRecvBytesPerSecond which
+	// limits the network bandwidth, it limits the disk bandwidth used for
+	// writing received snapshots. The default value 0 means there is no limit.
+	MaxReceivedSnapshotWriteBytesPerSecond uint64
+	// SnapshotEncryption is the optional encryption provider used for encrypting
+	// snapshot images, including exported snapshots and snapshots streamed to
+	// remote nodes, using authenticated encryption. The ID of the key used for
+	// encrypting each snapshot image is recorded in the snapshot header, all
+	// NodeHost instances in the same Raft cluster are thus expected to be able
+	// to provide the cipher for each used key ID. The default nil value means
+	// snapshot images are not encrypted.
+	SnapshotEncryption raftio.IEncryptionProvider
+	// SnapshotStorage is the optional storage backend used for placing finalized
+	// snapshots, e.g. in object storage services such as S3, GCS or Azure Blob
+	// Storage. When set, each saved snapshot is uploaded to the storage and the
+	// local copy of older snapshots is released, released snapshots are fetched
+	// back from the storage when they are required for recovery. The default
+	// nil value means snapshots are only kept in the local snapshot directory.
+	SnapshotStorage raftio.ISnapshotStorage
+	// TransportEncryption is the optional encryption provider used for
+	// encrypting Raft messages and snapshot chunks exchanged between NodeHost
+	// instances using authenticated encryption, independent of the TLS setting
+	// of the transport module. When set, unencrypted messages and snapshot
+	// chunks received from other NodeHost instances are dropped, all NodeHost
+	// instances in the same deployment are thus expected to have it set. The
+	// default nil value means messages and snapshot chunks are not encrypted at
+	// the application layer.
+	TransportEncryption raftio.ITransportEncryptionProvider
+	// TransportCompressionType is the compression type used by the built-in TCP
+	// transport module for compressing Raft message batches sent to other
+	// NodeHost instances, e.g. to reduce cross data center bandwidth usage for
+	// replication heavy workloads. The compression type used is recorded in the
+	// header of each message, NodeHost instances with different compression
+	// settings can thus exchange messages as long as they are all running
+	// versions that support compressed messages. Small message batches, e.g.
+	// heartbeats, and batches that are not compressible are sent uncompressed.
+	// TransportCompressionType is ignored when TransportEncryption is set as
+	// encrypted message batches are not compressible. The default
+	// NoCompression value means message batches are not compressed.
+	TransportCompressionType CompressionType
+	// SnapshotStream is the concurrency configuration of snapshot streams sent
+	// and received by the NodeHost.
+	SnapshotStream SnapshotStreamConfig
 	// NotifyCommit specifies whether clients should be notified when their
 	// regular proposals and config change requests are committed. By default,
 	// commits are not notified, clients are only notified when their proposals
@@ -483,6 +922,16 @@ type TransportFactory interface {
 	Validate(string) bool
 }
 
+// NodeRegistryFactory is the interface used for creating custom node
+// registries.
+type NodeRegistryFactory interface {
+	// Create creates a node registry for the NodeHost identified by the
+	// specified NodeHostID. The TargetValidator should be used for validating
+	// targets added to the registry.
+	Create(nhid string,
+		nhConfig NodeHostConfig, v TargetValidator) (raftio.INodeRegistry, error)
+}
+
 // LogDBInfo is the info provided when LogDBCallback is invoked.
 type LogDBInfo struct {
 	Shard uint64
@@ -493,6 +942,12 @@ type LogDBInfo struct {
 // be notified for the status change of the LogDB.
 type LogDBCallback func(LogDBInfo)
 
+// DialContextFunc is the function type used for establishing connections to
+// remote NodeHost instances. Its signature matches the DialContext method of
+// net.Dialer.
+type DialContextFunc func(ctx context.Context,
+	network string, address string) (net.Conn, error)
+
 // RaftRPCFactoryFunc is the factory function that creates the transport module
 // instance for exchanging Raft messages between NodeHosts.
 //
@@ -520,7 +975,7 @@ func (c *NodeHostConfig) Validate() error {
 		(len(c.CAFile) > 0 || len(c.CertFile) > 0 || len(c.KeyFile) > 0) {
 		plog.Warningf("CAFile/CertFile/KeyFile specified when MutualTLS is disabled")
 	}
-	if c.MutualTLS {
+	if c.MutualTLS && c.CertificateProvider == nil {
 		if len(c.CAFile) == 0 {
 			return errors.New("CA file not specified")
 		}
@@ -539,15 +994,42 @@ func (c *NodeHostConfig) Validate() error {
 		c.MaxReceiveQueueSize < settings.EntryNonCmdFieldsSize+1 {
 		return errors.New("MaxReceiveSize value is too small")
 	}
+	if c.TransportCompressionType != NoCompression &&
+		c.TransportCompressionType != Snappy &&
+		c.TransportCompressionType != Zstd {
+		return errors.New("unknown transport compression type")
+	}
 	if c.RaftRPCFactory != nil && c.Expert.TransportFactory != nil {
 		return errors.New("both TransportFactory and RaftRPCFactory specified")
 	}
 	if c.LogDBFactory != nil && c.Expert.LogDBFactory != nil {
 		return errors.New("both LogDBFactory and Expert.LogDBFactory specified")
 	}
-	if c.AddressByNodeHostID && c.Gossip.IsEmpty() {
+	if c.AddressByNodeHostID && c.Gossip.IsEmpty() &&
+		c.Expert.NodeRegistryFactory == nil {
 		return errors.New("gossip service not configured")
 	}
+	if c.DiskUsageReportInterval < 0 {
+		return errors.New("invalid DiskUsageReportInterval")
+	}
+	if c.PeerAddressRefreshInterval < 0 {
+		return errors.New("invalid PeerAddressRefreshInterval")
+	}
+	if err := c.PeerBackoff.validate(); err != nil {
+		return err
+	}
+	if err := c.MessageBatch.validate(); err != nil {
+		return err
+	}
+	if c.SnapshotStream.ParallelStreams > maxParallelSnapshotStreams {
+		return errors.New("SnapshotStream.ParallelStreams is too large")
+	}
+	if len(c.SnapshotStream.PullURL) > 0 {
+		u, err := url.Parse(c.SnapshotStream.PullURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("invalid SnapshotStream.PullURL")
+		}
+	}
 	validate := c.GetRaftAddressValidator()
 	if !validate(c.RaftAddress) {
 		return errors.New("invalid NodeHost address")
@@ -555,6 +1037,9 @@ func (c *NodeHostConfig) Validate() error {
 	if len(c.ListenAddress) > 0 && !validate(c.ListenAddress) {
 		return errors.New("invalid ListenAddress")
 	}
+	if len(c.ListenAddress) > 0 && c.Listener != nil {
+		return errors.New("ListenAddress and Listener can not be set together")
+	}
 	if !c.Gossip.IsEmpty() {
 		if err := c.Gossip.Validate(); err != nil {
 			return err
@@ -565,6 +1050,11 @@ func (c *NodeHostConfig) Validate() error {
 			return err
 		}
 	}
+	if !c.Expert.Retry.IsEmpty() {
+		if err := c.Expert.Retry.Validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -630,10 +1120,21 @@ func (c *NodeHostConfig) Prepare() error {
 		plog.Infof("using default EngineConfig")
 		c.Expert.Engine = GetDefaultEngineConfig()
 	}
+	c.Expert.Engine.prepare()
 	if c.Expert.LogDB.IsEmpty() {
 		plog.Infof("using default LogDBConfig")
 		c.Expert.LogDB = GetDefaultLogDBConfig()
 	}
+	if c.Expert.Retry.IsEmpty() {
+		c.Expert.Retry = GetDefaultRetryConfig()
+	}
+	c.SnapshotStream.prepare()
+	if c.SnapshotSaveHook != nil && c.SnapshotSaveHookTimeout == 0 {
+		c.SnapshotSaveHookTimeout = defaultSnapshotSaveHookTimeout
+	}
+	if c.DiskUsageListener != nil && c.DiskUsageReportInterval == 0 {
+		c.DiskUsageReportInterval = defaultDiskUsageReportInterval
+	}
 	if c.RaftRPCFactory != nil && c.Expert.TransportFactory == nil {
 		c.Expert.TransportFactory = &defaultTransport{factory: c.RaftRPCFactory}
 		c.RaftRPCFactory = nil
@@ -645,6 +1146,133 @@ func (c *NodeHostConfig) Prepare() error {
 	return nil
 }
 
+// MessageBatchConfig is the configuration used for coalescing Raft messages
+// into message batches. Larger batches reduce the number of syscalls and
+// network packets at the cost of higher replication latency. Latency critical
+// messages, such as heartbeats and votes, are never delayed.
+type MessageBatchConfig struct {
+	// MaxDelay is the maximum amount of time to wait for more messages to be
+	// added to a message batch before it is sent. The default value 0 means
+	// message batches are sent as soon as there is no more queued messages.
+	MaxDelay time.Duration
+	// MaxBytes is the maximum total size in bytes of messages in a message
+	// batch, a single message larger than MaxBytes is sent in its own batch.
+	// The default value of 64MBytes is used when it is 0, it can not be set to
+	// a value larger than the default value.
+	MaxBytes uint64
+	// MaxCount is the maximum number of messages in a message batch. The
+	// default value 0 means there is no limit on the number of messages.
+	MaxCount uint64
+}
+
+func (c *MessageBatchConfig) validate() error {
+	if c.MaxDelay < 0 {
+		return errors.New("invalid MessageBatch.MaxDelay")
+	}
+	if c.MaxBytes > settings.MaxMessageBatchSize {
+		return errors.New("MessageBatch.MaxBytes is too large")
+	}
+	return nil
+}
+
+// PeerBackoffConfig is the configuration of the exponential backoff used for
+// retrying connections to remote NodeHost instances. Each remote NodeHost has
+// its own circuit breaker, once a connection to it failed, further messages to
+// it are dropped until the backoff interval has elapsed. The backoff interval
+// grows after each consecutive failure and it is reset once connected.
+type PeerBackoffConfig struct {
+	// InitialInterval is the backoff interval after the first failure. The
+	// default value of 500 milliseconds is used when it is 0.
+	InitialInterval time.Duration
+	// MaxInterval is the maximum backoff interval. It should be shorter than
+	// the election timeout of Raft clusters to avoid disrupting restarted
+	// remote nodes that haven't heard from their leaders. The default value of
+	// 1 second is used when it is 0.
+	MaxInterval time.Duration
+	// Multiplier is the factor used for growing the backoff interval after
+	// each consecutive failure. The default value 1.5 is used when it is 0.
+	Multiplier float64
+	// Jitter is the randomization factor applied to each backoff interval, a
+	// value of 0.5 means each interval is randomly chosen between 50% and 150%
+	// of its nominal value. The default value 0.5 is used when it is 0, use a
+	// negative value to disable jitter.
+	Jitter float64
+}
+
+func (c *PeerBackoffConfig) validate() error {
+	if c.InitialInterval < 0 || c.MaxInterval < 0 {
+		return errors.New("invalid PeerBackoff interval")
+	}
+	if c.MaxInterval > 0 && c.InitialInterval > c.MaxInterval {
+		return errors.New("PeerBackoff.InitialInterval > PeerBackoff.MaxInterval")
+	}
+	if c.Multiplier != 0 && c.Multiplier < 1 {
+		return errors.New("invalid PeerBackoff.Multiplier")
+	}
+	if c.Jitter > 1 {
+		return errors.New("invalid PeerBackoff.Jitter")
+	}
+	return nil
+}
+
+// SnapshotStreamConfig is the configuration for limiting the number of
+// concurrent snapshot streams of a NodeHost. Dense NodeHosts with many Raft
+// clusters may need to tune these limits to avoid saturating the disk and the
+// network when many Raft clusters require snapshots at the same time.
+type SnapshotStreamConfig struct {
+	// MaxOutgoing is the maximum number of concurrent outgoing snapshot streams
+	// of the NodeHost. The default value 64 is used when it is 0.
+	MaxOutgoing uint64
+	// MaxOutgoingPerPeer is the maximum number of concurrent outgoing snapshot
+	// streams to each remote NodeHost. The default value 0 means there is no per
+	// peer limit.
+	MaxOutgoingPerPeer uint64
+	// MaxIncoming is the maximum number of concurrent incoming snapshot streams
+	// of the NodeHost, further incoming snapshot streams are dropped. The
+	// default value 128 is used when it is 0.
+	MaxIncoming uint64
+	// QueuePolicy is the policy used for outgoing snapshot streams that can not
+	// be started because of the MaxOutgoing or MaxOutgoingPerPeer limits.
+	// RejectSnapshotStreams is used by default.
+	QueuePolicy SnapshotStreamQueuePolicy
+	// MaxQueued is the maximum number of outgoing snapshot streams allowed to
+	// wait in the queue when the QueuePolicy is QueueSnapshotStreams, further
+	// snapshot streams are rejected. The MaxOutgoing value is used when it is
+	// 0.
+	MaxQueued uint64
+	// ParallelStreams is the number of concurrent connections used for sending
+	// each snapshot to a remote NodeHost, it helps to better utilize links with
+	// high bandwidth-delay product when sending large snapshots. Snapshot chunks
+	// are reordered by the receiver, which buffers up to 64 out of order chunks
+	// for each snapshot. Snapshots streamed by on disk state machines are always
+	// sent using a single connection. The default value 0 means a single
+	// connection is used for each snapshot, the maximum allowed value is 8.
+	ParallelStreams uint64
+	// PullURL is the URL at which the http.Handler returned by the
+	// NodeHost.SnapshotFileHandler method is served by the application. When
+	// PullURL is set, snapshots are sent to remote NodeHosts as manifests that
+	// only describe the snapshot files, receivers pull those files over HTTP(S)
+	// with range requests, which allows interrupted transfers to be resumed and
+	// snapshot files to be served via proxies. Snapshots streamed by on disk
+	// state machines and snapshots of witness nodes are always pushed. PullURL
+	// should only be set when all NodeHosts in the deployment support pulling
+	// snapshot files, older NodeHosts can not handle such manifests. The
+	// default empty value means snapshot files are pushed in chunks.
+	PullURL string
+}
+
+func (c *SnapshotStreamConfig) prepare() {
+	if c.MaxOutgoing == 0 {
+		c.MaxOutgoing = settings.Soft.MaxSnapshotConnections
+	}
+	if c.MaxIncoming == 0 {
+		c.MaxIncoming = settings.Soft.MaxConcurrentStreamingSnapshot
+	}
+	if c.QueuePolicy == QueueSnapshotStreams && c.MaxQueued == 0 {
+		c.MaxQueued = c.MaxOutgoing
+	}
+}
+
 // GetListenAddress returns the actual address the transport module is going to
 // listen on.
 func (c *NodeHostConfig) GetListenAddress() string {
@@ -658,7 +1286,7 @@ func (c *NodeHostConfig) GetListenAddress() string {
 // TLS settings in NodeHostConfig.
 func (c *NodeHostConfig) GetServerTLSConfig() (*tls.Config, error) {
 	if c.MutualTLS {
-		return netutil.GetServerTLSConfig(c.CAFile, c.CertFile, c.KeyFile)
+		return getServerTLSConfig(c.getCertificateProvider())
 	}
 	return nil, nil
 }
@@ -667,24 +1295,22 @@ func (c *NodeHostConfig) GetServerTLSConfig() (*tls.Config, error) {
 // target based on the TLS settings in NodeHostConfig.
 func (c *NodeHostConfig) GetClientTLSConfig(target string) (*tls.Config, error) {
 	if c.MutualTLS {
-		tlsConfig, err := netutil.GetClientTLSConfig("",
-			c.CAFile, c.CertFile, c.KeyFile)
-		if err != nil {
-			return nil, err
-		}
 		host, err := netutil.GetHost(target)
 		if err != nil {
 			return nil, err
 		}
-		return &tls.Config{
-			ServerName:   host,
-			Certificates: tlsConfig.Certificates,
-			RootCAs:      tlsConfig.RootCAs,
-		}, nil
+		return getClientTLSConfig(c.getCertificateProvider(), host)
 	}
 	return nil, nil
 }
 
+func (c *NodeHostConfig) getCertificateProvider() raftio.ICertificateProvider {
+	if c.CertificateProvider != nil {
+		return c.CertificateProvider
+	}
+	return NewFileCertificateProvider(c.CAFile, c.CertFile, c.KeyFile)
+}
+
 // GetDeploymentID returns the deployment ID to be used.
 func (c *NodeHostConfig) GetDeploymentID() uint64 {
 	if c.DeploymentID == 0 {
@@ -701,7 +1327,7 @@ func (c *NodeHostConfig) GetTargetValidator() TargetValidator {
 	} else if c.Expert.TransportFactory != nil {
 		return c.Expert.TransportFactory.Validate
 	}
-	return stringutil.IsValidAddress
+	return isValidAddressOrSRV
 }
 
 // GetRaftAddressValidator creates a RaftAddressValidator based on the specified
@@ -719,6 +1345,40 @@ func IsValidAddress(addr string) bool {
 	return stringutil.IsValidAddress(addr)
 }
 
+// SRVAddressPrefix is the prefix of addresses specified as DNS SRV names, e.g.
+// srv://_raft._tcp.example.com. Such addresses are resolved into the host and
+// port values of their SRV records, DNS SRV names are periodically queried
+// again so changed records are picked up.
+const SRVAddressPrefix = "srv://"
+
+// IsSRVAddress returns a boolean value indicating whether the input address is
+// a DNS SRV name prefixed with SRVAddressPrefix.
+func IsSRVAddress(addr string) bool {
+	if !strings.HasPrefix(addr, SRVAddressPrefix) {
+		return false
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(addr, SRVAddressPrefix), ".")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+				!(c >= '0' && c <= '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isValidAddressOrSRV(addr string) bool {
+	return stringutil.IsValidAddress(addr) || IsSRVAddress(addr)
+}
+
 // LogDBConfig is the configuration object for the LogDB storage engine. This
 // config option is only for advanced users when tuning the balance of I/O
 // performance and memory consumption.
@@ -750,6 +1410,66 @@ type LogDBConfig struct {
 	KVBlockSize                        uint64
 	SaveBufferSize                     uint64
 	MaxSaveBufferSize                  uint64
+	// EntryCompressionThreshold is the minimum size in bytes of a marshaled
+	// entry batch for it to be compressed using zstd before being written into
+	// the underlying Key-Value store. Entry batches are never compressed when
+	// it is 0, which is the default. It can be changed at any time as the
+	// compression codec is recorded with each stored entry batch.
+	EntryCompressionThreshold uint64
+	// PerClusterInstance determines whether each Raft cluster should be given
+	// its own LogDB instance stored in its own directory, rather than having
+	// all Raft clusters hashed across the fixed number of LogDB shards. This
+	// prevents compactions and write stalls caused by one busy Raft cluster
+	// from affecting other Raft clusters and allows the disk usage of each Raft
+	// cluster to be measured and limited, e.g. using file system quotas. The
+	// Shards field is ignored when PerClusterInstance is set, KV* options
+	// apply to each per cluster instance and should be adjusted accordingly to
+	// limit the total memory usage. This option can not be changed once the
+	// NodeHost has been started with data stored in its LogDB.
+	PerClusterInstance bool
+	// EntryCacheSize is the maximum total size in bytes of Raft log entries
+	// kept in the LogDB entry read cache. Entries read from the underlying
+	// Key-Value store, e.g. when replicating to lagging followers, are cached
+	// so repeated reads can be served from memory. The entry read cache is
+	// disabled when EntryCacheSize is 0, which is the default. When the
+	// PerClusterInstance option is set, each per cluster instance has its own
+	// entry read cache of the specified size.
+	EntryCacheSize uint64
+	// EntryCacheShards is the number of shards of the entry read cache, the
+	// EntryCacheSize is evenly split across all shards and entries of each Raft
+	// node are always cached on the same shard. Default value is 16.
+	EntryCacheShards uint64
+	// EntryCacheAdmission is the policy used for deciding whether entries read
+	// from the underlying Key-Value store should be admitted into the entry
+	// read cache. Default value is EntryCacheAdmitAll.
+	EntryCacheAdmission EntryCacheAdmissionPolicy
+	// GroupCommitMaxDelay is the maximum time to wait for Raft state saved
+	// concurrently by other execution shards mapped to the same LogDB shard, so
+	// they can be written into the underlying Key-Value store using a single
+	// write batch and a single fsync. A larger value improves write throughput
+	// when many execution shards share a LogDB shard at the cost of higher
+	// write latency. Group commit is disabled when GroupCommitMaxDelay is 0,
+	// which is the default, Raft state is then immediately written by each
+	// execution shard.
+	GroupCommitMaxDelay time.Duration
+	// GroupCommitMaxBytes is the maximum total size in bytes of Raft entries
+	// to be coalesced into a single group commit, the group is immediately
+	// written without waiting for GroupCommitMaxDelay once the limit is
+	// reached. There is no size limit when GroupCommitMaxBytes is 0, which is
+	// the default. GroupCommitMaxBytes is ignored when GroupCommitMaxDelay is 0.
+	GroupCommitMaxBytes uint64
+	// MaxCompactionBytesPerSecond is the maximum number of bytes of removed Raft
+	// Log entries per second to be compacted by the LogDB compaction workers,
+	// it helps to avoid compactions issued after snapshots to saturate the disk
+	// IO and cause proposal latency spikes. The size of removed entries is
+	// estimated when they are removed, which requires them to be scanned once.
+	// There is no rate limit when MaxCompactionBytesPerSecond is 0, which is the
+	// default.
+	MaxCompactionBytesPerSecond uint64
+	// MaxConcurrentCompactions is the maximum number of LogDB compactions that
+	// can run concurrently. One compaction is run at a time when
+	// MaxConcurrentCompactions is 0, which is the default.
+	MaxConcurrentCompactions uint64
 }
 
 // GetDefaultLogDBConfig returns the default configurations for the LogDB
@@ -850,6 +1570,36 @@ type EngineConfig struct {
 	// CloseShards is the number of close shards used for closing stopped
 	// state machines. Default value is 32.
 	CloseShards uint64
+	// ProfilerLabels indicates whether engine worker goroutines and Lookup
+	// invocations made by SyncRead, SyncReadOrStale, SyncReadAfter and
+	// BoundedStaleRead should be tagged with pprof labels. When enabled, CPU and
+	// blocking profiles can be attributed to specific Raft clusters using the
+	// clusterid and nodeid labels and to specific pipeline stages using the
+	// stage label. Default value is false.
+	ProfilerLabels bool
+	// ExecWorkers is the initial number of worker goroutines handling the
+	// ExecShards execution shards. It can be changed at runtime using
+	// NodeHost.SetEngineWorkers but it can never exceed ExecShards. Default
+	// value 0 means one worker per execution shard.
+	ExecWorkers uint64
+	// CommitWorkers is the initial number of worker goroutines handling the
+	// CommitShards commit shards, it can never exceed CommitShards. Default
+	// value 0 means one worker per commit shard.
+	CommitWorkers uint64
+	// ApplyWorkers is the initial number of worker goroutines handling the
+	// ApplyShards apply shards, it can never exceed ApplyShards. Default value
+	// 0 means one worker per apply shard.
+	ApplyWorkers uint64
+	// AutoScale indicates whether the number of execution, commit and apply
+	// workers should be automatically adjusted based on the number of Raft
+	// clusters waiting to be handled. The number of workers is doubled when
+	// there are more waiting Raft clusters than workers and halved after ten
+	// consecutive samples with no waiting Raft cluster. The shards values
+	// above are the upper limits. Default value is false.
+	AutoScale bool
+	// AutoScaleInterval is the interval between two samples taken when
+	// AutoScale is enabled. Default value is one second.
+	AutoScaleInterval time.Duration
 }
 
 // GetDefaultEngineConfig returns the default EngineConfig instance.
@@ -875,6 +1625,72 @@ func (ec EngineConfig) Validate() error {
 		ec.SnapshotShards == 0 || ec.CloseShards == 0 {
 		return errors.New("invalid engine configuration")
 	}
+	if ec.ExecWorkers > ec.ExecShards || ec.CommitWorkers > ec.CommitShards ||
+		ec.ApplyWorkers > ec.ApplyShards {
+		return errors.New("engine workers more than shards")
+	}
+	return nil
+}
+
+func (ec *EngineConfig) prepare() {
+	if ec.AutoScale && ec.AutoScaleInterval == 0 {
+		ec.AutoScaleInterval = defaultEngineAutoScaleInterval
+	}
+}
+
+// RetryConfig is the policy used by NodeHost when retrying requests
+// internally, e.g. when adding members in the BootstrapCoordinator. The
+// deadline of the caller's context is split into per attempt budgets, failed
+// attempts are followed by exponential backoffs with jitter.
+type RetryConfig struct {
+	// MaxAttempts is the max number of attempts, 0 means attempts are made
+	// until the deadline of the caller's context is reached.
+	MaxAttempts uint64
+	// MinAttemptTimeout is the minimum time budget of each attempt. The
+	// remaining time is evenly split among remaining attempts, each attempt
+	// gets at least MinAttemptTimeout when the remaining time allows.
+	MinAttemptTimeout time.Duration
+	// MaxAttemptTimeout is the maximum time budget of each attempt. It is also
+	// the budget of each attempt when the caller's context has no deadline.
+	MaxAttemptTimeout time.Duration
+	// InitialBackoff is the backoff after the first failed attempt, backoff is
+	// doubled after each subsequent failed attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum backoff between attempts.
+	MaxBackoff time.Duration
+	// BackoffJitter is the fraction of each backoff to be randomly added or
+	// subtracted, it must be within [0, 1].
+	BackoffJitter float64
+}
+
+// GetDefaultRetryConfig returns the default RetryConfig instance.
+func GetDefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MinAttemptTimeout: 500 * time.Millisecond,
+		MaxAttemptTimeout: 5 * time.Second,
+		InitialBackoff:    50 * time.Millisecond,
+		MaxBackoff:        2 * time.Second,
+		BackoffJitter:     0.2,
+	}
+}
+
+// IsEmpty returns a boolean value indicating whether RetryConfig is an empty
+// one.
+func (rc RetryConfig) IsEmpty() bool {
+	return reflect.DeepEqual(&rc, &RetryConfig{})
+}
+
+// Validate return an error value when the RetryConfig is invalid.
+func (rc RetryConfig) Validate() error {
+	if rc.MinAttemptTimeout <= 0 || rc.MaxAttemptTimeout < rc.MinAttemptTimeout {
+		return errors.New("invalid attempt timeout")
+	}
+	if rc.InitialBackoff <= 0 || rc.MaxBackoff < rc.InitialBackoff {
+		return errors.New("invalid backoff")
+	}
+	if rc.BackoffJitter < 0 || rc.BackoffJitter > 1 {
+		return errors.New("invalid backoff jitter")
+	}
 	return nil
 }
 
@@ -883,6 +1699,7 @@ func GetDefaultExpertConfig() ExpertConfig {
 	return ExpertConfig{
 		Engine: GetDefaultEngineConfig(),
 		LogDB:  getDefaultLogDBConfig(),
+		Retry:  GetDefaultRetryConfig(),
 	}
 }
 
@@ -898,6 +1715,11 @@ type ExpertConfig struct {
 	// transport module to be used by dragonbaot. When not set, the built-in TCP
 	// transport module is used.
 	TransportFactory TransportFactory
+	// NodeRegistryFactory is an optional factory type used for creating the
+	// custom node registry used for resolving Raft nodes to network addresses.
+	// When not set, the built-in gossip based registry is used when
+	// AddressByNodeHostID is enabled, targets are used as addresses otherwise.
+	NodeRegistryFactory NodeRegistryFactory
 	// Engine is the cponfiguration for the execution engine.
 	Engine EngineConfig
 	// LogDB contains configuration options for the LogDB storage engine. LogDB
@@ -905,6 +1727,15 @@ type ExpertConfig struct {
 	// by advanced users for tuning the balance of I/O performance, memory and
 	// disk usages.
 	LogDB LogDBConfig
+	// Retry is the policy used when retrying requests internally.
+	Retry RetryConfig
+	// RequestStateLeakDetection enables tracking of RequestState instances
+	// returned by asynchronous request methods. When enabled, the creation stack
+	// of each RequestState instance is recorded until it is released, unreleased
+	// instances can be listed using NodeHost's GetUnreleasedRequestStates method
+	// and are reported when the NodeHost is stopped. This option is expensive
+	// and is expected to be used for debugging purposes only.
+	RequestStateLeakDetection bool
 	// FS is the filesystem instance used in tests.
 	FS IFS
 	// TestNodeHostID is the NodeHostID value to be used by the NodeHost instance.
@@ -936,13 +1767,39 @@ type GossipConfig struct {
 	// NodeHost instance will try to contact all of them to bootstrap the gossip
 	// service. At least one reachable NodeHost instance is required to
 	// successfully bootstrap the gossip service. Each seed address is in the
-	// format of IP:Port, Hostname:Port or DNS Name:Port.
+	// format of IP:Port, Hostname:Port or DNS Name:Port. A seed address can also
+	// be a DNS SRV name in the format of srv://Name, it is expanded into the
+	// addresses of all its SRV records each time the seed list is contacted.
 	//
 	// It is ok to include seed addresses that are temporarily unreachable, e.g.
 	// when launching the first NodeHost instance in your deployment, you can
 	// include AdvertiseAddresses from other NodeHost instances that you plan to
 	// launch shortly afterwards.
+	//
+	// The seed list can be updated at runtime using the UpdateGossipSeed method
+	// of the NodeHost.
 	Seed []string
+	// SeedRefreshInterval is the interval at which the local gossip service
+	// contacts all seed addresses again even when it is already connected to
+	// the gossip group. Hostnames and DNS names in the seed list are resolved
+	// again each time, this allows long running NodeHost instances to discover
+	// new seed nodes behind existing DNS names after the original seed nodes
+	// have all been replaced. Setting SeedRefreshInterval to 0 disables such
+	// periodic refresh.
+	SeedRefreshInterval time.Duration
+	// EncryptionKeys is the optional list of keys used for encrypting gossip
+	// messages. The first key is the primary key used for encrypting outgoing
+	// messages, all keys are tried when decrypting incoming messages. Each key
+	// must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+	// Gossip messages are not encrypted when EncryptionKeys is empty.
+	//
+	// Keys can be rotated without restarting NodeHost instances. Install the
+	// new key on all NodeHost instances using the AddGossipEncryptionKey method
+	// of the NodeHost, make it the primary key on all of them using the
+	// UseGossipEncryptionKey method, then remove the old key using the
+	// RemoveGossipEncryptionKey method. EncryptionKeys should be updated
+	// accordingly so restarted NodeHost instances use the new key.
+	EncryptionKeys [][]byte
 }
 
 // IsEmpty returns a boolean flag indicating whether the GossipConfig instance
@@ -970,16 +1827,28 @@ func (g *GossipConfig) Validate() error {
 		if v != g.BindAddress && v != g.AdvertiseAddress {
 			count++
 		}
-		if !stringutil.IsValidAddress(v) {
+		if !isValidAddressOrSRV(v) {
 			return errors.New("invalid GossipConfig.Seed value")
 		}
 	}
 	if count == 0 {
 		return errors.New("no valid seed node")
 	}
+	for _, key := range g.EncryptionKeys {
+		if !IsValidGossipEncryptionKey(key) {
+			return errors.New("invalid GossipConfig.EncryptionKeys value")
+		}
+	}
 	return nil
 }
 
+// IsValidGossipEncryptionKey returns a boolean value indicating whether the
+// specified key can be used for encrypting gossip messages.
+func IsValidGossipEncryptionKey(key []byte) bool {
+	l := len(key)
+	return l == 16 || l == 24 || l == 32
+}
+
 func isValidAdvertiseAddress(addr string) bool {
 	host, sp, err := net.SplitHostPort(addr)
 	if err != nil {
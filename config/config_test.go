@@ -15,9 +15,12 @@
 package config
 
 import (
+	"net"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/lni/dragonboat/v3/internal/settings"
 	"github.com/lni/dragonboat/v3/raftio"
 )
 
@@ -120,6 +123,40 @@ func TestWitnessCanNotTakeSnapshot(t *testing.T) {
 	}
 }
 
+func TestOnlyWitnessCanBeEphemeral(t *testing.T) {
+	cfg := Config{NodeID: 1, HeartbeatRTT: 1, ElectionRTT: 10,
+		EphemeralWitness: true}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("non-witness node can not be ephemeral")
+	}
+	cfg.IsWitness = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("ephemeral witness rejected, %v", err)
+	}
+}
+
+func TestPanicPolicyIsValidated(t *testing.T) {
+	cfg := Config{NodeID: 1, HeartbeatRTT: 1, ElectionRTT: 10,
+		PanicPolicy: RestartOnPanic}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("valid panic policy rejected, %v", err)
+	}
+	cfg.PanicPolicy = RestartOnPanic + 1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("invalid panic policy not rejected")
+	}
+	cfg.PanicPolicy = StopOnPanic
+	cfg.PanicRestartBackoff = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("negative backoff not rejected")
+	}
+	cfg.PanicRestartBackoff = 2 * time.Second
+	cfg.MaxPanicRestartBackoff = time.Second
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("backoff larger than max backoff not rejected")
+	}
+}
+
 func TestLogDBConfigIsEmpty(t *testing.T) {
 	cfg := LogDBConfig{}
 	if !cfg.IsEmpty() {
@@ -171,6 +208,138 @@ func TestTransportFactoryAndModuleCanNotBeSetTogether(t *testing.T) {
 	}
 }
 
+func TestListenAddressAndListenerCanNotBeSetTogether(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen %v", err)
+	}
+	defer ln.Close()
+	c := NodeHostConfig{
+		RaftAddress:    "localhost:9010",
+		RTTMillisecond: 100,
+		NodeHostDir:    "/data",
+		Listener:       ln,
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("cfg not valid")
+	}
+	c.ListenAddress = "localhost:9010"
+	if err := c.Validate(); err == nil {
+		t.Fatalf("cfg not considered as invalid")
+	}
+}
+
+func TestMessageBatchIsValidated(t *testing.T) {
+	c := NodeHostConfig{
+		RaftAddress:    "localhost:9010",
+		RTTMillisecond: 100,
+		NodeHostDir:    "/data",
+		MessageBatch: MessageBatchConfig{
+			MaxDelay: time.Millisecond,
+			MaxBytes: 1024,
+			MaxCount: 16,
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("cfg not valid, %v", err)
+	}
+	c.MessageBatch.MaxDelay = -1
+	if err := c.Validate(); err == nil {
+		t.Fatalf("negative MaxDelay not rejected")
+	}
+	c.MessageBatch.MaxDelay = 0
+	c.MessageBatch.MaxBytes = settings.MaxMessageBatchSize + 1
+	if err := c.Validate(); err == nil {
+		t.Fatalf("large MaxBytes not rejected")
+	}
+}
+
+func TestParallelSnapshotStreamsIsLimited(t *testing.T) {
+	c := NodeHostConfig{
+		RaftAddress:    "localhost:9010",
+		RTTMillisecond: 100,
+		NodeHostDir:    "/data",
+	}
+	c.SnapshotStream.ParallelStreams = maxParallelSnapshotStreams
+	if err := c.Validate(); err != nil {
+		t.Fatalf("cfg not valid, %v", err)
+	}
+	c.SnapshotStream.ParallelStreams = maxParallelSnapshotStreams + 1
+	if err := c.Validate(); err == nil {
+		t.Fatalf("too many parallel streams not rejected")
+	}
+}
+
+func TestSnapshotPullURLIsValidated(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"", true},
+		{"http://localhost:8080/snapshots", true},
+		{"https://localhost/snapshots", true},
+		{"localhost:8080", false},
+		{"ftp://localhost/snapshots", false},
+	}
+	for idx, tt := range tests {
+		c := NodeHostConfig{
+			RaftAddress:    "localhost:9010",
+			RTTMillisecond: 100,
+			NodeHostDir:    "/data",
+		}
+		c.SnapshotStream.PullURL = tt.url
+		if err := c.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%d, unexpected result %v", idx, err)
+		}
+	}
+}
+
+func TestPeerBackoffIsValidated(t *testing.T) {
+	tests := []struct {
+		cfg   PeerBackoffConfig
+		valid bool
+	}{
+		{PeerBackoffConfig{}, true},
+		{PeerBackoffConfig{InitialInterval: time.Second, MaxInterval: time.Minute}, true},
+		{PeerBackoffConfig{InitialInterval: time.Minute, MaxInterval: time.Second}, false},
+		{PeerBackoffConfig{InitialInterval: -1}, false},
+		{PeerBackoffConfig{MaxInterval: -1}, false},
+		{PeerBackoffConfig{Multiplier: 2}, true},
+		{PeerBackoffConfig{Multiplier: 0.5}, false},
+		{PeerBackoffConfig{Jitter: -1}, true},
+		{PeerBackoffConfig{Jitter: 1.5}, false},
+	}
+	for idx, tt := range tests {
+		c := NodeHostConfig{
+			RaftAddress:    "localhost:9010",
+			RTTMillisecond: 100,
+			NodeHostDir:    "/data",
+			PeerBackoff:    tt.cfg,
+		}
+		if err := c.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%d, valid %t, want %t", idx, err == nil, tt.valid)
+		}
+	}
+}
+
+func TestTransportCompressionTypeIsValidated(t *testing.T) {
+	c := NodeHostConfig{
+		RaftAddress:    "localhost:9010",
+		RTTMillisecond: 100,
+		NodeHostDir:    "/data",
+	}
+	for _, ct := range []CompressionType{NoCompression, Snappy, Zstd} {
+		c.TransportCompressionType = ct
+		if err := c.Validate(); err != nil {
+			t.Fatalf("cfg not valid, %v", err)
+		}
+	}
+	c.TransportCompressionType = CompressionType(100)
+	if err := c.Validate(); err == nil {
+		t.Fatalf("cfg not considered as invalid")
+	}
+}
+
 func TestLogDBFactoryAndExpertLogDBFactoryCanNotBeSetTogether(t *testing.T) {
 	f := func(NodeHostConfig,
 		LogDBCallback, []string, []string) (raftio.ILogDB, error) {
@@ -213,6 +382,85 @@ func TestGossipMustBeConfiguredWhenAddressByNodeHostID(t *testing.T) {
 	}
 }
 
+type testNodeRegistryFactory struct{}
+
+func (testNodeRegistryFactory) Create(nhid string,
+	nhConfig NodeHostConfig, v TargetValidator) (raftio.INodeRegistry, error) {
+	return nil, nil
+}
+
+func TestGossipIsNotRequiredWhenNodeRegistryFactoryIsSet(t *testing.T) {
+	c := NodeHostConfig{
+		RaftAddress:         "localhost:9010",
+		RTTMillisecond:      100,
+		NodeHostDir:         "/data",
+		AddressByNodeHostID: true,
+	}
+	if err := c.Validate(); err == nil {
+		t.Fatalf("unexpectedly considreed as valid config")
+	}
+	c.Expert.NodeRegistryFactory = testNodeRegistryFactory{}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("invalid config, %v", err)
+	}
+}
+
+func TestIsSRVAddress(t *testing.T) {
+	tests := []struct {
+		addr  string
+		valid bool
+	}{
+		{"srv://_raft._tcp.example.com", true},
+		{"srv://_raft._tcp.example.com.", true},
+		{"srv://example", true},
+		{"srv://", false},
+		{"srv://_raft._tcp.example.com:9000", false},
+		{"srv://_raft.._tcp.example.com", false},
+		{"srv://_raft/_tcp", false},
+		{"_raft._tcp.example.com", false},
+		{"localhost:9000", false},
+	}
+	for idx, tt := range tests {
+		if v := IsSRVAddress(tt.addr); v != tt.valid {
+			t.Errorf("%d, %s, got %t, want %t", idx, tt.addr, v, tt.valid)
+		}
+	}
+}
+
+func TestSRVAddressCanBeUsedAsTargetAndSeed(t *testing.T) {
+	c := NodeHostConfig{
+		RaftAddress:    "localhost:9010",
+		RTTMillisecond: 100,
+		NodeHostDir:    "/data",
+	}
+	if !c.GetTargetValidator()("srv://_raft._tcp.example.com") {
+		t.Errorf("SRV target rejected")
+	}
+	c.AddressByNodeHostID = true
+	c.Gossip = GossipConfig{
+		BindAddress: "localhost:12345",
+		Seed:        []string{"srv://_gossip._udp.example.com"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("SRV seed rejected, %v", err)
+	}
+}
+
+func TestGossipEncryptionKeysAreValidated(t *testing.T) {
+	gc := GossipConfig{
+		BindAddress:    "localhost:12345",
+		Seed:           []string{"localhost:23456"},
+		EncryptionKeys: [][]byte{make([]byte, 32), make([]byte, 16)},
+	}
+	if err := gc.Validate(); err != nil {
+		t.Fatalf("valid keys rejected, %v", err)
+	}
+	gc.EncryptionKeys = append(gc.EncryptionKeys, make([]byte, 20))
+	if err := gc.Validate(); err == nil {
+		t.Errorf("invalid key not rejected")
+	}
+}
+
 func TestGossipConfigIsEmtpy(t *testing.T) {
 	gc := &GossipConfig{}
 	if !gc.IsEmpty() {
@@ -294,3 +542,131 @@ func TestDefaultEngineConfig(t *testing.T) {
 		t.Errorf("default engine configure not set")
 	}
 }
+
+func TestEngineWorkersCanNotExceedShards(t *testing.T) {
+	ec := GetDefaultEngineConfig()
+	ec.ApplyWorkers = ec.ApplyShards
+	if err := ec.Validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	ec.ApplyWorkers = ec.ApplyShards + 1
+	if err := ec.Validate(); err == nil {
+		t.Errorf("failed to return error")
+	}
+}
+
+func TestEngineAutoScaleIntervalIsSet(t *testing.T) {
+	nhc := &NodeHostConfig{}
+	nhc.Expert.Engine = GetDefaultEngineConfig()
+	nhc.Expert.Engine.AutoScale = true
+	if err := nhc.Prepare(); err != nil {
+		t.Errorf("prepare failed, %v", err)
+	}
+	if nhc.Expert.Engine.AutoScaleInterval != defaultEngineAutoScaleInterval {
+		t.Errorf("auto scale interval not set")
+	}
+}
+
+func TestDefaultRetryConfig(t *testing.T) {
+	nhc := &NodeHostConfig{}
+	if err := nhc.Prepare(); err != nil {
+		t.Errorf("prepare failed, %v", err)
+	}
+	rc := GetDefaultRetryConfig()
+	if !reflect.DeepEqual(&nhc.Expert.Retry, &rc) {
+		t.Errorf("default retry configure not set")
+	}
+	if err := rc.Validate(); err != nil {
+		t.Errorf("default retry config is invalid, %v", err)
+	}
+}
+
+func TestRetryConfigValidate(t *testing.T) {
+	tests := []struct {
+		update func(rc *RetryConfig)
+		valid  bool
+	}{
+		{func(rc *RetryConfig) {}, true},
+		{func(rc *RetryConfig) { rc.MinAttemptTimeout = 0 }, false},
+		{func(rc *RetryConfig) { rc.MaxAttemptTimeout = time.Millisecond }, false},
+		{func(rc *RetryConfig) { rc.InitialBackoff = 0 }, false},
+		{func(rc *RetryConfig) { rc.MaxBackoff = time.Millisecond }, false},
+		{func(rc *RetryConfig) { rc.BackoffJitter = 1.5 }, false},
+		{func(rc *RetryConfig) { rc.BackoffJitter = -0.1 }, false},
+	}
+	for idx, tt := range tests {
+		rc := GetDefaultRetryConfig()
+		tt.update(&rc)
+		err := rc.Validate()
+		if (err != nil && tt.valid) || (err == nil && !tt.valid) {
+			t.Errorf("%d, err: %v, valid: %t", idx, err, tt.valid)
+		}
+	}
+}
+
+func TestWitnessCanNotHaveApplyCheckpoint(t *testing.T) {
+	cfg := Config{
+		NodeID:            1,
+		HeartbeatRTT:      1,
+		ElectionRTT:       10,
+		IsWitness:         true,
+		CheckpointEntries: 100,
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("witness node can not have apply checkpoint")
+	}
+}
+
+func TestUnknownChecksumMismatchPolicyIsNotAllowed(t *testing.T) {
+	cfg := Config{
+		NodeID:                 1,
+		HeartbeatRTT:           1,
+		ElectionRTT:            10,
+		ChecksumMismatchPolicy: RefuseApplyOnChecksumMismatch,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	cfg.ChecksumMismatchPolicy = RefuseApplyOnChecksumMismatch + 1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("unknown checksum mismatch policy not rejected")
+	}
+}
+
+func TestUnknownReadBacklogPolicyIsNotAllowed(t *testing.T) {
+	cfg := Config{
+		NodeID:            1,
+		HeartbeatRTT:      1,
+		ElectionRTT:       10,
+		ReadBacklogPolicy: StaleReadsOnBacklog,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	cfg.ReadBacklogPolicy = StaleReadsOnBacklog + 1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("unknown read backlog policy not rejected")
+	}
+}
+
+func TestSnapshotCompressionTypeAndLevelAreValidated(t *testing.T) {
+	cfg := Config{
+		NodeID:                   1,
+		HeartbeatRTT:             1,
+		ElectionRTT:              10,
+		SnapshotCompressionType:  Zstd,
+		SnapshotCompressionLevel: 19,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	cfg.SnapshotCompressionLevel = 23
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("invalid compression level not rejected")
+	}
+	cfg.SnapshotCompressionLevel = 0
+	cfg.EntryCompressionType = Zstd
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("zstd entry compression not rejected")
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+var (
+	// certificateCheckInterval is the minimum interval between two checks on
+	// whether certificate files have been updated.
+	certificateCheckInterval = time.Second
+)
+
+var (
+	errFailedToAppendCerts = errors.New("failed to append certs")
+)
+
+// FileCertificateProvider is a raftio.ICertificateProvider implementation that
+// loads the certificate and certificate authorities from PEM encoded files.
+// Files are checked for updates at most once per second when the certificate
+// or the certificate authorities are requested, updated files are loaded again
+// so renewed certificates can be deployed by replacing files. The previously
+// loaded certificate and certificate authorities are kept in use when updated
+// files can not be loaded, e.g. when they are being replaced.
+type FileCertificateProvider struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes [3]time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+var _ raftio.ICertificateProvider = (*FileCertificateProvider)(nil)
+
+// NewFileCertificateProvider creates a new FileCertificateProvider instance
+// using the specified CA certificate file, node certificate file and node key
+// file.
+func NewFileCertificateProvider(caFile string,
+	certFile string, keyFile string) *FileCertificateProvider {
+	return &FileCertificateProvider{
+		caFile:   caFile,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+}
+
+// Certificate returns the current certificate.
+func (p *FileCertificateProvider) Certificate() (*tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	return p.cert, nil
+}
+
+// CertPool returns the current pool of certificate authorities.
+func (p *FileCertificateProvider) CertPool() (*x509.CertPool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	return p.pool, nil
+}
+
+func (p *FileCertificateProvider) refresh() error {
+	now := time.Now()
+	loaded := p.cert != nil
+	if loaded && now.Sub(p.checked) < certificateCheckInterval {
+		return nil
+	}
+	p.checked = now
+	var modTimes [3]time.Time
+	for i, fn := range []string{p.caFile, p.certFile, p.keyFile} {
+		fi, err := os.Stat(filepath.Clean(fn))
+		if err != nil {
+			return p.reloadFailed(err)
+		}
+		modTimes[i] = fi.ModTime()
+	}
+	if loaded && modTimes == p.modTimes {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return p.reloadFailed(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Clean(p.caFile))
+	if err != nil {
+		return p.reloadFailed(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return p.reloadFailed(errFailedToAppendCerts)
+	}
+	if loaded {
+		plog.Infof("reloaded TLS certificate files")
+	}
+	p.cert = &cert
+	p.pool = pool
+	p.modTimes = modTimes
+	return nil
+}
+
+func (p *FileCertificateProvider) reloadFailed(err error) error {
+	if p.cert == nil {
+		return err
+	}
+	plog.Warningf("failed to reload TLS certificate files, %v", err)
+	return nil
+}
+
+// getServerTLSConfig returns a server tls.Config that requests the
+// certificate and certificate authorities from the specified provider for
+// each new connection.
+func getServerTLSConfig(p raftio.ICertificateProvider) (*tls.Config, error) {
+	if _, err := p.Certificate(); err != nil {
+		return nil, err
+	}
+	if _, err := p.CertPool(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		// client certificates are verified by verifyClientCertificate using the
+		// current certificate authorities
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.Certificate()
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte,
+			_ [][]*x509.Certificate) error {
+			return verifyClientCertificate(p, rawCerts)
+		},
+	}, nil
+}
+
+func verifyClientCertificate(p raftio.ICertificateProvider,
+	rawCerts [][]byte) error {
+	pool, err := p.CertPool()
+	if err != nil {
+		return err
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return errors.New("no client certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(opts)
+	return err
+}
+
+// getClientTLSConfig returns a client tls.Config for the specified host
+// using the current certificate and certificate authorities of the provider.
+func getClientTLSConfig(p raftio.ICertificateProvider,
+	host string) (*tls.Config, error) {
+	cert, err := p.Certificate()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := p.CertPool()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		ServerName:   host,
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      pool,
+	}, nil
+}
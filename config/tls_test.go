@@ -0,0 +1,152 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, dir string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		DNSNames: []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create cert %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	files := map[string][]byte{"ca.crt": certPEM, "node.crt": certPEM, "node.key": keyPEM}
+	for fn, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), data, 0600); err != nil {
+			t.Fatalf("failed to write file %v", err)
+		}
+	}
+}
+
+func TestFileCertificateProviderReloadsUpdatedFiles(t *testing.T) {
+	interval := certificateCheckInterval
+	certificateCheckInterval = 0
+	defer func() {
+		certificateCheckInterval = interval
+	}()
+	dir, err := ioutil.TempDir("", "dragonboat-tls")
+	if err != nil {
+		t.Fatalf("failed to create dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCertificate(t, dir, "first")
+	p := NewFileCertificateProvider(filepath.Join(dir, "ca.crt"),
+		filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"))
+	first, err := p.Certificate()
+	if err != nil {
+		t.Fatalf("failed to get cert %v", err)
+	}
+	// broken files are ignored once a certificate has been loaded
+	if err := ioutil.WriteFile(filepath.Join(dir, "node.crt"),
+		[]byte("broken"), 0600); err != nil {
+		t.Fatalf("failed to write file %v", err)
+	}
+	cert, err := p.Certificate()
+	if err != nil {
+		t.Fatalf("failed to get cert %v", err)
+	}
+	if !bytes.Equal(cert.Certificate[0], first.Certificate[0]) {
+		t.Errorf("unexpected cert")
+	}
+	writeTestCertificate(t, dir, "second")
+	future := time.Now().Add(time.Minute)
+	for _, fn := range []string{"ca.crt", "node.crt", "node.key"} {
+		if err := os.Chtimes(filepath.Join(dir, fn), future, future); err != nil {
+			t.Fatalf("failed to change times %v", err)
+		}
+	}
+	cert, err = p.Certificate()
+	if err != nil {
+		t.Fatalf("failed to get cert %v", err)
+	}
+	if bytes.Equal(cert.Certificate[0], first.Certificate[0]) {
+		t.Errorf("cert not reloaded")
+	}
+	pool, err := p.CertPool()
+	if err != nil {
+		t.Fatalf("failed to get cert pool %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse cert %v", err)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+		t.Errorf("reloaded CA not used, %v", err)
+	}
+}
+
+func TestFileCertificateProviderFailsWhenNothingIsLoaded(t *testing.T) {
+	p := NewFileCertificateProvider("not-exist-ca.crt",
+		"not-exist.crt", "not-exist.key")
+	if _, err := p.Certificate(); err == nil {
+		t.Errorf("error not returned")
+	}
+	nhc := NodeHostConfig{MutualTLS: true, CertificateProvider: p}
+	if _, err := nhc.GetServerTLSConfig(); err == nil {
+		t.Errorf("error not returned")
+	}
+}
+
+func TestCertificateFilesAreNotRequiredWhenProviderIsSet(t *testing.T) {
+	nhc := NodeHostConfig{
+		RaftAddress:    "localhost:9010",
+		RTTMillisecond: 100,
+		NodeHostDir:    "/data",
+		MutualTLS:      true,
+	}
+	if err := nhc.Validate(); err == nil {
+		t.Errorf("cert files not checked")
+	}
+	nhc.CertificateProvider = NewFileCertificateProvider("ca.crt",
+		"node.crt", "node.key")
+	if err := nhc.Validate(); err != nil {
+		t.Errorf("validation failed %v", err)
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v3/internal/transport"
+)
+
+var (
+	// ErrNoReplacementTarget indicates that no NodeHost known by the gossip
+	// service is available for hosting the replacement of a local node.
+	ErrNoReplacementTarget = errors.New("no replacement target")
+)
+
+var (
+	decommissionPollInterval = 100 * time.Millisecond
+)
+
+// DecommissionStage is the stage of moving a local node to another NodeHost.
+type DecommissionStage uint8
+
+const (
+	// DecommissionStarted indicates that moving the local node has started.
+	DecommissionStarted DecommissionStage = iota
+	// ReplacementAdded indicates that the replacement node has been added to
+	// the Raft cluster.
+	ReplacementAdded
+	// ReplacementReady indicates that the replacement node has caught up with
+	// the leader.
+	ReplacementReady
+	// LocalNodeRemoved indicates that the local node has been removed from the
+	// Raft cluster and stopped.
+	LocalNodeRemoved
+)
+
+// DecommissionProgress is the progress of moving a local node to another
+// NodeHost.
+type DecommissionProgress struct {
+	// ClusterID and NodeID identify the local node being moved.
+	ClusterID uint64
+	NodeID    uint64
+	// Target is the NodeHostID of the NodeHost selected to host the replacement
+	// node.
+	Target string
+	// ReplacementNodeID is the NodeID of the replacement node.
+	ReplacementNodeID uint64
+	// Stage is the latest completed stage.
+	Stage DecommissionStage
+	// Err is the error that failed the move, it is nil when the move is still
+	// in progress or completed.
+	Err error
+}
+
+// DecommissionOption is the option type used by the Decommission method.
+type DecommissionOption struct {
+	// StartReplica is invoked after a replacement node is added to its Raft
+	// cluster. It is expected to have the replacement node started as a joining
+	// node on the target NodeHost, e.g. by asking the application instance
+	// running on the target NodeHost to call StartCluster with the join flag
+	// set to true. When StartReplica is nil, the application is responsible for
+	// starting replacement nodes by other means.
+	StartReplica func(ctx context.Context,
+		clusterID uint64, nodeID uint64, target string) error
+	// Progress is invoked each time when the move of a local node makes
+	// progress or fails. It is optional.
+	Progress func(DecommissionProgress)
+}
+
+// Decommission moves all local nodes to other NodeHosts so the NodeHost can be
+// permanently removed. Local nodes are moved one by one, for each of them, a
+// NodeHost that doesn't host any node of the same Raft cluster is selected from
+// NodeHosts known by the gossip service, a replacement node of the same type
+// is added to the Raft cluster and started on the selected NodeHost, the local
+// node is only removed from the Raft cluster and stopped after the
+// replacement node has caught up. The Raft cluster thus never operates with
+// fewer members than before.
+//
+// Decommission requires the gossip service to be enabled by setting the
+// AddressByNodeHostID field of config.NodeHostConfig to true,
+// ErrGossipNotEnabled is returned otherwise. Membership change requests are
+// retried according to the Retry field of config.ExpertConfig. Decommission
+// returns the first error that failed the move of a local node, it can be
+// invoked again to resume the operation, replacement nodes already added by
+// previous invocations are reused.
+func (nh *NodeHost) Decommission(ctx context.Context,
+	opt DecommissionOption) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	registry, ok := nh.nodes.(*transport.NodeHostIDRegistry)
+	if !ok {
+		return ErrGossipNotEnabled
+	}
+	nodes := make(map[uint64]uint64)
+	nh.forEachCluster(func(cid uint64, n *node) bool {
+		nodes[cid] = n.nodeID
+		return true
+	})
+	clusters := make([]uint64, 0, len(nodes))
+	for cid := range nodes {
+		clusters = append(clusters, cid)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i] < clusters[j] })
+	for _, cid := range clusters {
+		p := DecommissionProgress{ClusterID: cid, NodeID: nodes[cid]}
+		if err := nh.moveNode(ctx, registry, &p, opt); err != nil {
+			plog.Errorf("%s failed to move %s, %v",
+				nh.describe(), dn(cid, nodes[cid]), err)
+			p.Err = err
+			opt.report(p)
+			return err
+		}
+	}
+	return nil
+}
+
+func (opt DecommissionOption) report(p DecommissionProgress) {
+	if opt.Progress != nil {
+		opt.Progress(p)
+	}
+}
+
+func (nh *NodeHost) moveNode(ctx context.Context,
+	registry *transport.NodeHostIDRegistry,
+	p *DecommissionProgress, opt DecommissionOption) error {
+	opt.report(*p)
+	m, err := nh.getMembership(ctx, p.ClusterID)
+	if err != nil {
+		return err
+	}
+	_, regular := m.Nodes[p.NodeID]
+	_, observer := m.Observers[p.NodeID]
+	_, witness := m.Witnesses[p.NodeID]
+	if regular || observer || witness {
+		if !nh.getAddedReplacement(p, m) {
+			target, ok := getReplacementTarget(nh.ID(),
+				p.ClusterID, registry.Members(), m)
+			if !ok {
+				return ErrNoReplacementTarget
+			}
+			p.Target = target
+			p.ReplacementNodeID = getReplacementNodeID(m)
+			nh.replacements.Store(p.ClusterID, *p)
+		}
+		if err := nh.addReplacement(ctx, p, observer, witness); err != nil {
+			return err
+		}
+		p.Stage = ReplacementAdded
+		opt.report(*p)
+		if opt.StartReplica != nil {
+			if err := opt.StartReplica(ctx,
+				p.ClusterID, p.ReplacementNodeID, p.Target); err != nil {
+				return err
+			}
+		}
+		// only the catch up of regular nodes matters for the availability of the
+		// Raft cluster, it can only be observed on the leader
+		if regular {
+			if err := nh.waitForReplacement(ctx, p); err != nil {
+				return err
+			}
+		}
+		p.Stage = ReplacementReady
+		opt.report(*p)
+		if err := nh.removeLocalNode(ctx, p); err != nil {
+			return err
+		}
+	}
+	if err := nh.StopCluster(p.ClusterID); err != nil &&
+		err != ErrClusterNotFound {
+		return err
+	}
+	nh.replacements.Delete(p.ClusterID)
+	p.Stage = LocalNodeRemoved
+	opt.report(*p)
+	return nil
+}
+
+// getAddedReplacement checks whether a replacement node has been selected for
+// the local node by a previous Decommission invocation. Such replacement is
+// reused unless it has been removed from the Raft cluster, this prevents more
+// than one replacement to be added when resuming the operation.
+func (nh *NodeHost) getAddedReplacement(p *DecommissionProgress,
+	m *Membership) bool {
+	v, ok := nh.replacements.Load(p.ClusterID)
+	if !ok {
+		return false
+	}
+	rp := v.(DecommissionProgress)
+	if rp.NodeID != p.NodeID {
+		nh.replacements.Delete(p.ClusterID)
+		return false
+	}
+	if _, removed := m.Removed[rp.ReplacementNodeID]; removed {
+		nh.replacements.Delete(p.ClusterID)
+		return false
+	}
+	p.Target = rp.Target
+	p.ReplacementNodeID = rp.ReplacementNodeID
+	return true
+}
+
+func (nh *NodeHost) getMembership(ctx context.Context,
+	clusterID uint64) (*Membership, error) {
+	var m *Membership
+	r := newRetrier(nh.nhConfig.Expert.Retry, nh.stopper.ShouldStop())
+	if err := r.run(ctx, func(actx context.Context) error {
+		var err error
+		m, err = nh.SyncGetClusterMembership(actx, clusterID)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (nh *NodeHost) addReplacement(ctx context.Context,
+	p *DecommissionProgress, observer bool, witness bool) error {
+	r := newRetrier(nh.nhConfig.Expert.Retry, nh.stopper.ShouldStop())
+	return r.run(ctx, func(actx context.Context) error {
+		m, err := nh.SyncGetClusterMembership(actx, p.ClusterID)
+		if err != nil {
+			return err
+		}
+		if isMember(m, p.ReplacementNodeID) {
+			return nil
+		}
+		if observer {
+			return nh.SyncRequestAddObserver(actx, p.ClusterID,
+				p.ReplacementNodeID, p.Target, m.ConfigChangeID)
+		}
+		if witness {
+			return nh.SyncRequestAddWitness(actx, p.ClusterID,
+				p.ReplacementNodeID, p.Target, m.ConfigChangeID)
+		}
+		return nh.SyncRequestAddNode(actx, p.ClusterID,
+			p.ReplacementNodeID, p.Target, m.ConfigChangeID)
+	})
+}
+
+// waitForReplacement waits until the replacement node has caught up with all
+// entries committed when it was added. The replication progress is only known
+// by the leader, the leadership is requested for the local node only once and
+// the progress is then polled, repeated requests would keep disrupting the
+// Raft cluster. Once the replacement node is ready, the leadership of the
+// local node is transferred to it so the local node is not removed as the
+// leader.
+func (nh *NodeHost) waitForReplacement(ctx context.Context,
+	p *DecommissionProgress) error {
+	rs, err := nh.GetRaftState(p.ClusterID)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(decommissionPollInterval)
+	defer ticker.Stop()
+	requested := false
+	for {
+		leaderID, valid, err := nh.GetLeaderID(p.ClusterID)
+		if err != nil {
+			return err
+		}
+		ready, err := nh.replacementReady(p, rs.CommittedIndex)
+		if err != nil {
+			return err
+		}
+		if ready {
+			if valid && leaderID == p.NodeID {
+				nh.requestLeaderTransfer(p.ClusterID, p.ReplacementNodeID)
+			}
+			return nil
+		}
+		if !requested && valid && leaderID != p.NodeID {
+			requested = nh.requestLeaderTransfer(p.ClusterID, p.NodeID)
+		}
+		select {
+		case <-ctx.Done():
+			return getContextError(ctx, ErrTimeout)
+		case <-nh.stopper.ShouldStop():
+			return ErrClosed
+		case <-ticker.C:
+		}
+	}
+}
+
+func (nh *NodeHost) replacementReady(p *DecommissionProgress,
+	index uint64) (bool, error) {
+	status, err := nh.GetClusterNodeStatus(p.ClusterID)
+	if err == ErrInvalidOperation {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s, ok := status[p.ReplacementNodeID]
+	return ok && s.Contacted && s.MatchIndex >= index, nil
+}
+
+func (nh *NodeHost) requestLeaderTransfer(clusterID uint64,
+	target uint64) bool {
+	if err := nh.RequestLeaderTransfer(clusterID, target); err != nil {
+		plog.Debugf("%s failed to transfer leadership to %d, %v",
+			nh.describe(), target, err)
+		return false
+	}
+	return true
+}
+
+func (nh *NodeHost) removeLocalNode(ctx context.Context,
+	p *DecommissionProgress) error {
+	r := newRetrier(nh.nhConfig.Expert.Retry, nh.stopper.ShouldStop())
+	return r.run(ctx, func(actx context.Context) error {
+		m, err := nh.SyncGetClusterMembership(actx, p.ClusterID)
+		if err != nil {
+			return err
+		}
+		if !isMember(m, p.NodeID) {
+			return nil
+		}
+		return nh.SyncRequestDeleteNode(actx,
+			p.ClusterID, p.NodeID, m.ConfigChangeID)
+	})
+}
+
+// getReplacementTarget selects a NodeHost that doesn't host any node of the
+// specified Raft cluster. The selection is based on the hash of the clusterID
+// so replacements are spread across NodeHosts.
+func getReplacementTarget(nhid string,
+	clusterID uint64, nhids []string, m *Membership) (string, bool) {
+	used := map[string]struct{}{nhid: {}}
+	for _, members := range []map[uint64]string{
+		m.Nodes, m.Observers, m.Witnesses} {
+		for _, v := range members {
+			used[v] = struct{}{}
+		}
+	}
+	candidates := make([]string, 0)
+	for _, v := range nhids {
+		if _, ok := used[v]; !ok {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	sort.Strings(candidates)
+	return candidates[getClusterHash(clusterID)%uint64(len(candidates))], true
+}
+
+// getReplacementNodeID returns a NodeID that has never been used in the Raft
+// cluster.
+func getReplacementNodeID(m *Membership) uint64 {
+	nodeID := uint64(0)
+	for _, members := range []map[uint64]string{
+		m.Nodes, m.Observers, m.Witnesses} {
+		for v := range members {
+			if v > nodeID {
+				nodeID = v
+			}
+		}
+	}
+	for v := range m.Removed {
+		if v > nodeID {
+			nodeID = v
+		}
+	}
+	return nodeID + 1
+}
+
+func isMember(m *Membership, nodeID uint64) bool {
+	_, regular := m.Nodes[nodeID]
+	_, observer := m.Observers[nodeID]
+	_, witness := m.Witnesses[nodeID]
+	return regular || observer || witness
+}
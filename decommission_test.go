@@ -0,0 +1,170 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+func TestGetReplacementTarget(t *testing.T) {
+	m := &Membership{
+		Nodes:     map[uint64]string{1: "nhid-1", 2: "nhid-2"},
+		Observers: map[uint64]string{3: "nhid-3"},
+	}
+	nhids := []string{"nhid-1", "nhid-2", "nhid-3", "nhid-4", "nhid-5"}
+	for cid := uint64(0); cid < 16; cid++ {
+		target, ok := getReplacementTarget("nhid-1", cid, nhids, m)
+		if !ok || (target != "nhid-4" && target != "nhid-5") {
+			t.Errorf("unexpected target %s", target)
+		}
+	}
+	if _, ok := getReplacementTarget("nhid-1", 1, nhids[:3], m); ok {
+		t.Errorf("unexpectedly selected a target")
+	}
+}
+
+func TestGetReplacementNodeID(t *testing.T) {
+	m := &Membership{
+		Nodes:     map[uint64]string{1: "nhid-1"},
+		Witnesses: map[uint64]string{3: "nhid-3"},
+		Removed:   map[uint64]struct{}{5: {}},
+	}
+	if v := getReplacementNodeID(m); v != 6 {
+		t.Errorf("got %d, want 6", v)
+	}
+	delete(m.Removed, 5)
+	if v := getReplacementNodeID(m); v != 4 {
+		t.Errorf("got %d, want 4", v)
+	}
+}
+
+func TestDecommissionRequiresGossip(t *testing.T) {
+	tf := func(nh *NodeHost) {
+		if err := nh.Decommission(context.Background(),
+			DecommissionOption{}); err != ErrGossipNotEnabled {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	runNodeHostTest(t, &testOption{defaultTestNode: true, tf: tf}, vfs.GetTestFS())
+}
+
+func TestDecommissionMovesLocalNodes(t *testing.T) {
+	fs := vfs.GetTestFS()
+	os.RemoveAll(singleNodeHostTestDir)
+	defer os.RemoveAll(singleNodeHostTestDir)
+	nh1, err := NewNodeHost(getGossipTestConfig(t, fs, "nh1", nodeHostTestAddr1,
+		"127.0.0.1:25003", "127.0.0.1:25004", testNodeHostID1))
+	if err != nil {
+		t.Fatalf("failed to create nh, %v", err)
+	}
+	defer nh1.Stop()
+	nh2, err := NewNodeHost(getGossipTestConfig(t, fs, "nh2", nodeHostTestAddr2,
+		"127.0.0.1:25004", "127.0.0.1:25003", testNodeHostID2))
+	if err != nil {
+		t.Fatalf("failed to create nh, %v", err)
+	}
+	defer nh2.Stop()
+	createSM := func(uint64, uint64) sm.IStateMachine {
+		return &PST{}
+	}
+	rc := config.Config{
+		ClusterID:    1,
+		NodeID:       1,
+		ElectionRTT:  3,
+		HeartbeatRTT: 1,
+	}
+	members := map[uint64]Target{1: nh1.ID()}
+	if err := nh1.StartCluster(members, false, createSM, rc); err != nil {
+		t.Fatalf("failed to start cluster %v", err)
+	}
+	waitForLeaderToBeElected(t, nh1, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c, err := NewBootstrapCoordinator(nh1, 2, 0)
+	if err != nil {
+		t.Fatalf("failed to create coordinator %v", err)
+	}
+	if _, err := c.WaitForNodeHosts(ctx); err != nil {
+		t.Fatalf("failed to wait for nodehosts %v", err)
+	}
+	stages := make([]DecommissionStage, 0)
+	errStartReplica := errors.New("failed to start replica")
+	failed := false
+	opt := DecommissionOption{
+		StartReplica: func(ctx context.Context,
+			clusterID uint64, nodeID uint64, target string) error {
+			if target != nh2.ID() || nodeID != 2 {
+				t.Errorf("unexpected replacement %d on %s", nodeID, target)
+			}
+			cfg := rc
+			cfg.NodeID = nodeID
+			err := nh2.StartCluster(nil, true, createSM, cfg)
+			if err == ErrClusterAlreadyExist {
+				return nil
+			}
+			// report a failure after the first start, the added replacement must
+			// be reused when the operation is resumed
+			if err == nil && !failed {
+				failed = true
+				return errStartReplica
+			}
+			return err
+		},
+		Progress: func(p DecommissionProgress) {
+			if p.Err != nil {
+				if p.Err != errStartReplica {
+					t.Errorf("failed to move node %v", p.Err)
+				}
+				stages = stages[:0]
+				return
+			}
+			stages = append(stages, p.Stage)
+		},
+	}
+	if err := nh1.Decommission(ctx, opt); err != errStartReplica {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := nh1.Decommission(ctx, opt); err != nil {
+		t.Fatalf("failed to decommission %v", err)
+	}
+	if len(stages) != 4 || stages[3] != LocalNodeRemoved {
+		t.Errorf("unexpected stages %v", stages)
+	}
+	if _, ok := nh1.getCluster(1); ok {
+		t.Errorf("local node not stopped")
+	}
+	waitForLeaderToBeElected(t, nh2, 1)
+	m, err := nh2.SyncGetClusterMembership(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to get membership %v", err)
+	}
+	if len(m.Nodes) != 1 || m.Nodes[2] != nh2.ID() {
+		t.Errorf("unexpected membership %v", m.Nodes)
+	}
+	session := nh2.GetNoOPSession(1)
+	pctx, pcancel := context.WithTimeout(context.Background(), lpto(nh2))
+	defer pcancel()
+	if _, err := nh2.SyncPropose(pctx, session, make([]byte, 0)); err != nil {
+		t.Errorf("failed to make proposal %v", err)
+	}
+}
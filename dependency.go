@@ -0,0 +1,91 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+)
+
+// ApplyDependency is the dependency of a proposal on another Raft cluster. The
+// proposed entry is not applied into the state machine until the Raft cluster
+// identified by ClusterID has its applied index reaching Index on the local
+// NodeHost.
+type ApplyDependency struct {
+	ClusterID uint64
+	Index     uint64
+}
+
+// applyDependencies tracks Raft clusters with committed entries waiting for
+// other Raft clusters on the same NodeHost to reach the specified applied
+// indexes. Waiting clusters are notified once the clusters they depend on
+// have applied more entries.
+type applyDependencies struct {
+	mu sync.Mutex
+	// cluster ID -> IDs of clusters waiting for it
+	waiters    map[uint64]map[uint64]struct{}
+	getApplied func(clusterID uint64) (uint64, bool)
+	notify     func(clusterID uint64)
+}
+
+func newApplyDependencies(getApplied func(uint64) (uint64, bool),
+	notify func(uint64)) *applyDependencies {
+	return &applyDependencies{
+		waiters:    make(map[uint64]map[uint64]struct{}),
+		getApplied: getApplied,
+		notify:     notify,
+	}
+}
+
+// satisfied returns a boolean value indicating whether the specified
+// dependency has been satisfied. When it is not satisfied, the waiting cluster
+// will be notified once the cluster it depends on has applied more entries.
+func (d *applyDependencies) satisfied(waiter uint64, dep ApplyDependency) bool {
+	if d == nil || d.applied(dep) {
+		return true
+	}
+	d.mu.Lock()
+	waiters, ok := d.waiters[dep.ClusterID]
+	if !ok {
+		waiters = make(map[uint64]struct{})
+		d.waiters[dep.ClusterID] = waiters
+	}
+	waiters[waiter] = struct{}{}
+	d.mu.Unlock()
+	// check again in case the applied index was updated before the waiter was
+	// registered
+	return d.applied(dep)
+}
+
+func (d *applyDependencies) applied(dep ApplyDependency) bool {
+	applied, ok := d.getApplied(dep.ClusterID)
+	return ok && applied >= dep.Index
+}
+
+// appliedUpdated is invoked when the applied index of the specified cluster
+// has been updated.
+func (d *applyDependencies) appliedUpdated(clusterID uint64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	waiters, ok := d.waiters[clusterID]
+	if ok {
+		delete(d.waiters, clusterID)
+	}
+	d.mu.Unlock()
+	for waiter := range waiters {
+		d.notify(waiter)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"testing"
+)
+
+func TestApplyDependencies(t *testing.T) {
+	applied := map[uint64]uint64{1: 10}
+	notified := make(map[uint64]int)
+	d := newApplyDependencies(func(cid uint64) (uint64, bool) {
+		v, ok := applied[cid]
+		return v, ok
+	}, func(cid uint64) {
+		notified[cid]++
+	})
+	if !d.satisfied(2, ApplyDependency{ClusterID: 1, Index: 10}) {
+		t.Errorf("dependency not satisfied")
+	}
+	if d.satisfied(2, ApplyDependency{ClusterID: 1, Index: 11}) {
+		t.Errorf("dependency unexpectedly satisfied")
+	}
+	if d.satisfied(3, ApplyDependency{ClusterID: 4, Index: 1}) {
+		t.Errorf("dependency on unknown cluster unexpectedly satisfied")
+	}
+	applied[1] = 11
+	d.appliedUpdated(1)
+	if notified[2] != 1 || notified[3] != 0 {
+		t.Errorf("unexpected notifications %v", notified)
+	}
+	d.appliedUpdated(1)
+	if notified[2] != 1 {
+		t.Errorf("waiter notified more than once %v", notified)
+	}
+	var nilDeps *applyDependencies
+	if !nilDeps.satisfied(2, ApplyDependency{ClusterID: 1, Index: 100}) {
+		t.Errorf("dependency not satisfied")
+	}
+	nilDeps.appliedUpdated(1)
+}
@@ -0,0 +1,115 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+/*
+Package discovery allows lightweight client processes that don't run any
+NodeHost to learn NodeHost addresses and Raft cluster leaders directly from the
+gossip service used by NodeHosts configured with the AddressByNodeHostID field
+of config.NodeHostConfig set, removing the need for a separate discovery
+service in front of Dragonboat based deployments.
+*/
+package discovery
+
+import (
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/transport"
+)
+
+// Leader describes the leader of a Raft cluster learned from the gossip
+// service.
+type Leader struct {
+	// ClusterID is the ID of the Raft cluster.
+	ClusterID uint64
+	// NodeID is the NodeID of the leader node.
+	NodeID uint64
+	// Term is the Raft term in which the leader was elected.
+	Term uint64
+	// NodeHostID is the NodeHostID of the NodeHost running the leader node.
+	NodeHostID string
+	// RaftAddress is the RaftAddress of the NodeHost running the leader node.
+	RaftAddress string
+}
+
+// Observer is an observer-only member of the gossip group formed by NodeHosts.
+// It never takes part in any Raft cluster and it is not counted as a NodeHost,
+// it only learns NodeHost addresses, Raft cluster names and Raft cluster
+// leaders propagated by the gossip service.
+//
+// Leaders are announced by the NodeHosts running them when they are elected
+// and are periodically announced again, information returned by an Observer is
+// thus eventually consistent and might be stale, clients should be prepared
+// to retry requests on other NodeHosts.
+type Observer struct {
+	o *transport.GossipObserver
+}
+
+// NewObserver creates a new Observer instance and joins the gossip group using
+// the specified gossip config. The BindAddress and the Seed fields of the
+// config are required, the Seed field should contain AdvertiseAddress values
+// of NodeHosts in the gossip group.
+func NewObserver(cfg config.GossipConfig) (*Observer, error) {
+	o, err := transport.NewGossipObserver(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Observer{o: o}, nil
+}
+
+// Close leaves the gossip group and releases all resources owned by the
+// Observer.
+func (o *Observer) Close() {
+	o.o.Stop()
+}
+
+// SetSeed replaces the seed list used for joining the gossip group.
+func (o *Observer) SetSeed(seed []string) error {
+	return o.o.SetSeed(seed)
+}
+
+// GetLeader returns the most recently announced leader of the specified Raft
+// cluster. The returned boolean value is false when the leader is unknown or
+// when the NodeHost running the leader is not a member of the gossip group.
+func (o *Observer) GetLeader(clusterID uint64) (Leader, bool) {
+	rec, ok := o.o.ClusterLeaders().Get(clusterID)
+	if !ok {
+		return Leader{}, false
+	}
+	addr, ok := o.o.GetRaftAddress(rec.NodeHostID)
+	if !ok {
+		return Leader{}, false
+	}
+	return Leader{
+		ClusterID:   rec.ClusterID,
+		NodeID:      rec.LeaderID,
+		Term:        rec.Term,
+		NodeHostID:  rec.NodeHostID,
+		RaftAddress: addr,
+	}, true
+}
+
+// GetRaftAddress returns the RaftAddress of the NodeHost identified by the
+// specified NodeHostID.
+func (o *Observer) GetRaftAddress(nhid string) (string, bool) {
+	return o.o.GetRaftAddress(nhid)
+}
+
+// GetClusterID returns the ID of the Raft cluster with the specified name.
+func (o *Observer) GetClusterID(name string) (uint64, bool) {
+	return o.o.ClusterNames().GetClusterID(name)
+}
+
+// NodeHosts returns the RaftAddress values of all NodeHosts in the gossip
+// group keyed by their NodeHostIDs.
+func (o *Observer) NodeHosts() map[string]string {
+	return o.o.NodeHosts()
+}
@@ -0,0 +1,125 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+// GetDiskUsage returns the disk space used by the NodeHost, including the
+// LogDB, the WAL and snapshot directories, with a breakdown per Raft node for
+// saved snapshots, snapshots being generated or received and Raft Log entries.
+// Data of Raft nodes no longer managed by the NodeHost is included, such nodes
+// are reported as unmanaged. External disk managers can use the returned usage
+// to make informed decisions rather than treating the NodeHostDir as a black
+// box. See the DiskUsageListener field of config.NodeHostConfig for receiving
+// such usage periodically.
+//
+// GetDiskUsage walks all related directories, it is expected to be invoked
+// infrequently.
+func (nh *NodeHost) GetDiskUsage() (raftio.DiskUsage, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return raftio.DiskUsage{}, ErrClosed
+	}
+	nh.mu.RLock()
+	ldb := nh.mu.logdb
+	nh.mu.RUnlock()
+	return nh.getDiskUsage(ldb)
+}
+
+func (nh *NodeHost) getDiskUsage(ldb raftio.ILogDB) (raftio.DiskUsage, error) {
+	did := nh.nhConfig.GetDeploymentID()
+	logdb, wal, err := nh.env.GetLogDBDirUsage(did)
+	if err != nil {
+		return raftio.DiskUsage{}, err
+	}
+	dirs, err := nh.env.ListSnapshotDirs(did)
+	if err != nil {
+		return raftio.DiskUsage{}, err
+	}
+	e, estimate := ldb.(raftio.ICompactionEstimator)
+	usage := raftio.DiskUsage{
+		LogDB: logdb,
+		WAL:   wal,
+		Nodes: make([]raftio.NodeDiskUsage, 0, len(dirs)),
+	}
+	for _, sd := range dirs {
+		if isRemovedSnapshotDir(sd) {
+			continue
+		}
+		saved, temp, err := nh.env.GetSnapshotDirUsage(sd.Path)
+		if err != nil {
+			return raftio.DiskUsage{}, err
+		}
+		nu := raftio.NodeDiskUsage{
+			ClusterID:     sd.ClusterID,
+			NodeID:        sd.NodeID,
+			Managed:       nh.isManagedNode(sd.ClusterID, sd.NodeID),
+			SnapshotDir:   sd.Path,
+			SnapshotBytes: saved,
+			TempBytes:     temp,
+		}
+		if estimate {
+			ce, err := e.EstimateCompaction(sd.ClusterID,
+				sd.NodeID, math.MaxUint64)
+			if err != nil {
+				return raftio.DiskUsage{}, err
+			}
+			nu.LogDBBytes = ce.Bytes
+		}
+		usage.SnapshotBytes += saved
+		usage.TempBytes += temp
+		usage.Nodes = append(usage.Nodes, nu)
+	}
+	sort.Slice(usage.Nodes, func(i, j int) bool {
+		if usage.Nodes[i].ClusterID != usage.Nodes[j].ClusterID {
+			return usage.Nodes[i].ClusterID < usage.Nodes[j].ClusterID
+		}
+		return usage.Nodes[i].NodeID < usage.Nodes[j].NodeID
+	})
+	return usage, nil
+}
+
+func (nh *NodeHost) diskUsageMain() {
+	ticker := time.NewTicker(nh.nhConfig.DiskUsageReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nh.stopper.ShouldStop():
+			return
+		case <-ticker.C:
+			nh.reportDiskUsage()
+		}
+	}
+}
+
+// reportDiskUsage is invoked from a worker of the NodeHost stopper, the LogDB
+// is only closed after all such workers have stopped.
+func (nh *NodeHost) reportDiskUsage() {
+	nh.mu.RLock()
+	ldb := nh.mu.logdb
+	nh.mu.RUnlock()
+	usage, err := nh.getDiskUsage(ldb)
+	if err != nil {
+		plog.Errorf("failed to get disk usage, %v", err)
+		return
+	}
+	nh.nhConfig.DiskUsageListener.DiskUsageUpdated(usage)
+}
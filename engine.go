@@ -15,6 +15,7 @@
 package dragonboat
 
 import (
+	"context"
 	"reflect"
 	"sync"
 	"time"
@@ -31,11 +32,10 @@ import (
 )
 
 var (
-	reloadTime           = settings.Soft.NodeReloadMillisecond
 	timedCloseWaitSecond = settings.Soft.CloseWorkerTimedWaitSecond
 	timedCloseWait       = time.Second * time.Duration(timedCloseWaitSecond)
-	nodeReloadInterval   = time.Millisecond * time.Duration(reloadTime)
 	taskBatchSize        = settings.Soft.TaskBatchSize
+	autoScaleDownSamples = uint64(10)
 )
 
 type bitmap struct {
@@ -157,17 +157,21 @@ func (wr *workReady) notify(idx uint64) {
 	}
 }
 
-func (wr *workReady) clusterReadyByUpdates(updates []pb.Update) {
+// clusterReadyByUpdates marks clusters with committed entries as ready. Only
+// updates with the specified FastApply value are considered, so a step batch
+// wakes up each worker at most once per apply phase.
+func (wr *workReady) clusterReadyByUpdates(updates []pb.Update,
+	fastApply bool) {
 	var notified bitmap
 	for _, ud := range updates {
-		if len(ud.CommittedEntries) > 0 {
+		if ud.FastApply == fastApply && len(ud.CommittedEntries) > 0 {
 			idx := wr.partitioner.GetPartitionID(ud.ClusterID)
 			readyMap := wr.maps[idx]
 			readyMap.setClusterReady(ud.ClusterID)
 		}
 	}
 	for _, ud := range updates {
-		if len(ud.CommittedEntries) > 0 {
+		if ud.FastApply == fastApply && len(ud.CommittedEntries) > 0 {
 			idx := wr.partitioner.GetPartitionID(ud.ClusterID)
 			if !notified.contains(idx) {
 				notified.add(idx)
@@ -225,6 +229,280 @@ func (wr *workReady) getReadyMap(workerID uint64) map[uint64]struct{} {
 	return readyMap.getReadyClusters()
 }
 
+// pending returns the number of clusters marked as ready but not yet picked
+// up by workers.
+func (wr *workReady) pending() uint64 {
+	result := uint64(0)
+	for _, m := range wr.maps {
+		result += m.count()
+	}
+	return result
+}
+
+// partition is a group of clusters handled together by the step, commit or
+// apply stage of the execution engine. The partitionID is used as the
+// workerID when accessing per worker resources such as LogDB contexts and
+// profiler labels.
+type partition struct {
+	mu          sync.Mutex
+	nodes       map[uint64]*node
+	updates     []pb.Update
+	batch       []rsm.Task
+	entries     []sm.Entry
+	cci         uint64
+	partitionID uint64
+}
+
+func (p *partition) handle(f func(p *partition)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f(p)
+}
+
+// taskQueue holds functions to be invoked by the worker of an apply partition.
+type taskQueue struct {
+	mu    sync.Mutex
+	tasks []func()
+}
+
+func (q *taskQueue) add(f func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tasks = append(q.tasks, f)
+}
+
+func (q *taskQueue) get() []func() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tasks := q.tasks
+	q.tasks = nil
+	return tasks
+}
+
+// stage manages worker goroutines of the step, commit or apply stage of the
+// execution engine. The number of partitions is fixed as it determines the
+// LogDB shard used by each cluster, while the number of workers can be
+// changed at runtime. Worker w handles partitions w, w+n, w+2n ... where n is
+// the current number of workers, a partition handled by two workers during
+// resizing is protected by its mutex.
+type stage struct {
+	mu         sync.Mutex
+	stopper    *syncutil.Stopper
+	workReady  *workReady
+	cciReady   *workReady
+	partitions []*partition
+	rebalanceC []chan struct{}
+	running    []bool
+	load       func(p *partition)
+	process    func(p *partition)
+	run        func(workerID uint64)
+	workers    uint64
+	idle       uint64
+	stopped    bool
+}
+
+func newStage(stopper *syncutil.Stopper,
+	workReady *workReady, cciReady *workReady,
+	load func(p *partition), process func(p *partition)) *stage {
+	count := workReady.count
+	s := &stage{
+		stopper:    stopper,
+		workReady:  workReady,
+		cciReady:   cciReady,
+		partitions: make([]*partition, count),
+		rebalanceC: make([]chan struct{}, count),
+		running:    make([]bool, count),
+		load:       load,
+		process:    process,
+	}
+	for i := uint64(0); i < count; i++ {
+		s.partitions[i] = &partition{
+			partitionID: i + 1,
+			nodes:       make(map[uint64]*node),
+			updates:     make([]pb.Update, 0),
+		}
+		s.rebalanceC[i] = make(chan struct{}, 1)
+	}
+	s.run = s.workerMain
+	return s
+}
+
+func (s *stage) workerCount() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.workers
+}
+
+// resize sets the number of workers, it returns a boolean value indicating
+// whether the number of workers has been changed.
+func (s *stage) resize(count uint64) bool {
+	if count == 0 || count > uint64(len(s.partitions)) {
+		plog.Panicf("invalid worker count %d, partitions %d",
+			count, len(s.partitions))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || s.workers == count {
+		return false
+	}
+	s.workers = count
+	s.idle = 0
+	for i := uint64(0); i < count; i++ {
+		if !s.running[i] {
+			s.running[i] = true
+			workerID := i + 1
+			s.stopper.RunWorker(func() {
+				s.run(workerID)
+			})
+		}
+	}
+	// running workers reload their partitions, retired workers exit
+	for i, running := range s.running {
+		if running {
+			select {
+			case s.rebalanceC[i] <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return true
+}
+
+// autoScale doubles the number of workers when there are more clusters
+// waiting to be handled than workers, it halves the number of workers after
+// autoScaleDownSamples consecutive samples with no waiting cluster.
+func (s *stage) autoScale() {
+	pending := s.workReady.pending()
+	s.mu.Lock()
+	workers := s.workers
+	target := workers
+	if workers > 0 {
+		if pending > workers {
+			s.idle = 0
+			target = workers * 2
+			if target > uint64(len(s.partitions)) {
+				target = uint64(len(s.partitions))
+			}
+		} else if pending == 0 && workers > 1 {
+			s.idle++
+			if s.idle >= autoScaleDownSamples {
+				target = workers / 2
+			}
+		} else {
+			s.idle = 0
+		}
+	}
+	s.mu.Unlock()
+	if target != workers {
+		if s.resize(target) {
+			plog.Infof("engine stage resized from %d to %d workers, pending %d",
+				workers, target, pending)
+		}
+	}
+}
+
+func (s *stage) retired(workerID uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if workerID > s.workers {
+		s.running[workerID-1] = false
+		return true
+	}
+	return false
+}
+
+func (s *stage) owned(workerID uint64) []*partition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []*partition
+	for i := workerID - 1; i < uint64(len(s.partitions)); i += s.workers {
+		result = append(result, s.partitions[i])
+	}
+	return result
+}
+
+func (s *stage) workerMain(workerID uint64) {
+	for !s.retired(workerID) {
+		if !s.serve(workerID, s.owned(workerID)) {
+			return
+		}
+	}
+}
+
+// serve handles the specified partitions until the stage is stopped or
+// partitions are reassigned, it returns false when the stage is stopped.
+func (s *stage) serve(workerID uint64, owned []*partition) bool {
+	stopC := s.stopper.ShouldStop()
+	rebalanceC := s.rebalanceC[workerID-1]
+	if len(owned) == 1 {
+		p := owned[0]
+		for {
+			select {
+			case <-stopC:
+				return false
+			case <-rebalanceC:
+				return true
+			case <-s.cciReady.waitCh(p.partitionID):
+				p.handle(s.load)
+			case <-s.workReady.waitCh(p.partitionID):
+				p.handle(s.process)
+			}
+		}
+	}
+	// 0 - stopper stopc
+	// 1 - partitions reassigned
+	// 2+2i - cluster set changed for owned[i]
+	// 3+2i - clusters ready in owned[i]
+	cases := make([]reflect.SelectCase, 2+2*len(owned))
+	cases[0] = reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(stopC),
+	}
+	cases[1] = reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(rebalanceC),
+	}
+	for i, p := range owned {
+		cases[2+2*i] = reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(s.cciReady.waitCh(p.partitionID)),
+		}
+		cases[3+2*i] = reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(s.workReady.waitCh(p.partitionID)),
+		}
+	}
+	for {
+		chosen, _, _ := reflect.Select(cases)
+		if chosen == 0 {
+			return false
+		} else if chosen == 1 {
+			return true
+		}
+		p := owned[(chosen-2)/2]
+		if chosen%2 == 0 {
+			p.handle(s.load)
+		} else {
+			p.handle(s.process)
+		}
+	}
+}
+
+// stop stops all workers and offloads nodes from all partitions.
+func (s *stage) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.stopper.Stop()
+	for _, p := range s.partitions {
+		p.handle(func(p *partition) {
+			for _, n := range p.nodes {
+				n.offloaded()
+			}
+		})
+	}
+}
+
 type job struct {
 	node       *node
 	sink       getSink
@@ -262,7 +540,7 @@ func (w *ssWorker) workerMain() {
 			if job.node == nil {
 				panic("req.node == nil")
 			}
-			w.handle(job)
+			job.node.isolatePanic(func() { w.handle(job) })
 			w.completed()
 		}
 	}
@@ -273,6 +551,8 @@ func (w *ssWorker) completed() {
 }
 
 func (w *ssWorker) handle(j job) {
+	j.node.labels.set(snapshotStage)
+	defer j.node.labels.reset()
 	if j.task.Recover {
 		w.recover(j)
 	} else if j.task.Save {
@@ -301,7 +581,7 @@ func (w *ssWorker) save(j job) {
 }
 
 func (w *ssWorker) stream(j job) {
-	if err := j.node.stream(j.sink()); err != nil {
+	if err := j.node.stream(j.sink(), j.task.SSRequest.DeltaSince); err != nil {
 		panic(err)
 	} else {
 		j.node.streamDone()
@@ -369,9 +649,7 @@ func (p *workerPool) getWorker() *ssWorker {
 }
 
 func (p *workerPool) workerPoolMain() {
-	ticker := time.NewTicker(200 * time.Millisecond)
-	defer ticker.Stop()
-	cases := make([]reflect.SelectCase, len(p.workers)+6)
+	cases := make([]reflect.SelectCase, len(p.workers)+5)
 	for {
 		toSchedule := false
 		// 0 - pool stopper stopc
@@ -380,7 +658,6 @@ func (p *workerPool) workerPoolMain() {
 		// 3 - p.streamReady.waitCh(1)
 		// 4 - p.cciReady.waitCh(1)
 		// 5 - worker completedC
-		// 5 + len(workers) - ticker.C
 		cases[0] = reflect.SelectCase{
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(p.poolStopper.ShouldStop()),
@@ -407,10 +684,6 @@ func (p *workerPool) workerPoolMain() {
 				Chan: reflect.ValueOf(w.completedC),
 			}
 		}
-		cases[5+len(p.workers)] = reflect.SelectCase{
-			Dir:  reflect.SelectRecv,
-			Chan: reflect.ValueOf(ticker.C),
-		}
 		chosen, _, _ := reflect.Select(cases)
 		if chosen == 0 {
 			p.workerStopper.Stop()
@@ -452,8 +725,6 @@ func (p *workerPool) workerPoolMain() {
 			workerID := uint64(chosen - 5)
 			p.completed(workerID)
 			toSchedule = true
-		} else if chosen == len(cases)-1 {
-			p.loadNodes()
 		} else {
 			plog.Panicf("chosen %d, unexpected case", chosen)
 		}
@@ -959,6 +1230,7 @@ type engine struct {
 	nodeStopper     *syncutil.Stopper
 	commitStopper   *syncutil.Stopper
 	taskStopper     *syncutil.Stopper
+	scaleStopper    *syncutil.Stopper
 	nh              nodeLoader
 	loaded          *loadedNodes
 	env             *server.Env
@@ -969,14 +1241,23 @@ type engine struct {
 	commitCCIReady  *workReady
 	applyWorkReady  *workReady
 	applyCCIReady   *workReady
+	step            *stage
+	commit          *stage
+	apply           *stage
+	applyTasks      []*taskQueue
 	wp              *workerPool
 	cp              *closeWorkerPool
 	ec              chan error
+	stepLabels      []context.Context
+	commitLabels    []context.Context
+	applyLabels     []context.Context
+	metrics         *engineMetrics
 	notifyCommit    bool
 }
 
 func newExecEngine(nh nodeLoader, cfg config.EngineConfig, notifyCommit bool,
-	errorInjection bool, env *server.Env, logdb raftio.ILogDB) *engine {
+	errorInjection bool, useMetrics bool,
+	env *server.Env, logdb raftio.ILogDB) *engine {
 	if cfg.ExecShards == 0 {
 		panic("ExecShards == 0")
 	}
@@ -989,6 +1270,7 @@ func newExecEngine(nh nodeLoader, cfg config.EngineConfig, notifyCommit bool,
 		nodeStopper:     syncutil.NewStopper(),
 		commitStopper:   syncutil.NewStopper(),
 		taskStopper:     syncutil.NewStopper(),
+		scaleStopper:    syncutil.NewStopper(),
 		stepWorkReady:   newWorkReady(cfg.ExecShards),
 		stepCCIReady:    newWorkReady(cfg.ExecShards),
 		commitWorkReady: newWorkReady(cfg.CommitShards),
@@ -997,43 +1279,92 @@ func newExecEngine(nh nodeLoader, cfg config.EngineConfig, notifyCommit bool,
 		applyCCIReady:   newWorkReady(cfg.ApplyShards),
 		wp:              newWorkerPool(nh, cfg.SnapshotShards, loaded),
 		cp:              newCloseWorkerPool(cfg.CloseShards),
+		stepLabels:      newWorkerLabels(cfg.ProfilerLabels, stepStage, cfg.ExecShards),
+		commitLabels:    newWorkerLabels(cfg.ProfilerLabels, commitStage, cfg.CommitShards),
+		applyLabels:     newWorkerLabels(cfg.ProfilerLabels, applyStage, cfg.ApplyShards),
+		metrics:         newEngineMetrics(useMetrics),
 		notifyCommit:    notifyCommit,
 	}
 	if errorInjection {
 		s.ec = make(chan error, 1)
 	}
-	for i := uint64(1); i <= cfg.ExecShards; i++ {
-		workerID := i
-		s.nodeStopper.RunWorker(func() {
-			if errorInjection {
-				defer func() {
-					if r := recover(); r != nil {
-						if ce, ok := r.(error); ok {
-							s.crash(ce)
-						}
+	s.applyTasks = make([]*taskQueue, cfg.ApplyShards)
+	for i := range s.applyTasks {
+		s.applyTasks[i] = &taskQueue{}
+	}
+	s.step = newStage(s.nodeStopper,
+		s.stepWorkReady, s.stepCCIReady, s.loadStepNodes, s.stepPartition)
+	s.commit = newStage(s.commitStopper,
+		s.commitWorkReady, s.commitCCIReady, s.loadCommitNodes, s.commitPartition)
+	s.apply = newStage(s.taskStopper,
+		s.applyWorkReady, s.applyCCIReady, s.loadApplyNodes, s.applyPartition)
+	if errorInjection {
+		s.step.run = func(workerID uint64) {
+			defer func() {
+				if r := recover(); r != nil {
+					if ce, ok := r.(error); ok {
+						s.crash(ce)
 					}
-				}()
-			}
-			s.stepWorkerMain(workerID)
-		})
+				}
+			}()
+			s.step.workerMain(workerID)
+		}
 	}
+	s.step.resize(getWorkerCount(cfg.ExecWorkers, cfg.ExecShards))
 	if notifyCommit {
-		for i := uint64(1); i <= cfg.CommitShards; i++ {
-			commitWorkerID := i
-			s.commitStopper.RunWorker(func() {
-				s.commitWorkerMain(commitWorkerID)
-			})
-		}
+		s.commit.resize(getWorkerCount(cfg.CommitWorkers, cfg.CommitShards))
 	}
-	for i := uint64(1); i <= cfg.ApplyShards; i++ {
-		applyWorkerID := i
-		s.taskStopper.RunWorker(func() {
-			s.applyWorkerMain(applyWorkerID)
+	s.apply.resize(getWorkerCount(cfg.ApplyWorkers, cfg.ApplyShards))
+	if cfg.AutoScale && cfg.AutoScaleInterval > 0 {
+		s.scaleStopper.RunWorker(func() {
+			s.autoScaleMain(cfg.AutoScaleInterval)
 		})
 	}
 	return s
 }
 
+func getWorkerCount(workers uint64, shards uint64) uint64 {
+	if workers == 0 {
+		return shards
+	}
+	return workers
+}
+
+func (e *engine) autoScaleMain(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.scaleStopper.ShouldStop():
+			return
+		case <-ticker.C:
+			e.step.autoScale()
+			e.commit.autoScale()
+			e.apply.autoScale()
+		}
+	}
+}
+
+// workers returns the number of step, commit and apply workers. The number
+// of commit workers is 0 when commit notification is not enabled.
+func (e *engine) workers() (uint64, uint64, uint64) {
+	return e.step.workerCount(), e.commit.workerCount(), e.apply.workerCount()
+}
+
+// resize changes the number of step, commit and apply workers, 0 means the
+// number of workers of the stage is not changed.
+func (e *engine) resize(step uint64, commit uint64, apply uint64) {
+	if step > 0 {
+		e.step.resize(step)
+	}
+	if commit > 0 && e.notifyCommit {
+		e.commit.resize(commit)
+	}
+	if apply > 0 {
+		e.apply.resize(apply)
+	}
+}
+
 func (e *engine) crash(err error) {
 	select {
 	case e.ec <- err:
@@ -1042,9 +1373,10 @@ func (e *engine) crash(err error) {
 }
 
 func (e *engine) stop() {
-	e.nodeStopper.Stop()
-	e.commitStopper.Stop()
-	e.taskStopper.Stop()
+	e.scaleStopper.Stop()
+	e.step.stop()
+	e.commit.stop()
+	e.apply.stop()
 	e.wp.stop()
 	e.cp.stop()
 }
@@ -1072,34 +1404,28 @@ func (e *engine) load(workerID uint64,
 	return result, cci
 }
 
-func (e *engine) commitWorkerMain(workerID uint64) {
-	nodes := make(map[uint64]*node)
-	ticker := time.NewTicker(nodeReloadInterval)
-	defer ticker.Stop()
-	cci := uint64(0)
-	for {
-		select {
-		case <-e.commitStopper.ShouldStop():
-			e.offloadNodeMap(nodes)
-			return
-		case <-ticker.C:
-			nodes, cci = e.loadCommitNodes(workerID, cci, nodes)
-			e.processCommits(make(map[uint64]struct{}), nodes)
-		case <-e.commitCCIReady.waitCh(workerID):
-			nodes, cci = e.loadCommitNodes(workerID, cci, nodes)
-		case <-e.commitWorkReady.waitCh(workerID):
-			if cci == 0 || len(nodes) == 0 {
-				nodes, cci = e.loadCommitNodes(workerID, cci, nodes)
-			}
-			active := e.commitWorkReady.getReadyMap(workerID)
-			e.processCommits(active, nodes)
-		}
+// clusterSetChanged returns a boolean value indicating whether the cluster set
+// has been changed since the partition was last loaded. Work notifications can
+// be handled before the cluster set change notification of the same
+// partition, nodes are thus reloaded on demand so that notifications for newly
+// added clusters are not dropped.
+func (e *engine) clusterSetChanged(p *partition) bool {
+	return p.cci != e.nh.getClusterSetIndex()
+}
+
+func (e *engine) commitPartition(p *partition) {
+	setWorkerLabels(e.commitLabels, p.partitionID)
+	if e.clusterSetChanged(p) {
+		e.loadCommitNodes(p)
 	}
+	active := e.commitWorkReady.getReadyMap(p.partitionID)
+	e.processCommits(active, p.nodes)
+	setWorkerLabels(e.commitLabels, p.partitionID)
 }
 
-func (e *engine) loadCommitNodes(workerID uint64, cci uint64,
-	nodes map[uint64]*node) (map[uint64]*node, uint64) {
-	return e.load(workerID, cci, nodes, fromCommitWorker, e.commitWorkReady)
+func (e *engine) loadCommitNodes(p *partition) {
+	p.nodes, p.cci = e.load(p.partitionID,
+		p.cci, p.nodes, fromCommitWorker, e.commitWorkReady)
 }
 
 func (e *engine) processCommits(idmap map[uint64]struct{},
@@ -1114,42 +1440,40 @@ func (e *engine) processCommits(idmap map[uint64]struct{},
 		if !ok || node.stopped() {
 			continue
 		}
+		node.labels.set(commitStage)
 		node.notifyCommittedEntries()
 	}
 }
 
-func (e *engine) applyWorkerMain(workerID uint64) {
-	nodes := make(map[uint64]*node)
-	ticker := time.NewTicker(nodeReloadInterval)
-	defer ticker.Stop()
-	batch := make([]rsm.Task, 0, taskBatchSize)
-	entries := make([]sm.Entry, 0, taskBatchSize)
-	cci := uint64(0)
-	for {
-		select {
-		case <-e.taskStopper.ShouldStop():
-			e.offloadNodeMap(nodes)
-			return
-		case <-ticker.C:
-			nodes, cci = e.loadApplyNodes(workerID, cci, nodes)
-			e.processApplies(make(map[uint64]struct{}), nodes, batch, entries)
-			batch = make([]rsm.Task, 0, taskBatchSize)
-			entries = make([]sm.Entry, 0, taskBatchSize)
-		case <-e.applyCCIReady.waitCh(workerID):
-			nodes, cci = e.loadApplyNodes(workerID, cci, nodes)
-		case <-e.applyWorkReady.waitCh(workerID):
-			if cci == 0 || len(nodes) == 0 {
-				nodes, cci = e.loadApplyNodes(workerID, cci, nodes)
-			}
-			active := e.applyWorkReady.getReadyMap(workerID)
-			e.processApplies(active, nodes, batch, entries)
-		}
+func (e *engine) applyPartition(p *partition) {
+	setWorkerLabels(e.applyLabels, p.partitionID)
+	if p.batch == nil {
+		p.batch = make([]rsm.Task, 0, taskBatchSize)
+		p.entries = make([]sm.Entry, 0, taskBatchSize)
+	}
+	if e.clusterSetChanged(p) {
+		e.loadApplyNodes(p)
+	}
+	active := e.applyWorkReady.getReadyMap(p.partitionID)
+	e.processApplies(active, p.nodes, p.batch, p.entries)
+	for _, f := range e.applyTasks[p.partitionID-1].get() {
+		f()
 	}
+	setWorkerLabels(e.applyLabels, p.partitionID)
 }
 
-func (e *engine) loadApplyNodes(workerID uint64, cci uint64,
-	nodes map[uint64]*node) (map[uint64]*node, uint64) {
-	return e.load(workerID, cci, nodes, fromApplyWorker, e.applyWorkReady)
+// runOnApplyWorker schedules the specified function to be invoked by the apply
+// worker that handles the specified cluster. The function is not invoked when
+// the engine is stopped before the worker picks it up.
+func (e *engine) runOnApplyWorker(clusterID uint64, f func()) {
+	idx := e.applyWorkReady.getPartitioner().GetPartitionID(clusterID)
+	e.applyTasks[idx].add(f)
+	e.setApplyReady(clusterID)
+}
+
+func (e *engine) loadApplyNodes(p *partition) {
+	p.nodes, p.cci = e.load(p.partitionID,
+		p.cci, p.nodes, fromApplyWorker, e.applyWorkReady)
 }
 
 // S: save snapshot
@@ -1167,54 +1491,45 @@ func (e *engine) processApplies(idmap map[uint64]struct{},
 			idmap[k] = struct{}{}
 		}
 	}
+	processed := 0
 	for clusterID := range idmap {
 		node, ok := nodes[clusterID]
-		if !ok || node.stopped() {
+		if !ok || node.stopped() || node.applyRefused {
 			continue
 		}
+		node.labels.set(applyStage)
 		if node.processStatusTransition() {
 			continue
 		}
-		task, err := node.handleTask(batch, entries)
-		if err != nil {
-			panic(err)
-		}
-		if task.IsSnapshotTask() {
-			node.handleSnapshotTask(task)
+		if node.isolatePanic(func() {
+			task, err := node.handleTask(batch, entries)
+			if err != nil {
+				panic(err)
+			}
+			if task.IsSnapshotTask() {
+				node.handleSnapshotTask(task)
+			}
+		}) {
+			continue
 		}
+		processed++
 	}
+	e.metrics.applyBatchProcessed(processed)
 }
 
-func (e *engine) stepWorkerMain(workerID uint64) {
-	nodes := make(map[uint64]*node)
-	ticker := time.NewTicker(nodeReloadInterval)
-	defer ticker.Stop()
-	cci := uint64(0)
-	stopC := e.nodeStopper.ShouldStop()
-	updates := make([]pb.Update, 0)
-	for {
-		select {
-		case <-stopC:
-			e.offloadNodeMap(nodes)
-			return
-		case <-ticker.C:
-			nodes, cci = e.loadStepNodes(workerID, cci, nodes)
-			e.processSteps(workerID, make(map[uint64]struct{}), nodes, updates, stopC)
-		case <-e.stepCCIReady.waitCh(workerID):
-			nodes, cci = e.loadStepNodes(workerID, cci, nodes)
-		case <-e.stepWorkReady.waitCh(workerID):
-			if cci == 0 || len(nodes) == 0 {
-				nodes, cci = e.loadStepNodes(workerID, cci, nodes)
-			}
-			active := e.stepWorkReady.getReadyMap(workerID)
-			e.processSteps(workerID, active, nodes, updates, stopC)
-		}
+func (e *engine) stepPartition(p *partition) {
+	setWorkerLabels(e.stepLabels, p.partitionID)
+	if e.clusterSetChanged(p) {
+		e.loadStepNodes(p)
 	}
+	active := e.stepWorkReady.getReadyMap(p.partitionID)
+	e.processSteps(p.partitionID,
+		active, p.nodes, p.updates, e.nodeStopper.ShouldStop())
 }
 
-func (e *engine) loadStepNodes(workerID uint64,
-	cci uint64, nodes map[uint64]*node) (map[uint64]*node, uint64) {
-	return e.load(workerID, cci, nodes, fromStepWorker, e.stepWorkReady)
+func (e *engine) loadStepNodes(p *partition) {
+	p.nodes, p.cci = e.load(p.partitionID,
+		p.cci, p.nodes, fromStepWorker, e.stepWorkReady)
 }
 
 func (e *engine) loadBucketNodes(workerID uint64,
@@ -1271,10 +1586,26 @@ func (e *engine) processSteps(workerID uint64,
 		if !ok || node.stopped() {
 			continue
 		}
+		node.labels.set(stepStage)
 		if ud, hasUpdate := node.stepNode(); hasUpdate {
+			if ud.LatencyCritical {
+				// latency optimized nodes don't wait for other nodes to be stepped,
+				// their updates are immediately persisted and committed
+				e.processStepUpdates(workerID, []pb.Update{ud}, nodes)
+				continue
+			}
 			nodeUpdates = append(nodeUpdates, ud)
 		}
 	}
+	e.processStepUpdates(workerID, nodeUpdates, nodes)
+}
+
+func (e *engine) processStepUpdates(workerID uint64,
+	nodeUpdates []pb.Update, nodes map[uint64]*node) {
+	if len(nodeUpdates) == 0 {
+		return
+	}
+	setWorkerLabels(e.stepLabels, workerID)
 	e.applySnapshotAndUpdate(nodeUpdates, nodes, true)
 	// see raft thesis section 10.2.1 on details why we send Replicate message
 	// before those entries are persisted to disk
@@ -1288,18 +1619,27 @@ func (e *engine) processSteps(workerID uint64,
 	if err := e.logdb.SaveRaftState(nodeUpdates, workerID); err != nil {
 		panic(err)
 	}
+	e.metrics.stepBatchSaved(len(nodeUpdates))
 	if err := e.onSnapshotSaved(nodeUpdates, nodes); err != nil {
 		panic(err)
 	}
 	e.applySnapshotAndUpdate(nodeUpdates, nodes, false)
+	// messages from all clusters in the batch are handed to the transport in a
+	// single pass, so messages sharing the same connection are more likely to
+	// be sent in the same message batch
+	for _, ud := range nodeUpdates {
+		nodes[ud.ClusterID].sendMessages(ud.Messages)
+	}
 	for _, ud := range nodeUpdates {
 		node := nodes[ud.ClusterID]
+		node.labels.set(stepStage)
 		if err := node.processRaftUpdate(ud); err != nil {
 			panic(err)
 		}
 		e.processMoreCommittedEntries(ud)
 		node.commitRaftUpdate(ud)
 	}
+	setWorkerLabels(e.stepLabels, workerID)
 	if lazyFreeCycle > 0 {
 		resetNodeUpdate(nodeUpdates)
 	}
@@ -1338,9 +1678,9 @@ func (e *engine) applySnapshotAndUpdate(updates []pb.Update,
 		node.applyRaftUpdates(ud)
 	}
 	if !notifyCommit {
-		e.setApplyReadyByUpdates(updates)
+		e.setApplyReadyByUpdates(updates, fastApply)
 	} else {
-		e.setCommitReadyByUpdates(updates)
+		e.setCommitReadyByUpdates(updates, fastApply)
 	}
 }
 
@@ -1373,16 +1713,18 @@ func (e *engine) setStepReady(clusterID uint64) {
 	e.stepWorkReady.clusterReady(clusterID)
 }
 
-func (e *engine) setCommitReadyByUpdates(updates []pb.Update) {
-	e.commitWorkReady.clusterReadyByUpdates(updates)
+func (e *engine) setCommitReadyByUpdates(updates []pb.Update,
+	fastApply bool) {
+	e.commitWorkReady.clusterReadyByUpdates(updates, fastApply)
 }
 
 func (e *engine) setCommitReady(clusterID uint64) {
 	e.commitWorkReady.clusterReady(clusterID)
 }
 
-func (e *engine) setApplyReadyByUpdates(updates []pb.Update) {
-	e.applyWorkReady.clusterReadyByUpdates(updates)
+func (e *engine) setApplyReadyByUpdates(updates []pb.Update,
+	fastApply bool) {
+	e.applyWorkReady.clusterReadyByUpdates(updates, fastApply)
 }
 
 func (e *engine) setApplyReady(clusterID uint64) {
@@ -1408,8 +1750,35 @@ func (e *engine) setCCIReady(clusterID uint64) {
 	e.wp.cciReady.clusterReady(clusterID)
 }
 
-func (e *engine) offloadNodeMap(nodes map[uint64]*node) {
-	for _, node := range nodes {
-		node.offloaded()
+// engineMetrics tracks how many clusters are handled together by the engine
+// workers, the step batch size is the number of clusters sharing a single
+// LogDB write, the apply batch size is the number of clusters handled by a
+// single apply worker wakeup.
+type engineMetrics struct {
+	stepBatch  *server.BatchSizeHistogram
+	applyBatch *server.BatchSizeHistogram
+	useMetrics bool
+}
+
+func newEngineMetrics(useMetrics bool) *engineMetrics {
+	em := &engineMetrics{useMetrics: useMetrics}
+	if useMetrics {
+		name := "dragonboat_engine_step_batch_size"
+		em.stepBatch = server.NewBatchSizeHistogram(name)
+		name = "dragonboat_engine_apply_batch_size"
+		em.applyBatch = server.NewBatchSizeHistogram(name)
+	}
+	return em
+}
+
+func (em *engineMetrics) stepBatchSaved(count int) {
+	if em.useMetrics && count > 0 {
+		em.stepBatch.Observe(uint64(count))
+	}
+}
+
+func (em *engineMetrics) applyBatchProcessed(count int) {
+	if em.useMetrics && count > 0 {
+		em.applyBatch.Observe(uint64(count))
 	}
 }
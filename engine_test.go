@@ -15,7 +15,18 @@
 package dragonboat
 
 import (
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/rsm"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	pb "github.com/lni/dragonboat/v3/raftpb"
 )
 
 func TestBitmapAdd(t *testing.T) {
@@ -175,6 +186,35 @@ func TestReturnedReadyMapContainsReadyClusterID(t *testing.T) {
 	}
 }
 
+func TestClusterReadyByUpdatesOnlyConsidersMatchedUpdates(t *testing.T) {
+	wr := newWorkReady(4)
+	e := []pb.Entry{{Index: 1}}
+	updates := []pb.Update{
+		{ClusterID: 0, FastApply: true, CommittedEntries: e},
+		{ClusterID: 4, FastApply: false, CommittedEntries: e},
+		{ClusterID: 1, FastApply: false},
+	}
+	wr.clusterReadyByUpdates(updates, true)
+	ready := wr.getReadyMap(1)
+	if len(ready) != 1 {
+		t.Fatalf("unexpected ready map size, sz: %d", len(ready))
+	}
+	if _, ok := ready[0]; !ok {
+		t.Errorf("missing cluster id")
+	}
+	wr.clusterReadyByUpdates(updates, false)
+	ready = wr.getReadyMap(1)
+	if len(ready) != 1 {
+		t.Fatalf("unexpected ready map size, sz: %d", len(ready))
+	}
+	if _, ok := ready[4]; !ok {
+		t.Errorf("missing cluster id")
+	}
+	if len(wr.getReadyMap(2)) != 0 {
+		t.Errorf("cluster without committed entries is ready")
+	}
+}
+
 func TestLoadedNodes(t *testing.T) {
 	lns := newLoadedNodes()
 	if lns.get(2, 3) != nil {
@@ -220,6 +260,215 @@ func TestBusyMapKeyIsIgnoredWhenUpdatingLoadedNodes(t *testing.T) {
 	}
 }
 
+func TestStageWorkersHandleAllPartitions(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	processedC := make(chan uint64, 16)
+	s := newStage(syncutil.NewStopper(), newWorkReady(8), newWorkReady(8),
+		func(p *partition) {},
+		func(p *partition) {
+			processedC <- p.partitionID
+		})
+	defer s.stop()
+	for _, workers := range []uint64{8, 3, 1, 5} {
+		s.resize(workers)
+		if s.workerCount() != workers {
+			t.Fatalf("unexpected worker count %d", s.workerCount())
+		}
+		for cid := uint64(0); cid < 8; cid++ {
+			s.workReady.clusterReady(cid)
+		}
+		processed := make(map[uint64]struct{})
+		for len(processed) < 8 {
+			select {
+			case id := <-processedC:
+				processed[id] = struct{}{}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("workers %d, processed %v", workers, processed)
+			}
+		}
+	}
+}
+
+func TestStageAutoScale(t *testing.T) {
+	s := newStage(syncutil.NewStopper(), newWorkReady(4), newWorkReady(4),
+		func(p *partition) {}, func(p *partition) {})
+	s.run = func(workerID uint64) {}
+	defer s.stop()
+	s.resize(2)
+	for cid := uint64(0); cid < 3; cid++ {
+		s.workReady.clusterReady(cid)
+	}
+	s.autoScale()
+	if s.workerCount() != 4 {
+		t.Fatalf("failed to scale up, %d", s.workerCount())
+	}
+	s.autoScale()
+	if s.workerCount() != 4 {
+		t.Fatalf("scaled beyond the number of partitions")
+	}
+	for _, p := range s.partitions {
+		s.workReady.getReadyMap(p.partitionID)
+	}
+	for i := uint64(1); i < autoScaleDownSamples; i++ {
+		s.autoScale()
+		if s.workerCount() != 4 {
+			t.Fatalf("scaled down too early")
+		}
+	}
+	s.autoScale()
+	if s.workerCount() != 2 {
+		t.Fatalf("failed to scale down, %d", s.workerCount())
+	}
+}
+
+func TestFunctionCanBeRunOnApplyWorker(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	nh := &NodeHost{stopper: syncutil.NewStopper()}
+	e := newExecEngine(nh, config.GetDefaultEngineConfig(),
+		false, false, false, nil, nil)
+	defer e.stop()
+	doneC := make(chan struct{}, 2)
+	for cid := uint64(1); cid <= 2; cid++ {
+		e.runOnApplyWorker(cid, func() { doneC <- struct{}{} })
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-doneC:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("function not invoked")
+		}
+	}
+}
+
+func TestIdleStageWorkersAreNotWokenUp(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	var processed uint64
+	s := newStage(syncutil.NewStopper(), newWorkReady(4), newWorkReady(4),
+		func(p *partition) {},
+		func(p *partition) {
+			atomic.AddUint64(&processed, 1)
+		})
+	defer s.stop()
+	s.resize(2)
+	s.workReady.clusterReady(1)
+	for atomic.LoadUint64(&processed) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if v := atomic.LoadUint64(&processed); v != 1 {
+		t.Fatalf("idle workers woken up %d times", v-1)
+	}
+}
+
+type testNodeLoader struct {
+	mu    sync.Mutex
+	cci   uint64
+	nodes map[uint64]*node
+}
+
+func newTestNodeLoader() *testNodeLoader {
+	return &testNodeLoader{nodes: make(map[uint64]*node)}
+}
+
+func (l *testNodeLoader) describe() string {
+	return "test"
+}
+
+func (l *testNodeLoader) getClusterSetIndex() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cci
+}
+
+func (l *testNodeLoader) forEachCluster(f func(uint64, *node) bool) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for cid, n := range l.nodes {
+		if !f(cid, n) {
+			break
+		}
+	}
+	return l.cci
+}
+
+func (l *testNodeLoader) add(n *node) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nodes[n.clusterID] = n
+	l.cci++
+}
+
+func waitForCondition(t *testing.T, name string, cond func() bool) {
+	for i := 0; i < 5000; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%s: condition not met", name)
+}
+
+func isLoadedBy(e *engine, workerID uint64, from from, clusterID uint64) bool {
+	e.loaded.mu.Lock()
+	defer e.loaded.mu.Unlock()
+	_, ok := e.loaded.nodes[nodeType{workerID: workerID, from: from}][clusterID]
+	return ok
+}
+
+// work notifications can be handled before the cluster set change notification
+// of the same partition, without the periodic node reload, each worker must
+// still pick up a newly added cluster when only the work notification is
+// delivered.
+func TestEngineWorkersDoNotStallWithoutClusterSetNotification(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	defer cleanupTestDir(fs)
+	nodes, _, _, ldb := getTestRaftNodes(2, false, fs)
+	defer ldb.Close()
+	defer stopNodes(nodes)
+	for _, n := range nodes {
+		n.notifyCommit = true
+		n.toCommitQ = rsm.NewTaskQueue()
+	}
+	loaded, n := nodes[0], nodes[1]
+	n.clusterID = loaded.clusterID + 1
+	cfg := config.GetDefaultEngineConfig()
+	cfg.ExecShards = 1
+	cfg.CommitShards = 1
+	cfg.ApplyShards = 1
+	loader := newTestNodeLoader()
+	e := newExecEngine(loader, cfg, true, false, false, nil, ldb)
+	defer e.stop()
+	loader.add(loaded)
+	e.setCCIReady(loaded.clusterID)
+	waitForCondition(t, "load", func() bool {
+		return isLoadedBy(e, 1, fromStepWorker, loaded.clusterID) &&
+			isLoadedBy(e, 1, fromCommitWorker, loaded.clusterID) &&
+			isLoadedBy(e, 1, fromApplyWorker, loaded.clusterID) &&
+			isLoadedBy(e, 0, fromWorkerPool, loaded.clusterID)
+	})
+	// the cluster set is changed without notifying any worker
+	loader.add(n)
+	cid := n.clusterID
+	e.setStepReady(cid)
+	waitForCondition(t, "step", func() bool {
+		return isLoadedBy(e, 1, fromStepWorker, cid)
+	})
+	n.toCommitQ.Add(rsm.Task{})
+	e.setCommitReady(cid)
+	waitForCondition(t, "commit", func() bool {
+		return n.toCommitQ.Size() == 0 && n.toApplyQ.Size() == 1
+	})
+	e.setApplyReady(cid)
+	waitForCondition(t, "apply", func() bool {
+		return n.ss.recovering()
+	})
+	e.setSaveReady(cid)
+	waitForCondition(t, "snapshot worker pool", func() bool {
+		return isLoadedBy(e, 0, fromWorkerPool, cid)
+	})
+}
+
 /*
 func TestWPRemoveFromPending(t *testing.T) {
 	tests := []struct {
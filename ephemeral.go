@@ -0,0 +1,212 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/logdb"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+// ephemeralLogDB is an ILogDB wrapper that keeps data of ephemeral witness
+// nodes in an in-memory LogDB, data of all other nodes are stored in the
+// persistent LogDB of the NodeHost. The in-memory LogDB is only created when
+// the first ephemeral witness node is registered.
+type ephemeralLogDB struct {
+	raftio.ILogDB
+	nhConfig config.NodeHostConfig
+	count    int32
+	mu       sync.RWMutex
+	mem      raftio.ILogDB
+	nodes    map[raftio.NodeInfo]struct{}
+}
+
+var _ raftio.ILogDB = (*ephemeralLogDB)(nil)
+var _ raftio.ICompactionEstimator = (*ephemeralLogDB)(nil)
+
+func newEphemeralLogDB(ldb raftio.ILogDB,
+	nhConfig config.NodeHostConfig) *ephemeralLogDB {
+	return &ephemeralLogDB{
+		ILogDB:   ldb,
+		nhConfig: nhConfig,
+		nodes:    make(map[raftio.NodeInfo]struct{}),
+	}
+}
+
+func (l *ephemeralLogDB) register(clusterID uint64, nodeID uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.mem == nil {
+		mem, err := logdb.NewInMemoryLogDB(l.nhConfig)
+		if err != nil {
+			return err
+		}
+		l.mem = mem
+	}
+	ni := raftio.GetNodeInfo(clusterID, nodeID)
+	if _, ok := l.nodes[ni]; !ok {
+		l.nodes[ni] = struct{}{}
+		atomic.AddInt32(&l.count, 1)
+	}
+	return nil
+}
+
+func (l *ephemeralLogDB) get(clusterID uint64, nodeID uint64) raftio.ILogDB {
+	if atomic.LoadInt32(&l.count) == 0 {
+		return l.ILogDB
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if _, ok := l.nodes[raftio.GetNodeInfo(clusterID, nodeID)]; ok {
+		return l.mem
+	}
+	return l.ILogDB
+}
+
+func (l *ephemeralLogDB) split(updates []pb.Update) ([]pb.Update, []pb.Update) {
+	if atomic.LoadInt32(&l.count) == 0 {
+		return updates, nil
+	}
+	var persistent []pb.Update
+	var mem []pb.Update
+	for _, ud := range updates {
+		if l.get(ud.ClusterID, ud.NodeID) == l.ILogDB {
+			persistent = append(persistent, ud)
+		} else {
+			mem = append(mem, ud)
+		}
+	}
+	return persistent, mem
+}
+
+func (l *ephemeralLogDB) getMem() raftio.ILogDB {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.mem
+}
+
+func (l *ephemeralLogDB) Close() {
+	l.ILogDB.Close()
+	if mem := l.getMem(); mem != nil {
+		mem.Close()
+	}
+}
+
+func (l *ephemeralLogDB) ListNodeInfo() ([]raftio.NodeInfo, error) {
+	result, err := l.ILogDB.ListNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	if mem := l.getMem(); mem != nil {
+		ni, err := mem.ListNodeInfo()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ni...)
+	}
+	return result, nil
+}
+
+func (l *ephemeralLogDB) SaveBootstrapInfo(clusterID uint64,
+	nodeID uint64, bootstrap pb.Bootstrap) error {
+	return l.get(clusterID,
+		nodeID).SaveBootstrapInfo(clusterID, nodeID, bootstrap)
+}
+
+func (l *ephemeralLogDB) GetBootstrapInfo(clusterID uint64,
+	nodeID uint64) (pb.Bootstrap, error) {
+	return l.get(clusterID, nodeID).GetBootstrapInfo(clusterID, nodeID)
+}
+
+func (l *ephemeralLogDB) SaveRaftState(updates []pb.Update,
+	shardID uint64) error {
+	persistent, mem := l.split(updates)
+	if len(persistent) > 0 {
+		if err := l.ILogDB.SaveRaftState(persistent, shardID); err != nil {
+			return err
+		}
+	}
+	if len(mem) > 0 {
+		return l.getMem().SaveRaftState(mem, shardID)
+	}
+	return nil
+}
+
+func (l *ephemeralLogDB) IterateEntries(ents []pb.Entry,
+	size uint64, clusterID uint64, nodeID uint64, low uint64,
+	high uint64, maxSize uint64) ([]pb.Entry, uint64, error) {
+	return l.get(clusterID, nodeID).IterateEntries(ents,
+		size, clusterID, nodeID, low, high, maxSize)
+}
+
+func (l *ephemeralLogDB) ReadRaftState(clusterID uint64,
+	nodeID uint64, lastIndex uint64) (raftio.RaftState, error) {
+	return l.get(clusterID,
+		nodeID).ReadRaftState(clusterID, nodeID, lastIndex)
+}
+
+func (l *ephemeralLogDB) RemoveEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	return l.get(clusterID, nodeID).RemoveEntriesTo(clusterID, nodeID, index)
+}
+
+func (l *ephemeralLogDB) CompactEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) (<-chan struct{}, error) {
+	return l.get(clusterID, nodeID).CompactEntriesTo(clusterID, nodeID, index)
+}
+
+func (l *ephemeralLogDB) SaveSnapshots(updates []pb.Update) error {
+	persistent, mem := l.split(updates)
+	if len(persistent) > 0 {
+		if err := l.ILogDB.SaveSnapshots(persistent); err != nil {
+			return err
+		}
+	}
+	if len(mem) > 0 {
+		return l.getMem().SaveSnapshots(mem)
+	}
+	return nil
+}
+
+func (l *ephemeralLogDB) DeleteSnapshot(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	return l.get(clusterID, nodeID).DeleteSnapshot(clusterID, nodeID, index)
+}
+
+func (l *ephemeralLogDB) ListSnapshots(clusterID uint64,
+	nodeID uint64, index uint64) ([]pb.Snapshot, error) {
+	return l.get(clusterID, nodeID).ListSnapshots(clusterID, nodeID, index)
+}
+
+func (l *ephemeralLogDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
+	return l.get(clusterID, nodeID).RemoveNodeData(clusterID, nodeID)
+}
+
+func (l *ephemeralLogDB) ImportSnapshot(ss pb.Snapshot, nodeID uint64) error {
+	return l.get(ss.ClusterId, nodeID).ImportSnapshot(ss, nodeID)
+}
+
+func (l *ephemeralLogDB) EstimateCompaction(clusterID uint64,
+	nodeID uint64, index uint64) (raftio.CompactionEstimate, error) {
+	e, ok := l.get(clusterID, nodeID).(raftio.ICompactionEstimator)
+	if !ok {
+		return raftio.CompactionEstimate{}, ErrCompactionEstimateNotSupported
+	}
+	return e.EstimateCompaction(clusterID, nodeID, index)
+}
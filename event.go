@@ -39,27 +39,33 @@ type raftEventListener struct {
 	leaderID            *uint64
 	snapshotRejected    *metrics.Counter
 	queue               *leaderInfoQueue
+	journal             *eventJournal
 	hasLeader           *metrics.Gauge
 	term                *metrics.Gauge
 	campaignLaunched    *metrics.Counter
 	campaignSkipped     *metrics.Counter
+	readBacklogRejected *metrics.Counter
+	readBacklogStale    *metrics.Counter
 	termValue           uint64
 	nodeID              uint64
 	clusterID           uint64
+	name                string
 	metrics             bool
 }
 
 var _ server.IRaftEventListener = (*raftEventListener)(nil)
 
-func newRaftEventListener(clusterID uint64, nodeID uint64,
+func newRaftEventListener(clusterID uint64, nodeID uint64, name string,
 	leaderID *uint64, useMetrics bool,
-	queue *leaderInfoQueue) *raftEventListener {
+	queue *leaderInfoQueue, journal *eventJournal) *raftEventListener {
 	el := &raftEventListener{
+		name:      name,
 		clusterID: clusterID,
 		nodeID:    nodeID,
 		leaderID:  leaderID,
 		metrics:   useMetrics,
 		queue:     queue,
+		journal:   journal,
 	}
 	if useMetrics {
 		label := fmt.Sprintf(`{clusterid="%d",nodeid="%d"}`, clusterID, nodeID)
@@ -75,6 +81,10 @@ func newRaftEventListener(clusterID uint64, nodeID uint64,
 		el.proposalDropped = metrics.GetOrCreateCounter(name)
 		name = fmt.Sprintf(`dragonboat_raftnode_read_index_dropped_total%s`, label)
 		el.readIndexDropped = metrics.GetOrCreateCounter(name)
+		name = fmt.Sprintf(`dragonboat_raftnode_read_backlog_rejected_total%s`, label)
+		el.readBacklogRejected = metrics.GetOrCreateCounter(name)
+		name = fmt.Sprintf(`dragonboat_raftnode_read_backlog_stale_total%s`, label)
+		el.readBacklogStale = metrics.GetOrCreateCounter(name)
 		name = fmt.Sprintf(`dragonboat_raftnode_has_leader%s`, label)
 		el.hasLeader = metrics.GetOrCreateGauge(name, func() float64 {
 			if atomic.LoadUint64(leaderID) == raftio.NoLeader {
@@ -93,21 +103,44 @@ func newRaftEventListener(clusterID uint64, nodeID uint64,
 func (e *raftEventListener) stop() {
 }
 
+// readShed records a read request rejected or served as a stale read due to
+// the apply backlog of the local node.
+func (e *raftEventListener) readShed(stale bool) {
+	if e.metrics {
+		if stale {
+			e.readBacklogStale.Add(1)
+		} else {
+			e.readBacklogRejected.Add(1)
+		}
+	}
+}
+
 func (e *raftEventListener) LeaderUpdated(info server.LeaderInfo) {
 	atomic.StoreUint64(e.leaderID, info.LeaderID)
 	atomic.StoreUint64(&e.termValue, info.Term)
+	e.journal.record(JournalEvent{
+		Type:     "LeaderUpdated",
+		Term:     info.Term,
+		LeaderID: info.LeaderID,
+	})
 	if e.queue != nil {
 		ui := raftio.LeaderInfo{
-			ClusterID: info.ClusterID,
-			NodeID:    info.NodeID,
-			Term:      info.Term,
-			LeaderID:  info.LeaderID,
+			ClusterID:   info.ClusterID,
+			NodeID:      info.NodeID,
+			Term:        info.Term,
+			LeaderID:    info.LeaderID,
+			ClusterName: e.name,
 		}
 		e.queue.addLeaderInfo(ui)
 	}
 }
 
 func (e *raftEventListener) CampaignLaunched(info server.CampaignInfo) {
+	t := "CampaignLaunched"
+	if info.PreVote {
+		t = "PreVoteCampaignLaunched"
+	}
+	e.journal.record(JournalEvent{Type: t, Term: info.Term})
 	if e.metrics {
 		e.campaignLaunched.Add(1)
 	}
@@ -204,6 +237,30 @@ func (l *sysEventListener) handle(e server.SystemEvent) {
 		l.ul.LogCompacted(getEntryInfo(e))
 	case server.LogDBCompacted:
 		l.ul.LogDBCompacted(getEntryInfo(e))
+	case server.NodePanicked:
+		if pl, ok := l.ul.(raftio.INodePanicListener); ok {
+			pl.NodePanicked(getNodePanicInfo(e))
+		}
+	case server.ChecksumMismatch:
+		if cl, ok := l.ul.(raftio.IChecksumMismatchListener); ok {
+			cl.ChecksumMismatch(raftio.ChecksumMismatchInfo{
+				ClusterID: e.ClusterID,
+				NodeID:    e.NodeID,
+				Index:     e.Index,
+				Reason:    e.Reason,
+			})
+		}
+	case server.AddressChanged:
+		if al, ok := l.ul.(raftio.IAddressChangedListener); ok {
+			al.AddressChanged(getAddressChangedInfo(e))
+		}
+	case server.PeerHealthChanged:
+		if hl, ok := l.ul.(raftio.IPeerHealthListener); ok {
+			hl.PeerHealthChanged(raftio.PeerHealthInfo{
+				Address:   e.Address,
+				Reachable: e.Reachable,
+			})
+		}
 	default:
 		panic("unknown event type")
 	}
@@ -225,6 +282,23 @@ func getNodeInfo(e server.SystemEvent) raftio.NodeInfo {
 	}
 }
 
+func getAddressChangedInfo(e server.SystemEvent) raftio.AddressChangedInfo {
+	return raftio.AddressChangedInfo{
+		Address:  e.Address,
+		Previous: e.PreviousIPs,
+		Current:  e.CurrentIPs,
+	}
+}
+
+func getNodePanicInfo(e server.SystemEvent) raftio.NodePanicInfo {
+	return raftio.NodePanicInfo{
+		ClusterID: e.ClusterID,
+		NodeID:    e.NodeID,
+		Reason:    e.Reason,
+		Restart:   e.Restart,
+	}
+}
+
 func getEntryInfo(e server.SystemEvent) raftio.EntryInfo {
 	return raftio.EntryInfo{
 		ClusterID: e.ClusterID,
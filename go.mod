@@ -7,7 +7,9 @@ require (
 	github.com/golang/snappy v0.0.3-0.20201103224600-674baa8c7fc3
 	github.com/hashicorp/memberlist v0.2.2
 	github.com/juju/ratelimit v1.0.2-0.20191002062651-f60b32039441
+	github.com/klauspost/compress v1.11.13
 	github.com/lni/goutils v1.3.0
+	go.etcd.io/bbolt v1.3.6
 )
 
 go 1.14
@@ -0,0 +1,161 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+)
+
+const (
+	historyFilename    = "dragonboat.history"
+	historyTmpFilename = "dragonboat.history.tmp"
+	historyRecordSize  = 17
+)
+
+type historyRecord struct {
+	clusterID uint64
+	nodeID    uint64
+	removed   bool
+}
+
+type historyRecords []historyRecord
+
+func (h *historyRecords) Marshal() ([]byte, error) {
+	data := make([]byte, len(*h)*historyRecordSize)
+	for i, r := range *h {
+		v := data[i*historyRecordSize:]
+		binary.BigEndian.PutUint64(v, r.clusterID)
+		binary.BigEndian.PutUint64(v[8:], r.nodeID)
+		if r.removed {
+			v[16] = 1
+		}
+	}
+	return data, nil
+}
+
+func (h *historyRecords) Unmarshal(data []byte) error {
+	if len(data)%historyRecordSize != 0 {
+		return errors.New("invalid replica history data")
+	}
+	records := make(historyRecords, 0, len(data)/historyRecordSize)
+	for i := 0; i < len(data); i += historyRecordSize {
+		v := data[i:]
+		records = append(records, historyRecord{
+			clusterID: binary.BigEndian.Uint64(v),
+			nodeID:    binary.BigEndian.Uint64(v[8:]),
+			removed:   v[16] == 1,
+		})
+	}
+	*h = records
+	return nil
+}
+
+// replicaHistory is the persistent record of NodeIDs used by each Raft cluster
+// on the local NodeHost together with NodeIDs known to have been removed from
+// those Raft clusters. It is used to refuse to start nodes with NodeIDs that
+// have already been removed, such reused NodeIDs break the safety of Raft.
+type replicaHistory struct {
+	mu      sync.Mutex
+	dir     string
+	fs      vfs.IFS
+	records map[historyRecord]struct{}
+}
+
+func loadReplicaHistory(dir string, fs vfs.IFS) (*replicaHistory, error) {
+	h := &replicaHistory{
+		dir:     dir,
+		fs:      fs,
+		records: make(map[historyRecord]struct{}),
+	}
+	if !fileutil.HasFlagFile(dir, historyFilename, fs) {
+		return h, nil
+	}
+	var records historyRecords
+	if err := fileutil.GetFlagFileContent(dir,
+		historyFilename, &records, fs); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		h.records[r] = struct{}{}
+	}
+	return h, nil
+}
+
+// isRemoved returns a boolean value indicating whether the specified node is
+// known to have been removed from its Raft cluster.
+func (h *replicaHistory) isRemoved(clusterID uint64, nodeID uint64) bool {
+	if h == nil {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.records[historyRecord{clusterID, nodeID, true}]
+	return ok
+}
+
+// used records that the specified node has been started on the local NodeHost.
+func (h *replicaHistory) used(clusterID uint64, nodeID uint64) error {
+	return h.add([]historyRecord{{clusterID, nodeID, false}})
+}
+
+// removed records that the specified nodes have been removed from the Raft
+// cluster.
+func (h *replicaHistory) removed(clusterID uint64, nodeIDs []uint64) error {
+	records := make([]historyRecord, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		records = append(records, historyRecord{clusterID, nodeID, true})
+	}
+	return h.add(records)
+}
+
+func (h *replicaHistory) add(records []historyRecord) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	updated := false
+	for _, r := range records {
+		if _, ok := h.records[r]; !ok {
+			h.records[r] = struct{}{}
+			updated = true
+		}
+	}
+	if !updated {
+		return nil
+	}
+	return h.save()
+}
+
+func (h *replicaHistory) save() error {
+	records := make(historyRecords, 0, len(h.records))
+	for r := range h.records {
+		records = append(records, r)
+	}
+	if err := fileutil.CreateFlagFile(h.dir,
+		historyTmpFilename, &records, h.fs); err != nil {
+		return err
+	}
+	if err := h.fs.Rename(h.fs.PathJoin(h.dir, historyTmpFilename),
+		h.fs.PathJoin(h.dir, historyFilename)); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(h.dir, h.fs)
+}
@@ -0,0 +1,73 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"testing"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+)
+
+func TestReplicaHistoryCanBeLoaded(t *testing.T) {
+	fs := vfs.GetTestFS()
+	dir := "history_test_dir_safe_to_delete"
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create dir %v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(dir); err != nil {
+			t.Fatalf("failed to remove dir %v", err)
+		}
+	}()
+	h, err := loadReplicaHistory(dir, fs)
+	if err != nil {
+		t.Fatalf("failed to load history %v", err)
+	}
+	if err := h.used(1, 2); err != nil {
+		t.Fatalf("failed to record used node %v", err)
+	}
+	if h.isRemoved(1, 2) {
+		t.Errorf("unexpectedly removed")
+	}
+	if err := h.removed(1, []uint64{2, 3}); err != nil {
+		t.Fatalf("failed to record removed nodes %v", err)
+	}
+	h, err = loadReplicaHistory(dir, fs)
+	if err != nil {
+		t.Fatalf("failed to load history %v", err)
+	}
+	if len(h.records) != 3 {
+		t.Errorf("unexpected record count %d", len(h.records))
+	}
+	if !h.isRemoved(1, 2) || !h.isRemoved(1, 3) {
+		t.Errorf("removed nodes not recorded")
+	}
+	if h.isRemoved(2, 2) || h.isRemoved(1, 4) {
+		t.Errorf("unexpectedly removed")
+	}
+}
+
+func TestNilReplicaHistoryCanBeUsed(t *testing.T) {
+	var h *replicaHistory
+	if err := h.used(1, 2); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := h.removed(1, []uint64{2}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if h.isRemoved(1, 2) {
+		t.Errorf("unexpectedly removed")
+	}
+}
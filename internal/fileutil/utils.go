@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"runtime"
 	"strconv"
 	"strings"
@@ -375,3 +376,44 @@ func TempFile(dir,
 	}
 	return
 }
+
+// CopyFile copies the src file to dst and syncs the parent directory of dst.
+func CopyFile(src string, dst string, fs vfs.IFS) (err error) {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := in.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if runtime.GOOS != "windows" {
+		of, ok := out.(*os.File)
+		if ok {
+			if err := of.Chmod(fi.Mode()); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return SyncDir(fs.PathDir(dst), fs)
+}
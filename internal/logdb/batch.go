@@ -15,6 +15,7 @@
 package logdb
 
 import (
+	"encoding/binary"
 	"errors"
 	"math"
 
@@ -141,19 +142,21 @@ func getMergedFirstBatch(eb pb.EntryBatch, lb pb.EntryBatch) pb.EntryBatch {
 }
 
 type batchedEntries struct {
-	cs   *cache
-	keys *keyPool
-	kvs  kv.IKVStore
+	cs    *cache
+	keys  *keyPool
+	kvs   kv.IKVStore
+	codec *entryCodec
 }
 
 var _ entryManager = (*batchedEntries)(nil)
 
 func newBatchedEntries(cs *cache,
-	keys *keyPool, kvs kv.IKVStore) entryManager {
+	keys *keyPool, kvs kv.IKVStore, codec *entryCodec) entryManager {
 	return &batchedEntries{
-		cs:   cs,
-		keys: keys,
-		kvs:  kvs,
+		cs:    cs,
+		keys:  keys,
+		kvs:   kvs,
+		codec: codec,
 	}
 }
 
@@ -213,7 +216,7 @@ func (be *batchedEntries) iterateBatches(clusterID uint64,
 	expectedID := low
 	op := func(key []byte, data []byte) (bool, error) {
 		var eb pb.EntryBatch
-		if err := eb.Unmarshal(data); err != nil {
+		if err := be.unmarshal(data, &eb); err != nil {
 			panic(err)
 		}
 		if getBatchID(eb.Entries[0].Index) != expectedID {
@@ -242,7 +245,7 @@ func (be *batchedEntries) getRange(clusterID uint64,
 	length := uint64(0)
 	op := func(key []byte, data []byte) (bool, error) {
 		var eb pb.EntryBatch
-		if err := eb.Unmarshal(data); err != nil {
+		if err := be.unmarshal(data, &eb); err != nil {
 			panic(err)
 		}
 		if len(eb.Entries) == 0 {
@@ -288,6 +291,93 @@ func (be *batchedEntries) rangedOp(clusterID uint64,
 	return op(fk, lk)
 }
 
+func (be *batchedEntries) count(data []byte) (uint64, error) {
+	var eb pb.EntryBatch
+	if err := be.unmarshal(data, &eb); err != nil {
+		return 0, err
+	}
+	return uint64(len(eb.Entries)), nil
+}
+
+func (be *batchedEntries) setRecordKey(k *Key,
+	clusterID uint64, nodeID uint64, index uint64) {
+	k.SetEntryBatchKey(clusterID, nodeID, getBatchID(index))
+}
+
+func (be *batchedEntries) decode(key []byte,
+	data []byte) ([]pb.Entry, uint64, uint64, error) {
+	batchID := binary.BigEndian.Uint64(key[20:])
+	low := batchID * batchSize
+	high := low + batchSize - 1
+	var eb pb.EntryBatch
+	if err := be.unmarshal(data, &eb); err != nil {
+		return nil, low, high, err
+	}
+	if len(eb.Entries) > 1 {
+		eb = restoreBatchFields(eb)
+	}
+	return eb.Entries, low, high, nil
+}
+
+// truncate removes all entries after the specified index. The batch that
+// contains the specified index is rewritten to only keep entries up to index.
+func (be *batchedEntries) truncate(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	batchID := getBatchID(index + 1)
+	fk := be.keys.get()
+	lk := be.keys.get()
+	defer fk.Release()
+	defer lk.Release()
+	fk.SetEntryBatchKey(clusterID, nodeID, batchID+1)
+	lk.SetEntryBatchKey(clusterID, nodeID, math.MaxUint64)
+	if err := be.kvs.BulkRemoveEntries(fk.Key(), lk.Key()); err != nil {
+		return err
+	}
+	var eb pb.EntryBatch
+	fk.SetEntryBatchKey(clusterID, nodeID, batchID)
+	if err := be.kvs.GetValue(fk.Key(), func(data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+		if err := be.unmarshal(data, &eb); err != nil {
+			eb = pb.EntryBatch{}
+			return nil
+		}
+		if len(eb.Entries) > 1 {
+			eb = restoreBatchFields(eb)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	kept := pb.EntryBatch{}
+	for _, e := range eb.Entries {
+		if e.Index <= index {
+			kept.Entries = append(kept.Entries, e)
+		}
+	}
+	if len(kept.Entries) == 0 {
+		return be.kvs.DeleteValue(fk.Key())
+	}
+	be.cs.setLastBatch(clusterID, nodeID, kept)
+	if len(kept.Entries) > 1 {
+		kept = compactBatchFields(kept)
+	}
+	data, err := kept.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return be.kvs.SaveValue(fk.Key(), be.codec.encode(data))
+}
+
+func (be *batchedEntries) unmarshal(data []byte, eb *pb.EntryBatch) error {
+	data, err := be.codec.decode(data)
+	if err != nil {
+		return err
+	}
+	return eb.Unmarshal(data)
+}
+
 func (be *batchedEntries) recordBatch(wb kv.IWriteBatch,
 	clusterID uint64, nodeID uint64, eb pb.EntryBatch,
 	firstBatchID uint64, lastBatchID uint64, ctx IContext) {
@@ -314,7 +404,7 @@ func (be *batchedEntries) recordBatch(wb kv.IWriteBatch,
 	if err != nil {
 		panic(err)
 	}
-	data = data[:sz]
+	data = be.codec.encode(data[:sz])
 	k := ctx.GetKey()
 	k.SetEntryBatchKey(clusterID, nodeID, batchID)
 	wb.Put(k.Key(), data)
@@ -362,7 +452,7 @@ func (be *batchedEntries) getBatchFromDB(clusterID uint64,
 		if len(data) == 0 {
 			return errors.New("no such entry")
 		}
-		if err := e.Unmarshal(data); err != nil {
+		if err := be.unmarshal(data, &e); err != nil {
 			panic(err)
 		}
 		return nil
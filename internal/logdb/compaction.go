@@ -25,6 +25,8 @@ type task struct {
 	clusterID uint64
 	nodeID    uint64
 	index     uint64
+	// bytes is the estimated size of removed entries to be compacted
+	bytes uint64
 }
 
 type compactionInfo struct {
@@ -34,15 +36,26 @@ type compactionInfo struct {
 
 type compactions struct {
 	pendings map[raftio.NodeInfo]compactionInfo
+	removed  map[raftio.NodeInfo]uint64
 	mu       sync.Mutex
 }
 
 func newCompactions() *compactions {
 	return &compactions{
 		pendings: make(map[raftio.NodeInfo]compactionInfo),
+		removed:  make(map[raftio.NodeInfo]uint64),
 	}
 }
 
+// addRemoved records the estimated size of entries removed from the specified
+// node, they are to be reclaimed by the next compaction task of the node.
+func (p *compactions) addRemoved(clusterID uint64, nodeID uint64, bytes uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+	p.removed[key] += bytes
+}
+
 func (p *compactions) len() int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -79,8 +92,10 @@ func (p *compactions) getTask() (task, bool) {
 			nodeID:    k.NodeID,
 			index:     v.index,
 			done:      v.done,
+			bytes:     p.removed[k],
 		}
 		delete(p.pendings, k)
+		delete(p.removed, k)
 		return task, true
 	}
 	return task{}, false
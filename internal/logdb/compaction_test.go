@@ -17,9 +17,13 @@ package logdb
 import (
 	"reflect"
 	"testing"
+	"time"
 
-	"github.com/lni/dragonboat/v3/raftio"
+	"github.com/juju/ratelimit"
 	"github.com/lni/goutils/leaktest"
+	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat/v3/raftio"
 )
 
 func TestCompactionTaskCanBeCreated(t *testing.T) {
@@ -141,3 +145,53 @@ func TestMovingCompactionIndexBackWillCausePanic(t *testing.T) {
 	p.addTask(task{clusterID: 1, nodeID: 2, index: 3})
 	p.addTask(task{clusterID: 1, nodeID: 2, index: 2})
 }
+
+func TestRemovedBytesAreReturnedWithCompactionTask(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	p := newCompactions()
+	p.addRemoved(1, 2, 100)
+	p.addRemoved(1, 2, 200)
+	p.addRemoved(2, 2, 300)
+	p.addTask(task{clusterID: 1, nodeID: 2, index: 3})
+	task, ok := p.getTask()
+	if !ok {
+		t.Fatalf("failed to get task")
+	}
+	if task.bytes != 300 {
+		t.Errorf("bytes %d, want 300", task.bytes)
+	}
+	if len(p.removed) != 1 {
+		t.Errorf("removed bytes not cleared")
+	}
+}
+
+func TestCompactionCanBeThrottled(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	s := &ShardedDB{
+		compactionBucket: ratelimit.NewBucketWithRate(1000, 1000),
+		stopper:          syncutil.NewStopper(),
+	}
+	if !s.throttleCompaction(1000) {
+		t.Fatalf("unexpectedly stopped")
+	}
+	start := time.Now()
+	if !s.throttleCompaction(100) {
+		t.Fatalf("unexpectedly stopped")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("compaction not throttled")
+	}
+	stopped := make(chan bool, 1)
+	go func() {
+		stopped <- s.throttleCompaction(1000000)
+	}()
+	s.stopper.Stop()
+	select {
+	case v := <-stopped:
+		if v {
+			t.Errorf("unexpected return value")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("throttled compaction not stopped")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/lni/dragonboat/v3/internal/settings"
+)
+
+// Entry records are colfer encoded, their first byte is either the index of
+// the first non-zero field, optionally with the 0x80 flag set, or the 0x7F
+// terminator of an empty entry. Entry batch records are protobuf encoded and
+// start with the 0x0A tag of the entries field. Compressed records are
+// prefixed with a two bytes header, a marker byte that never appears as the
+// first byte of those records followed by the codec used for compressing the
+// record. Records written by earlier versions or not worth compressing are
+// stored as is.
+const (
+	codecHeaderMarker byte = 0xFF
+	codecHeaderSize        = 2
+	zstdCodec         byte = 1
+)
+
+var (
+	// maxCompressedRecordSize is the max size of records to be compressed, it
+	// also limits the size of decompressed records so corrupted records can not
+	// cause unbounded allocations.
+	maxCompressedRecordSize = settings.LargeEntitySize
+)
+
+var (
+	// ErrUnknownEntryCodec indicates that the codec recorded in the header of
+	// an entry record is unknown.
+	ErrUnknownEntryCodec = errors.New("unknown entry codec")
+)
+
+// entryCodec compresses and decompresses stored entry records. Its zstd
+// encoder and decoder are lazily created when they are first required.
+type entryCodec struct {
+	threshold uint64
+	mu        sync.Mutex
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+}
+
+func newEntryCodec(threshold uint64) *entryCodec {
+	return &entryCodec{threshold: threshold}
+}
+
+// encode returns the compressed form of data when data is large enough and
+// compressible, data itself is returned otherwise. Records larger than
+// maxCompressedRecordSize are never compressed.
+func (c *entryCodec) encode(data []byte) []byte {
+	if c.threshold == 0 || uint64(len(data)) < c.threshold ||
+		uint64(len(data)) > maxCompressedRecordSize {
+		return data
+	}
+	buf := make([]byte, codecHeaderSize, codecHeaderSize+len(data))
+	buf[0] = codecHeaderMarker
+	buf[1] = zstdCodec
+	result := c.getEncoder().EncodeAll(data, buf)
+	if len(result) >= len(data) {
+		return data
+	}
+	return result
+}
+
+// decode returns the uncompressed form of data.
+func (c *entryCodec) decode(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != codecHeaderMarker {
+		return data, nil
+	}
+	if len(data) < codecHeaderSize || data[1] != zstdCodec {
+		return nil, ErrUnknownEntryCodec
+	}
+	return c.getDecoder().DecodeAll(data[codecHeaderSize:], nil)
+}
+
+func (c *entryCodec) getEncoder() *zstd.Encoder {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.encoder == nil {
+		encoder, err := zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			panic(err)
+		}
+		c.encoder = encoder
+	}
+	return c.encoder
+}
+
+func (c *entryCodec) getDecoder() *zstd.Decoder {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.decoder == nil {
+		decoder, err := zstd.NewReader(nil,
+			zstd.WithDecoderMaxMemory(maxCompressedRecordSize))
+		if err != nil {
+			panic(err)
+		}
+		c.decoder = decoder
+	}
+	return c.decoder
+}
+
+func (c *entryCodec) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.encoder != nil {
+		if err := c.encoder.Close(); err != nil {
+			panic(err)
+		}
+		c.encoder = nil
+	}
+	if c.decoder != nil {
+		c.decoder.Close()
+		c.decoder = nil
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+func TestEntryCodecCompressesLargeRecords(t *testing.T) {
+	c := newEntryCodec(1024)
+	defer c.close()
+	small := bytes.Repeat([]byte{0x0A}, 512)
+	if v := c.encode(small); !bytes.Equal(v, small) {
+		t.Errorf("small record compressed")
+	}
+	large := bytes.Repeat([]byte{0x0A}, 4096)
+	v := c.encode(large)
+	if len(v) >= len(large) || v[0] != codecHeaderMarker || v[1] != zstdCodec {
+		t.Fatalf("large record not compressed")
+	}
+	decoded, err := c.decode(v)
+	if err != nil {
+		t.Fatalf("failed to decode %v", err)
+	}
+	if !bytes.Equal(decoded, large) {
+		t.Errorf("unexpected decoded record")
+	}
+	decoded, err = c.decode(small)
+	if err != nil || !bytes.Equal(decoded, small) {
+		t.Errorf("uncompressed record changed, %v", err)
+	}
+}
+
+func TestEntryCodecRejectsUnknownCodec(t *testing.T) {
+	c := newEntryCodec(0)
+	defer c.close()
+	v := []byte{codecHeaderMarker, 0x7F, 0x1}
+	if _, err := c.decode(v); err != ErrUnknownEntryCodec {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := c.decode(v[:1]); err != ErrUnknownEntryCodec {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestEntryCodecLimitsRecordSize(t *testing.T) {
+	orig := maxCompressedRecordSize
+	maxCompressedRecordSize = 8192
+	defer func() {
+		maxCompressedRecordSize = orig
+	}()
+	large := bytes.Repeat([]byte{0x0A}, 16384)
+	encoder := newEntryCodec(1024)
+	defer encoder.close()
+	if v := encoder.encode(large); !bytes.Equal(v, large) {
+		t.Errorf("record larger than the limit compressed")
+	}
+	maxCompressedRecordSize = uint64(len(large))
+	v := encoder.encode(large)
+	if v[0] != codecHeaderMarker {
+		t.Fatalf("record not compressed")
+	}
+	decoder := newEntryCodec(1024)
+	defer decoder.close()
+	maxCompressedRecordSize = 8192
+	if _, err := decoder.decode(v); err == nil {
+		t.Errorf("record decompressed beyond the limit")
+	}
+}
+
+func TestEntryCodecSkipsIncompressibleRecords(t *testing.T) {
+	c := newEntryCodec(1)
+	defer c.close()
+	data := []byte{0x0A, 0x01, 0x02}
+	if v := c.encode(data); !bytes.Equal(v, data) {
+		t.Errorf("incompressible record changed")
+	}
+}
+
+func testCompressedEntriesCanBeRead(t *testing.T, batched bool) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	dir := fs.PathJoin(RDBTestDirectory, "db-dir")
+	if err := fs.RemoveAll(RDBTestDirectory); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer deleteTestDB(fs)
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	open := func(threshold uint64) *ShardedDB {
+		expert := config.GetDefaultExpertConfig()
+		expert.LogDB.Shards = 1
+		expert.LogDB.EntryCompressionThreshold = threshold
+		cfg := config.NodeHostConfig{Expert: expert}
+		db, err := OpenShardedDB(cfg, nil,
+			[]string{dir}, nil, batched, false, fs, newDefaultKVStore)
+		if err != nil {
+			t.Fatalf("failed to open db %v", err)
+		}
+		return db
+	}
+	save := func(db *ShardedDB, low uint64, high uint64) {
+		ents := make([]pb.Entry, 0)
+		for i := low; i < high; i++ {
+			ents = append(ents, pb.Entry{Index: i, Term: 1, Cmd: make([]byte, 2048)})
+		}
+		ud := pb.Update{
+			ClusterID:     1,
+			NodeID:        1,
+			State:         pb.State{Term: 1, Commit: low},
+			EntriesToSave: ents,
+		}
+		if err := db.SaveRaftState([]pb.Update{ud}, 1); err != nil {
+			t.Fatalf("failed to save raft state %v", err)
+		}
+	}
+	check := func(db *ShardedDB, high uint64) {
+		ents, _, err := db.IterateEntries(nil, 0, 1, 1, 1, high, math.MaxUint64)
+		if err != nil {
+			t.Fatalf("failed to iterate entries %v", err)
+		}
+		if uint64(len(ents)) != high-1 {
+			t.Fatalf("got %d entries, want %d", len(ents), high-1)
+		}
+		for idx, e := range ents {
+			if e.Index != uint64(idx+1) || len(e.Cmd) != 2048 {
+				t.Fatalf("unexpected entry %d", e.Index)
+			}
+		}
+		rs, err := db.ReadRaftState(1, 1, 0)
+		if err != nil || rs.FirstIndex != 1 || rs.EntryCount != high-1 {
+			t.Fatalf("unexpected raft state %+v, %v", rs, err)
+		}
+	}
+	// uncompressed entries written by an earlier version
+	db := open(0)
+	save(db, 1, 10)
+	db.Close()
+	db = open(1024)
+	save(db, 10, 20)
+	check(db, 20)
+	compressed := 0
+	fk := newKey(maxKeySize, nil)
+	lk := newKey(maxKeySize, nil)
+	fk.SetMinimumKey()
+	lk.SetMaximumKey()
+	if err := db.shards[0].kvs.IterateValue(fk.Key(), lk.Key(), true,
+		func(key []byte, data []byte) (bool, error) {
+			if data[0] == codecHeaderMarker {
+				compressed++
+			}
+			return true, nil
+		}); err != nil {
+		t.Fatalf("failed to iterate %v", err)
+	}
+	if compressed == 0 {
+		t.Errorf("no compressed record found")
+	}
+	db.Close()
+	// compression disabled, compressed entries can still be read
+	db = open(0)
+	defer db.Close()
+	check(db, 20)
+}
+
+func TestCompressedEntriesCanBeRead(t *testing.T) {
+	testCompressedEntriesCanBeRead(t, false)
+	testCompressedEntriesCanBeRead(t, true)
+}
@@ -42,6 +42,10 @@ type entryManager interface {
 		maxIndex uint64) (uint64, uint64, error)
 	rangedOp(clusterID uint64,
 		nodeID uint64, index uint64, op func(*Key, *Key) error) error
+	count(data []byte) (uint64, error)
+	setRecordKey(k *Key, clusterID uint64, nodeID uint64, index uint64)
+	decode(key []byte, data []byte) ([]pb.Entry, uint64, uint64, error)
+	truncate(clusterID uint64, nodeID uint64, index uint64) error
 }
 
 // db is the struct used to manage log DB.
@@ -50,6 +54,8 @@ type db struct {
 	keys    *keyPool
 	kvs     kv.IKVStore
 	entries entryManager
+	codec   *entryCodec
+	gc      *groupCommitter
 }
 
 func hasEntryRecord(kvs kv.IKVStore, batched bool) (bool, error) {
@@ -82,17 +88,22 @@ func openRDB(config config.LogDBConfig,
 	}
 	cs := newCache()
 	pool := newLogDBKeyPool()
+	codec := newEntryCodec(config.EntryCompressionThreshold)
 	var em entryManager
 	if batched {
-		em = newBatchedEntries(cs, pool, kvs)
+		em = newBatchedEntries(cs, pool, kvs, codec)
 	} else {
-		em = newPlainEntries(cs, pool, kvs)
+		em = newPlainEntries(cs, pool, kvs, codec)
 	}
+	gc := newGroupCommitter(config.GroupCommitMaxDelay,
+		config.GroupCommitMaxBytes)
 	return &db{
 		cs:      cs,
 		keys:    pool,
 		kvs:     kvs,
 		entries: em,
+		codec:   codec,
+		gc:      gc,
 	}, nil
 }
 
@@ -113,6 +124,7 @@ func (r *db) close() {
 	if err := r.kvs.Close(); err != nil {
 		panic(err)
 	}
+	r.codec.close()
 }
 
 func (r *db) getWriteBatch(ctx IContext) kv.IWriteBatch {
@@ -177,6 +189,10 @@ func (r *db) getRange(clusterID uint64,
 }
 
 func (r *db) saveRaftState(updates []pb.Update, ctx IContext) error {
+	return r.gc.save(updates, ctx, r.writeRaftState)
+}
+
+func (r *db) writeRaftState(updates []pb.Update, ctx IContext) error {
 	wb := r.getWriteBatch(ctx)
 	for _, ud := range updates {
 		r.saveState(ud.ClusterID, ud.NodeID, ud.State, wb, ctx)
@@ -474,6 +490,31 @@ func (r *db) compact(clusterID uint64, nodeID uint64, index uint64) error {
 	return r.entries.rangedOp(clusterID, nodeID, index, op)
 }
 
+// estimateCompaction returns the number of entries and their total key value
+// size in bytes that would be removed when removing and compacting entries up
+// to the specified index. The same key range used by removeEntriesTo and
+// compact is scanned.
+func (r *db) estimateCompaction(clusterID uint64,
+	nodeID uint64, index uint64) (raftio.CompactionEstimate, error) {
+	result := raftio.CompactionEstimate{}
+	op := func(fk *Key, lk *Key) error {
+		f := func(key []byte, data []byte) (bool, error) {
+			n, err := r.entries.count(data)
+			if err != nil {
+				return false, err
+			}
+			result.EntryCount += n
+			result.Bytes += uint64(len(key) + len(data))
+			return true, nil
+		}
+		return r.kvs.IterateValue(fk.Key(), lk.Key(), false, f)
+	}
+	if err := r.entries.rangedOp(clusterID, nodeID, index, op); err != nil {
+		return raftio.CompactionEstimate{}, err
+	}
+	return result, nil
+}
+
 func (r *db) saveEntries(updates []pb.Update, wb kv.IWriteBatch, ctx IContext) {
 	for _, ud := range updates {
 		if len(ud.EntriesToSave) > 0 {
@@ -22,6 +22,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/juju/ratelimit"
 	"github.com/lni/goutils/leaktest"
 
 	"github.com/lni/dragonboat/v3/config"
@@ -1504,3 +1505,106 @@ func TestImportSnapshot(t *testing.T) {
 	fs := vfs.GetTestFS()
 	runLogDBTest(t, tf, fs)
 }
+
+func TestEstimateCompaction(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		clusterID := uint64(2)
+		nodeID := uint64(3)
+		ents := make([]pb.Entry, 0)
+		for i := uint64(1); i <= batchSize*4; i++ {
+			ents = append(ents, pb.Entry{Index: i, Term: 1, Cmd: make([]byte, 128)})
+		}
+		ud := pb.Update{
+			EntriesToSave: ents,
+			State:         pb.State{Commit: 1, Term: 1},
+			ClusterID:     clusterID,
+			NodeID:        nodeID,
+		}
+		if err := db.SaveRaftState([]pb.Update{ud}, 1); err != nil {
+			t.Fatalf("failed to save raft state %v", err)
+		}
+		e, ok := db.(raftio.ICompactionEstimator)
+		if !ok {
+			t.Fatalf("ICompactionEstimator not implemented")
+		}
+		index := batchSize*3 + 2
+		est, err := e.EstimateCompaction(clusterID, nodeID, index)
+		if err != nil {
+			t.Fatalf("failed to estimate compaction %v", err)
+		}
+		if est.EntryCount == 0 || est.Bytes < est.EntryCount*128 {
+			t.Errorf("unexpected estimate %+v", est)
+		}
+		if err := db.RemoveEntriesTo(clusterID, nodeID, index); err != nil {
+			t.Fatalf("failed to remove entries %v", err)
+		}
+		rs, err := db.ReadRaftState(clusterID, nodeID, 0)
+		if err != nil {
+			t.Fatalf("failed to read raft state %v", err)
+		}
+		if rs.FirstIndex-1 != est.EntryCount {
+			t.Errorf("estimated %d entries, %d removed",
+				est.EntryCount, rs.FirstIndex-1)
+		}
+		est, err = e.EstimateCompaction(clusterID, nodeID, index)
+		if err != nil {
+			t.Fatalf("failed to estimate compaction %v", err)
+		}
+		if est.EntryCount != 0 || est.Bytes != 0 {
+			t.Errorf("unexpected estimate %+v", est)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runLogDBTest(t, tf, fs)
+}
+
+func TestRateLimitedCompaction(t *testing.T) {
+	tf := func(t *testing.T, db raftio.ILogDB) {
+		sdb, ok := db.(*ShardedDB)
+		if !ok {
+			t.Fatalf("not a ShardedDB")
+		}
+		sdb.compactionBucket = ratelimit.NewBucketWithRate(1024*1024, 1024*1024)
+		clusterID := uint64(2)
+		nodeID := uint64(3)
+		ents := make([]pb.Entry, 0)
+		for i := uint64(1); i <= batchSize*4; i++ {
+			ents = append(ents, pb.Entry{Index: i, Term: 1, Cmd: make([]byte, 128)})
+		}
+		ud := pb.Update{
+			EntriesToSave: ents,
+			State:         pb.State{Commit: 1, Term: 1},
+			ClusterID:     clusterID,
+			NodeID:        nodeID,
+		}
+		if err := db.SaveRaftState([]pb.Update{ud}, 1); err != nil {
+			t.Fatalf("failed to save raft state %v", err)
+		}
+		index := batchSize*3 + 2
+		est, err := sdb.EstimateCompaction(clusterID, nodeID, index)
+		if err != nil {
+			t.Fatalf("failed to estimate compaction %v", err)
+		}
+		if err := db.RemoveEntriesTo(clusterID, nodeID, index); err != nil {
+			t.Fatalf("failed to remove entries %v", err)
+		}
+		ni := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+		sdb.compactions.mu.Lock()
+		removed := sdb.compactions.removed[ni]
+		sdb.compactions.mu.Unlock()
+		if removed == 0 || removed != est.Bytes {
+			t.Errorf("removed bytes %d, want %d", removed, est.Bytes)
+		}
+		done, err := db.CompactEntriesTo(clusterID, nodeID, index)
+		if err != nil {
+			t.Fatalf("failed to compact entries %v", err)
+		}
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("compaction not completed")
+		}
+	}
+	fs := vfs.GetTestFS()
+	runLogDBTest(t, tf, fs)
+}
@@ -0,0 +1,319 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+const (
+	defaultEntryCacheShards = 16
+	// max number of recently missed entries tracked by each cache shard for the
+	// EntryCacheAdmitOnSecondMiss policy
+	ghostCapacity = 8192
+)
+
+type entryKey struct {
+	clusterID uint64
+	nodeID    uint64
+	index     uint64
+}
+
+type cachedEntry struct {
+	key   entryKey
+	entry pb.Entry
+	size  uint64
+}
+
+// nodeEntries tracks per node state of an entry cache shard. gen is bumped
+// each time cached entries of the node are invalidated so concurrent reads
+// started before the invalidation won't admit stale entries. maxIndex is the
+// max index of all cached entries of the node.
+type nodeEntries struct {
+	gen      uint64
+	maxIndex uint64
+}
+
+type entryCacheShard struct {
+	mu        sync.Mutex
+	capacity  uint64
+	size      uint64
+	lru       *list.List
+	entries   map[entryKey]*list.Element
+	nodes     map[raftio.NodeInfo]*nodeEntries
+	ghosts    map[entryKey]struct{}
+	ghostKeys []entryKey
+	ghostPos  int
+}
+
+// entryCache is a sharded LRU cache of Raft log entries read from the
+// underlying KV store.
+type entryCache struct {
+	admission config.EntryCacheAdmissionPolicy
+	shards    []*entryCacheShard
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	metrics   *entryCacheMetrics
+}
+
+type entryCacheMetrics struct {
+	hits      *metrics.Counter
+	misses    *metrics.Counter
+	evictions *metrics.Counter
+}
+
+func newEntryCache(cfg config.LogDBConfig, useMetrics bool) *entryCache {
+	if cfg.EntryCacheSize == 0 {
+		return nil
+	}
+	count := cfg.EntryCacheShards
+	if count == 0 {
+		count = defaultEntryCacheShards
+	}
+	c := &entryCache{
+		admission: cfg.EntryCacheAdmission,
+		shards:    make([]*entryCacheShard, count),
+	}
+	for i := range c.shards {
+		c.shards[i] = &entryCacheShard{
+			capacity: cfg.EntryCacheSize / count,
+			lru:      list.New(),
+			entries:  make(map[entryKey]*list.Element),
+			nodes:    make(map[raftio.NodeInfo]*nodeEntries),
+		}
+		if c.admission == config.EntryCacheAdmitOnSecondMiss {
+			c.shards[i].ghosts = make(map[entryKey]struct{})
+			c.shards[i].ghostKeys = make([]entryKey, 0, ghostCapacity)
+		}
+	}
+	if useMetrics {
+		c.metrics = &entryCacheMetrics{
+			hits: metrics.GetOrCreateCounter(
+				"dragonboat_logdb_entry_cache_hit_total"),
+			misses: metrics.GetOrCreateCounter(
+				"dragonboat_logdb_entry_cache_miss_total"),
+			evictions: metrics.GetOrCreateCounter(
+				"dragonboat_logdb_entry_cache_eviction_total"),
+		}
+	}
+	return c
+}
+
+func (c *entryCache) getShard(clusterID uint64, nodeID uint64) *entryCacheShard {
+	return c.shards[(clusterID*31+nodeID)%uint64(len(c.shards))]
+}
+
+// iterate returns entries in the range of [low, high) of the specified node,
+// the longest prefix of the range available in the cache is served from the
+// cache, remaining entries are loaded using the specified load function.
+func (c *entryCache) iterate(ents []pb.Entry, size uint64,
+	clusterID uint64, nodeID uint64, low uint64, high uint64, maxSize uint64,
+	load func([]pb.Entry, uint64, uint64) ([]pb.Entry, uint64, error)) (
+	[]pb.Entry, uint64, error) {
+	s := c.getShard(clusterID, nodeID)
+	hits := uint64(0)
+	s.mu.Lock()
+	gen := s.getNode(clusterID, nodeID).gen
+	for ; low < high; low++ {
+		e, ok := s.get(entryKey{clusterID, nodeID, low})
+		if !ok {
+			break
+		}
+		ents = append(ents, e)
+		size += uint64(e.SizeUpperLimit())
+		hits++
+		if size > maxSize {
+			low = high
+			break
+		}
+	}
+	s.mu.Unlock()
+	c.addHits(hits)
+	if low == high {
+		return ents, size, nil
+	}
+	n := len(ents)
+	ents, size, err := load(ents, size, low)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.addMisses(uint64(len(ents) - n))
+	c.admit(s, clusterID, nodeID, gen, ents[n:])
+	return ents, size, nil
+}
+
+func (c *entryCache) admit(s *entryCacheShard,
+	clusterID uint64, nodeID uint64, gen uint64, ents []pb.Entry) {
+	if len(ents) == 0 {
+		return
+	}
+	evicted := uint64(0)
+	s.mu.Lock()
+	ne := s.getNode(clusterID, nodeID)
+	if ne.gen == gen {
+		for _, e := range ents {
+			key := entryKey{clusterID, nodeID, e.Index}
+			if c.admission == config.EntryCacheAdmitOnSecondMiss &&
+				!s.missedBefore(key) {
+				continue
+			}
+			evicted += s.add(key, e)
+			if e.Index > ne.maxIndex {
+				ne.maxIndex = e.Index
+			}
+		}
+	}
+	s.mu.Unlock()
+	c.addEvictions(evicted)
+}
+
+// invalidateFrom removes all cached entries of the specified node with index
+// values not less than the specified index.
+func (c *entryCache) invalidateFrom(clusterID uint64,
+	nodeID uint64, index uint64) {
+	s := c.getShard(clusterID, nodeID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ne := s.getNode(clusterID, nodeID)
+	ne.gen++
+	if index > ne.maxIndex {
+		return
+	}
+	for key, elem := range s.entries {
+		if key.clusterID == clusterID &&
+			key.nodeID == nodeID && key.index >= index {
+			s.remove(elem)
+		}
+	}
+	if index > 0 {
+		ne.maxIndex = index - 1
+	} else {
+		ne.maxIndex = 0
+	}
+}
+
+func (c *entryCache) getStats() raftio.EntryCacheStats {
+	stats := raftio.EntryCacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Entries += uint64(len(s.entries))
+		stats.Bytes += s.size
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+func (c *entryCache) addHits(v uint64) {
+	if v > 0 {
+		atomic.AddUint64(&c.hits, v)
+		if c.metrics != nil {
+			c.metrics.hits.Add(int(v))
+		}
+	}
+}
+
+func (c *entryCache) addMisses(v uint64) {
+	if v > 0 {
+		atomic.AddUint64(&c.misses, v)
+		if c.metrics != nil {
+			c.metrics.misses.Add(int(v))
+		}
+	}
+}
+
+func (c *entryCache) addEvictions(v uint64) {
+	if v > 0 {
+		atomic.AddUint64(&c.evictions, v)
+		if c.metrics != nil {
+			c.metrics.evictions.Add(int(v))
+		}
+	}
+}
+
+func (s *entryCacheShard) getNode(clusterID uint64,
+	nodeID uint64) *nodeEntries {
+	key := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+	ne, ok := s.nodes[key]
+	if !ok {
+		ne = &nodeEntries{}
+		s.nodes[key] = ne
+	}
+	return ne
+}
+
+func (s *entryCacheShard) get(key entryKey) (pb.Entry, bool) {
+	elem, ok := s.entries[key]
+	if !ok {
+		return pb.Entry{}, false
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*cachedEntry).entry, true
+}
+
+func (s *entryCacheShard) add(key entryKey, e pb.Entry) uint64 {
+	sz := uint64(e.SizeUpperLimit())
+	if sz > s.capacity {
+		return 0
+	}
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	ce := &cachedEntry{key: key, entry: e, size: sz}
+	s.entries[key] = s.lru.PushFront(ce)
+	s.size += sz
+	evicted := uint64(0)
+	for s.size > s.capacity {
+		s.remove(s.lru.Back())
+		evicted++
+	}
+	return evicted
+}
+
+func (s *entryCacheShard) remove(elem *list.Element) {
+	ce := s.lru.Remove(elem).(*cachedEntry)
+	delete(s.entries, ce.key)
+	s.size -= ce.size
+}
+
+// missedBefore returns a boolean value indicating whether the specified key
+// has been recently missed, the key is recorded as missed when it is not.
+func (s *entryCacheShard) missedBefore(key entryKey) bool {
+	if _, ok := s.ghosts[key]; ok {
+		delete(s.ghosts, key)
+		return true
+	}
+	if len(s.ghostKeys) < ghostCapacity {
+		s.ghostKeys = append(s.ghostKeys, key)
+	} else {
+		delete(s.ghosts, s.ghostKeys[s.ghostPos])
+		s.ghostKeys[s.ghostPos] = key
+		s.ghostPos = (s.ghostPos + 1) % ghostCapacity
+	}
+	s.ghosts[key] = struct{}{}
+	return false
+}
@@ -0,0 +1,236 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+func getTestEntryCache(size uint64,
+	admission config.EntryCacheAdmissionPolicy) *entryCache {
+	return newEntryCache(config.LogDBConfig{
+		EntryCacheSize:      size,
+		EntryCacheShards:    1,
+		EntryCacheAdmission: admission,
+	}, false)
+}
+
+func getTestEntryLoader(loaded *uint64) func([]pb.Entry,
+	uint64, uint64) ([]pb.Entry, uint64, error) {
+	return func(ents []pb.Entry,
+		size uint64, low uint64) ([]pb.Entry, uint64, error) {
+		for i := low; i < 10; i++ {
+			e := pb.Entry{Index: i, Term: 1, Cmd: make([]byte, 16)}
+			ents = append(ents, e)
+			size += uint64(e.SizeUpperLimit())
+			*loaded++
+		}
+		return ents, size, nil
+	}
+}
+
+func TestEntryCacheIsDisabledByDefault(t *testing.T) {
+	if c := newEntryCache(config.GetDefaultLogDBConfig(), false); c != nil {
+		t.Errorf("entry cache unexpectedly enabled")
+	}
+}
+
+func TestEntryCacheServesCachedEntries(t *testing.T) {
+	c := getTestEntryCache(1024*1024, config.EntryCacheAdmitAll)
+	loaded := uint64(0)
+	load := getTestEntryLoader(&loaded)
+	ents, _, err := c.iterate(nil, 0, 1, 1, 1, 10, 1024*1024, load)
+	if err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	if len(ents) != 9 || loaded != 9 {
+		t.Fatalf("unexpected result, %d, %d", len(ents), loaded)
+	}
+	ents, _, err = c.iterate(nil, 0, 1, 1, 1, 10, 1024*1024, load)
+	if err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	if len(ents) != 9 || loaded != 9 {
+		t.Fatalf("unexpected result, %d, %d", len(ents), loaded)
+	}
+	for i, e := range ents {
+		if e.Index != uint64(i+1) {
+			t.Errorf("unexpected entry index %d", e.Index)
+		}
+	}
+	stats := c.getStats()
+	if stats.Hits != 9 || stats.Misses != 9 || stats.Entries != 9 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestEntryCacheRespectsMaxSize(t *testing.T) {
+	c := getTestEntryCache(1024*1024, config.EntryCacheAdmitAll)
+	loaded := uint64(0)
+	load := getTestEntryLoader(&loaded)
+	if _, _, err := c.iterate(nil, 0, 1, 1, 1, 10, 1024*1024, load); err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	ents, _, err := c.iterate(nil, 0, 1, 1, 1, 10, 1, load)
+	if err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	if len(ents) != 1 {
+		t.Errorf("unexpected entry count %d", len(ents))
+	}
+}
+
+func TestEntryCacheEvictsEntries(t *testing.T) {
+	sz := uint64((&pb.Entry{Index: 1, Term: 1,
+		Cmd: make([]byte, 16)}).SizeUpperLimit())
+	c := getTestEntryCache(sz*4, config.EntryCacheAdmitAll)
+	loaded := uint64(0)
+	load := getTestEntryLoader(&loaded)
+	if _, _, err := c.iterate(nil, 0, 1, 1, 1, 10, 1024*1024, load); err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	stats := c.getStats()
+	if stats.Entries != 4 || stats.Evictions != 5 || stats.Bytes != sz*4 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	// the oldest entries were evicted, the range is thus loaded again
+	if _, _, err := c.iterate(nil, 0, 1, 1, 1, 10, 1024*1024, load); err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	if loaded != 18 {
+		t.Errorf("unexpected loaded count %d", loaded)
+	}
+}
+
+func TestEntryCacheInvalidation(t *testing.T) {
+	c := getTestEntryCache(1024*1024, config.EntryCacheAdmitAll)
+	loaded := uint64(0)
+	load := getTestEntryLoader(&loaded)
+	if _, _, err := c.iterate(nil, 0, 1, 1, 1, 10, 1024*1024, load); err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	c.invalidateFrom(1, 1, 5)
+	if stats := c.getStats(); stats.Entries != 4 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if _, _, err := c.iterate(nil, 0, 1, 1, 1, 10, 1024*1024, load); err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	if loaded != 14 {
+		t.Errorf("unexpected loaded count %d", loaded)
+	}
+}
+
+func TestEntryCacheDoesNotAdmitStaleEntries(t *testing.T) {
+	c := getTestEntryCache(1024*1024, config.EntryCacheAdmitAll)
+	load := func(ents []pb.Entry,
+		size uint64, low uint64) ([]pb.Entry, uint64, error) {
+		// entries are overwritten after being loaded
+		c.invalidateFrom(1, 1, low)
+		return append(ents, pb.Entry{Index: low, Term: 1}), size, nil
+	}
+	if _, _, err := c.iterate(nil, 0, 1, 1, 1, 2, 1024*1024, load); err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	if stats := c.getStats(); stats.Entries != 0 {
+		t.Errorf("stale entry admitted, %+v", stats)
+	}
+}
+
+func TestEntryCacheAdmitOnSecondMiss(t *testing.T) {
+	c := getTestEntryCache(1024*1024, config.EntryCacheAdmitOnSecondMiss)
+	loaded := uint64(0)
+	load := getTestEntryLoader(&loaded)
+	if _, _, err := c.iterate(nil, 0, 1, 1, 1, 10, 1024*1024, load); err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	if stats := c.getStats(); stats.Entries != 0 {
+		t.Errorf("entries admitted on first miss, %+v", stats)
+	}
+	if _, _, err := c.iterate(nil, 0, 1, 1, 1, 10, 1024*1024, load); err != nil {
+		t.Fatalf("iterate failed %v", err)
+	}
+	if stats := c.getStats(); stats.Entries != 9 {
+		t.Errorf("entries not admitted on second miss, %+v", stats)
+	}
+}
+
+func TestShardedDBEntryCache(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	defer deleteTestDB(fs)
+	dir := fs.PathJoin(RDBTestDirectory, "db-dir")
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expert := config.GetDefaultExpertConfig()
+	expert.LogDB = config.GetTinyMemLogDBConfig()
+	expert.LogDB.Shards = 1
+	expert.LogDB.EntryCacheSize = 1024 * 1024
+	cfg := config.NodeHostConfig{Expert: expert}
+	db, err := NewLogDB(cfg,
+		nil, []string{dir}, nil, false, true, fs, newDefaultKVStore)
+	if err != nil {
+		t.Fatalf("failed to open db %v", err)
+	}
+	defer db.Close()
+	save := func(term uint64, first uint64, last uint64) {
+		ud := pb.Update{
+			ClusterID: 1,
+			NodeID:    1,
+			State:     pb.State{Commit: 1, Term: term},
+		}
+		for i := first; i <= last; i++ {
+			ud.EntriesToSave = append(ud.EntriesToSave,
+				pb.Entry{Index: i, Term: term})
+		}
+		if err := db.SaveRaftState([]pb.Update{ud}, 1); err != nil {
+			t.Fatalf("failed to save raft state %v", err)
+		}
+	}
+	read := func() []pb.Entry {
+		ents, _, err := db.IterateEntries(nil, 0, 1, 1, 1, 11, 1024*1024)
+		if err != nil {
+			t.Fatalf("failed to iterate entries %v", err)
+		}
+		return ents
+	}
+	save(1, 1, 10)
+	read()
+	read()
+	r := db.(raftio.IEntryCacheStatsReporter)
+	if stats := r.GetEntryCacheStats(); stats.Hits != 10 || stats.Misses != 10 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	// conflicting entries are overwritten
+	save(2, 6, 10)
+	ents := read()
+	if len(ents) != 10 {
+		t.Fatalf("unexpected entry count %d", len(ents))
+	}
+	for _, e := range ents {
+		if (e.Index <= 5 && e.Term != 1) || (e.Index > 5 && e.Term != 2) {
+			t.Errorf("unexpected entry %+v", e)
+		}
+	}
+}
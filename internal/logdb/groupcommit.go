@@ -0,0 +1,126 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"sync"
+	"time"
+
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+// commitGroup is a group of Raft updates to be written using a single write
+// batch.
+type commitGroup struct {
+	updates []pb.Update
+	bytes   uint64
+	sealed  bool
+	fullC   chan struct{}
+	doneC   chan struct{}
+	err     error
+}
+
+func newCommitGroup() *commitGroup {
+	return &commitGroup{
+		fullC: make(chan struct{}),
+		doneC: make(chan struct{}),
+	}
+}
+
+// groupCommitter coalesces Raft updates concurrently saved into the same
+// LogDB shard. The first saver of each group becomes its leader, it waits for
+// up to maxDelay or until the group has maxBytes of entries and then writes
+// updates of all group members, other members just wait for the result.
+// Latency critical updates bypass the group and are immediately written.
+type groupCommitter struct {
+	mu       sync.Mutex
+	maxDelay time.Duration
+	maxBytes uint64
+	pending  *commitGroup
+}
+
+func newGroupCommitter(maxDelay time.Duration,
+	maxBytes uint64) *groupCommitter {
+	if maxDelay == 0 {
+		return nil
+	}
+	return &groupCommitter{maxDelay: maxDelay, maxBytes: maxBytes}
+}
+
+func (gc *groupCommitter) save(updates []pb.Update, ctx IContext,
+	write func([]pb.Update, IContext) error) error {
+	if gc == nil || latencyCritical(updates) {
+		return write(updates, ctx)
+	}
+	g, leader := gc.join(updates)
+	if !leader {
+		<-g.doneC
+		return g.err
+	}
+	timer := time.NewTimer(gc.maxDelay)
+	select {
+	case <-timer.C:
+	case <-g.fullC:
+		timer.Stop()
+	}
+	gc.seal(g)
+	g.err = write(g.updates, ctx)
+	close(g.doneC)
+	return g.err
+}
+
+func latencyCritical(updates []pb.Update) bool {
+	for _, ud := range updates {
+		if ud.LatencyCritical {
+			return true
+		}
+	}
+	return false
+}
+
+func (gc *groupCommitter) join(updates []pb.Update) (*commitGroup, bool) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	leader := false
+	if gc.pending == nil {
+		gc.pending = newCommitGroup()
+		leader = true
+	}
+	g := gc.pending
+	g.updates = append(g.updates, updates...)
+	for _, ud := range updates {
+		g.bytes += pb.GetEntrySliceSize(ud.EntriesToSave)
+	}
+	if gc.maxBytes > 0 && g.bytes >= gc.maxBytes {
+		gc.sealLocked(g)
+		close(g.fullC)
+	}
+	return g, leader
+}
+
+func (gc *groupCommitter) seal(g *commitGroup) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.sealLocked(g)
+}
+
+func (gc *groupCommitter) sealLocked(g *commitGroup) {
+	if !g.sealed {
+		g.sealed = true
+		if gc.pending == g {
+			gc.pending = nil
+		}
+	}
+}
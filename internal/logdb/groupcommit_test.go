@@ -0,0 +1,212 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+type testGroupWriter struct {
+	mu     sync.Mutex
+	writes [][]pb.Update
+}
+
+func (w *testGroupWriter) write(updates []pb.Update, ctx IContext) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, updates)
+	return nil
+}
+
+func (w *testGroupWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.writes)
+}
+
+func getTestGroupUpdate(clusterID uint64, cmdSize int) []pb.Update {
+	return []pb.Update{
+		{
+			ClusterID: clusterID,
+			NodeID:    1,
+			EntriesToSave: []pb.Entry{
+				{Index: 1, Term: 1, Cmd: make([]byte, cmdSize)},
+			},
+		},
+	}
+}
+
+func TestGroupCommitIsDisabledByDefault(t *testing.T) {
+	if gc := newGroupCommitter(0, 1024); gc != nil {
+		t.Fatalf("group committer unexpectedly created")
+	}
+	w := &testGroupWriter{}
+	var gc *groupCommitter
+	for i := uint64(1); i <= 3; i++ {
+		if err := gc.save(getTestGroupUpdate(i, 1), nil, w.write); err != nil {
+			t.Fatalf("save failed %v", err)
+		}
+	}
+	if w.count() != 3 {
+		t.Errorf("unexpected write count %d", w.count())
+	}
+}
+
+func TestGroupCommitCoalescesConcurrentSaves(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	gc := newGroupCommitter(time.Second, 0)
+	w := &testGroupWriter{}
+	var wg sync.WaitGroup
+	// the leader waits for the max delay, all others join the same group
+	if _, leader := gc.join(getTestGroupUpdate(1, 1)); !leader {
+		t.Fatalf("not leader")
+	}
+	g := gc.pending
+	for i := uint64(2); i <= 4; i++ {
+		wg.Add(1)
+		go func(clusterID uint64) {
+			defer wg.Done()
+			if err := gc.save(getTestGroupUpdate(clusterID, 1),
+				nil, w.write); err != nil {
+				t.Errorf("save failed %v", err)
+			}
+		}(i)
+	}
+	for {
+		gc.mu.Lock()
+		n := len(g.updates)
+		gc.mu.Unlock()
+		if n == 4 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	gc.seal(g)
+	g.err = w.write(g.updates, nil)
+	close(g.doneC)
+	wg.Wait()
+	if w.count() != 1 || len(w.writes[0]) != 4 {
+		t.Errorf("saves not coalesced, %d writes", w.count())
+	}
+}
+
+func TestGroupCommitWritesFullGroupWithoutDelay(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	gc := newGroupCommitter(time.Hour, 1024)
+	w := &testGroupWriter{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := gc.save(getTestGroupUpdate(1, 2048), nil, w.write); err != nil {
+			t.Errorf("save failed %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("full group not written")
+	}
+	if w.count() != 1 {
+		t.Errorf("unexpected write count %d", w.count())
+	}
+	if gc.pending != nil {
+		t.Errorf("full group not sealed")
+	}
+}
+
+func TestLatencyCriticalUpdatesBypassGroupCommit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	gc := newGroupCommitter(time.Hour, 0)
+	w := &testGroupWriter{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		updates := getTestGroupUpdate(1, 1)
+		updates[0].LatencyCritical = true
+		if err := gc.save(updates, nil, w.write); err != nil {
+			t.Errorf("save failed %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("latency critical update not written")
+	}
+	if w.count() != 1 {
+		t.Errorf("unexpected write count %d", w.count())
+	}
+	if gc.pending != nil {
+		t.Errorf("unexpected pending group")
+	}
+}
+
+func TestShardedDBGroupCommit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	defer deleteTestDB(fs)
+	dir := fs.PathJoin(RDBTestDirectory, "db-dir")
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expert := config.GetDefaultExpertConfig()
+	expert.LogDB = config.GetTinyMemLogDBConfig()
+	expert.LogDB.Shards = 1
+	expert.LogDB.GroupCommitMaxDelay = 5 * time.Millisecond
+	cfg := config.NodeHostConfig{Expert: expert}
+	db, err := NewLogDB(cfg,
+		nil, []string{dir}, nil, false, true, fs, newDefaultKVStore)
+	if err != nil {
+		t.Fatalf("failed to open db %v", err)
+	}
+	defer db.Close()
+	var wg sync.WaitGroup
+	for i := uint64(1); i <= 8; i++ {
+		wg.Add(1)
+		go func(clusterID uint64) {
+			defer wg.Done()
+			ud := pb.Update{
+				ClusterID: clusterID,
+				NodeID:    1,
+				State:     pb.State{Commit: 1, Term: 1},
+			}
+			for j := uint64(1); j <= 10; j++ {
+				ud.EntriesToSave = append(ud.EntriesToSave,
+					pb.Entry{Index: j, Term: 1, Cmd: make([]byte, 16)})
+			}
+			if err := db.SaveRaftState([]pb.Update{ud}, clusterID); err != nil {
+				t.Errorf("failed to save raft state %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := uint64(1); i <= 8; i++ {
+		ents, _, err := db.IterateEntries(nil, 0, i, 1, 1, 11, 1024*1024)
+		if err != nil {
+			t.Fatalf("failed to iterate entries %v", err)
+		}
+		if len(ents) != 10 {
+			t.Errorf("cluster %d, unexpected entry count %d", i, len(ents))
+		}
+	}
+}
@@ -0,0 +1,483 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+const (
+	isolatedDirPrefix = "logdb-cluster-"
+	probeDirName      = "logdb-probe"
+)
+
+var (
+	// ErrLogDBLayoutChanged indicates that the LogDBConfig.PerClusterInstance
+	// option has been changed after data has been stored in the LogDB.
+	ErrLogDBLayoutChanged = errors.New("logdb directory layout changed")
+)
+
+// IsolatedDB is a LogDB implementation that gives each Raft cluster its own
+// single shard ShardedDB instance stored in its own directory. Raft clusters
+// thus don't share any write ahead log, memtable or compaction worker.
+type IsolatedDB struct {
+	mu       sync.RWMutex
+	clusters map[uint64]*ShardedDB
+	config   config.NodeHostConfig
+	cb       config.LogDBCallback
+	dir      string
+	lldir    string
+	name     string
+	batched  bool
+	check    bool
+	fs       vfs.IFS
+	kvf      kvFactory
+}
+
+var _ raftio.ILogDB = (*IsolatedDB)(nil)
+var _ raftio.ICompactionEstimator = (*IsolatedDB)(nil)
+var _ raftio.IEntryCacheStatsReporter = (*IsolatedDB)(nil)
+var _ raftio.ILogDBScanner = (*IsolatedDB)(nil)
+
+// OpenIsolatedDB creates an IsolatedDB instance. Per cluster instances found
+// in the specified directory are opened immediately, other per cluster
+// instances are created when they are first accessed.
+func OpenIsolatedDB(cfg config.NodeHostConfig, cb config.LogDBCallback,
+	dir string, lldir string, batched bool, check bool,
+	fs vfs.IFS, kvf kvFactory) (*IsolatedDB, error) {
+	if cfg.Expert.LogDB.IsEmpty() {
+		panic("cfg.Expert.LogDB.IsEmpty()")
+	}
+	if check && batched {
+		plog.Panicf("check and batched both set")
+	}
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return nil, err
+	}
+	// each per cluster instance is a ShardedDB with a single shard accessed by a
+	// single execution engine worker
+	cfg.Expert.LogDB.Shards = 1
+	cfg.Expert.Engine.ExecShards = 1
+	s := &IsolatedDB{
+		clusters: make(map[uint64]*ShardedDB),
+		config:   cfg,
+		cb:       cb,
+		dir:      dir,
+		lldir:    lldir,
+		batched:  batched,
+		check:    check,
+		fs:       fs,
+		kvf:      kvf,
+	}
+	clusterIDs, err := s.listClusters()
+	if err != nil {
+		return nil, err
+	}
+	for _, clusterID := range clusterIDs {
+		if _, err := s.getCluster(clusterID); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if err := s.setName(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *IsolatedDB) listClusters() ([]uint64, error) {
+	exist, err := fileutil.Exist(s.fs.PathJoin(s.dir, "logdb-0"), s.fs)
+	if err != nil {
+		return nil, err
+	}
+	if exist {
+		return nil, ErrLogDBLayoutChanged
+	}
+	names, err := s.fs.List(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint64, 0)
+	for _, name := range names {
+		if !strings.HasPrefix(name, isolatedDirPrefix) {
+			continue
+		}
+		v := strings.TrimPrefix(name, isolatedDirPrefix)
+		clusterID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		result = append(result, clusterID)
+	}
+	return result, nil
+}
+
+// setName sets the type name of the instance, a temporary instance is created
+// to get the name of the underlying KV store when there is no per cluster
+// instance yet.
+func (s *IsolatedDB) setName() error {
+	for _, c := range s.clusters {
+		s.name = c.Name()
+		return nil
+	}
+	dir := s.fs.PathJoin(s.dir, probeDirName)
+	if err := s.fs.RemoveAll(dir); err != nil {
+		return err
+	}
+	db, err := OpenShardedDB(s.config, nil,
+		[]string{dir}, nil, s.batched, false, s.fs, s.kvf)
+	if err != nil {
+		return err
+	}
+	s.name = db.Name()
+	db.Close()
+	return s.fs.RemoveAll(dir)
+}
+
+func (s *IsolatedDB) getClusterDirs(clusterID uint64) (string, string) {
+	name := fmt.Sprintf("%s%d", isolatedDirPrefix, clusterID)
+	lldir := ""
+	if len(s.lldir) > 0 {
+		lldir = s.fs.PathJoin(s.lldir, name)
+	}
+	return s.fs.PathJoin(s.dir, name), lldir
+}
+
+func (s *IsolatedDB) getCluster(clusterID uint64) (*ShardedDB, error) {
+	s.mu.RLock()
+	c, ok := s.clusters[clusterID]
+	s.mu.RUnlock()
+	if ok {
+		return c, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.clusters[clusterID]; ok {
+		return c, nil
+	}
+	dir, lldir := s.getClusterDirs(clusterID)
+	var lldirs []string
+	if len(lldir) > 0 {
+		lldirs = []string{lldir}
+	}
+	var cb config.LogDBCallback
+	if s.cb != nil {
+		cb = func(info config.LogDBInfo) {
+			info.Shard = clusterID
+			s.cb(info)
+		}
+	}
+	c, err := OpenShardedDB(s.config, cb,
+		[]string{dir}, lldirs, s.batched, s.check, s.fs, s.kvf)
+	if err != nil {
+		return nil, err
+	}
+	s.clusters[clusterID] = c
+	return c, nil
+}
+
+// ClusterDiskUsage returns the number of bytes used by the LogDB instance of
+// the specified Raft cluster.
+func (s *IsolatedDB) ClusterDiskUsage(clusterID uint64) (uint64, error) {
+	dir, lldir := s.getClusterDirs(clusterID)
+	total, err := getDiskUsage(dir, s.fs)
+	if err != nil {
+		return 0, err
+	}
+	if len(lldir) > 0 {
+		sz, err := getDiskUsage(lldir, s.fs)
+		if err != nil {
+			return 0, err
+		}
+		total += sz
+	}
+	return total, nil
+}
+
+func getDiskUsage(dir string, fs vfs.IFS) (uint64, error) {
+	exist, err := fileutil.Exist(dir, fs)
+	if err != nil || !exist {
+		return 0, err
+	}
+	names, err := fs.List(dir)
+	if err != nil {
+		return 0, err
+	}
+	total := uint64(0)
+	for _, name := range names {
+		fp := fs.PathJoin(dir, name)
+		fi, err := fs.Stat(fp)
+		if err != nil {
+			return 0, err
+		}
+		if fi.IsDir() {
+			sz, err := getDiskUsage(fp, fs)
+			if err != nil {
+				return 0, err
+			}
+			total += sz
+		} else {
+			total += uint64(fi.Size())
+		}
+	}
+	return total, nil
+}
+
+// Name returns the type name of the instance.
+func (s *IsolatedDB) Name() string {
+	return s.name
+}
+
+// BinaryFormat is the binary format supported by the isolated DB.
+func (s *IsolatedDB) BinaryFormat() uint32 {
+	if s.batched {
+		return raftio.LogDBBinVersion
+	}
+	return raftio.PlainLogDBBinVersion
+}
+
+// SelfCheckFailed runs a self check on all per cluster instances and report
+// whether any failure is observed.
+func (s *IsolatedDB) SelfCheckFailed() (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.clusters {
+		failed, err := c.SelfCheckFailed()
+		if err != nil {
+			return false, err
+		}
+		if failed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SaveRaftState saves the raft state and logs found in the raft.Update list
+// to the log db. Updates of different Raft clusters are saved into their own
+// per cluster instances one by one.
+func (s *IsolatedDB) SaveRaftState(updates []pb.Update, shardID uint64) error {
+	for i := range updates {
+		c, err := s.getCluster(updates[i].ClusterID)
+		if err != nil {
+			return err
+		}
+		if err := c.SaveRaftState(updates[i:i+1], 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRaftState returns the persistent state of the specified raft node.
+func (s *IsolatedDB) ReadRaftState(clusterID uint64,
+	nodeID uint64, lastIndex uint64) (raftio.RaftState, error) {
+	c, err := s.getCluster(clusterID)
+	if err != nil {
+		return raftio.RaftState{}, err
+	}
+	return c.ReadRaftState(clusterID, nodeID, lastIndex)
+}
+
+// ListNodeInfo lists all available NodeInfo found in the log db.
+func (s *IsolatedDB) ListNodeInfo() ([]raftio.NodeInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r := make([]raftio.NodeInfo, 0)
+	for _, c := range s.clusters {
+		n, err := c.ListNodeInfo()
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, n...)
+	}
+	return r, nil
+}
+
+// SaveSnapshots saves all snapshot metadata found in the raft.Update list.
+func (s *IsolatedDB) SaveSnapshots(updates []pb.Update) error {
+	for i := range updates {
+		c, err := s.getCluster(updates[i].ClusterID)
+		if err != nil {
+			return err
+		}
+		if err := c.SaveSnapshots(updates[i : i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteSnapshot removes the specified snapshot metadata from the log db.
+func (s *IsolatedDB) DeleteSnapshot(clusterID uint64,
+	nodeID uint64, snapshotIndex uint64) error {
+	c, err := s.getCluster(clusterID)
+	if err != nil {
+		return err
+	}
+	return c.DeleteSnapshot(clusterID, nodeID, snapshotIndex)
+}
+
+// ListSnapshots lists all available snapshots associated with the specified
+// raft node.
+func (s *IsolatedDB) ListSnapshots(clusterID uint64,
+	nodeID uint64, index uint64) ([]pb.Snapshot, error) {
+	c, err := s.getCluster(clusterID)
+	if err != nil {
+		return nil, err
+	}
+	return c.ListSnapshots(clusterID, nodeID, index)
+}
+
+// SaveBootstrapInfo saves the specified bootstrap info for the given node.
+func (s *IsolatedDB) SaveBootstrapInfo(clusterID uint64,
+	nodeID uint64, bootstrap pb.Bootstrap) error {
+	c, err := s.getCluster(clusterID)
+	if err != nil {
+		return err
+	}
+	return c.SaveBootstrapInfo(clusterID, nodeID, bootstrap)
+}
+
+// GetBootstrapInfo returns the saved bootstrap info for the given node.
+func (s *IsolatedDB) GetBootstrapInfo(clusterID uint64,
+	nodeID uint64) (pb.Bootstrap, error) {
+	c, err := s.getCluster(clusterID)
+	if err != nil {
+		return pb.Bootstrap{}, err
+	}
+	return c.GetBootstrapInfo(clusterID, nodeID)
+}
+
+// IterateEntries returns a list of saved entries starting with index low up to
+// index high with a max size of maxSize.
+func (s *IsolatedDB) IterateEntries(ents []pb.Entry,
+	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
+	maxSize uint64) ([]pb.Entry, uint64, error) {
+	c, err := s.getCluster(clusterID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.IterateEntries(ents, size, clusterID, nodeID, low, high, maxSize)
+}
+
+// RemoveEntriesTo removes entries associated with the specified raft node up
+// to the specified index.
+func (s *IsolatedDB) RemoveEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	c, err := s.getCluster(clusterID)
+	if err != nil {
+		return err
+	}
+	return c.RemoveEntriesTo(clusterID, nodeID, index)
+}
+
+// CompactEntriesTo reclaims underlying storage space used for storing
+// entries up to the specified index. Each per cluster instance has its own
+// compaction worker.
+func (s *IsolatedDB) CompactEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) (<-chan struct{}, error) {
+	c, err := s.getCluster(clusterID)
+	if err != nil {
+		return nil, err
+	}
+	return c.CompactEntriesTo(clusterID, nodeID, index)
+}
+
+// EstimateCompaction reports the number of entries and the approximate number
+// of bytes that would be reclaimed by removing and compacting entries of the
+// specified raft node up to the specified index.
+func (s *IsolatedDB) EstimateCompaction(clusterID uint64,
+	nodeID uint64, index uint64) (raftio.CompactionEstimate, error) {
+	c, err := s.getCluster(clusterID)
+	if err != nil {
+		return raftio.CompactionEstimate{}, err
+	}
+	return c.EstimateCompaction(clusterID, nodeID, index)
+}
+
+// GetEntryCacheStats returns the aggregated statistics of the entry read
+// caches of all per cluster instances.
+func (s *IsolatedDB) GetEntryCacheStats() raftio.EntryCacheStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var stats raftio.EntryCacheStats
+	for _, c := range s.clusters {
+		cs := c.GetEntryCacheStats()
+		stats.Hits += cs.Hits
+		stats.Misses += cs.Misses
+		stats.Evictions += cs.Evictions
+		stats.Entries += cs.Entries
+		stats.Bytes += cs.Bytes
+	}
+	return stats
+}
+
+// Scan checks all records of all per cluster instances, see the Scan method
+// of ShardedDB for details.
+func (s *IsolatedDB) Scan(repair bool,
+	force bool) ([]raftio.NodeScanResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	results := make([]raftio.NodeScanResult, 0)
+	for _, c := range s.clusters {
+		r, err := c.Scan(repair, force)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r...)
+	}
+	return results, nil
+}
+
+// RemoveNodeData deletes all node data that belongs to the specified node.
+func (s *IsolatedDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
+	c, err := s.getCluster(clusterID)
+	if err != nil {
+		return err
+	}
+	return c.RemoveNodeData(clusterID, nodeID)
+}
+
+// ImportSnapshot imports the snapshot record and other metadata records to the
+// system.
+func (s *IsolatedDB) ImportSnapshot(ss pb.Snapshot, nodeID uint64) error {
+	c, err := s.getCluster(ss.ClusterId)
+	if err != nil {
+		return err
+	}
+	return c.ImportSnapshot(ss, nodeID)
+}
+
+// Close closes the IsolatedDB instance.
+func (s *IsolatedDB) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clusters {
+		c.Close()
+	}
+	s.clusters = make(map[uint64]*ShardedDB)
+}
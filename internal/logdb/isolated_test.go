@@ -0,0 +1,158 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+func getIsolatedTestConfig(perCluster bool) config.NodeHostConfig {
+	expert := config.GetDefaultExpertConfig()
+	expert.LogDB = config.GetTinyMemLogDBConfig()
+	expert.LogDB.Shards = 2
+	expert.LogDB.PerClusterInstance = perCluster
+	return config.NodeHostConfig{Expert: expert}
+}
+
+func openIsolatedTestDB(t *testing.T,
+	perCluster bool, fs vfs.IFS) (raftio.ILogDB, error) {
+	dir := fs.PathJoin(RDBTestDirectory, "db-dir")
+	lldir := fs.PathJoin(RDBTestDirectory, "wal-db-dir")
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := fileutil.MkdirAll(lldir, fs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return NewLogDB(getIsolatedTestConfig(perCluster), nil,
+		[]string{dir}, []string{lldir}, false, true, fs, newDefaultKVStore)
+}
+
+func TestIsolatedDBStoresClustersSeparately(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	defer deleteTestDB(fs)
+	db, err := openIsolatedTestDB(t, true, fs)
+	if err != nil {
+		t.Fatalf("failed to open db %v", err)
+	}
+	idb, ok := db.(*IsolatedDB)
+	if !ok {
+		t.Fatalf("not an IsolatedDB")
+	}
+	if idb.Name() != "sharded-pebble" {
+		t.Errorf("unexpected name %s", idb.Name())
+	}
+	updates := []pb.Update{
+		{
+			ClusterID:     1,
+			NodeID:        1,
+			State:         pb.State{Commit: 2, Term: 1},
+			EntriesToSave: []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}},
+		},
+		{
+			ClusterID:     2,
+			NodeID:        1,
+			State:         pb.State{Commit: 1, Term: 1},
+			EntriesToSave: []pb.Entry{{Index: 1, Term: 1, Cmd: make([]byte, 1024)}},
+		},
+	}
+	for _, ud := range updates {
+		err := db.SaveBootstrapInfo(ud.ClusterID, ud.NodeID, pb.Bootstrap{})
+		if err != nil {
+			t.Fatalf("failed to save bootstrap info %v", err)
+		}
+	}
+	if err := db.SaveRaftState(updates, 1); err != nil {
+		t.Fatalf("failed to save raft state %v", err)
+	}
+	for _, clusterID := range []uint64{1, 2} {
+		dir, lldir := idb.getClusterDirs(clusterID)
+		if exist, err := fileutil.Exist(dir, fs); err != nil || !exist {
+			t.Errorf("dir %s not created, %v", dir, err)
+		}
+		if exist, err := fileutil.Exist(lldir, fs); err != nil || !exist {
+			t.Errorf("dir %s not created, %v", lldir, err)
+		}
+		sz, err := idb.ClusterDiskUsage(clusterID)
+		if err != nil {
+			t.Fatalf("failed to get disk usage %v", err)
+		}
+		if sz == 0 {
+			t.Errorf("disk usage not reported")
+		}
+	}
+	db.Close()
+	db, err = openIsolatedTestDB(t, true, fs)
+	if err != nil {
+		t.Fatalf("failed to open db %v", err)
+	}
+	defer db.Close()
+	ni, err := db.ListNodeInfo()
+	if err != nil {
+		t.Fatalf("failed to list node info %v", err)
+	}
+	if len(ni) != 2 {
+		t.Errorf("unexpected node info %v", ni)
+	}
+	rs, err := db.ReadRaftState(1, 1, 0)
+	if err != nil {
+		t.Fatalf("failed to read raft state %v", err)
+	}
+	if rs.EntryCount != 2 || rs.State.Commit != 2 {
+		t.Errorf("unexpected raft state %+v", rs)
+	}
+	ents, _, err := db.IterateEntries(nil, 0, 2, 1, 1, 2, 1<<20)
+	if err != nil {
+		t.Fatalf("failed to iterate entries %v", err)
+	}
+	if len(ents) != 1 || len(ents[0].Cmd) != 1024 {
+		t.Errorf("unexpected entries %v", ents)
+	}
+}
+
+func TestLogDBLayoutChangeIsDetected(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	defer deleteTestDB(fs)
+	db, err := openIsolatedTestDB(t, true, fs)
+	if err != nil {
+		t.Fatalf("failed to open db %v", err)
+	}
+	if err := db.SaveBootstrapInfo(1, 1, pb.Bootstrap{}); err != nil {
+		t.Fatalf("failed to save bootstrap info %v", err)
+	}
+	db.Close()
+	if _, err := openIsolatedTestDB(t, false, fs); err != ErrLogDBLayoutChanged {
+		t.Errorf("unexpected error %v", err)
+	}
+	deleteTestDB(fs)
+	db, err = openIsolatedTestDB(t, false, fs)
+	if err != nil {
+		t.Fatalf("failed to open db %v", err)
+	}
+	db.Close()
+	if _, err := openIsolatedTestDB(t, true, fs); err != ErrLogDBLayoutChanged {
+		t.Errorf("unexpected error %v", err)
+	}
+}
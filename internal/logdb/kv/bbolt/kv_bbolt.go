@@ -0,0 +1,242 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bbolt
+
+// WARNING: bbolt support is expermental, DO NOT USE IT IN PRODUCTION.
+
+import (
+	"bytes"
+	"errors"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/logdb/kv"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+)
+
+var (
+	// ErrUnsupportedFS indicates that the specified vfs.IFS is not supported.
+	// bbolt always accesses the underlying file system directly, only the
+	// vfs.DefaultFS is supported.
+	ErrUnsupportedFS = errors.New("bbolt only supports the default fs")
+)
+
+const (
+	dbFilename = "logdb.bbolt"
+)
+
+var (
+	bucketName = []byte("logdb")
+)
+
+type writeOp struct {
+	key    []byte
+	val    []byte
+	delete bool
+}
+
+type boltWriteBatch struct {
+	db  *bolt.DB
+	ops []writeOp
+}
+
+func (w *boltWriteBatch) Destroy() {
+	w.ops = nil
+}
+
+func (w *boltWriteBatch) Put(key []byte, val []byte) {
+	w.ops = append(w.ops, writeOp{key: copyBytes(key), val: copyBytes(val)})
+}
+
+func (w *boltWriteBatch) Delete(key []byte) {
+	w.ops = append(w.ops, writeOp{key: copyBytes(key), delete: true})
+}
+
+func (w *boltWriteBatch) Clear() {
+	w.ops = w.ops[:0]
+}
+
+func (w *boltWriteBatch) Count() int {
+	return len(w.ops)
+}
+
+func copyBytes(v []byte) []byte {
+	result := make([]byte, len(v))
+	copy(result, v)
+	return result
+}
+
+// NewKVStore returns a bbolt based IKVStore instance. bbolt doesn't have a
+// separate WAL, the specified wal directory is ignored.
+func NewKVStore(config config.LogDBConfig, callback kv.LogDBCallback,
+	dir string, wal string, fs vfs.IFS) (kv.IKVStore, error) {
+	return openBoltDB(config, callback, dir, fs)
+}
+
+// KV is a bbolt based IKVStore type.
+type KV struct {
+	db *bolt.DB
+}
+
+var _ kv.IKVStore = (*KV)(nil)
+
+func openBoltDB(config config.LogDBConfig,
+	callback kv.LogDBCallback, dir string, fs vfs.IFS) (kv.IKVStore, error) {
+	if config.IsEmpty() {
+		panic("invalid LogDBConfig")
+	}
+	if fs != vfs.DefaultFS {
+		return nil, ErrUnsupportedFS
+	}
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(fs.PathJoin(dir, dbFilename), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &KV{db: db}, nil
+}
+
+// Name returns the IKVStore type name.
+func (r *KV) Name() string {
+	return "bbolt"
+}
+
+// Close closes the KV object.
+func (r *KV) Close() error {
+	return r.db.Close()
+}
+
+// IterateValue ...
+func (r *KV) IterateValue(fk []byte, lk []byte, inc bool,
+	op func(key []byte, data []byte) (bool, error)) error {
+	return r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for key, val := c.Seek(fk); key != nil; key, val = c.Next() {
+			if inc {
+				if bytes.Compare(key, lk) > 0 {
+					return nil
+				}
+			} else {
+				if bytes.Compare(key, lk) >= 0 {
+					return nil
+				}
+			}
+			cont, err := op(key, val)
+			if err != nil {
+				return err
+			}
+			if !cont {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// GetValue ...
+func (r *KV) GetValue(key []byte, op func([]byte) error) error {
+	return r.db.View(func(tx *bolt.Tx) error {
+		return op(tx.Bucket(bucketName).Get(key))
+	})
+}
+
+// SaveValue ...
+func (r *KV) SaveValue(key []byte, value []byte) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Put(key, value)
+	})
+}
+
+// DeleteValue ...
+func (r *KV) DeleteValue(key []byte) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Delete(key)
+	})
+}
+
+// GetWriteBatch ...
+func (r *KV) GetWriteBatch() kv.IWriteBatch {
+	return &boltWriteBatch{db: r.db}
+}
+
+// CommitWriteBatch atomically writes everything included in the write batch
+// into bbolt using a single transaction.
+func (r *KV) CommitWriteBatch(wb kv.IWriteBatch) error {
+	bwb, ok := wb.(*boltWriteBatch)
+	if !ok {
+		panic("unknown type")
+	}
+	if bwb.db != r.db {
+		panic("bwb.db != r.db")
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		for _, op := range bwb.ops {
+			if op.delete {
+				if err := b.Delete(op.key); err != nil {
+					return err
+				}
+			} else {
+				if err := b.Put(op.key, op.val); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// BulkRemoveEntries removes all keys in the range of [fk, lk).
+func (r *KV) BulkRemoveEntries(fk []byte, lk []byte) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		keys := make([][]byte, 0)
+		c := b.Cursor()
+		for key, _ := c.Seek(fk); key != nil; key, _ = c.Next() {
+			if bytes.Compare(key, lk) >= 0 {
+				break
+			}
+			keys = append(keys, copyBytes(key))
+		}
+		for _, key := range keys {
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CompactEntries is a no-op. Pages freed by removed entries are reused by
+// bbolt for new writes, the size of the database file never shrinks.
+func (r *KV) CompactEntries(fk []byte, lk []byte) error {
+	return nil
+}
+
+// FullCompaction is a no-op, see CompactEntries for details.
+func (r *KV) FullCompaction() error {
+	return nil
+}
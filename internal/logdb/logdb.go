@@ -21,8 +21,12 @@ to import this package.
 package logdb
 
 import (
+	"strings"
+
 	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
 	"github.com/lni/dragonboat/v3/internal/logdb/kv"
+	"github.com/lni/dragonboat/v3/internal/logdb/kv/pebble"
 	"github.com/lni/dragonboat/v3/internal/vfs"
 	"github.com/lni/dragonboat/v3/logger"
 	"github.com/lni/dragonboat/v3/raftio"
@@ -123,13 +127,56 @@ func NewDefaultBatchedLogDB(config config.NodeHostConfig,
 		callback, dirs, lldirs, true, false, fs, newDefaultKVStore)
 }
 
+// NewInMemoryLogDB creates a Log DB instance that keeps all its data in memory.
+// It is used by nodes that can afford to lose their Raft state on restart,
+// e.g. ephemeral witnesses.
+func NewInMemoryLogDB(config config.NodeHostConfig) (raftio.ILogDB, error) {
+	config.Expert.LogDB = getInMemoryLogDBConfig(config.Expert.LogDB)
+	fs := vfs.NewMem()
+	dir := "inmem"
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return OpenShardedDB(config,
+		nil, []string{dir}, nil, false, false, fs, newInMemoryKVStore)
+}
+
+func getInMemoryLogDBConfig(cfg config.LogDBConfig) config.LogDBConfig {
+	result := config.GetTinyMemLogDBConfig()
+	result.Shards = 1
+	result.KVWriteBufferSize = 1024 * 1024
+	result.KVMaxWriteBufferNumber = 2
+	result.EntryCompressionThreshold = cfg.EntryCompressionThreshold
+	return result
+}
+
+func newInMemoryKVStore(config config.LogDBConfig,
+	callback kv.LogDBCallback,
+	dir string, wal string, fs vfs.IFS) (kv.IKVStore, error) {
+	return pebble.NewKVStore(config, callback, dir, wal, fs)
+}
+
 // NewLogDB creates a Log DB instance based on provided configuration
 // parameters. The underlying KV store used by the Log DB instance is created
 // by the provided factory function.
 func NewLogDB(config config.NodeHostConfig,
 	callback config.LogDBCallback, dirs []string, lldirs []string,
 	batched bool, check bool, fs vfs.IFS, f kvFactory) (raftio.ILogDB, error) {
+	if config.Expert.LogDB.PerClusterInstance {
+		if len(dirs) != 1 || len(lldirs) > 1 {
+			plog.Panicf("per cluster instance requires a single dir")
+		}
+		lldir := ""
+		if len(lldirs) == 1 {
+			lldir = lldirs[0]
+		}
+		return OpenIsolatedDB(config,
+			callback, dirs[0], lldir, batched, check, fs, f)
+	}
 	checkDirs(config.Expert.LogDB.Shards, dirs, lldirs)
+	if err := checkFixedLayout(dirs[0], fs); err != nil {
+		return nil, err
+	}
 	llDirRequired := len(lldirs) == 1
 	if len(dirs) == 1 {
 		for i := uint64(1); i < config.Expert.LogDB.Shards; i++ {
@@ -142,6 +189,25 @@ func NewLogDB(config config.NodeHostConfig,
 	return OpenShardedDB(config, callback, dirs, lldirs, batched, check, fs, f)
 }
 
+// checkFixedLayout makes sure that no per cluster instance exists when using
+// the fixed number of LogDB shards.
+func checkFixedLayout(dir string, fs vfs.IFS) error {
+	exist, err := fileutil.Exist(dir, fs)
+	if err != nil || !exist {
+		return err
+	}
+	names, err := fs.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, isolatedDirPrefix) {
+			return ErrLogDBLayoutChanged
+		}
+	}
+	return nil
+}
+
 func checkDirs(numOfShards uint64, dirs []string, lldirs []string) {
 	if len(dirs) == 1 {
 		if len(lldirs) != 0 && len(lldirs) != 1 {
@@ -15,24 +15,30 @@
 package logdb
 
 import (
+	"encoding/binary"
+	"math"
+
 	"github.com/lni/dragonboat/v3/internal/logdb/kv"
 	"github.com/lni/dragonboat/v3/raftio"
 	pb "github.com/lni/dragonboat/v3/raftpb"
 )
 
 type plainEntries struct {
-	cs   *cache
-	keys *keyPool
-	kvs  kv.IKVStore
+	cs    *cache
+	keys  *keyPool
+	kvs   kv.IKVStore
+	codec *entryCodec
 }
 
 var _ entryManager = (*plainEntries)(nil)
 
-func newPlainEntries(cs *cache, keys *keyPool, kvs kv.IKVStore) entryManager {
+func newPlainEntries(cs *cache,
+	keys *keyPool, kvs kv.IKVStore, codec *entryCodec) entryManager {
 	return &plainEntries{
-		cs:   cs,
-		keys: keys,
-		kvs:  kvs,
+		cs:    cs,
+		keys:  keys,
+		kvs:   kvs,
+		codec: codec,
 	}
 }
 
@@ -51,7 +57,7 @@ func (pe *plainEntries) record(wb kv.IWriteBatch,
 		if err != nil {
 			panic(err)
 		}
-		data = data[:ms]
+		data = pe.codec.encode(data[:ms])
 		k := ctx.GetKey()
 		k.SetEntryKey(clusterID, nodeID, ent.Index)
 		wb.Put(k.Key(), data)
@@ -87,8 +93,8 @@ func (pe *plainEntries) iterate(ents []pb.Entry, maxIndex uint64,
 	expectedIndex := low
 	op := func(key []byte, data []byte) (bool, error) {
 		var e pb.Entry
-		if err := e.Unmarshal(data); err != nil {
-			panic(e)
+		if err := pe.unmarshal(data, &e); err != nil {
+			panic(err)
 		}
 		if e.Index != expectedIndex {
 			return false, nil
@@ -114,7 +120,7 @@ func (pe *plainEntries) getEntry(clusterID uint64,
 	k.SetEntryKey(clusterID, nodeID, index)
 	var e pb.Entry
 	op := func(v []byte) error {
-		if err := e.Unmarshal(v); err != nil {
+		if err := pe.unmarshal(v, &e); err != nil {
 			panic(err)
 		}
 		return nil
@@ -138,7 +144,7 @@ func (pe *plainEntries) getRange(clusterID uint64,
 	op := func(key []byte, data []byte) (bool, error) {
 		if firstIndex == 0 {
 			var e pb.Entry
-			if err := e.Unmarshal(data); err != nil {
+			if err := pe.unmarshal(data, &e); err != nil {
 				return false, err
 			}
 			firstIndex = e.Index
@@ -169,6 +175,44 @@ func (pe *plainEntries) rangedOp(clusterID uint64,
 	return op(fk, lk)
 }
 
+func (pe *plainEntries) count(data []byte) (uint64, error) {
+	return 1, nil
+}
+
+func (pe *plainEntries) setRecordKey(k *Key,
+	clusterID uint64, nodeID uint64, index uint64) {
+	k.SetEntryKey(clusterID, nodeID, index)
+}
+
+func (pe *plainEntries) decode(key []byte,
+	data []byte) ([]pb.Entry, uint64, uint64, error) {
+	index := binary.BigEndian.Uint64(key[20:])
+	var e pb.Entry
+	if err := pe.unmarshal(data, &e); err != nil {
+		return nil, index, index, err
+	}
+	return []pb.Entry{e}, index, index, nil
+}
+
+func (pe *plainEntries) truncate(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	fk := pe.keys.get()
+	lk := pe.keys.get()
+	defer fk.Release()
+	defer lk.Release()
+	fk.SetEntryKey(clusterID, nodeID, index+1)
+	lk.SetEntryKey(clusterID, nodeID, math.MaxUint64)
+	return pe.kvs.BulkRemoveEntries(fk.Key(), lk.Key())
+}
+
+func (pe *plainEntries) unmarshal(data []byte, e *pb.Entry) error {
+	data, err := pe.codec.decode(data)
+	if err != nil {
+		return err
+	}
+	return e.Unmarshal(data)
+}
+
 func (pe *plainEntries) binaryFormat() uint32 {
 	return raftio.PlainLogDBBinVersion
 }
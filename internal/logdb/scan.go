@@ -0,0 +1,289 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+// scan checks all records of all nodes stored in the db, see the Scan method
+// of ShardedDB for details.
+func (r *db) scan(repair bool, force bool) ([]raftio.NodeScanResult, error) {
+	nodes, err := r.listNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]raftio.NodeScanResult, 0, len(nodes))
+	for _, ni := range nodes {
+		result, err := r.scanNode(ni.ClusterID, ni.NodeID, repair, force)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (r *db) scanNode(clusterID uint64,
+	nodeID uint64, repair bool, force bool) (raftio.NodeScanResult, error) {
+	result := raftio.NodeScanResult{ClusterID: clusterID, NodeID: nodeID}
+	fixed := true
+	report := func(repairable bool, format string, args ...interface{}) {
+		result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+		if !repair || !repairable {
+			fixed = false
+		}
+	}
+	k := newKey(maxKeySize, nil)
+	k.setBootstrapKey(clusterID, nodeID)
+	if err := r.kvs.GetValue(k.Key(), func(data []byte) error {
+		var bs pb.Bootstrap
+		if err := bs.Unmarshal(data); err != nil {
+			report(false, "corrupted bootstrap record, %v", err)
+		}
+		return nil
+	}); err != nil {
+		return result, err
+	}
+	ss, err := r.scanSnapshots(clusterID, nodeID, repair, report)
+	if err != nil {
+		return result, err
+	}
+	result.SnapshotIndex = ss.Index
+	var st pb.State
+	stateOK := false
+	k.SetStateKey(clusterID, nodeID)
+	if err := r.kvs.GetValue(k.Key(), func(data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+		if err := st.Unmarshal(data); err != nil {
+			report(false, "corrupted state record, %v", err)
+			return nil
+		}
+		stateOK = true
+		return nil
+	}); err != nil {
+		return result, err
+	}
+	k.SetMaxIndexKey(clusterID, nodeID)
+	if err := r.kvs.GetValue(k.Key(), func(data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+		if len(data) != 8 {
+			report(false, "corrupted max index record, size %d", len(data))
+			return nil
+		}
+		result.MaxIndex = binary.BigEndian.Uint64(data)
+		return nil
+	}); err != nil {
+		return result, err
+	}
+	if result.MaxIndex < ss.Index {
+		report(false, "max index %d is behind snapshot index %d",
+			result.MaxIndex, ss.Index)
+		return result, nil
+	}
+	lastIndex, removable, err := r.scanEntries(clusterID,
+		nodeID, ss, result.MaxIndex, report)
+	if err != nil {
+		return result, err
+	}
+	result.LastIndex = lastIndex
+	// committed entries can only be removed when forced, otherwise the repair
+	// can break Raft's safety guarantees
+	truncate := true
+	if stateOK && st.Commit > lastIndex {
+		truncate = force
+		report(force, "commit index %d is beyond the last index %d",
+			st.Commit, lastIndex)
+	} else if !stateOK && lastIndex < result.MaxIndex {
+		truncate = force
+		report(force, "commit index unknown, entries [%d, %d] might be committed",
+			lastIndex+1, result.MaxIndex)
+	}
+	if repair {
+		if err := r.repairEntries(clusterID, nodeID, lastIndex,
+			result.MaxIndex, removable, st, stateOK, truncate); err != nil {
+			return result, err
+		}
+	}
+	result.Repaired = repair && fixed
+	return result, nil
+}
+
+// scanSnapshots checks all snapshot records of the specified node and returns
+// the latest valid snapshot record. Corrupted snapshot records are removed
+// when repair is true.
+func (r *db) scanSnapshots(clusterID uint64, nodeID uint64, repair bool,
+	report func(bool, string, ...interface{})) (pb.Snapshot, error) {
+	fk := newKey(snapshotKeySize, nil)
+	lk := newKey(snapshotKeySize, nil)
+	fk.setSnapshotKey(clusterID, nodeID, 0)
+	lk.setSnapshotKey(clusterID, nodeID, math.MaxUint64)
+	var latest pb.Snapshot
+	corrupted := make([][]byte, 0)
+	op := func(key []byte, data []byte) (bool, error) {
+		index := binary.BigEndian.Uint64(key[20:])
+		var ss pb.Snapshot
+		if err := ss.Unmarshal(data); err != nil {
+			report(true, "corrupted snapshot record %d, %v", index, err)
+			corrupted = append(corrupted, append([]byte(nil), key...))
+			return true, nil
+		}
+		if ss.Index != index {
+			report(true, "snapshot record %d has unexpected index %d",
+				index, ss.Index)
+			corrupted = append(corrupted, append([]byte(nil), key...))
+			return true, nil
+		}
+		latest = ss
+		return true, nil
+	}
+	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), true, op); err != nil {
+		return pb.Snapshot{}, err
+	}
+	if repair {
+		for _, key := range corrupted {
+			if err := r.kvs.DeleteValue(key); err != nil {
+				return pb.Snapshot{}, err
+			}
+		}
+	}
+	return latest, nil
+}
+
+// scanEntries checks all entry records of the specified node and returns the
+// index of the last entry that can be safely read. Keys of corrupted records
+// that are already covered by the snapshot are also returned.
+func (r *db) scanEntries(clusterID uint64, nodeID uint64,
+	ss pb.Snapshot, maxIndex uint64,
+	report func(bool, string, ...interface{})) (uint64, [][]byte, error) {
+	if maxIndex == 0 {
+		return 0, nil, nil
+	}
+	fk := newKey(maxKeySize, nil)
+	lk := newKey(maxKeySize, nil)
+	r.entries.setRecordKey(fk, clusterID, nodeID, 0)
+	r.entries.setRecordKey(lk, clusterID, nodeID, math.MaxUint64)
+	// expected is the index of the next expected entry, 0 means unknown
+	expected := uint64(0)
+	if ss.Index > 0 {
+		expected = ss.Index + 1
+	}
+	lastTerm := ss.Term
+	removable := make([][]byte, 0)
+	op := func(key []byte, data []byte) (bool, error) {
+		ents, low, high, err := r.entries.decode(key, data)
+		if low > maxIndex {
+			return false, nil
+		}
+		if err != nil {
+			report(true, "corrupted entry record [%d, %d], %v", low, high, err)
+			if high <= ss.Index {
+				removable = append(removable, append([]byte(nil), key...))
+				return true, nil
+			}
+			return false, nil
+		}
+		if len(ents) == 0 {
+			report(true, "empty entry record [%d, %d]", low, high)
+			return false, nil
+		}
+		for _, e := range ents {
+			if e.Index > maxIndex {
+				return false, nil
+			}
+			if e.Index < low || e.Index > high {
+				report(true, "entry %d found in record [%d, %d]", e.Index, low, high)
+				return false, nil
+			}
+			if e.Index <= ss.Index {
+				continue
+			}
+			if expected != 0 && e.Index != expected {
+				report(true, "entry %d found when expecting %d", e.Index, expected)
+				return false, nil
+			}
+			if e.Term < lastTerm {
+				report(true, "entry %d has term %d, previous term %d",
+					e.Index, e.Term, lastTerm)
+				return false, nil
+			}
+			expected = e.Index + 1
+			lastTerm = e.Term
+		}
+		return true, nil
+	}
+	if err := r.kvs.IterateValue(fk.Key(), lk.Key(), false, op); err != nil {
+		return 0, nil, err
+	}
+	lastIndex := ss.Index
+	if expected > ss.Index+1 {
+		lastIndex = expected - 1
+	}
+	if lastIndex < maxIndex {
+		report(true, "entries [%d, %d] are corrupted or missing",
+			lastIndex+1, maxIndex)
+	}
+	return lastIndex, removable, nil
+}
+
+// repairEntries removes corrupted records that are already covered by the
+// snapshot and truncates the Raft Log at lastIndex when truncate is true.
+func (r *db) repairEntries(clusterID uint64, nodeID uint64,
+	lastIndex uint64, maxIndex uint64, removable [][]byte,
+	st pb.State, stateOK bool, truncate bool) error {
+	for _, key := range removable {
+		if err := r.kvs.DeleteValue(key); err != nil {
+			return err
+		}
+	}
+	if !truncate {
+		plog.Warningf("log of %s not truncated at %d, committed entries found",
+			dn(clusterID, nodeID), lastIndex)
+		return nil
+	}
+	if lastIndex == maxIndex && (!stateOK || st.Commit <= lastIndex) {
+		return nil
+	}
+	plog.Warningf("truncating log of %s at %d, max index %d",
+		dn(clusterID, nodeID), lastIndex, maxIndex)
+	wb := r.getWriteBatch(nil)
+	defer wb.Destroy()
+	if stateOK && st.Commit > lastIndex {
+		st.Commit = lastIndex
+		r.saveStateAllocs(wb, clusterID, nodeID, st)
+		r.cs.setState(clusterID, nodeID, st)
+	}
+	if lastIndex == 0 {
+		k := newKey(maxKeySize, nil)
+		k.SetMaxIndexKey(clusterID, nodeID)
+		wb.Delete(k.Key())
+	} else {
+		r.saveMaxIndex(wb, clusterID, nodeID, lastIndex, nil)
+	}
+	if err := r.kvs.CommitWriteBatch(wb); err != nil {
+		return err
+	}
+	r.cs.setMaxIndex(clusterID, nodeID, lastIndex)
+	return r.entries.truncate(clusterID, nodeID, lastIndex)
+}
@@ -0,0 +1,240 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"testing"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+func getTestShard(ldb raftio.ILogDB, clusterID uint64) *db {
+	sdb := ldb.(*ShardedDB)
+	return sdb.shards[sdb.partitioner.GetPartitionID(clusterID)]
+}
+
+func saveScanTestData(t *testing.T, ldb raftio.ILogDB,
+	clusterID uint64, nodeID uint64, last uint64) {
+	bs := pb.NewBootstrapInfo(false, pb.RegularStateMachine,
+		map[uint64]string{nodeID: "a1"})
+	if err := ldb.SaveBootstrapInfo(clusterID, nodeID, bs); err != nil {
+		t.Fatalf("failed to save bootstrap info %v", err)
+	}
+	ents := make([]pb.Entry, 0)
+	for i := uint64(1); i <= last; i++ {
+		ents = append(ents, pb.Entry{Index: i, Term: 1 + i/10, Cmd: make([]byte, 16)})
+	}
+	ud := pb.Update{
+		EntriesToSave: ents,
+		State:         pb.State{Commit: last, Term: 1 + last/10},
+		ClusterID:     clusterID,
+		NodeID:        nodeID,
+	}
+	if err := ldb.SaveRaftState([]pb.Update{ud}, 1); err != nil {
+		t.Fatalf("failed to save raft state %v", err)
+	}
+}
+
+func scanTestDB(t *testing.T,
+	ldb raftio.ILogDB, repair bool, force bool) raftio.NodeScanResult {
+	results, err := ldb.(raftio.ILogDBScanner).Scan(repair, force)
+	if err != nil {
+		t.Fatalf("scan failed %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("unexpected result count %d", len(results))
+	}
+	return results[0]
+}
+
+func TestScanReportsNoProblemOnHealthyLogDB(t *testing.T) {
+	tf := func(t *testing.T, ldb raftio.ILogDB) {
+		last := batchSize * 3
+		saveScanTestData(t, ldb, 2, 3, last)
+		r := scanTestDB(t, ldb, false, false)
+		if r.Corrupted() {
+			t.Fatalf("unexpected problems %v", r.Problems)
+		}
+		if r.ClusterID != 2 || r.NodeID != 3 ||
+			r.MaxIndex != last || r.LastIndex != last || r.Repaired {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runLogDBTest(t, tf, fs)
+}
+
+func TestScanCanTruncateLogAtCorruptedEntry(t *testing.T) {
+	tf := func(t *testing.T, ldb raftio.ILogDB) {
+		clusterID := uint64(2)
+		nodeID := uint64(3)
+		last := batchSize * 3
+		saveScanTestData(t, ldb, clusterID, nodeID, last)
+		shard := getTestShard(ldb, clusterID)
+		corrupted := batchSize*2 + 5
+		k := newKey(maxKeySize, nil)
+		shard.entries.setRecordKey(k, clusterID, nodeID, corrupted)
+		if err := shard.kvs.SaveValue(k.Key(), []byte{0x08, 0xFF}); err != nil {
+			t.Fatalf("failed to save value %v", err)
+		}
+		expected := corrupted - 1
+		if _, batched := shard.entries.(*batchedEntries); batched {
+			expected = batchSize*2 - 1
+		}
+		r := scanTestDB(t, ldb, false, false)
+		if !r.Corrupted() || r.Repaired {
+			t.Fatalf("corruption not reported, %+v", r)
+		}
+		if r.LastIndex != expected || r.MaxIndex != last {
+			t.Errorf("unexpected result %+v", r)
+		}
+		r = scanTestDB(t, ldb, true, false)
+		if !r.Corrupted() || r.Repaired {
+			t.Fatalf("committed entries truncated without force, %+v", r)
+		}
+		if r = scanTestDB(t, ldb, false, false); r.MaxIndex != last {
+			t.Fatalf("log unexpectedly truncated, %+v", r)
+		}
+		r = scanTestDB(t, ldb, true, true)
+		if !r.Corrupted() || !r.Repaired {
+			t.Fatalf("corruption not repaired, %+v", r)
+		}
+		r = scanTestDB(t, ldb, false, false)
+		if r.Corrupted() {
+			t.Fatalf("unexpected problems %v", r.Problems)
+		}
+		if r.LastIndex != expected || r.MaxIndex != expected {
+			t.Errorf("unexpected result %+v", r)
+		}
+		rs, err := ldb.ReadRaftState(clusterID, nodeID, 0)
+		if err != nil {
+			t.Fatalf("failed to read raft state %v", err)
+		}
+		if rs.FirstIndex != 1 || rs.EntryCount != expected {
+			t.Errorf("unexpected raft state %+v", rs)
+		}
+		if rs.State.Commit != expected {
+			t.Errorf("commit not updated, %d", rs.State.Commit)
+		}
+		ents, _, err := ldb.IterateEntries(nil, 0,
+			clusterID, nodeID, 1, expected+1, 1<<30)
+		if err != nil {
+			t.Fatalf("failed to iterate entries %v", err)
+		}
+		if uint64(len(ents)) != expected {
+			t.Errorf("got %d entries, want %d", len(ents), expected)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runLogDBTest(t, tf, fs)
+}
+
+func TestScanCanTruncateUncommittedEntriesWithoutForce(t *testing.T) {
+	tf := func(t *testing.T, ldb raftio.ILogDB) {
+		clusterID := uint64(2)
+		nodeID := uint64(3)
+		saveScanTestData(t, ldb, clusterID, nodeID, 40)
+		st := pb.State{Commit: 20, Term: 5}
+		ud := pb.Update{ClusterID: clusterID, NodeID: nodeID, State: st}
+		if err := ldb.SaveRaftState([]pb.Update{ud}, 1); err != nil {
+			t.Fatalf("failed to save raft state %v", err)
+		}
+		shard := getTestShard(ldb, clusterID)
+		e := pb.Entry{Index: 25, Term: 1}
+		data, err := e.Marshal()
+		if err != nil {
+			t.Fatalf("failed to marshal %v", err)
+		}
+		k := newKey(maxKeySize, nil)
+		k.SetEntryKey(clusterID, nodeID, 25)
+		if err := shard.kvs.SaveValue(k.Key(), data); err != nil {
+			t.Fatalf("failed to save value %v", err)
+		}
+		r := scanTestDB(t, ldb, true, false)
+		if !r.Corrupted() || !r.Repaired || r.LastIndex != 24 {
+			t.Fatalf("unexpected result, %+v", r)
+		}
+		if r = scanTestDB(t, ldb, false, false); r.Corrupted() || r.MaxIndex != 24 {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runLogDBTestAs(t, false, tf, fs)
+}
+
+func TestScanCanDetectTermRegression(t *testing.T) {
+	tf := func(t *testing.T, ldb raftio.ILogDB) {
+		clusterID := uint64(2)
+		nodeID := uint64(3)
+		saveScanTestData(t, ldb, clusterID, nodeID, 40)
+		shard := getTestShard(ldb, clusterID)
+		e := pb.Entry{Index: 25, Term: 1}
+		data, err := e.Marshal()
+		if err != nil {
+			t.Fatalf("failed to marshal %v", err)
+		}
+		k := newKey(maxKeySize, nil)
+		k.SetEntryKey(clusterID, nodeID, 25)
+		if err := shard.kvs.SaveValue(k.Key(), data); err != nil {
+			t.Fatalf("failed to save value %v", err)
+		}
+		r := scanTestDB(t, ldb, true, true)
+		if !r.Corrupted() || !r.Repaired || r.LastIndex != 24 {
+			t.Fatalf("unexpected result, %+v", r)
+		}
+		if r = scanTestDB(t, ldb, false, false); r.Corrupted() || r.MaxIndex != 24 {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runLogDBTestAs(t, false, tf, fs)
+}
+
+func TestScanCanRemoveCorruptedSnapshotRecord(t *testing.T) {
+	tf := func(t *testing.T, ldb raftio.ILogDB) {
+		clusterID := uint64(2)
+		nodeID := uint64(3)
+		saveScanTestData(t, ldb, clusterID, nodeID, 40)
+		ss := pb.Snapshot{Index: 20, Term: 2, Filepath: "f1"}
+		ud := pb.Update{ClusterID: clusterID, NodeID: nodeID, Snapshot: ss}
+		if err := ldb.SaveSnapshots([]pb.Update{ud}); err != nil {
+			t.Fatalf("failed to save snapshot %v", err)
+		}
+		shard := getTestShard(ldb, clusterID)
+		k := newKey(snapshotKeySize, nil)
+		k.setSnapshotKey(clusterID, nodeID, 30)
+		if err := shard.kvs.SaveValue(k.Key(), []byte{0xFF}); err != nil {
+			t.Fatalf("failed to save value %v", err)
+		}
+		r := scanTestDB(t, ldb, true, false)
+		if !r.Corrupted() || !r.Repaired || r.SnapshotIndex != 20 {
+			t.Fatalf("unexpected result, %+v", r)
+		}
+		snapshots, err := ldb.ListSnapshots(clusterID, nodeID, 100)
+		if err != nil {
+			t.Fatalf("failed to list snapshots %v", err)
+		}
+		if len(snapshots) != 1 || snapshots[0].Index != 20 {
+			t.Errorf("unexpected snapshots %v", snapshots)
+		}
+		if r = scanTestDB(t, ldb, false, false); r.Corrupted() || r.LastIndex != 40 {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runLogDBTest(t, tf, fs)
+}
@@ -18,7 +18,9 @@ import (
 	"fmt"
 	"math"
 	"sync/atomic"
+	"time"
 
+	"github.com/juju/ratelimit"
 	"github.com/lni/goutils/syncutil"
 
 	"github.com/lni/dragonboat/v3/config"
@@ -34,13 +36,18 @@ type ShardedDB struct {
 	compactions          *compactions
 	stopper              *syncutil.Stopper
 	compactionCh         chan struct{}
+	compactionBucket     *ratelimit.Bucket
 	ctxs                 []IContext
 	shards               []*db
+	entryCache           *entryCache
 	config               config.LogDBConfig
 	completedCompactions uint64
 }
 
 var _ raftio.ILogDB = (*ShardedDB)(nil)
+var _ raftio.ICompactionEstimator = (*ShardedDB)(nil)
+var _ raftio.IEntryCacheStatsReporter = (*ShardedDB)(nil)
+var _ raftio.ILogDBScanner = (*ShardedDB)(nil)
 
 type shardCallback struct {
 	f     config.LogDBCallback
@@ -105,20 +112,31 @@ func OpenShardedDB(config config.NodeHostConfig, cb config.LogDBCallback,
 	partitioner := server.NewDoubleFixedPartitioner(config.Expert.Engine.ExecShards,
 		config.Expert.LogDB.Shards)
 	mw := &ShardedDB{
-		config:       config.Expert.LogDB,
-		shards:       shards,
-		ctxs:         make([]IContext, config.Expert.Engine.ExecShards),
-		partitioner:  partitioner,
-		compactions:  newCompactions(),
-		compactionCh: make(chan struct{}, 1),
-		stopper:      syncutil.NewStopper(),
+		config:      config.Expert.LogDB,
+		shards:      shards,
+		ctxs:        make([]IContext, config.Expert.Engine.ExecShards),
+		partitioner: partitioner,
+		entryCache:  newEntryCache(config.Expert.LogDB, config.EnableMetrics),
+		compactions: newCompactions(),
+		stopper:     syncutil.NewStopper(),
 	}
 	for i := uint64(0); i < config.Expert.Engine.ExecShards; i++ {
 		mw.ctxs[i] = newContext(mw.config.SaveBufferSize, mw.config.MaxSaveBufferSize)
 	}
-	mw.stopper.RunWorker(func() {
-		mw.compactionWorkerMain()
-	})
+	if rate := mw.config.MaxCompactionBytesPerSecond; rate > 0 {
+		mw.compactionBucket = ratelimit.NewBucketWithRate(float64(rate),
+			int64(rate)*2)
+	}
+	workers := mw.config.MaxConcurrentCompactions
+	if workers == 0 {
+		workers = 1
+	}
+	mw.compactionCh = make(chan struct{}, workers)
+	for i := uint64(0); i < workers; i++ {
+		mw.stopper.RunWorker(func() {
+			mw.compactionWorkerMain()
+		})
+	}
 	return mw, nil
 }
 
@@ -171,7 +189,11 @@ func (s *ShardedDB) SaveRaftStateCtx(updates []pb.Update, ctx IContext) error {
 		return nil
 	}
 	pid := s.getParititionID(updates)
-	return s.shards[pid].saveRaftState(updates, ctx)
+	if err := s.shards[pid].saveRaftState(updates, ctx); err != nil {
+		return err
+	}
+	s.invalidateEntryCache(updates)
+	return nil
 }
 
 // ReadRaftState returns the persistent state of the specified raft node.
@@ -238,8 +260,26 @@ func (s *ShardedDB) IterateEntries(ents []pb.Entry,
 	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
 	maxSize uint64) ([]pb.Entry, uint64, error) {
 	idx := s.partitioner.GetPartitionID(clusterID)
-	return s.shards[idx].iterateEntries(ents,
-		size, clusterID, nodeID, low, high, maxSize)
+	if s.entryCache == nil {
+		return s.shards[idx].iterateEntries(ents,
+			size, clusterID, nodeID, low, high, maxSize)
+	}
+	load := func(ents []pb.Entry,
+		size uint64, low uint64) ([]pb.Entry, uint64, error) {
+		return s.shards[idx].iterateEntries(ents,
+			size, clusterID, nodeID, low, high, maxSize)
+	}
+	return s.entryCache.iterate(ents,
+		size, clusterID, nodeID, low, high, maxSize, load)
+}
+
+// GetEntryCacheStats returns the statistics of the entry read cache. Zero
+// values are returned when the entry read cache is not enabled.
+func (s *ShardedDB) GetEntryCacheStats() raftio.EntryCacheStats {
+	if s.entryCache == nil {
+		return raftio.EntryCacheStats{}
+	}
+	return s.entryCache.getStats()
 }
 
 // RemoveEntriesTo removes entries associated with the specified raft node up
@@ -247,6 +287,15 @@ func (s *ShardedDB) IterateEntries(ents []pb.Entry,
 func (s *ShardedDB) RemoveEntriesTo(clusterID uint64,
 	nodeID uint64, index uint64) error {
 	idx := s.partitioner.GetPartitionID(clusterID)
+	if s.compactionBucket != nil {
+		// the size of removed entries is required for rate limiting the
+		// compaction that follows
+		est, err := s.shards[idx].estimateCompaction(clusterID, nodeID, index)
+		if err != nil {
+			return err
+		}
+		s.compactions.addRemoved(clusterID, nodeID, est.Bytes)
+	}
 	if err := s.shards[idx].removeEntriesTo(clusterID,
 		nodeID, index); err != nil {
 		return err
@@ -262,17 +311,62 @@ func (s *ShardedDB) CompactEntriesTo(clusterID uint64,
 	return done, nil
 }
 
+// EstimateCompaction reports the number of entries and the approximate number
+// of bytes that would be reclaimed by removing and compacting entries of the
+// specified raft node up to the specified index.
+func (s *ShardedDB) EstimateCompaction(clusterID uint64,
+	nodeID uint64, index uint64) (raftio.CompactionEstimate, error) {
+	idx := s.partitioner.GetPartitionID(clusterID)
+	return s.shards[idx].estimateCompaction(clusterID, nodeID, index)
+}
+
+// Scan checks all bootstrap, state, snapshot and entry records of all raft
+// nodes found in the sharded DB. Corrupted snapshot records are removed and the
+// raft log of each node is truncated at the first corrupted or missing entry
+// when repair is true. Committed entries are never removed unless force is
+// true. Scan is expected to be invoked when the sharded DB is not being used by
+// any NodeHost.
+func (s *ShardedDB) Scan(repair bool,
+	force bool) ([]raftio.NodeScanResult, error) {
+	results := make([]raftio.NodeScanResult, 0)
+	for _, shard := range s.shards {
+		r, err := shard.scan(repair, force)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r...)
+	}
+	if repair && s.entryCache != nil {
+		for _, r := range results {
+			s.entryCache.invalidateFrom(r.ClusterID, r.NodeID, 0)
+		}
+	}
+	return results, nil
+}
+
 // RemoveNodeData deletes all node data that belongs to the specified node.
 func (s *ShardedDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
 	idx := s.partitioner.GetPartitionID(clusterID)
-	return s.shards[idx].removeNodeData(clusterID, nodeID)
+	if err := s.shards[idx].removeNodeData(clusterID, nodeID); err != nil {
+		return err
+	}
+	if s.entryCache != nil {
+		s.entryCache.invalidateFrom(clusterID, nodeID, 0)
+	}
+	return nil
 }
 
 // ImportSnapshot imports the snapshot record and other metadata records to the
 // system.
 func (s *ShardedDB) ImportSnapshot(ss pb.Snapshot, nodeID uint64) error {
 	idx := s.partitioner.GetPartitionID(ss.ClusterId)
-	return s.shards[idx].importSnapshot(ss, nodeID)
+	if err := s.shards[idx].importSnapshot(ss, nodeID); err != nil {
+		return err
+	}
+	if s.entryCache != nil {
+		s.entryCache.invalidateFrom(ss.ClusterId, nodeID, 0)
+	}
+	return nil
 }
 
 // Close closes the ShardedDB instance.
@@ -286,6 +380,22 @@ func (s *ShardedDB) Close() {
 	}
 }
 
+// invalidateEntryCache removes cached entries that might have been overwritten
+// by the saved updates.
+func (s *ShardedDB) invalidateEntryCache(updates []pb.Update) {
+	if s.entryCache == nil {
+		return
+	}
+	for _, ud := range updates {
+		if !pb.IsEmptySnapshot(ud.Snapshot) {
+			s.entryCache.invalidateFrom(ud.ClusterID, ud.NodeID, 0)
+		} else if len(ud.EntriesToSave) > 0 {
+			s.entryCache.invalidateFrom(ud.ClusterID,
+				ud.NodeID, ud.EntriesToSave[0].Index)
+		}
+	}
+}
+
 func (s *ShardedDB) getParititionID(updates []pb.Update) uint64 {
 	pid := uint64(math.MaxUint64)
 	for _, ud := range updates {
@@ -333,9 +443,33 @@ func (s *ShardedDB) addCompaction(clusterID uint64,
 	return done
 }
 
+// throttleCompaction blocks until the compaction of the specified number of
+// bytes is allowed by the compaction rate limit. It returns false when the
+// ShardedDB is being stopped.
+func (s *ShardedDB) throttleCompaction(bytes uint64) bool {
+	if s.compactionBucket == nil || bytes == 0 {
+		return true
+	}
+	d := s.compactionBucket.Take(int64(bytes))
+	if d == 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stopper.ShouldStop():
+		return false
+	}
+}
+
 func (s *ShardedDB) compact() {
 	for {
 		if t, hasTask := s.compactions.getTask(); hasTask {
+			if !s.throttleCompaction(t.bytes) {
+				return
+			}
 			idx := s.partitioner.GetPartitionID(t.clusterID)
 			shard := s.shards[idx]
 			if err := shard.compact(t.clusterID, t.nodeID, t.index); err != nil {
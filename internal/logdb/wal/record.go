@@ -0,0 +1,158 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+type recordType uint8
+
+const (
+	recordEntries recordType = iota + 1
+	recordState
+	recordSnapshot
+	recordDeleteSnapshot
+	recordBootstrap
+	recordMaxIndex
+	recordRemoveEntries
+	recordRemoveNode
+)
+
+const (
+	// each record is stored as a 4 bytes payload length, a 4 bytes CRC32
+	// checksum of the payload and the payload itself.
+	recordHeaderSize = 8
+	// each payload starts with the record type, the cluster ID and the node ID.
+	payloadHeaderSize = 17
+)
+
+// record is a decoded WAL record.
+type record struct {
+	rt        recordType
+	clusterID uint64
+	nodeID    uint64
+	index     uint64
+	data      []byte
+}
+
+type marshaler interface {
+	Size() int
+	MarshalTo([]byte) (int, error)
+}
+
+// encoder appends encoded records to its buffer.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) reset() {
+	e.buf = e.buf[:0]
+}
+
+func (e *encoder) size() int64 {
+	return int64(len(e.buf))
+}
+
+func (e *encoder) grow(sz int) []byte {
+	l := len(e.buf)
+	if cap(e.buf)-l < sz {
+		nb := make([]byte, l, 2*cap(e.buf)+sz)
+		copy(nb, e.buf)
+		e.buf = nb
+	}
+	e.buf = e.buf[:l+sz]
+	return e.buf[l:]
+}
+
+func (e *encoder) add(rt recordType,
+	clusterID uint64, nodeID uint64, index uint64, m marshaler) {
+	sz := payloadHeaderSize
+	if m != nil {
+		sz += m.Size()
+	} else {
+		sz += 8
+	}
+	data := e.grow(recordHeaderSize + sz)
+	payload := data[recordHeaderSize:]
+	payload[0] = byte(rt)
+	binary.BigEndian.PutUint64(payload[1:], clusterID)
+	binary.BigEndian.PutUint64(payload[9:], nodeID)
+	if m != nil {
+		if _, err := m.MarshalTo(payload[payloadHeaderSize:]); err != nil {
+			panic(err)
+		}
+	} else {
+		binary.BigEndian.PutUint64(payload[payloadHeaderSize:], index)
+	}
+	binary.BigEndian.PutUint32(data, uint32(sz))
+	binary.BigEndian.PutUint32(data[4:], crc32.ChecksumIEEE(payload))
+}
+
+func (e *encoder) addEntries(clusterID uint64,
+	nodeID uint64, entries []pb.Entry) {
+	eb := pb.EntryBatch{Entries: entries}
+	e.add(recordEntries, clusterID, nodeID, 0, &eb)
+}
+
+// decodeRecord decodes the record at the beginning of data. It returns the
+// decoded record, the total size of the record and a boolean flag indicating
+// whether a valid record is available.
+func decodeRecord(data []byte) (record, int, bool) {
+	if len(data) < recordHeaderSize {
+		return record{}, 0, false
+	}
+	sz := int(binary.BigEndian.Uint32(data))
+	if sz < payloadHeaderSize || len(data)-recordHeaderSize < sz {
+		return record{}, 0, false
+	}
+	payload := data[recordHeaderSize : recordHeaderSize+sz]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:]) {
+		return record{}, 0, false
+	}
+	r := record{
+		rt:        recordType(payload[0]),
+		clusterID: binary.BigEndian.Uint64(payload[1:]),
+		nodeID:    binary.BigEndian.Uint64(payload[9:]),
+		data:      payload[payloadHeaderSize:],
+	}
+	switch r.rt {
+	case recordDeleteSnapshot, recordMaxIndex, recordRemoveEntries:
+		if len(r.data) != 8 {
+			return record{}, 0, false
+		}
+		r.index = binary.BigEndian.Uint64(r.data)
+	}
+	return r, recordHeaderSize + sz, true
+}
+
+// isTornTail returns a boolean value indicating whether data, which can not be
+// decoded as a valid record, looks like the tail of a partially completed
+// write. That is the case when the record header is incomplete, when the
+// record extends to or beyond the end of data, or when data is all zeros.
+func isTornTail(data []byte) bool {
+	if len(data) < recordHeaderSize {
+		return true
+	}
+	sz := int(binary.BigEndian.Uint32(data))
+	if len(data)-recordHeaderSize <= sz {
+		return true
+	}
+	return len(bytes.Trim(data, "\x00")) == 0
+}
@@ -0,0 +1,704 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+const (
+	segmentSuffix      = ".wal"
+	lockFilename       = "LOCK"
+	defaultSegmentSize = 64 * 1024 * 1024
+)
+
+type nodeKey struct {
+	clusterID uint64
+	nodeID    uint64
+}
+
+// position is the location of the entries record containing an entry.
+type position struct {
+	segment uint64
+	offset  int64
+	length  int64
+}
+
+// node contains everything known about a Raft node, it is rebuilt by
+// replaying all segments when the shard is opened.
+type node struct {
+	bootstrap   *pb.Bootstrap
+	state       pb.State
+	snapshots   map[uint64]pb.Snapshot
+	maxIndex    uint64
+	hasMaxIndex bool
+	// positions[i] is the position of the entry with index firstIndex+i.
+	firstIndex uint64
+	positions  []position
+}
+
+func newNode() *node {
+	return &node{snapshots: make(map[uint64]pb.Snapshot)}
+}
+
+func (n *node) lastIndex() uint64 {
+	return n.firstIndex + uint64(len(n.positions)) - 1
+}
+
+func (n *node) hasEntry(index uint64) bool {
+	return len(n.positions) > 0 &&
+		index >= n.firstIndex && index <= n.lastIndex()
+}
+
+// shard is a series of append-only segment files storing Raft logs and
+// metadata of a group of Raft nodes. Records are only appended to the most
+// recent segment, each segment starts with a checkpoint of all metadata so
+// old segments can be deleted once no entry stored in them is referenced.
+type shard struct {
+	mu          sync.Mutex
+	fs          vfs.IFS
+	dir         string
+	lock        io.Closer
+	nodes       map[nodeKey]*node
+	segments    []uint64
+	refs        map[uint64]int
+	readers     map[uint64]vfs.File
+	current     vfs.File
+	currentID   uint64
+	currentSize int64
+	segmentSize int64
+	enc         encoder
+	// err is the error that failed the shard, records that might be partially
+	// written to the current segment are never followed by other records.
+	err error
+}
+
+func openShard(dir string, segmentSize int64, fs vfs.IFS) (*shard, error) {
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return nil, err
+	}
+	lock, err := fs.Lock(fs.PathJoin(dir, lockFilename))
+	if err != nil {
+		return nil, err
+	}
+	s := &shard{
+		fs:          fs,
+		dir:         dir,
+		lock:        lock,
+		nodes:       make(map[nodeKey]*node),
+		refs:        make(map[uint64]int),
+		readers:     make(map[uint64]vfs.File),
+		segmentSize: segmentSize,
+	}
+	if err := s.replay(); err != nil {
+		s.close()
+		return nil, err
+	}
+	if err := s.createSegment(); err != nil {
+		s.close()
+		return nil, err
+	}
+	if err := s.gc(); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *shard) close() {
+	for _, f := range s.readers {
+		if err := f.Close(); err != nil {
+			plog.Errorf("failed to close segment, %v", err)
+		}
+	}
+	s.readers = nil
+	if s.current != nil {
+		if err := s.current.Close(); err != nil {
+			plog.Errorf("failed to close segment, %v", err)
+		}
+		s.current = nil
+	}
+	if s.lock != nil {
+		if err := s.lock.Close(); err != nil {
+			plog.Errorf("failed to release lock, %v", err)
+		}
+		s.lock = nil
+	}
+}
+
+func getSegmentFilename(id uint64) string {
+	return fmt.Sprintf("%020d%s", id, segmentSuffix)
+}
+
+func (s *shard) listSegments() ([]uint64, error) {
+	names, err := s.fs.List(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint64, 0)
+	for _, name := range names {
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		result = append(result, id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result, nil
+}
+
+func (s *shard) replay() error {
+	segments, err := s.listSegments()
+	if err != nil {
+		return err
+	}
+	for i, id := range segments {
+		data, err := s.readSegment(id)
+		if err != nil {
+			return err
+		}
+		offset := int64(0)
+		for offset < int64(len(data)) {
+			r, sz, ok := decodeRecord(data[offset:])
+			if !ok {
+				// only the last segment can have a partially written tail left by a
+				// crash, it is truncated as new records are written to a new segment.
+				if i != len(segments)-1 || !isTornTail(data[offset:]) {
+					return fmt.Errorf("%w, segment %d offset %d in %s",
+						ErrCorruptedSegment, id, offset, s.dir)
+				}
+				plog.Warningf("truncating %d bytes at the end of segment %d in %s",
+					int64(len(data))-offset, id, s.dir)
+				if err := s.truncateSegment(id, data[:offset]); err != nil {
+					return err
+				}
+				break
+			}
+			if err := s.apply(r, position{id, offset, int64(sz)}); err != nil {
+				return err
+			}
+			offset += int64(sz)
+		}
+		s.segments = append(s.segments, id)
+		s.currentID = id
+	}
+	return nil
+}
+
+func (s *shard) readSegment(id uint64) ([]byte, error) {
+	f, err := s.fs.Open(s.fs.PathJoin(s.dir, getSegmentFilename(id)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, fi.Size())
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// truncateSegment replaces the specified segment with a copy of its first
+// len(data) bytes.
+func (s *shard) truncateSegment(id uint64, data []byte) error {
+	fp := s.fs.PathJoin(s.dir, getSegmentFilename(id))
+	tmp := fp + ".tmp"
+	f, err := s.fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(tmp, fp); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(s.dir, s.fs)
+}
+
+func (s *shard) getNode(clusterID uint64, nodeID uint64, create bool) *node {
+	key := nodeKey{clusterID, nodeID}
+	n, ok := s.nodes[key]
+	if !ok && create {
+		n = newNode()
+		s.nodes[key] = n
+	}
+	return n
+}
+
+// apply applies the specified record to the in memory state.
+func (s *shard) apply(r record, pos position) error {
+	if r.rt == recordRemoveNode {
+		if n := s.getNode(r.clusterID, r.nodeID, false); n != nil {
+			s.removeEntries(n, n.lastIndex()+1)
+			delete(s.nodes, nodeKey{r.clusterID, r.nodeID})
+		}
+		return nil
+	}
+	n := s.getNode(r.clusterID, r.nodeID, true)
+	switch r.rt {
+	case recordEntries:
+		var eb pb.EntryBatch
+		if err := eb.Unmarshal(r.data); err != nil {
+			return err
+		}
+		if len(eb.Entries) > 0 {
+			s.appendEntries(n, eb.Entries, pos)
+		}
+	case recordState:
+		var st pb.State
+		if err := st.Unmarshal(r.data); err != nil {
+			return err
+		}
+		n.state = st
+	case recordSnapshot:
+		var ss pb.Snapshot
+		if err := ss.Unmarshal(r.data); err != nil {
+			return err
+		}
+		n.snapshots[ss.Index] = ss
+	case recordDeleteSnapshot:
+		delete(n.snapshots, r.index)
+	case recordBootstrap:
+		var bs pb.Bootstrap
+		if err := bs.Unmarshal(r.data); err != nil {
+			return err
+		}
+		n.bootstrap = &bs
+	case recordMaxIndex:
+		n.maxIndex = r.index
+		n.hasMaxIndex = true
+	case recordRemoveEntries:
+		s.removeEntries(n, r.index)
+	default:
+		return fmt.Errorf("unknown record type %d", r.rt)
+	}
+	return nil
+}
+
+func (s *shard) appendEntries(n *node, entries []pb.Entry, pos position) {
+	first := entries[0].Index
+	if len(n.positions) == 0 ||
+		first < n.firstIndex || first > n.lastIndex()+1 {
+		s.removeEntries(n, n.lastIndex()+1)
+		n.firstIndex = first
+	} else {
+		for _, p := range n.positions[first-n.firstIndex:] {
+			s.refs[p.segment]--
+		}
+		n.positions = n.positions[:first-n.firstIndex]
+	}
+	for range entries {
+		n.positions = append(n.positions, pos)
+	}
+	s.refs[pos.segment] += len(entries)
+	n.maxIndex = entries[len(entries)-1].Index
+	n.hasMaxIndex = true
+}
+
+// removeEntries removes all entries with index values lower than index.
+func (s *shard) removeEntries(n *node, index uint64) {
+	if len(n.positions) == 0 || index <= n.firstIndex {
+		return
+	}
+	count := index - n.firstIndex
+	if count > uint64(len(n.positions)) {
+		count = uint64(len(n.positions))
+	}
+	for _, p := range n.positions[:count] {
+		s.refs[p.segment]--
+	}
+	n.positions = append([]position{}, n.positions[count:]...)
+	n.firstIndex += count
+}
+
+// createSegment creates a new segment and writes a checkpoint of all metadata
+// into it.
+func (s *shard) createSegment() error {
+	if s.current != nil {
+		if err := s.current.Close(); err != nil {
+			return err
+		}
+		s.current = nil
+	}
+	id := s.currentID + 1
+	f, err := s.fs.Create(s.fs.PathJoin(s.dir, getSegmentFilename(id)))
+	if err != nil {
+		return err
+	}
+	if err := fileutil.SyncDir(s.dir, s.fs); err != nil {
+		f.Close()
+		return err
+	}
+	s.current = f
+	s.currentID = id
+	s.currentSize = 0
+	s.segments = append(s.segments, id)
+	s.enc.reset()
+	for key, n := range s.nodes {
+		if n.bootstrap != nil {
+			s.enc.add(recordBootstrap, key.clusterID, key.nodeID, 0, n.bootstrap)
+		}
+		if !pb.IsEmptyState(n.state) {
+			st := n.state
+			s.enc.add(recordState, key.clusterID, key.nodeID, 0, &st)
+		}
+		for _, ss := range n.snapshots {
+			ss := ss
+			s.enc.add(recordSnapshot, key.clusterID, key.nodeID, 0, &ss)
+		}
+		if n.hasMaxIndex {
+			s.enc.add(recordMaxIndex, key.clusterID, key.nodeID, n.maxIndex, nil)
+		}
+	}
+	return s.writeRecords(false)
+}
+
+// write writes all encoded records to the current segment and starts a new
+// segment when the current one is full.
+func (s *shard) write() error {
+	return s.writeRecords(true)
+}
+
+// writeRecords writes all encoded records to the current segment. The encoded
+// records are applied to the in memory state once they are persisted. The
+// shard is failed when the records can not be persisted, as they might have
+// been partially written and no further record can be appended after them.
+func (s *shard) writeRecords(rollover bool) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.enc.size() == 0 {
+		return nil
+	}
+	offset := s.currentSize
+	if _, err := s.current.Write(s.enc.buf); err != nil {
+		return s.fail(err)
+	}
+	if err := s.current.Sync(); err != nil {
+		return s.fail(err)
+	}
+	s.currentSize += s.enc.size()
+	data := s.enc.buf
+	for len(data) > 0 {
+		r, sz, ok := decodeRecord(data)
+		if !ok {
+			panic("failed to decode encoded record")
+		}
+		pos := position{s.currentID, offset, int64(sz)}
+		if err := s.apply(r, pos); err != nil {
+			return err
+		}
+		offset += int64(sz)
+		data = data[sz:]
+	}
+	s.enc.reset()
+	if rollover && s.currentSize >= s.segmentSize {
+		return s.createSegment()
+	}
+	return nil
+}
+
+func (s *shard) fail(err error) error {
+	plog.Errorf("shard in %s failed, %v", s.dir, err)
+	s.enc.reset()
+	s.err = fmt.Errorf("%w, %v", ErrShardFailed, err)
+	return s.err
+}
+
+func (s *shard) saveRaftState(updates []pb.Update) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.reset()
+	for _, ud := range updates {
+		n := s.getNode(ud.ClusterID, ud.NodeID, false)
+		if !pb.IsEmptyState(ud.State) &&
+			(n == nil || !pb.IsStateEqual(n.state, ud.State)) {
+			st := ud.State
+			s.enc.add(recordState, ud.ClusterID, ud.NodeID, 0, &st)
+		}
+		if !pb.IsEmptySnapshot(ud.Snapshot) {
+			ss := ud.Snapshot
+			s.enc.add(recordSnapshot, ud.ClusterID, ud.NodeID, 0, &ss)
+			s.enc.add(recordMaxIndex, ud.ClusterID, ud.NodeID, ss.Index, nil)
+		}
+		if len(ud.EntriesToSave) > 0 {
+			s.enc.addEntries(ud.ClusterID, ud.NodeID, ud.EntriesToSave)
+		}
+	}
+	return s.write()
+}
+
+func (s *shard) writeRecord(rt recordType,
+	clusterID uint64, nodeID uint64, index uint64, m marshaler) error {
+	s.enc.reset()
+	s.enc.add(rt, clusterID, nodeID, index, m)
+	return s.write()
+}
+
+func (s *shard) saveBootstrapInfo(clusterID uint64,
+	nodeID uint64, bs pb.Bootstrap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeRecord(recordBootstrap, clusterID, nodeID, 0, &bs)
+}
+
+func (s *shard) getBootstrapInfo(clusterID uint64,
+	nodeID uint64) (pb.Bootstrap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.getNode(clusterID, nodeID, false)
+	if n == nil || n.bootstrap == nil {
+		return pb.Bootstrap{}, raftio.ErrNoBootstrapInfo
+	}
+	return *n.bootstrap, nil
+}
+
+func (s *shard) listNodeInfo() []raftio.NodeInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]raftio.NodeInfo, 0)
+	for key, n := range s.nodes {
+		if n.bootstrap != nil {
+			result = append(result, raftio.GetNodeInfo(key.clusterID, key.nodeID))
+		}
+	}
+	return result
+}
+
+func (s *shard) saveSnapshots(updates []pb.Update) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.reset()
+	for _, ud := range updates {
+		if ud.Snapshot.Index > 0 {
+			ss := ud.Snapshot
+			s.enc.add(recordSnapshot, ud.ClusterID, ud.NodeID, 0, &ss)
+		}
+	}
+	return s.write()
+}
+
+func (s *shard) deleteSnapshot(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeRecord(recordDeleteSnapshot, clusterID, nodeID, index, nil)
+}
+
+func (s *shard) listSnapshots(clusterID uint64,
+	nodeID uint64, index uint64) []pb.Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]pb.Snapshot, 0)
+	n := s.getNode(clusterID, nodeID, false)
+	if n == nil {
+		return result
+	}
+	for idx, ss := range n.snapshots {
+		if idx <= index {
+			result = append(result, ss)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Index < result[j].Index
+	})
+	return result
+}
+
+func (s *shard) readRaftState(clusterID uint64,
+	nodeID uint64, snapshotIndex uint64) (raftio.RaftState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.getNode(clusterID, nodeID, false)
+	if n == nil || pb.IsEmptyState(n.state) {
+		return raftio.RaftState{}, raftio.ErrNoSavedLog
+	}
+	rs := raftio.RaftState{State: n.state, FirstIndex: snapshotIndex}
+	if !n.hasMaxIndex || n.maxIndex == snapshotIndex {
+		return rs, nil
+	}
+	first := snapshotIndex
+	if first < n.firstIndex {
+		first = n.firstIndex
+	}
+	if !n.hasEntry(first) || first > n.maxIndex {
+		plog.Panicf("first index %d, max index %d", first, n.maxIndex)
+	}
+	rs.FirstIndex = first
+	rs.EntryCount = n.maxIndex - first + 1
+	return rs, nil
+}
+
+func (s *shard) iterateEntries(ents []pb.Entry,
+	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
+	maxSize uint64) ([]pb.Entry, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.getNode(clusterID, nodeID, false)
+	if n == nil || !n.hasMaxIndex {
+		return ents, size, nil
+	}
+	if high > n.maxIndex+1 {
+		high = n.maxIndex + 1
+	}
+	var cached position
+	var batch pb.EntryBatch
+	for index := low; index < high && n.hasEntry(index); index++ {
+		pos := n.positions[index-n.firstIndex]
+		if pos != cached || len(batch.Entries) == 0 {
+			batch = pb.EntryBatch{}
+			if err := s.readEntries(pos, &batch); err != nil {
+				return nil, 0, err
+			}
+			cached = pos
+		}
+		offset := index - batch.Entries[0].Index
+		if index < batch.Entries[0].Index || offset >= uint64(len(batch.Entries)) {
+			plog.Panicf("entry %d not found in the batch", index)
+		}
+		e := batch.Entries[offset]
+		ents = append(ents, e)
+		size += uint64(e.SizeUpperLimit())
+		if size > maxSize {
+			break
+		}
+	}
+	return ents, size, nil
+}
+
+func (s *shard) readEntries(pos position, eb *pb.EntryBatch) error {
+	f, ok := s.readers[pos.segment]
+	if !ok {
+		fp := s.fs.PathJoin(s.dir, getSegmentFilename(pos.segment))
+		var err error
+		f, err = s.fs.Open(fp)
+		if err != nil {
+			return err
+		}
+		s.readers[pos.segment] = f
+	}
+	data := make([]byte, pos.length)
+	if _, err := f.ReadAt(data, pos.offset); err != nil {
+		return err
+	}
+	r, _, ok := decodeRecord(data)
+	if !ok || r.rt != recordEntries {
+		return fmt.Errorf("corrupted entries record in segment %d offset %d",
+			pos.segment, pos.offset)
+	}
+	return eb.Unmarshal(r.data)
+}
+
+func (s *shard) removeEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.getNode(clusterID, nodeID, false) == nil {
+		return nil
+	}
+	return s.writeRecord(recordRemoveEntries, clusterID, nodeID, index, nil)
+}
+
+func (s *shard) removeNodeData(clusterID uint64, nodeID uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeRecord(recordRemoveNode,
+		clusterID, nodeID, 0, nil); err != nil {
+		return err
+	}
+	return s.gc()
+}
+
+func (s *shard) importSnapshot(ss pb.Snapshot, nodeID uint64) error {
+	if ss.Type == pb.UnknownStateMachine {
+		panic("Unknown state machine type")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enc.reset()
+	if n := s.getNode(ss.ClusterId, nodeID, false); n != nil {
+		for idx := range n.snapshots {
+			if idx >= ss.Index {
+				s.enc.add(recordDeleteSnapshot, ss.ClusterId, nodeID, idx, nil)
+			}
+		}
+	}
+	bs := pb.Bootstrap{Join: true, Type: ss.Type}
+	st := pb.State{Term: ss.Term, Commit: ss.Index}
+	s.enc.add(recordBootstrap, ss.ClusterId, nodeID, 0, &bs)
+	s.enc.add(recordState, ss.ClusterId, nodeID, 0, &st)
+	s.enc.add(recordSnapshot, ss.ClusterId, nodeID, 0, &ss)
+	s.enc.add(recordMaxIndex, ss.ClusterId, nodeID, ss.Index, nil)
+	return s.write()
+}
+
+func (s *shard) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gc()
+}
+
+// gc deletes the oldest segments no longer referenced by any entry. All
+// metadata stored in such segments can be found in the checkpoints of later
+// segments.
+func (s *shard) gc() error {
+	removed := false
+	for len(s.segments) > 1 && s.refs[s.segments[0]] == 0 {
+		id := s.segments[0]
+		if f, ok := s.readers[id]; ok {
+			if err := f.Close(); err != nil {
+				return err
+			}
+			delete(s.readers, id)
+		}
+		fp := s.fs.PathJoin(s.dir, getSegmentFilename(id))
+		if err := s.fs.RemoveAll(fp); err != nil {
+			return err
+		}
+		delete(s.refs, id)
+		s.segments = s.segments[1:]
+		removed = true
+	}
+	if removed {
+		return fileutil.SyncDir(s.dir, s.fs)
+	}
+	return nil
+}
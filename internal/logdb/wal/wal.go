@@ -0,0 +1,237 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package wal implements a LogDB backed by append-only segmented write ahead
+logs.
+
+Each LogDB shard owns a series of segment files, Raft entries and metadata
+are only ever appended to the most recent segment. An in memory index of all
+entries and metadata is rebuilt by replaying segments when the LogDB is
+opened. As most Raft entries are deleted shortly after being compacted, this
+avoids the write amplification of LSM based key-value stores, segments are
+simply deleted once no entry stored in them is referenced.
+
+WARNING: the WAL based LogDB is experimental, DO NOT USE IT IN PRODUCTION.
+*/
+package wal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/logger"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+var (
+	plog = logger.GetLogger("wal")
+)
+
+var (
+	// ErrCorruptedSegment indicates that a corrupted record other than the
+	// partially written tail of the last segment has been found.
+	ErrCorruptedSegment = errors.New("corrupted WAL segment")
+	// ErrShardFailed indicates that the LogDB shard failed to persist records
+	// and can no longer be written to.
+	ErrShardFailed = errors.New("WAL shard failed")
+)
+
+// LogDB is a raftio.ILogDB implementation backed by sharded segmented write
+// ahead logs.
+type LogDB struct {
+	partitioner server.IPartitioner
+	shards      []*shard
+}
+
+var _ raftio.ILogDB = (*LogDB)(nil)
+
+// NewLogDB creates a LogDB instance. Each LogDB shard stores its segments in
+// the low latency dir when specified, or in the regular dir otherwise.
+func NewLogDB(cfg config.NodeHostConfig, cb config.LogDBCallback,
+	dirs []string, lldirs []string, fs vfs.IFS) (*LogDB, error) {
+	return newLogDB(cfg, dirs, lldirs, defaultSegmentSize, fs)
+}
+
+func newLogDB(cfg config.NodeHostConfig, dirs []string, lldirs []string,
+	segmentSize int64, fs vfs.IFS) (*LogDB, error) {
+	if len(dirs) == 0 {
+		panic("no regular dir")
+	}
+	count := cfg.Expert.LogDB.Shards
+	if count == 0 {
+		panic("invalid LogDB shard count")
+	}
+	l := &LogDB{
+		partitioner: server.NewDoubleFixedPartitioner(
+			cfg.Expert.Engine.ExecShards, count),
+	}
+	for i := uint64(0); i < count; i++ {
+		dir := dirs[0]
+		if len(lldirs) > 0 {
+			dir = lldirs[0]
+			if uint64(len(lldirs)) == count {
+				dir = lldirs[i]
+			}
+		} else if uint64(len(dirs)) == count {
+			dir = dirs[i]
+		}
+		s, err := openShard(fs.PathJoin(dir,
+			fmt.Sprintf("wal-%d", i)), segmentSize, fs)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.shards = append(l.shards, s)
+	}
+	return l, nil
+}
+
+func (l *LogDB) getShard(clusterID uint64) *shard {
+	return l.shards[l.partitioner.GetPartitionID(clusterID)]
+}
+
+// Name returns the type name of the instance.
+func (l *LogDB) Name() string {
+	return "sharded-wal"
+}
+
+// Close closes the LogDB instance.
+func (l *LogDB) Close() {
+	for _, s := range l.shards {
+		s.mu.Lock()
+		s.close()
+		s.mu.Unlock()
+	}
+}
+
+// BinaryFormat returns the binary format supported by the LogDB.
+func (l *LogDB) BinaryFormat() uint32 {
+	return raftio.LogDBBinVersion
+}
+
+// ListNodeInfo lists all available NodeInfo found in the LogDB.
+func (l *LogDB) ListNodeInfo() ([]raftio.NodeInfo, error) {
+	result := make([]raftio.NodeInfo, 0)
+	for _, s := range l.shards {
+		result = append(result, s.listNodeInfo()...)
+	}
+	return result, nil
+}
+
+// SaveBootstrapInfo saves the specified bootstrap info for the given node.
+func (l *LogDB) SaveBootstrapInfo(clusterID uint64,
+	nodeID uint64, bootstrap pb.Bootstrap) error {
+	return l.getShard(clusterID).saveBootstrapInfo(clusterID, nodeID, bootstrap)
+}
+
+// GetBootstrapInfo returns the saved bootstrap info for the given node.
+func (l *LogDB) GetBootstrapInfo(clusterID uint64,
+	nodeID uint64) (pb.Bootstrap, error) {
+	return l.getShard(clusterID).getBootstrapInfo(clusterID, nodeID)
+}
+
+// SaveRaftState saves the raft state and logs found in the pb.Update list
+// to the LogDB.
+func (l *LogDB) SaveRaftState(updates []pb.Update, shardID uint64) error {
+	for idx, ud := range l.group(updates) {
+		if err := l.shards[idx].saveRaftState(ud); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IterateEntries returns the continuous Raft log entries of the specified
+// Raft node between the index value range of [low, high) up to a max size
+// limit of maxSize bytes.
+func (l *LogDB) IterateEntries(ents []pb.Entry,
+	size uint64, clusterID uint64, nodeID uint64, low uint64, high uint64,
+	maxSize uint64) ([]pb.Entry, uint64, error) {
+	return l.getShard(clusterID).iterateEntries(ents,
+		size, clusterID, nodeID, low, high, maxSize)
+}
+
+// ReadRaftState returns the persistent state of the specified raft node.
+func (l *LogDB) ReadRaftState(clusterID uint64,
+	nodeID uint64, lastIndex uint64) (raftio.RaftState, error) {
+	return l.getShard(clusterID).readRaftState(clusterID, nodeID, lastIndex)
+}
+
+// RemoveEntriesTo removes entries associated with the specified raft node up
+// to the specified index.
+func (l *LogDB) RemoveEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	return l.getShard(clusterID).removeEntriesTo(clusterID, nodeID, index)
+}
+
+// CompactEntriesTo reclaims underlying storage space used for storing
+// entries up to the specified index by deleting segments no longer
+// referenced.
+func (l *LogDB) CompactEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) (<-chan struct{}, error) {
+	if err := l.getShard(clusterID).compact(); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	close(done)
+	return done, nil
+}
+
+// SaveSnapshots saves all snapshot metadata found in the pb.Update list.
+func (l *LogDB) SaveSnapshots(updates []pb.Update) error {
+	for idx, ud := range l.group(updates) {
+		if err := l.shards[idx].saveSnapshots(ud); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteSnapshot removes the specified snapshot metadata from the LogDB.
+func (l *LogDB) DeleteSnapshot(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	return l.getShard(clusterID).deleteSnapshot(clusterID, nodeID, index)
+}
+
+// ListSnapshots lists available snapshots associated with the specified
+// Raft node for index range (0, index].
+func (l *LogDB) ListSnapshots(clusterID uint64,
+	nodeID uint64, index uint64) ([]pb.Snapshot, error) {
+	return l.getShard(clusterID).listSnapshots(clusterID, nodeID, index), nil
+}
+
+// RemoveNodeData deletes all node data that belongs to the specified node.
+func (l *LogDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
+	return l.getShard(clusterID).removeNodeData(clusterID, nodeID)
+}
+
+// ImportSnapshot imports the snapshot record and other metadata records to the
+// LogDB.
+func (l *LogDB) ImportSnapshot(ss pb.Snapshot, nodeID uint64) error {
+	return l.getShard(ss.ClusterId).importSnapshot(ss, nodeID)
+}
+
+func (l *LogDB) group(updates []pb.Update) map[uint64][]pb.Update {
+	result := make(map[uint64][]pb.Update)
+	for _, ud := range updates {
+		idx := l.partitioner.GetPartitionID(ud.ClusterID)
+		result[idx] = append(result[idx], ud)
+	}
+	return result
+}
@@ -0,0 +1,432 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wal
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+const (
+	testDir = "wal_test_dir_safe_to_delete"
+)
+
+func getTestConfig() config.NodeHostConfig {
+	expert := config.GetDefaultExpertConfig()
+	expert.LogDB.Shards = 2
+	return config.NodeHostConfig{Expert: expert}
+}
+
+func openTestLogDB(t *testing.T, segmentSize int64, fs vfs.IFS) *LogDB {
+	db, err := newLogDB(getTestConfig(),
+		[]string{testDir}, nil, segmentSize, fs)
+	if err != nil {
+		t.Fatalf("failed to open logdb %v", err)
+	}
+	return db
+}
+
+func runLogDBTest(t *testing.T,
+	tf func(t *testing.T, open func() *LogDB), segmentSize int64) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(testDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(testDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	tf(t, func() *LogDB { return openTestLogDB(t, segmentSize, fs) })
+}
+
+func getTestEntries(low uint64, high uint64, term uint64) []pb.Entry {
+	result := make([]pb.Entry, 0)
+	for i := low; i < high; i++ {
+		result = append(result, pb.Entry{Index: i, Term: term, Cmd: make([]byte, 64)})
+	}
+	return result
+}
+
+func saveEntries(t *testing.T, db *LogDB, entries []pb.Entry) {
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: entries[0].Term, Commit: entries[0].Index},
+		EntriesToSave: entries,
+	}
+	if err := db.SaveRaftState([]pb.Update{ud}, 1); err != nil {
+		t.Fatalf("failed to save raft state %v", err)
+	}
+}
+
+func getEntries(t *testing.T, db *LogDB, low uint64, high uint64) []pb.Entry {
+	ents, _, err := db.IterateEntries(nil, 0, 1, 2, low, high, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("failed to iterate entries %v", err)
+	}
+	return ents
+}
+
+func checkEntries(t *testing.T,
+	ents []pb.Entry, low uint64, high uint64, term uint64) {
+	if uint64(len(ents)) != high-low {
+		t.Fatalf("got %d entries, want %d", len(ents), high-low)
+	}
+	for idx, e := range ents {
+		if e.Index != low+uint64(idx) || e.Term != term {
+			t.Fatalf("unexpected entry %d:%d", e.Index, e.Term)
+		}
+	}
+}
+
+func TestRecordCanBeEncodedAndDecoded(t *testing.T) {
+	e := encoder{}
+	st := pb.State{Term: 2, Vote: 3, Commit: 4}
+	e.add(recordState, 1, 2, 0, &st)
+	e.add(recordMaxIndex, 1, 2, 100, nil)
+	data := e.buf
+	r, sz, ok := decodeRecord(data)
+	if !ok || r.rt != recordState || r.clusterID != 1 || r.nodeID != 2 {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	var decoded pb.State
+	if err := decoded.Unmarshal(r.data); err != nil || decoded != st {
+		t.Errorf("unexpected state %v", decoded)
+	}
+	r, _, ok = decodeRecord(data[sz:])
+	if !ok || r.rt != recordMaxIndex || r.index != 100 {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if _, _, ok := decodeRecord(data[:sz-1]); ok {
+		t.Errorf("partial record not detected")
+	}
+	data[sz-1] ^= 0xFF
+	if _, _, ok := decodeRecord(data); ok {
+		t.Errorf("corrupted record not detected")
+	}
+}
+
+func TestEntriesCanBeSavedAndRead(t *testing.T) {
+	tf := func(t *testing.T, open func() *LogDB) {
+		db := open()
+		defer db.Close()
+		saveEntries(t, db, getTestEntries(1, 11, 1))
+		checkEntries(t, getEntries(t, db, 1, 11), 1, 11, 1)
+		checkEntries(t, getEntries(t, db, 3, 100), 3, 11, 1)
+		rs, err := db.ReadRaftState(1, 2, 0)
+		if err != nil {
+			t.Fatalf("failed to read raft state %v", err)
+		}
+		if rs.FirstIndex != 1 || rs.EntryCount != 10 || rs.State.Term != 1 {
+			t.Errorf("unexpected raft state %+v", rs)
+		}
+		ents, _, err := db.IterateEntries(nil, 0, 1, 2, 1, 11, 1)
+		if err != nil || len(ents) != 1 {
+			t.Errorf("max size not respected, %d, %v", len(ents), err)
+		}
+		if _, err := db.ReadRaftState(1, 3, 0); err != raftio.ErrNoSavedLog {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	runLogDBTest(t, tf, defaultSegmentSize)
+}
+
+func TestConflictingEntriesAreOverwritten(t *testing.T) {
+	tf := func(t *testing.T, open func() *LogDB) {
+		db := open()
+		saveEntries(t, db, getTestEntries(1, 11, 1))
+		saveEntries(t, db, getTestEntries(6, 8, 2))
+		ents := getEntries(t, db, 1, 100)
+		checkEntries(t, ents[:5], 1, 6, 1)
+		checkEntries(t, ents[5:], 6, 8, 2)
+		db.Close()
+		db = open()
+		defer db.Close()
+		ents = getEntries(t, db, 1, 100)
+		checkEntries(t, ents[:5], 1, 6, 1)
+		checkEntries(t, ents[5:], 6, 8, 2)
+	}
+	runLogDBTest(t, tf, defaultSegmentSize)
+}
+
+func TestMetadataCanBeRestored(t *testing.T) {
+	tf := func(t *testing.T, open func() *LogDB) {
+		db := open()
+		bs := pb.Bootstrap{Addresses: map[uint64]string{2: "a2"}}
+		if err := db.SaveBootstrapInfo(1, 2, bs); err != nil {
+			t.Fatalf("failed to save bootstrap %v", err)
+		}
+		saveEntries(t, db, getTestEntries(1, 11, 1))
+		ss := pb.Snapshot{ClusterId: 1, Index: 5, Term: 1}
+		if err := db.SaveSnapshots([]pb.Update{
+			{ClusterID: 1, NodeID: 2, Snapshot: ss}}); err != nil {
+			t.Fatalf("failed to save snapshot %v", err)
+		}
+		ss.Index = 8
+		if err := db.SaveSnapshots([]pb.Update{
+			{ClusterID: 1, NodeID: 2, Snapshot: ss}}); err != nil {
+			t.Fatalf("failed to save snapshot %v", err)
+		}
+		if err := db.DeleteSnapshot(1, 2, 5); err != nil {
+			t.Fatalf("failed to delete snapshot %v", err)
+		}
+		db.Close()
+		db = open()
+		defer db.Close()
+		ni, err := db.ListNodeInfo()
+		if err != nil || len(ni) != 1 || ni[0] != raftio.GetNodeInfo(1, 2) {
+			t.Errorf("unexpected node info %v, %v", ni, err)
+		}
+		rbs, err := db.GetBootstrapInfo(1, 2)
+		if err != nil || rbs.Addresses[2] != "a2" {
+			t.Errorf("unexpected bootstrap %v, %v", rbs, err)
+		}
+		snapshots, err := db.ListSnapshots(1, 2, math.MaxUint64)
+		if err != nil || len(snapshots) != 1 || snapshots[0].Index != 8 {
+			t.Errorf("unexpected snapshots %v, %v", snapshots, err)
+		}
+		if snapshots, _ := db.ListSnapshots(1, 2, 7); len(snapshots) != 0 {
+			t.Errorf("unexpected snapshots %v", snapshots)
+		}
+		checkEntries(t, getEntries(t, db, 1, 11), 1, 11, 1)
+	}
+	runLogDBTest(t, tf, defaultSegmentSize)
+}
+
+func TestSegmentsAreRemovedAfterCompaction(t *testing.T) {
+	tf := func(t *testing.T, open func() *LogDB) {
+		db := open()
+		for i := uint64(1); i < 1000; i += 10 {
+			saveEntries(t, db, getTestEntries(i, i+10, 1))
+		}
+		s := db.getShard(1)
+		count := len(s.segments)
+		if count < 10 {
+			t.Fatalf("segments not rolled over, %d", count)
+		}
+		if err := db.RemoveEntriesTo(1, 2, 900); err != nil {
+			t.Fatalf("failed to remove entries %v", err)
+		}
+		done, err := db.CompactEntriesTo(1, 2, 900)
+		if err != nil {
+			t.Fatalf("failed to compact %v", err)
+		}
+		<-done
+		if len(s.segments) >= count/2 {
+			t.Errorf("segments not removed, %d, %d", len(s.segments), count)
+		}
+		names, err := s.fs.List(s.dir)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(names) != len(s.segments)+1 {
+			t.Errorf("unexpected files %v", names)
+		}
+		rs, err := db.ReadRaftState(1, 2, 899)
+		if err != nil || rs.FirstIndex != 900 || rs.EntryCount != 101 {
+			t.Errorf("unexpected raft state %+v, %v", rs, err)
+		}
+		db.Close()
+		db = open()
+		defer db.Close()
+		checkEntries(t, getEntries(t, db, 900, 1001), 900, 1001, 1)
+		rs, err = db.ReadRaftState(1, 2, 899)
+		if err != nil || rs.FirstIndex != 900 || rs.EntryCount != 101 {
+			t.Errorf("unexpected raft state %+v, %v", rs, err)
+		}
+	}
+	runLogDBTest(t, tf, 4096)
+}
+
+func TestPartiallyWrittenRecordIsIgnored(t *testing.T) {
+	tf := func(t *testing.T, open func() *LogDB) {
+		db := open()
+		saveEntries(t, db, getTestEntries(1, 11, 1))
+		s := db.getShard(1)
+		fp := s.fs.PathJoin(s.dir, getSegmentFilename(s.currentID+1))
+		db.Close()
+		e := encoder{}
+		e.addEntries(1, 2, getTestEntries(11, 21, 1))
+		f, err := s.fs.Create(fp)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := f.Write(e.buf[:len(e.buf)-1]); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		db = open()
+		defer db.Close()
+		checkEntries(t, getEntries(t, db, 1, 100), 1, 11, 1)
+		saveEntries(t, db, getTestEntries(11, 21, 1))
+		checkEntries(t, getEntries(t, db, 1, 100), 1, 21, 1)
+		db.Close()
+		db = open()
+		checkEntries(t, getEntries(t, db, 1, 100), 1, 21, 1)
+	}
+	runLogDBTest(t, tf, defaultSegmentSize)
+}
+
+func corruptSegment(t *testing.T, s *shard, id uint64, offset int64) {
+	data, err := s.readSegment(id)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	data[offset] ^= 0xFF
+	f, err := s.fs.Create(s.fs.PathJoin(s.dir, getSegmentFilename(id)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestCorruptedRecordIsReported(t *testing.T) {
+	tests := []struct {
+		segmentSize int64
+		last        bool
+	}{
+		{defaultSegmentSize, true},
+		{4096, false},
+	}
+	for idx, tt := range tests {
+		tf := func(t *testing.T, open func() *LogDB) {
+			db := open()
+			for i := uint64(1); i < 100; i += 10 {
+				saveEntries(t, db, getTestEntries(i, i+10, 1))
+			}
+			s := db.getShard(1)
+			id := s.segments[0]
+			if tt.last {
+				id = s.currentID
+			}
+			pos := s.getNode(1, 2, false).positions[0]
+			if tt.last {
+				pos = s.getNode(1, 2, false).positions[10]
+			}
+			if pos.segment != id {
+				t.Fatalf("%d, unexpected segment %d, want %d", idx, pos.segment, id)
+			}
+			db.Close()
+			corruptSegment(t, s, id, pos.offset+recordHeaderSize+1)
+			_, err := newLogDB(getTestConfig(),
+				[]string{testDir}, nil, tt.segmentSize, s.fs)
+			if !errors.Is(err, ErrCorruptedSegment) {
+				t.Errorf("%d, unexpected error %v", idx, err)
+			}
+		}
+		runLogDBTest(t, tf, tt.segmentSize)
+	}
+}
+
+type faultyFile struct {
+	vfs.File
+}
+
+func (f *faultyFile) Write(data []byte) (int, error) {
+	n, _ := f.File.Write(data[:len(data)/2])
+	return n, errors.New("write failed")
+}
+
+func TestShardFailsOnPartialWrite(t *testing.T) {
+	tf := func(t *testing.T, open func() *LogDB) {
+		db := open()
+		saveEntries(t, db, getTestEntries(1, 11, 1))
+		s := db.getShard(1)
+		s.current = &faultyFile{File: s.current}
+		ud := pb.Update{
+			ClusterID:     1,
+			NodeID:        2,
+			EntriesToSave: getTestEntries(11, 21, 1),
+		}
+		if err := db.SaveRaftState([]pb.Update{ud}, 1); err == nil {
+			t.Fatalf("partial write not reported")
+		}
+		ud.EntriesToSave = getTestEntries(11, 12, 1)
+		err := db.SaveRaftState([]pb.Update{ud}, 1)
+		if !errors.Is(err, ErrShardFailed) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		checkEntries(t, getEntries(t, db, 1, 100), 1, 11, 1)
+		db.Close()
+		db = open()
+		defer db.Close()
+		checkEntries(t, getEntries(t, db, 1, 100), 1, 11, 1)
+	}
+	runLogDBTest(t, tf, defaultSegmentSize)
+}
+
+func TestNodeDataCanBeRemoved(t *testing.T) {
+	tf := func(t *testing.T, open func() *LogDB) {
+		db := open()
+		if err := db.SaveBootstrapInfo(1, 2, pb.Bootstrap{}); err != nil {
+			t.Fatalf("failed to save bootstrap %v", err)
+		}
+		saveEntries(t, db, getTestEntries(1, 11, 1))
+		if err := db.RemoveNodeData(1, 2); err != nil {
+			t.Fatalf("failed to remove node data %v", err)
+		}
+		db.Close()
+		db = open()
+		defer db.Close()
+		if _, err := db.GetBootstrapInfo(1, 2); err != raftio.ErrNoBootstrapInfo {
+			t.Errorf("unexpected error %v", err)
+		}
+		if ents := getEntries(t, db, 1, 11); len(ents) != 0 {
+			t.Errorf("entries not removed")
+		}
+	}
+	runLogDBTest(t, tf, defaultSegmentSize)
+}
+
+func TestSnapshotCanBeImported(t *testing.T) {
+	tf := func(t *testing.T, open func() *LogDB) {
+		db := open()
+		defer db.Close()
+		ss := pb.Snapshot{
+			ClusterId: 1,
+			Index:     100,
+			Term:      3,
+			Type:      pb.RegularStateMachine,
+		}
+		if err := db.ImportSnapshot(ss, 2); err != nil {
+			t.Fatalf("failed to import snapshot %v", err)
+		}
+		bs, err := db.GetBootstrapInfo(1, 2)
+		if err != nil || !bs.Join || bs.Type != pb.RegularStateMachine {
+			t.Errorf("unexpected bootstrap %v, %v", bs, err)
+		}
+		rs, err := db.ReadRaftState(1, 2, 100)
+		if err != nil || rs.State.Commit != 100 || rs.EntryCount != 0 {
+			t.Errorf("unexpected raft state %+v, %v", rs, err)
+		}
+		snapshots, err := db.ListSnapshots(1, 2, math.MaxUint64)
+		if err != nil || len(snapshots) != 1 || snapshots[0].Index != 100 {
+			t.Errorf("unexpected snapshots %v, %v", snapshots, err)
+		}
+	}
+	runLogDBTest(t, tf, defaultSegmentSize)
+}
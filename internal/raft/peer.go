@@ -85,6 +85,19 @@ func Launch(config config.Config,
 	return p
 }
 
+// ConfigChangeFilter is the function invoked by the leader for each config
+// change request before it is appended to the log, from is the NodeID of the
+// node on which the request was made. It returns the config change to be
+// appended and replicated, or false when the request is vetoed.
+type ConfigChangeFilter func(from uint64,
+	cc pb.ConfigChange) (pb.ConfigChange, bool)
+
+// SetConfigChangeFilter sets the config change filter used when the local
+// node is the leader.
+func (p *Peer) SetConfigChangeFilter(f ConfigChangeFilter) {
+	p.raft.configChangeFilter = f
+}
+
 // Tick moves the logical clock forward by one tick.
 func (p *Peer) Tick() {
 	p.raft.Handle(pb.Message{
@@ -274,6 +287,9 @@ func (p *Peer) HasUpdate(moreToApply bool) bool {
 	if len(r.droppedEntries) > 0 {
 		return true
 	}
+	if len(r.vetoedConfigChanges) > 0 {
+		return true
+	}
 	if len(r.droppedReadIndexes) > 0 {
 		return true
 	}
@@ -284,7 +300,10 @@ func (p *Peer) HasUpdate(moreToApply bool) bool {
 func (p *Peer) Commit(ud pb.Update) {
 	p.raft.msgs = nil
 	p.raft.droppedEntries = nil
+	p.raft.droppedEntryInfo = nil
+	p.raft.vetoedConfigChanges = nil
 	p.raft.droppedReadIndexes = nil
+	p.raft.droppedReadIndexInfo = nil
 	if !pb.IsEmptyState(ud.State) {
 		p.prevState = ud.State
 	}
@@ -316,6 +335,111 @@ func (p *Peer) HasEntryToApply() bool {
 	return p.entryLog().hasEntriesToApply()
 }
 
+// LocalStatus is the Raft log related status of the local Raft node.
+type LocalStatus struct {
+	Term            uint64
+	CommittedIndex  uint64
+	InMemEntryCount uint64
+	InMemEntrySize  uint64
+	// LeaderCommittedIndex is the highest committed index known to the local
+	// node as reported by the leader.
+	LeaderCommittedIndex uint64
+	// LeaderContactTicks is the number of ticks elapsed since the last message
+	// from the leader was received. On the leader, it is the number of ticks
+	// elapsed since the leader was last in contact with a quorum of voting
+	// members.
+	LeaderContactTicks uint64
+	// Vote is the NodeID of the node voted for in the current term.
+	Vote uint64
+	// LastIndex and LastTerm are the index and term of the last log entry.
+	LastIndex uint64
+	LastTerm  uint64
+	// SnapshotIndex is the index of the most recent snapshot known to the
+	// Raft log.
+	SnapshotIndex uint64
+}
+
+// GetLocalStatus returns the Raft log related status of the local Raft node.
+func (p *Peer) GetLocalStatus() LocalStatus {
+	ents := p.entryLog().inmem.entries
+	ls := LocalStatus{
+		Term:            p.raft.term,
+		CommittedIndex:  p.entryLog().committed,
+		InMemEntryCount: uint64(len(ents)),
+		InMemEntrySize:  pb.GetEntrySliceInMemSize(ents),
+		Vote:            p.raft.vote,
+		LastIndex:       p.entryLog().lastIndex(),
+		LastTerm:        p.entryLog().lastTerm(),
+		SnapshotIndex:   p.entryLog().snapshot().Index,
+	}
+	if p.raft.isLeader() {
+		ls.LeaderCommittedIndex = ls.CommittedIndex
+		ls.LeaderContactTicks = p.raft.quorumContactTicks()
+	} else {
+		ls.LeaderCommittedIndex = max(p.raft.leaderCommit, ls.CommittedIndex)
+		ls.LeaderContactTicks = p.raft.tickCount - p.raft.leaderContact
+	}
+	return ls
+}
+
+// RemoteStatus is the replication status of a Raft node as observed by the
+// leader.
+type RemoteStatus struct {
+	Match        uint64
+	Next         uint64
+	Paused       bool
+	Snapshotting bool
+	Observer     bool
+	Witness      bool
+	// Contacted indicates whether any response has been received from the
+	// node since the local node became the leader.
+	Contacted bool
+	// LastContactTicks is the number of ticks elapsed since the last response
+	// from the node was received. It is meaningful only when Contacted is true.
+	LastContactTicks uint64
+}
+
+// GetRemoteStatus returns the replication status of all nodes in the Raft
+// cluster as observed by the local node. The returned boolean value is false
+// when the local node is not the leader, the remote status is not tracked in
+// such case.
+func (p *Peer) GetRemoteStatus() (map[uint64]RemoteStatus, bool) {
+	r := p.raft
+	if !r.isLeader() {
+		return nil, false
+	}
+	result := make(map[uint64]RemoteStatus)
+	get := func(nodeID uint64, rp *remote) RemoteStatus {
+		rs := RemoteStatus{
+			Match:        rp.match,
+			Next:         rp.next,
+			Paused:       rp.isPaused(),
+			Snapshotting: rp.state == remoteSnapshot,
+		}
+		if nodeID == r.nodeID {
+			rs.Contacted = true
+		} else if rp.lastContact > 0 {
+			rs.Contacted = true
+			rs.LastContactTicks = r.tickCount - rp.lastContact
+		}
+		return rs
+	}
+	for nodeID, rp := range r.remotes {
+		result[nodeID] = get(nodeID, rp)
+	}
+	for nodeID, rp := range r.observers {
+		rs := get(nodeID, rp)
+		rs.Observer = true
+		result[nodeID] = rs
+	}
+	for nodeID, rp := range r.witnesses {
+		rs := get(nodeID, rp)
+		rs.Witness = true
+		result[nodeID] = rs
+	}
+	return result, true
+}
+
 func (p *Peer) entryLog() *entryLog {
 	return p.raft.log
 }
@@ -350,9 +474,14 @@ func (p *Peer) getUpdate(moreToApply bool, lastApplied uint64) pb.Update {
 	}
 	if len(p.raft.droppedEntries) > 0 {
 		ud.DroppedEntries = p.raft.droppedEntries
+		ud.DroppedEntryInfo = p.raft.droppedEntryInfo
+	}
+	if len(p.raft.vetoedConfigChanges) > 0 {
+		ud.VetoedConfigChanges = p.raft.vetoedConfigChanges
 	}
 	if len(p.raft.droppedReadIndexes) > 0 {
 		ud.DroppedReadIndexes = p.raft.droppedReadIndexes
+		ud.DroppedReadIndexInfo = p.raft.droppedReadIndexInfo
 	}
 	return ud
 }
@@ -211,6 +211,117 @@ func TestGetUpdateIncludeLastAppliedValue(t *testing.T) {
 	}
 }
 
+func TestGetLocalStatus(t *testing.T) {
+	s := NewTestLogDB()
+	rawNode := Launch(newTestConfig(1, 10, 1), s, nil, []PeerAddress{{NodeID: 1}}, true, true)
+	rawNode.raft.term = 5
+	rawNode.raft.log.committed = 1
+	ents := rawNode.raft.log.inmem.entries
+	ls := rawNode.GetLocalStatus()
+	if ls.Term != 5 || ls.CommittedIndex != 1 {
+		t.Errorf("unexpected status %+v", ls)
+	}
+	if ls.InMemEntryCount != uint64(len(ents)) ||
+		ls.InMemEntrySize != pb.GetEntrySliceInMemSize(ents) {
+		t.Errorf("unexpected in memory entry info %+v", ls)
+	}
+}
+
+func TestGetLocalStatusTracksLeaderCommit(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 5, 1, NewTestLogDB())
+	p := &Peer{raft: r}
+	r.becomeFollower(1, 2)
+	r.tick()
+	r.Handle(pb.Message{From: 2, To: 1, Type: pb.Heartbeat, Term: 1, Commit: 0})
+	r.Handle(pb.Message{From: 2, To: 1, Type: pb.Replicate, Term: 1,
+		LogIndex: 100, LogTerm: 1, Commit: 120})
+	r.tick()
+	r.tick()
+	ls := p.GetLocalStatus()
+	if ls.LeaderCommittedIndex != 120 {
+		t.Errorf("leader commit %d, want 120", ls.LeaderCommittedIndex)
+	}
+	if ls.LeaderContactTicks != 2 {
+		t.Errorf("leader contact ticks %d, want 2", ls.LeaderContactTicks)
+	}
+}
+
+func TestGetLocalStatusTracksQuorumContactOnPartitionedLeader(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 50, 1, NewTestLogDB())
+	p := &Peer{raft: r}
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.tick()
+	r.Handle(pb.Message{From: 2, To: 1, Type: pb.HeartbeatResp, Term: r.term})
+	if ls := p.GetLocalStatus(); ls.LeaderContactTicks != 0 {
+		t.Errorf("leader contact ticks %d, want 0", ls.LeaderContactTicks)
+	}
+	// the leader is partitioned, no response is received from the quorum
+	for i := 0; i < 10; i++ {
+		r.tick()
+	}
+	if !r.isLeader() {
+		t.Fatalf("not leader")
+	}
+	ls := p.GetLocalStatus()
+	if ls.LeaderContactTicks != 10 {
+		t.Errorf("leader contact ticks %d, want 10", ls.LeaderContactTicks)
+	}
+	if ls.LeaderCommittedIndex != ls.CommittedIndex {
+		t.Errorf("unexpected leader committed index %+v", ls)
+	}
+	// a response from a single node is enough to reach the quorum again
+	r.Handle(pb.Message{From: 3, To: 1, Type: pb.HeartbeatResp, Term: r.term})
+	if ls := p.GetLocalStatus(); ls.LeaderContactTicks != 0 {
+		t.Errorf("leader contact ticks %d, want 0", ls.LeaderContactTicks)
+	}
+}
+
+func TestGetLocalStatusReportsRaftState(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 5, 1, NewTestLogDB())
+	p := &Peer{raft: r}
+	r.becomeCandidate()
+	ls := p.GetLocalStatus()
+	if ls.Term != 1 || ls.Vote != 1 {
+		t.Errorf("unexpected status %+v", ls)
+	}
+	if ls.LastIndex != r.log.lastIndex() || ls.LastTerm != r.log.lastTerm() {
+		t.Errorf("unexpected status %+v", ls)
+	}
+}
+
+func TestGetRemoteStatus(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 5, 1, NewTestLogDB())
+	p := &Peer{raft: r}
+	if _, ok := p.GetRemoteStatus(); ok {
+		t.Errorf("remote status unexpectedly returned on follower")
+	}
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.tick()
+	r.tick()
+	r.handleLeaderHeartbeatResp(pb.Message{Type: pb.HeartbeatResp, From: 2},
+		r.remotes[2])
+	r.tick()
+	r.remotes[3].becomeSnapshot(10)
+	status, ok := p.GetRemoteStatus()
+	if !ok {
+		t.Fatalf("failed to get remote status")
+	}
+	if len(status) != 3 {
+		t.Fatalf("unexpected status count %d", len(status))
+	}
+	if !status[1].Contacted || status[1].Match != r.log.lastIndex() {
+		t.Errorf("unexpected local status %+v", status[1])
+	}
+	if !status[2].Contacted || status[2].LastContactTicks != 1 {
+		t.Errorf("unexpected status %+v", status[2])
+	}
+	if status[3].Contacted || !status[3].Snapshotting || !status[3].Paused {
+		t.Errorf("unexpected status %+v", status[3])
+	}
+}
+
 func TestRaftMoreEntriesToApplyControl(t *testing.T) {
 	s := NewTestLogDB()
 	rawNode := Launch(newTestConfig(1, 10, 1), s, nil, []PeerAddress{{NodeID: 1}}, true, true)
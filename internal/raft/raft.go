@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"math"
 	"sort"
+	"time"
 
 	"github.com/lni/goutils/logutil"
 	"github.com/lni/goutils/random"
@@ -47,7 +48,7 @@ const (
 	// NoNode is the flag used to indicate that the node id field is not set.
 	NoNode          uint64 = 0
 	noLimit         uint64 = math.MaxUint64
-	numMessageTypes uint64 = 26
+	numMessageTypes uint64 = 27
 )
 
 var (
@@ -199,6 +200,7 @@ type raft struct {
 	handlers                  [numStates][numMessageTypes]handlerFunc
 	events                    server.IRaftEventListener
 	hasNotAppliedConfigChange func() bool
+	configChangeFilter        ConfigChangeFilter
 	votes                     map[uint64]bool
 	handle                    stepFunc
 	log                       *entryLog
@@ -210,7 +212,10 @@ type raft struct {
 	matched                   []uint64
 	msgs                      []pb.Message
 	droppedReadIndexes        []pb.SystemCtx
+	droppedReadIndexInfo      []pb.DropInfo
 	droppedEntries            []pb.Entry
+	droppedEntryInfo          []pb.DropInfo
+	vetoedConfigChanges       []uint64
 	readyToRead               []pb.ReadyToRead
 	prevLeader                server.LeaderInfo
 	state                     State
@@ -222,13 +227,17 @@ type raft struct {
 	applied                   uint64
 	vote                      uint64
 	tickCount                 uint64
+	leaderContact             uint64
+	leaderCommit              uint64
 	electionTick              uint64
 	heartbeatTick             uint64
 	heartbeatTimeout          uint64
 	electionTimeout           uint64
 	randomizedElectionTimeout uint64
+	lastTimestamp             uint64
 	snapshotting              bool
 	checkQuorum               bool
+	entryTimestamp            bool
 	quiesce                   bool
 	isLeaderTransferTarget    bool
 	pendingConfigChange       bool
@@ -255,6 +264,7 @@ func newRaft(c config.Config, logdb ILogDB) *raft {
 		electionTimeout:  c.ElectionRTT,
 		heartbeatTimeout: c.HeartbeatRTT,
 		checkQuorum:      c.CheckQuorum,
+		entryTimestamp:   c.EntryTimestamp,
 		readIndex:        newReadIndex(),
 		rl:               rl,
 	}
@@ -395,6 +405,26 @@ func (r *raft) leaderHasQuorum() bool {
 	return c >= r.quorum()
 }
 
+// quorumContactTicks returns the number of ticks elapsed since the leader was
+// last in contact with a quorum of voting members, the leader itself included.
+func (r *raft) quorumContactTicks() uint64 {
+	contacts := make([]uint64, 0, r.numVotingMembers())
+	for nid, member := range r.votingMembers() {
+		if nid == r.nodeID {
+			contacts = append(contacts, r.tickCount)
+		} else {
+			contacts = append(contacts, member.lastContact)
+		}
+	}
+	if len(contacts) == 0 {
+		return r.tickCount
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i] > contacts[j]
+	})
+	return r.tickCount - contacts[r.quorum()-1]
+}
+
 func (r *raft) nodes() []uint64 {
 	nodes := make([]uint64, 0, r.numVotingMembers()+len(r.observers))
 	for id := range r.remotes {
@@ -788,6 +818,11 @@ func (r *raft) sendReplicateMessage(to uint64) {
 			return
 		}
 		index := r.makeInstallSnapshotMessage(to, &m)
+		// the applied index advertised by the remote allows a delta snapshot to
+		// be streamed when supported by the state machine
+		if rp.applied < index {
+			m.Hint = rp.applied
+		}
 		plog.Infof("%s is sending snapshot (%d) to %s, r.Next %d, r.Match %d, %v",
 			r.describe(), index, NodeID(to), rp.next, rp.match, err)
 		rp.becomeSnapshot(index)
@@ -913,9 +948,11 @@ func (r *raft) tryCommit() bool {
 
 func (r *raft) appendEntries(entries []pb.Entry) {
 	lastIndex := r.log.lastIndex()
+	ts := r.getTimestamp()
 	for i := range entries {
 		entries[i].Term = r.term
 		entries[i].Index = lastIndex + 1 + uint64(i)
+		entries[i].Timestamp = ts
 	}
 	r.log.append(entries)
 	r.remotes[r.nodeID].tryUpdate(r.log.lastIndex())
@@ -924,6 +961,18 @@ func (r *raft) appendEntries(entries []pb.Entry) {
 	}
 }
 
+// getTimestamp returns the timestamp to be recorded into entries appended by
+// the leader, it never decreases when the wall clock moves backwards.
+func (r *raft) getTimestamp() uint64 {
+	if !r.entryTimestamp {
+		return 0
+	}
+	if now := uint64(time.Now().UnixNano()); now > r.lastTimestamp {
+		r.lastTimestamp = now
+	}
+	return r.lastTimestamp
+}
+
 //
 // state transition related functions
 //
@@ -1314,6 +1363,7 @@ func (r *raft) getPendingConfigChangeCount() int {
 //
 
 func (r *raft) handleHeartbeatMessage(m pb.Message) {
+	r.setLeaderCommit(m.Commit)
 	r.log.commitTo(m.Commit)
 	r.send(pb.Message{
 		To:       m.From,
@@ -1353,9 +1403,11 @@ func (r *raft) handleInstallSnapshotMessage(m pb.Message) {
 
 func (r *raft) handleReplicateMessage(m pb.Message) {
 	resp := pb.Message{
-		To:   m.From,
-		Type: pb.ReplicateResp,
+		To:       m.From,
+		Type:     pb.ReplicateResp,
+		HintHigh: r.applied,
 	}
+	r.setLeaderCommit(m.Commit)
 	if m.LogIndex < r.log.committed {
 		resp.LogIndex = r.log.committed
 		r.send(resp)
@@ -1617,7 +1669,10 @@ func (r *raft) handleLeaderPropose(m pb.Message) {
 	r.mustBeLeader()
 	if r.leaderTransfering() {
 		plog.Warningf("%s dropped proposal, leader transferring", r.describe())
-		r.reportDroppedProposal(m)
+		r.reportDroppedProposal(m, pb.DropInfo{
+			Reason:     pb.DropLeaderTransferring,
+			LeaderHint: r.leaderTransferTarget,
+		})
 		return
 	}
 	for i, e := range m.Entries {
@@ -1626,6 +1681,11 @@ func (r *raft) handleLeaderPropose(m pb.Message) {
 				plog.Warningf("%s dropped config change, pending change", r.describe())
 				r.reportDroppedConfigChange(m.Entries[i])
 				m.Entries[i] = pb.Entry{Type: pb.ApplicationEntry}
+			} else if !r.filterConfigChange(m.From, &m.Entries[i]) {
+				plog.Warningf("%s vetoed config change", r.describe())
+				r.reportVetoedConfigChange(m.From, m.Entries[i])
+				m.Entries[i] = pb.Entry{Type: pb.ApplicationEntry}
+				continue
 			}
 			r.setPendingConfigChange()
 		}
@@ -1673,7 +1733,10 @@ func (r *raft) handleLeaderReadIndex(m pb.Message) {
 			// see raft thesis section 6.4, this is the first step of the ReadIndex
 			// protocol.
 			plog.Warningf("%s dropped ReadIndex, not ready", r.describe())
-			r.reportDroppedReadIndex(m)
+			r.reportDroppedReadIndex(m, pb.DropInfo{
+				Reason:     pb.DropLeaderNotReady,
+				LeaderHint: r.nodeID,
+			})
 			return
 		}
 		r.readIndex.addRequest(r.log.committed, ctx, m.From)
@@ -1697,6 +1760,8 @@ func (r *raft) handleLeaderReadIndex(m pb.Message) {
 func (r *raft) handleLeaderReplicateResp(m pb.Message, rp *remote) {
 	r.mustBeLeader()
 	rp.setActive()
+	rp.lastContact = r.tickCount
+	rp.applied = m.HintHigh
 	if !m.Reject {
 		paused := rp.isPaused()
 		if rp.tryUpdate(m.LogIndex) {
@@ -1728,6 +1793,7 @@ func (r *raft) handleLeaderReplicateResp(m pb.Message, rp *remote) {
 func (r *raft) handleLeaderHeartbeatResp(m pb.Message, rp *remote) {
 	r.mustBeLeader()
 	rp.setActive()
+	rp.lastContact = r.tickCount
 	rp.waitToRetry()
 	if rp.match < r.log.lastIndex() {
 		r.sendReplicateMessage(m.From)
@@ -1883,6 +1949,10 @@ func (r *raft) handleObserverReadIndexResp(m pb.Message) {
 	r.handleFollowerReadIndexResp(m)
 }
 
+func (r *raft) handleObserverConfigChangeVetoed(m pb.Message) {
+	r.handleFollowerConfigChangeVetoed(m)
+}
+
 //
 // message handlers used by witness, re-route them to follower handlers
 //
@@ -1906,7 +1976,7 @@ func (r *raft) handleWitnessSnapshot(m pb.Message) {
 func (r *raft) handleFollowerPropose(m pb.Message) {
 	if r.leaderID == NoLeader {
 		plog.Warningf("%s dropped proposal, no leader", r.describe())
-		r.reportDroppedProposal(m)
+		r.reportDroppedProposal(m, pb.DropInfo{Reason: pb.DropNoLeader})
 		return
 	}
 	m.To = r.leaderID
@@ -1919,6 +1989,15 @@ func (r *raft) handleFollowerPropose(m pb.Message) {
 
 func (r *raft) leaderIsAvailable() {
 	r.electionTick = 0
+	r.leaderContact = r.tickCount
+}
+
+// setLeaderCommit records the highest commit index reported by the leader, it
+// can be higher than the local committed index when the local log is behind.
+func (r *raft) setLeaderCommit(commit uint64) {
+	if commit > r.leaderCommit {
+		r.leaderCommit = commit
+	}
 }
 
 func (r *raft) handleFollowerReplicate(m pb.Message) {
@@ -1936,7 +2015,7 @@ func (r *raft) handleFollowerHeartbeat(m pb.Message) {
 func (r *raft) handleFollowerReadIndex(m pb.Message) {
 	if r.leaderID == NoLeader {
 		plog.Warningf("%s dropped ReadIndex, no leader", r.describe())
-		r.reportDroppedReadIndex(m)
+		r.reportDroppedReadIndex(m, pb.DropInfo{Reason: pb.DropNoLeader})
 		return
 	}
 	m.To = r.leaderID
@@ -1962,6 +2041,10 @@ func (r *raft) handleFollowerReadIndexResp(m pb.Message) {
 	r.addReadyToRead(m.LogIndex, ctx)
 }
 
+func (r *raft) handleFollowerConfigChangeVetoed(m pb.Message) {
+	r.vetoedConfigChanges = append(r.vetoedConfigChanges, m.Hint)
+}
+
 func (r *raft) handleFollowerInstallSnapshot(m pb.Message) {
 	r.leaderIsAvailable()
 	r.setLeaderID(m.From)
@@ -1992,17 +2075,12 @@ func (r *raft) doubleCheckTermMatched(msgTerm uint64) {
 
 func (r *raft) handleCandidatePropose(m pb.Message) {
 	plog.Warningf("%s dropped proposal, no leader", r.describe())
-	r.reportDroppedProposal(m)
+	r.reportDroppedProposal(m, pb.DropInfo{Reason: pb.DropNoLeader})
 }
 
 func (r *raft) handleCandidateReadIndex(m pb.Message) {
 	plog.Warningf("%s dropped read index, no leader", r.describe())
-	r.reportDroppedReadIndex(m)
-	ctx := pb.SystemCtx{
-		Low:  m.Hint,
-		High: m.HintHigh,
-	}
-	r.droppedReadIndexes = append(r.droppedReadIndexes, ctx)
+	r.reportDroppedReadIndex(m, pb.DropInfo{Reason: pb.DropNoLeader})
 }
 
 // when any of the following three methods
@@ -2047,10 +2125,52 @@ func (r *raft) handleCandidateRequestVoteResp(m pb.Message) {
 
 func (r *raft) reportDroppedConfigChange(e pb.Entry) {
 	r.droppedEntries = append(r.droppedEntries, e)
+	r.droppedEntryInfo = append(r.droppedEntryInfo,
+		pb.DropInfo{Reason: pb.DropPendingConfigChange, LeaderHint: r.nodeID})
 }
 
-func (r *raft) reportDroppedProposal(m pb.Message) {
+// reportVetoedConfigChange reports the vetoed config change to the node on
+// which it was requested, so the request can be completed as rejected there.
+func (r *raft) reportVetoedConfigChange(from uint64, e pb.Entry) {
+	if from == NoNode || from == r.nodeID {
+		r.vetoedConfigChanges = append(r.vetoedConfigChanges, e.Key)
+		return
+	}
+	r.send(pb.Message{To: from, Type: pb.ConfigChangeVetoed, Hint: e.Key})
+}
+
+// filterConfigChange passes the config change carried by the specified entry
+// to the config change filter. It returns a boolean value indicating whether
+// the config change is accepted, the entry is updated to carry the config
+// change returned by the filter.
+func (r *raft) filterConfigChange(from uint64, e *pb.Entry) bool {
+	if r.configChangeFilter == nil {
+		return true
+	}
+	if from == NoNode {
+		from = r.nodeID
+	}
+	var cc pb.ConfigChange
+	if err := cc.Unmarshal(e.Cmd); err != nil {
+		panic(err)
+	}
+	result, ok := r.configChangeFilter(from, cc)
+	if !ok {
+		return false
+	}
+	data, err := result.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	e.Cmd = data
+	return true
+}
+
+func (r *raft) reportDroppedProposal(m pb.Message, info pb.DropInfo) {
 	r.droppedEntries = append(r.droppedEntries, newEntrySlice(m.Entries)...)
+	for range m.Entries {
+		r.droppedEntryInfo = append(r.droppedEntryInfo, info)
+	}
 	if r.events != nil {
 		info := server.ProposalInfo{
 			ClusterID: r.clusterID,
@@ -2061,12 +2181,13 @@ func (r *raft) reportDroppedProposal(m pb.Message) {
 	}
 }
 
-func (r *raft) reportDroppedReadIndex(m pb.Message) {
+func (r *raft) reportDroppedReadIndex(m pb.Message, info pb.DropInfo) {
 	sysctx := pb.SystemCtx{
 		Low:  m.Hint,
 		High: m.HintHigh,
 	}
 	r.droppedReadIndexes = append(r.droppedReadIndexes, sysctx)
+	r.droppedReadIndexInfo = append(r.droppedReadIndexInfo, info)
 	if r.events != nil {
 		info := server.ReadIndexInfo{
 			ClusterID: r.clusterID,
@@ -2119,6 +2240,7 @@ func (r *raft) initializeHandlerMap() {
 	r.handlers[follower][pb.ReadIndex] = r.handleFollowerReadIndex
 	r.handlers[follower][pb.LeaderTransfer] = r.handleFollowerLeaderTransfer
 	r.handlers[follower][pb.ReadIndexResp] = r.handleFollowerReadIndexResp
+	r.handlers[follower][pb.ConfigChangeVetoed] = r.handleFollowerConfigChangeVetoed
 	r.handlers[follower][pb.InstallSnapshot] = r.handleFollowerInstallSnapshot
 	r.handlers[follower][pb.Election] = r.handleNodeElection
 	r.handlers[follower][pb.RequestVote] = r.handleNodeRequestVote
@@ -2149,6 +2271,7 @@ func (r *raft) initializeHandlerMap() {
 	r.handlers[observer][pb.Propose] = r.handleObserverPropose
 	r.handlers[observer][pb.ReadIndex] = r.handleObserverReadIndex
 	r.handlers[observer][pb.ReadIndexResp] = r.handleObserverReadIndexResp
+	r.handlers[observer][pb.ConfigChangeVetoed] = r.handleObserverConfigChangeVetoed
 	r.handlers[observer][pb.ConfigChangeEvent] = r.handleNodeConfigChange
 	r.handlers[observer][pb.LocalTick] = r.handleLocalTick
 	r.handlers[observer][pb.SnapshotReceived] = r.handleRestoreRemote
@@ -2172,6 +2295,7 @@ func (r *raft) checkHandlerMap() {
 		{leader, pb.Replicate},
 		{leader, pb.InstallSnapshot},
 		{leader, pb.ReadIndexResp},
+		{leader, pb.ConfigChangeVetoed},
 		{follower, pb.ReplicateResp},
 		{follower, pb.HeartbeatResp},
 		{follower, pb.SnapshotStatus},
@@ -2189,6 +2313,7 @@ func (r *raft) checkHandlerMap() {
 		{witness, pb.Propose},
 		{witness, pb.ReadIndex},
 		{witness, pb.ReadIndexResp},
+		{witness, pb.ConfigChangeVetoed},
 		{witness, pb.RequestVoteResp},
 		{witness, pb.ReplicateResp},
 		{witness, pb.HeartbeatResp},
@@ -1431,6 +1431,90 @@ func TestMakeInstallSnapshotMessage(t *testing.T) {
 	}
 }
 
+func TestReplicateRespIncludesAppliedIndex(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 5, 1, NewTestLogDB())
+	r.becomeFollower(1, 2)
+	r.setApplied(1)
+	r.handleReplicateMessage(pb.Message{From: 2, Type: pb.Replicate})
+	if len(r.msgs) != 1 {
+		t.Fatalf("unexpected message count %d", len(r.msgs))
+	}
+	if r.msgs[0].Type != pb.ReplicateResp || r.msgs[0].HintHigh != 1 {
+		t.Errorf("applied index not included, %+v", r.msgs[0])
+	}
+}
+
+func TestInstallSnapshotMessageIncludesRemoteAppliedIndex(t *testing.T) {
+	tests := []struct {
+		applied uint64
+		hint    uint64
+	}{
+		{0, 0},
+		{50, 50},
+		{100, 0},
+	}
+	for idx, tt := range tests {
+		st := NewTestLogDB()
+		r := newTestRaft(1, []uint64{1, 2}, 5, 1, st)
+		r.becomeCandidate()
+		r.becomeLeader()
+		ss := pb.Snapshot{Index: 100, Term: 2}
+		if err := st.ApplySnapshot(ss); err != nil {
+			t.Fatalf("apply snapshot failed %v", err)
+		}
+		r.log.inmem.restore(ss)
+		r.msgs = nil
+		rp := r.remotes[2]
+		rp.setActive()
+		rp.next, rp.applied = 10, tt.applied
+		r.sendReplicateMessage(2)
+		if len(r.msgs) != 1 || r.msgs[0].Type != pb.InstallSnapshot {
+			t.Fatalf("%d, snapshot not sent, %+v", idx, r.msgs)
+		}
+		if r.msgs[0].Hint != tt.hint {
+			t.Errorf("%d, hint %d, want %d", idx, r.msgs[0].Hint, tt.hint)
+		}
+	}
+}
+
+func newEntryTimestampTestRaft() *raft {
+	cfg := newTestConfig(1, 5, 1)
+	cfg.EntryTimestamp = true
+	r := newRaft(cfg, NewTestLogDB())
+	r.remotes[1] = &remote{next: 1}
+	r.hasNotAppliedConfigChange = r.testOnlyHasConfigChangeToApply
+	r.becomeCandidate()
+	r.becomeLeader()
+	return r
+}
+
+func TestLeaderRecordsEntryTimestamp(t *testing.T) {
+	r := newEntryTimestampTestRaft()
+	ents := []pb.Entry{{Type: pb.ApplicationEntry}}
+	r.appendEntries(ents)
+	if ents[0].Timestamp == 0 {
+		t.Errorf("timestamp not recorded")
+	}
+	r.entryTimestamp = false
+	ents = []pb.Entry{{Type: pb.ApplicationEntry}}
+	r.appendEntries(ents)
+	if ents[0].Timestamp != 0 {
+		t.Errorf("unexpected timestamp %d", ents[0].Timestamp)
+	}
+}
+
+func TestEntryTimestampNeverMovesBackwards(t *testing.T) {
+	r := newEntryTimestampTestRaft()
+	r.lastTimestamp = math.MaxUint64 - 1
+	ents := []pb.Entry{{Type: pb.ApplicationEntry}, {Type: pb.ApplicationEntry}}
+	r.appendEntries(ents)
+	for _, e := range ents {
+		if e.Timestamp != math.MaxUint64-1 {
+			t.Errorf("timestamp moved backwards, %d", e.Timestamp)
+		}
+	}
+}
+
 func TestMakeReplicateMessage(t *testing.T) {
 	st := NewTestLogDB()
 	r := newTestRaft(1, []uint64{1, 2}, 5, 1, st)
@@ -3112,3 +3196,102 @@ func TestCheckDelayedSnapshotAck(t *testing.T) {
 		t.Errorf("not in remote wait state, %s", rp.state)
 	}
 }
+
+func getTestConfigChangeEntry(t *testing.T, key uint64) pb.Entry {
+	cc := pb.ConfigChange{
+		Type:    pb.AddNode,
+		NodeID:  4,
+		Address: "a4",
+	}
+	data, err := cc.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal %v", err)
+	}
+	return pb.Entry{Type: pb.ConfigChangeEntry, Cmd: data, Key: key}
+}
+
+func TestLeaderCanVetoConfigChange(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 5, 1, NewTestLogDB())
+	r.becomeCandidate()
+	r.becomeLeader()
+	var from uint64
+	r.configChangeFilter = func(f uint64,
+		cc pb.ConfigChange) (pb.ConfigChange, bool) {
+		from = f
+		return cc, false
+	}
+	ents := []pb.Entry{getTestConfigChangeEntry(t, 100)}
+	r.handleLeaderPropose(pb.Message{Type: pb.Propose, From: 2, Entries: ents})
+	if from != 2 {
+		t.Errorf("from %d, want 2", from)
+	}
+	if ents[0].Type != pb.ApplicationEntry || len(ents[0].Cmd) != 0 {
+		t.Errorf("vetoed config change not replaced")
+	}
+	if r.hasPendingConfigChange() {
+		t.Errorf("pending config change flag unexpectedly set")
+	}
+	if len(r.vetoedConfigChanges) != 0 {
+		t.Errorf("veto of remote request reported locally")
+	}
+	msgs := r.readMessages()
+	if len(msgs) == 0 || msgs[0].Type != pb.ConfigChangeVetoed ||
+		msgs[0].To != 2 || msgs[0].Hint != 100 {
+		t.Errorf("veto not sent to the requesting node, %v", msgs)
+	}
+	ents = []pb.Entry{getTestConfigChangeEntry(t, 200)}
+	r.handleLeaderPropose(pb.Message{Type: pb.Propose, Entries: ents})
+	if from != 1 {
+		t.Errorf("from %d, want 1", from)
+	}
+	if len(r.vetoedConfigChanges) != 1 || r.vetoedConfigChanges[0] != 200 {
+		t.Errorf("vetoed config change not reported, %v", r.vetoedConfigChanges)
+	}
+	if len(r.droppedEntries) != 0 {
+		t.Errorf("unexpected dropped entries")
+	}
+}
+
+func TestFollowerReportsConfigChangeVetoedByLeader(t *testing.T) {
+	r := newTestRaft(2, []uint64{1, 2, 3}, 5, 1, NewTestLogDB())
+	r.becomeFollower(1, 1)
+	r.Handle(pb.Message{Type: pb.ConfigChangeVetoed, From: 1, To: 2,
+		Term: 1, Hint: 100})
+	if len(r.vetoedConfigChanges) != 1 || r.vetoedConfigChanges[0] != 100 {
+		t.Errorf("vetoed config change not reported, %v", r.vetoedConfigChanges)
+	}
+}
+
+func TestLeaderCanAnnotateConfigChange(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 5, 1, NewTestLogDB())
+	r.becomeCandidate()
+	r.becomeLeader()
+	var from uint64
+	r.configChangeFilter = func(f uint64,
+		cc pb.ConfigChange) (pb.ConfigChange, bool) {
+		from = f
+		cc.Address = "a4-annotated"
+		return cc, true
+	}
+	ents := []pb.Entry{getTestConfigChangeEntry(t, 100)}
+	r.handleLeaderPropose(pb.Message{Type: pb.Propose, Entries: ents})
+	if from != 1 {
+		t.Errorf("from %d, want 1", from)
+	}
+	if ents[0].Type != pb.ConfigChangeEntry {
+		t.Fatalf("config change entry unexpectedly replaced")
+	}
+	var cc pb.ConfigChange
+	if err := cc.Unmarshal(ents[0].Cmd); err != nil {
+		t.Fatalf("failed to unmarshal %v", err)
+	}
+	if cc.Address != "a4-annotated" || cc.NodeID != 4 {
+		t.Errorf("unexpected config change %+v", cc)
+	}
+	if !r.hasPendingConfigChange() {
+		t.Errorf("pending config change flag not set")
+	}
+	if len(r.vetoedConfigChanges) != 0 {
+		t.Errorf("unexpected vetoed config change")
+	}
+}
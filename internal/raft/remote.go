@@ -77,6 +77,12 @@ type remote struct {
 	state         remoteStateType
 	active        bool
 	delayed       snapshotAck
+	// tick count of the leader when the last response from the remote was
+	// received, 0 means no response received since the leader was elected
+	lastContact uint64
+	// applied index last advertised by the remote in its ReplicateResp, used
+	// for requesting delta snapshots
+	applied uint64
 }
 
 func (r *remote) String() string {
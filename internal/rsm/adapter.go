@@ -41,12 +41,115 @@ type IStateMachine interface {
 	Type() pb.StateMachineType
 }
 
+// idempotencyTokenUser is implemented by adapters that can pass the
+// idempotency tokens area to the underlying user state machine.
+type idempotencyTokenUser interface {
+	setIdempotencyTokens(t sm.IIdempotencyTokens)
+}
+
+func setIdempotencyTokens(s interface{}, t sm.IIdempotencyTokens) {
+	if u, ok := s.(sm.IIdempotencyTokenUser); ok {
+		u.SetIdempotencyTokens(t)
+	}
+}
+
+// warmUpUser is implemented by adapters that can pass warm-up hints to the
+// underlying user state machine.
+type warmUpUser interface {
+	warmUp(info sm.WarmUpInfo, done <-chan struct{}) error
+}
+
+func warmUp(s interface{}, info sm.WarmUpInfo, done <-chan struct{}) error {
+	if u, ok := s.(sm.IWarmUp); ok {
+		return u.WarmUp(info, done)
+	}
+	return nil
+}
+
+// compactionCoordinatorUser is implemented by adapters that can notify the
+// underlying user state machine of completed snapshots.
+type compactionCoordinatorUser interface {
+	snapshotCompleted(info sm.SnapshotCompletedInfo)
+}
+
+func snapshotCompleted(s interface{}, info sm.SnapshotCompletedInfo) {
+	if u, ok := s.(sm.ICompactionCoordinator); ok {
+		u.SnapshotCompleted(info)
+	}
+}
+
+// borrowedCommandsUser is implemented by adapters that can report whether the
+// underlying user state machine accepts borrowed Cmd slices.
+type borrowedCommandsUser interface {
+	borrowsCommands() bool
+}
+
+func borrowsCommands(s interface{}) bool {
+	if u, ok := s.(sm.IBorrowedCommands); ok {
+		return u.BorrowsCommands()
+	}
+	return false
+}
+
+// contextLookupUser is implemented by adapters that can pass the context of
+// queries to the underlying user state machine.
+type contextLookupUser interface {
+	contextLookup() (sm.IContextLookup, bool)
+}
+
+func getContextLookup(s interface{}) (sm.IContextLookup, bool) {
+	l, ok := s.(sm.IContextLookup)
+	return l, ok
+}
+
+// updateContextUser is implemented by adapters that can pass the context of
+// proposals to the underlying user state machine.
+type updateContextUser interface {
+	updateContext() (sm.IUpdateContext, bool)
+}
+
+func getUpdateContext(s interface{}) (sm.IUpdateContext, bool) {
+	u, ok := s.(sm.IUpdateContext)
+	return u, ok
+}
+
+// batchedLookupUser is implemented by adapters that can pass batched queries
+// to the underlying user state machine.
+type batchedLookupUser interface {
+	batchedLookup() (sm.IBatchedLookup, bool)
+}
+
+func getBatchedLookup(s interface{}) (sm.IBatchedLookup, bool) {
+	l, ok := s.(sm.IBatchedLookup)
+	return l, ok
+}
+
+// schemaVersionUser is implemented by adapters that can pass the schema version
+// recorded in snapshots to the underlying user state machine.
+type schemaVersionUser interface {
+	schemaVersion() (sm.ISchemaVersion, bool)
+}
+
+func getSchemaVersion(s interface{}) (sm.ISchemaVersion, bool) {
+	v, ok := s.(sm.ISchemaVersion)
+	return v, ok
+}
+
+// deltaSnapshotUser is implemented by adapters that can save and recover delta
+// snapshots using the underlying user state machine.
+type deltaSnapshotUser interface {
+	saveDelta(ctx interface{},
+		since uint64, w io.Writer, done <-chan struct{}) error
+	recoverFromDelta(r io.Reader, since uint64, done <-chan struct{}) error
+}
+
 // InMemStateMachine is a regular state machine not capable of concurrent
 // access from multiple goroutines.
 type InMemStateMachine struct {
 	sm sm.IStateMachine
 	h  sm.IHash
 	na sm.IExtended
+	eu sm.IEntryUpdater
 }
 
 var _ IStateMachine = (*InMemStateMachine)(nil)
@@ -57,12 +160,47 @@ func NewInMemStateMachine(s sm.IStateMachine) *InMemStateMachine {
 	if h, ok := s.(sm.IHash); ok {
 		i.h = h
 	}
+	if eu, ok := s.(sm.IEntryUpdater); ok {
+		i.eu = eu
+	}
 	if na, ok := s.(sm.IExtended); ok {
 		i.na = na
 	}
 	return i
 }
 
+func (i *InMemStateMachine) setIdempotencyTokens(t sm.IIdempotencyTokens) {
+	setIdempotencyTokens(i.sm, t)
+}
+
+func (i *InMemStateMachine) warmUp(info sm.WarmUpInfo, done <-chan struct{}) error {
+	return warmUp(i.sm, info, done)
+}
+
+func (i *InMemStateMachine) snapshotCompleted(info sm.SnapshotCompletedInfo) {
+	snapshotCompleted(i.sm, info)
+}
+
+func (i *InMemStateMachine) borrowsCommands() bool {
+	return borrowsCommands(i.sm)
+}
+
+func (i *InMemStateMachine) contextLookup() (sm.IContextLookup, bool) {
+	return getContextLookup(i.sm)
+}
+
+func (i *InMemStateMachine) updateContext() (sm.IUpdateContext, bool) {
+	return getUpdateContext(i.sm)
+}
+
+func (i *InMemStateMachine) batchedLookup() (sm.IBatchedLookup, bool) {
+	return getBatchedLookup(i.sm)
+}
+
+func (i *InMemStateMachine) schemaVersion() (sm.ISchemaVersion, bool) {
+	return getSchemaVersion(i.sm)
+}
+
 // Open opens the state machine.
 func (i *InMemStateMachine) Open(stopc <-chan struct{}) (uint64, error) {
 	panic("Open() called on InMemStateMachine")
@@ -74,7 +212,11 @@ func (i *InMemStateMachine) Update(entries []sm.Entry) ([]sm.Entry, error) {
 		panic("len(entries) != 1")
 	}
 	var err error
-	entries[0].Result, err = i.sm.Update(entries[0].Cmd)
+	if i.eu != nil {
+		entries[0].Result, err = i.eu.UpdateEntry(entries[0])
+	} else {
+		entries[0].Result, err = i.sm.Update(entries[0].Cmd)
+	}
 	return entries, err
 }
 
@@ -167,6 +309,38 @@ func NewConcurrentStateMachine(s sm.IConcurrentStateMachine) *ConcurrentStateMac
 	return v
 }
 
+func (s *ConcurrentStateMachine) setIdempotencyTokens(t sm.IIdempotencyTokens) {
+	setIdempotencyTokens(s.sm, t)
+}
+
+func (s *ConcurrentStateMachine) warmUp(info sm.WarmUpInfo, done <-chan struct{}) error {
+	return warmUp(s.sm, info, done)
+}
+
+func (s *ConcurrentStateMachine) snapshotCompleted(info sm.SnapshotCompletedInfo) {
+	snapshotCompleted(s.sm, info)
+}
+
+func (s *ConcurrentStateMachine) borrowsCommands() bool {
+	return borrowsCommands(s.sm)
+}
+
+func (s *ConcurrentStateMachine) contextLookup() (sm.IContextLookup, bool) {
+	return getContextLookup(s.sm)
+}
+
+func (s *ConcurrentStateMachine) updateContext() (sm.IUpdateContext, bool) {
+	return getUpdateContext(s.sm)
+}
+
+func (s *ConcurrentStateMachine) batchedLookup() (sm.IBatchedLookup, bool) {
+	return getBatchedLookup(s.sm)
+}
+
+func (s *ConcurrentStateMachine) schemaVersion() (sm.ISchemaVersion, bool) {
+	return getSchemaVersion(s.sm)
+}
+
 // Open opens the state machine.
 func (s *ConcurrentStateMachine) Open(stopc <-chan struct{}) (uint64, error) {
 	panic("Open() not implemented ConcurrentStateMachine")
@@ -253,6 +427,7 @@ type OnDiskStateMachine struct {
 	sm     sm.IOnDiskStateMachine
 	h      sm.IHash
 	na     sm.IExtended
+	ds     sm.IDeltaSnapshot
 	opened bool
 }
 
@@ -265,9 +440,44 @@ func NewOnDiskStateMachine(s sm.IOnDiskStateMachine) *OnDiskStateMachine {
 	if na, ok := s.(sm.IExtended); ok {
 		r.na = na
 	}
+	if ds, ok := s.(sm.IDeltaSnapshot); ok {
+		r.ds = ds
+	}
 	return r
 }
 
+func (s *OnDiskStateMachine) setIdempotencyTokens(t sm.IIdempotencyTokens) {
+	setIdempotencyTokens(s.sm, t)
+}
+
+func (s *OnDiskStateMachine) warmUp(info sm.WarmUpInfo, done <-chan struct{}) error {
+	return warmUp(s.sm, info, done)
+}
+
+func (s *OnDiskStateMachine) snapshotCompleted(info sm.SnapshotCompletedInfo) {
+	snapshotCompleted(s.sm, info)
+}
+
+func (s *OnDiskStateMachine) borrowsCommands() bool {
+	return borrowsCommands(s.sm)
+}
+
+func (s *OnDiskStateMachine) contextLookup() (sm.IContextLookup, bool) {
+	return getContextLookup(s.sm)
+}
+
+func (s *OnDiskStateMachine) updateContext() (sm.IUpdateContext, bool) {
+	return getUpdateContext(s.sm)
+}
+
+func (s *OnDiskStateMachine) batchedLookup() (sm.IBatchedLookup, bool) {
+	return getBatchedLookup(s.sm)
+}
+
+func (s *OnDiskStateMachine) schemaVersion() (sm.ISchemaVersion, bool) {
+	return getSchemaVersion(s.sm)
+}
+
 // SetTestFS injects the specified fs to the test SM.
 func (s *OnDiskStateMachine) SetTestFS(fs config.IFS) {
 	if tfs, ok := s.sm.(ITestFS); ok {
@@ -333,6 +543,24 @@ func (s *OnDiskStateMachine) Recover(r io.Reader,
 	return s.sm.RecoverFromSnapshot(r, stopc)
 }
 
+func (s *OnDiskStateMachine) saveDelta(ctx interface{},
+	since uint64, w io.Writer, stopc <-chan struct{}) error {
+	s.ensureOpened()
+	if s.ds == nil {
+		return sm.ErrDeltaSnapshotNotAvailable
+	}
+	return s.ds.SaveDeltaSnapshot(ctx, since, w, stopc)
+}
+
+func (s *OnDiskStateMachine) recoverFromDelta(r io.Reader,
+	since uint64, stopc <-chan struct{}) error {
+	s.ensureOpened()
+	if s.ds == nil {
+		return sm.ErrNotImplemented
+	}
+	return s.ds.RecoverFromDeltaSnapshot(r, since, stopc)
+}
+
 // Close closes the state machine.
 func (s *OnDiskStateMachine) Close() error {
 	return s.sm.Close()
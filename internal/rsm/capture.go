@@ -0,0 +1,240 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+var (
+	// ErrNonDeterministic indicates that replaying captured commands against a
+	// fresh state machine instance produced different results or a different
+	// final state.
+	ErrNonDeterministic = errors.New("non-deterministic state machine")
+	// ErrCaptureNotReplayable indicates that the command capture can not be
+	// replayed against a fresh state machine instance, e.g. the captured state
+	// machine was recovered from a snapshot.
+	ErrCaptureNotReplayable = errors.New("command capture not replayable")
+)
+
+const (
+	// CaptureStart is the type of the first record of a command capture.
+	CaptureStart = "start"
+	// CaptureUpdate is the type of records describing commands applied into
+	// the state machine.
+	CaptureUpdate = "update"
+	// CaptureRecovered is the type of records describing snapshots recovered
+	// into the state machine.
+	CaptureRecovered = "recovered"
+	// CaptureHash is the type of records describing the final state machine
+	// hash recorded when the state machine is closed.
+	CaptureHash = "hash"
+)
+
+// CapturedCommand is a record in the command capture file of a state machine,
+// see the CommandCaptureFile field of config.Config for details.
+type CapturedCommand struct {
+	// Type is the type of the record, e.g. CaptureUpdate or CaptureHash.
+	Type string
+	// ClusterID is the ClusterID of the captured node in CaptureStart records.
+	ClusterID uint64 `json:",omitempty"`
+	// NodeID is the NodeID of the captured node in CaptureStart records.
+	NodeID uint64 `json:",omitempty"`
+	// Index is the Raft log index of the applied entry or the recovered
+	// snapshot.
+	Index uint64 `json:",omitempty"`
+	// Term is the Raft term of the applied entry or the recovered snapshot.
+	Term uint64 `json:",omitempty"`
+	// ClientID is the client ID of the session used for making the proposal.
+	ClientID uint64 `json:",omitempty"`
+	// SeriesID is the series ID of the proposal within its client session.
+	SeriesID uint64 `json:",omitempty"`
+	// NoOPSession indicates whether the proposal was made using a NoOP session.
+	NoOPSession bool `json:",omitempty"`
+	// Cmd is the command applied into the state machine.
+	Cmd []byte `json:",omitempty"`
+	// Value is the Value field of the sm.Result returned by the state machine.
+	Value uint64 `json:",omitempty"`
+	// Data is the Data field of the sm.Result returned by the state machine.
+	Data []byte `json:",omitempty"`
+	// Error is the Error field of the sm.Result returned by the state machine.
+	Error *sm.ApplicationError `json:",omitempty"`
+	// Hash is the state machine hash of CaptureHash records.
+	Hash uint64 `json:",omitempty"`
+}
+
+// commandCapture records all commands applied into a state machine together
+// with their results into a JSON lines file so the same sequence of commands
+// can later be replayed against a fresh state machine instance.
+type commandCapture struct {
+	mu sync.Mutex
+	fp string
+	f  vfs.File
+	w  *bufio.Writer
+}
+
+func openCommandCapture(fp string,
+	clusterID uint64, nodeID uint64, fs vfs.IFS) (*commandCapture, error) {
+	f, err := fs.Create(fp)
+	if err != nil {
+		return nil, err
+	}
+	c := &commandCapture{fp: fp, f: f, w: bufio.NewWriter(f)}
+	c.record(CapturedCommand{
+		Type:      CaptureStart,
+		ClusterID: clusterID,
+		NodeID:    nodeID,
+	})
+	return c, nil
+}
+
+func (c *commandCapture) record(cmd CapturedCommand) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := c.w.Write(append(data, '\n')); err != nil {
+		plog.Panicf("failed to write command capture %s, %v", c.fp, err)
+	}
+}
+
+func (c *commandCapture) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.f == nil {
+		return
+	}
+	if err := c.w.Flush(); err != nil {
+		plog.Errorf("failed to flush command capture %s, %v", c.fp, err)
+	}
+	if err := c.f.Sync(); err != nil {
+		plog.Errorf("failed to sync command capture %s, %v", c.fp, err)
+	}
+	if err := c.f.Close(); err != nil {
+		plog.Errorf("failed to close command capture %s, %v", c.fp, err)
+	}
+	c.f = nil
+}
+
+// ReadCommandCapture returns all records found in the specified command
+// capture file.
+func ReadCommandCapture(fp string, fs vfs.IFS) ([]CapturedCommand, error) {
+	f, err := fs.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := make([]CapturedCommand, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		var cmd CapturedCommand
+		if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+			return nil, err
+		}
+		result = append(result, cmd)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReplayCommandCapture replays commands recorded in the specified command
+// capture file against a fresh state machine instance returned by the create
+// function. An error wrapping ErrNonDeterministic is returned when the state
+// machine returns a different result for any of the replayed commands or
+// reports a different final hash.
+func ReplayCommandCapture(fp string, fs vfs.IFS,
+	create func(clusterID uint64, nodeID uint64) IStateMachine) error {
+	records, err := ReadCommandCapture(fp, fs)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 || records[0].Type != CaptureStart {
+		return ErrCaptureNotReplayable
+	}
+	for _, r := range records {
+		if r.Type == CaptureRecovered {
+			return fmt.Errorf("%w, snapshot recovered at index %d",
+				ErrCaptureNotReplayable, r.Index)
+		}
+	}
+	s := create(records[0].ClusterID, records[0].NodeID)
+	done := make(chan struct{})
+	defer close(done)
+	if s.OnDisk() {
+		if _, err := s.Open(done); err != nil {
+			return err
+		}
+	}
+	if err := replayCommands(records[1:], s); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
+func replayCommands(records []CapturedCommand, s IStateMachine) error {
+	for _, r := range records {
+		switch r.Type {
+		case CaptureUpdate:
+			ents := []sm.Entry{{Index: r.Index, Cmd: r.Cmd}}
+			results, err := s.Update(ents)
+			if err != nil {
+				return err
+			}
+			result := results[0].Result
+			if result.Value != r.Value || !bytes.Equal(result.Data, r.Data) ||
+				!reflect.DeepEqual(result.Error, r.Error) {
+				return fmt.Errorf("%w, result mismatch at index %d",
+					ErrNonDeterministic, r.Index)
+			}
+		case CaptureHash:
+			h, err := s.GetHash()
+			if err != nil {
+				return err
+			}
+			if h != r.Hash {
+				return fmt.Errorf("%w, hash mismatch at index %d",
+					ErrNonDeterministic, r.Index)
+			}
+		default:
+			return fmt.Errorf("%w, unexpected record type %s",
+				ErrCaptureNotReplayable, r.Type)
+		}
+	}
+	return nil
+}
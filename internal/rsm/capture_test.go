@@ -0,0 +1,146 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+
+	"github.com/lni/dragonboat/v3/client"
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/tests"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+type fixedResultSM struct {
+	tests.NoOP
+	value uint64
+}
+
+func (f *fixedResultSM) Update(data []byte) (sm.Result, error) {
+	return sm.Result{Value: f.value}, nil
+}
+
+func captureTestCommands(t *testing.T, fp string, fs vfs.IFS) {
+	store := tests.NewKVTest(1, 1)
+	store.(*tests.KVTest).DisableLargeDelay()
+	cfg := config.Config{ClusterID: 1, NodeID: 1, CommandCaptureFile: fp}
+	ds := NewNativeSM(cfg, NewInMemStateMachine(store), make(chan struct{}))
+	s := NewStateMachine(ds, newTestSnapshotter(fs), cfg, newTestNodeProxy(), fs)
+	ents := []pb.Entry{
+		{
+			ClientID: 123,
+			SeriesID: client.NoOPSeriesID,
+			Cmd:      genTestKVData("k1", "v1"),
+			Index:    1,
+			Term:     1,
+		},
+		{
+			ClientID: 123,
+			SeriesID: client.NoOPSeriesID,
+			Cmd:      genTestKVData("k2", "value2"),
+			Index:    2,
+			Term:     1,
+		},
+	}
+	s.taskQ.Add(Task{Entries: ents})
+	if _, err := s.Handle(make([]Task, 0, 8), nil); err != nil {
+		t.Fatalf("handle failed %v", err)
+	}
+	s.Close()
+}
+
+func TestCommandCaptureRecordsAppliedCommands(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	createTestDir(fs)
+	defer removeTestDir(fs)
+	fp := fs.PathJoin(testSnapshotterDir, "capture.json")
+	captureTestCommands(t, fp, fs)
+	records, err := ReadCommandCapture(fp, fs)
+	if err != nil {
+		t.Fatalf("failed to read capture %v", err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("unexpected record count %d", len(records))
+	}
+	if records[0].Type != CaptureStart ||
+		records[0].ClusterID != 1 || records[0].NodeID != 1 {
+		t.Errorf("unexpected start record %+v", records[0])
+	}
+	for i := 1; i <= 2; i++ {
+		r := records[i]
+		if r.Type != CaptureUpdate || r.Index != uint64(i) ||
+			r.ClientID != 123 || !r.NoOPSession || r.Value != uint64(len(r.Cmd)) {
+			t.Errorf("unexpected update record %+v", r)
+		}
+	}
+	if records[3].Type != CaptureHash || records[3].Index != 2 {
+		t.Errorf("unexpected hash record %+v", records[3])
+	}
+	reportLeakedFD(fs, t)
+}
+
+func TestCommandCaptureCanBeReplayed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	createTestDir(fs)
+	defer removeTestDir(fs)
+	fp := fs.PathJoin(testSnapshotterDir, "capture.json")
+	captureTestCommands(t, fp, fs)
+	kv := func(clusterID uint64, nodeID uint64) IStateMachine {
+		store := tests.NewKVTest(clusterID, nodeID)
+		store.(*tests.KVTest).DisableLargeDelay()
+		return NewInMemStateMachine(store)
+	}
+	if err := ReplayCommandCapture(fp, fs, kv); err != nil {
+		t.Errorf("replay failed %v", err)
+	}
+	fixed := func(clusterID uint64, nodeID uint64) IStateMachine {
+		return NewInMemStateMachine(&fixedResultSM{value: 1})
+	}
+	err := ReplayCommandCapture(fp, fs, fixed)
+	if !errors.Is(err, ErrNonDeterministic) {
+		t.Errorf("failed to detect non-deterministic SM, %v", err)
+	}
+	reportLeakedFD(fs, t)
+}
+
+func TestRecoveredCommandCaptureCanNotBeReplayed(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	createTestDir(fs)
+	defer removeTestDir(fs)
+	fp := fs.PathJoin(testSnapshotterDir, "capture.json")
+	c, err := openCommandCapture(fp, 1, 1, fs)
+	if err != nil {
+		t.Fatalf("failed to open capture %v", err)
+	}
+	c.record(CapturedCommand{Type: CaptureRecovered, Index: 100})
+	c.close()
+	create := func(clusterID uint64, nodeID uint64) IStateMachine {
+		t.Fatalf("unexpected create call")
+		return nil
+	}
+	err = ReplayCommandCapture(fp, fs, create)
+	if !errors.Is(err, ErrCaptureNotReplayable) {
+		t.Errorf("failed to return ErrCaptureNotReplayable, %v", err)
+	}
+	reportLeakedFD(fs, t)
+}
@@ -38,7 +38,9 @@ var _ io.WriteCloser = (*ChunkWriter)(nil)
 type ChunkWriter struct {
 	sink    pb.IChunkSink
 	bw      IBlockWriter
+	ew      *encryptedWriter
 	meta    SSMeta
+	keyID   string
 	chunkID uint64
 	failed  bool
 	stopped bool
@@ -54,8 +56,31 @@ func NewChunkWriter(sink pb.IChunkSink, meta SSMeta) *ChunkWriter {
 	return cw
 }
 
+// NewEncryptedChunkWriter creates and returns a chunk writer instance that
+// encrypts the snapshot payload using the current key of the specified
+// encryption provider. When ep is nil, the payload is not encrypted.
+func NewEncryptedChunkWriter(sink pb.IChunkSink,
+	meta SSMeta, ep raftio.IEncryptionProvider) (*ChunkWriter, error) {
+	cw := NewChunkWriter(sink, meta)
+	if ep == nil {
+		return cw, nil
+	}
+	keyID, aead, err := getEncryptionCipher(ep)
+	if err != nil {
+		return nil, err
+	}
+	cw.ew = newEncryptedWriter(cw.bw, keyID, aead)
+	cw.keyID = keyID
+	return cw, nil
+}
+
 // Close closes the chunk writer.
 func (cw *ChunkWriter) Close() error {
+	if cw.ew != nil && !cw.failed && !cw.stopped {
+		if err := cw.ew.Close(); err != nil {
+			return err
+		}
+	}
 	if err := cw.bw.Close(); err != nil {
 		return err
 	}
@@ -68,6 +93,12 @@ func (cw *ChunkWriter) Close() error {
 	return nil
 }
 
+// Sent returns a boolean value indicating whether any chunk has been sent to
+// the remote node.
+func (cw *ChunkWriter) Sent() bool {
+	return cw.chunkID > 0
+}
+
 // Write writes the specified input data.
 func (cw *ChunkWriter) Write(data []byte) (int, error) {
 	if cw.stopped {
@@ -76,6 +107,9 @@ func (cw *ChunkWriter) Write(data []byte) (int, error) {
 	if cw.failed {
 		return 0, sm.ErrSnapshotStreaming
 	}
+	if cw.ew != nil {
+		return cw.ew.Write(data)
+	}
 	return cw.bw.Write(data)
 }
 
@@ -119,6 +153,9 @@ func (cw *ChunkWriter) getHeader() []byte {
 		ChecksumType:    DefaultChecksumType,
 		Version:         uint64(V2),
 		CompressionType: cw.meta.CompressionType,
+		EncryptionKeyId: cw.keyID,
+		DeltaSince:      cw.meta.Request.DeltaSince,
+		SchemaVersion:   cw.meta.SchemaVersion,
 	}
 	data, err := header.Marshal()
 	if err != nil {
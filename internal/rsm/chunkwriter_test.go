@@ -203,3 +203,63 @@ func TestFailedChunkWriterWillNotSendTheTailChunk(t *testing.T) {
 		}
 	}
 }
+
+func TestChunkWriterRecordsDeltaSince(t *testing.T) {
+	meta := getTestSSMeta()
+	meta.Request.DeltaSince = 100
+	cw := NewChunkWriter(&testSink{}, meta)
+	if cw.Sent() {
+		t.Errorf("unexpectedly sent")
+	}
+	if _, err := cw.Write([]byte("test-data")); err != nil {
+		t.Fatalf("failed to write the data %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("failed to flush %v", err)
+	}
+	if !cw.Sent() {
+		t.Errorf("not sent")
+	}
+	chunks := cw.sink.(*testSink).chunks
+	sz := binary.LittleEndian.Uint64(chunks[0].Data)
+	var header pb.SnapshotHeader
+	if err := header.Unmarshal(chunks[0].Data[8 : 8+sz]); err != nil {
+		t.Fatalf("failed to unmarshal %v", err)
+	}
+	if header.DeltaSince != 100 {
+		t.Errorf("unexpected delta since %d", header.DeltaSince)
+	}
+}
+
+func TestEncryptedChunkWriterRecordsKeyID(t *testing.T) {
+	meta := getTestSSMeta()
+	p := newTestEncryptionProvider("key-1")
+	cw, err := NewEncryptedChunkWriter(&testSink{}, meta, p)
+	if err != nil {
+		t.Fatalf("failed to create chunk writer %v", err)
+	}
+	data := make([]byte, ChunkSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := cw.Write(data); err != nil {
+		t.Fatalf("failed to write the data %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("failed to flush %v", err)
+	}
+	chunks := cw.sink.(*testSink).chunks
+	sz := binary.LittleEndian.Uint64(chunks[0].Data)
+	var header pb.SnapshotHeader
+	if err := header.Unmarshal(chunks[0].Data[8 : 8+sz]); err != nil {
+		t.Fatalf("failed to unmarshal %v", err)
+	}
+	if header.EncryptionKeyId != "key-1" {
+		t.Errorf("unexpected key ID %s", header.EncryptionKeyId)
+	}
+	for _, chunk := range chunks {
+		if bytes.Contains(chunk.Data, data[:1024]) {
+			t.Errorf("plain text found in chunk")
+		}
+	}
+}
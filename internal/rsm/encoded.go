@@ -16,6 +16,7 @@ package rsm
 
 import (
 	"encoding/binary"
+	"hash/crc32"
 
 	"github.com/lni/dragonboat/v3/config"
 	"github.com/lni/dragonboat/v3/internal/utils/dio"
@@ -32,6 +33,16 @@ const (
 	EEHeaderSize uint8 = 1
 	EEVersion    uint8 = 0 << 4
 	EEV0         uint8 = 0 << 4
+	// V1 format is the V0 format followed by a 4 bytes little endian CRC32
+	// checksum of all preceding bytes.
+	EEV1           uint8 = 1 << 4
+	EEChecksumSize int   = 4
+	// V2 format is the 1 byte header followed by the apply dependency, which is
+	// the 8 bytes little endian cluster ID and the 8 bytes little endian applied
+	// index, and then the payload in the V0 or V1 format.
+	EEV2               uint8 = 2 << 4
+	EEDependencyOffset int   = 1
+	EEDependencySize   int   = 16
 
 	// for V0 format, entries with empty payload will cause panic as such
 	// entries always have their TYPE value set to ApplicationEntry
@@ -61,6 +72,104 @@ func GetPayload(e pb.Entry) []byte {
 	panic("unknown entry type")
 }
 
+// payloadArena holds decompressed payloads of entries passed to user state
+// machines accepting borrowed Cmd slices, it is reset before each Update or
+// BatchedUpdate call so its buffer is reused.
+type payloadArena struct {
+	buf    []byte
+	offset int
+}
+
+func (a *payloadArena) reset() {
+	a.offset = 0
+}
+
+// get returns the payload of the entry, compressed payloads are decompressed
+// into the arena when there is enough space, the arena grows for the
+// following batches otherwise.
+func (a *payloadArena) get(e pb.Entry) []byte {
+	if e.Type != pb.EncodedEntry || !isCompressed(e.Cmd) {
+		return GetPayload(e)
+	}
+	free := a.buf[a.offset:]
+	result := getDecodedPayload(e.Cmd, free)
+	if len(result) <= len(free) {
+		a.offset += len(result)
+		return result[:len(result):len(result)]
+	}
+	sz := 2 * (len(a.buf) + len(result))
+	a.buf = make([]byte, sz)
+	a.offset = 0
+	return result
+}
+
+func isCompressed(cmd []byte) bool {
+	if len(cmd) == 0 {
+		return false
+	}
+	ver, ct, _ := parseEncodedHeader(cmd)
+	if ver == EEV2 {
+		if !hasDependency(cmd) {
+			return false
+		}
+		return isCompressed(cmd[int(EEHeaderSize)+EEDependencySize:])
+	}
+	return ct == EESnappy
+}
+
+// hasDependency returns a boolean value indicating whether the V2 encoded cmd
+// is long enough to contain the apply dependency.
+func hasDependency(cmd []byte) bool {
+	return len(cmd) >= int(EEHeaderSize)+EEDependencySize
+}
+
+// GetDependency returns the apply dependency of the entry, which is the
+// cluster ID and the applied index that Raft cluster must reach on the local
+// NodeHost before the entry can be applied. ErrEntryTruncated is returned
+// when the entry is too short to contain the dependency it claims to have.
+func GetDependency(e pb.Entry) (uint64, uint64, bool, error) {
+	if e.Type != pb.EncodedEntry || len(e.Cmd) == 0 {
+		return 0, 0, false, nil
+	}
+	ver, _, _ := parseEncodedHeader(e.Cmd)
+	if ver != EEV2 {
+		return 0, 0, false, nil
+	}
+	if !hasDependency(e.Cmd) {
+		return 0, 0, false, ErrEntryTruncated
+	}
+	dep := e.Cmd[EEDependencyOffset:]
+	return binary.LittleEndian.Uint64(dep), binary.LittleEndian.Uint64(dep[8:]),
+		true, nil
+}
+
+// VerifyChecksum returns a boolean value indicating whether the payload of the
+// entry matches its checksum. Entries without checksum are always considered
+// as valid, entries too short to contain their dependency or checksum are
+// always considered as invalid.
+func VerifyChecksum(e pb.Entry) bool {
+	if e.Type != pb.EncodedEntry || len(e.Cmd) == 0 {
+		return true
+	}
+	ver, _, _ := parseEncodedHeader(e.Cmd)
+	if ver == EEV2 {
+		if !hasDependency(e.Cmd) {
+			return false
+		}
+		e.Cmd = e.Cmd[int(EEHeaderSize)+EEDependencySize:]
+		return VerifyChecksum(e)
+	}
+	if ver != EEV1 {
+		return true
+	}
+	if len(e.Cmd) < int(EEHeaderSize)+EEChecksumSize {
+		return false
+	}
+	sz := len(e.Cmd) - EEChecksumSize
+	sum := binary.LittleEndian.Uint32(e.Cmd[sz:])
+	return crc32.ChecksumIEEE(e.Cmd[:sz]) == sum
+}
+
 // ToDioType converts the CompressionType type defined in the config package to
 // the CompressionType value defined in the dio package.
 func ToDioType(ct config.CompressionType) dio.CompressionType {
@@ -76,6 +185,45 @@ func GetEncoded(ct dio.CompressionType, cmd []byte, dst []byte) []byte {
 	return getEncoded(ct, cmd, dst)
 }
 
+// GetChecksumEncoded returns the encoded payload using the specified
+// compression type, the payload is protected by a checksum verified again
+// before it is applied into the state machine.
+func GetChecksumEncoded(ct dio.CompressionType, cmd []byte) []byte {
+	if len(cmd) == 0 {
+		panic("empty payload")
+	}
+	var dst []byte
+	if ct == dio.NoCompression {
+		// leave room for the checksum so cmd is only copied once
+		dst = make([]byte, len(cmd)+1+EEChecksumSize)
+	}
+	v0 := getEncoded(ct, cmd, dst)
+	sz := len(v0)
+	var result []byte
+	if cap(v0) >= sz+EEChecksumSize {
+		result = v0[:sz+EEChecksumSize]
+	} else {
+		result = make([]byte, sz+EEChecksumSize)
+		copy(result, v0)
+	}
+	result[0] = result[0] | EEV1
+	binary.LittleEndian.PutUint32(result[sz:], crc32.ChecksumIEEE(result[:sz]))
+	return result
+}
+
+// GetDependencyEncoded returns the V2 encoded payload with the specified apply
+// dependency, cmd is the payload encoded in the V0 or V1 format or an empty
+// slice for entries with empty payload.
+func GetDependencyEncoded(cmd []byte, clusterID uint64, index uint64) []byte {
+	offset := int(EEHeaderSize) + EEDependencySize
+	result := make([]byte, offset+len(cmd))
+	result[0] = getEncodedHeader(EEV2, EENoCompression, false)
+	binary.LittleEndian.PutUint64(result[EEDependencyOffset:], clusterID)
+	binary.LittleEndian.PutUint64(result[EEDependencyOffset+8:], index)
+	copy(result[offset:], cmd)
+	return result
+}
+
 // get v0 encoded payload
 func getEncoded(ct dio.CompressionType, cmd []byte, dst []byte) []byte {
 	if ct == dio.NoCompression {
@@ -127,6 +275,25 @@ func parseEncodedHeader(cmd []byte) (uint8, uint8, bool) {
 
 func getDecodedPayload(cmd []byte, buf []byte) []byte {
 	ver, ct, hasSession := parseEncodedHeader(cmd)
+	if ver == EEV2 {
+		if !hasDependency(cmd) {
+			plog.Panicf("v2 cmd too short, len %d", len(cmd))
+		}
+		cmd = cmd[int(EEHeaderSize)+EEDependencySize:]
+		if len(cmd) == 0 {
+			return nil
+		}
+		return getDecodedPayload(cmd, buf)
+	}
+	if ver == EEV1 {
+		// the checksum is verified by the caller when required, the rest is in
+		// the V0 format
+		if len(cmd) < int(EEHeaderSize)+EEChecksumSize {
+			plog.Panicf("v1 cmd too short, len %d", len(cmd))
+		}
+		cmd = cmd[:len(cmd)-EEChecksumSize]
+		ver = EEV0
+	}
 	if ver == EEV0 {
 		if hasSession {
 			plog.Panicf("v0 cmd has session info")
@@ -96,3 +96,134 @@ func TestGetV0EncodedPayload(t *testing.T) {
 		}
 	}
 }
+
+func TestChecksumEncodedPayload(t *testing.T) {
+	for _, ct := range []dio.CompressionType{dio.NoCompression, dio.Snappy} {
+		src := make([]byte, 128)
+		rand.Read(src)
+		e := pb.Entry{Type: pb.EncodedEntry, Cmd: GetChecksumEncoded(ct, src)}
+		ver, _, hasSession := parseEncodedHeader(e.Cmd)
+		if ver != EEV1 || hasSession {
+			t.Errorf("unexpected header, ver %d", ver)
+		}
+		if !VerifyChecksum(e) {
+			t.Errorf("checksum mismatch")
+		}
+		if !bytes.Equal(src, GetPayload(e)) {
+			t.Errorf("payload changed")
+		}
+		e.Cmd[len(e.Cmd)/2] = e.Cmd[len(e.Cmd)/2] + 1
+		if VerifyChecksum(e) {
+			t.Errorf("corruption not detected")
+		}
+	}
+}
+
+func TestEntryWithoutChecksumIsAlwaysValid(t *testing.T) {
+	e := pb.Entry{
+		Type: pb.EncodedEntry,
+		Cmd:  GetEncoded(dio.NoCompression, make([]byte, 16), nil),
+	}
+	if !VerifyChecksum(e) {
+		t.Errorf("unexpected checksum mismatch")
+	}
+	if !VerifyChecksum(pb.Entry{Type: pb.ApplicationEntry}) {
+		t.Errorf("unexpected checksum mismatch")
+	}
+}
+
+func TestDependencyEncodedPayload(t *testing.T) {
+	src := make([]byte, 128)
+	rand.Read(src)
+	inputs := [][]byte{
+		GetEncoded(dio.Snappy, src, nil),
+		GetChecksumEncoded(dio.NoCompression, src),
+	}
+	for _, cmd := range inputs {
+		e := pb.Entry{
+			Type: pb.EncodedEntry,
+			Cmd:  GetDependencyEncoded(cmd, 100, 200),
+		}
+		cid, index, ok, err := GetDependency(e)
+		if err != nil || !ok || cid != 100 || index != 200 {
+			t.Errorf("unexpected dependency %d, %d, %t, %v", cid, index, ok, err)
+		}
+		if !VerifyChecksum(e) {
+			t.Errorf("checksum mismatch")
+		}
+		if !bytes.Equal(src, GetPayload(e)) {
+			t.Errorf("payload changed")
+		}
+	}
+	e := pb.Entry{Type: pb.EncodedEntry, Cmd: GetDependencyEncoded(nil, 1, 2)}
+	if len(GetPayload(e)) != 0 || !VerifyChecksum(e) {
+		t.Errorf("unexpected empty payload")
+	}
+	e = pb.Entry{Type: pb.EncodedEntry, Cmd: GetEncoded(dio.NoCompression, src, nil)}
+	if _, _, ok, err := GetDependency(e); ok || err != nil {
+		t.Errorf("unexpected dependency")
+	}
+}
+
+func TestTruncatedDependencyEncodedEntry(t *testing.T) {
+	cmd := GetDependencyEncoded(GetChecksumEncoded(dio.NoCompression,
+		[]byte("test-data")), 100, 200)
+	for _, sz := range []int{1, int(EEHeaderSize) + EEDependencySize - 1,
+		int(EEHeaderSize) + EEDependencySize + 1} {
+		e := pb.Entry{Type: pb.EncodedEntry, Cmd: cmd[:sz]}
+		if VerifyChecksum(e) {
+			t.Errorf("truncated entry of size %d passed verification", sz)
+		}
+		if isCompressed(e.Cmd) {
+			t.Errorf("truncated entry of size %d reported as compressed", sz)
+		}
+	}
+	for _, sz := range []int{1, int(EEHeaderSize) + EEDependencySize - 1} {
+		e := pb.Entry{Type: pb.EncodedEntry, Cmd: cmd[:sz]}
+		if _, _, ok, err := GetDependency(e); ok || err != ErrEntryTruncated {
+			t.Errorf("size %d, ok %t, err %v", sz, ok, err)
+		}
+	}
+}
+
+func TestPayloadArenaReusesBuffer(t *testing.T) {
+	a := &payloadArena{}
+	src1 := make([]byte, 128)
+	src2 := make([]byte, 256)
+	rand.Read(src1)
+	rand.Read(src2)
+	e1 := pb.Entry{Type: pb.EncodedEntry, Cmd: GetEncoded(dio.Snappy, src1, nil)}
+	e2 := pb.Entry{
+		Type: pb.EncodedEntry,
+		Cmd:  GetDependencyEncoded(GetChecksumEncoded(dio.Snappy, src2), 1, 2),
+	}
+	// the first batches grow the arena
+	for i := 0; i < 2; i++ {
+		if !bytes.Equal(src1, a.get(e1)) || !bytes.Equal(src2, a.get(e2)) {
+			t.Fatalf("payload changed")
+		}
+		a.reset()
+	}
+	p1 := a.get(e1)
+	p2 := a.get(e2)
+	if !bytes.Equal(src1, p1) || !bytes.Equal(src2, p2) {
+		t.Fatalf("payload changed")
+	}
+	if &p1[0] != &a.buf[0] || &p2[0] != &a.buf[len(p1)] {
+		t.Errorf("arena not used")
+	}
+	if cap(p1) != len(p1) {
+		t.Errorf("appending to p1 can overwrite p2")
+	}
+	a.reset()
+	if p := a.get(e2); &p[0] != &a.buf[0] {
+		t.Errorf("arena not reused")
+	}
+	e3 := pb.Entry{
+		Type: pb.EncodedEntry,
+		Cmd:  GetEncoded(dio.NoCompression, src1, nil),
+	}
+	if p := a.get(e3); &p[0] != &e3.Cmd[1] {
+		t.Errorf("uncompressed payload copied")
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+const (
+	// encryptionBlockSize is the max number of plain text bytes sealed into a
+	// single encrypted record.
+	encryptionBlockSize = 64 * 1024
+	// maxEncryptionKeyIDLength is the max length of key IDs recorded in the
+	// snapshot header.
+	maxEncryptionKeyIDLength = 256
+	// each encrypted record starts with a 1 byte flag indicating whether it is
+	// the final record followed by the 4 bytes length of the sealed data.
+	encryptedRecordHeaderSize = 5
+	finalRecordFlag           = 1
+)
+
+var (
+	// ErrNoEncryptionProvider indicates that the snapshot is encrypted but no
+	// encryption provider is available for decrypting it.
+	ErrNoEncryptionProvider = errors.New("no encryption provider")
+	// ErrInvalidEncryptionKeyID indicates that the key ID returned by the
+	// encryption provider is invalid.
+	ErrInvalidEncryptionKeyID = errors.New("invalid encryption key ID")
+	// ErrSnapshotDecryption indicates that the snapshot data can not be
+	// authenticated and decrypted.
+	ErrSnapshotDecryption = errors.New("failed to decrypt snapshot data")
+)
+
+func getEncryptionCipher(ep raftio.IEncryptionProvider) (string,
+	cipher.AEAD, error) {
+	keyID := ep.KeyID()
+	if len(keyID) == 0 || len(keyID) > maxEncryptionKeyIDLength {
+		return "", nil, ErrInvalidEncryptionKeyID
+	}
+	aead, err := ep.AEAD(keyID)
+	if err != nil {
+		return "", nil, err
+	}
+	return keyID, aead, nil
+}
+
+func getDecryptionCipher(ep raftio.IEncryptionProvider,
+	keyID string) (cipher.AEAD, error) {
+	if ep == nil {
+		return nil, ErrNoEncryptionProvider
+	}
+	return ep.AEAD(keyID)
+}
+
+// getEncryptedSize returns the number of bytes required for storing sz bytes
+// of plain text data in encrypted records.
+func getEncryptedSize(sz uint64, aead cipher.AEAD) uint64 {
+	records := sz/encryptionBlockSize + 1
+	overhead := uint64(encryptedRecordHeaderSize + aead.NonceSize() +
+		aead.Overhead())
+	return sz + records*overhead
+}
+
+// getRecordAD returns the additional data authenticated together with each
+// record, it binds the record to its key ID, position and the final flag so
+// records can not be reordered, dropped or truncated without being detected.
+func getRecordAD(keyID string, index uint64, flag byte) []byte {
+	ad := make([]byte, len(keyID)+9)
+	copy(ad, keyID)
+	binary.LittleEndian.PutUint64(ad[len(keyID):], index)
+	ad[len(ad)-1] = flag
+	return ad
+}
+
+// encryptedWriter is an io.WriteCloser that seals input data into encrypted
+// records using an authenticated encryption cipher. Close must be called to
+// write the final record.
+type encryptedWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	keyID string
+	buf   []byte
+	index uint64
+}
+
+func newEncryptedWriter(w io.Writer,
+	keyID string, aead cipher.AEAD) *encryptedWriter {
+	return &encryptedWriter{
+		w:     w,
+		aead:  aead,
+		keyID: keyID,
+		buf:   make([]byte, 0, encryptionBlockSize),
+	}
+}
+
+func (ew *encryptedWriter) Write(data []byte) (int, error) {
+	total := len(data)
+	for len(data) > 0 {
+		sz := encryptionBlockSize - len(ew.buf)
+		if sz > len(data) {
+			sz = len(data)
+		}
+		ew.buf = append(ew.buf, data[:sz]...)
+		data = data[sz:]
+		if len(ew.buf) == encryptionBlockSize {
+			if err := ew.seal(0); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (ew *encryptedWriter) Close() error {
+	return ew.seal(finalRecordFlag)
+}
+
+func (ew *encryptedWriter) seal(flag byte) error {
+	nonce := make([]byte, ew.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	ad := getRecordAD(ew.keyID, ew.index, flag)
+	sz := encryptedRecordHeaderSize + len(nonce)
+	record := make([]byte, sz, sz+len(ew.buf)+ew.aead.Overhead())
+	record[0] = flag
+	binary.LittleEndian.PutUint32(record[1:],
+		uint32(len(ew.buf)+ew.aead.Overhead()))
+	copy(record[encryptedRecordHeaderSize:], nonce)
+	record = ew.aead.Seal(record, nonce, ew.buf, ad)
+	if _, err := ew.w.Write(record); err != nil {
+		return err
+	}
+	ew.buf = ew.buf[:0]
+	ew.index++
+	return nil
+}
+
+// encryptedReader is an io.Reader that authenticates and decrypts records
+// written by encryptedWriter.
+type encryptedReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	keyID string
+	buf   []byte
+	index uint64
+	done  bool
+}
+
+func newEncryptedReader(r io.Reader,
+	keyID string, aead cipher.AEAD) *encryptedReader {
+	return &encryptedReader{
+		r:     r,
+		aead:  aead,
+		keyID: keyID,
+	}
+}
+
+func (er *encryptedReader) Read(data []byte) (int, error) {
+	for len(er.buf) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		if err := er.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, er.buf)
+	er.buf = er.buf[n:]
+	return n, nil
+}
+
+func (er *encryptedReader) open() error {
+	header := make([]byte, encryptedRecordHeaderSize+er.aead.NonceSize())
+	if _, err := io.ReadFull(er.r, header); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	flag := header[0]
+	sz := binary.LittleEndian.Uint32(header[1:])
+	if flag > finalRecordFlag ||
+		sz > uint32(encryptionBlockSize+er.aead.Overhead()) {
+		return ErrSnapshotDecryption
+	}
+	sealed := make([]byte, sz)
+	if _, err := io.ReadFull(er.r, sealed); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	nonce := header[encryptedRecordHeaderSize:]
+	ad := getRecordAD(er.keyID, er.index, flag)
+	plain, err := er.aead.Open(sealed[:0], nonce, sealed, ad)
+	if err != nil {
+		return ErrSnapshotDecryption
+	}
+	er.buf = plain
+	er.index++
+	er.done = flag == finalRecordFlag
+	return nil
+}
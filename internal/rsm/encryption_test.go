@@ -0,0 +1,145 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+type testEncryptionProvider struct {
+	keyID string
+	keys  map[string][]byte
+}
+
+func newTestEncryptionProvider(keyID string) *testEncryptionProvider {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &testEncryptionProvider{
+		keyID: keyID,
+		keys:  map[string][]byte{keyID: key},
+	}
+}
+
+func (p *testEncryptionProvider) KeyID() string {
+	return p.keyID
+}
+
+func (p *testEncryptionProvider) AEAD(keyID string) (cipher.AEAD, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, errors.New("unknown key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func getTestEncryptedData(t *testing.T,
+	aead cipher.AEAD, plain []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	ew := newEncryptedWriter(buf, "key-1", aead)
+	if _, err := ew.Write(plain); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatalf("close failed %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncryptedDataCanBeDecrypted(t *testing.T) {
+	p := newTestEncryptionProvider("key-1")
+	aead, err := p.AEAD("key-1")
+	if err != nil {
+		t.Fatalf("failed to get aead %v", err)
+	}
+	sizes := []int{0, 1, 1024, encryptionBlockSize - 1, encryptionBlockSize,
+		encryptionBlockSize + 1, 3 * encryptionBlockSize, 1024 * 1024}
+	for _, sz := range sizes {
+		plain := make([]byte, sz)
+		rand.Read(plain)
+		data := getTestEncryptedData(t, aead, plain)
+		if uint64(len(data)) != getEncryptedSize(uint64(sz), aead) {
+			t.Errorf("size %d, got %d, want %d",
+				sz, len(data), getEncryptedSize(uint64(sz), aead))
+		}
+		if sz >= 1024 && bytes.Contains(data, plain[:1024]) {
+			t.Errorf("plain text found in encrypted data")
+		}
+		er := newEncryptedReader(bytes.NewReader(data), "key-1", aead)
+		result, err := ioutil.ReadAll(er)
+		if err != nil {
+			t.Fatalf("failed to read, %v", err)
+		}
+		if !bytes.Equal(result, plain) {
+			t.Errorf("size %d, unexpected content", sz)
+		}
+	}
+}
+
+func TestTruncatedEncryptedDataIsRejected(t *testing.T) {
+	p := newTestEncryptionProvider("key-1")
+	aead, err := p.AEAD("key-1")
+	if err != nil {
+		t.Fatalf("failed to get aead %v", err)
+	}
+	plain := make([]byte, 2*encryptionBlockSize)
+	data := getTestEncryptedData(t, aead, plain)
+	// drop the final record
+	data = data[:getEncryptedSize(2*encryptionBlockSize, aead)-
+		getEncryptedSize(0, aead)]
+	er := newEncryptedReader(bytes.NewReader(data), "key-1", aead)
+	if _, err := ioutil.ReadAll(er); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated data not reported, %v", err)
+	}
+}
+
+func TestTamperedEncryptedDataIsRejected(t *testing.T) {
+	p := newTestEncryptionProvider("key-1")
+	aead, err := p.AEAD("key-1")
+	if err != nil {
+		t.Fatalf("failed to get aead %v", err)
+	}
+	plain := make([]byte, 2*encryptionBlockSize)
+	data := getTestEncryptedData(t, aead, plain)
+	data[len(data)/2] ^= 0xFF
+	er := newEncryptedReader(bytes.NewReader(data), "key-1", aead)
+	if _, err := ioutil.ReadAll(er); err != ErrSnapshotDecryption {
+		t.Errorf("tampered data not reported, %v", err)
+	}
+	data = getTestEncryptedData(t, aead, plain)
+	er = newEncryptedReader(bytes.NewReader(data), "key-2", aead)
+	if _, err := ioutil.ReadAll(er); err != ErrSnapshotDecryption {
+		t.Errorf("mismatched key ID not reported, %v", err)
+	}
+}
+
+func TestInvalidEncryptionKeyIDIsRejected(t *testing.T) {
+	for _, keyID := range []string{"", string(make([]byte, 257))} {
+		p := newTestEncryptionProvider(keyID)
+		if _, _, err := getEncryptionCipher(p); err != ErrInvalidEncryptionKeyID {
+			t.Errorf("invalid key ID not rejected, %v", err)
+		}
+	}
+}
@@ -29,6 +29,8 @@ import (
 const (
 	// EmptyClientSessionLength defines the length of an empty sessions instance.
 	EmptyClientSessionLength uint64 = 16
+	// sessionFlagsMask is the mask of flag bits stored in the size field
+	sessionFlagsMask uint64 = 0xFF << 56
 )
 
 var (
@@ -90,6 +92,12 @@ func (rec *lrusession) getSession(key RaftClientID) (*Session, bool) {
 // Save checkpoints the state of the lrusession and save the checkpointed
 // state into the writer.
 func (rec *lrusession) save(writer io.Writer) error {
+	return rec.saveAs(writer, 0)
+}
+
+// saveAs saves the lrusession with the specified flags stored in the high bits
+// of the size field.
+func (rec *lrusession) saveAs(writer io.Writer, flags uint64) error {
 	rec.Lock()
 	defer rec.Unlock()
 	idList := make([]RaftClientID, 0)
@@ -98,7 +106,7 @@ func (rec *lrusession) save(writer io.Writer) error {
 		idList = append(idList, *key)
 	})
 	totalbuf := make([]byte, 8)
-	binary.LittleEndian.PutUint64(totalbuf, rec.size)
+	binary.LittleEndian.PutUint64(totalbuf, rec.size|flags)
 	if _, err := writer.Write(totalbuf); err != nil {
 		return err
 	}
@@ -121,31 +129,40 @@ func (rec *lrusession) save(writer io.Writer) error {
 // Load restores the state the of lrusession from the provided reader.
 // reader contains lrusession state previously checkpointed.
 func (rec *lrusession) load(reader io.Reader, v SSVersion) error {
+	_, err := rec.loadAs(reader, v)
+	return err
+}
+
+// loadAs restores the lrusession and returns flags stored in the high bits of
+// the size field.
+func (rec *lrusession) loadAs(reader io.Reader, v SSVersion) (uint64, error) {
 	rec.Lock()
 	defer rec.Unlock()
 	sessionList := make([]*Session, 0)
 	sizebuf := make([]byte, 8)
 	n, err := io.ReadFull(reader, sizebuf)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if n != len(sizebuf) {
-		return io.ErrUnexpectedEOF
+		return 0, io.ErrUnexpectedEOF
 	}
 	sz := binary.LittleEndian.Uint64(sizebuf)
+	flags := sz & sessionFlagsMask
+	sz &^= sessionFlagsMask
 	n, err = io.ReadFull(reader, sizebuf)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if n != len(sizebuf) {
-		return io.ErrUnexpectedEOF
+		return 0, io.ErrUnexpectedEOF
 	}
 	total := binary.LittleEndian.Uint64(sizebuf)
 	for i := uint64(0); i < total; i++ {
 		s := &Session{}
 		err := s.recoverFromSnapshot(reader, v)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		sessionList = append(sessionList, s)
 	}
@@ -155,7 +172,7 @@ func (rec *lrusession) load(reader io.Reader, v SSVersion) error {
 	for _, s := range sessionList {
 		rec.addSessionLocked(s.ClientID, *s)
 	}
-	return nil
+	return flags, nil
 }
 
 func (rec *lrusession) makeEntry(key RaftClientID,
@@ -15,6 +15,7 @@
 package rsm
 
 import (
+	"context"
 	"errors"
 	"io"
 	"sync"
@@ -34,6 +35,12 @@ type IStreamable interface {
 	Stream(interface{}, io.Writer) error
 }
 
+// IDeltaStreamable is the interface for types that can stream delta
+// snapshots.
+type IDeltaStreamable interface {
+	StreamDelta(interface{}, uint64, io.Writer) error
+}
+
 // ISavable is the interface for types that can its content saved as snapshots.
 type ISavable interface {
 	Save(SSMeta, io.Writer, []byte, sm.ISnapshotFileCollection) (bool, error)
@@ -45,6 +52,20 @@ type IRecoverable interface {
 	Recover(io.Reader, []sm.SnapshotFile) error
 }
 
+// IDeltaRecoverable is the interface for types that can have its state
+// restored from delta snapshots.
+type IDeltaRecoverable interface {
+	RecoverFromDelta(io.Reader, uint64) error
+}
+
+// ISchemaVersioned is the interface for types that record the schema version
+// of the user state machine in snapshots and check it before recovering from
+// them.
+type ISchemaVersioned interface {
+	SchemaVersion() uint64
+	PrepareRecovery(uint64) error
+}
+
 // ILoadable is the interface for types that can load client session
 // state from a snapshot.
 type ILoadable interface {
@@ -110,6 +131,9 @@ var _ IManagedStateMachine = (*NativeSM)(nil)
 var _ ISavable = (*NativeSM)(nil)
 var _ IStreamable = (*NativeSM)(nil)
 var _ IRecoverable = (*NativeSM)(nil)
+var _ IDeltaStreamable = (*NativeSM)(nil)
+var _ IDeltaRecoverable = (*NativeSM)(nil)
+var _ ISchemaVersioned = (*NativeSM)(nil)
 
 // NewNativeSM creates and returns a new NativeSM object.
 func NewNativeSM(config config.Config, ism IStateMachine,
@@ -244,6 +268,151 @@ func (ds *NativeSM) GetHash() (uint64, error) {
 	return ds.sm.GetHash()
 }
 
+// setIdempotencyTokens passes the idempotency tokens area to the user state
+// machine when it implements the sm.IIdempotencyTokenUser interface.
+func (ds *NativeSM) setIdempotencyTokens(t sm.IIdempotencyTokens) {
+	if a, ok := ds.sm.(idempotencyTokenUser); ok {
+		a.setIdempotencyTokens(t)
+	}
+}
+
+// warmUp passes warm-up hints to the user state machine when it implements the
+// sm.IWarmUp interface.
+func (ds *NativeSM) warmUp(info sm.WarmUpInfo, done <-chan struct{}) error {
+	if a, ok := ds.sm.(warmUpUser); ok {
+		return a.warmUp(info, done)
+	}
+	return nil
+}
+
+// SchemaVersion returns the schema version of the user state machine, 0 is
+// returned when it doesn't implement the sm.ISchemaVersion interface.
+func (ds *NativeSM) SchemaVersion() uint64 {
+	if a, ok := ds.sm.(schemaVersionUser); ok {
+		if sv, ok := a.schemaVersion(); ok {
+			return sv.SchemaVersion()
+		}
+	}
+	return 0
+}
+
+// PrepareRecovery checks the schema version recorded in the snapshot about to
+// be recovered. sm.ErrIncompatibleSchemaVersion is returned when the snapshot
+// was saved by a newer version of the user state machine, otherwise the
+// version is passed to the user state machine.
+func (ds *NativeSM) PrepareRecovery(version uint64) error {
+	a, ok := ds.sm.(schemaVersionUser)
+	if !ok {
+		return nil
+	}
+	sv, ok := a.schemaVersion()
+	if !ok {
+		return nil
+	}
+	if local := sv.SchemaVersion(); local > 0 && version > local {
+		plog.Errorf("snapshot schema version %d, local schema version %d",
+			version, local)
+		return sm.ErrIncompatibleSchemaVersion
+	}
+	return sv.PrepareRecovery(version)
+}
+
+// snapshotCompleted notifies the user state machine of the completed snapshot
+// when it implements the sm.ICompactionCoordinator interface.
+func (ds *NativeSM) snapshotCompleted(info sm.SnapshotCompletedInfo) {
+	if a, ok := ds.sm.(compactionCoordinatorUser); ok {
+		a.snapshotCompleted(info)
+	}
+}
+
+// borrowsCommands returns a boolean value indicating whether the user state
+// machine implements the sm.IBorrowedCommands interface and accepts borrowed
+// Cmd slices.
+func (ds *NativeSM) borrowsCommands() bool {
+	if a, ok := ds.sm.(borrowedCommandsUser); ok {
+		return a.borrowsCommands()
+	}
+	return false
+}
+
+// getUpdateContext returns the sm.IUpdateContext implemented by the user
+// state machine.
+func (ds *NativeSM) getUpdateContext() (sm.IUpdateContext, bool) {
+	if a, ok := ds.sm.(updateContextUser); ok {
+		return a.updateContext()
+	}
+	return nil, false
+}
+
+func (ds *NativeSM) getContextLookup() (sm.IContextLookup, bool) {
+	if a, ok := ds.sm.(contextLookupUser); ok {
+		return a.contextLookup()
+	}
+	return nil, false
+}
+
+// SupportsContextLookup returns a boolean value indicating whether the user
+// state machine implements the sm.IContextLookup interface.
+func (ds *NativeSM) SupportsContextLookup() bool {
+	_, ok := ds.getContextLookup()
+	return ok
+}
+
+// ContextLookup queries the data store using the specified context. The
+// Lookup method of the user state machine is used when it doesn't implement
+// the sm.IContextLookup interface.
+func (ds *NativeSM) ContextLookup(ctx context.Context,
+	query interface{}) (interface{}, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	if ds.destroyed {
+		return nil, ErrClusterClosed
+	}
+	return ds.ConcurrentContextLookup(ctx, query)
+}
+
+// ConcurrentContextLookup queries the data store using the specified context
+// without obtaining the NativeSM.mu.
+func (ds *NativeSM) ConcurrentContextLookup(ctx context.Context,
+	query interface{}) (interface{}, error) {
+	if l, ok := ds.getContextLookup(); ok {
+		return l.LookupWithContext(ctx, query)
+	}
+	return ds.sm.Lookup(query)
+}
+
+// BatchedLookup queries the data store using all specified queries.
+func (ds *NativeSM) BatchedLookup(queries []interface{}) ([]interface{}, error) {
+	ds.mu.RLock()
+	defer ds.mu.RUnlock()
+	if ds.destroyed {
+		return nil, ErrClusterClosed
+	}
+	return ds.ConcurrentBatchedLookup(queries)
+}
+
+// ConcurrentBatchedLookup queries the data store using all specified queries
+// without obtaining the NativeSM.mu. The BatchedLookup method of the user state
+// machine is used when it implements the sm.IBatchedLookup interface, or its
+// Lookup method is invoked for each query otherwise.
+func (ds *NativeSM) ConcurrentBatchedLookup(
+	queries []interface{}) ([]interface{}, error) {
+	if a, ok := ds.sm.(batchedLookupUser); ok {
+		if l, ok := a.batchedLookup(); ok {
+			results, err := l.BatchedLookup(queries)
+			if err != nil {
+				return nil, err
+			}
+			if len(results) != len(queries) {
+				plog.Panicf("%d results returned for %d queries",
+					len(results), len(queries))
+			}
+			return results, nil
+		}
+	}
+	return lookupEach(queries, ds.sm.Lookup)
+}
+
 // Prepare makes preparation for concurrently taking snapshot.
 func (ds *NativeSM) Prepare() (interface{}, error) {
 	return ds.sm.Prepare()
@@ -288,3 +457,28 @@ func (ds *NativeSM) Stream(ctx interface{}, w io.Writer) error {
 func (ds *NativeSM) Recover(r io.Reader, files []sm.SnapshotFile) error {
 	return ds.sm.Recover(r, files, ds.done)
 }
+
+// StreamDelta creates and streams a delta snapshot containing changes made
+// after the since index to a remote node. sm.ErrDeltaSnapshotNotAvailable is
+// returned when the user state machine can not produce such delta snapshot.
+func (ds *NativeSM) StreamDelta(ctx interface{},
+	since uint64, w io.Writer) error {
+	a, ok := ds.sm.(deltaSnapshotUser)
+	if !ok {
+		return sm.ErrDeltaSnapshotNotAvailable
+	}
+	if _, err := w.Write(GetEmptyLRUSession()); err != nil {
+		return err
+	}
+	return a.saveDelta(ctx, since, w, ds.done)
+}
+
+// RecoverFromDelta recovers the state of the data store from the delta
+// snapshot read from the specified reader.
+func (ds *NativeSM) RecoverFromDelta(r io.Reader, since uint64) error {
+	a, ok := ds.sm.(deltaSnapshotUser)
+	if !ok {
+		return sm.ErrNotImplemented
+	}
+	return a.recoverFromDelta(r, since, ds.done)
+}
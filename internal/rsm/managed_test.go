@@ -15,6 +15,7 @@
 package rsm
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -22,6 +23,7 @@ import (
 	"time"
 
 	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/tests"
 	pb "github.com/lni/dragonboat/v3/raftpb"
 	sm "github.com/lni/dragonboat/v3/statemachine"
 )
@@ -107,3 +109,147 @@ func TestLookupWillFailOnClosedStateMachine(t *testing.T) {
 		t.Errorf("failed to return ErrClusterClosed")
 	}
 }
+
+func TestDeltaSnapshotNotAvailableWhenNotImplemented(t *testing.T) {
+	od := NewOnDiskStateMachine(tests.NewFakeDiskSM(0))
+	ds := NewNativeSM(config.Config{}, od, nil)
+	if _, err := ds.Open(); err != nil {
+		t.Fatalf("failed to open %v", err)
+	}
+	var buf bytes.Buffer
+	if err := ds.StreamDelta(nil, 1, &buf); err != sm.ErrDeltaSnapshotNotAvailable {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := ds.RecoverFromDelta(&buf, 1); err != sm.ErrNotImplemented {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDeltaGuardRejectsOutOfDateState(t *testing.T) {
+	od := NewOnDiskStateMachine(tests.NewFakeDiskSM(0))
+	ds := NewNativeSM(config.Config{}, od, nil)
+	if _, err := ds.Open(); err != nil {
+		t.Fatalf("failed to open %v", err)
+	}
+	g := &deltaGuard{IManagedStateMachine: ds, index: 10}
+	if err := g.RecoverFromDelta(nil, 11); err != ErrDeltaSnapshotNotApplicable {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := g.RecoverFromDelta(nil, 10); err != sm.ErrNotImplemented {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+type schemaVersionedSM struct {
+	tests.NoOP
+	version  uint64
+	prepared []uint64
+}
+
+func (s *schemaVersionedSM) SchemaVersion() uint64 {
+	return s.version
+}
+
+func (s *schemaVersionedSM) PrepareRecovery(version uint64) error {
+	s.prepared = append(s.prepared, version)
+	return nil
+}
+
+func TestSchemaVersionIsCheckedBeforeRecovery(t *testing.T) {
+	u := &schemaVersionedSM{version: 2}
+	ds := NewNativeSM(config.Config{}, NewInMemStateMachine(u), nil)
+	if v := ds.SchemaVersion(); v != 2 {
+		t.Errorf("schema version %d, want 2", v)
+	}
+	for _, v := range []uint64{0, 1, 2} {
+		if err := ds.PrepareRecovery(v); err != nil {
+			t.Errorf("version %d, unexpected error %v", v, err)
+		}
+	}
+	if err := ds.PrepareRecovery(3); err != sm.ErrIncompatibleSchemaVersion {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(u.prepared) != 3 || u.prepared[2] != 2 {
+		t.Errorf("unexpected prepared versions %v", u.prepared)
+	}
+	u.version = 0
+	if err := ds.PrepareRecovery(3); err != nil {
+		t.Errorf("unversioned state machine refused snapshot, %v", err)
+	}
+	g := &deltaGuard{IManagedStateMachine: ds}
+	if err := g.PrepareRecovery(4); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(u.prepared) != 5 || u.prepared[4] != 4 {
+		t.Errorf("unexpected prepared versions %v", u.prepared)
+	}
+}
+
+func TestSchemaVersionIsNotCheckedWhenNotImplemented(t *testing.T) {
+	ds := NewNativeSM(config.Config{}, NewInMemStateMachine(&tests.NoOP{}), nil)
+	if v := ds.SchemaVersion(); v != 0 {
+		t.Errorf("schema version %d, want 0", v)
+	}
+	if err := ds.PrepareRecovery(100); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+type batchedLookupSM struct {
+	tests.NoOP
+	batches int
+}
+
+func (s *batchedLookupSM) BatchedLookup(
+	queries []interface{}) ([]interface{}, error) {
+	s.batches++
+	return queries, nil
+}
+
+func TestBatchedLookup(t *testing.T) {
+	u := &batchedLookupSM{}
+	ds := NewNativeSM(config.Config{}, NewInMemStateMachine(u), nil)
+	queries := []interface{}{1, 2, 3}
+	results, err := ds.BatchedLookup(queries)
+	if err != nil {
+		t.Fatalf("batched lookup failed %v", err)
+	}
+	if len(results) != 3 || u.batches != 1 {
+		t.Errorf("unexpected results %v, batches %d", results, u.batches)
+	}
+	ds = NewNativeSM(config.Config{},
+		NewInMemStateMachine(&tests.NoOP{}), nil)
+	results, err = ds.BatchedLookup(queries)
+	if err != nil {
+		t.Fatalf("batched lookup failed %v", err)
+	}
+	if len(results) != 3 {
+		t.Errorf("unexpected results %v", results)
+	}
+	ds.Loaded()
+	ds.Offloaded()
+	ds.Close()
+	if _, err := ds.BatchedLookup(queries); err != ErrClusterClosed {
+		t.Errorf("failed to return ErrClusterClosed")
+	}
+}
+
+type borrowedCommandsSM struct {
+	tests.NoOP
+}
+
+func (s *borrowedCommandsSM) BorrowsCommands() bool {
+	return true
+}
+
+func TestBorrowedCommandsSupportIsReported(t *testing.T) {
+	ds := NewNativeSM(config.Config{},
+		NewInMemStateMachine(&borrowedCommandsSM{}), nil)
+	if !ds.borrowsCommands() {
+		t.Errorf("borrowed commands not reported")
+	}
+	ds = NewNativeSM(config.Config{}, NewInMemStateMachine(&tests.NoOP{}), nil)
+	if ds.borrowsCommands() {
+		t.Errorf("unexpected borrowed commands support")
+	}
+}
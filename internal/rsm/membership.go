@@ -274,6 +274,13 @@ func (m *membership) apply(cc pb.ConfigChange, index uint64) {
 var nid = logutil.NodeID
 
 func (m *membership) handleConfigChange(cc pb.ConfigChange, index uint64) bool {
+	return !m.processConfigChange(cc, index).Rejected
+}
+
+// processConfigChange applies the config change when it is accepted, the
+// returned ConfigChangeRejection describes why it is rejected.
+func (m *membership) processConfigChange(cc pb.ConfigChange,
+	index uint64) ConfigChangeRejection {
 	// order id requested by user
 	ccid := cc.ConfigChangeId
 	nodeBecomingObserver := m.isAddNodeAsObserver(cc)
@@ -314,39 +321,54 @@ func (m *membership) handleConfigChange(cc pb.ConfigChange, index uint64) bool {
 		} else {
 			plog.Panicf("unknown cc.Type value %d", cc.Type)
 		}
+		return ConfigChangeRejection{}
+	}
+	r := ConfigChangeRejection{Rejected: true}
+	if !upToDateCC {
+		plog.Warningf("%s rej out-of-order ConfChange ccid %d (%d), type %s",
+			m.id(), ccid, index, cc.Type)
+		r.Detail = "out-of-order config change"
+	} else if addRemovedNode {
+		plog.Warningf("%s rej add removed ccid %d (%d), %s",
+			m.id(), ccid, index, nid(cc.NodeID))
+		r.Detail = "adding a removed node"
+	} else if alreadyMember {
+		plog.Warningf("%s rej add exist ccid %d (%d) %s (%s)",
+			m.id(), ccid, index, nid(cc.NodeID), cc.Address)
+		r.Detail = "adding an existing member"
+	} else if nodeBecomingObserver {
+		plog.Warningf("%s rej add exist as observer ccid %d (%d) %s (%s)",
+			m.id(), ccid, index, nid(cc.NodeID), cc.Address)
+		r.Detail = "adding an existing node as observer"
+	} else if nodeBecomingWitness {
+		plog.Warningf("%s rej add exist as witness ccid %d (%d) %s (%s)",
+			m.id(), ccid, index, nid(cc.NodeID), cc.Address)
+		r.Detail = "adding an existing node as witness"
+		r.WitnessTarget = true
+	} else if witnessBecomingNode {
+		plog.Warningf("%s rej add witness as node ccid %d (%d) %s (%s)",
+			m.id(), ccid, index, nid(cc.NodeID), cc.Address)
+		r.Detail = "adding a witness as regular node"
+		r.WitnessTarget = true
+	} else if witnessBecomingObserver {
+		plog.Warningf("%s rej add witness as observer ccid %d (%d) %s (%s)",
+			m.id(), ccid, index, nid(cc.NodeID), cc.Address)
+		r.Detail = "adding a witness as observer"
+		r.WitnessTarget = true
+	} else if observerBecomingWitness {
+		plog.Warningf("%s rej add observer as witness ccid %d (%d) %s (%s)",
+			m.id(), ccid, index, nid(cc.NodeID), cc.Address)
+		r.Detail = "adding an observer as witness"
+		r.WitnessTarget = true
+	} else if deleteOnlyNode {
+		plog.Warningf("%s rej remove the only node %s", m.id(), nid(cc.NodeID))
+		r.Detail = "removing the only node"
+	} else if invalidPromotion {
+		plog.Warningf("%s rej invalid observer promotion ccid %d (%d) %s (%s)",
+			m.id(), ccid, index, nid(cc.NodeID), cc.Address)
+		r.Detail = "invalid observer promotion"
 	} else {
-		if !upToDateCC {
-			plog.Warningf("%s rej out-of-order ConfChange ccid %d (%d), type %s",
-				m.id(), ccid, index, cc.Type)
-		} else if addRemovedNode {
-			plog.Warningf("%s rej add removed ccid %d (%d), %s",
-				m.id(), ccid, index, nid(cc.NodeID))
-		} else if alreadyMember {
-			plog.Warningf("%s rej add exist ccid %d (%d) %s (%s)",
-				m.id(), ccid, index, nid(cc.NodeID), cc.Address)
-		} else if nodeBecomingObserver {
-			plog.Warningf("%s rej add exist as observer ccid %d (%d) %s (%s)",
-				m.id(), ccid, index, nid(cc.NodeID), cc.Address)
-		} else if nodeBecomingWitness {
-			plog.Warningf("%s rej add exist as witness ccid %d (%d) %s (%s)",
-				m.id(), ccid, index, nid(cc.NodeID), cc.Address)
-		} else if witnessBecomingNode {
-			plog.Warningf("%s rej add witness as node ccid %d (%d) %s (%s)",
-				m.id(), ccid, index, nid(cc.NodeID), cc.Address)
-		} else if witnessBecomingObserver {
-			plog.Warningf("%s rej add witness as observer ccid %d (%d) %s (%s)",
-				m.id(), ccid, index, nid(cc.NodeID), cc.Address)
-		} else if observerBecomingWitness {
-			plog.Warningf("%s rej add observer as witness ccid %d (%d) %s (%s)",
-				m.id(), ccid, index, nid(cc.NodeID), cc.Address)
-		} else if deleteOnlyNode {
-			plog.Warningf("%s rej remove the only node %s", m.id(), nid(cc.NodeID))
-		} else if invalidPromotion {
-			plog.Warningf("%s rej invalid observer promotion ccid %d (%d) %s (%s)",
-				m.id(), ccid, index, nid(cc.NodeID), cc.Address)
-		} else {
-			plog.Panicf("config change rejected for unknown reasons")
-		}
+		plog.Panicf("config change rejected for unknown reasons")
 	}
-	return accepted
+	return r
 }
@@ -501,11 +501,16 @@ func (v *v2validator) validateBlock(block []byte) bool {
 // GetV2PayloadChecksum calculates the payload checksum of the specified
 // snapshot file.
 func GetV2PayloadChecksum(fp string, fs vfs.IFS) (crc []byte, err error) {
-	offsets, err := getV2CRCOffsetList(fp, fs)
+	t, err := getV2ChecksumType(fp, fs)
 	if err != nil {
 		return nil, err
 	}
-	t, err := getV2ChecksumType(fp, fs)
+	return getV2PayloadChecksum(fp, t, fs)
+}
+
+func getV2PayloadChecksum(fp string,
+	t pb.ChecksumType, fs vfs.IFS) (crc []byte, err error) {
+	offsets, err := getV2CRCOffsetList(fp, fs)
 	if err != nil {
 		return nil, err
 	}
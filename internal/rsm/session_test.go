@@ -48,7 +48,7 @@ func TestResponseCanBeAdded(t *testing.T) {
 		}
 		v, ok := s.getResponse(tt.testSeriesNum)
 		if v.Value != tt.expectedValue {
-			t.Errorf("i %d, v %d, want %d", i, v, tt.expectedValue)
+			t.Errorf("i %d, v %v, want %d", i, v, tt.expectedValue)
 		}
 		if ok != tt.expectedResult {
 			t.Errorf("i %d, v %t, want %t", i, ok, tt.expectedResult)
@@ -151,6 +151,33 @@ func TestSessionCanBeSavedAndRestored(t *testing.T) {
 	}
 }
 
+func TestApplicationErrorCanBeSavedAndRestored(t *testing.T) {
+	s := newSession(0)
+	s.addResponse(1, sm.Result{Value: 100})
+	snapshot := &bytes.Buffer{}
+	if err := s.save(snapshot); err != nil {
+		t.Fatalf("save failed %v", err)
+	}
+	if bytes.Contains(snapshot.Bytes(), []byte("Error")) {
+		t.Errorf("nil application error saved")
+	}
+	s.addResponse(2, sm.Result{
+		Value: 200,
+		Error: &sm.ApplicationError{Code: 3, Message: "insufficient balance"},
+	})
+	snapshot.Reset()
+	if err := s.save(snapshot); err != nil {
+		t.Fatalf("save failed %v", err)
+	}
+	newS := &Session{}
+	if err := newS.recoverFromSnapshot(snapshot, V2); err != nil {
+		t.Fatalf("failed to create session from snapshot, %v", err)
+	}
+	if !reflect.DeepEqual(newS, s) {
+		t.Errorf("got %v, want %v", newS, s)
+	}
+}
+
 func TestSessionCanBeRestoredFromV1Snapshot(t *testing.T) {
 	session := &v1session{
 		ClientID:      123,
@@ -15,6 +15,9 @@
 package rsm
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
 	"io"
 
 	sm "github.com/lni/dragonboat/v3/statemachine"
@@ -23,7 +26,8 @@ import (
 // SessionManager is the wrapper struct that implements client session related
 // functionalites used in the IManagedStateMachine interface.
 type SessionManager struct {
-	lru *lrusession
+	lru    *lrusession
+	tokens *IdempotencyTokens
 }
 
 var _ ILoadable = (*SessionManager)(nil)
@@ -31,14 +35,32 @@ var _ ILoadable = (*SessionManager)(nil)
 // NewSessionManager returns a new SessionManager instance.
 func NewSessionManager() *SessionManager {
 	return &SessionManager{
-		lru: newLRUSession(LRUMaxSessionCount),
+		lru:    newLRUSession(LRUMaxSessionCount),
+		tokens: newIdempotencyTokens(),
 	}
 }
 
 // GetSessionHash returns an uint64 integer representing the state of the
 // session manager.
 func (ds *SessionManager) GetSessionHash() uint64 {
-	return ds.lru.getHash()
+	if ds.tokens.Len() == 0 {
+		return ds.lru.getHash()
+	}
+	buf := &bytes.Buffer{}
+	if err := ds.SaveSessions(buf); err != nil {
+		panic(err)
+	}
+	md5sum := md5.Sum(buf.Bytes())
+	return binary.LittleEndian.Uint64(md5sum[:8])
+}
+
+// GetIdempotencyTokens returns the idempotency tokens area saved and loaded
+// together with client sessions.
+func (ds *SessionManager) GetIdempotencyTokens() *IdempotencyTokens {
+	if ds == nil {
+		return nil
+	}
+	return ds.tokens
 }
 
 // UpdateRespondedTo updates the responded to value of the specified
@@ -124,12 +146,30 @@ func (ds *SessionManager) AddResponse(session *Session,
 	session.addResponse(RaftSeriesID(seriesID), result)
 }
 
-// SaveSessions saves the sessions to the provided io.writer.
+// SaveSessions saves the sessions to the provided io.writer. Idempotency
+// tokens, when there is any, are saved after the sessions.
 func (ds *SessionManager) SaveSessions(writer io.Writer) error {
-	return ds.lru.save(writer)
+	if ds.tokens.Len() == 0 {
+		return ds.lru.save(writer)
+	}
+	if err := ds.lru.saveAs(writer, tokensFlag); err != nil {
+		return err
+	}
+	return ds.tokens.save(writer)
 }
 
 // LoadSessions loads and restores sessions from io.Reader.
 func (ds *SessionManager) LoadSessions(reader io.Reader, v SSVersion) error {
-	return ds.lru.load(reader, v)
+	flags, err := ds.lru.loadAs(reader, v)
+	if err != nil {
+		return err
+	}
+	if flags&tokensFlag == 0 {
+		ds.tokens.reset()
+		return nil
+	}
+	if ds.tokens == nil {
+		ds.tokens = newIdempotencyTokens()
+	}
+	return ds.tokens.load(reader)
 }
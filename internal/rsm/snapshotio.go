@@ -25,6 +25,7 @@ import (
 	"github.com/lni/dragonboat/v3/internal/fileutil"
 	"github.com/lni/dragonboat/v3/internal/settings"
 	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
 	pb "github.com/lni/dragonboat/v3/raftpb"
 )
 
@@ -160,11 +161,14 @@ func GetWitnessSnapshot(fs vfs.IFS) ([]byte, error) {
 
 // SnapshotWriter is an io.Writer used to write snapshot file.
 type SnapshotWriter struct {
-	vw   IVWriter
-	file vfs.File
-	fs   vfs.IFS
-	fp   string
-	ct   pb.CompressionType
+	vw    IVWriter
+	ew    *encryptedWriter
+	file  vfs.File
+	fs    vfs.IFS
+	fp    string
+	keyID string
+	ct    pb.CompressionType
+	sv    uint64
 }
 
 // NewSnapshotWriter creates a new snapshot writer instance.
@@ -173,6 +177,28 @@ func NewSnapshotWriter(fp string,
 	return newVersionedSnapshotWriter(fp, DefaultVersion, ct, fs)
 }
 
+// NewEncryptedSnapshotWriter creates a new snapshot writer instance that
+// encrypts the snapshot payload using the current key of the specified
+// encryption provider. The key ID is recorded in the snapshot header. When ep
+// is nil, the payload is not encrypted.
+func NewEncryptedSnapshotWriter(fp string, ct pb.CompressionType,
+	ep raftio.IEncryptionProvider, fs vfs.IFS) (*SnapshotWriter, error) {
+	if ep == nil {
+		return NewSnapshotWriter(fp, ct, fs)
+	}
+	keyID, aead, err := getEncryptionCipher(ep)
+	if err != nil {
+		return nil, err
+	}
+	sw, err := NewSnapshotWriter(fp, ct, fs)
+	if err != nil {
+		return nil, err
+	}
+	sw.ew = newEncryptedWriter(sw.vw, keyID, aead)
+	sw.keyID = keyID
+	return sw, nil
+}
+
 func newVersionedSnapshotWriter(fp string,
 	v SSVersion, ct pb.CompressionType, fs vfs.IFS) (*SnapshotWriter, error) {
 	f, err := fs.Create(fp)
@@ -215,13 +241,25 @@ func (sw *SnapshotWriter) Close() error {
 	return fileutil.SyncDir(sw.fs.PathDir(sw.fp), sw.fs)
 }
 
+// SetSchemaVersion sets the schema version of the user state machine to be
+// recorded in the snapshot header.
+func (sw *SnapshotWriter) SetSchemaVersion(v uint64) {
+	sw.sv = v
+}
+
 // Write writes the specified data to the snapshot.
 func (sw *SnapshotWriter) Write(data []byte) (int, error) {
+	if sw.ew != nil {
+		return sw.ew.Write(data)
+	}
 	return sw.vw.Write(data)
 }
 
 // GetPayloadSize returns the payload size.
 func (sw *SnapshotWriter) GetPayloadSize(sz uint64) uint64 {
+	if sw.ew != nil {
+		sz = getEncryptedSize(sz, sw.ew.aead)
+	}
 	return sw.vw.GetPayloadSize(sz)
 }
 
@@ -231,6 +269,11 @@ func (sw *SnapshotWriter) GetPayloadChecksum() []byte {
 }
 
 func (sw *SnapshotWriter) flush() error {
+	if sw.ew != nil {
+		if err := sw.ew.Close(); err != nil {
+			return err
+		}
+	}
 	return sw.vw.Close()
 }
 
@@ -243,6 +286,8 @@ func (sw *SnapshotWriter) saveHeader() error {
 		ChecksumType:    getChecksumType(),
 		Version:         uint64(sw.vw.GetVersion()),
 		CompressionType: sw.ct,
+		EncryptionKeyId: sw.keyID,
+		SchemaVersion:   sw.sv,
 	}
 	data, err := sh.Marshal()
 	if err != nil {
@@ -274,17 +319,27 @@ func (sw *SnapshotWriter) saveHeader() error {
 // SnapshotReader is an io.Reader for reading from snapshot files.
 type SnapshotReader struct {
 	r      IVReader
+	er     *encryptedReader
+	ep     raftio.IEncryptionProvider
 	file   vfs.File
 	header pb.SnapshotHeader
 }
 
 // NewSnapshotReader creates a new snapshot reader instance.
 func NewSnapshotReader(fp string, fs vfs.IFS) (*SnapshotReader, error) {
+	return NewEncryptedSnapshotReader(fp, nil, fs)
+}
+
+// NewEncryptedSnapshotReader creates a new snapshot reader instance that uses
+// the specified encryption provider to decrypt snapshots with an encryption
+// key ID recorded in their headers. Unencrypted snapshots can be read as well.
+func NewEncryptedSnapshotReader(fp string,
+	ep raftio.IEncryptionProvider, fs vfs.IFS) (*SnapshotReader, error) {
 	f, err := fs.Open(fp)
 	if err != nil {
 		return nil, err
 	}
-	return &SnapshotReader{file: f}, nil
+	return &SnapshotReader{file: f, ep: ep}, nil
 }
 
 // Close closes the snapshot reader instance.
@@ -348,6 +403,13 @@ func (sr *SnapshotReader) GetHeader() (pb.SnapshotHeader, error) {
 		reader = io.LimitReader(reader, payloadSz)
 	}
 	sr.r = mustGetVersionedReader(reader, v, sr.header.ChecksumType)
+	if keyID := sr.header.EncryptionKeyId; len(keyID) > 0 {
+		aead, err := getDecryptionCipher(sr.ep, keyID)
+		if err != nil {
+			return empty, err
+		}
+		sr.er = newEncryptedReader(sr.r, keyID, aead)
+	}
 	return sr.header, nil
 }
 
@@ -356,6 +418,9 @@ func (sr *SnapshotReader) Read(data []byte) (int, error) {
 	if sr.r == nil {
 		panic("Read called before GetHeader")
 	}
+	if sr.er != nil {
+		return sr.er.Read(data)
+	}
 	return sr.r.Read(data)
 }
 
@@ -474,6 +539,52 @@ func IsShrunkSnapshotFile(fp string, fs vfs.IFS) (shrunk bool, err error) {
 	return false, err
 }
 
+// ValidateSnapshotFile returns a boolean flag indicating whether the header
+// and the payload of the specified snapshot file match their checksums.
+// Shrunk snapshot files are considered as valid when their headers are valid.
+func ValidateSnapshotFile(fp string, fs vfs.IFS) (bool, error) {
+	fi, err := fs.Stat(fp)
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() < int64(HeaderSize) {
+		return false, nil
+	}
+	valid, headerValid, err := validateSnapshotFile(fp, fs)
+	if err != nil || valid || !headerValid {
+		return valid, err
+	}
+	return IsShrunkSnapshotFile(fp, fs)
+}
+
+func validateSnapshotFile(fp string,
+	fs vfs.IFS) (valid bool, headerValid bool, err error) {
+	f, err := fs.Open(fp)
+	if err != nil {
+		return false, false, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	v := NewSnapshotValidator()
+	buf := make([]byte, settings.SnapshotChunkSize)
+	for chunkID := uint64(0); ; chunkID++ {
+		n, rerr := io.ReadFull(f, buf)
+		if n > 0 && !v.AddChunk(buf[:n], chunkID) {
+			return false, chunkID > 0 || v.v != nil, nil
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return false, false, rerr
+		}
+	}
+	return v.Validate(), true, nil
+}
+
 func mustInSameDir(fp string, newFp string, fs vfs.IFS) {
 	if fs.PathDir(fp) != fs.PathDir(newFp) {
 		plog.Panicf("not in the same dir, dir 1: %s, dir 2: %s",
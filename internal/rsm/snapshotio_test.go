@@ -18,10 +18,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 
 	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
 	pb "github.com/lni/dragonboat/v3/raftpb"
 	gvfs "github.com/lni/goutils/vfs"
 )
@@ -62,6 +64,7 @@ func TestSaveHeaderSavesTheHeader(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to create snapshot writer %v", err)
 		}
+		w.SetSchemaVersion(3)
 		sessionData := make([]byte, testSessionSize)
 		storeData := make([]byte, testPayloadSize)
 		rand.Read(sessionData)
@@ -94,6 +97,9 @@ func TestSaveHeaderSavesTheHeader(t *testing.T) {
 			t.Errorf("unexpected checksum type %d, want %d",
 				header.ChecksumType, DefaultChecksumType)
 		}
+		if header.SchemaVersion != 3 {
+			t.Errorf("schema version %d, want 3", header.SchemaVersion)
+		}
 		storeChecksum := w.vw.GetPayloadSum()
 		if !bytes.Equal(header.PayloadChecksum, storeChecksum) {
 			t.Errorf("data store checksum mismatch")
@@ -620,3 +626,151 @@ func TestGetWitnessSnapshot(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateSnapshotFile(t *testing.T) {
+	fs := vfs.GetTestFS()
+	snapshotFilename := "test_snapshot_safe_to_delete.data"
+	shrunkFilename := "test_snapshot_safe_to_delete.shrunk"
+	defer func() {
+		if err := fs.RemoveAll(snapshotFilename); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := fs.RemoveAll(shrunkFilename); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	writer, err := NewSnapshotWriter(snapshotFilename, pb.NoCompression, fs)
+	if err != nil {
+		t.Fatalf("failed to get writer %v", err)
+	}
+	sz := make([]byte, 8)
+	if _, err := writer.Write(sz); err != nil {
+		t.Fatalf("failed to write session size %v", err)
+	}
+	data := make([]byte, 5*1024*1024)
+	rand.Read(data)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("close failed %v", err)
+	}
+	valid, err := ValidateSnapshotFile(snapshotFilename, fs)
+	if err != nil || !valid {
+		t.Fatalf("valid snapshot file not accepted, %t, %v", valid, err)
+	}
+	if err := ShrinkSnapshot(snapshotFilename, shrunkFilename, fs); err != nil {
+		t.Fatalf("failed to shrink snapshot %v", err)
+	}
+	valid, err = ValidateSnapshotFile(shrunkFilename, fs)
+	if err != nil || !valid {
+		t.Fatalf("shrunk snapshot file not accepted, %t, %v", valid, err)
+	}
+	f, err := fs.Open(snapshotFilename)
+	if err != nil {
+		t.Fatalf("failed to open the file %v", err)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close %v", err)
+	}
+	content[3*1024*1024] ^= 0xFF
+	f, err = fs.Create(snapshotFilename)
+	if err != nil {
+		t.Fatalf("failed to create the file %v", err)
+	}
+	if _, err := f.Write(content); err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close %v", err)
+	}
+	valid, err = ValidateSnapshotFile(snapshotFilename, fs)
+	if err != nil || valid {
+		t.Errorf("corrupted snapshot file not reported, %t, %v", valid, err)
+	}
+	if _, err := ValidateSnapshotFile("no-such-file", fs); !vfs.IsNotExist(err) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestEncryptedSnapshotCanBeRead(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(testSnapshotFilename); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	p := newTestEncryptionProvider("key-1")
+	w, err := NewEncryptedSnapshotWriter(testSnapshotFilename,
+		pb.NoCompression, p, fs)
+	if err != nil {
+		t.Fatalf("failed to create snapshot writer %v", err)
+	}
+	data := make([]byte, 3*1024*1024)
+	rand.Read(data)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed %v", err)
+	}
+	fi, err := fs.Stat(testSnapshotFilename)
+	if err != nil {
+		t.Fatalf("stat failed %v", err)
+	}
+	sz := w.GetPayloadSize(uint64(len(data))) + HeaderSize
+	if uint64(fi.Size()) != sz {
+		t.Errorf("file size %d, want %d", fi.Size(), sz)
+	}
+	valid, err := ValidateSnapshotFile(testSnapshotFilename, fs)
+	if err != nil || !valid {
+		t.Fatalf("valid snapshot file not accepted, %t, %v", valid, err)
+	}
+	f, err := fs.Open(testSnapshotFilename)
+	if err != nil {
+		t.Fatalf("failed to open the file %v", err)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close %v", err)
+	}
+	if bytes.Contains(content, data[:1024]) {
+		t.Errorf("plain text found in the snapshot file")
+	}
+	read := func(ep raftio.IEncryptionProvider) ([]byte, error) {
+		r, err := NewEncryptedSnapshotReader(testSnapshotFilename, ep, fs)
+		if err != nil {
+			t.Fatalf("failed to create reader %v", err)
+		}
+		defer r.Close()
+		header, err := r.GetHeader()
+		if err != nil {
+			return nil, err
+		}
+		if header.EncryptionKeyId != "key-1" {
+			t.Errorf("unexpected key ID %s", header.EncryptionKeyId)
+		}
+		return ioutil.ReadAll(r)
+	}
+	result, err := read(p)
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	if !bytes.Equal(result, data) {
+		t.Errorf("unexpected content")
+	}
+	if _, err := read(nil); err != ErrNoEncryptionProvider {
+		t.Errorf("missing encryption provider not reported, %v", err)
+	}
+	other := newTestEncryptionProvider("key-1")
+	if _, err := read(other); err != ErrSnapshotDecryption {
+		t.Errorf("wrong key not reported, %v", err)
+	}
+}
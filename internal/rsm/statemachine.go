@@ -22,7 +22,10 @@ package rsm
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
 
@@ -48,6 +51,18 @@ var (
 	ErrRestoreSnapshot             = errors.New("failed to restore snapshot")
 	batchedEntryApply              = settings.Soft.BatchedEntryApply
 	sessionBufferInitialCap uint64 = 128 * 1024
+	// ErrChecksumMismatch indicates that the payload of a committed entry doesn't
+	// match its checksum.
+	ErrChecksumMismatch = errors.New("entry checksum mismatch")
+	// ErrEntryTruncated indicates that an encoded entry is too short to contain
+	// the fields specified in its header.
+	ErrEntryTruncated = errors.New("encoded entry truncated")
+	// ErrDiverged indicates that the hash of the state machine doesn't match the
+	// apply checkpoint persisted for the same index before the restart.
+	ErrDiverged = errors.New("state machine diverged from checkpoint")
+	// ErrDeltaSnapshotNotApplicable indicates that the state machine doesn't
+	// have all entries required by the delta snapshot applied.
+	ErrDeltaSnapshotNotApplicable = errors.New("delta snapshot not applicable")
 )
 
 // SSReqType is the type of a snapshot request.
@@ -69,11 +84,13 @@ type SSEnv = server.SSEnv
 
 // SSRequest is the type for describing the details of a snapshot request.
 type SSRequest struct {
+	Writer             io.Writer
 	Path               string
 	Type               SSReqType
 	Key                uint64
 	CompactionOverhead uint64
 	OverrideCompaction bool
+	DeltaSince         uint64
 }
 
 // Exported returns a boolean value indicating whether the snapshot request
@@ -82,6 +99,12 @@ func (r *SSRequest) Exported() bool {
 	return r.Type == Exported
 }
 
+// ExportedToWriter returns a boolean value indicating whether the snapshot
+// request is to export a snapshot to the specified io.Writer.
+func (r *SSRequest) ExportedToWriter() bool {
+	return r.Exported() && r.Writer != nil
+}
+
 // Streaming returns a boolean value indicating whether the snapshot request
 // is to stream snapshot.
 func (r *SSRequest) Streaming() bool {
@@ -90,16 +113,18 @@ func (r *SSRequest) Streaming() bool {
 
 // SSMeta is the metadata of a snapshot.
 type SSMeta struct {
-	Membership      pb.Membership
-	Ctx             interface{}
-	Session         *bytes.Buffer
-	Request         SSRequest
-	From            uint64
-	OnDiskIndex     uint64
-	Index           uint64
-	Term            uint64
-	Type            pb.StateMachineType
-	CompressionType config.CompressionType
+	Membership       pb.Membership
+	Ctx              interface{}
+	Session          *bytes.Buffer
+	Request          SSRequest
+	From             uint64
+	OnDiskIndex      uint64
+	Index            uint64
+	Term             uint64
+	Type             pb.StateMachineType
+	CompressionType  config.CompressionType
+	CompressionLevel int
+	SchemaVersion    uint64
 }
 
 // Task describes a task that need to be handled by StateMachine.
@@ -134,12 +159,31 @@ func (t *Task) isSyncTask() bool {
 type SMFactoryFunc func(clusterID uint64,
 	nodeID uint64, done <-chan struct{}) IManagedStateMachine
 
+// Checkpoint is a lightweight record of the state machine state at the
+// specified applied index.
+type Checkpoint struct {
+	Index uint64
+	Hash  uint64
+}
+
+// ConfigChangeRejection describes why a config change is rejected, the zero
+// value means that the config change has been accepted.
+type ConfigChangeRejection struct {
+	Rejected bool
+	// WitnessTarget indicates that the config change is rejected as it tries to
+	// change the role of a witness or to convert an existing member to witness.
+	WitnessTarget bool
+	// Detail is a human readable description of the rejection.
+	Detail string
+}
+
 // INode is the interface of a dragonboat node.
 type INode interface {
 	StepReady()
 	RestoreRemotes(pb.Snapshot)
 	ApplyUpdate(pb.Entry, sm.Result, bool, bool, bool)
-	ApplyConfigChange(pb.ConfigChange, uint64, bool)
+	ApplyConfigChange(pb.ConfigChange, uint64, ConfigChangeRejection)
+	ProposalContext(pb.Entry) context.Context
 	NodeID() uint64
 	ClusterID() uint64
 	ShouldStop() <-chan struct{}
@@ -182,11 +226,24 @@ type StateMachine struct {
 	onDiskInitIndex uint64
 	onDiskIndex     uint64
 	syncedIndex     uint64
+	// checkpoint is only accessed by the apply worker
+	checkpoint      Checkpoint
+	checkpointEvery uint64
 	mu              sync.RWMutex
 	sct             config.CompressionType
+	scl             int
 	onDiskSM        bool
 	aborted         bool
 	isWitness       bool
+	// capture records applied commands when the CommandCaptureFile field of
+	// config.Config is set
+	capture *commandCapture
+	// arena holds decompressed payloads when the user state machine accepts
+	// borrowed Cmd slices, only accessed by the apply worker
+	arena *payloadArena
+	// updateCtx is set when the user state machine wants the contexts of
+	// proposals before they are applied.
+	updateCtx sm.IUpdateContext
 }
 
 // NewStateMachine creates a new application state machine object.
@@ -194,18 +251,39 @@ func NewStateMachine(sm IManagedStateMachine,
 	snapshotter ISnapshotter,
 	cfg config.Config, node INode, fs vfs.IFS) *StateMachine {
 	ordered := cfg.OrderedConfigChange
-	return &StateMachine{
-		snapshotter: snapshotter,
-		sm:          sm,
-		onDiskSM:    sm.OnDisk(),
-		taskQ:       NewTaskQueue(),
-		node:        node,
-		sessions:    NewSessionManager(),
-		members:     newMembership(node.ClusterID(), node.NodeID(), ordered),
-		isWitness:   cfg.IsWitness,
-		sct:         cfg.SnapshotCompressionType,
-		fs:          fs,
+	s := &StateMachine{
+		snapshotter:     snapshotter,
+		sm:              sm,
+		onDiskSM:        sm.OnDisk(),
+		taskQ:           NewTaskQueue(),
+		node:            node,
+		sessions:        NewSessionManager(),
+		members:         newMembership(node.ClusterID(), node.NodeID(), ordered),
+		isWitness:       cfg.IsWitness,
+		sct:             cfg.SnapshotCompressionType,
+		scl:             cfg.SnapshotCompressionLevel,
+		checkpointEvery: cfg.CheckpointEntries,
+		fs:              fs,
+	}
+	if len(cfg.CommandCaptureFile) > 0 && !cfg.IsWitness {
+		c, err := openCommandCapture(cfg.CommandCaptureFile,
+			node.ClusterID(), node.NodeID(), fs)
+		if err != nil {
+			plog.Panicf("%s failed to open command capture %s, %v",
+				s.id(), cfg.CommandCaptureFile, err)
+		}
+		s.capture = c
 	}
+	if ns, ok := sm.(*NativeSM); ok {
+		ns.setIdempotencyTokens(s.sessions.GetIdempotencyTokens())
+		if ns.borrowsCommands() {
+			s.arena = &payloadArena{}
+		}
+		if u, ok := ns.getUpdateContext(); ok {
+			s.updateCtx = u
+		}
+	}
+	return s
 }
 
 // Type returns the state machine type.
@@ -227,7 +305,28 @@ func (s *StateMachine) TaskChanBusy() bool {
 
 // Close closes the state machine.
 func (s *StateMachine) Close() {
+	s.captureHash()
 	s.sm.Close()
+	s.capture.close()
+}
+
+// captureHash records the final state machine hash into the command capture.
+func (s *StateMachine) captureHash() {
+	if s.capture == nil {
+		return
+	}
+	h, err := s.GetHash()
+	if err != nil {
+		if err != sm.ErrNotImplemented {
+			plog.Errorf("%s failed to get hash, %v", s.id(), err)
+		}
+		return
+	}
+	s.capture.record(CapturedCommand{
+		Type:  CaptureHash,
+		Index: s.GetLastApplied(),
+		Hash:  h,
+	})
 }
 
 // DestroyedC return a chan struct{} used to indicate whether the SM has been
@@ -250,6 +349,11 @@ func (s *StateMachine) Recover(t Task) (uint64, error) {
 	if err := s.recover(ss, t.Initial); err != nil {
 		return 0, err
 	}
+	s.capture.record(CapturedCommand{
+		Type:  CaptureRecovered,
+		Index: ss.Index,
+		Term:  ss.Term,
+	})
 	s.node.RestoreRemotes(ss)
 	plog.Debugf("%s restored %s", s.id(), s.ssid(ss.Index))
 	return ss.Index, nil
@@ -318,6 +422,24 @@ func (s *StateMachine) checkRecoverOnDiskSM(ss pb.Snapshot, init bool) {
 	}
 }
 
+// WarmUp passes the warm-up hints of the recovered snapshot to the user state
+// machine. Lookups are blocked until WarmUp returns.
+func (s *StateMachine) WarmUp(info sm.WarmUpInfo, done <-chan struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ns, ok := s.sm.(*NativeSM); ok {
+		return ns.warmUp(info, done)
+	}
+	return nil
+}
+
+// SnapshotCompleted notifies the user state machine of the completed snapshot.
+func (s *StateMachine) SnapshotCompleted(info sm.SnapshotCompletedInfo) {
+	if ns, ok := s.sm.(*NativeSM); ok {
+		ns.snapshotCompleted(info)
+	}
+}
+
 func (s *StateMachine) recover(ss pb.Snapshot, init bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -352,7 +474,15 @@ func (s *StateMachine) doRecover(ss pb.Snapshot, init bool) error {
 	s.logMembership("members", index, ss.Membership.Addresses)
 	s.logMembership("observers", index, ss.Membership.Observers)
 	s.logMembership("witnesses", index, ss.Membership.Witnesses)
-	if err := s.snapshotter.Load(ss, s.sessions, s.sm); err != nil {
+	var asm IRecoverable = s.sm
+	if s.OnDiskStateMachine() {
+		applied := s.GetLastApplied()
+		if s.onDiskInitIndex > applied {
+			applied = s.onDiskInitIndex
+		}
+		asm = &deltaGuard{IManagedStateMachine: s.sm, index: applied}
+	}
+	if err := s.snapshotter.Load(ss, s.sessions, asm); err != nil {
 		plog.Errorf("%s failed to load %s, %v", s.id(), s.ssid(index), err)
 		if err == sm.ErrSnapshotStopped {
 			s.aborted = true
@@ -363,6 +493,37 @@ func (s *StateMachine) doRecover(ss pb.Snapshot, init bool) error {
 	return nil
 }
 
+// deltaGuard prevents the user state machine from being recovered from a delta
+// snapshot when it doesn't have all entries up to the since index applied.
+type deltaGuard struct {
+	IManagedStateMachine
+	index uint64
+}
+
+func (g *deltaGuard) RecoverFromDelta(r io.Reader, since uint64) error {
+	if g.index < since {
+		return ErrDeltaSnapshotNotApplicable
+	}
+	if dr, ok := g.IManagedStateMachine.(IDeltaRecoverable); ok {
+		return dr.RecoverFromDelta(r, since)
+	}
+	return sm.ErrNotImplemented
+}
+
+func (g *deltaGuard) SchemaVersion() uint64 {
+	if sv, ok := g.IManagedStateMachine.(ISchemaVersioned); ok {
+		return sv.SchemaVersion()
+	}
+	return 0
+}
+
+func (g *deltaGuard) PrepareRecovery(version uint64) error {
+	if sv, ok := g.IManagedStateMachine.(ISchemaVersioned); ok {
+		return sv.PrepareRecovery(version)
+	}
+	return nil
+}
+
 func (s *StateMachine) apply(ss pb.Snapshot) {
 	s.members.set(ss.Membership)
 	s.lastApplied.Lock()
@@ -416,6 +577,10 @@ func (s *StateMachine) OpenOnDiskStateMachine() (uint64, error) {
 		return 0, err
 	}
 	plog.Infof("%s opened disk SM, index %d", s.id(), index)
+	if index > 0 {
+		// existing on disk state can not be reproduced by replaying the capture
+		s.capture.record(CapturedCommand{Type: CaptureRecovered, Index: index})
+	}
 	s.onDiskInitIndex = index
 	s.onDiskIndex = index
 	return index, nil
@@ -454,6 +619,82 @@ func (s *StateMachine) concurrentLookup(query interface{}) (interface{}, error)
 	return s.sm.ConcurrentLookup(query)
 }
 
+// ContextLookup queries the local state machine using the specified context.
+// When the user state machine implements the sm.IContextLookup interface, the
+// context is passed to it so long running queries can be cancelled. Otherwise
+// the query is made in a separate goroutine and abandoned once the context is
+// done, its result is discarded as it can no longer be delivered.
+func (s *StateMachine) ContextLookup(ctx context.Context,
+	query interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ns, ok := s.sm.(*NativeSM); ok && ns.SupportsContextLookup() {
+		if s.Concurrent() {
+			return ns.ConcurrentContextLookup(ctx, query)
+		}
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if s.aborted {
+			return nil, ErrClusterClosed
+		}
+		return ns.ContextLookup(ctx, query)
+	}
+	if ctx.Done() == nil {
+		return s.Lookup(query)
+	}
+	type lookupResult struct {
+		result interface{}
+		err    error
+	}
+	resultC := make(chan lookupResult, 1)
+	go func() {
+		result, err := s.Lookup(query)
+		resultC <- lookupResult{result: result, err: err}
+	}()
+	select {
+	case r := <-resultC:
+		return r.result, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// BatchedLookup queries the local state machine using all specified queries,
+// the results are returned in the same order as the queries.
+func (s *StateMachine) BatchedLookup(
+	queries []interface{}) ([]interface{}, error) {
+	ns, ok := s.sm.(*NativeSM)
+	if s.Concurrent() {
+		if ok {
+			return ns.ConcurrentBatchedLookup(queries)
+		}
+		return lookupEach(queries, s.concurrentLookup)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.aborted {
+		return nil, ErrClusterClosed
+	}
+	if ok {
+		return ns.BatchedLookup(queries)
+	}
+	return lookupEach(queries, s.sm.Lookup)
+}
+
+func lookupEach(queries []interface{},
+	f func(interface{}) (interface{}, error)) ([]interface{}, error) {
+	results := make([]interface{}, len(queries))
+	for i, query := range queries {
+		result, err := f(query)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
 // NALookup queries the local state machine.
 func (s *StateMachine) NALookup(query []byte) ([]byte, error) {
 	if s.Concurrent() {
@@ -509,9 +750,10 @@ func (s *StateMachine) Save(req SSRequest) (pb.Snapshot, SSEnv, error) {
 }
 
 // Stream starts to stream snapshot from the current SM to a remote node
-// targeted by the provided sink.
-func (s *StateMachine) Stream(sink pb.IChunkSink) error {
-	return s.stream(sink)
+// targeted by the provided sink. When since is not 0, a delta snapshot with
+// changes made after the since index is streamed if supported by the SM.
+func (s *StateMachine) Stream(sink pb.IChunkSink, since uint64) error {
+	return s.stream(sink, since)
 }
 
 // Sync synchronizes state machine's in-core state with that on disk.
@@ -612,16 +854,20 @@ func (s *StateMachine) getSSMeta(c interface{}, r SSRequest) (SSMeta, error) {
 	}
 	buf := bytes.NewBuffer(make([]byte, 0, sessionBufferInitialCap))
 	meta := SSMeta{
-		From:            s.node.NodeID(),
-		Ctx:             c,
-		Index:           s.index,
-		Term:            s.term,
-		OnDiskIndex:     s.onDiskIndex,
-		Request:         r,
-		Session:         buf,
-		Membership:      s.members.get(),
-		Type:            s.sm.Type(),
-		CompressionType: ct,
+		From:             s.node.NodeID(),
+		Ctx:              c,
+		Index:            s.index,
+		Term:             s.term,
+		OnDiskIndex:      s.onDiskIndex,
+		Request:          r,
+		Session:          buf,
+		Membership:       s.members.get(),
+		Type:             s.sm.Type(),
+		CompressionType:  ct,
+		CompressionLevel: s.scl,
+	}
+	if sv, ok := s.sm.(ISchemaVersioned); ok {
+		meta.SchemaVersion = sv.SchemaVersion()
 	}
 	s.logMembership("members", meta.Index, meta.Membership.Addresses)
 	if err := s.sessions.SaveSessions(meta.Session); err != nil {
@@ -720,13 +966,13 @@ func (s *StateMachine) checkSnapshotStatus(r SSRequest) error {
 	return nil
 }
 
-func (s *StateMachine) stream(sink pb.IChunkSink) error {
+func (s *StateMachine) stream(sink pb.IChunkSink, since uint64) error {
 	var err error
 	var meta SSMeta
 	if err := func() error {
 		s.mu.RLock()
 		defer s.mu.RUnlock()
-		meta, err = s.prepare(SSRequest{Type: Streaming})
+		meta, err = s.prepare(SSRequest{Type: Streaming, DeltaSince: since})
 		return err
 	}(); err != nil {
 		return err
@@ -817,6 +1063,11 @@ func getEntryTypes(entries []pb.Entry) (bool, bool) {
 
 func (s *StateMachine) handle(t []Task, a []sm.Entry) error {
 	batch := batchedEntryApply && s.Concurrent()
+	for idx := range t {
+		if err := s.verifyEntries(t[idx].Entries); err != nil {
+			return err
+		}
+	}
 	for idx := range t {
 		if t[idx].IsSnapshotTask() || t[idx].isSyncTask() {
 			plog.Panicf("%s trying to handle a snapshot/sync request", s.id())
@@ -824,7 +1075,7 @@ func (s *StateMachine) handle(t []Task, a []sm.Entry) error {
 		e := t[idx].Entries
 		update, noop := getEntryTypes(e)
 		if batch && update && noop {
-			if err := s.handleBatch(e, a); err != nil {
+			if err := s.handleCheckpointedBatch(e, a); err != nil {
 				return err
 			}
 		} else {
@@ -833,6 +1084,9 @@ func (s *StateMachine) handle(t []Task, a []sm.Entry) error {
 				if err := s.handleEntry(e[i], last); err != nil {
 					return err
 				}
+				if err := s.mayCheckpoint(e[i].Index); err != nil {
+					return err
+				}
 			}
 		}
 		s.setLastApplied(e)
@@ -840,8 +1094,78 @@ func (s *StateMachine) handle(t []Task, a []sm.Entry) error {
 	return nil
 }
 
+// verifyEntries verifies the checksums of the specified entries of all types.
+// ErrChecksumMismatch is returned on mismatch as a corrupted entry can not be
+// skipped or applied without diverging from other nodes.
+func (s *StateMachine) verifyEntries(entries []pb.Entry) error {
+	for _, e := range entries {
+		if !VerifyChecksum(e) {
+			plog.Errorf("%s checksum mismatch, entry index %d, term %d",
+				s.id(), e.Index, e.Term)
+			return fmt.Errorf("%w, entry index %d, term %d",
+				ErrChecksumMismatch, e.Index, e.Term)
+		}
+	}
+	return nil
+}
+
+// GetCheckpoint returns the most recent apply checkpoint. It is expected to be
+// called by the apply worker after Handle returns.
+func (s *StateMachine) GetCheckpoint() Checkpoint {
+	return s.checkpoint
+}
+
+// handleCheckpointedBatch applies the specified entries using BatchedUpdate.
+// The state of the state machine is not observable in the middle of a
+// BatchedUpdate call, entries are thus split at multiples of the configured
+// CheckpointEntries value so each checkpoint is taken at the same index no
+// matter how entries are batched.
+func (s *StateMachine) handleCheckpointedBatch(e []pb.Entry,
+	a []sm.Entry) error {
+	for len(e) > 0 {
+		count := len(e)
+		if s.checkpointEvery > 0 {
+			first := e[0].Index
+			next := (first + s.checkpointEvery - 1) /
+				s.checkpointEvery * s.checkpointEvery
+			if next <= e[count-1].Index {
+				count = int(next-first) + 1
+			}
+		}
+		if err := s.handleBatch(e[:count], a); err != nil {
+			return err
+		}
+		if err := s.mayCheckpoint(e[count-1].Index); err != nil {
+			return err
+		}
+		e = e[count:]
+	}
+	return nil
+}
+
+// mayCheckpoint records a checkpoint when the specified index is a multiple of
+// the configured CheckpointEntries value. Only regular state machines that
+// implement the statemachine.IHash interface are checkpointed.
+func (s *StateMachine) mayCheckpoint(index uint64) error {
+	if s.checkpointEvery == 0 || index%s.checkpointEvery != 0 {
+		return nil
+	}
+	if s.isWitness || s.OnDiskStateMachine() {
+		return nil
+	}
+	h, err := s.GetHash()
+	if err != nil {
+		if err == sm.ErrNotImplemented {
+			return nil
+		}
+		return err
+	}
+	s.checkpoint = Checkpoint{Index: index, Hash: h}
+	return nil
+}
+
 func isEmptyResult(result sm.Result) bool {
-	return result.Data == nil && result.Value == 0
+	return result.Data == nil && result.Value == 0 && result.Error == nil
 }
 
 func (s *StateMachine) entryInInitDiskSM(index uint64) bool {
@@ -918,18 +1242,23 @@ func (s *StateMachine) handleBatch(input []pb.Entry, ents []sm.Entry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	skipped := 0
+	s.resetArena()
 	for _, e := range input {
 		if !s.entryInInitDiskSM(e.Index) {
 			ents = append(ents, sm.Entry{
-				Index: e.Index,
-				Cmd:   GetPayload(e),
+				Index:     e.Index,
+				Term:      e.Term,
+				Timestamp: e.Timestamp,
+				Cmd:       s.getPayload(e),
 			})
+			s.beforeUpdate(e, ents[len(ents)-1])
 		} else {
 			skipped++
 			s.setApplied(e.Index, e.Term)
 		}
 	}
 	if len(ents) > 0 {
+		s.sessions.GetIdempotencyTokens().setIndex(ents[len(ents)-1].Index)
 		results, err := s.sm.BatchedUpdate(ents)
 		if err != nil {
 			return err
@@ -942,6 +1271,7 @@ func (s *StateMachine) handleBatch(input []pb.Entry, ents []sm.Entry) error {
 					s.id(), ce.Index, e.Index, skipped)
 			}
 			last := ce.Index == input[len(input)-1].Index
+			s.captureUpdate(ce, e.Result)
 			s.onApplied(ce, e.Result, false, false, last)
 			s.setApplied(ce.Index, ce.Term)
 		}
@@ -955,16 +1285,14 @@ func (s *StateMachine) configChange(e pb.Entry) {
 	if err := cc.Unmarshal(e.Cmd); err != nil {
 		panic(err)
 	}
-	rejected := true
+	var r ConfigChangeRejection
 	func() {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 		defer s.setApplied(e.Index, e.Term)
-		if s.members.handleConfigChange(cc, e.Index) {
-			rejected = false
-		}
+		r = s.members.processConfigChange(cc, e.Index)
 	}()
-	s.node.ApplyConfigChange(cc, e.Key, rejected)
+	s.node.ApplyConfigChange(cc, e.Key, r)
 }
 
 func (s *StateMachine) registerSession(e pb.Entry) sm.Result {
@@ -1024,17 +1352,69 @@ func (s *StateMachine) update(e pb.Entry) (sm.Result, bool, bool, error) {
 			panic("already has response in session")
 		}
 	}
-	r, err := s.sm.Update(sm.Entry{Index: e.Index, Cmd: GetPayload(e)})
+	s.sessions.GetIdempotencyTokens().setIndex(e.Index)
+	s.resetArena()
+	ent := sm.Entry{
+		Index:     e.Index,
+		Term:      e.Term,
+		Timestamp: e.Timestamp,
+		Cmd:       s.getPayload(e),
+	}
+	s.beforeUpdate(e, ent)
+	r, err := s.sm.Update(ent)
 	if err != nil {
 		return sm.Result{}, false, false, err
 	}
 	s.setOnDiskIndex(e.Index, e.Index)
+	s.captureUpdate(e, r)
 	if session != nil {
 		session.addResponse(RaftSeriesID(e.SeriesID), r)
 	}
 	return r, false, false, nil
 }
 
+// getPayload returns the payload of the entry to be passed to the user state
+// machine, it is decompressed into the arena when borrowed Cmd slices are
+// accepted.
+func (s *StateMachine) getPayload(e pb.Entry) []byte {
+	if s.arena != nil {
+		return s.arena.get(e)
+	}
+	return GetPayload(e)
+}
+
+// beforeUpdate passes the context of the proposal to the user state machine
+// when it implements the sm.IUpdateContext interface.
+func (s *StateMachine) beforeUpdate(e pb.Entry, ent sm.Entry) {
+	if s.updateCtx != nil {
+		s.updateCtx.BeforeUpdate(s.node.ProposalContext(e), ent)
+	}
+}
+
+func (s *StateMachine) resetArena() {
+	if s.arena != nil {
+		s.arena.reset()
+	}
+}
+
+func (s *StateMachine) captureUpdate(e pb.Entry, r sm.Result) {
+	if s.capture == nil {
+		return
+	}
+	s.capture.record(CapturedCommand{
+		Type:        CaptureUpdate,
+		Index:       e.Index,
+		Term:        e.Term,
+		ClientID:    e.ClientID,
+		SeriesID:    e.SeriesID,
+		NoOPSession: e.IsNoOPSession(),
+		Cmd:         GetPayload(e),
+		Value:       r.Value,
+		Data:        r.Data,
+		Error:       r.Error,
+	})
+}
+
 func (s *StateMachine) id() string {
 	return logutil.DescribeSM(s.node.ClusterID(), s.node.NodeID())
 }
@@ -16,10 +16,13 @@ package rsm
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/lni/goutils/leaktest"
 
@@ -99,6 +102,10 @@ func (p *testNodeProxy) ApplyUpdate(entry pb.Entry,
 
 func (p *testNodeProxy) SetLastApplied(v uint64) {}
 
+func (p *testNodeProxy) ProposalContext(e pb.Entry) context.Context {
+	return context.Background()
+}
+
 func (p *testNodeProxy) RestoreRemotes(s pb.Snapshot) {
 	for k := range s.Membership.Addresses {
 		_ = k
@@ -107,7 +114,9 @@ func (p *testNodeProxy) RestoreRemotes(s pb.Snapshot) {
 	}
 }
 
-func (p *testNodeProxy) ApplyConfigChange(cc pb.ConfigChange, key uint64, rejected bool) {
+func (p *testNodeProxy) ApplyConfigChange(cc pb.ConfigChange,
+	key uint64, r ConfigChangeRejection) {
+	rejected := r.Rejected
 	if !rejected {
 		p.applyConfChange = true
 		if cc.Type == pb.AddNode {
@@ -357,6 +366,46 @@ func TestUpdatesCanBeBatched(t *testing.T) {
 	reportLeakedFD(fs, t)
 }
 
+func TestBatchedUpdatesAreSplitAtCheckpoints(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	createTestDir(fs)
+	defer removeTestDir(fs)
+	store := &tests.ConcurrentUpdate{}
+	config := config.Config{ClusterID: 1, NodeID: 1}
+	ds := NewNativeSM(config, NewConcurrentStateMachine(store), make(chan struct{}))
+	nodeProxy := newTestNodeProxy()
+	snapshotter := newTestSnapshotter(fs)
+	sm := NewStateMachine(ds, snapshotter, config, nodeProxy, fs)
+	sm.checkpointEvery = 10
+	entries := make([]pb.Entry, 0)
+	for index := uint64(235); index <= 247; index++ {
+		entries = append(entries, pb.Entry{
+			ClientID: 123,
+			SeriesID: client.NoOPSeriesID,
+			Index:    index,
+			Term:     1,
+		})
+	}
+	sm.lastApplied.index = 234
+	sm.index = 234
+	sm.taskQ.Add(Task{Entries: entries})
+	batch := make([]Task, 0, 8)
+	if _, err := sm.Handle(batch, nil); err != nil {
+		t.Fatalf("handle failed %v", err)
+	}
+	if sm.GetLastApplied() != 247 {
+		t.Errorf("last applied %d, want 247", sm.GetLastApplied())
+	}
+	if count := store.UpdateCount; count != 6 {
+		t.Errorf("batch not split at checkpoint, first batch size %d", count)
+	}
+	if cp := sm.GetCheckpoint(); cp.Index != 240 {
+		t.Errorf("unexpected checkpoint %+v", cp)
+	}
+	reportLeakedFD(fs, t)
+}
+
 func TestMetadataEntryCanBeHandled(t *testing.T) {
 	fs := vfs.GetTestFS()
 	defer leaktest.AfterTest(t)()
@@ -1567,7 +1616,7 @@ func TestSessionCanBeCreatedAndRemoved(t *testing.T) {
 			t.Errorf("session not removed")
 		}
 		if nodeProxy.smResult.Value != clientID {
-			t.Errorf("smResult %d, want %d", nodeProxy.smResult, clientID)
+			t.Errorf("smResult %v, want %d", nodeProxy.smResult, clientID)
 		}
 	}
 	fs := vfs.GetTestFS()
@@ -1610,7 +1659,7 @@ func TestDuplicatedSessionWillBeReported(t *testing.T) {
 				sm.GetLastApplied(), e.Index)
 		}
 		if nodeProxy.smResult.Value != 0 {
-			t.Errorf("smResult %d, want %d", nodeProxy.smResult, 0)
+			t.Errorf("smResult %v, want %d", nodeProxy.smResult, 0)
 		}
 		if !nodeProxy.rejected {
 			t.Errorf("reject flag not set")
@@ -1640,7 +1689,7 @@ func TestRemovingUnregisteredSessionWillBeReported(t *testing.T) {
 			t.Errorf("session not suppose to be there")
 		}
 		if nodeProxy.smResult.Value != 0 {
-			t.Errorf("smResult %d, want %d", nodeProxy.smResult, 0)
+			t.Errorf("smResult %v, want %d", nodeProxy.smResult, 0)
 		}
 		if !nodeProxy.rejected {
 			t.Errorf("reject flag not set")
@@ -1671,7 +1720,7 @@ func TestUpdateFromUnregisteredClientWillBeReported(t *testing.T) {
 			t.Errorf("ignored %t, want false", nodeProxy.ignored)
 		}
 		if nodeProxy.smResult.Value != 0 {
-			t.Errorf("smResult %d, want 0", nodeProxy.smResult)
+			t.Errorf("smResult %v, want 0", nodeProxy.smResult)
 		}
 		if !nodeProxy.rejected {
 			t.Errorf("rejected %t, want true", nodeProxy.rejected)
@@ -1704,7 +1753,7 @@ func TestDuplicatedUpdateWillNotBeAppliedTwice(t *testing.T) {
 			t.Errorf("update not invoked")
 		}
 		if nodeProxy.smResult.Value != uint64(len(data)) {
-			t.Errorf("smResult %d, want %d", nodeProxy.smResult, len(data))
+			t.Errorf("smResult %v, want %d", nodeProxy.smResult, len(data))
 		}
 		nodeProxy.applyUpdateInvoked = false
 		storeCount := store.(*tests.KVTest).Count
@@ -2143,7 +2192,7 @@ func TestStreamSnapshot(t *testing.T) {
 	ts := &testSink{
 		chunks: make([]pb.Chunk, 0),
 	}
-	if err := sm.Stream(ts); err != nil {
+	if err := sm.Stream(ts, 0); err != nil {
 		t.Errorf("stream snapshot failed %v", err)
 	}
 	if len(ts.chunks) != 3 {
@@ -2411,3 +2460,125 @@ func TestSetLastApplied(t *testing.T) {
 		}()
 	}
 }
+
+func TestCheckpointIsRecordedAtExpectedIndex(t *testing.T) {
+	tf := func(t *testing.T, sm *StateMachine) {
+		sm.checkpointEvery = 10
+		if err := sm.mayCheckpoint(9); err != nil {
+			t.Fatalf("mayCheckpoint failed %v", err)
+		}
+		if cp := sm.GetCheckpoint(); cp.Index != 0 {
+			t.Errorf("unexpected checkpoint %+v", cp)
+		}
+		if err := sm.mayCheckpoint(20); err != nil {
+			t.Fatalf("mayCheckpoint failed %v", err)
+		}
+		hash, err := sm.GetHash()
+		if err != nil {
+			t.Fatalf("failed to get hash %v", err)
+		}
+		if cp := sm.GetCheckpoint(); cp.Index != 20 || cp.Hash != hash {
+			t.Errorf("unexpected checkpoint %+v, want hash %d", cp, hash)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runSMTest(t, tf, fs)
+}
+
+func TestEntriesAreNotAppliedOnChecksumMismatch(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	createTestDir(fs)
+	defer removeTestDir(fs)
+	store := &tests.ConcurrentUpdate{}
+	config := config.Config{ClusterID: 1, NodeID: 1}
+	ds := NewNativeSM(config, NewConcurrentStateMachine(store), make(chan struct{}))
+	nodeProxy := newTestNodeProxy()
+	snapshotter := newTestSnapshotter(fs)
+	sm := NewStateMachine(ds, snapshotter, config, nodeProxy, fs)
+	cmd := GetChecksumEncoded(dio.NoCompression, make([]byte, 16))
+	cmd[1] = cmd[1] + 1
+	sm.lastApplied.index = 234
+	sm.index = 234
+	sm.taskQ.Add(Task{Entries: []pb.Entry{
+		{ClientID: 123, SeriesID: client.NoOPSeriesID, Index: 235, Term: 1},
+	}})
+	sm.taskQ.Add(Task{Entries: []pb.Entry{
+		{ClientID: 123, SeriesID: client.NoOPSeriesID, Index: 236, Term: 1,
+			Type: pb.EncodedEntry, Cmd: cmd},
+	}})
+	batch := make([]Task, 0, 8)
+	if _, err := sm.Handle(batch, nil); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("failed to return ErrChecksumMismatch, got %v", err)
+	}
+	if sm.GetLastApplied() != 234 {
+		t.Errorf("last applied %d, want 234", sm.GetLastApplied())
+	}
+	if store.UpdateCount != 0 {
+		t.Errorf("entries applied, update count %d", store.UpdateCount)
+	}
+	reportLeakedFD(fs, t)
+}
+
+type blockingLookupSM struct {
+	tests.NoOP
+	releaseC chan struct{}
+}
+
+func (b *blockingLookupSM) Lookup(query interface{}) (interface{}, error) {
+	<-b.releaseC
+	return query, nil
+}
+
+type contextLookupSM struct {
+	tests.NoOP
+}
+
+type testContextKey struct{}
+
+func (c *contextLookupSM) LookupWithContext(ctx context.Context,
+	query interface{}) (interface{}, error) {
+	return ctx.Value(testContextKey{}), nil
+}
+
+func getContextLookupTestSM(s sm.IStateMachine, fs vfs.IFS) *StateMachine {
+	cfg := config.Config{ClusterID: 1, NodeID: 1}
+	ds := NewNativeSM(cfg, NewInMemStateMachine(s), make(chan struct{}))
+	return NewStateMachine(ds, newTestSnapshotter(fs), cfg, newTestNodeProxy(), fs)
+}
+
+func TestContextLookupIsAbandonedWhenContextIsDone(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	user := &blockingLookupSM{releaseC: make(chan struct{})}
+	s := getContextLookupTestSM(user, fs)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.ContextLookup(ctx, "q"); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := s.ContextLookup(ctx, "q"); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error %v", err)
+	}
+	close(user.releaseC)
+	result, err := s.ContextLookup(context.Background(), "q")
+	if err != nil || result.(string) != "q" {
+		t.Errorf("unexpected result %v, %v", result, err)
+	}
+	s.Close()
+}
+
+func TestContextIsPassedToContextLookupSM(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.GetTestFS()
+	s := getContextLookupTestSM(&contextLookupSM{}, fs)
+	defer s.Close()
+	ctx := context.WithValue(context.Background(), testContextKey{}, "v")
+	result, err := s.ContextLookup(ctx, "q")
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	if result.(string) != "v" {
+		t.Errorf("context not passed to the state machine")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+const (
+	// tokensFlag is the flag stored in the size field of the saved client
+	// sessions to indicate that idempotency tokens are saved after sessions.
+	tokensFlag uint64 = 1 << 63
+)
+
+type idempotencyToken struct {
+	index uint64
+	value []byte
+}
+
+// IdempotencyTokens is the library managed idempotency tokens area of a Raft
+// node, it implements the sm.IIdempotencyTokens interface.
+type IdempotencyTokens struct {
+	mu     sync.RWMutex
+	index  uint64
+	tokens map[string]idempotencyToken
+}
+
+var _ sm.IIdempotencyTokens = (*IdempotencyTokens)(nil)
+
+func newIdempotencyTokens() *IdempotencyTokens {
+	return &IdempotencyTokens{tokens: make(map[string]idempotencyToken)}
+}
+
+// Set records the specified token.
+func (t *IdempotencyTokens) Set(key string, value []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v := make([]byte, len(value))
+	copy(v, value)
+	t.tokens[key] = idempotencyToken{index: t.index, value: v}
+}
+
+// Get returns the value of the specified token.
+func (t *IdempotencyTokens) Get(key string) ([]byte, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	v, ok := t.tokens[key]
+	return v.value, ok
+}
+
+// Delete removes the specified token.
+func (t *IdempotencyTokens) Delete(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tokens, key)
+}
+
+// RemoveBefore removes all tokens recorded before the specified index.
+func (t *IdempotencyTokens) RemoveBefore(index uint64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count := 0
+	for k, v := range t.tokens {
+		if v.index < index {
+			delete(t.tokens, k)
+			count++
+		}
+	}
+	return count
+}
+
+// Len returns the number of recorded tokens.
+func (t *IdempotencyTokens) Len() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.tokens)
+}
+
+func (t *IdempotencyTokens) setIndex(index uint64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.index = index
+}
+
+func (t *IdempotencyTokens) save(w io.Writer) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	keys := make([]string, 0, len(t.tokens))
+	for k := range t.tokens {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := make([]byte, 8)
+	write := func(v uint64, data []byte) error {
+		binary.LittleEndian.PutUint64(buf, v)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		_, err := w.Write(data)
+		return err
+	}
+	if err := write(uint64(len(keys)), nil); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		v := t.tokens[k]
+		if err := write(uint64(len(k)), []byte(k)); err != nil {
+			return err
+		}
+		if err := write(v.index, nil); err != nil {
+			return err
+		}
+		if err := write(uint64(len(v.value)), v.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *IdempotencyTokens) load(r io.Reader) error {
+	buf := make([]byte, 8)
+	readUint64 := func() (uint64, error) {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(buf), nil
+	}
+	readBytes := func() ([]byte, error) {
+		sz, err := readUint64()
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, sz)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	count, err := readUint64()
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]idempotencyToken)
+	for i := uint64(0); i < count; i++ {
+		key, err := readBytes()
+		if err != nil {
+			return err
+		}
+		index, err := readUint64()
+		if err != nil {
+			return err
+		}
+		value, err := readBytes()
+		if err != nil {
+			return err
+		}
+		tokens[string(key)] = idempotencyToken{index: index, value: value}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens = tokens
+	return nil
+}
+
+func (t *IdempotencyTokens) reset() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens = make(map[string]idempotencyToken)
+}
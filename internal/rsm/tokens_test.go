@@ -0,0 +1,146 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lni/dragonboat/v3/client"
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/tests"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+type tokenTestSM struct {
+	tests.NoOP
+	tokens sm.IIdempotencyTokens
+}
+
+func (s *tokenTestSM) SetIdempotencyTokens(tokens sm.IIdempotencyTokens) {
+	s.tokens = tokens
+}
+
+func (s *tokenTestSM) Update(data []byte) (sm.Result, error) {
+	if _, ok := s.tokens.Get(string(data)); ok {
+		return sm.Result{Value: 0}, nil
+	}
+	s.tokens.Set(string(data), []byte("done"))
+	return sm.Result{Value: 1}, nil
+}
+
+func TestIdempotencyTokens(t *testing.T) {
+	tokens := newIdempotencyTokens()
+	tokens.setIndex(10)
+	tokens.Set("t1", []byte("v1"))
+	tokens.setIndex(20)
+	tokens.Set("t2", []byte("v2"))
+	tokens.Set("t3", nil)
+	if tokens.Len() != 3 {
+		t.Errorf("unexpected len %d", tokens.Len())
+	}
+	if v, ok := tokens.Get("t1"); !ok || string(v) != "v1" {
+		t.Errorf("unexpected value %s, %t", v, ok)
+	}
+	tokens.Delete("t3")
+	if _, ok := tokens.Get("t3"); ok {
+		t.Errorf("token not deleted")
+	}
+	if n := tokens.RemoveBefore(20); n != 1 {
+		t.Errorf("removed %d tokens", n)
+	}
+	if _, ok := tokens.Get("t1"); ok {
+		t.Errorf("token not removed")
+	}
+	if _, ok := tokens.Get("t2"); !ok {
+		t.Errorf("token unexpectedly removed")
+	}
+}
+
+func TestSessionManagerCanSaveAndLoadIdempotencyTokens(t *testing.T) {
+	s1 := NewSessionManager()
+	s1.RegisterClientID(123)
+	noTokens := &bytes.Buffer{}
+	if err := s1.SaveSessions(noTokens); err != nil {
+		t.Fatalf("failed to save sessions %v", err)
+	}
+	expected := &bytes.Buffer{}
+	if err := s1.lru.save(expected); err != nil {
+		t.Fatalf("failed to save sessions %v", err)
+	}
+	if !bytes.Equal(noTokens.Bytes(), expected.Bytes()) {
+		t.Errorf("saved sessions changed when there is no token")
+	}
+	s1.GetIdempotencyTokens().setIndex(5)
+	s1.GetIdempotencyTokens().Set("t1", []byte("v1"))
+	buf := &bytes.Buffer{}
+	if err := s1.SaveSessions(buf); err != nil {
+		t.Fatalf("failed to save sessions %v", err)
+	}
+	s2 := NewSessionManager()
+	if err := s2.LoadSessions(bytes.NewReader(buf.Bytes()), V2); err != nil {
+		t.Fatalf("failed to load sessions %v", err)
+	}
+	if _, ok := s2.ClientRegistered(123); !ok {
+		t.Errorf("session not loaded")
+	}
+	if v, ok := s2.GetIdempotencyTokens().Get("t1"); !ok || string(v) != "v1" {
+		t.Errorf("token not loaded, %s, %t", v, ok)
+	}
+	if s2.GetIdempotencyTokens().RemoveBefore(5) != 0 ||
+		s2.GetIdempotencyTokens().RemoveBefore(6) != 1 {
+		t.Errorf("token index not loaded")
+	}
+	if s1.GetSessionHash() == s2.GetSessionHash() {
+		t.Errorf("tokens not included in the hash")
+	}
+	if err := s1.LoadSessions(bytes.NewReader(noTokens.Bytes()), V2); err != nil {
+		t.Fatalf("failed to load sessions %v", err)
+	}
+	if s1.GetIdempotencyTokens().Len() != 0 {
+		t.Errorf("tokens not reset")
+	}
+	if s1.GetSessionHash() != s2.GetSessionHash() {
+		t.Errorf("unexpected hash")
+	}
+}
+
+func TestIdempotencyTokensArePassedToStateMachine(t *testing.T) {
+	fs := vfs.GetTestFS()
+	cfg := config.Config{ClusterID: 1, NodeID: 1}
+	ds := NewNativeSM(cfg, NewInMemStateMachine(&tokenTestSM{}), make(chan struct{}))
+	s := NewStateMachine(ds, nil, cfg, newTestNodeProxy(), fs)
+	ents := []pb.Entry{
+		{ClientID: 1, SeriesID: client.NoOPSeriesID, Cmd: []byte("t1"), Index: 1, Term: 1},
+		{ClientID: 1, SeriesID: client.NoOPSeriesID, Cmd: []byte("t2"), Index: 2, Term: 1},
+		{ClientID: 1, SeriesID: client.NoOPSeriesID, Cmd: []byte("t1"), Index: 3, Term: 1},
+	}
+	s.taskQ.Add(Task{Entries: ents})
+	if _, err := s.Handle(make([]Task, 0, 8), nil); err != nil {
+		t.Fatalf("handle failed %v", err)
+	}
+	tokens := s.sessions.GetIdempotencyTokens()
+	if tokens.Len() != 2 {
+		t.Fatalf("unexpected token count %d", tokens.Len())
+	}
+	if n := tokens.RemoveBefore(2); n != 1 {
+		t.Errorf("unexpected removed count %d", n)
+	}
+	if _, ok := tokens.Get("t2"); !ok {
+		t.Errorf("token t2 not found")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lni/dragonboat/v3/internal/settings"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+var (
+	// ErrSnapshotTruncated indicates that the snapshot file is shorter than
+	// expected.
+	ErrSnapshotTruncated = errors.New("snapshot file truncated")
+	// ErrSnapshotHeaderCorrupted indicates that the snapshot header doesn't
+	// match its checksum or can not be decoded.
+	ErrSnapshotHeaderCorrupted = errors.New("snapshot header corrupted")
+	// ErrSnapshotChunkCorrupted indicates that a block of the snapshot payload
+	// doesn't match its checksum.
+	ErrSnapshotChunkCorrupted = errors.New("snapshot chunk corrupted")
+	// ErrSnapshotPayloadCorrupted indicates that the snapshot payload doesn't
+	// match the checksum recorded in the header or the snapshot record.
+	ErrSnapshotPayloadCorrupted = errors.New("snapshot payload corrupted")
+	// ErrSnapshotFileMissing indicates that an external file of the snapshot
+	// is missing or its size doesn't match the snapshot record.
+	ErrSnapshotFileMissing = errors.New("snapshot external file missing")
+)
+
+// VerifySnapshot re-reads the snapshot image described by the specified
+// snapshot record and validates its header, chunk and payload checksums, the
+// payload checksum recorded in the snapshot record and the presence of all
+// external files. nil is returned when the snapshot is valid, the returned
+// error wraps one of the ErrSnapshot* errors defined in this package otherwise.
+func VerifySnapshot(ss pb.Snapshot, fs vfs.IFS) error {
+	if ss.Witness || len(ss.Filepath) == 0 {
+		return nil
+	}
+	header, err := verifySnapshotFile(ss.Filepath, fs)
+	if err != nil {
+		return err
+	}
+	if len(ss.Checksum) > 0 && header.Version == uint64(V2) {
+		checksum, err := getV2PayloadChecksum(ss.Filepath, header.ChecksumType, fs)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(checksum, ss.Checksum) {
+			return fmt.Errorf("%w, checksum doesn't match the snapshot record",
+				ErrSnapshotPayloadCorrupted)
+		}
+	}
+	for _, f := range ss.Files {
+		fi, err := fs.Stat(f.Filepath)
+		if err != nil {
+			return fmt.Errorf("%w, file %s, %v",
+				ErrSnapshotFileMissing, f.Filepath, err)
+		}
+		if uint64(fi.Size()) != f.FileSize {
+			return fmt.Errorf("%w, file %s size %d, expected %d",
+				ErrSnapshotFileMissing, f.Filepath, fi.Size(), f.FileSize)
+		}
+	}
+	return nil
+}
+
+// VerifySnapshotFile re-reads the specified snapshot file and validates its
+// header, chunk and payload checksums. nil is returned when the snapshot file
+// is valid, the returned error wraps one of the ErrSnapshot* errors defined in
+// this package when a problem is detected. Shrunk snapshot files are
+// considered as valid when their headers are valid.
+func VerifySnapshotFile(fp string, fs vfs.IFS) error {
+	_, err := verifySnapshotFile(fp, fs)
+	return err
+}
+
+func verifySnapshotFile(fp string,
+	fs vfs.IFS) (header pb.SnapshotHeader, err error) {
+	fi, err := fs.Stat(fp)
+	if err != nil {
+		return header, err
+	}
+	if fi.Size() < int64(HeaderSize) {
+		return header, fmt.Errorf("%w, size %d", ErrSnapshotTruncated, fi.Size())
+	}
+	f, err := fs.Open(fp)
+	if err != nil {
+		return header, err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	var v IVValidator
+	buf := make([]byte, settings.SnapshotChunkSize)
+	offset := uint64(0)
+	for chunkID := uint64(0); ; chunkID++ {
+		n, rerr := io.ReadFull(f, buf)
+		if n > 0 {
+			if chunkID == 0 {
+				if header, v, err = getVerifiedValidator(buf[:n]); err != nil {
+					return header, err
+				}
+			}
+			if !v.AddChunk(buf[:n], chunkID) {
+				return header, fmt.Errorf("%w, chunk %d at offset %d",
+					ErrSnapshotChunkCorrupted, chunkID, offset)
+			}
+			offset += uint64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return header, rerr
+		}
+	}
+	if v.Validate() {
+		return header, nil
+	}
+	shrunk, err := IsShrunkSnapshotFile(fp, fs)
+	if err != nil {
+		return header, err
+	}
+	if shrunk {
+		return header, nil
+	}
+	return header, fmt.Errorf("%w, checksum doesn't match the snapshot header",
+		ErrSnapshotPayloadCorrupted)
+}
+
+func getVerifiedValidator(data []byte) (pb.SnapshotHeader, IVValidator, error) {
+	var hr pb.SnapshotHeader
+	header, crc, ok := getHeaderFromFirstChunk(data)
+	if !ok {
+		return hr, nil, fmt.Errorf("%w, invalid header size",
+			ErrSnapshotHeaderCorrupted)
+	}
+	if !validateHeader(header, crc) {
+		return hr, nil, fmt.Errorf("%w, checksum mismatch",
+			ErrSnapshotHeaderCorrupted)
+	}
+	if err := hr.Unmarshal(header); err != nil {
+		return hr, nil, fmt.Errorf("%w, %v", ErrSnapshotHeaderCorrupted, err)
+	}
+	v, ok := getVersionedValidator(hr)
+	if !ok {
+		return hr, nil, fmt.Errorf("%w, unknown version %d",
+			ErrSnapshotHeaderCorrupted, hr.Version)
+	}
+	return hr, v, nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+func writeVerifyTestSnapshot(t *testing.T, fp string, fs vfs.IFS) []byte {
+	writer, err := NewSnapshotWriter(fp, pb.NoCompression, fs)
+	if err != nil {
+		t.Fatalf("failed to get writer %v", err)
+	}
+	sz := make([]byte, 8)
+	if _, err := writer.Write(sz); err != nil {
+		t.Fatalf("failed to write session size %v", err)
+	}
+	data := make([]byte, 5*1024*1024)
+	rand.Read(data)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("close failed %v", err)
+	}
+	return writer.GetPayloadChecksum()
+}
+
+func updateVerifyTestSnapshot(t *testing.T,
+	fp string, fs vfs.IFS, update func([]byte) []byte) {
+	f, err := fs.Open(fp)
+	if err != nil {
+		t.Fatalf("failed to open the file %v", err)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close %v", err)
+	}
+	content = update(content)
+	f, err = fs.Create(fp)
+	if err != nil {
+		t.Fatalf("failed to create the file %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+}
+
+func TestVerifySnapshotFileReportsDetailedErrors(t *testing.T) {
+	tests := []struct {
+		update func([]byte) []byte
+		err    error
+	}{
+		{func(d []byte) []byte { return d }, nil},
+		{func(d []byte) []byte { d[10] ^= 0xFF; return d }, ErrSnapshotHeaderCorrupted},
+		{func(d []byte) []byte { d[HeaderSize+100] ^= 0xFF; return d }, ErrSnapshotChunkCorrupted},
+		{func(d []byte) []byte { return d[:len(d)-1024] }, ErrSnapshotPayloadCorrupted},
+		{func(d []byte) []byte { return d[:HeaderSize-1] }, ErrSnapshotTruncated},
+	}
+	fs := vfs.GetTestFS()
+	fp := "test_snapshot_safe_to_delete.data"
+	defer func() {
+		if err := fs.RemoveAll(fp); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	for idx, tt := range tests {
+		writeVerifyTestSnapshot(t, fp, fs)
+		updateVerifyTestSnapshot(t, fp, fs, tt.update)
+		err := VerifySnapshotFile(fp, fs)
+		if tt.err == nil && err != nil {
+			t.Errorf("%d, unexpected error %v", idx, err)
+		}
+		if tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("%d, got %v, want %v", idx, err, tt.err)
+		}
+	}
+	reportLeakedFD(fs, t)
+}
+
+func TestVerifySnapshotChecksRecordAndExternalFiles(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fp := "test_snapshot_safe_to_delete.data"
+	efp := "test_snapshot_safe_to_delete.external"
+	defer func() {
+		if err := fs.RemoveAll(fp); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := fs.RemoveAll(efp); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	checksum := writeVerifyTestSnapshot(t, fp, fs)
+	f, err := fs.Create(efp)
+	if err != nil {
+		t.Fatalf("failed to create external file %v", err)
+	}
+	if _, err := f.Write(make([]byte, 16)); err != nil {
+		t.Fatalf("failed to write %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close %v", err)
+	}
+	ss := pb.Snapshot{
+		Filepath: fp,
+		Checksum: checksum,
+		Files:    []*pb.SnapshotFile{{Filepath: efp, FileSize: 16}},
+	}
+	if err := VerifySnapshot(ss, fs); err != nil {
+		t.Fatalf("valid snapshot not accepted, %v", err)
+	}
+	ss.Files[0].FileSize = 32
+	if err := VerifySnapshot(ss, fs); !errors.Is(err, ErrSnapshotFileMissing) {
+		t.Errorf("external file size mismatch not reported, %v", err)
+	}
+	ss.Files[0].FileSize = 16
+	ss.Checksum = []byte{1, 2, 3, 4}
+	if err := VerifySnapshot(ss, fs); !errors.Is(err, ErrSnapshotPayloadCorrupted) {
+		t.Errorf("record checksum mismatch not reported, %v", err)
+	}
+	if err := VerifySnapshot(pb.Snapshot{Witness: true}, fs); err != nil {
+		t.Errorf("witness snapshot not accepted, %v", err)
+	}
+}
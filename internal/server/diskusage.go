@@ -0,0 +1,112 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"regexp"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+// GetLogDBDirUsage returns the disk space used by the LogDB and the WAL
+// directories of the specified deployment. Snapshot directories stored under
+// the LogDB directory are excluded. The returned WAL usage is empty when there
+// is no dedicated WAL directory.
+func (env *Env) GetLogDBDirUsage(did uint64) (raftio.DirUsage,
+	raftio.DirUsage, error) {
+	dir, walDir := env.GetLogDBDirs(did)
+	size, err := env.getDirSize(dir, snapshotPartDirNameRe)
+	if err != nil {
+		return raftio.DirUsage{}, raftio.DirUsage{}, err
+	}
+	logdb := raftio.DirUsage{Path: dir, Bytes: size}
+	if walDir == dir {
+		return logdb, raftio.DirUsage{}, nil
+	}
+	size, err = env.getDirSize(walDir, nil)
+	if err != nil {
+		return raftio.DirUsage{}, raftio.DirUsage{}, err
+	}
+	return logdb, raftio.DirUsage{Path: walDir, Bytes: size}, nil
+}
+
+// GetSnapshotDirUsage returns the disk space used by saved snapshots and by
+// snapshots being generated or received found in the specified node snapshot
+// directory.
+func (env *Env) GetSnapshotDirUsage(dir string) (uint64, uint64, error) {
+	files, err := env.fs.List(dir)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	saved := uint64(0)
+	temp := uint64(0)
+	for _, fn := range files {
+		size, err := env.getSize(env.fs.PathJoin(dir, fn))
+		if err != nil {
+			return 0, 0, err
+		}
+		if GenSnapshotDirNameRe.MatchString(fn) ||
+			RecvSnapshotDirNameRe.MatchString(fn) {
+			temp += size
+		} else {
+			saved += size
+		}
+	}
+	return saved, temp, nil
+}
+
+// getDirSize returns the total size of all files found in the specified
+// directory and its sub-directories, entries of the directory with names
+// matching the optional skip regexp are ignored.
+func (env *Env) getDirSize(dir string, skip *regexp.Regexp) (uint64, error) {
+	files, err := env.fs.List(dir)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	total := uint64(0)
+	for _, fn := range files {
+		if skip != nil && skip.MatchString(fn) {
+			continue
+		}
+		size, err := env.getSize(env.fs.PathJoin(dir, fn))
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+func (env *Env) getSize(fp string) (uint64, error) {
+	fi, err := env.fs.Stat(fp)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			// removed in the meantime
+			return 0, nil
+		}
+		return 0, err
+	}
+	if fi.IsDir() {
+		return env.getDirSize(fp, nil)
+	}
+	return uint64(fi.Size()), nil
+}
@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/lni/goutils/random"
@@ -138,6 +140,91 @@ func (env *Env) getSnapshotDirParts(did uint64,
 		env.fs.PathJoin(dir, env.hostname, dd), append(toBeCreated, pd, sd)
 }
 
+var (
+	snapshotPartDirNameRe = regexp.MustCompile(`^snapshot-part-[0-9]+$`)
+	nodeSnapshotDirNameRe = regexp.MustCompile(`^snapshot-([0-9]+)-([0-9]+)$`)
+)
+
+// SnapshotDirInfo is the info of a node snapshot directory found on disk.
+type SnapshotDirInfo struct {
+	ClusterID uint64
+	NodeID    uint64
+	// Path is the path of the node snapshot directory.
+	Path string
+	// Removed indicates whether the directory has been marked as removed.
+	Removed bool
+	// Empty indicates whether the directory contains no sub-directory, i.e. no
+	// saved, temporary or received snapshot.
+	Empty bool
+}
+
+// ListSnapshotDirs returns the info of all node snapshot directories of the
+// specified deployment found on disk.
+func (env *Env) ListSnapshotDirs(did uint64) ([]SnapshotDirInfo, error) {
+	dir := env.fs.PathJoin(env.nhConfig.NodeHostDir,
+		env.hostname, env.getDeploymentIDSubDirName(did))
+	result := make([]SnapshotDirInfo, 0)
+	parts, err := env.listSubDirs(dir, snapshotPartDirNameRe)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	for _, pd := range parts {
+		nodeDirs, err := env.listSubDirs(pd, nodeSnapshotDirNameRe)
+		if err != nil {
+			return nil, err
+		}
+		for _, nd := range nodeDirs {
+			m := nodeSnapshotDirNameRe.FindStringSubmatch(env.fs.PathBase(nd))
+			clusterID, err := strconv.ParseUint(m[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			nodeID, err := strconv.ParseUint(m[2], 10, 64)
+			if err != nil {
+				continue
+			}
+			removed, err := fileutil.IsDirMarkedAsDeleted(nd, env.fs)
+			if err != nil {
+				return nil, err
+			}
+			subDirs, err := env.listSubDirs(nd, nil)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, SnapshotDirInfo{
+				ClusterID: clusterID,
+				NodeID:    nodeID,
+				Path:      nd,
+				Removed:   removed,
+				Empty:     len(subDirs) == 0,
+			})
+		}
+	}
+	return result, nil
+}
+
+func (env *Env) listSubDirs(dir string, re *regexp.Regexp) ([]string, error) {
+	files, err := env.fs.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0)
+	for _, fn := range files {
+		fp := env.fs.PathJoin(dir, fn)
+		fi, err := env.fs.Stat(fp)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() && (re == nil || re.MatchString(fi.Name())) {
+			result = append(result, fp)
+		}
+	}
+	return result, nil
+}
+
 // GetLogDBDirs returns the directory names for LogDB
 func (env *Env) GetLogDBDirs(did uint64) (string, string) {
 	dir, lldir := env.getDataDirs()
@@ -259,7 +346,8 @@ func (env *Env) LockNodeHostDir() error {
 }
 
 // RemoveSnapshotDir marks the node snapshot directory as removed and have all
-// existing snapshots deleted.
+// existing snapshots, including temporary and partially received ones,
+// deleted.
 func (env *Env) RemoveSnapshotDir(did uint64,
 	clusterID uint64, nodeID uint64) error {
 	dir := env.GetSnapshotDir(did, clusterID, nodeID)
@@ -298,7 +386,9 @@ func removeSavedSnapshots(dir string, fs vfs.IFS) error {
 		if !fi.IsDir() {
 			continue
 		}
-		if SnapshotDirNameRe.Match([]byte(fi.Name())) {
+		if SnapshotDirNameRe.Match([]byte(fi.Name())) ||
+			GenSnapshotDirNameRe.Match([]byte(fi.Name())) ||
+			RecvSnapshotDirNameRe.Match([]byte(fi.Name())) {
 			ssdir := fs.PathJoin(dir, fi.Name())
 			if err := fs.RemoveAll(ssdir); err != nil {
 				return err
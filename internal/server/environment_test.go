@@ -16,6 +16,8 @@ package server
 
 import (
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 
@@ -304,6 +306,67 @@ func TestRemoveSavedSnapshots(t *testing.T) {
 	reportLeakedFD(fs, t)
 }
 
+func TestListSnapshotDirs(t *testing.T) {
+	fs := vfs.GetTestFS()
+	c := getTestNodeHostConfig()
+	c.Expert.FS = fs
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	env, err := NewEnv(c, fs)
+	if err != nil {
+		t.Fatalf("failed to new environment %v", err)
+	}
+	defer env.Stop()
+	dirs, err := env.ListSnapshotDirs(testDeploymentID)
+	if err != nil || len(dirs) != 0 {
+		t.Fatalf("unexpected result %v, %v", dirs, err)
+	}
+	if _, _, err := env.CreateNodeHostDir(testDeploymentID); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, nodeID := range []uint64{1, 2} {
+		if err := env.CreateSnapshotDir(testDeploymentID, 100, nodeID); err != nil {
+			t.Fatalf("failed to create snapshot dir %v", err)
+		}
+	}
+	ssdir := fs.PathJoin(env.GetSnapshotDir(testDeploymentID, 100, 1),
+		"snapshot-0000000000000064")
+	if err := fs.MkdirAll(ssdir, 0755); err != nil {
+		t.Fatalf("failed to mkdir %v", err)
+	}
+	if err := env.RemoveSnapshotDir(testDeploymentID, 100, 2); err != nil {
+		t.Fatalf("failed to remove snapshot dir %v", err)
+	}
+	dirs, err = env.ListSnapshotDirs(testDeploymentID)
+	if err != nil {
+		t.Fatalf("failed to list snapshot dirs %v", err)
+	}
+	if len(dirs) != 2 {
+		t.Fatalf("unexpected dirs %v", dirs)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].NodeID < dirs[j].NodeID })
+	expected := []SnapshotDirInfo{
+		{
+			ClusterID: 100,
+			NodeID:    1,
+			Path:      env.GetSnapshotDir(testDeploymentID, 100, 1),
+		},
+		{
+			ClusterID: 100,
+			NodeID:    2,
+			Path:      env.GetSnapshotDir(testDeploymentID, 100, 2),
+			Removed:   true,
+			Empty:     true,
+		},
+	}
+	if !reflect.DeepEqual(dirs, expected) {
+		t.Errorf("got %v, want %v", dirs, expected)
+	}
+}
+
 func TestWALDirCanBeSet(t *testing.T) {
 	walDir := "d2-wal-dir-name"
 	nhConfig := config.NodeHostConfig{
@@ -353,3 +416,61 @@ func TestCompatibleLogDBType(t *testing.T) {
 		}
 	}
 }
+
+func TestSnapshotDirUsage(t *testing.T) {
+	fs := vfs.GetTestFS()
+	c := getTestNodeHostConfig()
+	c.Expert.FS = fs
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	env, err := NewEnv(c, fs)
+	if err != nil {
+		t.Fatalf("failed to new environment %v", err)
+	}
+	defer env.Stop()
+	if _, _, err := env.CreateNodeHostDir(testDeploymentID); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := env.CreateSnapshotDir(testDeploymentID, 100, 1); err != nil {
+		t.Fatalf("failed to create snapshot dir %v", err)
+	}
+	dir := env.GetSnapshotDir(testDeploymentID, 100, 1)
+	write := func(sub string, sz int) {
+		sd := fs.PathJoin(dir, sub)
+		if err := fs.MkdirAll(sd, 0755); err != nil {
+			t.Fatalf("failed to mkdir %v", err)
+		}
+		f, err := fs.Create(fs.PathJoin(sd, "data"))
+		if err != nil {
+			t.Fatalf("failed to create file %v", err)
+		}
+		defer f.Close()
+		if _, err := f.Write(make([]byte, sz)); err != nil {
+			t.Fatalf("failed to write %v", err)
+		}
+	}
+	write("snapshot-0000000000000064", 100)
+	write("snapshot-00000000000000C8-1.generating", 30)
+	write("snapshot-00000000000000C8-2.receiving", 20)
+	saved, temp, err := env.GetSnapshotDirUsage(dir)
+	if err != nil {
+		t.Fatalf("failed to get snapshot dir usage %v", err)
+	}
+	if saved != 100 || temp != 50 {
+		t.Errorf("saved %d, temp %d, want 100, 50", saved, temp)
+	}
+	logdb, wal, err := env.GetLogDBDirUsage(testDeploymentID)
+	if err != nil {
+		t.Fatalf("failed to get logdb dir usage %v", err)
+	}
+	if logdb.Bytes >= 150 {
+		t.Errorf("snapshot dirs included in logdb usage, %d", logdb.Bytes)
+	}
+	if wal.Bytes != 0 || len(wal.Path) != 0 {
+		t.Errorf("unexpected wal usage %+v", wal)
+	}
+	reportLeakedFD(fs, t)
+}
@@ -116,6 +116,14 @@ const (
 	LogCompacted
 	// LogDBCompacted ...
 	LogDBCompacted
+	// NodePanicked ...
+	NodePanicked
+	// AddressChanged ...
+	AddressChanged
+	// PeerHealthChanged ...
+	PeerHealthChanged
+	// ChecksumMismatch ...
+	ChecksumMismatch
 )
 
 // SystemEvent is an system event record published by the system that can be
@@ -128,4 +136,9 @@ type SystemEvent struct {
 	From               uint64
 	Index              uint64
 	SnapshotConnection bool
+	Reason             string
+	Restart            bool
+	PreviousIPs        []string
+	CurrentIPs         []string
+	Reachable          bool
 }
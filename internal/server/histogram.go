@@ -0,0 +1,61 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var batchSizeBounds = []uint64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+// BatchSizeHistogram records the distribution of batch sizes as a Prometheus
+// histogram with power of two bucket boundaries. It is built from plain
+// counters so no background goroutine is required.
+type BatchSizeHistogram struct {
+	buckets []*metrics.Counter
+	sum     *metrics.Counter
+	count   *metrics.Counter
+}
+
+// NewBatchSizeHistogram returns a BatchSizeHistogram registered using the
+// specified metric name.
+func NewBatchSizeHistogram(name string) *BatchSizeHistogram {
+	h := &BatchSizeHistogram{
+		buckets: make([]*metrics.Counter, 0, len(batchSizeBounds)+1),
+		sum:     metrics.GetOrCreateCounter(name + "_sum"),
+		count:   metrics.GetOrCreateCounter(name + "_count"),
+	}
+	for _, b := range batchSizeBounds {
+		bn := fmt.Sprintf(`%s_bucket{le="%d"}`, name, b)
+		h.buckets = append(h.buckets, metrics.GetOrCreateCounter(bn))
+	}
+	bn := fmt.Sprintf(`%s_bucket{le="+Inf"}`, name)
+	h.buckets = append(h.buckets, metrics.GetOrCreateCounter(bn))
+	return h
+}
+
+// Observe records a batch of the specified size.
+func (h *BatchSizeHistogram) Observe(sz uint64) {
+	for i, b := range batchSizeBounds {
+		if sz <= b {
+			h.buckets[i].Inc()
+		}
+	}
+	h.buckets[len(batchSizeBounds)].Inc()
+	h.sum.Add(int(sz))
+	h.count.Inc()
+}
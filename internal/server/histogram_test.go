@@ -0,0 +1,35 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestBatchSizeHistogramBuckets(t *testing.T) {
+	h := NewBatchSizeHistogram("test_batch_size_histogram")
+	h.Observe(1)
+	h.Observe(3)
+	h.Observe(2000)
+	expected := []uint64{1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3}
+	for i, c := range h.buckets {
+		if c.Get() != expected[i] {
+			t.Errorf("bucket %d, got %d, want %d", i, c.Get(), expected[i])
+		}
+	}
+	if h.sum.Get() != 2004 || h.count.Get() != 3 {
+		t.Errorf("unexpected sum %d or count %d", h.sum.Get(), h.count.Get())
+	}
+}
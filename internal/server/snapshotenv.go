@@ -15,6 +15,7 @@
 package server
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
@@ -23,6 +24,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/lni/dragonboat/v3/internal/fileutil"
 	"github.com/lni/dragonboat/v3/internal/vfs"
@@ -33,6 +35,9 @@ var (
 	ErrSnapshotOutOfDate = errors.New("snapshot out of date")
 	// MetadataFilename is the filename of a snapshot's metadata file.
 	MetadataFilename = "snapshot.metadata"
+	// CreatedTimeFilename is the filename of the file recording the time when
+	// the snapshot was finalized.
+	CreatedTimeFilename = "snapshot.created"
 	// SnapshotFileSuffix is the filename suffix of a snapshot file.
 	SnapshotFileSuffix = "gbsnap"
 	// SnapshotDirNameRe is the regex of snapshot names.
@@ -182,13 +187,19 @@ func (se *SSEnv) MustRemoveTempDir() {
 	}
 }
 
-// FinalizeSnapshot finalizes the snapshot.
+// FinalizeSnapshot finalizes the snapshot. The time of the finalization is
+// recorded as the creation time of the snapshot.
 func (se *SSEnv) FinalizeSnapshot(msg fileutil.Marshaler) error {
 	finalizeLock.Lock()
 	defer finalizeLock.Unlock()
 	if err := se.createFlagFile(msg); err != nil {
 		return err
 	}
+	ct := createdTime(time.Now().UnixNano())
+	if err := fileutil.CreateFlagFile(se.tmpDir,
+		CreatedTimeFilename, &ct, se.fs); err != nil {
+		return err
+	}
 	if se.finalDirExists() {
 		return ErrSnapshotOutOfDate
 	}
@@ -210,6 +221,18 @@ func (se *SSEnv) SaveSSMetadata(msg fileutil.Marshaler) error {
 	return fileutil.CreateFlagFile(se.tmpDir, MetadataFilename, msg, se.fs)
 }
 
+// GetCreatedTime returns the creation time of the finalized snapshot. An
+// error satisfying vfs.IsNotExist is returned when the creation time is not
+// recorded.
+func (se *SSEnv) GetCreatedTime() (time.Time, error) {
+	var ct createdTime
+	if err := fileutil.GetFlagFileContent(se.finalDir,
+		CreatedTimeFilename, &ct, se.fs); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(ct)), nil
+}
+
 // HasFlagFile returns a boolean flag indicating whether the flag file is
 // available in the final directory.
 func (se *SSEnv) HasFlagFile() bool {
@@ -277,3 +300,19 @@ func (se *SSEnv) createFlagFile(msg fileutil.Marshaler) error {
 	return fileutil.CreateFlagFile(se.tmpDir,
 		fileutil.SnapshotFlagFilename, msg, se.fs)
 }
+
+type createdTime int64
+
+func (c *createdTime) Marshal() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(*c))
+	return data, nil
+}
+
+func (c *createdTime) Unmarshal(data []byte) error {
+	if len(data) != 8 {
+		return errors.New("invalid snapshot created time")
+	}
+	*c = createdTime(binary.BigEndian.Uint64(data))
+	return nil
+}
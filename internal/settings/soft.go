@@ -114,9 +114,6 @@ type soft struct {
 
 	// TaskBatchSize defines the length of the committed batch slice.
 	TaskBatchSize uint64
-	// NodeReloadMillisecond defines how often step engine should reload
-	// nodes, it is defined in number of millisecond.
-	NodeReloadMillisecond uint64
 	// CloseWorkerTimedWaitSecond is the number of seconds allowed for the
 	// close worker to run cleanups before exit.
 	CloseWorkerTimedWaitSecond uint64
@@ -193,7 +190,6 @@ func getDefaultSoftSettings() soft {
 		TaskQueueTargetLength:          64,
 		NodeHostRequestStatePoolShards: 8,
 		TaskBatchSize:                  512,
-		NodeReloadMillisecond:          200,
 		CloseWorkerTimedWaitSecond:     5,
 		SendQueueLength:                1024 * 2,
 		ReceiveQueueLength:             1024,
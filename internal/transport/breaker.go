@@ -0,0 +1,110 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lni/goutils/netutil/cenk/backoff"
+	"github.com/lni/goutils/netutil/facebookgo/clock"
+	circuit "github.com/lni/goutils/netutil/rubyist/circuitbreaker"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+const (
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = time.Second
+	defaultMultiplier     = 1.5
+	defaultJitter         = 0.5
+)
+
+// newBreaker returns a circuit breaker that trips on the first failure and
+// allows retries using the exponential backoff specified by cfg.
+func newBreaker(cfg config.PeerBackoffConfig) *circuit.Breaker {
+	c := clock.New()
+	return circuit.NewBreakerWithOptions(&circuit.Options{
+		BackOff:    newBackoff(cfg, c),
+		Clock:      c,
+		ShouldTrip: circuit.ThresholdTripFunc(1),
+	})
+}
+
+func newBackoff(cfg config.PeerBackoffConfig,
+	c backoff.Clock) *backoff.ExponentialBackOff {
+	b := &backoff.ExponentialBackOff{
+		InitialInterval:     cfg.InitialInterval,
+		RandomizationFactor: cfg.Jitter,
+		Multiplier:          cfg.Multiplier,
+		MaxInterval:         cfg.MaxInterval,
+		MaxElapsedTime:      0,
+		Clock:               c,
+	}
+	if b.InitialInterval == 0 {
+		b.InitialInterval = defaultInitialBackoff
+	}
+	if b.MaxInterval == 0 {
+		b.MaxInterval = defaultMaxBackoff
+	}
+	if b.InitialInterval > b.MaxInterval {
+		b.InitialInterval = b.MaxInterval
+	}
+	if b.Multiplier == 0 {
+		b.Multiplier = defaultMultiplier
+	}
+	if b.RandomizationFactor == 0 {
+		b.RandomizationFactor = defaultJitter
+	} else if b.RandomizationFactor < 0 {
+		b.RandomizationFactor = 0
+	}
+	b.Reset()
+	return b
+}
+
+// peerHealth tracks remote NodeHosts that are considered as unreachable, it
+// is used for reporting reachable/unreachable transitions only once.
+type peerHealth struct {
+	mu          sync.Mutex
+	unreachable map[string]struct{}
+}
+
+func newPeerHealth() *peerHealth {
+	return &peerHealth{unreachable: make(map[string]struct{})}
+}
+
+// failed marks addr as unreachable, it returns a boolean value indicating
+// whether addr was considered as reachable.
+func (h *peerHealth) failed(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.unreachable[addr]; ok {
+		return false
+	}
+	h.unreachable[addr] = struct{}{}
+	return true
+}
+
+// connected marks addr as reachable, it returns a boolean value indicating
+// whether addr was considered as unreachable.
+func (h *peerHealth) connected(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.unreachable[addr]; !ok {
+		return false
+	}
+	delete(h.unreachable, addr)
+	return true
+}
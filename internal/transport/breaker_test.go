@@ -0,0 +1,155 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/goutils/netutil/facebookgo/clock"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftpb"
+)
+
+func TestBackoffDefaultValues(t *testing.T) {
+	b := newBackoff(config.PeerBackoffConfig{}, clock.New())
+	if b.InitialInterval != defaultInitialBackoff ||
+		b.MaxInterval != defaultMaxBackoff ||
+		b.Multiplier != defaultMultiplier ||
+		b.RandomizationFactor != defaultJitter {
+		t.Errorf("unexpected default backoff %+v", b)
+	}
+}
+
+func TestBackoffGrowsExponentially(t *testing.T) {
+	cfg := config.PeerBackoffConfig{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     350 * time.Millisecond,
+		Multiplier:      2,
+		Jitter:          -1,
+	}
+	b := newBackoff(cfg, clock.New())
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		350 * time.Millisecond,
+		350 * time.Millisecond,
+	}
+	for idx, v := range expected {
+		if d := b.NextBackOff(); d != v {
+			t.Errorf("%d, backoff %s, want %s", idx, d, v)
+		}
+	}
+	b.Reset()
+	if d := b.NextBackOff(); d != cfg.InitialInterval {
+		t.Errorf("backoff %s after reset, want %s", d, cfg.InitialInterval)
+	}
+}
+
+func TestBackoffHasJitter(t *testing.T) {
+	cfg := config.PeerBackoffConfig{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     100 * time.Millisecond,
+		Jitter:          0.5,
+	}
+	b := newBackoff(cfg, clock.New())
+	values := make(map[time.Duration]struct{})
+	for i := 0; i < 100; i++ {
+		d := b.NextBackOff()
+		if d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("unexpected backoff %s", d)
+		}
+		values[d] = struct{}{}
+	}
+	if len(values) == 1 {
+		t.Errorf("no jitter applied")
+	}
+}
+
+func TestPeerHealthTransitions(t *testing.T) {
+	h := newPeerHealth()
+	if h.connected("a1") {
+		t.Errorf("unexpected transition")
+	}
+	if !h.failed("a1") {
+		t.Errorf("transition to unreachable not reported")
+	}
+	if h.failed("a1") {
+		t.Errorf("transition to unreachable reported twice")
+	}
+	if !h.connected("a1") {
+		t.Errorf("transition to reachable not reported")
+	}
+	if h.connected("a1") {
+		t.Errorf("transition to reachable reported twice")
+	}
+}
+
+type testHealthEvent struct {
+	dummyTransportEvent
+	mu     sync.Mutex
+	events []bool
+}
+
+func (e *testHealthEvent) PeerHealthChanged(addr string, reachable bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, reachable)
+}
+
+func (e *testHealthEvent) get() []bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]bool{}, e.events...)
+}
+
+func TestUnreachablePeerIsReportedOnce(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	handler := newTestMessageHandler()
+	trans, nodes, stopper, _ := newTestTransport(handler, false, fs)
+	defer trans.env.Stop()
+	defer trans.Stop()
+	defer stopper.Stop()
+	events := &testHealthEvent{}
+	trans.sysEvents = events
+	addr := "nosuchhost:39001"
+	nodes.Add(100, 2, addr)
+	msg := raftpb.Message{
+		Type:      raftpb.Heartbeat,
+		To:        2,
+		From:      1,
+		ClusterId: 100,
+	}
+	for i := 0; i < 2; i++ {
+		for !trans.Send(msg) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		for trans.queueSize() != 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if e := events.get(); len(e) != 1 || e[0] {
+		t.Errorf("unexpected events %v", e)
+	}
+	trans.peerConnected(addr)
+	if e := events.get(); len(e) != 2 || !e[1] {
+		t.Errorf("unexpected events %v", e)
+	}
+}
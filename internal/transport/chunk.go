@@ -15,12 +15,19 @@
 package transport
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"net/http"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/juju/ratelimit"
 	"github.com/lni/goutils/logutil"
 
 	"github.com/lni/dragonboat/v3/internal/fileutil"
@@ -41,16 +48,40 @@ var (
 	maxConcurrentSlot        = settings.Soft.MaxConcurrentStreamingSnapshot
 )
 
+const (
+	// maxPendingChunks is the max number of out of order chunks buffered for
+	// each snapshot received from multiple parallel streams.
+	maxPendingChunks = 64
+)
+
 func chunkKey(c pb.Chunk) string {
 	return fmt.Sprintf("%d:%d:%d", c.ClusterId, c.NodeId, c.Index)
 }
 
+// getChunkChecksum returns the checksum of the chunk data.
+func getChunkChecksum(data []byte) []byte {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, crc32.ChecksumIEEE(data))
+	return v
+}
+
+// hasValidChecksum returns a boolean value indicating whether the chunk data
+// matches its checksum. Chunks sent without checksums are considered as valid.
+func hasValidChecksum(c pb.Chunk) bool {
+	if c.Checksum == nil {
+		return true
+	}
+	return bytes.Equal(c.Checksum, getChunkChecksum(c.Data))
+}
+
 type tracked struct {
 	validator *rsm.SnapshotValidator
 	files     []*pb.SnapshotFile
-	first     pb.Chunk
-	tick      uint64
-	next      uint64
+	// pending contains chunks received ahead of the next expected chunk
+	pending map[uint64]pb.Chunk
+	first   pb.Chunk
+	tick    uint64
+	next    uint64
 }
 
 type ssLock struct {
@@ -68,6 +99,8 @@ func (l *ssLock) unlock() {
 // Chunk managed on the receiving side
 type Chunk struct {
 	fs        vfs.IFS
+	ctx       context.Context
+	client    *http.Client
 	tracked   map[string]*tracked
 	locks     map[string]*ssLock
 	dir       server.SnapshotDirFunc
@@ -77,8 +110,12 @@ type Chunk struct {
 	did       uint64
 	tick      uint64
 	gcTick    uint64
-	mu        sync.Mutex
-	validate  bool
+	// maxIncoming is the max number of concurrent incoming snapshot streams
+	maxIncoming uint64
+	// writeBucket limits the disk bandwidth used for writing received chunks
+	writeBucket *ratelimit.Bucket
+	mu          sync.Mutex
+	validate    bool
 }
 
 // NewChunk creates and returns a new snapshot chunks instance.
@@ -86,16 +123,19 @@ func NewChunk(onReceive func(pb.MessageBatch),
 	confirm func(uint64, uint64, uint64), dir server.SnapshotDirFunc,
 	did uint64, fs vfs.IFS) *Chunk {
 	return &Chunk{
-		did:       did,
-		validate:  true,
-		onReceive: onReceive,
-		confirm:   confirm,
-		tracked:   make(map[string]*tracked),
-		locks:     make(map[string]*ssLock),
-		timeout:   snapshotChunkTimeoutTick,
-		gcTick:    gcIntervalTick,
-		dir:       dir,
-		fs:        fs,
+		did:         did,
+		validate:    true,
+		ctx:         context.Background(),
+		client:      http.DefaultClient,
+		onReceive:   onReceive,
+		confirm:     confirm,
+		tracked:     make(map[string]*tracked),
+		locks:       make(map[string]*ssLock),
+		timeout:     snapshotChunkTimeoutTick,
+		gcTick:      gcIntervalTick,
+		dir:         dir,
+		maxIncoming: maxConcurrentSlot,
+		fs:          fs,
 	}
 }
 
@@ -107,11 +147,97 @@ func (c *Chunk) Add(chunk pb.Chunk) bool {
 			chunk.DeploymentId, c.did, chunk.BinVer, raftio.TransportBinVersion)
 		return false
 	}
+	if !hasValidChecksum(chunk) {
+		plog.Errorf("checksum mismatch, chunk %d of %s dropped",
+			chunk.ChunkId, c.ssid(chunk))
+		return false
+	}
+	key := chunkKey(chunk)
+	lock := c.getSnapshotLock(key)
+	lock.lock()
+	defer lock.unlock()
+	if buffered, ok := c.buffer(chunk); buffered {
+		return ok
+	}
+	if !c.addLocked(chunk) {
+		return false
+	}
+	for {
+		next, ok := c.nextPending(key)
+		if !ok {
+			return true
+		}
+		if !c.addLocked(next) {
+			return false
+		}
+	}
+}
+
+// buffer buffers the specified chunk when it is received ahead of the next
+// expected chunk of the snapshot. It returns a boolean value indicating
+// whether the chunk is handled and another boolean value indicating whether
+// the chunk is accepted.
+func (c *Chunk) buffer(chunk pb.Chunk) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	td, ok := c.tracked[chunkKey(chunk)]
+	if !ok || chunk.ChunkId <= td.next ||
+		td.first.From != chunk.From || td.first.Term != chunk.Term {
+		return false, false
+	}
+	if len(td.pending) >= maxPendingChunks {
+		plog.Errorf("too many pending chunks, chunk %d of %s dropped",
+			chunk.ChunkId, c.ssid(chunk))
+		return true, false
+	}
+	if td.pending == nil {
+		td.pending = make(map[uint64]pb.Chunk)
+	}
+	td.pending[chunk.ChunkId] = chunk
+	td.tick = c.getTick()
+	return true, true
+}
+
+// nextPending returns the buffered next expected chunk of the snapshot.
+func (c *Chunk) nextPending(key string) (pb.Chunk, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	td, ok := c.tracked[key]
+	if !ok {
+		return pb.Chunk{}, false
+	}
+	chunk, ok := td.pending[td.next]
+	if ok {
+		delete(td.pending, td.next)
+	}
+	return chunk, ok
+}
+
+// Resume returns the ID of the next chunk expected for the snapshot the
+// specified chunk belongs to. It returns 0 when the snapshot is not being
+// received from the same sender, in which case the snapshot should be sent
+// again from its first chunk.
+func (c *Chunk) Resume(chunk pb.Chunk) uint64 {
+	if chunk.DeploymentId != c.did ||
+		chunk.BinVer != raftio.TransportBinVersion {
+		return 0
+	}
 	key := chunkKey(chunk)
 	lock := c.getSnapshotLock(key)
 	lock.lock()
 	defer lock.unlock()
-	return c.addLocked(chunk)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	td, ok := c.tracked[key]
+	if !ok || td.first.From != chunk.From ||
+		td.first.Term != chunk.Term || td.first.ChunkCount != chunk.ChunkCount {
+		return 0
+	}
+	td.tick = c.getTick()
+	// buffered chunks are going to be sent again
+	td.pending = nil
+	plog.Infof("resuming %s from chunk %d", c.ssid(chunk), td.next)
+	return td.next
 }
 
 // Tick moves the internal logical clock forward.
@@ -188,7 +314,13 @@ func (c *Chunk) getSnapshotLock(key string) *ssLock {
 }
 
 func (c *Chunk) full() bool {
-	return uint64(len(c.tracked)) >= maxConcurrentSlot
+	return uint64(len(c.tracked)) >= c.maxIncoming
+}
+
+func (c *Chunk) getIncomingCount() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return uint64(len(c.tracked))
 }
 
 func (c *Chunk) record(chunk pb.Chunk) *tracked {
@@ -208,7 +340,7 @@ func (c *Chunk) record(chunk pb.Chunk) *tracked {
 			}
 		}
 		validator := rsm.NewSnapshotValidator()
-		if c.validate && !chunk.HasFileInfo {
+		if c.shouldValidateFirst(chunk) {
 			if !validator.AddChunk(chunk.Data, chunk.ChunkId) {
 				return nil
 			}
@@ -247,8 +379,15 @@ func (c *Chunk) record(chunk pb.Chunk) *tracked {
 	return td
 }
 
+// shouldValidateFirst returns a boolean value indicating whether the first
+// chunk should be validated. Pulled snapshot files are validated once they are
+// downloaded.
+func (c *Chunk) shouldValidateFirst(chunk pb.Chunk) bool {
+	return c.validate && !chunk.HasFileInfo && len(chunk.PullUrl) == 0
+}
+
 func (c *Chunk) shouldValidate(chunk pb.Chunk) bool {
-	return c.validate && !chunk.HasFileInfo && chunk.ChunkId != 0
+	return c.shouldValidateFirst(chunk) && chunk.ChunkId != 0
 }
 
 func (c *Chunk) addLocked(chunk pb.Chunk) bool {
@@ -274,14 +413,19 @@ func (c *Chunk) addLocked(chunk pb.Chunk) bool {
 		}
 	}
 	if err := c.save(chunk); err != nil {
-		plog.Errorf("failed to save a chunk %s, %v", key, err)
 		c.removeTempDir(chunk)
+		if len(chunk.PullUrl) > 0 {
+			plog.Warningf("failed to pull a snapshot file %s, %v", key, err)
+			c.reset(key)
+			return false
+		}
+		plog.Errorf("failed to save a chunk %s, %v", key, err)
 		panic(err)
 	}
 	if chunk.IsLastChunk() {
 		plog.Debugf("last chunk %s received", key)
 		defer c.reset(key)
-		if c.validate {
+		if c.validate && len(chunk.PullUrl) == 0 {
 			if !td.validator.Validate() {
 				plog.Warningf("dropped an invalid snapshot %s", key)
 				c.removeTempDir(chunk)
@@ -319,6 +463,9 @@ func (c *Chunk) save(chunk pb.Chunk) (err error) {
 	}
 	fn := c.fs.PathBase(chunk.Filepath)
 	fp := c.fs.PathJoin(env.GetTempDir(), fn)
+	if len(chunk.PullUrl) > 0 {
+		return c.pull(chunk, fp)
+	}
 	var f *ChunkFile
 	if chunk.FileChunkId == 0 {
 		f, err = CreateChunkFile(fp, c.fs)
@@ -333,6 +480,9 @@ func (c *Chunk) save(chunk pb.Chunk) (err error) {
 			err = cerr
 		}
 	}()
+	if c.writeBucket != nil {
+		c.writeBucket.Wait(int64(len(chunk.Data)))
+	}
 	n, err := f.Write(chunk.Data)
 	if err != nil {
 		return err
@@ -348,6 +498,38 @@ func (c *Chunk) save(chunk pb.Chunk) (err error) {
 	return nil
 }
 
+// pull downloads the snapshot file described by the specified manifest chunk
+// to the target path. Interrupted downloads are resumed from the end of the
+// downloaded content up to maxResumeCount times.
+func (c *Chunk) pull(chunk pb.Chunk, fp string) error {
+	plog.Infof("pulling %s of %s from %s",
+		c.fs.PathBase(fp), c.ssid(chunk), chunk.PullUrl)
+	for resumed := 0; ; resumed++ {
+		err := DownloadSnapshotFile(c.ctx, c.client, chunk.PullUrl, fp, c.fs)
+		if err == nil {
+			break
+		}
+		if err == ErrCorruptedSnapshotFile ||
+			c.ctx.Err() != nil || resumed >= maxResumeCount {
+			return err
+		}
+		plog.Warningf("resuming the download of %s, %v", chunk.PullUrl, err)
+		select {
+		case <-time.After(resumeDelay):
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+	fi, err := c.fs.Stat(fp)
+	if err != nil {
+		return err
+	}
+	if uint64(fi.Size()) != chunk.FileSize {
+		return ErrCorruptedSnapshotFile
+	}
+	return nil
+}
+
 func (c *Chunk) getEnv(chunk pb.Chunk) server.SSEnv {
 	return server.NewSSEnv(c.dir, chunk.ClusterId, chunk.NodeId,
 		chunk.Index, chunk.From, server.ReceivingMode, c.fs)
@@ -15,10 +15,13 @@
 package transport
 
 import (
+	"bytes"
+	"io/ioutil"
 	"math/rand"
 	"reflect"
 	"testing"
 
+	"github.com/juju/ratelimit"
 	"github.com/lni/goutils/leaktest"
 
 	"github.com/lni/dragonboat/v3/internal/fileutil"
@@ -269,6 +272,44 @@ func TestAddFirstChunkRecordsTheSnapshotAndCreatesTheTempFile(t *testing.T) {
 	runChunkTest(t, fn, fs)
 }
 
+func TestResumeReturnsTheNextExpectedChunk(t *testing.T) {
+	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
+		inputs := getTestChunk()
+		chunks.validate = false
+		if v := chunks.Resume(inputs[0]); v != 0 {
+			t.Errorf("not tracked snapshot resumed from %d", v)
+		}
+		for _, c := range inputs[:4] {
+			if !chunks.Add(c) {
+				t.Fatalf("failed to add chunk")
+			}
+		}
+		if v := chunks.Resume(inputs[0]); v != 4 {
+			t.Errorf("resumed from %d, want 4", v)
+		}
+		other := inputs[0]
+		other.From = other.From + 1
+		if v := chunks.Resume(other); v != 0 {
+			t.Errorf("snapshot from other node resumed from %d", v)
+		}
+		other = inputs[0]
+		other.DeploymentId = other.DeploymentId + 1
+		if v := chunks.Resume(other); v != 0 {
+			t.Errorf("snapshot with other deployment ID resumed from %d", v)
+		}
+		for _, c := range inputs[4:] {
+			if !chunks.Add(c) {
+				t.Fatalf("failed to add chunk")
+			}
+		}
+		if v := chunks.Resume(inputs[0]); v != 0 {
+			t.Errorf("completed snapshot resumed from %d", v)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runChunkTest(t, fn, fs)
+}
+
 func TestGcRemovesRecordAndTempFile(t *testing.T) {
 	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
 		inputs := getTestChunk()
@@ -320,6 +361,30 @@ func TestReceivedCompleteChunkWillBeMergedIntoSnapshotFile(t *testing.T) {
 	runChunkTest(t, fn, fs)
 }
 
+func TestReceivedChunkWritesAreRateLimited(t *testing.T) {
+	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
+		capacity := int64(1024 * 1024)
+		chunks.writeBucket = ratelimit.NewBucketWithRate(1, capacity)
+		inputs := getTestChunk()
+		chunks.validate = false
+		total := int64(0)
+		for _, c := range inputs {
+			if !chunks.addLocked(c) {
+				t.Errorf("failed to add chunk")
+			}
+			total += int64(len(c.Data))
+		}
+		if handler.getSnapshotCount(100, 2) != 1 {
+			t.Errorf("got %d, want %d", handler.getSnapshotCount(100, 2), 1)
+		}
+		if v := chunks.writeBucket.Available(); v != capacity-total {
+			t.Errorf("available %d, want %d", v, capacity-total)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runChunkTest(t, fn, fs)
+}
+
 func TestChunkAreIgnoredWhenNodeIsRemoved(t *testing.T) {
 	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
 		inputs := getTestChunk()
@@ -500,7 +565,7 @@ func testSnapshotWithExternalFilesAreHandledByChunk(t *testing.T,
 			ClusterId: 100,
 			Snapshot:  ss,
 		}
-		inputs := splitSnapshotMessage(msg, chunks.fs)
+		inputs := splitSnapshotMessage(msg, "", chunks.fs)
 		for _, c := range inputs {
 			c.DeploymentId = settings.UnmanagedDeploymentID
 			c.Data = make([]byte, c.ChunkSize)
@@ -550,7 +615,7 @@ func TestWitnessSnapshotCanBeHandled(t *testing.T) {
 			ClusterId: 100,
 			Snapshot:  ss,
 		}
-		inputs := splitSnapshotMessage(msg, chunks.fs)
+		inputs := splitSnapshotMessage(msg, "", chunks.fs)
 		if len(inputs) != 1 {
 			t.Errorf("got %d chunks, want 1", len(inputs))
 		}
@@ -592,7 +657,7 @@ func TestSnapshotRecordWithoutExternalFilesCanBeSplitIntoChunk(t *testing.T) {
 		ClusterId: 100,
 		Snapshot:  ss,
 	}
-	chunks := splitSnapshotMessage(msg, fs)
+	chunks := splitSnapshotMessage(msg, "", fs)
 	if len(chunks) != 4 {
 		t.Errorf("got %d counts, want 4", len(chunks))
 	}
@@ -674,7 +739,7 @@ func TestSnapshotRecordWithTwoExternalFilesCanBeSplitIntoChunk(t *testing.T) {
 		ClusterId: 100,
 		Snapshot:  ss,
 	}
-	chunks := splitSnapshotMessage(msg, fs)
+	chunks := splitSnapshotMessage(msg, "", fs)
 	if len(chunks) != 7 {
 		t.Errorf("unexpected chunk count")
 	}
@@ -785,3 +850,90 @@ func TestGetMessageFromChunk(t *testing.T) {
 	fs := vfs.GetTestFS()
 	runChunkTest(t, fn, fs)
 }
+
+func TestOutOfOrderChunksFromParallelStreamsAreBuffered(t *testing.T) {
+	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
+		inputs := getTestChunk()
+		chunks.validate = false
+		order := []int{0, 2, 4, 3, 9, 1, 5, 7, 8, 6}
+		for _, idx := range order {
+			if !chunks.Add(inputs[idx]) {
+				t.Fatalf("failed to add chunk %d", idx)
+			}
+		}
+		if _, ok := chunks.tracked[chunkKey(inputs[0])]; ok {
+			t.Errorf("snapshot still tracked")
+		}
+		if handler.getSnapshotCount(100, 2) != 1 {
+			t.Errorf("got %d, want %d", handler.getSnapshotCount(100, 2), 1)
+		}
+		env := chunks.getEnv(inputs[0])
+		f, err := chunks.fs.Open(env.GetFilepath())
+		if err != nil {
+			t.Fatalf("failed to open the snapshot file, %v", err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatalf("failed to read the snapshot file, %v", err)
+		}
+		expected := make([]byte, 0)
+		for _, c := range inputs {
+			expected = append(expected, c.Data...)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("unexpected snapshot file content")
+		}
+	}
+	fs := vfs.GetTestFS()
+	runChunkTest(t, fn, fs)
+}
+
+func TestTooManyPendingChunksAreRejected(t *testing.T) {
+	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
+		inputs := getTestChunk()
+		chunks.validate = false
+		if !chunks.Add(inputs[0]) {
+			t.Fatalf("failed to add chunk")
+		}
+		td := chunks.tracked[chunkKey(inputs[0])]
+		td.pending = make(map[uint64]pb.Chunk)
+		for i := uint64(0); i < maxPendingChunks; i++ {
+			td.pending[i+100] = pb.Chunk{}
+		}
+		if chunks.Add(inputs[2]) {
+			t.Errorf("chunk not rejected")
+		}
+		// resume drops pending chunks as they will be sent again
+		if next := chunks.Resume(inputs[0]); next != 1 {
+			t.Errorf("next %d, want 1", next)
+		}
+		if len(td.pending) != 0 {
+			t.Errorf("pending chunks not dropped")
+		}
+	}
+	fs := vfs.GetTestFS()
+	runChunkTest(t, fn, fs)
+}
+
+func TestChunkWithInvalidChecksumIsRejected(t *testing.T) {
+	fn := func(t *testing.T, chunks *Chunk, handler *testMessageHandler) {
+		inputs := getTestChunk()
+		chunks.validate = false
+		c := inputs[0]
+		c.Checksum = getChunkChecksum(c.Data)
+		if !hasValidChecksum(c) {
+			t.Fatalf("unexpected checksum mismatch")
+		}
+		c.Data = append([]byte{}, c.Data...)
+		c.Data[0]++
+		if chunks.Add(c) {
+			t.Errorf("chunk with invalid checksum not rejected")
+		}
+		if _, ok := chunks.tracked[chunkKey(c)]; ok {
+			t.Errorf("rejected chunk tracked")
+		}
+	}
+	fs := vfs.GetTestFS()
+	runChunkTest(t, fn, fs)
+}
@@ -0,0 +1,133 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+// The payload of message batches sent by the TCP transport module can be
+// compressed, the compression type used is recorded in the request header of
+// each message so receivers always know how to decompress the payload.
+// Snapshot chunks are never compressed by the transport module as their data
+// is already compressed based on the SnapshotCompressionType setting.
+
+const (
+	// minCompressionSize is the minimum size of payloads to be compressed,
+	// smaller payloads such as heartbeats are not worth compressing.
+	minCompressionSize = 512
+	// maxPayloadSize is the max size of received payloads after decompression.
+	// Message batches are cut once they exceed maxMsgBatchSize, a batch can be
+	// up to one max sized entry larger than maxMsgBatchSize.
+	maxPayloadSize = 2 * maxMsgBatchSize
+)
+
+var (
+	errUnknownCompressionType = errors.New("unknown compression type")
+	errPayloadTooLarge        = errors.New("payload too large")
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// getZstd returns the zstd encoder and decoder shared by all connections,
+// their EncodeAll and DecodeAll methods are safe for concurrent use.
+func getZstd() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		encoder, err := zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			panic(err)
+		}
+		decoder, err := zstd.NewReader(nil,
+			zstd.WithDecoderMaxMemory(maxPayloadSize))
+		if err != nil {
+			panic(err)
+		}
+		zstdEncoder = encoder
+		zstdDecoder = decoder
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+func isValidCompressionType(ct pb.CompressionType) bool {
+	return ct == pb.NoCompression || ct == pb.Snappy || ct == pb.Zstd
+}
+
+// compressPayload compresses data using the specified compression type, dst is
+// reused when it is large enough. The returned boolean value indicates whether
+// data has been compressed, data is not compressed when it is too small or
+// compression doesn't reduce its size.
+func compressPayload(ct pb.CompressionType,
+	dst []byte, data []byte) ([]byte, bool) {
+	if ct == pb.NoCompression || len(data) < minCompressionSize {
+		return nil, false
+	}
+	var result []byte
+	switch ct {
+	case pb.Snappy:
+		if n := snappy.MaxEncodedLen(len(data)); n > 0 && cap(dst) < n {
+			dst = make([]byte, n)
+		}
+		result = snappy.Encode(dst[:cap(dst)], data)
+	case pb.Zstd:
+		encoder, _ := getZstd()
+		result = encoder.EncodeAll(data, dst[:0])
+	default:
+		panic(errUnknownCompressionType)
+	}
+	if len(result) >= len(data) {
+		return nil, false
+	}
+	return result, true
+}
+
+// decompressPayload decompresses data compressed using the specified
+// compression type into a newly allocated buffer. errPayloadTooLarge is
+// returned when the decompressed payload would exceed maxPayloadSize.
+func decompressPayload(ct pb.CompressionType, data []byte) ([]byte, error) {
+	switch ct {
+	case pb.NoCompression:
+		return data, nil
+	case pb.Snappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(n) > maxPayloadSize {
+			return nil, errPayloadTooLarge
+		}
+		return snappy.Decode(nil, data)
+	case pb.Zstd:
+		_, decoder := getZstd()
+		result, err := decoder.DecodeAll(data, nil)
+		if err == zstd.ErrDecoderSizeExceeded ||
+			uint64(len(result)) > maxPayloadSize {
+			return nil, errPayloadTooLarge
+		}
+		return result, err
+	default:
+		return nil, errUnknownCompressionType
+	}
+}
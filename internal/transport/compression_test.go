@@ -0,0 +1,197 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/lni/dragonboat/v3/config"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+func TestPayloadCanBeCompressedAndDecompressed(t *testing.T) {
+	data := bytes.Repeat([]byte("dragonboat"), 1024)
+	for _, ct := range []pb.CompressionType{pb.Snappy, pb.Zstd} {
+		compressed, ok := compressPayload(ct, nil, data)
+		if !ok {
+			t.Fatalf("%s, payload not compressed", ct)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("%s, size not reduced", ct)
+		}
+		result, err := decompressPayload(ct, compressed)
+		if err != nil {
+			t.Fatalf("%s, failed to decompress %v", ct, err)
+		}
+		if !bytes.Equal(data, result) {
+			t.Errorf("%s, payload changed", ct)
+		}
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestOversizedSnappyPayloadIsRejected(t *testing.T) {
+	data := make([]byte, binary.MaxVarintLen64+16)
+	binary.PutUvarint(data, maxPayloadSize+1)
+	if _, err := decompressPayload(pb.Snappy, data); err != errPayloadTooLarge {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestOversizedZstdPayloadIsRejected(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		t.Fatalf("failed to create encoder %v", err)
+	}
+	// streamed frames don't include the content size
+	if _, err := io.CopyN(w, zeroReader{}, int64(maxPayloadSize)+1); err != nil {
+		t.Fatalf("failed to compress %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close encoder %v", err)
+	}
+	if _, err := decompressPayload(pb.Zstd, buf.Bytes()); err != errPayloadTooLarge {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSmallOrIncompressiblePayloadIsNotCompressed(t *testing.T) {
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("failed to get random data %v", err)
+	}
+	small := bytes.Repeat([]byte("d"), minCompressionSize-1)
+	for _, ct := range []pb.CompressionType{pb.Snappy, pb.Zstd} {
+		if _, ok := compressPayload(ct, nil, small); ok {
+			t.Errorf("%s, small payload compressed", ct)
+		}
+		if _, ok := compressPayload(ct, nil, random); ok {
+			t.Errorf("%s, incompressible payload compressed", ct)
+		}
+	}
+	data := bytes.Repeat([]byte("dragonboat"), 1024)
+	if _, ok := compressPayload(pb.NoCompression, nil, data); ok {
+		t.Errorf("payload unexpectedly compressed")
+	}
+}
+
+func TestCompressionTypeIsEncodedInRequestHeader(t *testing.T) {
+	r := requestHeader{
+		method:      raftType,
+		size:        1024,
+		crc:         1000,
+		compression: pb.Zstd,
+	}
+	buf := make([]byte, requestHeaderSize)
+	rr := requestHeader{}
+	if !rr.decode(r.encode(buf)) {
+		t.Fatalf("decode failed")
+	}
+	if rr != r {
+		t.Errorf("request header changed, %+v, %+v", rr, r)
+	}
+	r.method = snapshotType
+	if rr.decode(r.encode(buf)) {
+		t.Errorf("compressed snapshot chunk not rejected")
+	}
+	r.method = raftType
+	r.compression = pb.CompressionType(100)
+	if rr.decode(r.encode(buf)) {
+		t.Errorf("unknown compression type not rejected")
+	}
+}
+
+func TestCompressedMessageBatchCanBeReceived(t *testing.T) {
+	for _, ct := range []pb.CompressionType{pb.Snappy, pb.Zstd} {
+		var mu sync.Mutex
+		var received []pb.MessageBatch
+		handler := func(mb pb.MessageBatch) {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, mb)
+		}
+		nhConfig := config.NodeHostConfig{
+			RaftAddress:              serverAddress,
+			TransportCompressionType: ct,
+		}
+		trans := NewTCPTransport(nhConfig, handler, func(pb.Chunk) bool {
+			return true
+		})
+		if err := trans.Start(); err != nil {
+			t.Fatalf("failed to start transport %v", err)
+		}
+		conn, err := trans.GetConnection(context.Background(), serverAddress)
+		if err != nil {
+			t.Fatalf("failed to get connection %v", err)
+		}
+		cmd := bytes.Repeat([]byte("dragonboat"), 1024*1024)
+		batch := pb.MessageBatch{
+			SourceAddress: serverAddress,
+			Requests: []pb.Message{
+				{Type: pb.Heartbeat, ClusterId: 1, To: 2},
+				{
+					Type:      pb.Replicate,
+					ClusterId: 1,
+					To:        2,
+					Entries:   []pb.Entry{{Index: 1, Cmd: cmd}},
+				},
+			},
+		}
+		if err := conn.SendMessageBatch(batch); err != nil {
+			t.Fatalf("failed to send message batch %v", err)
+		}
+		if err := conn.SendMessageBatch(pb.MessageBatch{
+			Requests: []pb.Message{{Type: pb.Heartbeat}},
+		}); err != nil {
+			t.Fatalf("failed to send message batch %v", err)
+		}
+		for i := 0; i < 500; i++ {
+			mu.Lock()
+			count := len(received)
+			mu.Unlock()
+			if count == 2 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		conn.Close()
+		trans.Stop()
+		if len(received) != 2 {
+			t.Fatalf("%s, got %d message batches", ct, len(received))
+		}
+		if len(received[0].Requests) != 2 ||
+			!bytes.Equal(received[0].Requests[1].Entries[0].Cmd, cmd) {
+			t.Errorf("%s, message batch changed", ct)
+		}
+	}
+}
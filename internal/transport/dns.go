@@ -0,0 +1,230 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+var (
+	lookupTimeout      = 5 * time.Second
+	srvRefreshInterval = 30 * time.Second
+	srvRetryInterval   = time.Second
+)
+
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
+
+type srvLookupFunc func(ctx context.Context, name string) ([]*net.SRV, error)
+
+func lookupSRV(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return records, err
+}
+
+// resolveSRV returns the host:port addresses of all SRV records of the
+// specified DNS SRV address. Addresses are sorted by priority and weight of
+// their records so the same records are always returned in the same order.
+func resolveSRV(lookup srvLookupFunc, addr string) ([]string, error) {
+	name := strings.TrimPrefix(addr, config.SRVAddressPrefix)
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	records, err := lookup(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Priority != records[j].Priority {
+			return records[i].Priority < records[j].Priority
+		}
+		if records[i].Weight != records[j].Weight {
+			return records[i].Weight > records[j].Weight
+		}
+		if records[i].Target != records[j].Target {
+			return records[i].Target < records[j].Target
+		}
+		return records[i].Port < records[j].Port
+	})
+	result := make([]string, 0, len(records))
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		result = append(result,
+			net.JoinHostPort(host, strconv.FormatUint(uint64(r.Port), 10)))
+	}
+	return result, nil
+}
+
+// expandSRV replaces DNS SRV addresses in the specified address list with the
+// addresses of their SRV records. DNS SRV addresses that can not be resolved
+// are skipped.
+func expandSRV(lookup srvLookupFunc, addrs []string) []string {
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !config.IsSRVAddress(addr) {
+			result = append(result, addr)
+			continue
+		}
+		resolved, err := resolveSRV(lookup, addr)
+		if err != nil {
+			plog.Warningf("failed to resolve %s, %v", addr, err)
+			continue
+		}
+		result = append(result, resolved...)
+	}
+	return result
+}
+
+type srvRecord struct {
+	addr    string
+	next    time.Time
+	pending bool
+}
+
+// srvResolver resolves DNS SRV addresses used as node targets. Resolved
+// addresses are cached, stale ones are queried again in the background so
+// resolving never blocks on DNS queries.
+type srvResolver struct {
+	mu      sync.Mutex
+	lookup  srvLookupFunc
+	records map[string]*srvRecord
+}
+
+func newSRVResolver() *srvResolver {
+	return &srvResolver{
+		lookup:  lookupSRV,
+		records: make(map[string]*srvRecord),
+	}
+}
+
+// resolve returns the cached host:port address of the specified DNS SRV
+// address. A background query is started when the address has not been
+// resolved yet or when the cached address is stale.
+func (r *srvResolver) resolve(addr string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.records[addr]
+	if !ok {
+		rec = &srvRecord{}
+		r.records[addr] = rec
+	}
+	if !rec.pending && !time.Now().Before(rec.next) {
+		rec.pending = true
+		go r.refresh(addr)
+	}
+	return rec.addr, len(rec.addr) > 0
+}
+
+func (r *srvResolver) refresh(addr string) {
+	resolved, err := resolveSRV(r.lookup, addr)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.records[addr]
+	if !ok {
+		return
+	}
+	rec.pending = false
+	if err != nil || len(resolved) == 0 {
+		plog.Warningf("failed to resolve %s, %v", addr, err)
+		rec.next = time.Now().Add(srvRetryInterval)
+		return
+	}
+	if len(rec.addr) > 0 && rec.addr != resolved[0] {
+		plog.Infof("%s resolved to %s, was %s", addr, resolved[0], rec.addr)
+	}
+	rec.addr = resolved[0]
+	rec.next = time.Now().Add(srvRefreshInterval)
+}
+
+// addressWatcher keeps track of the IP addresses resolved from the hostnames
+// of remote NodeHost addresses, so changed IP addresses can be detected.
+type addressWatcher struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	lookup   lookupFunc
+	onChange func(target string, previous []string, current []string)
+	resolved map[string][]string
+}
+
+func newAddressWatcher(ctx context.Context,
+	onChange func(string, []string, []string)) *addressWatcher {
+	return &addressWatcher{
+		ctx:      ctx,
+		lookup:   net.DefaultResolver.LookupHost,
+		onChange: onChange,
+		resolved: make(map[string][]string),
+	}
+}
+
+// refresh resolves the hostname of the specified target address again, it
+// returns a boolean value indicating whether the resolved IP addresses have
+// changed since the last resolution.
+func (w *addressWatcher) refresh(target string) bool {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil || net.ParseIP(host) != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(w.ctx, lookupTimeout)
+	defer cancel()
+	current, err := w.lookup(ctx, host)
+	if err != nil || len(current) == 0 {
+		plog.Warningf("failed to resolve %s, %v", host, err)
+		return false
+	}
+	sort.Strings(current)
+	w.mu.Lock()
+	previous, ok := w.resolved[target]
+	w.resolved[target] = current
+	w.mu.Unlock()
+	if !ok || equalStrings(previous, current) {
+		return false
+	}
+	plog.Infof("%s resolved to %v, was %v", target, current, previous)
+	w.onChange(target, previous, current)
+	return true
+}
+
+// refreshAll resolves the specified target addresses again, targets not
+// specified are no longer tracked.
+func (w *addressWatcher) refreshAll(targets map[string]struct{}) {
+	w.mu.Lock()
+	for target := range w.resolved {
+		if _, ok := targets[target]; !ok {
+			delete(w.resolved, target)
+		}
+	}
+	w.mu.Unlock()
+	for target := range targets {
+		w.refresh(target)
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftpb"
+)
+
+func TestAddressWatcherDetectsChangedAddresses(t *testing.T) {
+	ips := []string{"10.0.0.2", "10.0.0.1"}
+	lookups := 0
+	changed := 0
+	var previous []string
+	var current []string
+	w := newAddressWatcher(context.Background(),
+		func(target string, p []string, c []string) {
+			if target != "node1:9000" {
+				t.Errorf("unexpected target %s", target)
+			}
+			changed++
+			previous = p
+			current = c
+		})
+	w.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return append([]string{}, ips...), nil
+	}
+	if w.refresh("node1:9000") {
+		t.Errorf("first resolution reported as changed")
+	}
+	ips = []string{"10.0.0.1", "10.0.0.2"}
+	if w.refresh("node1:9000") {
+		t.Errorf("unchanged addresses reported as changed")
+	}
+	ips = []string{"10.0.0.3"}
+	if !w.refresh("node1:9000") {
+		t.Errorf("changed addresses not reported")
+	}
+	if changed != 1 {
+		t.Fatalf("changed %d, want 1", changed)
+	}
+	if !reflect.DeepEqual(previous, []string{"10.0.0.1", "10.0.0.2"}) ||
+		!reflect.DeepEqual(current, []string{"10.0.0.3"}) {
+		t.Errorf("unexpected addresses %v, %v", previous, current)
+	}
+	if w.refresh("10.0.0.9:9000") {
+		t.Errorf("IP address reported as changed")
+	}
+	if lookups != 3 {
+		t.Errorf("lookups %d, want 3", lookups)
+	}
+	w.refreshAll(map[string]struct{}{})
+	if len(w.resolved) != 0 {
+		t.Errorf("target not removed")
+	}
+}
+
+func TestAddressChangeClosesSendQueue(t *testing.T) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	tt, nodes, _, _, _ := newNOOPTestTransport(handler, fs)
+	defer tt.Stop()
+	nodes.Add(100, 2, serverAddress)
+	msg := raftpb.Message{ClusterId: 100, To: 2, Type: raftpb.Heartbeat}
+	if !tt.Send(msg) {
+		t.Fatalf("failed to send")
+	}
+	breaker := tt.GetCircuitBreaker(serverAddress)
+	tt.addressChanged(serverAddress, []string{"10.0.0.1"}, []string{"10.0.0.2"})
+	if tt.GetCircuitBreaker(serverAddress) == breaker {
+		t.Errorf("circuit breaker not reset")
+	}
+	for i := 0; i < 1000; i++ {
+		if len(tt.getTargets()) == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("send queue not closed")
+}
+
+func getTestSRVLookup(records map[string][]*net.SRV) srvLookupFunc {
+	return func(ctx context.Context, name string) ([]*net.SRV, error) {
+		r, ok := records[name]
+		if !ok {
+			return nil, errors.New("no such host")
+		}
+		return append([]*net.SRV{}, r...), nil
+	}
+}
+
+func TestResolveSRVSortsRecords(t *testing.T) {
+	lookup := getTestSRVLookup(map[string][]*net.SRV{
+		"_raft._tcp.example.com": {
+			{Target: "c.example.com.", Port: 9000, Priority: 20, Weight: 10},
+			{Target: "b.example.com.", Port: 9000, Priority: 10, Weight: 10},
+			{Target: "a.example.com.", Port: 9001, Priority: 10, Weight: 10},
+			{Target: "d.example.com.", Port: 9000, Priority: 10, Weight: 50},
+		},
+	})
+	addrs, err := resolveSRV(lookup, "srv://_raft._tcp.example.com")
+	if err != nil {
+		t.Fatalf("failed to resolve, %v", err)
+	}
+	expected := []string{"d.example.com:9000", "a.example.com:9001",
+		"b.example.com:9000", "c.example.com:9000"}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("addrs %v, want %v", addrs, expected)
+	}
+}
+
+func TestExpandSRV(t *testing.T) {
+	lookup := getTestSRVLookup(map[string][]*net.SRV{
+		"_gossip._udp.example.com": {
+			{Target: "a.example.com.", Port: 7000},
+			{Target: "b.example.com.", Port: 7001},
+		},
+	})
+	seed := []string{"10.0.0.1:7000",
+		"srv://_gossip._udp.example.com", "srv://_gossip._udp.missing.com"}
+	expected := []string{"10.0.0.1:7000", "a.example.com:7000",
+		"b.example.com:7001"}
+	if result := expandSRV(lookup, seed); !reflect.DeepEqual(result, expected) {
+		t.Errorf("seed %v, want %v", result, expected)
+	}
+}
+
+func waitForSRVAddress(t *testing.T,
+	r *srvResolver, addr string, expected string) {
+	for i := 0; i < 100; i++ {
+		if v, ok := r.resolve(addr); ok && v == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s not resolved to %s", addr, expected)
+}
+
+func TestSRVResolverRefreshesStaleAddresses(t *testing.T) {
+	orgRefresh, orgRetry := srvRefreshInterval, srvRetryInterval
+	srvRefreshInterval = 50 * time.Millisecond
+	srvRetryInterval = 10 * time.Millisecond
+	defer func() {
+		srvRefreshInterval, srvRetryInterval = orgRefresh, orgRetry
+	}()
+	var mu sync.Mutex
+	records := map[string][]*net.SRV{}
+	lookup := getTestSRVLookup(records)
+	r := newSRVResolver()
+	r.lookup = func(ctx context.Context, name string) ([]*net.SRV, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return lookup(ctx, name)
+	}
+	addr := "srv://_raft._tcp.node1.example.com"
+	if _, ok := r.resolve(addr); ok {
+		t.Fatalf("unexpectedly resolved")
+	}
+	mu.Lock()
+	records["_raft._tcp.node1.example.com"] = []*net.SRV{
+		{Target: "10.0.0.1", Port: 9000},
+	}
+	mu.Unlock()
+	waitForSRVAddress(t, r, addr, "10.0.0.1:9000")
+	mu.Lock()
+	records["_raft._tcp.node1.example.com"] = []*net.SRV{
+		{Target: "10.0.0.2", Port: 9000},
+	}
+	mu.Unlock()
+	waitForSRVAddress(t, r, addr, "10.0.0.2:9000")
+	mu.Lock()
+	delete(records, "_raft._tcp.node1.example.com")
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	if v, ok := r.resolve(addr); !ok || v != "10.0.0.2:9000" {
+		t.Errorf("cached address not kept on failures, %s", v)
+	}
+}
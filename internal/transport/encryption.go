@@ -0,0 +1,255 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+const (
+	// maxEncryptionKeyIDLength is the max length of key IDs attached to
+	// encrypted message batches and snapshot chunks.
+	maxEncryptionKeyIDLength = 256
+)
+
+var (
+	// ErrInvalidEncryptionKeyID indicates that the key ID returned by the
+	// transport encryption provider is invalid.
+	ErrInvalidEncryptionKeyID = errors.New("invalid encryption key ID")
+	// ErrPayloadDecryption indicates that the received encrypted payload can
+	// not be authenticated and decrypted.
+	ErrPayloadDecryption = errors.New("failed to decrypt payload")
+	// ErrUnencryptedPayload indicates that an unencrypted payload is received
+	// when transport encryption is required.
+	ErrUnencryptedPayload = errors.New("unencrypted payload")
+	// ErrNoEncryptionProvider indicates that an encrypted payload is received
+	// but no transport encryption provider is available.
+	ErrNoEncryptionProvider = errors.New("no transport encryption provider")
+)
+
+// payloadCipher encrypts message batches and snapshot chunks sent to remote
+// NodeHost instances and decrypts those received from them. A nil
+// payloadCipher leaves unencrypted payloads untouched.
+type payloadCipher struct {
+	ep raftio.ITransportEncryptionProvider
+}
+
+func newPayloadCipher(ep raftio.ITransportEncryptionProvider) *payloadCipher {
+	if ep == nil {
+		return nil
+	}
+	return &payloadCipher{ep: ep}
+}
+
+func (p *payloadCipher) getSealCipher(target string) (string,
+	cipher.AEAD, error) {
+	keyID := p.ep.KeyID(target)
+	if len(keyID) == 0 || len(keyID) > maxEncryptionKeyIDLength {
+		return "", nil, ErrInvalidEncryptionKeyID
+	}
+	aead, err := p.ep.AEAD(keyID)
+	if err != nil {
+		return "", nil, err
+	}
+	return keyID, aead, nil
+}
+
+func (p *payloadCipher) getOpenCipher(keyID string) (cipher.AEAD, error) {
+	if p == nil {
+		return nil, ErrNoEncryptionProvider
+	}
+	return p.ep.AEAD(keyID)
+}
+
+func seal(aead cipher.AEAD, data []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(),
+		aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, ad), nil
+}
+
+func open(aead cipher.AEAD, data []byte, ad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, ErrPayloadDecryption
+	}
+	nonce := data[:aead.NonceSize()]
+	result, err := aead.Open(nil, nonce, data[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrPayloadDecryption
+	}
+	return result, nil
+}
+
+// getBatchAD returns the additional data authenticated together with the
+// sealed requests, it binds the requests to the unencrypted fields of the
+// message batch.
+func getBatchAD(keyID string, mb pb.MessageBatch) []byte {
+	ad := make([]byte, 12, 12+len(keyID)+len(mb.SourceAddress))
+	binary.LittleEndian.PutUint64(ad, mb.DeploymentId)
+	binary.LittleEndian.PutUint32(ad[8:], mb.BinVer)
+	ad = append(ad, keyID...)
+	return append(ad, mb.SourceAddress...)
+}
+
+// getChunkAD returns the additional data authenticated together with the
+// sealed chunk data, it binds the data to the snapshot and its position in
+// the snapshot so chunks can not be swapped without being detected. The URL
+// of pulled snapshot files is authenticated as well.
+func getChunkAD(keyID string, c pb.Chunk) []byte {
+	fields := []uint64{c.DeploymentId, c.ClusterId, c.NodeId, c.From,
+		c.Index, c.Term, c.ChunkId, c.ChunkCount, c.FileChunkId, c.FileChunkCount}
+	ad := make([]byte, len(fields)*8, len(fields)*8+len(keyID))
+	for i, v := range fields {
+		binary.LittleEndian.PutUint64(ad[i*8:], v)
+	}
+	ad = append(ad, keyID...)
+	return append(ad, c.PullUrl...)
+}
+
+func (p *payloadCipher) sealBatch(target string,
+	mb pb.MessageBatch) (pb.MessageBatch, error) {
+	keyID, aead, err := p.getSealCipher(target)
+	if err != nil {
+		return pb.MessageBatch{}, err
+	}
+	requests := pb.MessageBatch{Requests: mb.Requests}
+	data, err := requests.Marshal()
+	if err != nil {
+		return pb.MessageBatch{}, err
+	}
+	sealed, err := seal(aead, data, getBatchAD(keyID, mb))
+	if err != nil {
+		return pb.MessageBatch{}, err
+	}
+	return pb.MessageBatch{
+		DeploymentId:    mb.DeploymentId,
+		SourceAddress:   mb.SourceAddress,
+		BinVer:          mb.BinVer,
+		EncryptionKeyId: keyID,
+		Sealed:          sealed,
+	}, nil
+}
+
+func (p *payloadCipher) openBatch(mb pb.MessageBatch) (pb.MessageBatch, error) {
+	if len(mb.EncryptionKeyId) == 0 {
+		if p != nil {
+			return pb.MessageBatch{}, ErrUnencryptedPayload
+		}
+		return mb, nil
+	}
+	aead, err := p.getOpenCipher(mb.EncryptionKeyId)
+	if err != nil {
+		return pb.MessageBatch{}, err
+	}
+	data, err := open(aead, mb.Sealed, getBatchAD(mb.EncryptionKeyId, mb))
+	if err != nil {
+		return pb.MessageBatch{}, err
+	}
+	// data is owned by the returned requests
+	var requests pb.MessageBatch
+	if err := requests.UnmarshalNoCopy(data); err != nil {
+		return pb.MessageBatch{}, err
+	}
+	mb.Requests = requests.Requests
+	mb.EncryptionKeyId = ""
+	mb.Sealed = nil
+	return mb, nil
+}
+
+func (p *payloadCipher) sealChunk(target string, c pb.Chunk) (pb.Chunk, error) {
+	keyID, aead, err := p.getSealCipher(target)
+	if err != nil {
+		return pb.Chunk{}, err
+	}
+	data, err := seal(aead, c.Data, getChunkAD(keyID, c))
+	if err != nil {
+		return pb.Chunk{}, err
+	}
+	c.Data = data
+	c.EncryptionKeyId = keyID
+	return c, nil
+}
+
+func (p *payloadCipher) openChunk(c pb.Chunk) (pb.Chunk, error) {
+	if len(c.EncryptionKeyId) == 0 {
+		if p != nil {
+			return pb.Chunk{}, ErrUnencryptedPayload
+		}
+		return c, nil
+	}
+	aead, err := p.getOpenCipher(c.EncryptionKeyId)
+	if err != nil {
+		return pb.Chunk{}, err
+	}
+	data, err := open(aead, c.Data, getChunkAD(c.EncryptionKeyId, c))
+	if err != nil {
+		return pb.Chunk{}, err
+	}
+	c.Data = data
+	c.EncryptionKeyId = ""
+	return c, nil
+}
+
+// sealedConnection is an IConnection that encrypts message batches before
+// sending them to the target NodeHost.
+type sealedConnection struct {
+	raftio.IConnection
+	cipher *payloadCipher
+	target string
+}
+
+func (c *sealedConnection) SendMessageBatch(batch pb.MessageBatch) error {
+	sealed, err := c.cipher.sealBatch(c.target, batch)
+	if err != nil {
+		return err
+	}
+	return c.IConnection.SendMessageBatch(sealed)
+}
+
+// sealedSnapshotConnection is an ISnapshotConnection that encrypts snapshot
+// chunks before sending them to the target NodeHost.
+type sealedSnapshotConnection struct {
+	raftio.ISnapshotConnection
+	cipher *payloadCipher
+	target string
+}
+
+func (c *sealedSnapshotConnection) SendChunk(chunk pb.Chunk) error {
+	sealed, err := c.cipher.sealChunk(c.target, chunk)
+	if err != nil {
+		return err
+	}
+	return c.ISnapshotConnection.SendChunk(sealed)
+}
+
+func (c *sealedSnapshotConnection) Resume(chunk pb.Chunk) (uint64, error) {
+	rc, ok := c.ISnapshotConnection.(raftio.IResumableSnapshotConnection)
+	if !ok {
+		return 0, nil
+	}
+	sealed, err := c.cipher.sealChunk(c.target, chunk)
+	if err != nil {
+		return 0, err
+	}
+	return rc.Resume(sealed)
+}
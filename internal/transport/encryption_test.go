@@ -0,0 +1,212 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftpb"
+)
+
+type testTransportEncryptionProvider struct {
+	keys map[string][]byte
+}
+
+func newTestTransportEncryptionProvider() *testTransportEncryptionProvider {
+	return &testTransportEncryptionProvider{
+		keys: map[string][]byte{
+			"key-1": bytes.Repeat([]byte{1}, 32),
+			"key-2": bytes.Repeat([]byte{2}, 32),
+		},
+	}
+}
+
+func (p *testTransportEncryptionProvider) KeyID(target string) string {
+	if target == "peer-2" {
+		return "key-2"
+	}
+	return "key-1"
+}
+
+func (p *testTransportEncryptionProvider) AEAD(keyID string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(p.keys[keyID])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func getTestEncryptionBatch() raftpb.MessageBatch {
+	return raftpb.MessageBatch{
+		DeploymentId:  1,
+		SourceAddress: "peer-1",
+		BinVer:        2,
+		Requests: []raftpb.Message{
+			{
+				Type:      raftpb.Replicate,
+				ClusterId: 100,
+				To:        2,
+				Entries:   []raftpb.Entry{{Index: 1, Cmd: []byte("test-data")}},
+			},
+		},
+	}
+}
+
+func TestMessageBatchCanBeSealedAndOpened(t *testing.T) {
+	p := newPayloadCipher(newTestTransportEncryptionProvider())
+	for _, target := range []string{"peer-1", "peer-2"} {
+		mb := getTestEncryptionBatch()
+		sealed, err := p.sealBatch(target, mb)
+		if err != nil {
+			t.Fatalf("failed to seal %v", err)
+		}
+		if len(sealed.Requests) != 0 || len(sealed.EncryptionKeyId) == 0 {
+			t.Fatalf("requests not sealed")
+		}
+		if bytes.Contains(sealed.Sealed, []byte("test-data")) {
+			t.Errorf("plain text found in sealed batch")
+		}
+		data, err := sealed.Marshal()
+		if err != nil {
+			t.Fatalf("failed to marshal %v", err)
+		}
+		var received raftpb.MessageBatch
+		if err := received.Unmarshal(data); err != nil {
+			t.Fatalf("failed to unmarshal %v", err)
+		}
+		opened, err := p.openBatch(received)
+		if err != nil {
+			t.Fatalf("failed to open %v", err)
+		}
+		if len(opened.Requests) != 1 ||
+			!bytes.Equal(opened.Requests[0].Entries[0].Cmd, []byte("test-data")) ||
+			opened.SourceAddress != mb.SourceAddress {
+			t.Errorf("unexpected opened batch %+v", opened)
+		}
+	}
+}
+
+func TestTamperedMessageBatchCanNotBeOpened(t *testing.T) {
+	p := newPayloadCipher(newTestTransportEncryptionProvider())
+	sealed, err := p.sealBatch("peer-1", getTestEncryptionBatch())
+	if err != nil {
+		t.Fatalf("failed to seal %v", err)
+	}
+	mb := sealed
+	mb.SourceAddress = "peer-3"
+	if _, err := p.openBatch(mb); err != ErrPayloadDecryption {
+		t.Errorf("unexpected error %v", err)
+	}
+	mb = sealed
+	mb.Sealed = append([]byte(nil), sealed.Sealed...)
+	mb.Sealed[len(mb.Sealed)-1] ^= 1
+	if _, err := p.openBatch(mb); err != ErrPayloadDecryption {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUnencryptedPayloadIsRejectedWhenEncryptionIsRequired(t *testing.T) {
+	p := newPayloadCipher(newTestTransportEncryptionProvider())
+	if _, err := p.openBatch(getTestEncryptionBatch()); err != ErrUnencryptedPayload {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := p.openChunk(raftpb.Chunk{Data: []byte("test-data")}); err != ErrUnencryptedPayload {
+		t.Errorf("unexpected error %v", err)
+	}
+	var np *payloadCipher
+	mb := getTestEncryptionBatch()
+	if opened, err := np.openBatch(mb); err != nil || len(opened.Requests) != 1 {
+		t.Errorf("unexpected result %v", err)
+	}
+	sealed, err := p.sealBatch("peer-1", mb)
+	if err != nil {
+		t.Fatalf("failed to seal %v", err)
+	}
+	if _, err := np.openBatch(sealed); err != ErrNoEncryptionProvider {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestChunkCanBeSealedAndOpened(t *testing.T) {
+	p := newPayloadCipher(newTestTransportEncryptionProvider())
+	chunk := raftpb.Chunk{
+		ClusterId: 100,
+		NodeId:    2,
+		From:      1,
+		ChunkId:   3,
+		Index:     200,
+		Data:      []byte("test-data"),
+	}
+	sealed, err := p.sealChunk("peer-2", chunk)
+	if err != nil {
+		t.Fatalf("failed to seal %v", err)
+	}
+	if sealed.EncryptionKeyId != "key-2" {
+		t.Errorf("unexpected key ID %s", sealed.EncryptionKeyId)
+	}
+	if bytes.Contains(sealed.Data, chunk.Data) {
+		t.Errorf("plain text found in sealed chunk")
+	}
+	opened, err := p.openChunk(sealed)
+	if err != nil {
+		t.Fatalf("failed to open %v", err)
+	}
+	if !bytes.Equal(opened.Data, chunk.Data) || opened.EncryptionKeyId != "" {
+		t.Errorf("unexpected opened chunk %+v", opened)
+	}
+	sealed.ChunkId = 4
+	if _, err := p.openChunk(sealed); err != ErrPayloadDecryption {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestEncryptedMessageCanBeSent(t *testing.T) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	trans, nodes, stopper, _ := newTestTransport(handler, false, fs)
+	defer trans.env.Stop()
+	defer trans.Stop()
+	defer stopper.Stop()
+	trans.cipher = newPayloadCipher(newTestTransportEncryptionProvider())
+	nodes.Add(100, 2, serverAddress)
+	for i := 0; i < 20; i++ {
+		msg := raftpb.Message{
+			Type:      raftpb.Heartbeat,
+			To:        2,
+			ClusterId: 100,
+		}
+		if !trans.Send(msg) {
+			t.Errorf("failed to send message")
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if handler.getRequestCount(100, 2) == 20 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("got %d, want 20", handler.getRequestCount(100, 2))
+}
+
+func TestEncryptedSnapshotCanBeSent(t *testing.T) {
+	fs := vfs.GetTestFS()
+	p := newPayloadCipher(newTestTransportEncryptionProvider())
+	testSnapshotCanBeSentWithCipher(t, snapshotChunkSize*3+1, 10000, false, p, fs)
+}
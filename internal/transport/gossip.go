@@ -15,17 +15,39 @@
 package transport
 
 import (
+	"bytes"
+	"errors"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/memberlist"
+	"github.com/lni/goutils/stringutil"
 	"github.com/lni/goutils/syncutil"
 
 	"github.com/lni/dragonboat/v3/config"
 )
 
+var (
+	// ErrInvalidGossipSeed indicates that the specified gossip seed list is
+	// empty or contains invalid addresses.
+	ErrInvalidGossipSeed = errors.New("invalid gossip seed")
+	// ErrGossipEncryptionNotEnabled indicates that gossip messages are not
+	// encrypted as no encryption key was configured.
+	ErrGossipEncryptionNotEnabled = errors.New("gossip encryption not enabled")
+	// ErrInvalidGossipEncryptionKey indicates that the specified key can not be
+	// used for encrypting gossip messages.
+	ErrInvalidGossipEncryptionKey = errors.New("invalid gossip encryption key")
+	// ErrUnknownGossipEncryptionKey indicates that the specified key has not
+	// been installed.
+	ErrUnknownGossipEncryptionKey = errors.New("unknown gossip encryption key")
+	// ErrPrimaryGossipEncryptionKey indicates that the primary key can not be
+	// removed.
+	ErrPrimaryGossipEncryptionKey = errors.New("primary gossip encryption key")
+)
+
 // NodeHostIDRegistry is a node registry backed by gossip. It is capable of
 // supporting NodeHosts with dynamic RaftAddress values.
 type NodeHostIDRegistry struct {
@@ -37,7 +59,8 @@ type NodeHostIDRegistry struct {
 func NewNodeHostIDRegistry(nhid string,
 	nhConfig config.NodeHostConfig, streamConnections uint64,
 	v config.TargetValidator) (INodeRegistry, error) {
-	gossip, err := newGossipManager(nhid, nhConfig)
+	gossip, err := newGossipManager(nhid,
+		nhConfig, NewClusterNames(), NewClusterLeaders())
 	if err != nil {
 		return nil, err
 	}
@@ -53,6 +76,63 @@ func (n *NodeHostIDRegistry) Stop() {
 	n.gossip.Stop()
 }
 
+// ClusterNames returns the Raft cluster names propagated by the gossip
+// service.
+func (n *NodeHostIDRegistry) ClusterNames() *ClusterNames {
+	return n.gossip.names
+}
+
+// ClusterLeaders returns the registry of Raft cluster leaders learned from the
+// gossip service.
+func (n *NodeHostIDRegistry) ClusterLeaders() *ClusterLeaders {
+	return n.gossip.leaders
+}
+
+// LeaderUpdated announces the leader of a Raft cluster to all members of the
+// gossip group, including observer-only members, when the leader is the
+// specified local node.
+func (n *NodeHostIDRegistry) LeaderUpdated(clusterID uint64,
+	nodeID uint64, leaderID uint64, term uint64) {
+	if nodeID == leaderID {
+		n.gossip.announceLeader(clusterID, leaderID, term)
+	}
+}
+
+// SetSeed replaces the seed list of the gossip service and tries to join the
+// gossip group using the new seed addresses. The specified seed list is also
+// used when the gossip service rejoins the gossip group later.
+func (n *NodeHostIDRegistry) SetSeed(seed []string) error {
+	return n.gossip.setSeed(seed)
+}
+
+// Seed returns the seed list currently used by the gossip service.
+func (n *NodeHostIDRegistry) Seed() []string {
+	return n.gossip.getSeed()
+}
+
+// AddEncryptionKey installs the specified key so it can be used for
+// decrypting incoming gossip messages.
+func (n *NodeHostIDRegistry) AddEncryptionKey(key []byte) error {
+	return n.gossip.addKey(key)
+}
+
+// UseEncryptionKey makes the specified installed key the primary key used for
+// encrypting outgoing gossip messages.
+func (n *NodeHostIDRegistry) UseEncryptionKey(key []byte) error {
+	return n.gossip.useKey(key)
+}
+
+// RemoveEncryptionKey removes the specified key, the primary key can not be
+// removed.
+func (n *NodeHostIDRegistry) RemoveEncryptionKey(key []byte) error {
+	return n.gossip.removeKey(key)
+}
+
+// NumEncryptionKeys returns the number of installed gossip encryption keys.
+func (n *NodeHostIDRegistry) NumEncryptionKeys() int {
+	return n.gossip.numKeys()
+}
+
 // AdvertiseAddress returns the advertise address of the gossip service.
 func (n *NodeHostIDRegistry) AdvertiseAddress() string {
 	return n.gossip.advertiseAddress()
@@ -63,6 +143,12 @@ func (n *NodeHostIDRegistry) NumMembers() int {
 	return n.gossip.numMembers()
 }
 
+// Members returns the sorted NodeHostID values of all live NodeHosts known by
+// the gossip service, including the local NodeHost.
+func (n *NodeHostIDRegistry) Members() []string {
+	return n.gossip.members()
+}
+
 // Add adds a new node with its known NodeHostID to the registry.
 func (n *NodeHostIDRegistry) Add(clusterID uint64,
 	nodeID uint64, target string) {
@@ -119,7 +205,10 @@ func (d *eventDelegate) start() {
 				return
 			case e := <-d.ch:
 				if e.Event == memberlist.NodeJoin || e.Event == memberlist.NodeUpdate {
-					d.nodes.Store(e.Node.Name, string(e.Node.Meta))
+					// observer-only members don't advertise any RaftAddress
+					if len(e.Node.Meta) > 0 {
+						d.nodes.Store(e.Node.Name, string(e.Node.Meta))
+					}
 				} else if e.Event == memberlist.NodeLeave {
 					d.nodes.Delete(e.Node.Name)
 				} else {
@@ -132,15 +221,34 @@ func (d *eventDelegate) start() {
 
 type delegate struct {
 	raftAddress string
+	names       *ClusterNames
+	leaders     *ClusterLeaders
+	broadcasts  *memberlist.TransmitLimitedQueue
 }
 
 func (d *delegate) NodeMeta(limit int) []byte {
 	return []byte(d.raftAddress)
 }
-func (d *delegate) NotifyMsg([]byte)                           {}
-func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
-func (d *delegate) LocalState(join bool) []byte                { return nil }
-func (d *delegate) MergeRemoteState(buf []byte, join bool)     {}
+
+// NotifyMsg handles leader records broadcasted by remote NodeHosts.
+func (d *delegate) NotifyMsg(data []byte) {
+	d.leaders.merge(data)
+}
+
+func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return d.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+// LocalState returns the known Raft cluster names to be exchanged with
+// remote NodeHosts during push/pull state synchronizations.
+func (d *delegate) LocalState(join bool) []byte {
+	return d.names.marshal()
+}
+
+// MergeRemoteState merges Raft cluster names received from remote NodeHosts.
+func (d *delegate) MergeRemoteState(buf []byte, join bool) {
+	d.names.merge(buf)
+}
 
 func parseAddress(addr string) (string, int, error) {
 	host, sp, err := net.SplitHostPort(addr)
@@ -155,15 +263,20 @@ func parseAddress(addr string) (string, int, error) {
 }
 
 type gossipManager struct {
-	nhConfig config.NodeHostConfig
-	cfg      *memberlist.Config
-	list     *memberlist.Memberlist
-	ed       *eventDelegate
-	stopper  *syncutil.Stopper
+	nhConfig   config.NodeHostConfig
+	cfg        *memberlist.Config
+	list       *memberlist.Memberlist
+	ed         *eventDelegate
+	names      *ClusterNames
+	leaders    *ClusterLeaders
+	broadcasts *memberlist.TransmitLimitedQueue
+	stopper    *syncutil.Stopper
+	mu         sync.Mutex
+	seed       []string
 }
 
-func newGossipManager(nhid string,
-	nhConfig config.NodeHostConfig) (*gossipManager, error) {
+func newGossipManager(nhid string, nhConfig config.NodeHostConfig,
+	names *ClusterNames, leaders *ClusterLeaders) (*gossipManager, error) {
 	stopper := syncutil.NewStopper()
 	ed := newEventDelegate(stopper)
 	cfg := memberlist.DefaultWANConfig()
@@ -179,6 +292,13 @@ func newGossipManager(nhid string,
 	}
 	cfg.BindAddr = bindAddr
 	cfg.BindPort = bindPort
+	if keys := nhConfig.Gossip.EncryptionKeys; len(keys) > 0 {
+		keyring, err := memberlist.NewKeyring(copyKeys(keys), copyKey(keys[0]))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Keyring = keyring
+	}
 	if len(nhConfig.Gossip.AdvertiseAddress) > 0 {
 		aAddr, aPort, err := parseAddress(nhConfig.Gossip.AdvertiseAddress)
 		if err != nil {
@@ -187,34 +307,58 @@ func newGossipManager(nhid string,
 		cfg.AdvertiseAddr = aAddr
 		cfg.AdvertisePort = aPort
 	}
-	cfg.Delegate = &delegate{raftAddress: nhConfig.RaftAddress}
+	broadcasts := &memberlist.TransmitLimitedQueue{RetransmitMult: 3}
+	cfg.Delegate = &delegate{
+		raftAddress: nhConfig.RaftAddress,
+		names:       names,
+		leaders:     leaders,
+		broadcasts:  broadcasts,
+	}
 	cfg.Events = ed
 	list, err := memberlist.Create(cfg)
 	if err != nil {
 		plog.Errorf("failed to create memberlist, %v", err)
 		return nil, err
 	}
-	seed := make([]string, 0, len(nhConfig.Gossip.Seed))
-	seed = append(seed, nhConfig.Gossip.Seed...)
+	broadcasts.NumNodes = list.NumMembers
 	g := &gossipManager{
-		nhConfig: nhConfig,
-		cfg:      cfg,
-		list:     list,
-		ed:       ed,
-		stopper:  stopper,
+		nhConfig:   nhConfig,
+		cfg:        cfg,
+		list:       list,
+		ed:         ed,
+		names:      names,
+		leaders:    leaders,
+		broadcasts: broadcasts,
+		stopper:    stopper,
+		seed:       copySeed(nhConfig.Gossip.Seed),
 	}
-	g.join(seed)
+	g.join(g.getSeed())
 	g.ed.start()
 	g.stopper.RunWorker(func() {
 		ticker := time.NewTicker(5 * time.Second)
 		defer ticker.Stop()
+		var refreshCh <-chan time.Time
+		if interval := nhConfig.Gossip.SeedRefreshInterval; interval > 0 {
+			refreshTicker := time.NewTicker(interval)
+			defer refreshTicker.Stop()
+			refreshCh = refreshTicker.C
+		}
 		for {
 			select {
 			case <-ticker.C:
-				if len(g.list.Members()) > 1 {
-					return
+				// keep trying to rejoin when all other known members are gone
+				if len(g.list.Members()) <= 1 {
+					g.join(g.getSeed())
 				}
-				g.join(seed)
+				// announce local leaders again for recently joined members
+				for _, rec := range g.leaders.announcedBy(g.cfg.Name) {
+					g.broadcasts.QueueBroadcast(&leaderBroadcast{rec: rec})
+				}
+			case <-refreshCh:
+				// hostnames and DNS SRV names in the seed list are resolved again on
+				// each join, this allows new NodeHosts behind the same DNS names to
+				// be discovered
+				g.join(g.getSeed())
 			case <-g.stopper.ShouldStop():
 				return
 			}
@@ -223,8 +367,102 @@ func newGossipManager(nhid string,
 	return g, nil
 }
 
+func copySeed(seed []string) []string {
+	result := make([]string, 0, len(seed))
+	return append(result, seed...)
+}
+
+func (g *gossipManager) getSeed() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return copySeed(g.seed)
+}
+
+func (g *gossipManager) setSeed(seed []string) error {
+	if len(seed) == 0 {
+		return ErrInvalidGossipSeed
+	}
+	for _, v := range seed {
+		if !stringutil.IsValidAddress(v) && !config.IsSRVAddress(v) {
+			return ErrInvalidGossipSeed
+		}
+	}
+	g.mu.Lock()
+	g.seed = copySeed(seed)
+	g.mu.Unlock()
+	g.join(seed)
+	return nil
+}
+
+func copyKey(key []byte) []byte {
+	return append([]byte{}, key...)
+}
+
+func copyKeys(keys [][]byte) [][]byte {
+	result := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, copyKey(key))
+	}
+	return result
+}
+
+func (g *gossipManager) hasKey(key []byte) bool {
+	for _, k := range g.cfg.Keyring.GetKeys() {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *gossipManager) addKey(key []byte) error {
+	if g.cfg.Keyring == nil {
+		return ErrGossipEncryptionNotEnabled
+	}
+	if !config.IsValidGossipEncryptionKey(key) {
+		return ErrInvalidGossipEncryptionKey
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.cfg.Keyring.AddKey(copyKey(key))
+}
+
+func (g *gossipManager) useKey(key []byte) error {
+	if g.cfg.Keyring == nil {
+		return ErrGossipEncryptionNotEnabled
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.hasKey(key) {
+		return ErrUnknownGossipEncryptionKey
+	}
+	return g.cfg.Keyring.UseKey(key)
+}
+
+func (g *gossipManager) removeKey(key []byte) error {
+	if g.cfg.Keyring == nil {
+		return ErrGossipEncryptionNotEnabled
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if bytes.Equal(g.cfg.Keyring.GetPrimaryKey(), key) {
+		return ErrPrimaryGossipEncryptionKey
+	}
+	if !g.hasKey(key) {
+		return ErrUnknownGossipEncryptionKey
+	}
+	return g.cfg.Keyring.RemoveKey(key)
+}
+
+func (g *gossipManager) numKeys() int {
+	if g.cfg.Keyring == nil {
+		return 0
+	}
+	return len(g.cfg.Keyring.GetKeys())
+}
+
 func (g *gossipManager) join(seed []string) {
-	if count, err := g.list.Join(seed); err != nil {
+	if count, err := g.list.Join(expandSRV(lookupSRV, seed)); err != nil {
 		plog.Errorf("failed to join the gossip group, %v", err)
 	} else {
 		plog.Infof("connected to %d gossip nodes", count)
@@ -251,10 +489,48 @@ func (g *gossipManager) GetRaftAddress(nhid string) (string, bool) {
 	return "", false
 }
 
+func (g *gossipManager) announceLeader(clusterID uint64,
+	leaderID uint64, term uint64) {
+	rec := LeaderRecord{
+		ClusterID:  clusterID,
+		LeaderID:   leaderID,
+		Term:       term,
+		NodeHostID: g.cfg.Name,
+	}
+	if g.leaders.update(rec) {
+		g.broadcasts.QueueBroadcast(&leaderBroadcast{rec: rec})
+	}
+}
+
 func (g *gossipManager) advertiseAddress() string {
 	return g.list.LocalNode().Address()
 }
 
+// numMembers returns the number of NodeHosts in the gossip group,
+// observer-only members are not counted.
 func (g *gossipManager) numMembers() int {
-	return g.list.NumMembers()
+	return len(g.members())
+}
+
+// members returns the NodeHostIDs of all NodeHosts in the gossip group,
+// observer-only members are not included.
+func (g *gossipManager) members() []string {
+	result := make([]string, 0)
+	for _, m := range g.list.Members() {
+		if len(m.Meta) > 0 {
+			result = append(result, m.Name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (g *gossipManager) nodeHosts() map[string]string {
+	result := make(map[string]string)
+	for _, m := range g.list.Members() {
+		if len(m.Meta) > 0 {
+			result[m.Name] = string(m.Meta)
+		}
+	}
+	return result
 }
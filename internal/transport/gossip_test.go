@@ -15,6 +15,7 @@
 package transport
 
 import (
+	"reflect"
 	"testing"
 	"time"
 
@@ -83,7 +84,8 @@ func TestGossipManagerCanBeCreatedAndStopped(t *testing.T) {
 			Seed:             []string{"127.0.0.1:26002"},
 		},
 	}
-	m, err := newGossipManager(nhid, nhConfig)
+	m, err := newGossipManager(nhid, nhConfig,
+		NewClusterNames(), NewClusterLeaders())
 	if err != nil {
 		t.Fatalf("gossip manager failed to start, %v", err)
 	}
@@ -129,12 +131,14 @@ func TestGossipManagerCanGossip(t *testing.T) {
 			Seed:             []string{"127.0.0.1:26001"},
 		},
 	}
-	m1, err := newGossipManager(nhid1, nhConfig1)
+	m1, err := newGossipManager(nhid1, nhConfig1,
+		NewClusterNames(), NewClusterLeaders())
 	if err != nil {
 		t.Fatalf("gossip manager failed to start, %v", err)
 	}
 	defer m1.Stop()
-	m2, err := newGossipManager(nhid2, nhConfig2)
+	m2, err := newGossipManager(nhid2, nhConfig2,
+		NewClusterNames(), NewClusterLeaders())
 	if err != nil {
 		t.Fatalf("gossip manager failed to start, %v", err)
 	}
@@ -158,3 +162,260 @@ func TestGossipManagerCanGossip(t *testing.T) {
 	}
 	t.Fatalf("failed to complete all queries")
 }
+
+func TestGossipManagerSeedCanBeUpdated(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	nhid1 := "nhid-12345"
+	nhConfig1 := config.NodeHostConfig{
+		RaftAddress: "localhost:27001",
+		Expert: config.ExpertConfig{
+			TestGossipProbeInterval: 10 * time.Millisecond,
+		},
+		Gossip: config.GossipConfig{
+			BindAddress:      "localhost:26001",
+			AdvertiseAddress: "127.0.0.1:26001",
+			Seed:             []string{"127.0.0.1:26003"},
+		},
+	}
+	nhid2 := "nhid-67890"
+	nhConfig2 := config.NodeHostConfig{
+		RaftAddress: "localhost:27002",
+		Expert: config.ExpertConfig{
+			TestGossipProbeInterval: 10 * time.Millisecond,
+		},
+		Gossip: config.GossipConfig{
+			BindAddress:      "localhost:26002",
+			AdvertiseAddress: "127.0.0.1:26002",
+			Seed:             []string{"127.0.0.1:26003"},
+		},
+	}
+	m1, err := newGossipManager(nhid1, nhConfig1,
+		NewClusterNames(), NewClusterLeaders())
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer m1.Stop()
+	m2, err := newGossipManager(nhid2, nhConfig2,
+		NewClusterNames(), NewClusterLeaders())
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer m2.Stop()
+	if err := m1.setSeed(nil); err != ErrInvalidGossipSeed {
+		t.Errorf("empty seed not rejected, %v", err)
+	}
+	if err := m1.setSeed([]string{"bad-address"}); err != ErrInvalidGossipSeed {
+		t.Errorf("invalid seed not rejected, %v", err)
+	}
+	if m1.numMembers() != 1 || m2.numMembers() != 1 {
+		t.Fatalf("unexpectedly joined")
+	}
+	seed := []string{"127.0.0.1:26002"}
+	if err := m1.setSeed(seed); err != nil {
+		t.Fatalf("failed to set seed, %v", err)
+	}
+	if !reflect.DeepEqual(m1.getSeed(), seed) {
+		t.Errorf("unexpected seed %v", m1.getSeed())
+	}
+	retry := 0
+	for retry < 1000 {
+		retry++
+		time.Sleep(5 * time.Millisecond)
+		if m1.numMembers() != 2 || m2.numMembers() != 2 {
+			continue
+		}
+		addr, ok := m2.GetRaftAddress(nhid1)
+		if !ok || addr != nhConfig1.RaftAddress {
+			continue
+		}
+		return
+	}
+	t.Fatalf("failed to join using the updated seed")
+}
+
+func getTestEncryptedGossipConfig(raftAddress string, bindAddress string,
+	seed string, keys ...[]byte) config.NodeHostConfig {
+	return config.NodeHostConfig{
+		RaftAddress: raftAddress,
+		Expert: config.ExpertConfig{
+			TestGossipProbeInterval: 10 * time.Millisecond,
+		},
+		Gossip: config.GossipConfig{
+			BindAddress:      bindAddress,
+			AdvertiseAddress: "127.0.0.1" + bindAddress[len("localhost"):],
+			Seed:             []string{seed},
+			EncryptionKeys:   keys,
+		},
+	}
+}
+
+func waitForGossipMembers(t *testing.T, count int, ms ...*gossipManager) {
+	for retry := 0; retry < 1000; retry++ {
+		joined := true
+		for _, m := range ms {
+			if m.numMembers() != count {
+				joined = false
+			}
+		}
+		if joined {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("failed to have %d gossip members", count)
+}
+
+func TestGossipEncryptionKeysCanBeRotated(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210fedcba9876543210")
+	m1, err := newGossipManager("nhid-12345",
+		getTestEncryptedGossipConfig("localhost:27001",
+			"localhost:26001", "127.0.0.1:26002", key1),
+		NewClusterNames(), NewClusterLeaders())
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer m1.Stop()
+	m2, err := newGossipManager("nhid-67890",
+		getTestEncryptedGossipConfig("localhost:27002",
+			"localhost:26002", "127.0.0.1:26001", key1),
+		NewClusterNames(), NewClusterLeaders())
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer m2.Stop()
+	waitForGossipMembers(t, 2, m1, m2)
+	if err := m1.useKey(key2); err != ErrUnknownGossipEncryptionKey {
+		t.Errorf("unknown key used, %v", err)
+	}
+	if err := m1.addKey([]byte("short")); err != ErrInvalidGossipEncryptionKey {
+		t.Errorf("invalid key added, %v", err)
+	}
+	for _, m := range []*gossipManager{m1, m2} {
+		if err := m.addKey(key2); err != nil {
+			t.Fatalf("failed to add key, %v", err)
+		}
+	}
+	for _, m := range []*gossipManager{m1, m2} {
+		if err := m.useKey(key2); err != nil {
+			t.Fatalf("failed to use key, %v", err)
+		}
+		if err := m.removeKey(key2); err != ErrPrimaryGossipEncryptionKey {
+			t.Errorf("primary key removed, %v", err)
+		}
+	}
+	for _, m := range []*gossipManager{m1, m2} {
+		if err := m.removeKey(key1); err != nil {
+			t.Fatalf("failed to remove key, %v", err)
+		}
+		if m.numKeys() != 1 {
+			t.Errorf("num of keys %d, want 1", m.numKeys())
+		}
+	}
+	if err := m1.removeKey(key1); err != ErrUnknownGossipEncryptionKey {
+		t.Errorf("removed key removed again, %v", err)
+	}
+	// a new member only knows the rotated key
+	m3, err := newGossipManager("nhid-24680",
+		getTestEncryptedGossipConfig("localhost:27003",
+			"localhost:26003", "127.0.0.1:26001", key2),
+		NewClusterNames(), NewClusterLeaders())
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer m3.Stop()
+	waitForGossipMembers(t, 3, m1, m2, m3)
+}
+
+func TestGossipEncryptionKeysRequireEncryption(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	m, err := newGossipManager("nhid-12345",
+		getTestEncryptedGossipConfig("localhost:27001",
+			"localhost:26001", "127.0.0.1:26002"),
+		NewClusterNames(), NewClusterLeaders())
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer m.Stop()
+	key := []byte("0123456789abcdef")
+	if err := m.addKey(key); err != ErrGossipEncryptionNotEnabled {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := m.useKey(key); err != ErrGossipEncryptionNotEnabled {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := m.removeKey(key); err != ErrGossipEncryptionNotEnabled {
+		t.Errorf("unexpected error %v", err)
+	}
+	if m.numKeys() != 0 {
+		t.Errorf("unexpected num of keys %d", m.numKeys())
+	}
+}
+
+func TestGossipObserverLearnsNodeHostsAndLeaders(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	nhid := "nhid-12345"
+	nhConfig := config.NodeHostConfig{
+		RaftAddress: "localhost:27001",
+		Expert: config.ExpertConfig{
+			TestGossipProbeInterval: 10 * time.Millisecond,
+		},
+		Gossip: config.GossipConfig{
+			BindAddress:      "localhost:26001",
+			AdvertiseAddress: "127.0.0.1:26001",
+			Seed:             []string{"127.0.0.1:26002"},
+		},
+	}
+	m, err := newGossipManager(nhid, nhConfig,
+		NewClusterNames(), NewClusterLeaders())
+	if err != nil {
+		t.Fatalf("gossip manager failed to start, %v", err)
+	}
+	defer m.Stop()
+	m.names.Set("test-cluster", 123)
+	m.announceLeader(123, 2, 5)
+	o, err := newGossipObserver(config.NodeHostConfig{
+		Expert: config.ExpertConfig{
+			TestGossipProbeInterval: 10 * time.Millisecond,
+		},
+		Gossip: config.GossipConfig{
+			BindAddress:      "localhost:26002",
+			AdvertiseAddress: "127.0.0.1:26002",
+			Seed:             []string{"127.0.0.1:26001"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("gossip observer failed to start, %v", err)
+	}
+	defer o.Stop()
+	for retry := 0; retry < 1000; retry++ {
+		time.Sleep(10 * time.Millisecond)
+		if m.list.NumMembers() != 2 {
+			continue
+		}
+		if m.numMembers() != 1 || len(m.members()) != 1 {
+			t.Fatalf("observer counted as a NodeHost")
+		}
+		if _, ok := m.GetRaftAddress(o.gossip.cfg.Name); ok {
+			t.Fatalf("observer has a RaftAddress")
+		}
+		nodeHosts := o.NodeHosts()
+		if len(nodeHosts) != 1 || nodeHosts[nhid] != nhConfig.RaftAddress {
+			continue
+		}
+		cid, ok := o.ClusterNames().GetClusterID("test-cluster")
+		if !ok || cid != 123 {
+			continue
+		}
+		rec, ok := o.ClusterLeaders().Get(123)
+		if !ok {
+			continue
+		}
+		if rec.LeaderID != 2 || rec.Term != 5 || rec.NodeHostID != nhid {
+			t.Fatalf("unexpected leader record %+v", rec)
+		}
+		return
+	}
+	t.Fatalf("failed to learn NodeHosts and leaders")
+}
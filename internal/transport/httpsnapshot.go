@@ -0,0 +1,281 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/lni/dragonboat/v3/internal/rsm"
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+)
+
+var (
+	// ErrInvalidSnapshotFilePath indicates that the requested snapshot file path
+	// is not within the snapshot directory.
+	ErrInvalidSnapshotFilePath = errors.New("invalid snapshot file path")
+	// ErrCorruptedSnapshotFile indicates that the downloaded snapshot file
+	// doesn't match its size or checksum.
+	ErrCorruptedSnapshotFile = errors.New("corrupted snapshot file")
+)
+
+// SnapshotFileHandler is a http.Handler that serves snapshot files of local
+// Raft nodes. Range requests are supported so snapshot files can be pulled
+// by receivers in parallel or resumed after failures. Requests are expected to
+// specify the cluster, node and file query parameters, the file parameter is
+// the path of the snapshot file relative to the snapshot directory of the
+// specified node.
+type SnapshotFileHandler struct {
+	dir server.SnapshotDirFunc
+	fs  vfs.IFS
+}
+
+var _ http.Handler = (*SnapshotFileHandler)(nil)
+
+// NewSnapshotFileHandler creates a new SnapshotFileHandler instance.
+func NewSnapshotFileHandler(dir server.SnapshotDirFunc,
+	fs vfs.IFS) *SnapshotFileHandler {
+	return &SnapshotFileHandler{dir: dir, fs: fs}
+}
+
+// GetSnapshotFileURL returns the URL of the specified snapshot file served by
+// the SnapshotFileHandler mounted at baseURL.
+func GetSnapshotFileURL(baseURL string,
+	clusterID uint64, nodeID uint64, file string) string {
+	v := url.Values{}
+	v.Set("cluster", strconv.FormatUint(clusterID, 10))
+	v.Set("node", strconv.FormatUint(nodeID, 10))
+	v.Set("file", file)
+	return fmt.Sprintf("%s?%s", baseURL, v.Encode())
+}
+
+// ServeHTTP serves the requested snapshot file.
+func (h *SnapshotFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fp, err := h.getFilepath(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := h.fs.Open(fp)
+	if err != nil {
+		http.Error(w, "snapshot file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.Error(w, "snapshot file not found", http.StatusNotFound)
+		return
+	}
+	rs := io.NewSectionReader(f, 0, fi.Size())
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), rs)
+}
+
+func (h *SnapshotFileHandler) getFilepath(q url.Values) (string, error) {
+	clusterID, err := strconv.ParseUint(q.Get("cluster"), 10, 64)
+	if err != nil {
+		return "", err
+	}
+	nodeID, err := strconv.ParseUint(q.Get("node"), 10, 64)
+	if err != nil {
+		return "", err
+	}
+	file := q.Get("file")
+	if len(file) == 0 || path.IsAbs(file) {
+		return "", ErrInvalidSnapshotFilePath
+	}
+	file = path.Clean(file)
+	if file == ".." || strings.HasPrefix(file, "../") {
+		return "", ErrInvalidSnapshotFilePath
+	}
+	parts := append([]string{h.dir(clusterID, nodeID)},
+		strings.Split(file, "/")...)
+	return h.fs.PathJoin(parts...), nil
+}
+
+// DownloadSnapshotFile downloads the snapshot file at the specified URL to
+// the target path using HTTP range requests. When the target file already
+// exists, the download is resumed from the end of the existing content if
+// supported by the underlying file system, it is restarted from the
+// beginning otherwise. The size of the downloaded file is checked against the
+// size reported by the server and snapshot images are checked against their
+// checksums, a corrupted target file is removed.
+func DownloadSnapshotFile(ctx context.Context,
+	client *http.Client, fileURL string, target string, fs vfs.IFS) error {
+	offset := int64(0)
+	if fi, err := fs.Stat(target); err == nil {
+		offset = fi.Size()
+	}
+	for {
+		size, restart, err := downloadFrom(ctx,
+			client, fileURL, target, offset, fs)
+		if err != nil {
+			return err
+		}
+		if restart {
+			offset = 0
+			continue
+		}
+		return verifyDownloadedFile(target, size, fs)
+	}
+}
+
+// downloadFrom downloads the content of the snapshot file from the specified
+// offset. It returns the size of the snapshot file reported by the server, -1
+// when unknown, and a boolean value indicating whether the download should be
+// restarted from the beginning.
+func downloadFrom(ctx context.Context, client *http.Client,
+	fileURL string, target string, offset int64, fs vfs.IFS) (int64, bool, error) {
+	var f vfs.File
+	if offset > 0 {
+		var err error
+		if f, err = openForResume(target, fs); err != nil {
+			return 0, false, err
+		}
+		if f == nil {
+			return 0, true, nil
+		}
+		defer f.Close()
+	}
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	size := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if size, err = getContentRangeSize(resp.Header); err != nil {
+			return 0, false, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset == 0 {
+			return 0, false, fmt.Errorf("failed to download %s, status %s",
+				fileURL, resp.Status)
+		}
+		if size, err = getContentRangeSize(resp.Header); err != nil {
+			return 0, false, err
+		}
+		// the target file is complete only when its size matches the size of the
+		// remote file, it is downloaded again otherwise
+		return size, size != offset, nil
+	case http.StatusOK:
+		// range not honored by the server, restart from the beginning with the
+		// existing content truncated
+		size = resp.ContentLength
+		offset = 0
+		if f != nil {
+			if err := f.Close(); err != nil {
+				return 0, false, err
+			}
+		}
+		if f, err = fs.Create(target); err != nil {
+			return 0, false, err
+		}
+		defer f.Close()
+	default:
+		return 0, false, fmt.Errorf("failed to download %s, status %s",
+			fileURL, resp.Status)
+	}
+	var w io.Writer = f
+	if wa, ok := f.(io.WriterAt); ok {
+		w = &offsetWriter{w: wa, offset: offset}
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return 0, false, err
+	}
+	return size, false, f.Sync()
+}
+
+// openForResume opens the existing target file for writing. It returns a nil
+// file when writing at the end of the existing content is not supported.
+func openForResume(target string, fs vfs.IFS) (vfs.File, error) {
+	f, err := fs.ReuseForWrite(target, target)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(io.WriterAt); !ok {
+		return nil, f.Close()
+	}
+	return f, nil
+}
+
+// getContentRangeSize returns the complete length of the file specified in
+// the Content-Range header, -1 is returned when the length is unknown.
+func getContentRangeSize(h http.Header) (int64, error) {
+	v := h.Get("Content-Range")
+	idx := strings.LastIndex(v, "/")
+	if !strings.HasPrefix(v, "bytes ") || idx < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %s", v)
+	}
+	if v[idx+1:] == "*" {
+		return -1, nil
+	}
+	return strconv.ParseInt(v[idx+1:], 10, 64)
+}
+
+// verifyDownloadedFile checks the size of the downloaded file, snapshot
+// images are also checked against their checksums. The downloaded file is
+// removed when it is corrupted.
+func verifyDownloadedFile(target string, size int64, fs vfs.IFS) error {
+	fi, err := fs.Stat(target)
+	if err != nil {
+		return err
+	}
+	valid := size < 0 || fi.Size() == size
+	if valid && strings.HasSuffix(target, "."+server.SnapshotFileSuffix) {
+		if valid, err = rsm.ValidateSnapshotFile(target, fs); err != nil {
+			return err
+		}
+	}
+	if !valid {
+		if err := fs.RemoveAll(target); err != nil {
+			return err
+		}
+		return ErrCorruptedSnapshotFile
+	}
+	return nil
+}
+
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(data []byte) (int, error) {
+	n, err := o.w.WriteAt(data, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
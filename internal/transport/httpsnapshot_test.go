@@ -0,0 +1,167 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+)
+
+const (
+	httpSnapshotTestDir = "http_snapshot_test_dir_safe_to_delete"
+)
+
+func runHTTPSnapshotTest(t *testing.T,
+	tf func(t *testing.T, url string, data []byte, fs vfs.IFS)) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(httpSnapshotTestDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := fs.MkdirAll(fs.PathJoin(httpSnapshotTestDir, "src"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(httpSnapshotTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	for _, fn := range []string{"test.data", "test.gbsnap"} {
+		f, err := fs.Create(fs.PathJoin(httpSnapshotTestDir, "src", fn))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := f.Write(data); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	dir := func(clusterID uint64, nodeID uint64) string {
+		return fs.PathJoin(httpSnapshotTestDir, "src")
+	}
+	server := httptest.NewServer(NewSnapshotFileHandler(dir, fs))
+	defer server.Close()
+	tf(t, server.URL, data, fs)
+}
+
+func TestSnapshotFileCanBeDownloaded(t *testing.T) {
+	tf := func(t *testing.T, url string, data []byte, fs vfs.IFS) {
+		target := fs.PathJoin(httpSnapshotTestDir, "test.data")
+		fileURL := GetSnapshotFileURL(url, 1, 2, "test.data")
+		err := DownloadSnapshotFile(context.Background(),
+			http.DefaultClient, fileURL, target, fs)
+		if err != nil {
+			t.Fatalf("failed to download %v", err)
+		}
+		checkDownloadedFile(t, target, data, fs)
+	}
+	runHTTPSnapshotTest(t, tf)
+}
+
+func TestCorruptedSnapshotImageIsRemoved(t *testing.T) {
+	tf := func(t *testing.T, url string, data []byte, fs vfs.IFS) {
+		target := fs.PathJoin(httpSnapshotTestDir, "test.gbsnap")
+		fileURL := GetSnapshotFileURL(url, 1, 2, "test.gbsnap")
+		err := DownloadSnapshotFile(context.Background(),
+			http.DefaultClient, fileURL, target, fs)
+		if err != ErrCorruptedSnapshotFile {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if _, err := fs.Stat(target); !vfs.IsNotExist(err) {
+			t.Errorf("corrupted snapshot image not removed, %v", err)
+		}
+	}
+	runHTTPSnapshotTest(t, tf)
+}
+
+func TestSnapshotFileDownloadCanBeResumed(t *testing.T) {
+	tf := func(t *testing.T, url string, data []byte, fs vfs.IFS) {
+		target := fs.PathJoin(httpSnapshotTestDir, "test.data")
+		f, err := fs.Create(target)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := f.Write(data[:1000]); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("%v", err)
+		}
+		fileURL := GetSnapshotFileURL(url, 1, 2, "test.data")
+		err = DownloadSnapshotFile(context.Background(),
+			http.DefaultClient, fileURL, target, fs)
+		if err != nil {
+			t.Fatalf("failed to download %v", err)
+		}
+		checkDownloadedFile(t, target, data, fs)
+		// already completed
+		err = DownloadSnapshotFile(context.Background(),
+			http.DefaultClient, fileURL, target, fs)
+		if err != nil {
+			t.Fatalf("failed to download %v", err)
+		}
+		checkDownloadedFile(t, target, data, fs)
+	}
+	runHTTPSnapshotTest(t, tf)
+}
+
+func TestSnapshotFileHandlerRejectsInvalidPath(t *testing.T) {
+	tf := func(t *testing.T, url string, data []byte, fs vfs.IFS) {
+		for _, file := range []string{"", "../src/test.gbsnap", "/etc/passwd"} {
+			resp, err := http.Get(GetSnapshotFileURL(url, 1, 2, file))
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("file %s, unexpected status %d", file, resp.StatusCode)
+			}
+		}
+		resp, err := http.Get(GetSnapshotFileURL(url, 1, 2, "missing.gbsnap"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("unexpected status %d", resp.StatusCode)
+		}
+	}
+	runHTTPSnapshotTest(t, tf)
+}
+
+func checkDownloadedFile(t *testing.T, fp string, data []byte, fs vfs.IFS) {
+	f, err := fs.Open(fp)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	downloaded, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Errorf("downloaded content changed")
+	}
+}
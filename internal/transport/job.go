@@ -17,7 +17,9 @@ package transport
 import (
 	"context"
 	"errors"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/lni/goutils/logutil"
 
@@ -28,6 +30,16 @@ import (
 
 const (
 	streamingChanLength = 4
+	// maxResumeCount is the max number of times a broken snapshot transfer can
+	// be resumed.
+	maxResumeCount = 3
+	// parallelChunkWindow is the max distance between the first chunk not yet
+	// sent and other chunks being sent by parallel streams.
+	parallelChunkWindow = maxPendingChunks / 4
+)
+
+var (
+	resumeDelay = 100 * time.Millisecond
 )
 
 var (
@@ -72,6 +84,10 @@ type job struct {
 	fs           vfs.IFS
 	ctx          context.Context
 	transport    raftio.ITransport
+	cipher       *payloadCipher
+	peers        *peerMetrics
+	addr         string
+	pullURL      string
 	ch           chan pb.Chunk
 	completed    chan struct{}
 	stopc        chan struct{}
@@ -79,6 +95,8 @@ type job struct {
 	deploymentID uint64
 	nodeID       uint64
 	clusterID    uint64
+	sent         uint64
+	streams      uint64
 	streaming    bool
 }
 
@@ -115,17 +133,55 @@ func (j *job) close() {
 }
 
 func (j *job) connect(addr string) error {
-	conn, err := j.transport.GetSnapshotConnection(j.ctx, addr)
+	conn, err := j.dial(addr)
 	if err != nil {
-		plog.Errorf("failed to get a job to %s, %v", addr, err)
+		plog.Debugf("failed to get a job to %s, %v", addr, err)
 		return err
 	}
 	j.conn = conn
+	j.addr = addr
 	return nil
 }
 
+func (j *job) dial(addr string) (raftio.ISnapshotConnection, error) {
+	conn, err := j.transport.GetSnapshotConnection(j.ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if j.cipher != nil {
+		conn = &sealedSnapshotConnection{
+			ISnapshotConnection: conn,
+			cipher:              j.cipher,
+			target:              addr,
+		}
+	}
+	return conn, nil
+}
+
+// resume reconnects to the target and returns the ID of the next chunk
+// expected by the target for the snapshot the specified chunk belongs to.
+func (j *job) resume(first pb.Chunk) (uint64, error) {
+	j.close()
+	j.conn = nil
+	select {
+	case <-time.After(resumeDelay):
+	case <-j.stopc:
+		return 0, ErrStopped
+	}
+	if err := j.connect(j.addr); err != nil {
+		return 0, err
+	}
+	rc, ok := j.conn.(raftio.IResumableSnapshotConnection)
+	if !ok {
+		return 0, nil
+	}
+	first.DeploymentId = j.deploymentID
+	first.Data = nil
+	return rc.Resume(first)
+}
+
 func (j *job) addSnapshot(m pb.Message) {
-	chunks := splitSnapshotMessage(m, j.fs)
+	chunks := splitSnapshotMessage(m, j.pullURL, j.fs)
 	if len(chunks) != cap(j.ch) {
 		plog.Panicf("cap of ch is %d, want %d", cap(j.ch), len(chunks))
 	}
@@ -218,33 +274,212 @@ func (j *job) sendSnapshot() error {
 }
 
 func (j *job) sendChunks(chunks []pb.Chunk) error {
+	if j.streams <= 1 || len(chunks) <= 2 {
+		return j.sendChunksFrom(chunks, 0, 0)
+	}
+	err := j.sendChunksInParallel(chunks)
+	if err == nil || err == errChunkSendSkipped || err == ErrStopped {
+		return err
+	}
+	// continue from the next chunk expected by the target using a single
+	// connection
+	plog.Warningf("parallel streams to %s failed, %v",
+		dn(j.clusterID, j.nodeID), err)
+	next, rerr := j.resume(chunks[0])
+	if rerr != nil {
+		plog.Warningf("failed to resume snapshot to %s, %v",
+			dn(j.clusterID, j.nodeID), rerr)
+		return err
+	}
+	if next >= uint64(len(chunks)) || chunks[next].ChunkId != next {
+		plog.Errorf("unexpected resume point %d", next)
+		return err
+	}
+	return j.sendChunksFrom(chunks, int(next), 1)
+}
+
+func (j *job) sendChunksFrom(chunks []pb.Chunk, first int, resumed int) error {
 	chunkData := make([]byte, snapshotChunkSize)
-	for _, chunk := range chunks {
+	for idx := first; idx < len(chunks); idx++ {
+		chunk := chunks[idx]
 		select {
 		case <-j.stopc:
 			return ErrStopped
 		default:
 		}
-		chunk.DeploymentId = j.deploymentID
-		if !chunk.Witness {
-			data, err := loadChunkData(chunk, chunkData, j.fs)
-			if err != nil {
-				plog.Errorf("failed to read the snapshot chunk, %v", err)
+		if err := j.sendChunkData(chunk, j.conn, chunkData); err != nil {
+			plog.Debugf("send chunk to %s failed", dn(chunk.ClusterId, chunk.NodeId))
+			if err == errChunkSendSkipped || resumed >= maxResumeCount {
 				return err
 			}
-			chunk.Data = data
+			resumed++
+			next, rerr := j.resume(chunks[0])
+			if rerr != nil {
+				plog.Warningf("failed to resume snapshot to %s, %v",
+					dn(chunk.ClusterId, chunk.NodeId), rerr)
+				return err
+			}
+			if next >= uint64(len(chunks)) || chunks[next].ChunkId != next {
+				plog.Errorf("unexpected resume point %d", next)
+				return err
+			}
+			plog.Infof("resuming snapshot to %s from chunk %d",
+				dn(chunk.ClusterId, chunk.NodeId), next)
+			idx = int(next) - 1
+			continue
 		}
-		if err := j.sendChunk(chunk, j.conn); err != nil {
-			plog.Debugf("send chunk to %s failed", dn(chunk.ClusterId, chunk.NodeId))
+	}
+	return nil
+}
+
+// sendChunksInParallel sends the first chunk using the connection of the job,
+// remaining chunks are then sent using j.streams concurrent connections with
+// chunk i sent by stream i%j.streams.
+func (j *job) sendChunksInParallel(chunks []pb.Chunk) error {
+	conns := []raftio.ISnapshotConnection{j.conn}
+	defer func() {
+		for _, conn := range conns[1:] {
+			conn.Close()
+		}
+	}()
+	for uint64(len(conns)) < j.streams {
+		conn, err := j.dial(j.addr)
+		if err != nil {
 			return err
 		}
-		if f := j.postSend.Load(); f != nil {
-			f.(func(pb.Chunk))(chunk)
+		conns = append(conns, conn)
+	}
+	if err := j.sendChunkData(chunks[0],
+		j.conn, make([]byte, snapshotChunkSize)); err != nil {
+		return err
+	}
+	w := newChunkWindow(chunks[1].ChunkId, parallelChunkWindow)
+	queues := make([]chan pb.Chunk, len(conns))
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i := range conns {
+		queues[i] = make(chan pb.Chunk, parallelChunkWindow)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chunkData := make([]byte, snapshotChunkSize)
+			for chunk := range queues[i] {
+				if errs[i] != nil {
+					continue
+				}
+				if err := j.sendChunkData(chunk, conns[i], chunkData); err != nil {
+					errs[i] = err
+					w.fail()
+					continue
+				}
+				w.done(chunk.ChunkId)
+			}
+		}(i)
+	}
+	var err error
+	for idx := 1; idx < len(chunks); idx++ {
+		select {
+		case <-j.stopc:
+			err = ErrStopped
+		default:
+		}
+		if err != nil || !w.wait(chunks[idx].ChunkId) {
+			break
+		}
+		queues[idx%len(queues)] <- chunks[idx]
+	}
+	for _, q := range queues {
+		close(q)
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	for _, e := range errs {
+		if e != nil {
+			return e
 		}
 	}
 	return nil
 }
 
+// sendChunkData loads the data of the specified chunk into the data buffer
+// and sends the chunk using the specified connection.
+func (j *job) sendChunkData(chunk pb.Chunk,
+	conn raftio.ISnapshotConnection, data []byte) error {
+	chunk.DeploymentId = j.deploymentID
+	if !chunk.Witness && len(chunk.PullUrl) == 0 {
+		v, err := loadChunkData(chunk, data, j.fs)
+		if err != nil {
+			plog.Errorf("failed to read the snapshot chunk, %v", err)
+			return err
+		}
+		chunk.Data = v
+		chunk.Checksum = getChunkChecksum(v)
+	}
+	if err := j.sendChunk(chunk, conn); err != nil {
+		return err
+	}
+	if f := j.postSend.Load(); f != nil {
+		f.(func(pb.Chunk))(chunk)
+	}
+	return nil
+}
+
+// chunkWindow limits how far ahead chunks sent by parallel streams can be of
+// the first chunk not yet sent, it bounds the number of out of order chunks
+// buffered by the receiver.
+type chunkWindow struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	sent   map[uint64]struct{}
+	low    uint64
+	size   uint64
+	failed bool
+}
+
+func newChunkWindow(low uint64, size uint64) *chunkWindow {
+	w := &chunkWindow{
+		sent: make(map[uint64]struct{}),
+		low:  low,
+		size: size,
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+// wait blocks until the specified chunk is allowed to be sent. It returns a
+// boolean value indicating whether the chunk should be sent.
+func (w *chunkWindow) wait(chunkID uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for !w.failed && chunkID >= w.low+w.size {
+		w.cond.Wait()
+	}
+	return !w.failed
+}
+
+func (w *chunkWindow) done(chunkID uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sent[chunkID] = struct{}{}
+	for {
+		if _, ok := w.sent[w.low]; !ok {
+			break
+		}
+		delete(w.sent, w.low)
+		w.low++
+	}
+	w.cond.Broadcast()
+}
+
+func (w *chunkWindow) fail() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failed = true
+	w.cond.Broadcast()
+}
+
 func (j *job) sendChunk(c pb.Chunk,
 	conn raftio.ISnapshotConnection) error {
 	if f := j.preSend.Load(); f != nil {
@@ -253,7 +488,18 @@ func (j *job) sendChunk(c pb.Chunk,
 			plog.Debugf("chunk to %s skipped", dn(c.ClusterId, c.NodeId))
 			return errChunkSendSkipped
 		}
-		return conn.SendChunk(updated)
+		return j.chunkSent(c, conn.SendChunk(updated))
+	}
+	return j.chunkSent(c, conn.SendChunk(c))
+}
+
+// chunkSent records the size of the specified chunk as snapshot bytes in
+// flight when it is successfully sent.
+func (j *job) chunkSent(c pb.Chunk, err error) error {
+	if err == nil && j.peers != nil {
+		sz := uint64(len(c.Data))
+		atomic.AddUint64(&j.sent, sz)
+		j.peers.snapshotSent(j.addr, sz)
 	}
-	return conn.SendChunk(c)
+	return err
 }
@@ -53,7 +53,7 @@ func TestSendSavedSnapshotPutsAllChunksInCh(t *testing.T) {
 			FileSize: 1024 * 1024 * 512,
 		},
 	}
-	chunks := splitSnapshotMessage(m, fs)
+	chunks := splitSnapshotMessage(m, "", fs)
 	transport := NewNOOPTransport(config.NodeHostConfig{}, nil, nil)
 	c := newJob(context.Background(), 1, 1, 1, false, len(chunks), transport, nil, fs)
 	if cap(c.ch) != len(chunks) {
@@ -0,0 +1,118 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	leaderMessageType byte = 1
+)
+
+// LeaderRecord describes the leader of a Raft cluster as announced by the
+// NodeHost running the leader node.
+type LeaderRecord struct {
+	ClusterID  uint64 `json:"c"`
+	LeaderID   uint64 `json:"l"`
+	Term       uint64 `json:"t"`
+	NodeHostID string `json:"n"`
+}
+
+// ClusterLeaders is a registry of Raft cluster leaders learned from the gossip
+// service. For each Raft cluster, only the record with the highest term is
+// kept.
+type ClusterLeaders struct {
+	mu      sync.RWMutex
+	leaders map[uint64]LeaderRecord
+}
+
+// NewClusterLeaders creates a new ClusterLeaders instance.
+func NewClusterLeaders() *ClusterLeaders {
+	return &ClusterLeaders{leaders: make(map[uint64]LeaderRecord)}
+}
+
+// Get returns the leader record of the specified Raft cluster.
+func (c *ClusterLeaders) Get(clusterID uint64) (LeaderRecord, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.leaders[clusterID]
+	return v, ok
+}
+
+func (c *ClusterLeaders) update(rec LeaderRecord) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.leaders[rec.ClusterID]; ok && v.Term >= rec.Term {
+		return false
+	}
+	c.leaders[rec.ClusterID] = rec
+	return true
+}
+
+func (c *ClusterLeaders) announcedBy(nhid string) []LeaderRecord {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	result := make([]LeaderRecord, 0)
+	for _, v := range c.leaders {
+		if v.NodeHostID == nhid {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (c *ClusterLeaders) merge(data []byte) {
+	if len(data) < 2 || data[0] != leaderMessageType {
+		return
+	}
+	var rec LeaderRecord
+	if err := json.Unmarshal(data[1:], &rec); err != nil {
+		plog.Errorf("failed to unmarshal leader record, %v", err)
+		return
+	}
+	c.update(rec)
+}
+
+type leaderBroadcast struct {
+	rec LeaderRecord
+}
+
+var _ memberlist.NamedBroadcast = (*leaderBroadcast)(nil)
+
+func (b *leaderBroadcast) Name() string {
+	return fmt.Sprintf("leader-%d", b.rec.ClusterID)
+}
+
+func (b *leaderBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	if o, ok := other.(*leaderBroadcast); ok {
+		return o.rec.ClusterID == b.rec.ClusterID
+	}
+	return false
+}
+
+func (b *leaderBroadcast) Message() []byte {
+	data, err := json.Marshal(b.rec)
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{leaderMessageType}, data...)
+}
+
+func (b *leaderBroadcast) Finished() {}
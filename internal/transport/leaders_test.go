@@ -0,0 +1,45 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"testing"
+)
+
+func TestClusterLeadersKeepsHighestTerm(t *testing.T) {
+	c := NewClusterLeaders()
+	if !c.update(LeaderRecord{ClusterID: 1, LeaderID: 2, Term: 5, NodeHostID: "a"}) {
+		t.Fatalf("failed to update")
+	}
+	if c.update(LeaderRecord{ClusterID: 1, LeaderID: 3, Term: 4, NodeHostID: "b"}) {
+		t.Fatalf("stale record accepted")
+	}
+	b := &leaderBroadcast{
+		rec: LeaderRecord{ClusterID: 1, LeaderID: 3, Term: 6, NodeHostID: "b"},
+	}
+	c.merge(b.Message())
+	rec, ok := c.Get(1)
+	if !ok || rec.LeaderID != 3 || rec.Term != 6 || rec.NodeHostID != "b" {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	if len(c.announcedBy("a")) != 0 || len(c.announcedBy("b")) != 1 {
+		t.Errorf("unexpected announced records")
+	}
+	c.merge([]byte{leaderMessageType + 1, '{', '}'})
+	c.merge(nil)
+	if rec, _ := c.Get(1); rec.Term != 6 {
+		t.Errorf("record unexpectedly changed")
+	}
+}
@@ -15,7 +15,13 @@
 package transport
 
 import (
+	"sync"
+	"time"
+
 	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/raftio"
 )
 
 type transportMetrics struct {
@@ -30,6 +36,7 @@ type transportMetrics struct {
 	messageReceived    *metrics.Counter
 	messageRecvDropped *metrics.Counter
 	snapshotReceived   *metrics.Counter
+	messageBatchSize   *server.BatchSizeHistogram
 	useMetrics         bool
 }
 
@@ -45,6 +52,8 @@ func newTransportMetrics(useMetrics bool,
 		tm.messageDropped = metrics.GetOrCreateCounter(name)
 		name = "dragonboat_transport_message_send_success_total"
 		tm.messageSent = metrics.GetOrCreateCounter(name)
+		name = "dragonboat_transport_message_batch_size"
+		tm.messageBatchSize = server.NewBatchSizeHistogram(name)
 		name = "dragonboat_transport_snapshot_send_failure_total"
 		tm.snapshotDropped = metrics.GetOrCreateCounter(name)
 		name = "dragonboat_transport_snapshot_send_success_total"
@@ -63,6 +72,20 @@ func newTransportMetrics(useMetrics bool,
 	return tm
 }
 
+// addSnapshotStreamGauges registers gauges for the number of active and
+// queued outgoing snapshot streams and the number of incoming snapshot streams.
+func (tm *transportMetrics) addSnapshotStreamGauges(active func() float64,
+	queued func() float64, incoming func() float64) {
+	if tm.useMetrics {
+		name := "dragonboat_transport_snapshot_streams_active"
+		metrics.GetOrCreateGauge(name, active)
+		name = "dragonboat_transport_snapshot_streams_queued"
+		metrics.GetOrCreateGauge(name, queued)
+		name = "dragonboat_transport_snapshot_streams_incoming"
+		metrics.GetOrCreateGauge(name, incoming)
+	}
+}
+
 func (tm *transportMetrics) messageConnectionFailure() {
 	if tm.useMetrics {
 		tm.messageConnFailed.Add(1)
@@ -87,6 +110,7 @@ func (tm *transportMetrics) receivedMessages(ss uint64,
 func (tm *transportMetrics) messageSendSuccess(count uint64) {
 	if tm.useMetrics {
 		tm.messageSent.Add(int(count))
+		tm.messageBatchSize.Observe(count)
 	}
 }
 
@@ -107,3 +131,76 @@ func (tm *transportMetrics) snapshotSendFailure() {
 		tm.snapshotDropped.Add(1)
 	}
 }
+
+// peerMetrics reports per remote NodeHost metrics to the optional
+// raftio.ITransportMetrics instance, all its methods are no-op when no such
+// instance is provided.
+type peerMetrics struct {
+	listener raftio.ITransportMetrics
+	mu       sync.Mutex
+	inflight map[string]uint64
+}
+
+func newPeerMetrics(listener raftio.ITransportMetrics) *peerMetrics {
+	return &peerMetrics{
+		listener: listener,
+		inflight: make(map[string]uint64),
+	}
+}
+
+func (pm *peerMetrics) batchSent(addr string,
+	count uint64, latency time.Duration) {
+	if pm.listener != nil {
+		pm.listener.MessageBatchSent(addr, count, latency)
+	}
+}
+
+func (pm *peerMetrics) dropped(addr string, count uint64) {
+	if pm.listener != nil && count > 0 {
+		pm.listener.MessageDropped(addr, count)
+	}
+}
+
+func (pm *peerMetrics) queueLength(addr string, sq sendQueue) {
+	if pm.listener != nil {
+		pm.listener.SendQueueLength(addr, uint64(len(sq.ch)+len(sq.pch)))
+	}
+}
+
+func (pm *peerMetrics) reconnected(addr string) {
+	if pm.listener != nil {
+		pm.listener.Reconnected(addr)
+	}
+}
+
+// snapshotSent records that sz snapshot bytes were sent to addr by an ongoing
+// snapshot transfer.
+func (pm *peerMetrics) snapshotSent(addr string, sz uint64) {
+	if pm.listener == nil || sz == 0 {
+		return
+	}
+	pm.mu.Lock()
+	v := pm.inflight[addr] + sz
+	pm.inflight[addr] = v
+	pm.mu.Unlock()
+	pm.listener.SnapshotBytesInFlight(addr, v)
+}
+
+// snapshotDone records that a snapshot transfer to addr which sent sz bytes
+// has been completed.
+func (pm *peerMetrics) snapshotDone(addr string, sz uint64) {
+	if pm.listener == nil || sz == 0 {
+		return
+	}
+	pm.mu.Lock()
+	v := pm.inflight[addr]
+	if v > sz {
+		v -= sz
+		pm.inflight[addr] = v
+	} else {
+		v = 0
+		delete(pm.inflight, addr)
+	}
+	pm.mu.Unlock()
+	pm.listener.SnapshotBytesInFlight(addr, v)
+}
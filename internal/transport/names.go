@@ -0,0 +1,107 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// ClusterNames is a registry of human-readable Raft cluster names. When the
+// gossip based NodeHostIDRegistry is used, names registered on each NodeHost
+// are propagated to all other NodeHosts in the gossip group.
+type ClusterNames struct {
+	mu    sync.RWMutex
+	ids   map[string]uint64
+	names map[uint64]string
+}
+
+// NewClusterNames creates a new ClusterNames instance.
+func NewClusterNames() *ClusterNames {
+	return &ClusterNames{
+		ids:   make(map[string]uint64),
+		names: make(map[uint64]string),
+	}
+}
+
+// Set maps the specified name to the specified Raft cluster. It returns a
+// boolean flag indicating whether the name has been set, the name is not set
+// when it is already used by another Raft cluster or when the Raft cluster
+// already has a different name.
+func (c *ClusterNames) Set(name string, clusterID uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.set(name, clusterID)
+}
+
+func (c *ClusterNames) set(name string, clusterID uint64) bool {
+	if v, ok := c.ids[name]; ok {
+		return v == clusterID
+	}
+	if _, ok := c.names[clusterID]; ok {
+		return false
+	}
+	c.ids[name] = clusterID
+	c.names[clusterID] = name
+	return true
+}
+
+// GetClusterID returns the ID of the Raft cluster with the specified name.
+func (c *ClusterNames) GetClusterID(name string) (uint64, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.ids[name]
+	return v, ok
+}
+
+// GetName returns the name of the specified Raft cluster.
+func (c *ClusterNames) GetName(clusterID uint64) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.names[clusterID]
+	return v, ok
+}
+
+func (c *ClusterNames) marshal() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.ids) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(c.ids)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func (c *ClusterNames) merge(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	ids := make(map[string]uint64)
+	if err := json.Unmarshal(data, &ids); err != nil {
+		plog.Errorf("failed to unmarshal cluster names, %v", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, clusterID := range ids {
+		if !c.set(name, clusterID) {
+			plog.Warningf("ignored conflicting name %s for cluster %d",
+				name, clusterID)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"testing"
+)
+
+func TestClusterNamesCanBeSet(t *testing.T) {
+	c := NewClusterNames()
+	if !c.Set("users", 1) {
+		t.Fatalf("failed to set name")
+	}
+	if !c.Set("users", 1) {
+		t.Errorf("failed to set the same name again")
+	}
+	if c.Set("users", 2) {
+		t.Errorf("name used by another cluster set")
+	}
+	if c.Set("orders", 1) {
+		t.Errorf("second name of the cluster set")
+	}
+	if v, ok := c.GetClusterID("users"); !ok || v != 1 {
+		t.Errorf("unexpected cluster id %d, %t", v, ok)
+	}
+	if name, ok := c.GetName(1); !ok || name != "users" {
+		t.Errorf("unexpected name %s, %t", name, ok)
+	}
+	if _, ok := c.GetClusterID("orders"); ok {
+		t.Errorf("unexpected name found")
+	}
+}
+
+func TestClusterNamesCanBeMerged(t *testing.T) {
+	c1 := NewClusterNames()
+	c2 := NewClusterNames()
+	if c1.marshal() != nil {
+		t.Errorf("unexpected marshaled data")
+	}
+	c1.Set("users", 1)
+	c1.Set("orders", 2)
+	c2.Set("orders", 3)
+	c2.Set("items", 4)
+	c2.merge(c1.marshal())
+	if v, ok := c2.GetClusterID("users"); !ok || v != 1 {
+		t.Errorf("unexpected cluster id %d, %t", v, ok)
+	}
+	if v, ok := c2.GetClusterID("orders"); !ok || v != 3 {
+		t.Errorf("conflicting name merged, %d, %t", v, ok)
+	}
+	if _, ok := c2.GetName(2); ok {
+		t.Errorf("conflicting name merged")
+	}
+	c2.merge([]byte("invalid"))
+	if v, ok := c2.GetClusterID("items"); !ok || v != 4 {
+		t.Errorf("unexpected cluster id %d, %t", v, ok)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/id"
+)
+
+const (
+	observerNamePrefix = "observer-"
+)
+
+// GossipObserver is an observer-only member of the gossip group formed by
+// NodeHosts. It doesn't advertise any RaftAddress, it is thus never counted
+// as a NodeHost, but it learns NodeHost addresses, Raft cluster names and Raft
+// cluster leaders propagated by the gossip service.
+type GossipObserver struct {
+	gossip *gossipManager
+}
+
+// NewGossipObserver creates a new GossipObserver instance that joins the
+// gossip group using the specified gossip config.
+func NewGossipObserver(cfg config.GossipConfig) (*GossipObserver, error) {
+	return newGossipObserver(config.NodeHostConfig{Gossip: cfg})
+}
+
+func newGossipObserver(nhConfig config.NodeHostConfig) (*GossipObserver, error) {
+	if err := nhConfig.Gossip.Validate(); err != nil {
+		return nil, err
+	}
+	nhConfig.RaftAddress = ""
+	name := observerNamePrefix + id.NewRandomNodeHostID().String()
+	gossip, err := newGossipManager(name,
+		nhConfig, NewClusterNames(), NewClusterLeaders())
+	if err != nil {
+		return nil, err
+	}
+	return &GossipObserver{gossip: gossip}, nil
+}
+
+// Stop stops the GossipObserver instance.
+func (o *GossipObserver) Stop() {
+	o.gossip.Stop()
+}
+
+// SetSeed replaces the seed list of the gossip service and tries to join the
+// gossip group using the new seed addresses.
+func (o *GossipObserver) SetSeed(seed []string) error {
+	return o.gossip.setSeed(seed)
+}
+
+// ClusterNames returns the Raft cluster names learned from the gossip service.
+func (o *GossipObserver) ClusterNames() *ClusterNames {
+	return o.gossip.names
+}
+
+// ClusterLeaders returns the Raft cluster leaders learned from the gossip
+// service.
+func (o *GossipObserver) ClusterLeaders() *ClusterLeaders {
+	return o.gossip.leaders
+}
+
+// GetRaftAddress returns the RaftAddress of the specified NodeHost.
+func (o *GossipObserver) GetRaftAddress(nhid string) (string, bool) {
+	return o.gossip.GetRaftAddress(nhid)
+}
+
+// NodeHosts returns the RaftAddress values of all known NodeHosts keyed by
+// their NodeHostIDs.
+func (o *GossipObserver) NodeHosts() map[string]string {
+	return o.gossip.nodeHosts()
+}
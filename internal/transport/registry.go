@@ -50,12 +50,13 @@ var _ IResolver = (*Registry)(nil)
 type Registry struct {
 	partitioner server.IPartitioner
 	validate    config.TargetValidator
+	srv         *srvResolver
 	addr        sync.Map // map of raftio.NodeInfo => string
 }
 
 // NewNodeRegistry returns a new Registry object.
 func NewNodeRegistry(streamConnections uint64, v config.TargetValidator) *Registry {
-	n := &Registry{validate: v}
+	n := &Registry{validate: v, srv: newSRVResolver()}
 	if streamConnections > 1 {
 		n.partitioner = server.NewFixedPartitioner(streamConnections)
 	}
@@ -70,6 +71,10 @@ func (n *Registry) Add(clusterID uint64, nodeID uint64, target string) {
 	if n.validate != nil && !n.validate(target) {
 		plog.Panicf("invalid target %s", target)
 	}
+	if config.IsSRVAddress(target) {
+		// start resolving the DNS SRV address in the background
+		n.srv.resolve(target)
+	}
 	key := raftio.GetNodeInfo(clusterID, nodeID)
 	v, ok := n.addr.LoadOrStore(key, target)
 	if ok {
@@ -110,9 +115,15 @@ func (n *Registry) RemoveCluster(clusterID uint64) {
 // Resolve looks up the Addr of the specified node.
 func (n *Registry) Resolve(clusterID uint64, nodeID uint64) (string, string, error) {
 	key := raftio.GetNodeInfo(clusterID, nodeID)
-	addr, ok := n.addr.Load(key)
+	v, ok := n.addr.Load(key)
 	if !ok {
 		return "", "", ErrUnknownTarget
 	}
-	return addr.(string), n.getConnectionKey(addr.(string), clusterID), nil
+	addr := v.(string)
+	if config.IsSRVAddress(addr) {
+		if addr, ok = n.srv.resolve(addr); !ok {
+			return "", "", ErrUnknownTarget
+		}
+	}
+	return addr, n.getConnectionKey(addr, clusterID), nil
 }
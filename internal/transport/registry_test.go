@@ -15,7 +15,9 @@
 package transport
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/lni/goutils/stringutil"
 
@@ -38,6 +40,28 @@ func TestPeerCanBeAdded(t *testing.T) {
 	}
 }
 
+func TestSRVTargetIsResolved(t *testing.T) {
+	nodes := NewNodeRegistry(settings.Soft.StreamConnections, nil)
+	nodes.srv.lookup = getTestSRVLookup(map[string][]*net.SRV{
+		"_raft._tcp.node2.example.com": {{Target: "a2.example.com.", Port: 2}},
+	})
+	nodes.Add(100, 2, "srv://_raft._tcp.node2.example.com")
+	for i := 0; i < 100; i++ {
+		url, _, err := nodes.Resolve(100, 2)
+		if err == nil {
+			if url != "a2.example.com:2" {
+				t.Errorf("got %s, want %s", url, "a2.example.com:2")
+			}
+			return
+		}
+		if err != ErrUnknownTarget {
+			t.Fatalf("unexpected error %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("failed to resolve SRV target")
+}
+
 func TestPeerAddressCanNotBeUpdated(t *testing.T) {
 	nodes := NewNodeRegistry(settings.Soft.StreamConnections, nil)
 	defer func() {
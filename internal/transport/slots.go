@@ -0,0 +1,136 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"sync"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+type slotWaiter struct {
+	addr    string
+	readyC  chan struct{}
+	granted bool
+}
+
+// streamSlots limits the number of concurrent outgoing snapshot streams, both
+// in total and for each remote address. Depending on the queue policy, streams
+// that can not be immediately started are either rejected or queued until
+// slots are released by completed streams.
+type streamSlots struct {
+	mu      sync.Mutex
+	cfg     config.SnapshotStreamConfig
+	active  uint64
+	peers   map[string]uint64
+	waiters []*slotWaiter
+}
+
+func newStreamSlots(cfg config.SnapshotStreamConfig) *streamSlots {
+	if cfg.MaxOutgoing == 0 {
+		cfg.MaxOutgoing = maxConnectionCount
+	}
+	if cfg.QueuePolicy == config.QueueSnapshotStreams && cfg.MaxQueued == 0 {
+		cfg.MaxQueued = cfg.MaxOutgoing
+	}
+	return &streamSlots{cfg: cfg, peers: make(map[string]uint64)}
+}
+
+// acquire tries to acquire a slot for a stream to the specified address. It
+// returns a boolean flag indicating whether the stream is accepted, accepted
+// streams that have to wait for a slot are given a non-nil waiter.
+func (s *streamSlots) acquire(addr string) (*slotWaiter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.waiters) == 0 && s.available(addr) {
+		s.take(addr)
+		return nil, true
+	}
+	if s.cfg.QueuePolicy != config.QueueSnapshotStreams ||
+		uint64(len(s.waiters)) >= s.cfg.MaxQueued {
+		return nil, false
+	}
+	w := &slotWaiter{addr: addr, readyC: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	return w, true
+}
+
+// cancel gives up waiting for a slot.
+func (s *streamSlots) cancel(w *slotWaiter) {
+	s.mu.Lock()
+	granted := w.granted
+	if !granted {
+		for idx, v := range s.waiters {
+			if v == w {
+				s.waiters = append(s.waiters[:idx], s.waiters[idx+1:]...)
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	if granted {
+		s.release(w.addr)
+	}
+}
+
+// release releases the slot held by a completed stream to the specified
+// address and grants freed slots to queued streams in FIFO order. Queued
+// streams to remote addresses with no available per peer slot are skipped.
+func (s *streamSlots) release(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if v := s.peers[addr]; v <= 1 {
+		delete(s.peers, addr)
+	} else {
+		s.peers[addr] = v - 1
+	}
+	waiters := s.waiters[:0]
+	for _, w := range s.waiters {
+		if s.available(w.addr) {
+			s.take(w.addr)
+			w.granted = true
+			close(w.readyC)
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	s.waiters = waiters
+}
+
+func (s *streamSlots) available(addr string) bool {
+	if s.active >= s.cfg.MaxOutgoing {
+		return false
+	}
+	return s.cfg.MaxOutgoingPerPeer == 0 ||
+		s.peers[addr] < s.cfg.MaxOutgoingPerPeer
+}
+
+func (s *streamSlots) take(addr string) {
+	s.active++
+	s.peers[addr]++
+}
+
+func (s *streamSlots) getActiveCount() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+func (s *streamSlots) getQueuedCount() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint64(len(s.waiters))
+}
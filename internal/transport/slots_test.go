@@ -0,0 +1,121 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"testing"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+func TestStreamSlotsRejectWhenFull(t *testing.T) {
+	s := newStreamSlots(config.SnapshotStreamConfig{MaxOutgoing: 2})
+	for i := 0; i < 2; i++ {
+		if w, ok := s.acquire("a1"); !ok || w != nil {
+			t.Fatalf("failed to acquire slot")
+		}
+	}
+	if _, ok := s.acquire("a2"); ok {
+		t.Fatalf("slot count not limited")
+	}
+	s.release("a1")
+	if w, ok := s.acquire("a2"); !ok || w != nil {
+		t.Fatalf("failed to acquire released slot")
+	}
+	if s.getActiveCount() != 2 {
+		t.Errorf("unexpected active count %d", s.getActiveCount())
+	}
+}
+
+func TestStreamSlotsPerPeerLimit(t *testing.T) {
+	s := newStreamSlots(config.SnapshotStreamConfig{
+		MaxOutgoing:        8,
+		MaxOutgoingPerPeer: 1,
+	})
+	if _, ok := s.acquire("a1"); !ok {
+		t.Fatalf("failed to acquire slot")
+	}
+	if _, ok := s.acquire("a1"); ok {
+		t.Fatalf("per peer slot count not limited")
+	}
+	if _, ok := s.acquire("a2"); !ok {
+		t.Fatalf("failed to acquire slot for another peer")
+	}
+}
+
+func TestStreamSlotsQueuedInFIFOOrder(t *testing.T) {
+	s := newStreamSlots(config.SnapshotStreamConfig{
+		MaxOutgoing:        2,
+		MaxOutgoingPerPeer: 1,
+		QueuePolicy:        config.QueueSnapshotStreams,
+		MaxQueued:          3,
+	})
+	for _, addr := range []string{"a1", "a2"} {
+		if w, ok := s.acquire(addr); !ok || w != nil {
+			t.Fatalf("failed to acquire slot")
+		}
+	}
+	w1, ok1 := s.acquire("a1")
+	w2, ok2 := s.acquire("a3")
+	w3, ok3 := s.acquire("a4")
+	if !ok1 || !ok2 || !ok3 || w1 == nil || w2 == nil || w3 == nil {
+		t.Fatalf("streams not queued")
+	}
+	if _, ok := s.acquire("a5"); ok {
+		t.Fatalf("queue length not limited")
+	}
+	if s.getQueuedCount() != 3 {
+		t.Errorf("unexpected queued count %d", s.getQueuedCount())
+	}
+	// a1 still has an active stream, the slot goes to the queued a3 stream
+	s.release("a2")
+	select {
+	case <-w1.readyC:
+		t.Fatalf("per peer limit ignored")
+	case <-w2.readyC:
+	default:
+		t.Fatalf("slot not granted")
+	}
+	s.cancel(w3)
+	s.release("a1")
+	select {
+	case <-w1.readyC:
+	default:
+		t.Fatalf("slot not granted")
+	}
+	if s.getQueuedCount() != 0 || s.getActiveCount() != 2 {
+		t.Errorf("unexpected counts %d, %d",
+			s.getQueuedCount(), s.getActiveCount())
+	}
+}
+
+func TestCancelGrantedWaiterReleasesSlot(t *testing.T) {
+	s := newStreamSlots(config.SnapshotStreamConfig{
+		MaxOutgoing: 1,
+		QueuePolicy: config.QueueSnapshotStreams,
+	})
+	if _, ok := s.acquire("a1"); !ok {
+		t.Fatalf("failed to acquire slot")
+	}
+	w, ok := s.acquire("a1")
+	if !ok || w == nil {
+		t.Fatalf("stream not queued")
+	}
+	s.release("a1")
+	s.cancel(w)
+	if s.getActiveCount() != 0 {
+		t.Errorf("slot not released")
+	}
+}
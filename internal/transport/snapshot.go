@@ -69,6 +69,12 @@ func (t *Transport) GetStreamSink(clusterID uint64, nodeID uint64) *Sink {
 	return s
 }
 
+// GetSnapshotJobCount returns the number of snapshot jobs that are currently
+// being sent or streamed to remote nodes.
+func (t *Transport) GetSnapshotJobCount() uint64 {
+	return atomic.LoadUint64(&t.jobs)
+}
+
 func (t *Transport) getStreamSink(clusterID uint64, nodeID uint64) *Sink {
 	addr, _, err := t.resolver.Resolve(clusterID, nodeID)
 	if err != nil {
@@ -91,7 +97,7 @@ func (t *Transport) sendSnapshot(m pb.Message) bool {
 	if m.Type != pb.InstallSnapshot {
 		panic("not a snapshot message")
 	}
-	chunks := splitSnapshotMessage(m, t.fs)
+	chunks := splitSnapshotMessage(m, t.nhConfig.SnapshotStream.PullURL, t.fs)
 	addr, _, err := t.resolver.Resolve(clusterID, toNodeID)
 	if err != nil {
 		return false
@@ -111,25 +117,51 @@ func (t *Transport) sendSnapshot(m pb.Message) bool {
 
 func (t *Transport) createJob(key raftio.NodeInfo,
 	addr string, streaming bool, sz int) *job {
-	if v := atomic.AddUint64(&t.jobs, 1); v > maxConnectionCount {
-		r := atomic.AddUint64(&t.jobs, ^uint64(0))
-		plog.Warningf("job count is rate limited %d", r)
+	w, ok := t.slots.acquire(addr)
+	if !ok {
+		plog.Warningf("job count is rate limited %d", t.GetSnapshotJobCount())
 		return nil
 	}
+	atomic.AddUint64(&t.jobs, 1)
 	job := newJob(t.ctx, key.ClusterID, key.NodeID, t.nhConfig.GetDeploymentID(),
 		streaming, sz, t.trans, t.stopper.ShouldStop(), t.fs)
 	job.postSend = t.postSend
 	job.preSend = t.preSend
+	job.cipher = t.cipher
+	job.peers = t.peers
+	job.streams = t.nhConfig.SnapshotStream.ParallelStreams
+	job.pullURL = t.nhConfig.SnapshotStream.PullURL
 	shutdown := func() {
 		atomic.AddUint64(&t.jobs, ^uint64(0))
 	}
 	t.stopper.RunWorker(func() {
-		t.processSnapshot(job, addr)
+		if t.waitForSlot(w, job) {
+			t.processSnapshot(job, addr)
+			t.peers.snapshotDone(addr, atomic.LoadUint64(&job.sent))
+			t.slots.release(addr)
+		}
 		shutdown()
 	})
 	return job
 }
 
+// waitForSlot waits until the queued job is granted a slot. It returns a
+// boolean flag indicating whether the job can be processed.
+func (t *Transport) waitForSlot(w *slotWaiter, c *job) bool {
+	if w == nil {
+		return true
+	}
+	select {
+	case <-w.readyC:
+		return true
+	case <-t.stopper.ShouldStop():
+		t.slots.cancel(w)
+		close(c.failed)
+		t.sendSnapshotNotification(c.clusterID, c.nodeID, true)
+		return false
+	}
+}
+
 func (t *Transport) processSnapshot(c *job, addr string) {
 	breaker := t.GetCircuitBreaker(addr)
 	successes := breaker.Successes()
@@ -138,14 +170,16 @@ func (t *Transport) processSnapshot(c *job, addr string) {
 	nodeID := c.nodeID
 	if err := func() error {
 		if err := c.connect(addr); err != nil {
-			plog.Warningf("failed to get snapshot conn to %s", dn(clusterID, nodeID))
+			plog.Debugf("failed to get snapshot conn to %s", dn(clusterID, nodeID))
 			t.sendSnapshotNotification(clusterID, nodeID, true)
 			close(c.failed)
 			t.metrics.snapshotCnnectionFailure()
+			t.peerFailed(addr, err)
 			return err
 		}
 		defer c.close()
 		breaker.Success()
+		t.peerConnected(addr)
 		if successes == 0 || consecFailures > 0 {
 			plog.Debugf("snapshot stream to %s (%s) established",
 				dn(clusterID, nodeID), addr)
@@ -161,6 +195,7 @@ func (t *Transport) processSnapshot(c *job, addr string) {
 		plog.Warningf("processSnapshot failed: %v", err)
 		breaker.Fail()
 		t.sysEvents.ConnectionFailed(addr, true)
+		t.watcher.refresh(addr)
 	}
 }
 
@@ -234,6 +269,50 @@ func getChunks(m pb.Message) []pb.Chunk {
 	return results
 }
 
+// getManifestChunks returns chunks that only describe the snapshot files, one
+// chunk for each file. Each chunk carries the URL of the file to be pulled by
+// the receiver, no file content is included.
+func getManifestChunks(m pb.Message, pullURL string, fs vfs.IFS) []pb.Chunk {
+	results := []pb.Chunk{getManifestChunk(m,
+		m.Snapshot.Filepath, m.Snapshot.FileSize, nil, pullURL, fs)}
+	for _, snapshotFile := range m.Snapshot.Files {
+		results = append(results, getManifestChunk(m, snapshotFile.Filepath,
+			snapshotFile.FileSize, snapshotFile, pullURL, fs))
+	}
+	for idx := range results {
+		results[idx].ChunkId = uint64(idx)
+		results[idx].ChunkCount = uint64(len(results))
+	}
+	return results
+}
+
+func getManifestChunk(m pb.Message, filepath string, filesize uint64,
+	sf *pb.SnapshotFile, pullURL string, fs vfs.IFS) pb.Chunk {
+	// snapshot files are all located in the snapshot's own directory within
+	// the snapshot directory of the node
+	file := fs.PathBase(fs.PathDir(filepath)) + "/" + fs.PathBase(filepath)
+	c := pb.Chunk{
+		BinVer:         raftio.TransportBinVersion,
+		ClusterId:      m.ClusterId,
+		NodeId:         m.To,
+		From:           m.From,
+		FileChunkId:    0,
+		FileChunkCount: 1,
+		Index:          m.Snapshot.Index,
+		Term:           m.Snapshot.Term,
+		OnDiskIndex:    m.Snapshot.OnDiskIndex,
+		Membership:     m.Snapshot.Membership,
+		Filepath:       filepath,
+		FileSize:       filesize,
+		PullUrl:        GetSnapshotFileURL(pullURL, m.ClusterId, m.From, file),
+	}
+	if sf != nil {
+		c.HasFileInfo = true
+		c.FileInfo = *sf
+	}
+	return c
+}
+
 func getWitnessChunk(m pb.Message, fs vfs.IFS) []pb.Chunk {
 	ss, err := rsm.GetWitnessSnapshot(fs)
 	if err != nil {
@@ -262,13 +341,17 @@ func getWitnessChunk(m pb.Message, fs vfs.IFS) []pb.Chunk {
 	return results
 }
 
-func splitSnapshotMessage(m pb.Message, fs vfs.IFS) []pb.Chunk {
+func splitSnapshotMessage(m pb.Message,
+	pullURL string, fs vfs.IFS) []pb.Chunk {
 	if m.Type != pb.InstallSnapshot {
 		panic("not a snapshot message")
 	}
 	if m.Snapshot.Witness {
 		return getWitnessChunk(m, fs)
 	}
+	if len(pullURL) > 0 {
+		return getManifestChunks(m, pullURL, fs)
+	}
 	return getChunks(m)
 }
 
@@ -59,13 +59,18 @@ const (
 	TCPTransportName         = "go-tcp-transport"
 	requestHeaderSize        = 18
 	raftType          uint16 = 100
+	resumeType        uint16 = 150
 	snapshotType      uint16 = 200
+	resumeReplySize          = 8
 )
 
 type requestHeader struct {
 	size   uint64
 	crc    uint32
 	method uint16
+	// compression is the compression type of the payload, it is encoded in the
+	// high byte of the method field.
+	compression pb.CompressionType
 }
 
 // TODO:
@@ -81,7 +86,7 @@ func (h *requestHeader) encode(buf []byte) []byte {
 	if len(buf) < requestHeaderSize {
 		panic("input buf too small")
 	}
-	binary.BigEndian.PutUint16(buf, h.method)
+	binary.BigEndian.PutUint16(buf, h.method|uint16(h.compression)<<8)
 	binary.BigEndian.PutUint64(buf[2:], h.size)
 	binary.BigEndian.PutUint32(buf[10:], 0)
 	binary.BigEndian.PutUint32(buf[14:], h.crc)
@@ -103,11 +108,19 @@ func (h *requestHeader) decode(buf []byte) bool {
 	}
 	binary.BigEndian.PutUint32(buf[10:], incoming)
 	method := binary.BigEndian.Uint16(buf)
-	if method != raftType && method != snapshotType {
+	ct := pb.CompressionType(method >> 8)
+	method &= 0xFF
+	if method != raftType && method != snapshotType && method != resumeType {
 		plog.Errorf("invalid method type")
 		return false
 	}
+	if !isValidCompressionType(ct) ||
+		(method != raftType && ct != pb.NoCompression) {
+		plog.Errorf("invalid compression type")
+		return false
+	}
 	h.method = method
+	h.compression = ct
 	h.size = binary.BigEndian.Uint64(buf[2:])
 	h.crc = binary.BigEndian.Uint32(buf[14:])
 	return true
@@ -199,8 +212,8 @@ func readMessage(conn net.Conn,
 		plog.Errorf("invalid header")
 		return requestHeader{}, nil, ErrBadMessage
 	}
-	if rheader.size == 0 {
-		plog.Errorf("invalid payload length")
+	if rheader.size == 0 || rheader.size > maxPayloadSize {
+		plog.Errorf("invalid payload length %d", rheader.size)
 		return requestHeader{}, nil, ErrBadMessage
 	}
 	var buf []byte
@@ -319,22 +332,28 @@ func (c *connection) SetWriteDeadline(t time.Time) error {
 // TCPConnection is the connection used for sending raft messages to remote
 // nodes.
 type TCPConnection struct {
-	conn      net.Conn
-	header    []byte
-	payload   []byte
-	encrypted bool
+	conn        net.Conn
+	header      []byte
+	payload     []byte
+	compressed  []byte
+	encrypted   bool
+	compression pb.CompressionType
 }
 
 var _ raftio.IConnection = (*TCPConnection)(nil)
 
-// NewTCPConnection creates and returns a new TCPConnection instance.
+// NewTCPConnection creates and returns a new TCPConnection instance. Message
+// batches are compressed using the specified compression type when they are
+// large enough.
 func NewTCPConnection(conn net.Conn,
-	rb *ratelimit.Bucket, wb *ratelimit.Bucket, encrypted bool) *TCPConnection {
+	rb *ratelimit.Bucket, wb *ratelimit.Bucket, encrypted bool,
+	compression pb.CompressionType) *TCPConnection {
 	return &TCPConnection{
-		conn:      newConnection(conn, rb, wb),
-		header:    make([]byte, requestHeaderSize),
-		payload:   make([]byte, perConnBufSize),
-		encrypted: encrypted,
+		conn:        newConnection(conn, rb, wb),
+		header:      make([]byte, requestHeaderSize),
+		payload:     make([]byte, perConnBufSize),
+		encrypted:   encrypted,
+		compression: compression,
 	}
 }
 
@@ -359,7 +378,15 @@ func (c *TCPConnection) SendMessageBatch(batch pb.MessageBatch) error {
 	if err != nil {
 		panic(err)
 	}
-	return writeMessage(c.conn, header, buf[:n], c.header, c.encrypted)
+	buf = buf[:n]
+	if cbuf, ok := compressPayload(c.compression, c.compressed, buf); ok {
+		header.compression = c.compression
+		buf = cbuf
+		if uint64(cap(cbuf)) <= perConnBufSize {
+			c.compressed = cbuf[:0]
+		}
+	}
+	return writeMessage(c.conn, header, buf, c.header, c.encrypted)
 }
 
 // TCPSnapshotConnection is the connection for sending raft snapshot chunks to
@@ -370,7 +397,7 @@ type TCPSnapshotConnection struct {
 	encrypted bool
 }
 
-var _ raftio.ISnapshotConnection = (*TCPSnapshotConnection)(nil)
+var _ raftio.IResumableSnapshotConnection = (*TCPSnapshotConnection)(nil)
 
 // NewTCPSnapshotConnection creates and returns a new snapshot connection.
 func NewTCPSnapshotConnection(conn net.Conn,
@@ -404,6 +431,35 @@ func (c *TCPSnapshotConnection) SendChunk(chunk pb.Chunk) error {
 	return writeMessage(c.conn, header, buf[:n], c.header, c.encrypted)
 }
 
+// Resume queries the remote node for the ID of the next chunk it expects for
+// the snapshot the specified chunk belongs to.
+func (c *TCPSnapshotConnection) Resume(chunk pb.Chunk) (uint64, error) {
+	chunk.Data = nil
+	header := requestHeader{method: resumeType}
+	buf := make([]byte, chunk.Size())
+	n, err := chunk.MarshalTo(buf)
+	if err != nil {
+		panic(err)
+	}
+	if err := writeMessage(c.conn,
+		header, buf[:n], c.header, c.encrypted); err != nil {
+		return 0, err
+	}
+	magicNum := make([]byte, len(magicNumber))
+	if err := readMagicNumber(c.conn, magicNum); err != nil {
+		return 0, err
+	}
+	rbuf := make([]byte, resumeReplySize)
+	rheader, reply, err := readMessage(c.conn, c.header, rbuf, c.encrypted)
+	if err != nil {
+		return 0, err
+	}
+	if rheader.method != resumeType || len(reply) != resumeReplySize {
+		return 0, ErrBadMessage
+	}
+	return binary.BigEndian.Uint64(reply), nil
+}
+
 // TCP is a TCP based transport module for exchanging raft messages and
 // snapshots between NodeHost instances.
 type TCP struct {
@@ -412,12 +468,15 @@ type TCP struct {
 	connStopper    *syncutil.Stopper
 	requestHandler raftio.MessageHandler
 	chunkHandler   raftio.ChunkHandler
-	writeBucket    *ratelimit.Bucket
+	resumeHandler  raftio.ChunkResumeHandler
+	throttle       *sendThrottle
 	nhConfig       config.NodeHostConfig
 	encrypted      bool
+	compression    pb.CompressionType
 }
 
 var _ raftio.ITransport = (*TCP)(nil)
+var _ raftio.IResumableTransport = (*TCP)(nil)
 
 // NewTCPTransport creates and returns a new TCP transport module.
 func NewTCPTransport(nhConfig config.NodeHostConfig,
@@ -431,17 +490,21 @@ func NewTCPTransport(nhConfig config.NodeHostConfig,
 		chunkHandler:   chunkHandler,
 		encrypted:      nhConfig.MutualTLS,
 	}
-	rate := nhConfig.MaxSnapshotSendBytesPerSecond
-	if rate > 0 {
-		t.writeBucket = ratelimit.NewBucketWithRate(float64(rate), int64(rate)*2)
-	}
-	rate = nhConfig.MaxSnapshotRecvBytesPerSecond
-	if rate > 0 {
-		t.readBucket = ratelimit.NewBucketWithRate(float64(rate), int64(rate)*2)
+	// payloads sealed by TransportEncryption are not compressible
+	if nhConfig.TransportEncryption == nil {
+		t.compression = nhConfig.TransportCompressionType
 	}
+	t.throttle = newSendThrottle(nhConfig)
+	t.readBucket = newBucket(nhConfig.MaxSnapshotRecvBytesPerSecond)
 	return t
 }
 
+// SetChunkResumeHandler sets the handler used for handling snapshot resume
+// queries.
+func (t *TCP) SetChunkResumeHandler(h raftio.ChunkResumeHandler) {
+	t.resumeHandler = h
+}
+
 // Start starts the TCP transport module.
 func (t *TCP) Start() error {
 	address := t.nhConfig.GetListenAddress()
@@ -449,10 +512,22 @@ func (t *TCP) Start() error {
 	if err != nil {
 		return err
 	}
-	listener, err := netutil.NewStoppableListener(address,
-		tlsConfig, t.stopper.ShouldStop())
-	if err != nil {
-		return err
+	var listener net.Listener
+	if t.nhConfig.Listener != nil {
+		listener = newSharedListener(t.nhConfig.Listener,
+			tlsConfig, t.stopper.ShouldStop())
+		t.stopper.RunWorker(func() {
+			<-t.stopper.ShouldStop()
+			if err := listener.Close(); err != nil {
+				plog.Errorf("failed to close the listener %v", err)
+			}
+		})
+	} else {
+		listener, err = netutil.NewStoppableListener(address,
+			tlsConfig, t.stopper.ShouldStop())
+		if err != nil {
+			return err
+		}
 	}
 	t.connStopper.RunWorker(func() {
 		// sync.WaitGroup's doc mentions that
@@ -470,6 +545,10 @@ func (t *TCP) Start() error {
 				if err == netutil.ErrListenerStopped {
 					return
 				}
+				if t.nhConfig.Listener != nil {
+					plog.Errorf("listener failed %v", err)
+					return
+				}
 				panic(err)
 			}
 			var once sync.Once
@@ -506,7 +585,7 @@ func (t *TCP) GetConnection(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
-	return NewTCPConnection(conn, nil, nil, t.encrypted), nil
+	return NewTCPConnection(conn, nil, nil, t.encrypted, t.compression), nil
 }
 
 // GetSnapshotConnection returns a new raftio.IConnection for sending raft
@@ -517,8 +596,8 @@ func (t *TCP) GetSnapshotConnection(ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
-	return NewTCPSnapshotConnection(conn,
-		t.readBucket, t.writeBucket, t.encrypted), nil
+	return NewTCPSnapshotConnection(t.throttle.wrap(conn, target),
+		t.readBucket, nil, t.encrypted), nil
 }
 
 // Name returns a human readable name of the TCP transport module.
@@ -553,10 +632,32 @@ func (t *TCP) serveConn(conn net.Conn) {
 		}
 		if rheader.method == raftType {
 			batch := pb.MessageBatch{}
-			if err := batch.Unmarshal(buf); err != nil {
+			// tbuf is reused for the next message, large messages are read into
+			// their own buffers which can be referred by the received entries
+			unmarshal := batch.Unmarshal
+			if rheader.size > uint64(len(tbuf)) {
+				unmarshal = batch.UnmarshalNoCopy
+			}
+			if rheader.compression != pb.NoCompression {
+				// decompressed payloads are always in their own buffers
+				if buf, err = decompressPayload(rheader.compression, buf); err != nil {
+					plog.Errorf("failed to decompress the payload %v", err)
+					return
+				}
+				unmarshal = batch.UnmarshalNoCopy
+			}
+			if err := unmarshal(buf); err != nil {
 				return
 			}
 			t.requestHandler(batch)
+		} else if rheader.method == resumeType {
+			chunk := pb.Chunk{}
+			if err := chunk.Unmarshal(buf); err != nil {
+				return
+			}
+			if err := t.replyResume(conn, chunk, header); err != nil {
+				return
+			}
 		} else {
 			chunk := pb.Chunk{}
 			if err := chunk.Unmarshal(buf); err != nil {
@@ -570,6 +671,70 @@ func (t *TCP) serveConn(conn net.Conn) {
 	}
 }
 
+func (t *TCP) replyResume(conn net.Conn,
+	chunk pb.Chunk, headerBuf []byte) error {
+	next := uint64(0)
+	if t.resumeHandler != nil {
+		next = t.resumeHandler(chunk)
+	}
+	reply := make([]byte, resumeReplySize)
+	binary.BigEndian.PutUint64(reply, next)
+	header := requestHeader{method: resumeType}
+	return writeMessage(conn, header, reply, headerBuf, t.encrypted)
+}
+
+// sharedListener is a net.Listener that accepts connections from a listener
+// provided by the application, the port of the provided listener can thus be
+// shared with other services of the application.
+type sharedListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	stopc     <-chan struct{}
+}
+
+func newSharedListener(ln net.Listener,
+	tlsConfig *tls.Config, stopc <-chan struct{}) *sharedListener {
+	return &sharedListener{
+		Listener:  ln,
+		tlsConfig: tlsConfig,
+		stopc:     stopc,
+	}
+}
+
+func (l *sharedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case <-l.stopc:
+				return nil, netutil.ErrListenerStopped
+			default:
+			}
+			return nil, err
+		}
+		if tcpconn, ok := conn.(*net.TCPConn); ok {
+			if err := setTCPConn(tcpconn); err != nil {
+				conn.Close()
+				continue
+			}
+		}
+		if l.tlsConfig != nil {
+			tc := tls.Server(conn, l.tlsConfig)
+			tt := time.Now().Add(tlsHandshackTimeout)
+			if err := tc.SetDeadline(tt); err != nil {
+				tc.Close()
+				continue
+			}
+			if err := tc.Handshake(); err != nil {
+				tc.Close()
+				continue
+			}
+			conn = tc
+		}
+		return conn, nil
+	}
+}
+
 func setTCPConn(conn *net.TCPConn) error {
 	if err := conn.SetLinger(0); err != nil {
 		return err
@@ -582,10 +747,20 @@ func setTCPConn(conn *net.TCPConn) error {
 
 // FIXME:
 // context.Context is ignored
+func (t *TCP) dial(ctx context.Context,
+	target string, timeout time.Duration) (net.Conn, error) {
+	if t.nhConfig.DialContext == nil {
+		return net.DialTimeout("tcp", target, timeout)
+	}
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return t.nhConfig.DialContext(dctx, "tcp", target)
+}
+
 func (t *TCP) getConnection(ctx context.Context,
 	target string) (net.Conn, error) {
 	timeout := time.Duration(dialTimeoutSecond) * time.Second
-	conn, err := net.DialTimeout("tcp", target, timeout)
+	conn, err := t.dial(ctx, target, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -15,9 +15,15 @@
 package transport
 
 import (
+	"context"
 	"encoding/binary"
+	"net"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3/config"
+	pb "github.com/lni/dragonboat/v3/raftpb"
 )
 
 func TestRequstHeaderCanBeEncodedAndDecoded(t *testing.T) {
@@ -86,3 +92,91 @@ func TestInvalidMethodNameIsReported(t *testing.T) {
 		t.Fatalf("decode did not report invalid method name")
 	}
 }
+
+func TestTCPTransportCanUseProvidedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen %v", err)
+	}
+	addr := ln.Addr().String()
+	received := make(chan pb.MessageBatch, 1)
+	handler := func(b pb.MessageBatch) {
+		received <- b
+	}
+	chunkHandler := func(c pb.Chunk) bool {
+		return true
+	}
+	nhConfig := config.NodeHostConfig{
+		RaftAddress: addr,
+		Listener:    ln,
+	}
+	trans := NewTCPTransport(nhConfig, handler, chunkHandler)
+	if err := trans.Start(); err != nil {
+		t.Fatalf("failed to start %v", err)
+	}
+	conn, err := trans.GetConnection(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to get connection %v", err)
+	}
+	batch := pb.MessageBatch{
+		Requests: []pb.Message{{Type: pb.Heartbeat, ClusterId: 100, To: 2}},
+	}
+	if err := conn.SendMessageBatch(batch); err != nil {
+		t.Fatalf("failed to send %v", err)
+	}
+	select {
+	case b := <-received:
+		if len(b.Requests) != 1 || b.Requests[0].ClusterId != 100 {
+			t.Errorf("unexpected batch %v", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("batch not received")
+	}
+	conn.Close()
+	trans.Stop()
+	if _, err := ln.Accept(); err == nil {
+		t.Errorf("listener not closed")
+	}
+}
+
+func TestTCPTransportUsesDialContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen %v", err)
+	}
+	addr := ln.Addr().String()
+	dialed := make(chan string, 1)
+	dial := func(ctx context.Context,
+		network string, address string) (net.Conn, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("no dial deadline")
+		}
+		dialed <- address
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	nhConfig := config.NodeHostConfig{
+		RaftAddress: addr,
+		Listener:    ln,
+		DialContext: dial,
+	}
+	trans := NewTCPTransport(nhConfig,
+		func(pb.MessageBatch) {}, func(pb.Chunk) bool { return true })
+	if err := trans.Start(); err != nil {
+		t.Fatalf("failed to start %v", err)
+	}
+	defer trans.Stop()
+	conn, err := trans.GetConnection(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("failed to get connection %v", err)
+	}
+	defer conn.Close()
+	select {
+	case v := <-dialed:
+		if v != addr {
+			t.Errorf("dialed %s, want %s", v, addr)
+		}
+	default:
+		t.Errorf("DialContext not used")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"sync"
+
+	"github.com/juju/ratelimit"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+// sendThrottle schedules the outbound snapshot bandwidth of the NodeHost.
+// Each remote NodeHost can have its own bandwidth limit, the NodeHost wide
+// limit is shared among remote NodeHosts by allowing at most one connection
+// to each remote NodeHost to wait on the shared bucket at any time.
+type sendThrottle struct {
+	mu      sync.Mutex
+	shared  *ratelimit.Bucket
+	perPeer uint64
+	rates   map[string]uint64
+	peers   map[string]*peerThrottle
+}
+
+func newSendThrottle(nhConfig config.NodeHostConfig) *sendThrottle {
+	t := &sendThrottle{
+		shared:  newBucket(nhConfig.MaxSnapshotSendBytesPerSecond),
+		perPeer: nhConfig.MaxSnapshotSendBytesPerSecondPerPeer,
+		rates:   nhConfig.PeerSnapshotSendBytesPerSecond,
+		peers:   make(map[string]*peerThrottle),
+	}
+	return t
+}
+
+func newBucket(rate uint64) *ratelimit.Bucket {
+	if rate == 0 {
+		return nil
+	}
+	return ratelimit.NewBucketWithRate(float64(rate), int64(rate)*2)
+}
+
+func (t *sendThrottle) limited(target string) bool {
+	if t.shared != nil || t.perPeer > 0 {
+		return true
+	}
+	_, ok := t.rates[target]
+	return ok
+}
+
+func (t *sendThrottle) get(target string) *peerThrottle {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.peers[target]
+	if !ok {
+		rate := t.perPeer
+		if v, ok := t.rates[target]; ok {
+			rate = v
+		}
+		p = &peerThrottle{shared: t.shared, bucket: newBucket(rate)}
+		t.peers[target] = p
+	}
+	return p
+}
+
+// wrap returns a net.Conn with its writes throttled as configured for the
+// specified target.
+func (t *sendThrottle) wrap(conn net.Conn, target string) net.Conn {
+	if !t.limited(target) {
+		return conn
+	}
+	return &throttledConn{Conn: conn, p: t.get(target)}
+}
+
+type peerThrottle struct {
+	// mu serializes waits on the shared bucket
+	mu     sync.Mutex
+	shared *ratelimit.Bucket
+	bucket *ratelimit.Bucket
+}
+
+func (p *peerThrottle) wait(n int64) {
+	if p.bucket != nil {
+		p.bucket.Wait(n)
+	}
+	if p.shared != nil {
+		p.mu.Lock()
+		p.shared.Wait(n)
+		p.mu.Unlock()
+	}
+}
+
+type throttledConn struct {
+	net.Conn
+	p *peerThrottle
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	c.p.wait(int64(len(b)))
+	return c.Conn.Write(b)
+}
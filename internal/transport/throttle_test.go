@@ -0,0 +1,85 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"net"
+	"testing"
+
+	"github.com/juju/ratelimit"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+func TestSendThrottleUsesPeerRates(t *testing.T) {
+	nhConfig := config.NodeHostConfig{
+		MaxSnapshotSendBytesPerSecondPerPeer: 100,
+		PeerSnapshotSendBytesPerSecond:       map[string]uint64{"b": 200, "c": 0},
+	}
+	st := newSendThrottle(nhConfig)
+	if st.shared != nil {
+		t.Errorf("unexpected shared bucket")
+	}
+	if v := st.get("a").bucket.Capacity(); v != 200 {
+		t.Errorf("capacity %d, want 200", v)
+	}
+	if v := st.get("b").bucket.Capacity(); v != 400 {
+		t.Errorf("capacity %d, want 400", v)
+	}
+	if st.get("c").bucket != nil {
+		t.Errorf("unexpected bucket")
+	}
+	if st.get("a") != st.get("a") {
+		t.Errorf("peer throttle not reused")
+	}
+}
+
+func TestUnlimitedConnIsNotWrapped(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	st := newSendThrottle(config.NodeHostConfig{})
+	if st.wrap(c1, "a") != c1 {
+		t.Errorf("unlimited conn wrapped")
+	}
+	nhConfig := config.NodeHostConfig{
+		PeerSnapshotSendBytesPerSecond: map[string]uint64{"b": 100},
+	}
+	st = newSendThrottle(nhConfig)
+	if st.wrap(c1, "a") != c1 {
+		t.Errorf("unlimited conn wrapped")
+	}
+	if _, ok := st.wrap(c1, "b").(*throttledConn); !ok {
+		t.Errorf("limited conn not wrapped")
+	}
+}
+
+func TestPeerThrottleTakesFromBothBuckets(t *testing.T) {
+	capacity := int64(1024)
+	shared := ratelimit.NewBucketWithRate(1, capacity)
+	p1 := &peerThrottle{
+		shared: shared,
+		bucket: ratelimit.NewBucketWithRate(1, capacity),
+	}
+	p2 := &peerThrottle{shared: shared}
+	p1.wait(100)
+	p2.wait(200)
+	if v := p1.bucket.Available(); v != capacity-100 {
+		t.Errorf("available %d, want %d", v, capacity-100)
+	}
+	if v := shared.Available(); v != capacity-300 {
+		t.Errorf("available %d, want %d", v, capacity-300)
+	}
+}
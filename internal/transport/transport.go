@@ -47,8 +47,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/juju/ratelimit"
 	"github.com/lni/goutils/logutil"
-	"github.com/lni/goutils/netutil"
 	circuit "github.com/lni/goutils/netutil/rubyist/circuitbreaker"
 	"github.com/lni/goutils/syncutil"
 
@@ -102,6 +102,7 @@ type ITransport interface {
 	Send(pb.Message) bool
 	SendSnapshot(pb.Message) bool
 	GetStreamSink(clusterID uint64, nodeID uint64) *Sink
+	GetSnapshotJobCount() uint64
 	Stop()
 }
 
@@ -119,7 +120,25 @@ type SendMessageBatchFunc func(pb.MessageBatch) (pb.MessageBatch, bool)
 
 type sendQueue struct {
 	ch chan pb.Message
-	rl *server.RateLimiter
+	// pch is the priority lane for latency critical control messages, messages
+	// in pch are sent ahead of messages in ch.
+	pch chan pb.Message
+	rl  *server.RateLimiter
+	// stopc is closed to have the connection to addr closed
+	stopc chan struct{}
+	addr  string
+}
+
+// isPriorityMessage returns a boolean value indicating whether the specified
+// message type is a latency critical control message type that should not be
+// queued behind bulk replication messages.
+func isPriorityMessage(t pb.MessageType) bool {
+	switch t {
+	case pb.Heartbeat, pb.HeartbeatResp,
+		pb.RequestVote, pb.RequestVoteResp, pb.TimeoutNow:
+		return true
+	}
+	return false
 }
 
 func (sq *sendQueue) rateLimited() bool {
@@ -144,6 +163,8 @@ func (sq *sendQueue) decrease(msg pb.Message) {
 type ITransportEvent interface {
 	ConnectionEstablished(string, bool)
 	ConnectionFailed(string, bool)
+	AddressChanged(string, []string, []string)
+	PeerHealthChanged(string, bool)
 }
 
 type failedSend uint64
@@ -194,7 +215,13 @@ type Transport struct {
 	dir          server.SnapshotDirFunc
 	env          *server.Env
 	metrics      *transportMetrics
+	peers        *peerMetrics
+	health       *peerHealth
+	batch        config.MessageBatchConfig
 	chunks       *Chunk
+	cipher       *payloadCipher
+	slots        *streamSlots
+	watcher      *addressWatcher
 	cancel       context.CancelFunc
 	sourceID     string
 	nhConfig     config.NodeHostConfig
@@ -222,17 +249,39 @@ func NewTransport(nhConfig config.NodeHostConfig,
 		sysEvents:  sysEvents,
 		fs:         fs,
 		msgHandler: handler,
+		cipher:     newPayloadCipher(nhConfig.TransportEncryption),
+		slots:      newStreamSlots(nhConfig.SnapshotStream),
+		peers:      newPeerMetrics(nhConfig.TransportMetrics),
+		health:     newPeerHealth(),
+		batch:      nhConfig.MessageBatch,
 	}
+	if t.batch.MaxBytes == 0 {
+		t.batch.MaxBytes = maxMsgBatchSize
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
 	chunks := NewChunk(t.handleRequest,
 		t.snapshotReceived, t.dir, t.nhConfig.GetDeploymentID(), fs)
-	t.trans = create(nhConfig, t.handleRequest, chunks.Add)
+	chunks.ctx = t.ctx
+	if nhConfig.SnapshotStream.MaxIncoming > 0 {
+		chunks.maxIncoming = nhConfig.SnapshotStream.MaxIncoming
+	}
+	if rate := nhConfig.MaxReceivedSnapshotWriteBytesPerSecond; rate > 0 {
+		chunks.writeBucket = ratelimit.NewBucketWithRate(float64(rate),
+			int64(rate)*2)
+	}
 	t.chunks = chunks
+	t.trans = create(nhConfig, t.receiveRequest, t.receiveChunk)
+	if rt, ok := t.trans.(raftio.IResumableTransport); ok {
+		rt.SetChunkResumeHandler(t.resumeChunk)
+	}
 	plog.Infof("transport type: %s", t.trans.Name())
 	if err := t.trans.Start(); err != nil {
 		plog.Errorf("transport failed to start %v", err)
 		t.trans.Stop()
 		return nil, err
 	}
+	// the logical clock used for timing out incoming snapshot chunks is owned
+	// by the NodeHost, its cost does not grow with the number of clusters
 	t.stopper.RunWorker(func() {
 		ticker := time.NewTicker(time.Second)
 		defer ticker.Stop()
@@ -245,9 +294,23 @@ func NewTransport(nhConfig config.NodeHostConfig,
 			}
 		}
 	})
-	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.watcher = newAddressWatcher(t.ctx, t.addressChanged)
 	t.mu.queues = make(map[string]sendQueue)
 	t.mu.breakers = make(map[string]*circuit.Breaker)
+	if interval := nhConfig.PeerAddressRefreshInterval; interval > 0 {
+		t.stopper.RunWorker(func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					t.watcher.refreshAll(t.getTargets())
+				case <-t.stopper.ShouldStop():
+					return
+				}
+			}
+		})
+	}
 	msgConn := func() float64 {
 		t.mu.Lock()
 		defer t.mu.Unlock()
@@ -257,6 +320,10 @@ func NewTransport(nhConfig config.NodeHostConfig,
 		return float64(atomic.LoadUint64(&t.jobs))
 	}
 	t.metrics = newTransportMetrics(true, msgConn, ssCount)
+	t.metrics.addSnapshotStreamGauges(
+		func() float64 { return float64(t.slots.getActiveCount()) },
+		func() float64 { return float64(t.slots.getQueuedCount()) },
+		func() float64 { return float64(chunks.getIncomingCount()) })
 	return t, nil
 }
 
@@ -296,7 +363,7 @@ func (t *Transport) GetCircuitBreaker(key string) *circuit.Breaker {
 	t.mu.Lock()
 	breaker, ok := t.mu.breakers[key]
 	if !ok {
-		breaker = netutil.NewBreaker()
+		breaker = newBreaker(t.nhConfig.PeerBackoff)
 		t.mu.breakers[key] = breaker
 	}
 	t.mu.Unlock()
@@ -304,6 +371,37 @@ func (t *Transport) GetCircuitBreaker(key string) *circuit.Breaker {
 	return breaker
 }
 
+// getTargets returns the addresses of all remote NodeHosts with send queues.
+func (t *Transport) getTargets() map[string]struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	targets := make(map[string]struct{})
+	for _, sq := range t.mu.queues {
+		targets[sq.addr] = struct{}{}
+	}
+	return targets
+}
+
+// addressChanged is invoked when the specified target address is resolved to
+// different IP addresses. Connections to the target are closed and its
+// circuit breaker is reset so new connections are made to the new IPs.
+func (t *Transport) addressChanged(target string,
+	previous []string, current []string) {
+	t.mu.Lock()
+	delete(t.mu.breakers, target)
+	for _, sq := range t.mu.queues {
+		if sq.addr == target {
+			select {
+			case <-sq.stopc:
+			default:
+				close(sq.stopc)
+			}
+		}
+	}
+	t.mu.Unlock()
+	t.sysEvents.AddressChanged(target, previous, current)
+}
+
 func (t *Transport) handleRequest(req pb.MessageBatch) {
 	did := t.nhConfig.GetDeploymentID()
 	if req.DeploymentId != did {
@@ -329,13 +427,49 @@ func (t *Transport) handleRequest(req pb.MessageBatch) {
 	t.metrics.receivedMessages(ssCount, msgCount, dropedMsgCount)
 }
 
+// receiveRequest decrypts the received message batch when required before
+// handling it.
+func (t *Transport) receiveRequest(req pb.MessageBatch) {
+	opened, err := t.cipher.openBatch(req)
+	if err != nil {
+		plog.Warningf("failed to open message batch from %s, %v, dropped",
+			req.SourceAddress, err)
+		return
+	}
+	t.handleRequest(opened)
+}
+
+// receiveChunk decrypts the received snapshot chunk when required before
+// adding it to chunks.
+func (t *Transport) receiveChunk(chunk pb.Chunk) bool {
+	opened, err := t.cipher.openChunk(chunk)
+	if err != nil {
+		plog.Errorf("failed to open snapshot chunk from %s, %v, dropped",
+			dn(chunk.ClusterId, chunk.From), err)
+		return false
+	}
+	return t.chunks.Add(opened)
+}
+
+// resumeChunk returns the ID of the next chunk expected for the snapshot the
+// specified chunk belongs to.
+func (t *Transport) resumeChunk(chunk pb.Chunk) uint64 {
+	opened, err := t.cipher.openChunk(chunk)
+	if err != nil {
+		plog.Errorf("failed to open snapshot resume query from %s, %v",
+			dn(chunk.ClusterId, chunk.From), err)
+		return 0
+	}
+	return t.chunks.Resume(opened)
+}
+
 func (t *Transport) snapshotReceived(clusterID uint64,
 	nodeID uint64, from uint64) {
 	t.msgHandler.HandleSnapshot(clusterID, nodeID, from)
 }
 
 func (t *Transport) notifyUnreachable(addr string, affected nodeMap) {
-	plog.Warningf("%s became unreachable, affected %d nodes", addr, len(affected))
+	plog.Debugf("%s became unreachable, affected %d nodes", addr, len(affected))
 	for n := range affected {
 		t.msgHandler.HandleUnreachable(n.ClusterID, n.NodeID)
 	}
@@ -369,6 +503,7 @@ func (t *Transport) send(req pb.Message) (bool, failedSend) {
 	// fail fast
 	if !t.GetCircuitBreaker(addr).Ready() {
 		t.metrics.messageConnectionFailure()
+		t.peers.dropped(addr, 1)
 		return false, circuitBreakerNotReady
 	}
 	// get the channel, create it in case it is not in the queue map
@@ -376,8 +511,11 @@ func (t *Transport) send(req pb.Message) (bool, failedSend) {
 	sq, ok := t.mu.queues[key]
 	if !ok {
 		sq = sendQueue{
-			ch: make(chan pb.Message, sendQueueLen),
-			rl: server.NewRateLimiter(t.nhConfig.MaxSendQueueSize),
+			ch:    make(chan pb.Message, sendQueueLen),
+			pch:   make(chan pb.Message, sendQueueLen),
+			rl:    server.NewRateLimiter(t.nhConfig.MaxSendQueueSize),
+			stopc: make(chan struct{}),
+			addr:  addr,
 		}
 		t.mu.queues[key] = sq
 	}
@@ -396,7 +534,17 @@ func (t *Transport) send(req pb.Message) (bool, failedSend) {
 			shutdownQueue()
 		})
 	}
+	if isPriorityMessage(req.Type) {
+		select {
+		case sq.pch <- req:
+			return true, success
+		default:
+			t.peers.dropped(addr, 1)
+			return false, chanIsFull
+		}
+	}
 	if sq.rateLimited() {
+		t.peers.dropped(addr, 1)
 		return false, rateLimited
 	}
 	select {
@@ -404,6 +552,7 @@ func (t *Transport) send(req pb.Message) (bool, failedSend) {
 		sq.increase(req)
 		return true, success
 	default:
+		t.peers.dropped(addr, 1)
 		return false, chanIsFull
 	}
 }
@@ -425,110 +574,211 @@ func (t *Transport) connectAndProcess(clusterID uint64,
 		plog.Debugf("%s is trying to connect to %s", t.sourceID, remoteHost)
 		conn, err := t.trans.GetConnection(t.ctx, remoteHost)
 		if err != nil {
-			plog.Errorf("Nodehost %s failed to get a connection to %s, %v",
+			plog.Debugf("Nodehost %s failed to get a connection to %s, %v",
 				t.sourceID, remoteHost, err)
 			return err
 		}
 		defer conn.Close()
+		if t.cipher != nil {
+			conn = &sealedConnection{
+				IConnection: conn,
+				cipher:      t.cipher,
+				target:      remoteHost,
+			}
+		}
 		breaker.Success()
+		t.peerConnected(remoteHost)
 		if successes == 0 || consecFailures > 0 {
 			plog.Debugf("%s, message stream to %s (%s) established",
 				dn(clusterID, from), dn(clusterID, toNodeID), remoteHost)
 			t.sysEvents.ConnectionEstablished(remoteHost, false)
+			if consecFailures > 0 {
+				t.peers.reconnected(remoteHost)
+			}
+			t.watcher.refresh(remoteHost)
 		}
 		return t.processMessages(clusterID, toNodeID, sq, conn, affected)
 	}(); err != nil {
-		plog.Warningf("breaker %s to %s failed, connect and process failed: %s",
-			t.sourceID, remoteHost, err.Error())
+		t.peerFailed(remoteHost, err)
 		breaker.Fail()
 		t.metrics.messageConnectionFailure()
 		t.sysEvents.ConnectionFailed(remoteHost, false)
+		t.watcher.refresh(remoteHost)
 		return false
 	}
 	return true
 }
 
+// peerFailed is invoked when the connection to the specified remote NodeHost
+// failed. Only the transition to the unreachable state is logged as a warning
+// to avoid flooding the log when the remote NodeHost is down.
+func (t *Transport) peerFailed(addr string, err error) {
+	if t.health.failed(addr) {
+		plog.Warningf("%s became unreachable from %s, %v", addr, t.sourceID, err)
+		t.sysEvents.PeerHealthChanged(addr, false)
+	} else {
+		plog.Debugf("%s is still unreachable from %s, %v", addr, t.sourceID, err)
+	}
+}
+
+// peerConnected is invoked when connected to the specified remote NodeHost.
+func (t *Transport) peerConnected(addr string) {
+	if t.health.connected(addr) {
+		plog.Infof("%s became reachable from %s", addr, t.sourceID)
+		t.sysEvents.PeerHealthChanged(addr, true)
+	}
+}
+
 func (t *Transport) processMessages(clusterID uint64,
 	toNodeID uint64, sq sendQueue, conn raftio.IConnection,
 	affected nodeMap) error {
 	idleTimer := time.NewTimer(idleTimeout)
 	defer idleTimer.Stop()
+	var delayTimer *time.Timer
+	if t.batch.MaxDelay > 0 {
+		delayTimer = time.NewTimer(t.batch.MaxDelay)
+		if !delayTimer.Stop() {
+			<-delayTimer.C
+		}
+		defer delayTimer.Stop()
+	}
 	sz := uint64(0)
 	batch := pb.MessageBatch{
 		SourceAddress: t.sourceID,
 		BinVer:        raftio.TransportBinVersion,
 	}
 	did := t.nhConfig.GetDeploymentID()
+	// requests contains priority messages, bulk contains other messages
 	requests := make([]pb.Message, 0)
+	bulk := make([]pb.Message, 0)
+	add := func(req pb.Message, priority bool) {
+		sz += uint64(req.SizeUpperLimit())
+		if priority {
+			requests = append(requests, req)
+		} else {
+			sq.decrease(req)
+			bulk = append(bulk, req)
+		}
+	}
+	full := func() bool {
+		count := uint64(len(requests) + len(bulk))
+		return sz >= t.batch.MaxBytes ||
+			(t.batch.MaxCount > 0 && count >= t.batch.MaxCount)
+	}
 	for {
 		idleTimer.Reset(idleTimeout)
+		var req pb.Message
+		priority := false
 		select {
 		case <-t.stopper.ShouldStop():
 			return nil
 		case <-idleTimer.C:
 			return nil
-		case req := <-sq.ch:
-			n := raftio.NodeInfo{
-				ClusterID: clusterID,
-				NodeID:    req.From,
-			}
-			affected[n] = struct{}{}
-			sq.decrease(req)
-			sz += uint64(req.SizeUpperLimit())
-			requests = append(requests, req)
-			for done := false; !done && sz < maxMsgBatchSize; {
+		case <-sq.stopc:
+			return nil
+		case req = <-sq.pch:
+			priority = true
+		case req = <-sq.ch:
+		}
+		n := raftio.NodeInfo{
+			ClusterID: clusterID,
+			NodeID:    req.From,
+		}
+		affected[n] = struct{}{}
+		add(req, priority)
+		// wait up to MaxDelay for more messages, batches with priority messages
+		// are never delayed
+		waiting := delayTimer != nil && !priority
+		if waiting {
+			delayTimer.Reset(t.batch.MaxDelay)
+		}
+		for done := false; !done && !full(); {
+			select {
+			case req = <-sq.pch:
+				add(req, true)
+			default:
 				select {
+				case req = <-sq.pch:
+					add(req, true)
 				case req = <-sq.ch:
-					sq.decrease(req)
-					sz += uint64(req.SizeUpperLimit())
-					requests = append(requests, req)
+					add(req, false)
 				case <-t.stopper.ShouldStop():
 					return nil
 				default:
-					done = true
+					if !waiting || len(requests) > 0 {
+						done = true
+						break
+					}
+					select {
+					case req = <-sq.pch:
+						add(req, true)
+					case req = <-sq.ch:
+						add(req, false)
+					case <-t.stopper.ShouldStop():
+						return nil
+					case <-delayTimer.C:
+						waiting = false
+						done = true
+					}
 				}
 			}
-			batch.DeploymentId = did
-			twoBatch := false
-			if sz < maxMsgBatchSize || len(requests) == 1 {
-				batch.Requests = requests
-			} else {
-				twoBatch = true
-				batch.Requests = requests[:len(requests)-1]
-			}
-			if err := t.sendMessageBatch(conn, batch); err != nil {
-				plog.Errorf("send batch failed, target %s (%v), %d",
+		}
+		if waiting && !delayTimer.Stop() {
+			<-delayTimer.C
+		}
+		// priority messages are sent ahead of other messages
+		requests = append(requests, bulk...)
+		bulk = freeEntries(bulk)
+		batch.DeploymentId = did
+		twoBatch := false
+		if sz < t.batch.MaxBytes || len(requests) == 1 {
+			batch.Requests = requests
+		} else {
+			twoBatch = true
+			batch.Requests = requests[:len(requests)-1]
+		}
+		if err := t.sendMessageBatch(conn, sq.addr, batch); err != nil {
+			plog.Errorf("send batch failed, target %s (%v), %d",
+				dn(clusterID, toNodeID), err, len(batch.Requests))
+			return err
+		}
+		if twoBatch {
+			batch.Requests = []pb.Message{requests[len(requests)-1]}
+			if err := t.sendMessageBatch(conn, sq.addr, batch); err != nil {
+				plog.Errorf("send batch failed, taret node %s (%v), %d",
 					dn(clusterID, toNodeID), err, len(batch.Requests))
 				return err
 			}
-			if twoBatch {
-				batch.Requests = []pb.Message{requests[len(requests)-1]}
-				if err := t.sendMessageBatch(conn, batch); err != nil {
-					plog.Errorf("send batch failed, taret node %s (%v), %d",
-						dn(clusterID, toNodeID), err, len(batch.Requests))
-					return err
-				}
-			}
-			sz = 0
-			requests, batch = lazyFree(requests, batch)
-			requests = requests[:0]
 		}
+		t.peers.queueLength(sq.addr, sq)
+		sz = 0
+		requests, batch = lazyFree(requests, batch)
+		requests = requests[:0]
 	}
 }
 
 func lazyFree(reqs []pb.Message,
 	mb pb.MessageBatch) ([]pb.Message, pb.MessageBatch) {
+	if lazyFreeCycle > 0 {
+		freeEntries(reqs)
+		mb.Requests = []pb.Message{}
+	}
+	return reqs, mb
+}
+
+// freeEntries releases entries referenced by the specified messages when
+// lazy free is enabled, it returns the emptied slice for reuse.
+func freeEntries(reqs []pb.Message) []pb.Message {
 	if lazyFreeCycle > 0 {
 		for i := 0; i < len(reqs); i++ {
 			reqs[i].Entries = nil
 		}
-		mb.Requests = []pb.Message{}
 	}
-	return reqs, mb
+	return reqs[:0]
 }
 
 func (t *Transport) sendMessageBatch(conn raftio.IConnection,
-	batch pb.MessageBatch) error {
+	addr string, batch pb.MessageBatch) error {
 	if f := t.preSendBatch.Load(); f != nil {
 		updated, shouldSend := f.(SendMessageBatchFunc)(batch)
 		if !shouldSend {
@@ -536,11 +786,14 @@ func (t *Transport) sendMessageBatch(conn raftio.IConnection,
 		}
 		return conn.SendMessageBatch(updated)
 	}
+	start := time.Now()
 	if err := conn.SendMessageBatch(batch); err != nil {
 		t.metrics.messageSendFailure(uint64(len(batch.Requests)))
+		t.peers.dropped(addr, uint64(len(batch.Requests)))
 		return err
 	}
 	t.metrics.messageSendSuccess(uint64(len(batch.Requests)))
+	t.peers.batchSent(addr, uint64(len(batch.Requests)), time.Since(start))
 	return nil
 }
 
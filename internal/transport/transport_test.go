@@ -16,10 +16,12 @@ package transport
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
 	"math/rand"
+	"net/http/httptest"
 	"os"
 	"strconv"
 	"sync"
@@ -68,6 +70,10 @@ type dummyTransportEvent struct{}
 
 func (d *dummyTransportEvent) ConnectionEstablished(addr string, snapshot bool) {}
 func (d *dummyTransportEvent) ConnectionFailed(addr string, snapshot bool)      {}
+func (d *dummyTransportEvent) AddressChanged(addr string,
+	previous []string, current []string) {
+}
+func (d *dummyTransportEvent) PeerHealthChanged(addr string, reachable bool) {}
 
 type testSnapshotDir struct {
 	fs vfs.IFS
@@ -639,6 +645,47 @@ func TestSnapshotCanBeSent(t *testing.T) {
 	}
 }
 
+func TestSnapshotCanBeSentUsingParallelStreams(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	for _, streams := range []uint64{2, 4} {
+		testSnapshotCanBeSentWithStreams(t,
+			snapshotChunkSize*9+1, 10000, false, nil, streams, fs)
+		testSnapshotCanBeSentWithStreams(t,
+			snapshotChunkSize*9+1, 10000, true, nil, streams, fs)
+	}
+}
+
+func TestChunkWindowBoundsOutOfOrderChunks(t *testing.T) {
+	w := newChunkWindow(1, 4)
+	for id := uint64(1); id < 5; id++ {
+		if !w.wait(id) {
+			t.Fatalf("wait failed")
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		w.wait(5)
+		close(done)
+	}()
+	w.done(2)
+	w.done(3)
+	select {
+	case <-done:
+		t.Fatalf("chunk 5 is allowed before chunk 1 is sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.done(1)
+	<-done
+	if w.low != 4 {
+		t.Errorf("low %d, want 4", w.low)
+	}
+	w.fail()
+	if w.wait(100) {
+		t.Errorf("wait returned true after failure")
+	}
+}
+
 func testSourceAddressWillBeAddedToNodeRegistry(t *testing.T, mutualTLS bool, fs vfs.IFS) {
 	handler := newTestMessageHandler()
 	trans, nodes, stopper, _ := newTestTransport(handler, mutualTLS, fs)
@@ -750,8 +797,21 @@ func getTestSnapshotFileSize(sz uint64) uint64 {
 
 func testSnapshotCanBeSent(t *testing.T,
 	sz uint64, maxWait uint64, mutualTLS bool, fs vfs.IFS) {
+	testSnapshotCanBeSentWithCipher(t, sz, maxWait, mutualTLS, nil, fs)
+}
+
+func testSnapshotCanBeSentWithCipher(t *testing.T, sz uint64,
+	maxWait uint64, mutualTLS bool, p *payloadCipher, fs vfs.IFS) {
+	testSnapshotCanBeSentWithStreams(t, sz, maxWait, mutualTLS, p, 0, fs)
+}
+
+func testSnapshotCanBeSentWithStreams(t *testing.T, sz uint64,
+	maxWait uint64, mutualTLS bool, p *payloadCipher, streams uint64,
+	fs vfs.IFS) {
 	handler := newTestMessageHandler()
 	trans, nodes, stopper, tt := newTestTransport(handler, mutualTLS, fs)
+	trans.cipher = p
+	trans.nhConfig.SnapshotStream.ParallelStreams = streams
 	defer func() {
 		if err := fs.RemoveAll(snapshotDir); err != nil {
 			t.Fatalf("%v", err)
@@ -1007,6 +1067,107 @@ func testFailedConnectionReportsSnapshotFailure(t *testing.T,
 	}
 }
 
+// brokenSnapshotTransport returns snapshot connections that break once when
+// sending the specified chunk.
+type brokenSnapshotTransport struct {
+	raftio.ITransport
+	failAt     uint64
+	failed     uint32
+	firstCount uint32
+}
+
+func (b *brokenSnapshotTransport) GetSnapshotConnection(ctx context.Context,
+	target string) (raftio.ISnapshotConnection, error) {
+	conn, err := b.ITransport.GetSnapshotConnection(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return &brokenSnapshotConnection{
+		IResumableSnapshotConnection: conn.(raftio.IResumableSnapshotConnection),
+		t:                            b,
+	}, nil
+}
+
+type brokenSnapshotConnection struct {
+	raftio.IResumableSnapshotConnection
+	t *brokenSnapshotTransport
+}
+
+func (c *brokenSnapshotConnection) SendChunk(chunk raftpb.Chunk) error {
+	if chunk.ChunkId == 0 {
+		atomic.AddUint32(&c.t.firstCount, 1)
+	}
+	if chunk.ChunkId == c.t.failAt &&
+		atomic.CompareAndSwapUint32(&c.t.failed, 0, 1) {
+		return io.ErrUnexpectedEOF
+	}
+	return c.IResumableSnapshotConnection.SendChunk(chunk)
+}
+
+func testBrokenSnapshotTransferCanBeResumed(t *testing.T,
+	mutualTLS bool, fs vfs.IFS) {
+	sz := snapshotChunkSize*3 + 1
+	handler := newTestMessageHandler()
+	trans, nodes, stopper, tt := newTestTransport(handler, mutualTLS, fs)
+	broken := &brokenSnapshotTransport{ITransport: trans.trans, failAt: 2}
+	trans.trans = broken
+	defer func() {
+		if err := fs.RemoveAll(snapshotDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	defer trans.env.Stop()
+	defer tt.cleanup()
+	defer trans.Stop()
+	defer stopper.Stop()
+	nodes.Add(100, 2, serverAddress)
+	tt.generateSnapshotFile(100, 12, testSnapshotIndex, "testsnapshot.gbsnap", sz, fs)
+	m := getTestSnapshotMessage(2)
+	m.Snapshot.FileSize = getTestSnapshotFileSize(sz)
+	dir := tt.GetSnapshotDir(100, 12, testSnapshotIndex)
+	m.Snapshot.Filepath = fs.PathJoin(dir, "testsnapshot.gbsnap")
+	if err := fs.MkdirAll(trans.dir(100, 2), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !trans.SendSnapshot(m) {
+		t.Fatalf("failed to send the snapshot")
+	}
+	waitForFirstSnapshotStatusUpdate(handler, 10000)
+	waitForSnapshotCountUpdate(handler, 10000)
+	if handler.getSnapshotCount(100, 2) != 1 {
+		t.Errorf("got %d, want %d", handler.getSnapshotCount(100, 2), 1)
+	}
+	if handler.getFailedSnapshotCount(100, 2) != 0 {
+		t.Errorf("got %d, want 0", handler.getFailedSnapshotCount(100, 2))
+	}
+	if atomic.LoadUint32(&broken.failed) != 1 {
+		t.Errorf("snapshot stream not broken")
+	}
+	if v := atomic.LoadUint32(&broken.firstCount); v != 1 {
+		t.Errorf("first chunk sent %d times, not resumed", v)
+	}
+	md5Original, err := tt.getSnapshotFileMD5(100,
+		2, testSnapshotIndex, "testsnapshot.gbsnap")
+	if err != nil {
+		t.Errorf("err %v, want nil", err)
+	}
+	md5Received, err := tt.getSnapshotFileMD5(100,
+		12, testSnapshotIndex, "testsnapshot.gbsnap")
+	if err != nil {
+		t.Errorf("err %v, want nil", err)
+	}
+	if !bytes.Equal(md5Original, md5Received) {
+		t.Errorf("snapshot content changed during transmission")
+	}
+}
+
+func TestBrokenSnapshotTransferCanBeResumed(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	testBrokenSnapshotTransferCanBeResumed(t, true, fs)
+	testBrokenSnapshotTransferCanBeResumed(t, false, fs)
+}
+
 func TestFailedConnectionReportsSnapshotFailure(t *testing.T) {
 	fs := vfs.GetTestFS()
 	defer leaktest.AfterTest(t)()
@@ -1082,9 +1243,14 @@ func TestFailedSnapshotSendWillBeReported(t *testing.T) {
 }
 
 func testSnapshotWithExternalFilesCanBeSend(t *testing.T,
-	sz uint64, maxWait uint64, mutualTLS bool, fs vfs.IFS) {
+	sz uint64, maxWait uint64, mutualTLS bool, pull bool, fs vfs.IFS) {
 	handler := newTestMessageHandler()
 	trans, nodes, stopper, tt := newTestTransport(handler, mutualTLS, fs)
+	if pull {
+		hs := httptest.NewServer(NewSnapshotFileHandler(tt.GetSnapshotRootDir, fs))
+		defer hs.Close()
+		trans.nhConfig.SnapshotStream.PullURL = hs.URL
+	}
 	defer func() {
 		if err := fs.RemoveAll(snapshotDir); err != nil {
 			t.Fatalf("%v", err)
@@ -1160,10 +1326,16 @@ func testSnapshotWithExternalFilesCanBeSend(t *testing.T,
 
 func TestSnapshotWithExternalFilesCanBeSend(t *testing.T) {
 	fs := vfs.GetTestFS()
-	testSnapshotWithExternalFilesCanBeSend(t, snapshotChunkSize/2, 3000, false, fs)
-	testSnapshotWithExternalFilesCanBeSend(t, snapshotChunkSize*3+100, 3000, false, fs)
-	testSnapshotWithExternalFilesCanBeSend(t, snapshotChunkSize/2, 3000, true, fs)
-	testSnapshotWithExternalFilesCanBeSend(t, snapshotChunkSize*3+100, 3000, true, fs)
+	testSnapshotWithExternalFilesCanBeSend(t, snapshotChunkSize/2, 3000, false, false, fs)
+	testSnapshotWithExternalFilesCanBeSend(t, snapshotChunkSize*3+100, 3000, false, false, fs)
+	testSnapshotWithExternalFilesCanBeSend(t, snapshotChunkSize/2, 3000, true, false, fs)
+	testSnapshotWithExternalFilesCanBeSend(t, snapshotChunkSize*3+100, 3000, true, false, fs)
+}
+
+func TestSnapshotWithExternalFilesCanBePulled(t *testing.T) {
+	fs := vfs.GetTestFS()
+	testSnapshotWithExternalFilesCanBeSend(t, snapshotChunkSize/2, 3000, false, true, fs)
+	testSnapshotWithExternalFilesCanBeSend(t, snapshotChunkSize*3+100, 3000, true, true, fs)
 }
 
 func TestNoOPTransportCanBeCreated(t *testing.T) {
@@ -1438,6 +1610,199 @@ func TestInMemoryEntrySizeCanBeLimitedWhenSendingMessages(t *testing.T) {
 	}
 }
 
+func TestPriorityMessagesAreSentAheadOfBulkMessages(t *testing.T) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	tt, nodes, _, _, _ := newNOOPTestTransport(handler, fs)
+	defer tt.Stop()
+	nodes.Add(100, 2, serverAddress)
+	var mu sync.Mutex
+	batches := make([]raftpb.MessageBatch, 0)
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	f := func(b raftpb.MessageBatch) (raftpb.MessageBatch, bool) {
+		mu.Lock()
+		batches = append(batches, b)
+		first := len(batches) == 1
+		mu.Unlock()
+		if first {
+			close(blocked)
+			<-unblock
+		}
+		return b, true
+	}
+	tt.SetPreSendBatchHook(f)
+	replicate := raftpb.Message{ClusterId: 100, To: 2, Type: raftpb.Replicate}
+	if !tt.Send(replicate) {
+		t.Fatalf("failed to send")
+	}
+	<-blocked
+	for i := 0; i < 3; i++ {
+		if !tt.Send(replicate) {
+			t.Fatalf("failed to send")
+		}
+	}
+	heartbeat := raftpb.Message{ClusterId: 100, To: 2, Type: raftpb.Heartbeat}
+	if !tt.Send(heartbeat) {
+		t.Fatalf("failed to send")
+	}
+	close(unblock)
+	for i := 0; i < 1000; i++ {
+		mu.Lock()
+		count := len(batches)
+		mu.Unlock()
+		if count == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 2 {
+		t.Fatalf("got %d batches, want 2", len(batches))
+	}
+	reqs := batches[1].Requests
+	if len(reqs) != 4 {
+		t.Fatalf("got %d messages, want 4", len(reqs))
+	}
+	if reqs[0].Type != raftpb.Heartbeat {
+		t.Errorf("heartbeat not sent first")
+	}
+	for _, m := range reqs[1:] {
+		if m.Type != raftpb.Replicate {
+			t.Errorf("unexpected type %s", m.Type)
+		}
+	}
+}
+
+type testBatchRecorder struct {
+	mu      sync.Mutex
+	batches []raftpb.MessageBatch
+}
+
+func (r *testBatchRecorder) record(b raftpb.MessageBatch) (raftpb.MessageBatch,
+	bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, b)
+	return b, true
+}
+
+func (r *testBatchRecorder) sizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]int, 0)
+	for _, b := range r.batches {
+		result = append(result, len(b.Requests))
+	}
+	return result
+}
+
+func (r *testBatchRecorder) wait(count int) {
+	for i := 0; i < 1000; i++ {
+		total := 0
+		for _, v := range r.sizes() {
+			total += v
+		}
+		if total >= count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMessageBatchCountIsLimited(t *testing.T) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	tt, nodes, _, _, _ := newNOOPTestTransport(handler, fs)
+	defer tt.Stop()
+	tt.batch.MaxCount = 2
+	nodes.Add(100, 2, serverAddress)
+	r := &testBatchRecorder{}
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	first := true
+	tt.SetPreSendBatchHook(func(b raftpb.MessageBatch) (raftpb.MessageBatch,
+		bool) {
+		if first {
+			first = false
+			close(blocked)
+			<-unblock
+		}
+		return r.record(b)
+	})
+	replicate := raftpb.Message{ClusterId: 100, To: 2, Type: raftpb.Replicate}
+	if !tt.Send(replicate) {
+		t.Fatalf("failed to send")
+	}
+	<-blocked
+	for i := 0; i < 5; i++ {
+		if !tt.Send(replicate) {
+			t.Fatalf("failed to send")
+		}
+	}
+	close(unblock)
+	r.wait(6)
+	sizes := r.sizes()
+	if len(sizes) != 4 || sizes[0] != 1 ||
+		sizes[1] != 2 || sizes[2] != 2 || sizes[3] != 1 {
+		t.Errorf("unexpected batch sizes %v", sizes)
+	}
+}
+
+func TestMessageBatchCanBeDelayed(t *testing.T) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	tt, nodes, _, _, _ := newNOOPTestTransport(handler, fs)
+	defer tt.Stop()
+	tt.batch.MaxDelay = 500 * time.Millisecond
+	nodes.Add(100, 2, serverAddress)
+	r := &testBatchRecorder{}
+	tt.SetPreSendBatchHook(r.record)
+	replicate := raftpb.Message{ClusterId: 100, To: 2, Type: raftpb.Replicate}
+	for i := 0; i < 2; i++ {
+		if !tt.Send(replicate) {
+			t.Fatalf("failed to send")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	r.wait(2)
+	if sizes := r.sizes(); len(sizes) != 1 || sizes[0] != 2 {
+		t.Errorf("unexpected batch sizes %v", sizes)
+	}
+}
+
+func TestPriorityMessagesAreNotDelayed(t *testing.T) {
+	fs := vfs.GetTestFS()
+	handler := newTestMessageHandler()
+	tt, nodes, _, _, _ := newNOOPTestTransport(handler, fs)
+	defer tt.Stop()
+	tt.batch.MaxDelay = time.Hour
+	nodes.Add(100, 2, serverAddress)
+	r := &testBatchRecorder{}
+	tt.SetPreSendBatchHook(r.record)
+	heartbeat := raftpb.Message{ClusterId: 100, To: 2, Type: raftpb.Heartbeat}
+	if !tt.Send(heartbeat) {
+		t.Fatalf("failed to send")
+	}
+	r.wait(1)
+	if sizes := r.sizes(); len(sizes) != 1 {
+		t.Errorf("heartbeat delayed")
+	}
+}
+
+func TestPriorityMessageTypes(t *testing.T) {
+	for _, mt := range []raftpb.MessageType{raftpb.Heartbeat,
+		raftpb.HeartbeatResp, raftpb.RequestVote, raftpb.RequestVoteResp} {
+		if !isPriorityMessage(mt) {
+			t.Errorf("%s is not a priority message", mt)
+		}
+	}
+	if isPriorityMessage(raftpb.Replicate) {
+		t.Errorf("replicate is a priority message")
+	}
+}
+
 func TestInMemoryEntrySizeCanDropToZero(t *testing.T) {
 	fs := vfs.GetTestFS()
 	handler := newTestMessageHandler()
@@ -1484,3 +1849,124 @@ func TestInMemoryEntrySizeCanDropToZero(t *testing.T) {
 		}
 	}
 }
+
+type testTransportMetrics struct {
+	mu       sync.Mutex
+	sent     map[string]uint64
+	dropped  map[string]uint64
+	queued   map[string]uint64
+	inflight map[string]uint64
+	reported bool
+}
+
+func newTestTransportMetrics() *testTransportMetrics {
+	return &testTransportMetrics{
+		sent:     make(map[string]uint64),
+		dropped:  make(map[string]uint64),
+		queued:   make(map[string]uint64),
+		inflight: make(map[string]uint64),
+	}
+}
+
+func (m *testTransportMetrics) MessageBatchSent(addr string,
+	count uint64, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent[addr] += count
+}
+
+func (m *testTransportMetrics) MessageDropped(addr string, count uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped[addr] += count
+}
+
+func (m *testTransportMetrics) SendQueueLength(addr string, length uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued[addr] = length
+	m.reported = true
+}
+
+func (m *testTransportMetrics) Reconnected(addr string) {}
+
+func (m *testTransportMetrics) SnapshotBytesInFlight(addr string, sz uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inflight[addr] = sz
+}
+
+func (m *testTransportMetrics) getSent(addr string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sent[addr]
+}
+
+func TestTransportMetricsAreReportedPerPeer(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	handler := newTestMessageHandler()
+	trans, nodes, stopper, _ := newTestTransport(handler, false, fs)
+	defer trans.env.Stop()
+	defer trans.Stop()
+	defer stopper.Stop()
+	m := newTestTransportMetrics()
+	trans.peers = newPeerMetrics(m)
+	nodes.Add(100, 2, serverAddress)
+	for i := 0; i < 20; i++ {
+		msg := raftpb.Message{
+			Type:      raftpb.Heartbeat,
+			To:        2,
+			ClusterId: 100,
+		}
+		if !trans.Send(msg) {
+			t.Errorf("failed to send message")
+		}
+	}
+	for i := 0; i < 200; i++ {
+		if m.getSent(serverAddress) == 20 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := m.getSent(serverAddress); v != 20 {
+		t.Errorf("sent count %d, want 20", v)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.reported {
+		t.Errorf("send queue length not reported")
+	}
+	if len(m.dropped) != 0 {
+		t.Errorf("unexpected dropped messages %v", m.dropped)
+	}
+}
+
+func TestSnapshotBytesInFlightAreReleased(t *testing.T) {
+	m := newTestTransportMetrics()
+	pm := newPeerMetrics(m)
+	pm.snapshotSent("a1", 100)
+	pm.snapshotSent("a1", 200)
+	pm.snapshotSent("a2", 50)
+	if m.inflight["a1"] != 300 || m.inflight["a2"] != 50 {
+		t.Errorf("unexpected in-flight bytes %v", m.inflight)
+	}
+	pm.snapshotDone("a1", 100)
+	if m.inflight["a1"] != 200 {
+		t.Errorf("in-flight bytes %d, want 200", m.inflight["a1"])
+	}
+	pm.snapshotDone("a1", 200)
+	if m.inflight["a1"] != 0 {
+		t.Errorf("in-flight bytes %d, want 0", m.inflight["a1"])
+	}
+	if _, ok := pm.inflight["a1"]; ok {
+		t.Errorf("a1 not removed")
+	}
+	// no-op when there is no listener
+	pm = newPeerMetrics(nil)
+	pm.snapshotSent("a1", 100)
+	pm.dropped("a1", 1)
+	if len(pm.inflight) != 0 {
+		t.Errorf("unexpected in-flight record")
+	}
+}
@@ -20,6 +20,8 @@ import (
 	"sync/atomic"
 
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
 	pb "github.com/lni/dragonboat/v3/raftpb"
 )
 
@@ -33,8 +35,17 @@ const (
 	// Snappy is the CompressionType value used to indicate that google snappy
 	// is used for data compression.
 	Snappy CompressionType = pb.Snappy
+	// Zstd is the CompressionType value used to indicate that zstd is used for
+	// data compression.
+	Zstd CompressionType = pb.Zstd
 )
 
+// IsKnownCompressionType returns a boolean value indicating whether the
+// specified compression type is supported.
+func IsKnownCompressionType(ct CompressionType) bool {
+	return ct == NoCompression || ct == Snappy || ct == Zstd
+}
+
 // CountedWriter is a io.WriteCloser wrapper that keeps the total number of bytes
 // written to the underlying writer.
 type CountedWriter struct {
@@ -80,6 +91,15 @@ type Compressor struct {
 
 // NewCompressor returns a Compressor instance.
 func NewCompressor(ct CompressionType, wc io.WriteCloser) io.WriteCloser {
+	return NewLeveledCompressor(ct, 0, wc)
+}
+
+// NewLeveledCompressor returns a Compressor instance that uses the specified
+// compression level. The level is only used by Zstd, it follows the zstd
+// convention of 1 (fastest) to 22 (best compression), 0 means the default
+// level.
+func NewLeveledCompressor(ct CompressionType,
+	level int, wc io.WriteCloser) io.WriteCloser {
 	if ct == NoCompression {
 		return wc
 	} else if ct == Snappy {
@@ -89,6 +109,16 @@ func NewCompressor(ct CompressionType, wc io.WriteCloser) io.WriteCloser {
 			ct: ct,
 		}
 		return c
+	} else if ct == Zstd {
+		el := zstd.SpeedDefault
+		if level > 0 {
+			el = zstd.EncoderLevelFromZstd(level)
+		}
+		w, err := zstd.NewWriter(wc, zstd.WithEncoderLevel(el))
+		if err != nil {
+			panic(err)
+		}
+		return &Compressor{uw: wc, wc: w, ct: ct}
 	} else {
 		panic("unknown compression type")
 	}
@@ -118,6 +148,7 @@ func (c *Compressor) Close() error {
 type Decompressor struct {
 	ur io.ReadCloser
 	rc io.Reader
+	zd *zstd.Decoder
 	ct CompressionType
 }
 
@@ -132,6 +163,12 @@ func NewDecompressor(ct CompressionType, r io.ReadCloser) io.ReadCloser {
 			ct: ct,
 		}
 		return d
+	} else if ct == Zstd {
+		zd, err := zstd.NewReader(r)
+		if err != nil {
+			panic(err)
+		}
+		return &Decompressor{ur: r, rc: zd, zd: zd, ct: ct}
 	} else {
 		panic("unknown compression type")
 	}
@@ -148,6 +185,9 @@ func (dc *Decompressor) Close() error {
 		panic("not suppose to reach here")
 	} else if dc.ct == Snappy {
 		return dc.ur.Close()
+	} else if dc.ct == Zstd {
+		dc.zd.Close()
+		return dc.ur.Close()
 	} else {
 		panic("unknown compression type")
 	}
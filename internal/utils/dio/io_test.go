@@ -16,6 +16,7 @@ package dio
 
 import (
 	"bytes"
+	"io/ioutil"
 	"math/rand"
 	"testing"
 )
@@ -99,6 +100,35 @@ func (t *tb) Read(data []byte) (int, error) {
 	return t.buf.Read(data)
 }
 
+func TestZstdCompressorDecompressor(t *testing.T) {
+	for _, level := range []int{0, 1, 3, 19} {
+		src := bytes.Repeat([]byte("test-data"), 64*1024)
+		buf := &tb{buf: bytes.NewBuffer(nil)}
+		c := NewLeveledCompressor(Zstd, level, buf)
+		n, err := c.Write(src)
+		if n != len(src) || err != nil {
+			t.Fatalf("failed to write all data")
+		}
+		if err := c.Close(); err != nil {
+			t.Fatalf("failed to close %v", err)
+		}
+		if buf.buf.Len() >= len(src) {
+			t.Errorf("data not compressed, level %d", level)
+		}
+		d := NewDecompressor(Zstd, buf)
+		dst, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatalf("failed to close %v", err)
+		}
+		if !bytes.Equal(src, dst) {
+			t.Fatalf("content changed, level %d", level)
+		}
+	}
+}
+
 func TestCompressorDecompressor(t *testing.T) {
 	for i := 1; i <= 128; i++ {
 		src := make([]byte, 10*i*1024)
@@ -36,6 +36,11 @@ var DefaultFS IFS = gvfs.Default
 // MemStrictFS is a vfs instance using memfs.
 var MemStrictFS IFS = gvfs.NewStrictMem()
 
+// NewMem returns a new memory backed IFS instance.
+func NewMem() IFS {
+	return gvfs.NewMem()
+}
+
 // File is the file interface returned by IFS.
 type File = gvfs.File
 
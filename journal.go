@@ -0,0 +1,305 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"bufio"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+)
+
+const (
+	journalFilename    = "dragonboat.journal"
+	journalOldFilename = "dragonboat.journal.old"
+	journalTmpFilename = "dragonboat.journal.tmp"
+)
+
+// JournalEvent is a significant event recorded in the event journal of a Raft
+// node, see the EventJournalSize field of config.Config for details.
+type JournalEvent struct {
+	// Time is the time when the event was recorded.
+	Time time.Time
+	// Type is the type of the event, e.g. LeaderUpdated or SnapshotCreated.
+	Type string
+	// Term is the Raft term of elections related events.
+	Term uint64 `json:",omitempty"`
+	// LeaderID is the NodeID of the new leader for LeaderUpdated events.
+	LeaderID uint64 `json:",omitempty"`
+	// From is the NodeID of the sender for received snapshots.
+	From uint64 `json:",omitempty"`
+	// Index is the Raft log index related to the event.
+	Index uint64 `json:",omitempty"`
+	// Error is the error message of failure events.
+	Error string `json:",omitempty"`
+}
+
+var journalEventTypes = map[server.SystemEventType]string{
+	server.NodeReady:             "NodeReady",
+	server.NodeUnloaded:          "NodeUnloaded",
+	server.MembershipChanged:     "MembershipChanged",
+	server.SendSnapshotStarted:   "SendSnapshotStarted",
+	server.SendSnapshotCompleted: "SendSnapshotCompleted",
+	server.SendSnapshotAborted:   "SendSnapshotAborted",
+	server.SnapshotReceived:      "SnapshotReceived",
+	server.SnapshotRecovered:     "SnapshotRecovered",
+	server.SnapshotCreated:       "SnapshotCreated",
+	server.SnapshotCompacted:     "SnapshotCompacted",
+	server.LogCompacted:          "LogCompacted",
+	server.LogDBCompacted:        "LogDBCompacted",
+	server.NodePanicked:          "NodePanicked",
+	server.ChecksumMismatch:      "ChecksumMismatch",
+}
+
+// eventJournal is a bounded on disk journal of significant events of a Raft
+// node. Events are appended to the current journal file, once it holds half of
+// the maximum number of events, it becomes the old journal file and a new
+// current journal file is started. At least the most recent max/2 events are
+// thus always available.
+//
+// Events are recorded by the step and apply workers, they are written into the
+// journal file in place while the file is synced by a background goroutine so
+// recording an event never waits for the disk. The journal file is also synced
+// when it is rotated or closed.
+type eventJournal struct {
+	mu sync.Mutex
+	// syncMu is held when syncing or replacing f, mu is not held when syncing
+	// so events can be recorded in the meantime.
+	syncMu  sync.Mutex
+	wg      sync.WaitGroup
+	fs      vfs.IFS
+	f       vfs.File
+	dir     string
+	count   uint64
+	limit   uint64
+	syncing bool
+	dirty   bool
+}
+
+func openEventJournal(dir string, max uint64, fs vfs.IFS) (*eventJournal, error) {
+	j := &eventJournal{dir: dir, fs: fs, limit: max / 2}
+	if j.limit == 0 {
+		j.limit = 1
+	}
+	events, err := readJournalFile(fs.PathJoin(dir, journalFilename), fs)
+	if err != nil {
+		return nil, err
+	}
+	// vfs.IFS doesn't support appending to existing files, existing events are
+	// rewritten into a new file which then replaces the current journal file
+	tmp := fs.PathJoin(dir, journalTmpFilename)
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+	for _, e := range events {
+		if err := j.write(e); err != nil {
+			j.close()
+			return nil, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		j.close()
+		return nil, err
+	}
+	if err := fs.Rename(tmp, fs.PathJoin(dir, journalFilename)); err != nil {
+		j.close()
+		return nil, err
+	}
+	if err := fileutil.SyncDir(dir, fs); err != nil {
+		j.close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *eventJournal) record(e JournalEvent) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := j.mayRotate(); err != nil {
+		plog.Errorf("failed to rotate event journal in %s, %v", j.dir, err)
+		return
+	}
+	if err := j.write(e); err != nil {
+		plog.Errorf("failed to record event in %s, %v", j.dir, err)
+		return
+	}
+	if j.syncing {
+		j.dirty = true
+		return
+	}
+	j.syncing = true
+	j.wg.Add(1)
+	go j.sync()
+}
+
+// sync keeps syncing the journal file until there is no more event recorded
+// since the last sync.
+func (j *eventJournal) sync() {
+	defer j.wg.Done()
+	for {
+		j.syncMu.Lock()
+		if j.f != nil {
+			if err := j.f.Sync(); err != nil {
+				plog.Errorf("failed to sync event journal in %s, %v", j.dir, err)
+			}
+		}
+		j.syncMu.Unlock()
+		j.mu.Lock()
+		if !j.dirty {
+			j.syncing = false
+			j.mu.Unlock()
+			return
+		}
+		j.dirty = false
+		j.mu.Unlock()
+	}
+}
+
+func (j *eventJournal) recordSystemEvent(e server.SystemEvent) {
+	if j == nil {
+		return
+	}
+	if t, ok := journalEventTypes[e.Type]; ok {
+		j.record(JournalEvent{Type: t,
+			From: e.From, Index: e.Index, Error: e.Reason})
+	}
+}
+
+func (j *eventJournal) recordError(t string, index uint64, err error) {
+	if j == nil {
+		return
+	}
+	j.record(JournalEvent{Type: t, Index: index, Error: err.Error()})
+}
+
+func (j *eventJournal) mayRotate() error {
+	if j.count < j.limit {
+		return nil
+	}
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	if err := j.closeFile(); err != nil {
+		return err
+	}
+	fp := j.fs.PathJoin(j.dir, journalFilename)
+	if err := j.fs.Rename(fp, j.fs.PathJoin(j.dir, journalOldFilename)); err != nil {
+		return err
+	}
+	f, err := j.fs.Create(fp)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	j.count = 0
+	return fileutil.SyncDir(j.dir, j.fs)
+}
+
+func (j *eventJournal) write(e JournalEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	j.count++
+	return nil
+}
+
+// closeFile syncs and closes the journal file, both mu and syncMu are
+// required to be held by the caller.
+func (j *eventJournal) closeFile() error {
+	f := j.f
+	j.f = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (j *eventJournal) close() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.syncMu.Lock()
+	if j.f != nil {
+		if err := j.closeFile(); err != nil {
+			plog.Errorf("failed to close event journal in %s, %v", j.dir, err)
+		}
+	}
+	j.syncMu.Unlock()
+	j.mu.Unlock()
+	j.wg.Wait()
+}
+
+// readEventJournal returns all events found in the event journal files in the
+// specified directory, ordered from the oldest to the most recent.
+func readEventJournal(dir string, fs vfs.IFS) ([]JournalEvent, error) {
+	old, err := readJournalFile(fs.PathJoin(dir, journalOldFilename), fs)
+	if err != nil {
+		return nil, err
+	}
+	current, err := readJournalFile(fs.PathJoin(dir, journalFilename), fs)
+	if err != nil {
+		return nil, err
+	}
+	return append(old, current...), nil
+}
+
+func readJournalFile(fp string, fs vfs.IFS) ([]JournalEvent, error) {
+	exist, err := fileutil.Exist(fp, fs)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, nil
+	}
+	f, err := fs.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := make([]JournalEvent, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e JournalEvent
+		// a partially written last record is ignored
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break
+		}
+		result = append(result, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
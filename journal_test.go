@@ -0,0 +1,180 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+)
+
+const (
+	testJournalDir = "test_journal_dir_safe_to_delete"
+)
+
+func runEventJournalTest(t *testing.T, tf func(t *testing.T, fs vfs.IFS)) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(testJournalDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := fs.MkdirAll(testJournalDir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(testJournalDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	tf(t, fs)
+}
+
+func TestEventJournalIsBounded(t *testing.T) {
+	tf := func(t *testing.T, fs vfs.IFS) {
+		j, err := openEventJournal(testJournalDir, 4, fs)
+		if err != nil {
+			t.Fatalf("failed to open event journal %v", err)
+		}
+		for i := uint64(1); i <= 5; i++ {
+			j.record(JournalEvent{Type: "LeaderUpdated", Term: i})
+		}
+		j.close()
+		// closed journal ignores new events
+		j.record(JournalEvent{Type: "LeaderUpdated", Term: 6})
+		events, err := readEventJournal(testJournalDir, fs)
+		if err != nil {
+			t.Fatalf("failed to read event journal %v", err)
+		}
+		if len(events) != 3 {
+			t.Fatalf("unexpected event count %d", len(events))
+		}
+		for idx, e := range events {
+			if e.Term != uint64(idx+3) || e.Time.IsZero() {
+				t.Errorf("unexpected event %+v", e)
+			}
+		}
+	}
+	runEventJournalTest(t, tf)
+}
+
+func TestEventJournalIsKeptAfterReopen(t *testing.T) {
+	tf := func(t *testing.T, fs vfs.IFS) {
+		j, err := openEventJournal(testJournalDir, 100, fs)
+		if err != nil {
+			t.Fatalf("failed to open event journal %v", err)
+		}
+		j.recordSystemEvent(server.SystemEvent{Type: server.SnapshotCreated,
+			Index: 100})
+		// not journaled
+		j.recordSystemEvent(server.SystemEvent{Type: server.ConnectionFailed})
+		j.close()
+		j, err = openEventJournal(testJournalDir, 100, fs)
+		if err != nil {
+			t.Fatalf("failed to open event journal %v", err)
+		}
+		j.recordError("ApplyFailed", 101, errors.New("test error"))
+		j.close()
+		events, err := readEventJournal(testJournalDir, fs)
+		if err != nil {
+			t.Fatalf("failed to read event journal %v", err)
+		}
+		if len(events) != 2 {
+			t.Fatalf("unexpected event count %d", len(events))
+		}
+		if events[0].Type != "SnapshotCreated" || events[0].Index != 100 {
+			t.Errorf("unexpected event %+v", events[0])
+		}
+		if events[1].Type != "ApplyFailed" || events[1].Index != 101 ||
+			events[1].Error != "test error" {
+			t.Errorf("unexpected event %+v", events[1])
+		}
+	}
+	runEventJournalTest(t, tf)
+}
+
+func TestMissingEventJournalIsAllowed(t *testing.T) {
+	tf := func(t *testing.T, fs vfs.IFS) {
+		events, err := readEventJournal(testJournalDir, fs)
+		if err != nil {
+			t.Fatalf("failed to read event journal %v", err)
+		}
+		if len(events) != 0 {
+			t.Errorf("unexpected events %v", events)
+		}
+	}
+	runEventJournalTest(t, tf)
+}
+
+type blockingSyncFS struct {
+	vfs.IFS
+	blocked uint32
+	release chan struct{}
+}
+
+func (fs *blockingSyncFS) Create(name string) (vfs.File, error) {
+	f, err := fs.IFS.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &blockingSyncFile{File: f, fs: fs}, nil
+}
+
+type blockingSyncFile struct {
+	vfs.File
+	fs *blockingSyncFS
+}
+
+func (f *blockingSyncFile) Sync() error {
+	if atomic.LoadUint32(&f.fs.blocked) == 1 {
+		<-f.fs.release
+	}
+	return f.File.Sync()
+}
+
+func TestEventJournalDoesNotWaitForSync(t *testing.T) {
+	tf := func(t *testing.T, fs vfs.IFS) {
+		bfs := &blockingSyncFS{IFS: fs, release: make(chan struct{})}
+		j, err := openEventJournal(testJournalDir, 100, bfs)
+		if err != nil {
+			t.Fatalf("failed to open event journal %v", err)
+		}
+		atomic.StoreUint32(&bfs.blocked, 1)
+		done := make(chan struct{})
+		go func() {
+			for i := uint64(1); i <= 10; i++ {
+				j.record(JournalEvent{Type: "LeaderUpdated", Term: i})
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("recording events waited for sync")
+		}
+		close(bfs.release)
+		j.close()
+		events, err := readEventJournal(testJournalDir, fs)
+		if err != nil {
+			t.Fatalf("failed to read event journal %v", err)
+		}
+		if len(events) != 10 {
+			t.Fatalf("unexpected event count %d", len(events))
+		}
+	}
+	runEventJournalTest(t, tf)
+}
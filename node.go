@@ -15,9 +15,15 @@
 package dragonboat
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"reflect"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/lni/goutils/logutil"
 	"github.com/lni/goutils/syncutil"
@@ -71,6 +77,7 @@ func (l *logDBMetrics) isBusy() bool {
 
 type node struct {
 	clusterInfo           atomic.Value
+	checkpoint            atomic.Value
 	nodeRegistry          transport.INodeRegistry
 	logdb                 raftio.ILogDB
 	pipeline              pipeline
@@ -84,12 +91,23 @@ type node struct {
 	metrics               *logDBMetrics
 	stopC                 chan struct{}
 	pendingLeaderTransfer *pendingLeaderTransfer
+	recoveredCheckpoint   rsm.Checkpoint
+	checkpointIndex       uint64
 	sysEvents             *sysEventListener
+	history               *replicaHistory
+	dependencies          *applyDependencies
+	onPanic               func(*node)
+	delayedEntries        []pb.Entry
 	raftEvents            *raftEventListener
+	journal               *eventJournal
 	handleSnapshotStatus  func(uint64, uint64, bool)
 	sendRaftMessage       func(pb.Message)
 	validateTarget        func(string) bool
+	snapshotSaveHook      raftio.ISnapshotSaveHook
+	configChangeHook      raftio.IConfigChangeHook
+	snapshotSaveTimeout   time.Duration
 	sm                    *rsm.StateMachine
+	labels                *profilerLabels
 	snapshotLock          *syncutil.Lock
 	incomingReadIndexes   *readIndexQueue
 	pendingProposals      *pendingProposal
@@ -107,6 +125,8 @@ type node struct {
 	config                config.Config
 	currentTick           uint64
 	gcTick                uint64
+	scheduledSSTick       uint64
+	scheduledSSIndex      uint64
 	appliedIndex          uint64
 	pushedIndex           uint64
 	confirmedIndex        uint64
@@ -116,12 +136,14 @@ type node struct {
 	leaderID              uint64
 	instanceID            uint64
 	initializedFlag       uint64
+	latencyOptimizedFlag  uint64
 	closeOnce             sync.Once
 	raftMu                sync.Mutex
 	new                   bool
 	logDBLimited          bool
 	rateLimited           bool
 	notifyCommit          bool
+	applyRefused          bool
 }
 
 var _ rsm.INode = (*node)(nil)
@@ -143,7 +165,10 @@ func newNode(peers map[uint64]string,
 	pool *sync.Pool,
 	ldb raftio.ILogDB,
 	metrics *logDBMetrics,
-	sysEvents *sysEventListener) (*node, error) {
+	sysEvents *sysEventListener,
+	history *replicaHistory,
+	dependencies *applyDependencies,
+	onPanic func(*node)) (*node, error) {
 	notifyCommit := nhConfig.NotifyCommit
 	proposals := newEntryQueue(incomingProposalsMaxLen, lazyFreeCycle)
 	readIndexes := newReadIndexQueue(incomingReadIndexMaxLen)
@@ -181,11 +206,19 @@ func newNode(peers map[uint64]string,
 		snapshotLock:          syncutil.NewLock(),
 		syncTask:              newTask(syncTaskInterval),
 		sysEvents:             sysEvents,
+		history:               history,
+		dependencies:          dependencies,
+		onPanic:               onPanic,
 		notifyCommit:          notifyCommit,
 		metrics:               metrics,
 		initializedC:          make(chan struct{}),
 		ss:                    &snapshotState{},
 		validateTarget:        nhConfig.GetTargetValidator(),
+		snapshotSaveHook:      nhConfig.SnapshotSaveHook,
+		snapshotSaveTimeout:   nhConfig.SnapshotSaveHookTimeout,
+		configChangeHook:      nhConfig.ConfigChangeHook,
+		labels: newProfilerLabels(nhConfig.Expert.Engine.ProfilerLabels,
+			config.ClusterID, config.NodeID),
 		qs: &quiesceState{
 			electionTick: config.ElectionRTT * 2,
 			enabled:      config.Quiesce,
@@ -200,10 +233,23 @@ func newNode(peers map[uint64]string,
 	}
 	rn.toApplyQ = sm.TaskQ()
 	rn.sm = sm
-	rn.raftEvents = newRaftEventListener(config.ClusterID,
-		config.NodeID, &rn.leaderID, nhConfig.EnableMetrics, liQueue)
+	rn.setLatencyOptimized(config.LatencyOptimized)
+	if err := rn.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+	if config.EventJournalSize > 0 {
+		j, err := openEventJournal(snapshotter.dir,
+			config.EventJournalSize, snapshotter.fs)
+		if err != nil {
+			return nil, err
+		}
+		rn.journal = j
+	}
+	rn.raftEvents = newRaftEventListener(config.ClusterID, config.NodeID,
+		config.ClusterName, &rn.leaderID, nhConfig.EnableMetrics, liQueue, rn.journal)
 	new, err := rn.startRaft(config, peers, initialMember)
 	if err != nil {
+		rn.journal.close()
 		return nil, err
 	}
 	rn.new = new
@@ -224,6 +270,7 @@ func (n *node) ShouldStop() <-chan struct{} {
 
 func (n *node) StepReady() {
 	n.pipeline.setStepReady(n.clusterID)
+	n.dependencies.appliedUpdated(n.clusterID)
 }
 
 func (n *node) applyReady() {
@@ -246,18 +293,36 @@ func (n *node) ApplyUpdate(e pb.Entry,
 		if e.Key == 0 {
 			plog.Panicf("key is 0")
 		}
-		n.pendingProposals.applied(e.ClientID, e.SeriesID, e.Key, result, rejected)
+		n.pendingProposals.applied(e.ClientID,
+			e.SeriesID, e.Key, e.Index, result, rejected)
 	}
 }
 
+// ProposalContext returns the context used for proposing the specified entry
+// on this node, the background context is returned for entries proposed on
+// other nodes or without a context.
+func (n *node) ProposalContext(e pb.Entry) context.Context {
+	return n.pendingProposals.context(e.ClientID, e.SeriesID, e.Key)
+}
+
 func (n *node) ApplyConfigChange(cc pb.ConfigChange,
-	key uint64, rejected bool) {
+	key uint64, r rsm.ConfigChangeRejection) {
 	n.raftMu.Lock()
 	defer n.raftMu.Unlock()
-	if !rejected {
+	if !r.Rejected {
 		n.applyConfigChange(cc)
 	}
-	n.configChangeProcessed(key, rejected)
+	n.configChangeProcessed(key, r.Rejected, getConfigChangeRejection(r))
+}
+
+func getConfigChangeRejection(r rsm.ConfigChangeRejection) rejection {
+	if !r.Rejected {
+		return rejection{}
+	}
+	if r.WitnessTarget {
+		return rejection{reason: ReasonWitnessTarget, detail: r.Detail}
+	}
+	return rejection{reason: ReasonInvalidConfigChange, detail: r.Detail}
 }
 
 func (n *node) applyConfigChange(cc pb.ConfigChange) {
@@ -278,7 +343,8 @@ func (n *node) applyConfigChange(cc pb.ConfigChange) {
 	}
 }
 
-func (n *node) configChangeProcessed(key uint64, rejected bool) {
+func (n *node) configChangeProcessed(key uint64,
+	rejected bool, r rejection) {
 	if n.isWitness() {
 		return
 	}
@@ -287,7 +353,24 @@ func (n *node) configChangeProcessed(key uint64, rejected bool) {
 	} else {
 		n.notifyConfigChange()
 	}
-	n.pendingConfigChange.apply(key, rejected)
+	n.pendingConfigChange.apply(key, rejected, r)
+	if !rejected {
+		n.recordRemovedNodes()
+	}
+}
+
+func (n *node) recordRemovedNodes() {
+	m := n.sm.GetMembership()
+	if len(m.Removed) == 0 {
+		return
+	}
+	removed := make([]uint64, 0, len(m.Removed))
+	for nid := range m.Removed {
+		removed = append(removed, nid)
+	}
+	if err := n.history.removed(n.clusterID, removed); err != nil {
+		plog.Errorf("%s failed to record removed nodes, %v", n.id(), err)
+	}
 }
 
 func (n *node) RestoreRemotes(snapshot pb.Snapshot) {
@@ -314,6 +397,7 @@ func (n *node) RestoreRemotes(snapshot pb.Snapshot) {
 	plog.Debugf("%s is restoring remotes", n.id())
 	n.p.RestoreRemotes(snapshot)
 	n.notifyConfigChange()
+	n.recordRemovedNodes()
 }
 
 func (n *node) startRaft(cfg config.Config,
@@ -327,9 +411,39 @@ func (n *node) startRaft(cfg config.Config,
 		pas = append(pas, raft.PeerAddress{NodeID: k, Address: v})
 	}
 	n.p = raft.Launch(cfg, n.logReader, n.raftEvents, pas, initial, newNode)
+	if n.configChangeHook != nil {
+		n.p.SetConfigChangeFilter(n.filterConfigChange)
+	}
 	return newNode, nil
 }
 
+// filterConfigChange is invoked by the leader to let the config change hook
+// veto or annotate the requested config change before it is replicated.
+func (n *node) filterConfigChange(from uint64,
+	cc pb.ConfigChange) (pb.ConfigChange, bool) {
+	info := raftio.ConfigChangeRequestInfo{
+		ClusterID: n.clusterID,
+		LeaderID:  n.nodeID,
+		From:      from,
+		Type:      cc.Type,
+		NodeID:    cc.NodeID,
+		Address:   cc.Address,
+	}
+	addr, err := n.configChangeHook.ConfigChangeRequested(info)
+	if err != nil {
+		plog.Warningf("%s config change %s from node %d vetoed, %v",
+			n.id(), cc.Type, from, err)
+		return cc, false
+	}
+	if addr != cc.Address && !n.validateTarget(addr) {
+		plog.Warningf("%s config change %s from node %d vetoed, invalid target %s",
+			n.id(), cc.Type, from, addr)
+		return cc, false
+	}
+	cc.Address = addr
+	return cc, true
+}
+
 func (n *node) close() {
 	n.requestRemoval()
 	n.raftEvents.stop()
@@ -395,6 +509,17 @@ func (n *node) payloadTooBig(sz int) bool {
 
 func (n *node) propose(session *client.Session,
 	cmd []byte, timeout uint64) (*RequestState, error) {
+	return n.proposeWithContext(context.Background(), session, cmd, timeout)
+}
+
+func (n *node) proposeWithContext(ctx context.Context,
+	session *client.Session, cmd []byte, timeout uint64) (*RequestState, error) {
+	return n.proposeWithDependency(ctx, session, cmd, nil, timeout)
+}
+
+func (n *node) proposeWithDependency(ctx context.Context,
+	session *client.Session, cmd []byte, dep *ApplyDependency,
+	timeout uint64) (*RequestState, error) {
 	if !n.initialized() {
 		return nil, ErrClusterNotReady
 	}
@@ -405,9 +530,15 @@ func (n *node) propose(session *client.Session,
 		return nil, ErrInvalidSession
 	}
 	if n.payloadTooBig(len(cmd)) {
-		return nil, ErrPayloadTooBig
+		limit := n.config.MaxInMemLogSize - settings.EntryNonCmdFieldsSize
+		return n.pendingProposals.rejected(requestRejected,
+			rejection{reason: ReasonPayloadTooBig, limit: limit}), nil
+	}
+	if dep != nil && dep.ClusterID == n.clusterID {
+		return nil, ErrInvalidOperation
 	}
-	return n.pendingProposals.propose(session, cmd, timeout)
+	return n.pendingProposals.proposeWithDependency(ctx,
+		session, cmd, dep, timeout)
 }
 
 func (n *node) read(timeout uint64) (*RequestState, error) {
@@ -417,6 +548,16 @@ func (n *node) read(timeout uint64) (*RequestState, error) {
 	if n.isWitness() {
 		return nil, ErrInvalidOperation
 	}
+	if n.hasApplyBacklog() {
+		switch n.config.ReadBacklogPolicy {
+		case config.RejectReadsOnBacklog:
+			n.raftEvents.readShed(false)
+			return nil, ErrApplyBacklog
+		case config.StaleReadsOnBacklog:
+			n.raftEvents.readShed(true)
+			return n.readStale(timeout)
+		}
+	}
 	rs, err := n.pendingReadIndexes.read(timeout)
 	if err == nil {
 		rs.node = n
@@ -424,6 +565,79 @@ func (n *node) read(timeout uint64) (*RequestState, error) {
 	return rs, err
 }
 
+// readStale returns a RequestState that completes once the local state machine
+// has applied its current last applied index, i.e. immediately, without going
+// through the ReadIndex protocol. The completed result is flagged as stale.
+func (n *node) readStale(timeout uint64) (*RequestState, error) {
+	applied := n.sm.GetLastApplied()
+	rs, err := n.pendingReadIndexes.readStale(applied, timeout)
+	if err != nil {
+		return nil, err
+	}
+	rs.node = n
+	n.pendingReadIndexes.applied(applied)
+	return rs, nil
+}
+
+// hasApplyBacklog returns a boolean value indicating whether the number of
+// committed but not yet applied entries exceeds the ReadBacklogThreshold.
+func (n *node) hasApplyBacklog() bool {
+	if n.config.ReadBacklogThreshold == 0 {
+		return false
+	}
+	n.raftMu.Lock()
+	ls := n.p.GetLocalStatus()
+	n.raftMu.Unlock()
+	applied := n.sm.GetLastApplied()
+	return ls.CommittedIndex > applied &&
+		ls.CommittedIndex-applied > n.config.ReadBacklogThreshold
+}
+
+// lookup queries the state machine with pprof labels of the node attached
+// to the calling goroutine when profiler labels are enabled. The query is
+// abandoned once the specified context is done.
+func (n *node) lookup(ctx context.Context,
+	query interface{}) (interface{}, error) {
+	var result interface{}
+	var err error
+	n.labels.do(ctx, func() {
+		result, err = n.sm.ContextLookup(ctx, query)
+	})
+	if err == context.Canceled {
+		return nil, ErrCanceled
+	} else if err == context.DeadlineExceeded {
+		return nil, ErrTimeout
+	}
+	return result, err
+}
+
+func (n *node) batchedLookup(ctx context.Context,
+	queries []interface{}) ([]interface{}, error) {
+	var result []interface{}
+	var err error
+	n.labels.do(ctx, func() {
+		result, err = n.sm.BatchedLookup(queries)
+	})
+	return result, err
+}
+
+func (n *node) readAt(index uint64, timeout uint64) (*RequestState, error) {
+	if !n.initialized() {
+		return nil, ErrClusterNotReady
+	}
+	if n.isWitness() {
+		return nil, ErrInvalidOperation
+	}
+	rs, err := n.pendingReadIndexes.readAt(index, timeout)
+	if err != nil {
+		return nil, err
+	}
+	rs.node = n
+	// the specified index might have already been applied
+	n.pendingReadIndexes.applied(n.sm.GetLastApplied())
+	return rs, nil
+}
+
 func (n *node) requestLeaderTransfer(nodeID uint64) error {
 	if !n.initialized() {
 		return ErrClusterNotReady
@@ -434,6 +648,151 @@ func (n *node) requestLeaderTransfer(nodeID uint64) error {
 	return n.pendingLeaderTransfer.request(nodeID)
 }
 
+// getLeaderTransferTarget returns the most up to date voting member other than
+// the local node, it is expected to be invoked on the leader as the replication
+// progress of members is only known by the leader. Members that have been
+// contacted by the leader are preferred, ties are broken by choosing the one
+// with the smallest NodeID.
+func (n *node) getLeaderTransferTarget() (uint64, bool) {
+	status, ok := n.getNodeStatus()
+	if !ok {
+		return 0, false
+	}
+	var target NodeStatus
+	for nodeID, s := range status {
+		if nodeID == n.nodeID || s.IsObserver || s.IsWitness {
+			continue
+		}
+		if target.NodeID == 0 || isMoreUpToDate(s, target) {
+			target = s
+		}
+	}
+	return target.NodeID, target.NodeID != 0
+}
+
+func isMoreUpToDate(s NodeStatus, target NodeStatus) bool {
+	if s.Contacted != target.Contacted {
+		return s.Contacted
+	}
+	if s.MatchIndex != target.MatchIndex {
+		return s.MatchIndex > target.MatchIndex
+	}
+	return s.NodeID < target.NodeID
+}
+
+func (n *node) getClusterStats() (ClusterStats, error) {
+	n.raftMu.Lock()
+	ls := n.p.GetLocalStatus()
+	n.raftMu.Unlock()
+	leaderID, _ := n.getLeaderID()
+	ss := n.logReader.Snapshot()
+	first, last := n.logReader.GetRange()
+	entryCount := uint64(0)
+	if last >= first {
+		entryCount = last - first + 1
+	}
+	logDBSize := uint64(0)
+	if e, ok := n.logdb.(raftio.ICompactionEstimator); ok {
+		ce, err := e.EstimateCompaction(n.clusterID, n.nodeID, math.MaxUint64)
+		if err != nil {
+			return ClusterStats{}, err
+		}
+		logDBSize = ce.Bytes
+	}
+	return ClusterStats{
+		ClusterID:        n.clusterID,
+		NodeID:           n.nodeID,
+		LeaderID:         leaderID,
+		Term:             ls.Term,
+		AppliedIndex:     n.sm.GetLastApplied(),
+		CommittedIndex:   ls.CommittedIndex,
+		LogDBEntryCount:  entryCount,
+		LogDBSize:        logDBSize,
+		EntryCacheCount:  ls.InMemEntryCount,
+		EntryCacheSize:   ls.InMemEntrySize,
+		SnapshotIndex:    ss.Index,
+		SnapshotTerm:     ss.Term,
+		PendingProposals: n.pendingProposals.count(),
+	}, nil
+}
+
+func (n *node) getNodeStatus() (map[uint64]NodeStatus, bool) {
+	n.raftMu.Lock()
+	status, ok := n.p.GetRemoteStatus()
+	n.raftMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	lastIndex := status[n.nodeID].Match
+	result := make(map[uint64]NodeStatus, len(status))
+	for nodeID, rs := range status {
+		ns := NodeStatus{
+			NodeID:       nodeID,
+			IsObserver:   rs.Observer,
+			IsWitness:    rs.Witness,
+			MatchIndex:   rs.Match,
+			Paused:       rs.Paused,
+			Snapshotting: rs.Snapshotting,
+			Contacted:    rs.Contacted,
+			LastContact: time.Duration(rs.LastContactTicks*n.tickMillisecond) *
+				time.Millisecond,
+		}
+		if lastIndex > rs.Match {
+			ns.Lag = lastIndex - rs.Match
+		}
+		result[nodeID] = ns
+	}
+	return result, true
+}
+
+func (n *node) getRaftState() RaftState {
+	n.raftMu.Lock()
+	ls := n.p.GetLocalStatus()
+	n.raftMu.Unlock()
+	return RaftState{
+		ClusterID:      n.clusterID,
+		NodeID:         n.nodeID,
+		Term:           ls.Term,
+		Vote:           ls.Vote,
+		CommittedIndex: ls.CommittedIndex,
+		AppliedIndex:   n.sm.GetLastApplied(),
+		LastIndex:      ls.LastIndex,
+		LastTerm:       ls.LastTerm,
+		SnapshotIndex:  ls.SnapshotIndex,
+	}
+}
+
+// withinStaleness returns a boolean value indicating whether the state machine
+// of the local node is considered as fresh enough to serve the specified
+// staleness bounds. The leader is considered as fresh only when it was in
+// contact with a quorum of voting members within maxStaleness, a partitioned
+// or deposed leader thus stops serving such reads.
+func (n *node) withinStaleness(maxLag uint64,
+	maxStaleness time.Duration) bool {
+	if _, ok := n.getLeaderID(); !ok {
+		return false
+	}
+	n.raftMu.Lock()
+	ls := n.p.GetLocalStatus()
+	n.raftMu.Unlock()
+	applied := n.sm.GetLastApplied()
+	if ls.LeaderCommittedIndex > applied &&
+		ls.LeaderCommittedIndex-applied > maxLag {
+		return false
+	}
+	elapsed := time.Duration(ls.LeaderContactTicks*n.tickMillisecond) *
+		time.Millisecond
+	return elapsed <= maxStaleness
+}
+
+func (n *node) hasPendingRequest() bool {
+	return n.pendingProposals.hasPending() ||
+		n.pendingReadIndexes.hasPending() ||
+		n.pendingConfigChange.hasPending() ||
+		n.pendingSnapshot.hasPending() ||
+		n.ss.streaming()
+}
+
 func (n *node) requestSnapshot(opt SnapshotOption,
 	timeout uint64) (*RequestState, error) {
 	if !n.initialized() {
@@ -442,6 +801,10 @@ func (n *node) requestSnapshot(opt SnapshotOption,
 	if n.isWitness() {
 		return nil, ErrInvalidOperation
 	}
+	if opt.Exported && opt.ExportWriter != nil {
+		plog.Debugf("%s called export snapshot to writer", n.id())
+		return n.pendingSnapshot.requestExport(opt.ExportWriter, timeout)
+	}
 	st := rsm.UserRequested
 	if opt.Exported {
 		plog.Debugf("%s called export snapshot", n.id())
@@ -518,12 +881,52 @@ func (n *node) getLeaderID() (uint64, bool) {
 
 func (n *node) destroy() {
 	n.sm.Close()
+	n.journal.close()
+}
+
+// isolatePanic invokes f, panics raised by f are confined to the node unless
+// the PanicPolicy of the node is CrashOnPanic. It returns a boolean value
+// indicating whether f panicked.
+func (n *node) isolatePanic(f func()) (panicked bool) {
+	if n.config.PanicPolicy == config.CrashOnPanic {
+		f()
+		return false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			n.panicked(r)
+		}
+	}()
+	f()
+	return false
+}
+
+func (n *node) panicked(r interface{}) {
+	plog.Errorf("%s panicked, %v\n%s", n.id(), r, debug.Stack())
+	n.requestRemoval()
+	n.publishEvent(server.SystemEvent{
+		Type:      server.NodePanicked,
+		ClusterID: n.clusterID,
+		NodeID:    n.nodeID,
+		Index:     n.sm.GetLastApplied(),
+		Reason:    fmt.Sprint(r),
+		Restart:   n.config.PanicPolicy == config.RestartOnPanic,
+	})
+	if n.onPanic != nil {
+		n.onPanic(n)
+	}
+}
+
+func (n *node) publishEvent(e server.SystemEvent) {
+	n.journal.recordSystemEvent(e)
+	n.sysEvents.Publish(e)
 }
 
 func (n *node) offloaded() {
 	if n.sm.Offloaded() {
 		n.pipeline.setCloseReady(n)
-		n.sysEvents.Publish(server.SystemEvent{
+		n.publishEvent(server.SystemEvent{
 			Type:      server.NodeUnloaded,
 			ClusterID: n.clusterID,
 			NodeID:    n.nodeID,
@@ -572,15 +975,57 @@ func (n *node) pushEntries(ents []pb.Entry) {
 	if len(ents) == 0 {
 		return
 	}
-	n.pushTask(rsm.Task{Entries: ents}, false)
 	n.pushedIndex = ents[len(ents)-1].Index
+	if len(n.delayedEntries) > 0 {
+		n.delayedEntries = append(n.delayedEntries, ents...)
+		return
+	}
+	n.pushReadyEntries(ents, false)
 }
 
-func (n *node) pushStreamSnapshotRequest(clusterID uint64, nodeID uint64) {
+// pushReadyEntries pushes entries to the apply queue until the first entry
+// with an unsatisfied apply dependency, that entry and all entries after it
+// are delayed.
+func (n *node) pushReadyEntries(ents []pb.Entry, notify bool) {
+	ready := ents
+	for i, e := range ents {
+		cid, index, ok, err := rsm.GetDependency(e)
+		if err != nil {
+			// truncated entries fail checksum verification when being applied
+			plog.Errorf("%s entry %d, %v", n.id(), e.Index, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		dep := ApplyDependency{ClusterID: cid, Index: index}
+		if !n.dependencies.satisfied(n.clusterID, dep) {
+			ready = ents[:i]
+			n.delayedEntries = append([]pb.Entry(nil), ents[i:]...)
+			break
+		}
+	}
+	if len(ready) > 0 {
+		n.pushTask(rsm.Task{Entries: ready}, notify)
+	}
+}
+
+func (n *node) pushDelayedEntries() {
+	if len(n.delayedEntries) == 0 {
+		return
+	}
+	ents := n.delayedEntries
+	n.delayedEntries = nil
+	n.pushReadyEntries(ents, true)
+}
+
+func (n *node) pushStreamSnapshotRequest(clusterID uint64,
+	nodeID uint64, since uint64) {
 	n.pushTask(rsm.Task{
 		ClusterID: clusterID,
 		NodeID:    nodeID,
 		Stream:    true,
+		SSRequest: rsm.SSRequest{DeltaSince: since},
 	}, true)
 }
 
@@ -601,6 +1046,8 @@ func (n *node) pushSnapshot(snapshot pb.Snapshot, applied uint64) {
 		plog.Panicf("out of date snapshot, index %d, pushed %d, applied %d, ss %d",
 			snapshot.Index, n.pushedIndex, applied, n.ss.getIndex())
 	}
+	// delayed entries are all covered by the snapshot
+	n.delayedEntries = nil
 	n.pushTask(rsm.Task{
 		Recover: true,
 		Index:   snapshot.Index,
@@ -686,7 +1133,7 @@ func (n *node) save(rec rsm.Task) error {
 		return err
 	}
 	n.pendingSnapshot.apply(rec.SSRequest.Key, index == 0, false, index)
-	n.sysEvents.Publish(server.SystemEvent{
+	n.publishEvent(server.SystemEvent{
 		Type:      server.SnapshotCreated,
 		ClusterID: n.clusterID,
 		NodeID:    n.nodeID,
@@ -714,6 +1161,7 @@ func (n *node) doSave(req rsm.SSRequest) (uint64, error) {
 			return 0, nil
 		}
 		plog.Errorf("%s save snapshot failed %v", n.id(), err)
+		n.journal.recordError("SaveSnapshotFailed", 0, err)
 		return 0, err
 	}
 	plog.Infof("%s saved snapshot, index %s, term %d, file count %d",
@@ -727,6 +1175,7 @@ func (n *node) doSave(req rsm.SSRequest) (uint64, error) {
 			ssenv.MustRemoveTempDir()
 			return 0, nil
 		}
+		n.journal.recordError("CommitSnapshotFailed", ss.Index, err)
 		return 0, err
 	}
 	if req.Exported() {
@@ -742,16 +1191,72 @@ func (n *node) doSave(req rsm.SSRequest) (uint64, error) {
 		}
 		return 0, err
 	}
-	if err := n.compact(req, ss.Index); err != nil {
+	n.snapshotSaved(ss)
+	compactTo := n.compactLogTo(req, ss.Index)
+	n.sm.SnapshotCompleted(sm.SnapshotCompletedInfo{
+		Index:        ss.Index,
+		Term:         ss.Term,
+		OnDiskIndex:  ss.OnDiskIndex,
+		CompactLogTo: compactTo,
+	})
+	if err := n.compact(compactTo, ss.Index); err != nil {
 		return 0, err
 	}
 	n.ss.setIndex(ss.Index)
 	return ss.Index, nil
 }
 
-func (n *node) compact(req rsm.SSRequest, index uint64) error {
+// snapshotSaved invokes the snapshot save hook and waits for it to return
+// before any snapshot or log compaction can happen, the wait is bounded by the
+// configured timeout and is interrupted when the node is being stopped.
+func (n *node) snapshotSaved(ss pb.Snapshot) {
+	if n.snapshotSaveHook == nil {
+		return
+	}
+	info := raftio.SavedSnapshotInfo{
+		ClusterID: n.clusterID,
+		NodeID:    n.nodeID,
+		Index:     ss.Index,
+		Term:      ss.Term,
+		Filepath:  ss.Filepath,
+		Files:     make([]string, 0, len(ss.Files)),
+	}
+	for _, f := range ss.Files {
+		info.Files = append(info.Files, f.Filepath)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		n.snapshotSaveTimeout)
+	defer cancel()
+	doneC := make(chan error, 1)
+	go func() {
+		doneC <- n.snapshotSaveHook.SnapshotSaved(ctx, info)
+	}()
+	select {
+	case err := <-doneC:
+		if err != nil {
+			plog.Errorf("%s snapshot save hook failed, index %s, %v",
+				n.id(), n.ssid(ss.Index), err)
+		}
+	case <-ctx.Done():
+		plog.Warningf("%s snapshot save hook timed out, index %s",
+			n.id(), n.ssid(ss.Index))
+	case <-n.stopC:
+	}
+}
+
+// compactLogTo returns the index up to which Raft Log entries can be removed
+// once the snapshot at the specified index is saved, 0 is returned when no
+// entry can be removed.
+func (n *node) compactLogTo(req rsm.SSRequest, index uint64) uint64 {
 	if overhead := n.compactionOverhead(req); index > overhead {
-		n.ss.setCompactLogTo(index - overhead)
+		return index - overhead
+	}
+	return 0
+}
+
+func (n *node) compact(compactTo uint64, index uint64) error {
+	if compactTo > 0 {
+		n.ss.setCompactLogTo(compactTo)
 	}
 	return n.compactSnapshots(index)
 }
@@ -763,10 +1268,11 @@ func (n *node) compactionOverhead(req rsm.SSRequest) uint64 {
 	return n.config.CompactionOverhead
 }
 
-func (n *node) stream(sink pb.IChunkSink) error {
+func (n *node) stream(sink pb.IChunkSink, since uint64) error {
 	if sink != nil {
-		plog.Infof("%s requested to stream to %d", n.id(), sink.ToNodeID())
-		if err := n.sm.Stream(sink); err != nil {
+		plog.Infof("%s requested to stream to %d, since %d",
+			n.id(), sink.ToNodeID(), since)
+		if err := n.sm.Stream(sink, since); err != nil {
 			if !streamAborted(err) {
 				plog.Errorf("%s failed to stream, %v", n.id(), err)
 				return err
@@ -801,6 +1307,7 @@ func (n *node) recover(rec rsm.Task) (uint64, error) {
 			plog.Warningf("%s aborted recovery", n.id())
 			return 0, nil
 		}
+		n.journal.recordError("RecoverSnapshotFailed", rec.Index, err)
 		return 0, err
 	}
 	if index > 0 {
@@ -819,8 +1326,11 @@ func (n *node) recover(rec rsm.Task) (uint64, error) {
 			plog.Errorf("%s failed to compact snapshots, %v", n.id(), err)
 			return 0, err
 		}
+		if err := n.warmUp(index); err != nil {
+			return 0, err
+		}
 	}
-	n.sysEvents.Publish(server.SystemEvent{
+	n.publishEvent(server.SystemEvent{
 		Type:      server.SnapshotRecovered,
 		ClusterID: n.clusterID,
 		NodeID:    n.nodeID,
@@ -829,6 +1339,61 @@ func (n *node) recover(rec rsm.Task) (uint64, error) {
 	return index, nil
 }
 
+func (n *node) warmUp(index uint64) error {
+	ss, err := n.snapshotter.GetSnapshot(index)
+	if err != nil {
+		if err == ErrNoSnapshot {
+			return nil
+		}
+		plog.Errorf("%s failed to get %s, %v", n.id(), n.ssid(index), err)
+		return err
+	}
+	if ss.Dummy || ss.Witness {
+		return nil
+	}
+	info := sm.WarmUpInfo{
+		Index:    ss.Index,
+		Term:     ss.Term,
+		Filepath: n.snapshotter.getFilePath(ss.Index),
+		FileSize: ss.FileSize,
+		Files:    make([]sm.SnapshotFile, 0, len(ss.Files)),
+	}
+	for _, f := range ss.Files {
+		info.Files = append(info.Files, sm.SnapshotFile{
+			FileID:   f.FileId,
+			Filepath: f.Filepath,
+			Metadata: f.Metadata,
+		})
+	}
+	done := make(chan struct{})
+	errC := make(chan error, 1)
+	go func() {
+		errC <- n.sm.WarmUp(info, done)
+	}()
+	var budgetC <-chan time.Time
+	if n.config.SnapshotWarmUpBudget > 0 {
+		timer := time.NewTimer(n.config.SnapshotWarmUpBudget)
+		defer timer.Stop()
+		budgetC = timer.C
+	}
+	select {
+	case err = <-errC:
+	case <-budgetC:
+		plog.Warningf("%s warm up exceeded the budget of %s",
+			n.id(), n.config.SnapshotWarmUpBudget)
+		close(done)
+		err = <-errC
+	case <-n.stopC:
+		close(done)
+		err = <-errC
+	}
+	if err != nil {
+		plog.Warningf("%s failed to warm up from %s, %v",
+			n.id(), n.ssid(index), err)
+	}
+	return nil
+}
+
 func (n *node) streamDone() {
 	n.ss.notifySnapshotStatus(false, false, true, false, 0)
 	n.applyReady()
@@ -858,7 +1423,84 @@ func (n *node) recoverFromSnapshotDone() {
 }
 
 func (n *node) handleTask(ts []rsm.Task, es []sm.Entry) (rsm.Task, error) {
-	return n.sm.Handle(ts, es)
+	task, err := n.sm.Handle(ts, es)
+	if errors.Is(err, rsm.ErrChecksumMismatch) {
+		return rsm.Task{}, n.checksumMismatch(err)
+	}
+	if err != nil {
+		n.journal.recordError("ApplyFailed", n.sm.GetLastApplied(), err)
+		return rsm.Task{}, err
+	}
+	if err := n.saveCheckpoint(); err != nil {
+		return rsm.Task{}, err
+	}
+	return task, nil
+}
+
+// checksumMismatch publishes the ChecksumMismatch event and handles the
+// mismatch according to the ChecksumMismatchPolicy of the node. The returned
+// error fails the node, nil is returned when the node is to stay in the Raft
+// cluster with its apply refused.
+func (n *node) checksumMismatch(err error) error {
+	n.publishEvent(server.SystemEvent{
+		Type:      server.ChecksumMismatch,
+		ClusterID: n.clusterID,
+		NodeID:    n.nodeID,
+		Index:     n.sm.GetLastApplied(),
+		Reason:    err.Error(),
+	})
+	if n.config.ChecksumMismatchPolicy == config.RefuseApplyOnChecksumMismatch {
+		plog.Errorf("%s refused to apply entries, %v", n.id(), err)
+		n.applyRefused = true
+		return nil
+	}
+	return err
+}
+
+func (n *node) loadCheckpoint() error {
+	n.checkpoint.Store(rsm.Checkpoint{})
+	if n.config.CheckpointEntries == 0 {
+		return nil
+	}
+	cp, err := n.snapshotter.getCheckpoint()
+	if err != nil {
+		return err
+	}
+	if cp.Index > 0 {
+		plog.Infof("%s has apply checkpoint at index %d, hash %d",
+			n.id(), cp.Index, cp.Hash)
+	}
+	n.recoveredCheckpoint = cp
+	n.checkpoint.Store(cp)
+	return nil
+}
+
+func (n *node) getCheckpoint() rsm.Checkpoint {
+	return n.checkpoint.Load().(rsm.Checkpoint)
+}
+
+func (n *node) saveCheckpoint() error {
+	cp := n.sm.GetCheckpoint()
+	if cp.Index <= n.checkpointIndex {
+		return nil
+	}
+	n.checkpointIndex = cp.Index
+	if cp.Index <= n.recoveredCheckpoint.Index {
+		// checkpoints already persisted before the restart are only verified
+		if cp.Index == n.recoveredCheckpoint.Index &&
+			cp.Hash != n.recoveredCheckpoint.Hash {
+			plog.Errorf("%s diverged at index %d, hash %d, checkpoint hash %d",
+				n.id(), cp.Index, cp.Hash, n.recoveredCheckpoint.Hash)
+			n.journal.record(JournalEvent{Type: "Diverged", Index: cp.Index})
+			return rsm.ErrDiverged
+		}
+		return nil
+	}
+	if err := n.snapshotter.saveCheckpoint(cp); err != nil {
+		return err
+	}
+	n.checkpoint.Store(cp)
+	return nil
 }
 
 func (n *node) removeSnapshotFlagFile(index uint64) error {
@@ -897,7 +1539,7 @@ func (n *node) compactSnapshots(index uint64) error {
 	if err := n.snapshotter.compact(index); err != nil {
 		return err
 	}
-	n.sysEvents.Publish(server.SystemEvent{
+	n.publishEvent(server.SystemEvent{
 		Type:      server.SnapshotCompacted,
 		ClusterID: n.clusterID,
 		NodeID:    n.nodeID,
@@ -923,7 +1565,7 @@ func (n *node) removeLog() error {
 		}
 		plog.Debugf("%s compacted log up to index %d", n.id(), compactTo)
 		n.ss.setCompactedTo(compactTo)
-		n.sysEvents.Publish(server.SystemEvent{
+		n.publishEvent(server.SystemEvent{
 			Type:      server.LogCompacted,
 			ClusterID: n.clusterID,
 			NodeID:    n.nodeID,
@@ -944,7 +1586,7 @@ func (n *node) requestCompaction() (*SysOpState, error) {
 		if err != nil {
 			return nil, err
 		}
-		n.sysEvents.Publish(server.SystemEvent{
+		n.publishEvent(server.SystemEvent{
 			Type:      server.LogDBCompacted,
 			ClusterID: n.clusterID,
 			NodeID:    n.nodeID,
@@ -1001,28 +1643,45 @@ func (n *node) getUpdate() (pb.Update, bool) {
 				n.confirmedIndex, n.appliedIndex)
 		}
 		ud := n.p.GetUpdate(moreEntries, n.appliedIndex)
+		ud.LatencyCritical = n.latencyOptimized()
 		n.confirmedIndex = n.appliedIndex
 		return ud, true
 	}
 	return pb.Update{}, false
 }
 
+func getDropInfo(info []pb.DropInfo, i int) pb.DropInfo {
+	if i < len(info) {
+		return info[i]
+	}
+	return pb.DropInfo{Reason: pb.DropNoLeader}
+}
+
 func (n *node) processDroppedReadIndexes(ud pb.Update) {
-	for _, sysctx := range ud.DroppedReadIndexes {
-		n.pendingReadIndexes.dropped(sysctx)
+	for i, sysctx := range ud.DroppedReadIndexes {
+		info := getDropInfo(ud.DroppedReadIndexInfo, i)
+		n.pendingReadIndexes.dropped(sysctx, info)
 	}
 }
 
 func (n *node) processDroppedEntries(ud pb.Update) {
-	for _, e := range ud.DroppedEntries {
+	for i, e := range ud.DroppedEntries {
+		info := getDropInfo(ud.DroppedEntryInfo, i)
 		if e.IsProposal() {
-			n.pendingProposals.dropped(e.ClientID, e.SeriesID, e.Key)
+			n.pendingProposals.dropped(e.ClientID, e.SeriesID, e.Key, info)
 		} else if e.Type == pb.ConfigChangeEntry {
-			n.pendingConfigChange.dropped(e.Key)
+			n.pendingConfigChange.dropped(e.Key, info)
 		} else {
 			plog.Panicf("unknown entry type %s", e.Type)
 		}
 	}
+	vetoed := rejection{
+		reason: ReasonConfigChangeVetoed,
+		detail: "vetoed by the config change filter",
+	}
+	for _, key := range ud.VetoedConfigChanges {
+		n.pendingConfigChange.apply(key, true, vetoed)
+	}
 }
 
 func (n *node) notifyCommittedEntries() {
@@ -1071,7 +1730,6 @@ func (n *node) processRaftUpdate(ud pb.Update) error {
 	if err := n.logReader.Append(ud.EntriesToSave); err != nil {
 		return err
 	}
-	n.sendMessages(ud.Messages)
 	if err := n.removeLog(); err != nil {
 		return err
 	}
@@ -1108,6 +1766,7 @@ func (n *node) stepNode() (pb.Update, bool) {
 	n.raftMu.Lock()
 	defer n.raftMu.Unlock()
 	if n.initialized() {
+		n.pushDelayedEntries()
 		if n.handleEvents() {
 			if n.qs.newQuiesceState() {
 				n.sendEnterQuiesceMessages()
@@ -1145,6 +1804,9 @@ func (n *node) handleEvents() bool {
 	if n.handleSnapshot(lastApplied) {
 		hasEvent = true
 	}
+	if n.handleScheduledSnapshot(lastApplied) {
+		hasEvent = true
+	}
 	if n.handleCompaction() {
 		hasEvent = true
 	}
@@ -1192,6 +1854,43 @@ func (n *node) handleSnapshot(lastApplied uint64) bool {
 	return true
 }
 
+func (n *node) handleScheduledSnapshot(lastApplied uint64) bool {
+	interval := n.snapshotIntervalTick()
+	if interval == 0 {
+		return false
+	}
+	if index := n.ss.getIndex(); index != n.scheduledSSIndex {
+		n.scheduledSSIndex = index
+		n.scheduledSSTick = n.currentTick
+		return false
+	}
+	if n.currentTick-n.scheduledSSTick < interval {
+		return false
+	}
+	if n.isBusySnapshotting() {
+		return false
+	}
+	n.scheduledSSTick = n.currentTick
+	if lastApplied <= n.scheduledSSIndex || lastApplied == n.ss.getReqIndex() {
+		return false
+	}
+	plog.Infof("%s requested scheduled %s", n.id(), n.ssid(lastApplied))
+	n.ss.setReqIndex(lastApplied)
+	n.pushTakeSnapshotRequest(rsm.SSRequest{})
+	return true
+}
+
+func (n *node) snapshotIntervalTick() uint64 {
+	if n.config.SnapshotInterval == 0 || n.tickMillisecond == 0 {
+		return 0
+	}
+	tick := time.Duration(n.tickMillisecond) * time.Millisecond
+	if v := uint64(n.config.SnapshotInterval / tick); v > 0 {
+		return v
+	}
+	return 1
+}
+
 func (n *node) handleProposals() bool {
 	rateLimited := n.p.RateLimited()
 	if n.rateLimited != rateLimited {
@@ -1325,12 +2024,16 @@ func (n *node) handleSnapshotTask(task rsm.Task) {
 		if n.ss.saving() {
 			plog.Warningf("%s taking snapshot, ignored new snapshot req", n.id())
 			n.reportIgnoredSnapshotRequest(task.SSRequest.Key)
+			// tasks queued after the ignored request are not going to be picked up
+			// by any snapshot completion notification
+			n.applyReady()
 			return
 		}
 		n.reportSaveSnapshot(task)
 	} else if task.Stream {
 		if !n.canStream() {
 			n.reportSnapshotStatus(task.ClusterID, task.NodeID, true)
+			n.applyReady()
 			return
 		}
 		n.reportStreamSnapshot(task)
@@ -1426,7 +2129,7 @@ func (n *node) processRecoverStatus() bool {
 		if rec.Initial {
 			plog.Infof("%s initialized using %s", n.id(), n.ssid(rec.Index))
 			n.setInitialStatus(rec.Index)
-			n.sysEvents.Publish(server.SystemEvent{
+			n.publishEvent(server.SystemEvent{
 				Type:      server.NodeReady,
 				ClusterID: n.clusterID,
 				NodeID:    n.nodeID,
@@ -1489,6 +2192,7 @@ func (n *node) notifyConfigChange() {
 	_, isObserver := m.Observers[n.nodeID]
 	_, isWitness := m.Witnesses[n.nodeID]
 	ci := &ClusterInfo{
+		ClusterName:       n.config.ClusterName,
 		ClusterID:         n.clusterID,
 		NodeID:            n.nodeID,
 		IsLeader:          n.isLeader(),
@@ -1498,7 +2202,7 @@ func (n *node) notifyConfigChange() {
 		Nodes:             m.Addresses,
 	}
 	n.clusterInfo.Store(ci)
-	n.sysEvents.Publish(server.SystemEvent{
+	n.publishEvent(server.SystemEvent{
 		Type:      server.MembershipChanged,
 		ClusterID: n.clusterID,
 		NodeID:    n.nodeID,
@@ -1509,6 +2213,7 @@ func (n *node) getClusterInfo() *ClusterInfo {
 	v := n.clusterInfo.Load()
 	if v == nil {
 		return &ClusterInfo{
+			ClusterName:      n.config.ClusterName,
 			ClusterID:        n.clusterID,
 			NodeID:           n.nodeID,
 			Pending:          true,
@@ -1517,6 +2222,7 @@ func (n *node) getClusterInfo() *ClusterInfo {
 	}
 	ci := v.(*ClusterInfo)
 	return &ClusterInfo{
+		ClusterName:       ci.ClusterName,
 		ClusterID:         ci.ClusterID,
 		NodeID:            ci.NodeID,
 		IsLeader:          n.isLeader(),
@@ -1536,6 +2242,9 @@ func (n *node) logDBBusy() bool {
 }
 
 func (n *node) id() string {
+	if len(n.config.ClusterName) > 0 {
+		return fmt.Sprintf("%s(%s)", dn(n.clusterID, n.nodeID), n.config.ClusterName)
+	}
 	return dn(n.clusterID, n.nodeID)
 }
 
@@ -1572,6 +2281,18 @@ func (n *node) initialized() bool {
 	return false
 }
 
+func (n *node) latencyOptimized() bool {
+	return atomic.LoadUint64(&n.latencyOptimizedFlag) != 0
+}
+
+func (n *node) setLatencyOptimized(v bool) {
+	if v {
+		atomic.StoreUint64(&n.latencyOptimizedFlag, 1)
+	} else {
+		atomic.StoreUint64(&n.latencyOptimizedFlag, 0)
+	}
+}
+
 func (n *node) setInitialized() {
 	close(n.initializedC)
 }
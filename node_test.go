@@ -16,6 +16,7 @@ package dragonboat
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"sort"
@@ -258,7 +259,10 @@ func doGetTestRaftNodes(startID uint64, count int, ordered bool,
 			requestStatePool,
 			ldb,
 			nil,
-			newSysEventListener(nil, nil))
+			newSysEventListener(nil, nil),
+			nil,
+			nil,
+			nil)
 		if err != nil {
 			panic(err)
 		}
@@ -313,6 +317,9 @@ func step(nodes []*node) bool {
 	if err := nodes[0].logdb.SaveRaftState(nodeUpdates, 1); err != nil {
 		panic(err)
 	}
+	for idx, ud := range nodeUpdates {
+		activeNodes[idx].sendMessages(ud.Messages)
+	}
 	for idx, ud := range nodeUpdates {
 		node := activeNodes[idx]
 		if err := node.processRaftUpdate(ud); err != nil {
@@ -501,7 +508,7 @@ func makeCheckedTestProposal(t *testing.T, session *client.Session,
 		}
 		if checkResult {
 			if v.GetResult().Value != expectedResult {
-				t.Errorf("result %d, want %d", v.GetResult(), expectedResult)
+				t.Errorf("result %v, want %v", v.GetResult(), expectedResult)
 			}
 		}
 	default:
@@ -1632,6 +1639,29 @@ func TestTakingSnapshotNodeCanComplete(t *testing.T) {
 	}
 }
 
+type applyReadyRecorder struct {
+	dummyEngine
+	applyReady uint64
+}
+
+func (r *applyReadyRecorder) setApplyReady(clusterID uint64) {
+	r.applyReady++
+}
+
+func TestIgnoredSnapshotRequestNotifiesApplyWorker(t *testing.T) {
+	r := &applyReadyRecorder{}
+	n := &node{
+		ss:              &snapshotState{},
+		pipeline:        r,
+		pendingSnapshot: newPendingSnapshot(make(chan rsm.SSRequest, 1)),
+	}
+	n.ss.setSaving()
+	n.handleSnapshotTask(rsm.Task{Save: true})
+	if r.applyReady != 1 {
+		t.Errorf("apply worker not notified")
+	}
+}
+
 func TestTakingSnapshotOnUninitializedNodeWillPanic(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -1670,10 +1700,14 @@ type testDummyNodeProxy struct{}
 func (np *testDummyNodeProxy) StepReady()                                        {}
 func (np *testDummyNodeProxy) RestoreRemotes(pb.Snapshot)                        {}
 func (np *testDummyNodeProxy) ApplyUpdate(pb.Entry, sm.Result, bool, bool, bool) {}
-func (np *testDummyNodeProxy) ApplyConfigChange(pb.ConfigChange, uint64, bool)   {}
-func (np *testDummyNodeProxy) NodeID() uint64                                    { return 1 }
-func (np *testDummyNodeProxy) ClusterID() uint64                                 { return 1 }
-func (np *testDummyNodeProxy) ShouldStop() <-chan struct{}                       { return nil }
+func (np *testDummyNodeProxy) ApplyConfigChange(pb.ConfigChange, uint64, rsm.ConfigChangeRejection) {
+}
+func (np *testDummyNodeProxy) ProposalContext(pb.Entry) context.Context {
+	return context.Background()
+}
+func (np *testDummyNodeProxy) NodeID() uint64              { return 1 }
+func (np *testDummyNodeProxy) ClusterID() uint64           { return 1 }
+func (np *testDummyNodeProxy) ShouldStop() <-chan struct{} { return nil }
 
 func TestNotReadyTakingSnapshotNodeIsSkippedWhenConcurrencyIsNotSupported(t *testing.T) {
 	fs := vfs.GetTestFS()
@@ -1817,3 +1851,83 @@ func TestEntriesToApply(t *testing.T) {
 		}()
 	}
 }
+
+func TestMostUpToDateVoterIsPreferredAsTransferTarget(t *testing.T) {
+	tests := []struct {
+		s      NodeStatus
+		target NodeStatus
+		result bool
+	}{
+		{NodeStatus{NodeID: 3, MatchIndex: 10}, NodeStatus{NodeID: 2, MatchIndex: 9}, true},
+		{NodeStatus{NodeID: 3, MatchIndex: 9}, NodeStatus{NodeID: 2, MatchIndex: 10}, false},
+		{NodeStatus{NodeID: 2, MatchIndex: 10}, NodeStatus{NodeID: 3, MatchIndex: 10}, true},
+		{NodeStatus{NodeID: 3, MatchIndex: 10}, NodeStatus{NodeID: 2, MatchIndex: 10}, false},
+		{NodeStatus{NodeID: 3, MatchIndex: 1, Contacted: true},
+			NodeStatus{NodeID: 2, MatchIndex: 10}, true},
+	}
+	for idx, tt := range tests {
+		if v := isMoreUpToDate(tt.s, tt.target); v != tt.result {
+			t.Errorf("%d, got %t, want %t", idx, v, tt.result)
+		}
+	}
+}
+
+func testChecksumMismatchIsHandled(t *testing.T,
+	policy config.ChecksumMismatchPolicy) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	defer cleanupTestDir(fs)
+	nodes, smList, router, ldb := getTestRaftNodes(1, false, fs)
+	defer ldb.Close()
+	defer stopNodes(nodes)
+	stepNodesUntilThereIsLeader(nodes, smList, router)
+	n := nodes[0]
+	n.config.ChecksumMismatchPolicy = policy
+	listener := &testSysEventListener{}
+	events := make(chan server.SystemEvent, 1)
+	n.sysEvents = &sysEventListener{events: events, ul: listener}
+	cmd := rsm.GetChecksumEncoded(rsm.ToDioType(config.NoCompression),
+		[]byte("test-data"))
+	cmd[1] = cmd[1] + 1
+	lastApplied := n.sm.GetLastApplied()
+	n.pushTask(rsm.Task{Entries: []pb.Entry{{
+		Index: lastApplied + 1,
+		Term:  1,
+		Type:  pb.EncodedEntry,
+		Cmd:   cmd,
+	}}}, false)
+	_, err := n.handleTask(make([]rsm.Task, 0), make([]sm.Entry, 0))
+	if policy == config.RefuseApplyOnChecksumMismatch {
+		if err != nil || !n.applyRefused {
+			t.Errorf("apply not refused, %v", err)
+		}
+	} else {
+		if !errors.Is(err, rsm.ErrChecksumMismatch) || n.applyRefused {
+			t.Errorf("node not halted, %v", err)
+		}
+	}
+	if n.sm.GetLastApplied() != lastApplied {
+		t.Errorf("corrupted entry applied")
+	}
+	select {
+	case e := <-events:
+		n.sysEvents.handle(e)
+	default:
+		t.Fatalf("ChecksumMismatch event not published")
+	}
+	info := listener.getChecksumMismatch()
+	if len(info) != 1 || info[0].ClusterID != testClusterID ||
+		info[0].NodeID != 1 || info[0].Index != lastApplied ||
+		!strings.Contains(info[0].Reason,
+			fmt.Sprintf("entry index %d", lastApplied+1)) {
+		t.Errorf("unexpected ChecksumMismatch info %+v", info)
+	}
+}
+
+func TestChecksumMismatchHaltsNodeByDefault(t *testing.T) {
+	testChecksumMismatchIsHandled(t, config.HaltOnChecksumMismatch)
+}
+
+func TestChecksumMismatchCanRefuseApply(t *testing.T) {
+	testChecksumMismatchIsHandled(t, config.RefuseApplyOnChecksumMismatch)
+}
@@ -85,13 +85,16 @@ package dragonboat // github.com/lni/dragonboat/v3
 import (
 	"context"
 	"errors"
+	"io"
 	"math"
+	"net/http"
 	"reflect"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/juju/ratelimit"
 	"github.com/lni/goutils/logutil"
 	"github.com/lni/goutils/syncutil"
 
@@ -122,9 +125,10 @@ const (
 )
 
 var (
-	receiveQueueLen   = settings.Soft.ReceiveQueueLength
-	requestPoolShards = settings.Soft.NodeHostRequestStatePoolShards
-	streamConnections = settings.Soft.StreamConnections
+	receiveQueueLen    = settings.Soft.ReceiveQueueLength
+	requestPoolShards  = settings.Soft.NodeHostRequestStatePoolShards
+	streamConnections  = settings.Soft.StreamConnections
+	drainCheckInterval = 100 * time.Millisecond
 )
 
 var (
@@ -136,6 +140,13 @@ var (
 	ErrClusterNotFound = errors.New("cluster not found")
 	// ErrClusterAlreadyExist indicates that the specified cluster already exist.
 	ErrClusterAlreadyExist = errors.New("cluster already exist")
+	// ErrClusterNameNotFound indicates that the specified cluster name is not
+	// known to the NodeHost.
+	ErrClusterNameNotFound = errors.New("cluster name not found")
+	// ErrClusterNameConflict indicates that the specified cluster name is
+	// already used by another Raft cluster or the Raft cluster already has a
+	// different name.
+	ErrClusterNameConflict = errors.New("cluster name conflict")
 	// ErrClusterNotStopped indicates that the specified cluster is still running
 	// and thus prevented the requested operation to be completed.
 	ErrClusterNotStopped = errors.New("cluster not stopped")
@@ -158,13 +169,68 @@ var (
 	ErrInvalidDeadline = errors.New("invalid deadline")
 	// ErrDirNotExist indicates that the specified dir does not exist.
 	ErrDirNotExist = errors.New("specified dir does not exist")
+	// ErrDraining indicates that the NodeHost is being drained and thus no
+	// longer accepts new proposals or membership change requests.
+	ErrDraining = errors.New("nodehost is draining")
+	// ErrCompactionEstimateNotSupported indicates that the LogDB in use can not
+	// estimate the outcome of compactions.
+	ErrCompactionEstimateNotSupported = errors.New("compaction estimate not supported")
+	// ErrEntryCacheStatsNotSupported indicates that the LogDB in use doesn't
+	// report entry read cache statistics.
+	ErrEntryCacheStatsNotSupported = errors.New("entry cache stats not supported")
+	// ErrInvalidExportedSnapshot indicates that the specified exported snapshot
+	// is incomplete or can not be used to bootstrap a Raft node.
+	ErrInvalidExportedSnapshot = errors.New("invalid exported snapshot")
+	// ErrInvalidEngineWorkers indicates that the specified number of engine
+	// workers exceeds the number of shards of the stage or that commit workers
+	// are specified when NotifyCommit is not enabled.
+	ErrInvalidEngineWorkers = errors.New("invalid engine workers")
 )
 
+// ClusterStats is the statistics of a Raft node managed by the NodeHost
+// instance, it is returned by the GetClusterStats method.
+type ClusterStats struct {
+	// ClusterID is the cluster ID of the Raft node.
+	ClusterID uint64
+	// NodeID is the node ID of the Raft node.
+	NodeID uint64
+	// LeaderID is the node ID of the leader known to the Raft node, it is 0 when
+	// the leader is unknown.
+	LeaderID uint64
+	// Term is the current Raft term of the Raft node.
+	Term uint64
+	// AppliedIndex is the index of the last entry applied into the state
+	// machine.
+	AppliedIndex uint64
+	// CommittedIndex is the index of the last entry known to be committed.
+	CommittedIndex uint64
+	// LogDBEntryCount is the number of Raft log entries that have not been
+	// compacted from LogDB.
+	LogDBEntryCount uint64
+	// LogDBSize is the approximate size in bytes of the Raft log entries stored
+	// on disk by LogDB. It is 0 when the LogDB does not implement the
+	// raftio.ICompactionEstimator interface.
+	LogDBSize uint64
+	// EntryCacheCount is the number of Raft log entries kept in memory.
+	EntryCacheCount uint64
+	// EntryCacheSize is the estimated size in bytes of the Raft log entries
+	// kept in memory.
+	EntryCacheSize uint64
+	// SnapshotIndex is the index of the most recent snapshot.
+	SnapshotIndex uint64
+	// SnapshotTerm is the term of the most recent snapshot.
+	SnapshotTerm uint64
+	// PendingProposals is the number of proposals waiting to be completed.
+	PendingProposals uint64
+}
+
 // ClusterInfo is a record for representing the state of a Raft cluster based
 // on the knowledge of the local NodeHost instance.
 type ClusterInfo struct {
 	// Nodes is a map of member node IDs to their Raft addresses.
 	Nodes map[uint64]string
+	// ClusterName is the optional human-readable name of the Raft cluster.
+	ClusterName string
 	// ClusterID is the cluster ID of the Raft cluster node.
 	ClusterID uint64
 	// NodeID is the node ID of the Raft cluster node.
@@ -199,6 +265,9 @@ type GossipInfo struct {
 	NumOfKnownNodeHosts int
 	// Enabled is a boolean flag indicating whether the gossip service is enabled.
 	Enabled bool
+	// NumOfEncryptionKeys is the number of keys installed for encrypting and
+	// decrypting gossip messages, it is 0 when gossip encryption is not enabled.
+	NumOfEncryptionKeys int
 }
 
 // NodeHostInfo provides info about the NodeHost, including its managed Raft
@@ -236,6 +305,14 @@ type SnapshotOption struct {
 	// must point to an existing directory for which the current user has write
 	// permission to it.
 	ExportPath string
+	// ExportWriter is the io.Writer to which the exported snapshot should be
+	// streamed. When set, the snapshot is written to ExportWriter as a sequence
+	// of snapshot chunks without touching the local disk, ExportPath is ignored
+	// in such case. State machines that add external files to the snapshot can
+	// not be exported to ExportWriter. ExportWriter is accessed from a snapshot
+	// worker goroutine, it must not be used by the caller until the request
+	// completes. ExportWriter is ignored when Exported is false.
+	ExportWriter io.Writer
 	// CompactionOverhead is the compaction overhead value to use for the request
 	// snapshot operation when OverrideCompactionOverhead is true. This field is
 	// ignored when exporting a snapshot, that is when Exported is true.
@@ -261,7 +338,9 @@ var DefaultSnapshotOption SnapshotOption
 // Target is the type used to specify where a node is running. Target is remote
 // NodeHost's RaftAddress value when NodeHostConfig.AddressByNodeHostID is not
 // set. Target will use NodeHost's ID value when
-// NodeHostConfig.AddressByNodeHostID is set.
+// NodeHostConfig.AddressByNodeHostID is set. When using the built-in transport
+// module, the RaftAddress can also be specified as a DNS SRV name in the form
+// of srv://Name, see config.SRVAddressPrefix for details.
 type Target = string
 
 // NodeHost manages Raft clusters and enables them to share resources such as
@@ -282,6 +361,7 @@ type NodeHost struct {
 		sys         *sysEventListener
 	}
 	nodes        transport.INodeRegistry
+	names        *transport.ClusterNames
 	fs           vfs.IFS
 	transport    transport.ITransport
 	id           *id.NodeHostID
@@ -291,7 +371,14 @@ type NodeHost struct {
 	engine       *engine
 	nhConfig     config.NodeHostConfig
 	requestPools []*sync.Pool
+	requests     *requestStateTracker
+	history      *replicaHistory
+	replacements sync.Map
+	dependencies *applyDependencies
+	restarts     *panicRestarter
+	saveBucket   *ratelimit.Bucket
 	partitioned  int32
+	draining     int32
 	closed       int32
 }
 
@@ -318,6 +405,7 @@ func NewNodeHost(nhConfig config.NodeHostConfig) (*NodeHost, error) {
 		env:      env,
 		nhConfig: nhConfig,
 		stopper:  syncutil.NewStopper(),
+		restarts: newPanicRestarter(),
 		fs:       nhConfig.Expert.FS,
 	}
 	// make static check happy
@@ -326,16 +414,21 @@ func NewNodeHost(nhConfig config.NodeHostConfig) (*NodeHost, error) {
 	nh.events.sys = newSysEventListener(nhConfig.SystemEventListener,
 		nh.stopper.ShouldStop())
 	nh.mu.cciCh = make(chan struct{}, 1)
-	if nhConfig.RaftEventListener != nil {
+	// leader info is also required for announcing leaders via gossip
+	if nhConfig.RaftEventListener != nil || nhConfig.AddressByNodeHostID {
 		nh.events.leaderInfoQ = newLeaderInfoQueue()
 	}
-	if nhConfig.RaftEventListener != nil || nhConfig.SystemEventListener != nil {
+	if nhConfig.RaftEventListener != nil ||
+		nhConfig.SystemEventListener != nil || nhConfig.AddressByNodeHostID {
 		nh.stopper.RunWorker(func() {
 			nh.handleListenerEvents()
 		})
 	}
 	nh.msgHandler = newNodeHostMessageHandler(nh)
 	nh.createPools()
+	if rate := nhConfig.MaxSnapshotSaveBytesPerSecond; rate > 0 {
+		nh.saveBucket = ratelimit.NewBucketWithRate(float64(rate), int64(rate)*2)
+	}
 	defer func() {
 		if r := recover(); r != nil {
 			nh.Stop()
@@ -348,6 +441,10 @@ func NewNodeHost(nhConfig config.NodeHostConfig) (*NodeHost, error) {
 		nh.Stop()
 		return nil, err
 	}
+	if err := nh.loadReplicaHistory(); err != nil {
+		nh.Stop()
+		return nil, err
+	}
 	if err := nh.loadNodeHostID(); err != nil {
 		nh.Stop()
 		return nil, err
@@ -363,7 +460,10 @@ func NewNodeHost(nhConfig config.NodeHostConfig) (*NodeHost, error) {
 		plog.Infof("filesystem error injection mode enabled: %t", errorInjection)
 	}
 	nh.engine = newExecEngine(nh, nhConfig.Expert.Engine,
-		nh.nhConfig.NotifyCommit, errorInjection, nh.env, nh.mu.logdb)
+		nh.nhConfig.NotifyCommit, errorInjection, nhConfig.EnableMetrics,
+		nh.env, nh.mu.logdb)
+	nh.dependencies = newApplyDependencies(nh.getAppliedIndex,
+		nh.engine.setStepReady)
 	if err := nh.createTransport(); err != nil {
 		nh.Stop()
 		return nil, err
@@ -371,6 +471,11 @@ func NewNodeHost(nhConfig config.NodeHostConfig) (*NodeHost, error) {
 	nh.stopper.RunWorker(func() {
 		nh.nodeMonitorMain()
 	})
+	if nhConfig.DiskUsageListener != nil {
+		nh.stopper.RunWorker(func() {
+			nh.diskUsageMain()
+		})
+	}
 	nh.stopper.RunWorker(func() {
 		nh.tickWorkerMain()
 	})
@@ -401,6 +506,54 @@ func (nh *NodeHost) ID() string {
 	return nh.id.String()
 }
 
+// SnapshotFileHandler returns a http.Handler that serves snapshot files of
+// local Raft nodes with HTTP range request support. It allows snapshot images
+// to be pulled over HTTP(S), e.g. via proxies or by resumable and parallel
+// downloaders, see tools.DownloadSnapshotFile for details. The handler is not
+// served by default, it is up to the application to mount it on its own HTTP
+// server and to apply required access control. Set the
+// SnapshotStream.PullURL field of the NodeHostConfig to the URL of the mounted
+// handler to have remote NodeHosts pull snapshot files from it.
+func (nh *NodeHost) SnapshotFileHandler() http.Handler {
+	did := nh.nhConfig.GetDeploymentID()
+	getSnapshotDir := func(cid uint64, nid uint64) string {
+		return nh.env.GetSnapshotDir(did, cid, nid)
+	}
+	return transport.NewSnapshotFileHandler(getSnapshotDir, nh.fs)
+}
+
+// Drain prepares the NodeHost instance to be shut down. It transfers the
+// leadership of all local Raft nodes to the most up to date voting members,
+// rejects new proposals and membership change requests with ErrDraining and
+// waits for all in-flight requests and snapshot streams to complete. Drain
+// returns nil once the NodeHost instance is ready to be stopped, or the context
+// error when ctx is done before that.
+//
+// Leadership of Raft clusters without any other voting member is not
+// transferred. Once Drain is called, the NodeHost instance stays in the
+// draining state until it is stopped.
+func (nh *NodeHost) Drain(ctx context.Context) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	atomic.StoreInt32(&nh.draining, 1)
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		if nh.drained() {
+			plog.Infof("%s is drained", nh.describe())
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-nh.stopper.ShouldStop():
+			return ErrClosed
+		case <-ticker.C:
+		}
+	}
+}
+
 // Stop stops all Raft nodes managed by the NodeHost instance, it also closes
 // all internal components such as the transport and LogDB modules.
 func (nh *NodeHost) Stop() {
@@ -447,6 +600,7 @@ func (nh *NodeHost) Stop() {
 	}
 	plog.Debugf("%s is stopping the env module", nh.describe())
 	nh.env.Stop()
+	nh.reportUnreleasedRequestStates()
 	plog.Debugf("NodeHost %s stopped", nh.describe())
 }
 
@@ -529,6 +683,7 @@ func (nh *NodeHost) StopCluster(clusterID uint64) error {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return ErrClosed
 	}
+	nh.restarts.stopped(clusterID)
 	return nh.stopNode(clusterID, 0, false)
 }
 
@@ -541,6 +696,9 @@ func (nh *NodeHost) StopNode(clusterID uint64, nodeID uint64) error {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return ErrClosed
 	}
+	if nh.restarts.has(clusterID, nodeID) {
+		nh.restarts.stopped(clusterID)
+	}
 	return nh.stopNode(clusterID, nodeID, true)
 }
 
@@ -562,13 +720,87 @@ func (nh *NodeHost) StopNode(clusterID uint64, nodeID uint64) error {
 // the Raft paper recommends to crash the client in this highly unlikely
 // event. When the proposal completed successfully, caller must call
 // client.ProposalCompleted() to get it ready to be used in future proposals.
+//
+// A proposal applied but rejected by the business logic of the state machine
+// is also considered as completed, the returned error is nil and the Error
+// field of the returned result is set by the state machine.
+//
+// The specified ctx is passed to the BeforeUpdate method of the local replica's
+// state machine when it implements the statemachine.IUpdateContext interface.
 func (nh *NodeHost) SyncPropose(ctx context.Context,
 	session *client.Session, cmd []byte) (sm.Result, error) {
 	timeout, err := getTimeoutFromContext(ctx)
 	if err != nil {
 		return sm.Result{}, err
 	}
-	rs, err := nh.Propose(session, cmd, timeout)
+	rs, err := nh.propose(ctx, session, cmd, timeout)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	result, err := getRequestState(ctx, rs)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	rs.Release()
+	return result, nil
+}
+
+// ReadToken identifies the state of a Raft cluster right after a completed
+// proposal, it can be passed to SyncReadWithToken to read from any replica of
+// the Raft cluster with the read-your-writes guarantee. ReadToken values are
+// plain values, they can be stored or sent to other processes.
+type ReadToken struct {
+	// ClusterID is the ID of the Raft cluster that applied the proposal.
+	ClusterID uint64
+	// Index is the index of the Raft log entry of the proposal.
+	Index uint64
+}
+
+// After returns the ReadToken that covers both the token and the specified
+// other token of the same Raft cluster. ErrInvalidOperation is returned when
+// the two tokens are from different Raft clusters.
+func (t ReadToken) After(other ReadToken) (ReadToken, error) {
+	if t.ClusterID != other.ClusterID {
+		return ReadToken{}, ErrInvalidOperation
+	}
+	if other.Index > t.Index {
+		return other, nil
+	}
+	return t, nil
+}
+
+// SyncProposeWithReadToken is similar to SyncPropose, it also returns a
+// ReadToken that can be passed to SyncReadWithToken to observe the update made
+// by the proposal.
+func (nh *NodeHost) SyncProposeWithReadToken(ctx context.Context,
+	session *client.Session, cmd []byte) (sm.Result, ReadToken, error) {
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return sm.Result{}, ReadToken{}, err
+	}
+	rs, err := nh.propose(ctx, session, cmd, timeout)
+	if err != nil {
+		return sm.Result{}, ReadToken{}, err
+	}
+	r, err := getRequestResult(ctx, rs)
+	if err != nil {
+		return sm.Result{}, ReadToken{}, err
+	}
+	rs.Release()
+	token := ReadToken{ClusterID: session.ClusterID, Index: r.AppliedIndex()}
+	return r.GetResult(), token, nil
+}
+
+// SyncProposeWithDependency makes a synchronous proposal with an apply
+// dependency on another Raft cluster. See ProposeWithDependency for details.
+func (nh *NodeHost) SyncProposeWithDependency(ctx context.Context,
+	session *client.Session, cmd []byte,
+	dep ApplyDependency) (sm.Result, error) {
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	rs, err := nh.ProposeWithDependency(session, cmd, dep, timeout)
 	if err != nil {
 		return sm.Result{}, err
 	}
@@ -586,12 +818,19 @@ func (nh *NodeHost) SyncPropose(ctx context.Context,
 // method of the IStateMachine or IOnDiskStateMachine after the system
 // determines that it is safe to perform the local read on IStateMachine or
 // IOnDiskStateMachine. It returns the query result from the Lookup method or
-// the error encountered.
+// the error encountered. Once the specified context is done, the query is
+// cancelled when the state machine implements statemachine.IContextLookup, or
+// abandoned with its result discarded otherwise.
+//
+// When the apply backlog of the local node exceeds the ReadBacklogThreshold
+// specified in config.Config, SyncRead either fails fast with ErrApplyBacklog or
+// serves a stale read depending on the ReadBacklogPolicy. Use SyncReadOrStale
+// to find out whether a read was served as a stale read.
 func (nh *NodeHost) SyncRead(ctx context.Context, clusterID uint64,
 	query interface{}) (interface{}, error) {
 	v, err := nh.linearizableRead(ctx, clusterID,
 		func(node *node) (interface{}, error) {
-			data, err := node.sm.Lookup(query)
+			data, err := node.lookup(ctx, query)
 			if err == rsm.ErrClusterClosed {
 				return nil, ErrClusterClosed
 			}
@@ -603,6 +842,129 @@ func (nh *NodeHost) SyncRead(ctx context.Context, clusterID uint64,
 	return v, nil
 }
 
+// SyncReadBatch performs a synchronous linearizable read on the specified Raft
+// cluster for all specified queries. A single ReadIndex request is made for the
+// whole batch, all queries are then passed to the BatchedLookup method of the
+// state machine in one call when it implements statemachine.IBatchedLookup, or
+// to its Lookup method one by one otherwise. The specified context parameter
+// must has the timeout value set. The returned results are in the same order as
+// the specified queries, an error is returned when any of the queries failed.
+//
+// Compared with making a SyncRead call for each query, SyncReadBatch cuts the
+// per read overhead on read heavy Raft clusters. The batched queries are not
+// cancelled once the specified context is done.
+func (nh *NodeHost) SyncReadBatch(ctx context.Context, clusterID uint64,
+	queries []interface{}) ([]interface{}, error) {
+	if len(queries) == 0 {
+		return []interface{}{}, nil
+	}
+	v, err := nh.linearizableRead(ctx, clusterID,
+		func(node *node) (interface{}, error) {
+			data, err := node.batchedLookup(ctx, queries)
+			if err == rsm.ErrClusterClosed {
+				return nil, ErrClusterClosed
+			}
+			return data, err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]interface{}), nil
+}
+
+// SyncReadOrStale is similar to SyncRead, it also returns a boolean value
+// indicating whether the read was served from the local state machine without
+// the linearizability guarantee as the apply backlog of the local node exceeded
+// the ReadBacklogThreshold and the StaleReadsOnBacklog policy is used. See
+// config.Config for details.
+func (nh *NodeHost) SyncReadOrStale(ctx context.Context, clusterID uint64,
+	query interface{}) (interface{}, bool, error) {
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	rs, node, err := nh.readIndex(clusterID, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	r, err := getRequestResult(ctx, rs)
+	if err != nil {
+		return nil, false, err
+	}
+	rs.Release()
+	data, err := node.lookup(ctx, query)
+	if err == rsm.ErrClusterClosed {
+		return nil, false, ErrClusterClosed
+	}
+	return data, r.Stale(), err
+}
+
+// SyncReadAfter performs a synchronous read on the specified Raft cluster that
+// is guaranteed to observe the update made by the completed proposal that
+// returned the specified RequestResult. Instead of starting a new ReadIndex
+// request, it waits until the local state machine has applied the entry of that
+// proposal before passing the query to the Lookup method of the state machine.
+// The specified context parameter must has the timeout value set.
+//
+// SyncReadAfter provides the read-your-writes guarantee, it is not a
+// linearizable read as updates made by other clients after the specified
+// proposal might not be observed. ErrInvalidOperation is returned when the
+// specified RequestResult is not from a completed proposal.
+func (nh *NodeHost) SyncReadAfter(ctx context.Context, clusterID uint64,
+	result RequestResult, query interface{}) (interface{}, error) {
+	if !result.Completed() || result.AppliedIndex() == 0 {
+		return nil, ErrInvalidOperation
+	}
+	return nh.syncReadAt(ctx, clusterID, result.AppliedIndex(), query)
+}
+
+// SyncReadWithToken performs a synchronous read on the specified Raft cluster
+// that is guaranteed to observe the update made by the proposal that returned
+// the specified ReadToken. It waits until the local replica has applied the
+// entry identified by the token before passing the query to the Lookup method
+// of the state machine, no ReadIndex request is made. The local replica can be
+// any replica of the Raft cluster, including those not involved in the
+// proposal. The specified context parameter must has the timeout value set.
+//
+// Similar to SyncReadAfter, SyncReadWithToken provides the read-your-writes
+// guarantee rather than linearizability. ErrInvalidOperation is returned when
+// the specified token is empty or when it is from another Raft cluster.
+func (nh *NodeHost) SyncReadWithToken(ctx context.Context, clusterID uint64,
+	token ReadToken, query interface{}) (interface{}, error) {
+	if token.Index == 0 || token.ClusterID != clusterID {
+		return nil, ErrInvalidOperation
+	}
+	return nh.syncReadAt(ctx, clusterID, token.Index, query)
+}
+
+func (nh *NodeHost) syncReadAt(ctx context.Context,
+	clusterID uint64, index uint64, query interface{}) (interface{}, error) {
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getCluster(clusterID)
+	if !ok {
+		return nil, ErrClusterNotFound
+	}
+	rs, err := n.readAt(index, nh.getTimeoutTick(timeout))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getRequestState(ctx, rs); err != nil {
+		return nil, err
+	}
+	rs.Release()
+	data, err := n.lookup(ctx, query)
+	if err == rsm.ErrClusterClosed {
+		return nil, ErrClusterClosed
+	}
+	return data, err
+}
+
 // Membership is the struct used to describe Raft cluster membership query
 // results.
 type Membership struct {
@@ -670,6 +1032,93 @@ func (nh *NodeHost) GetClusterMembership(ctx context.Context,
 	return nh.SyncGetClusterMembership(ctx, clusterID)
 }
 
+// NodeStatus is the replication status of a Raft node as observed by the
+// leader of the Raft cluster.
+type NodeStatus struct {
+	// NodeID is the NodeID of the Raft node.
+	NodeID uint64
+	// IsObserver indicates whether the node is an observer.
+	IsObserver bool
+	// IsWitness indicates whether the node is a witness.
+	IsWitness bool
+	// MatchIndex is the highest Raft log index known to be replicated to the
+	// node.
+	MatchIndex uint64
+	// Lag is the number of Raft log entries the node is behind the leader.
+	Lag uint64
+	// Paused indicates whether the leader has paused replicating to the node,
+	// e.g. when waiting for the node to respond or catch up.
+	Paused bool
+	// Snapshotting indicates whether the node is being brought up to date by
+	// a snapshot.
+	Snapshotting bool
+	// Contacted indicates whether any response has been received from the node
+	// since the current leader was elected.
+	Contacted bool
+	// LastContact is the elapsed time since the last response from the node
+	// was received by the leader. It is measured in ticks of RTTMillisecond
+	// and is meaningful only when Contacted is true.
+	LastContact time.Duration
+}
+
+// GetClusterNodeStatus returns the replication status of all nodes in the
+// specified Raft cluster, e.g. their match indexes and last contact times, as
+// observed by the leader. The local node must be the leader of the Raft
+// cluster, ErrInvalidOperation is returned otherwise. Use the GetLeaderID
+// method to locate the leader.
+func (nh *NodeHost) GetClusterNodeStatus(
+	clusterID uint64) (map[uint64]NodeStatus, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getCluster(clusterID)
+	if !ok {
+		return nil, ErrClusterNotFound
+	}
+	status, ok := n.getNodeStatus()
+	if !ok {
+		return nil, ErrInvalidOperation
+	}
+	return status, nil
+}
+
+// RaftState is the Raft state of a local Raft node.
+type RaftState struct {
+	ClusterID uint64
+	NodeID    uint64
+	// Term is the current Raft term.
+	Term uint64
+	// Vote is the NodeID of the node voted for in the current term, it is 0
+	// when the local node hasn't voted in the current term.
+	Vote uint64
+	// CommittedIndex is the index of the last committed log entry known to the
+	// local node.
+	CommittedIndex uint64
+	// AppliedIndex is the index of the last log entry applied into the state
+	// machine.
+	AppliedIndex uint64
+	// LastIndex and LastTerm are the index and term of the last log entry.
+	LastIndex uint64
+	LastTerm  uint64
+	// SnapshotIndex is the index of the most recent snapshot.
+	SnapshotIndex uint64
+}
+
+// GetRaftState returns the current Raft state of the local node of the
+// specified Raft cluster. All fields other than AppliedIndex are read from the
+// Raft node in a consistent manner. The returned RaftState is intended to be
+// used by consistency checkers and debugging tools.
+func (nh *NodeHost) GetRaftState(clusterID uint64) (RaftState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return RaftState{}, ErrClosed
+	}
+	n, ok := nh.getCluster(clusterID)
+	if !ok {
+		return RaftState{}, ErrClusterNotFound
+	}
+	return n.getRaftState(), nil
+}
+
 // GetLeaderID returns the leader node ID of the specified Raft cluster based
 // on local node's knowledge. The returned boolean value indicates whether the
 // leader information is available.
@@ -685,6 +1134,97 @@ func (nh *NodeHost) GetLeaderID(clusterID uint64) (uint64, bool, error) {
 	return leaderID, valid, nil
 }
 
+// GetClusterStats returns the statistics of the local Raft node of the
+// specified Raft cluster. It provides more details than the ClusterInfo
+// returned by the GetNodeHostInfo method, e.g. for capacity planning. Getting
+// the LogDBSize value requires scanning the Raft log entries stored in LogDB,
+// GetClusterStats is thus not expected to be frequently invoked.
+func (nh *NodeHost) GetClusterStats(clusterID uint64) (ClusterStats, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ClusterStats{}, ErrClosed
+	}
+	n, ok := nh.getCluster(clusterID)
+	if !ok {
+		return ClusterStats{}, ErrClusterNotFound
+	}
+	return n.getClusterStats()
+}
+
+// ApplyCheckpoint is the lightweight apply checkpoint persisted between
+// snapshots, see the CheckpointEntries field of config.Config for details.
+type ApplyCheckpoint struct {
+	// Index is the index of the last applied entry covered by the checkpoint.
+	Index uint64
+	// Hash is the hash value returned by the state machine's GetHash method
+	// after applying the entry at Index.
+	Hash uint64
+}
+
+// GetApplyCheckpoint returns the most recent apply checkpoint of the specified
+// Raft cluster. The returned ApplyCheckpoint has zero Index value when no
+// checkpoint is available. Comparing checkpoints at the same Index from
+// different nodes of the same Raft cluster helps to detect divergence of state
+// machines.
+func (nh *NodeHost) GetApplyCheckpoint(clusterID uint64) (ApplyCheckpoint, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ApplyCheckpoint{}, ErrClosed
+	}
+	v, ok := nh.getCluster(clusterID)
+	if !ok {
+		return ApplyCheckpoint{}, ErrClusterNotFound
+	}
+	cp := v.getCheckpoint()
+	return ApplyCheckpoint{Index: cp.Index, Hash: cp.Hash}, nil
+}
+
+// VerifySnapshot re-reads the local snapshot image taken at the specified
+// index by the specified Raft cluster and validates its header, chunk and
+// payload checksums together with the presence of its external files. The
+// most recent local snapshot is verified when index is 0. ErrNoSnapshot is
+// returned when the requested snapshot is not available.
+//
+// nil is returned when the snapshot is valid. Otherwise the returned error
+// describes the detected problem, use errors.Is to check whether it is caused
+// by one of the ErrSnapshot* errors defined in the tools package. Exported
+// snapshots can be verified using the tools.VerifySnapshot function.
+func (nh *NodeHost) VerifySnapshot(clusterID uint64, index uint64) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	v, ok := nh.getCluster(clusterID)
+	if !ok {
+		return ErrClusterNotFound
+	}
+	var ss pb.Snapshot
+	var err error
+	if index == 0 {
+		ss, err = v.snapshotter.GetMostRecentSnapshot()
+	} else {
+		ss, err = v.snapshotter.GetSnapshot(index)
+	}
+	if err != nil {
+		return err
+	}
+	if err := v.snapshotter.fetch(ss); err != nil {
+		return err
+	}
+	return rsm.VerifySnapshot(ss, nh.fs)
+}
+
+// GetEventJournal returns events recorded in the event journal of the
+// specified Raft node, ordered from the oldest to the most recent. The node is
+// not required to be running, events recorded before the node was stopped are
+// returned. An empty result is returned when no event journal is available,
+// see the EventJournalSize field of config.Config for details.
+func (nh *NodeHost) GetEventJournal(clusterID uint64,
+	nodeID uint64) ([]JournalEvent, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	did := nh.nhConfig.GetDeploymentID()
+	return readEventJournal(nh.env.GetSnapshotDir(did, clusterID, nodeID), nh.fs)
+}
+
 // GetNoOPSession returns a NO-OP client session ready to be used for making
 // proposals. The NO-OP client session is a dummy client session that will not
 // be checked or enforced. Use this No-OP client session when you want to ignore
@@ -808,7 +1348,10 @@ func (nh *NodeHost) SyncCloseSession(ctx context.Context,
 // This method returns a RequestState instance or an error immediately.
 // Application can wait on the ResultC() channel of the returned RequestState
 // instance to get notified for the outcome of the proposal and access to the
-// result of the proposal.
+// result of the proposal. Proposals with payload larger than the allowed limit
+// or made while the node is not accepting new proposals as its in memory log
+// quota is exceeded get their RequestState completed immediately, the Reason()
+// and Limit() methods of the RequestResult describe the cause.
 //
 // After the proposal is completed, i.e. RequestResult is received from the
 // ResultC() channel of the returned RequestState, unless NO-OP client session
@@ -823,7 +1366,42 @@ func (nh *NodeHost) SyncCloseSession(ctx context.Context,
 // session ready to be used in future proposals.
 func (nh *NodeHost) Propose(session *client.Session, cmd []byte,
 	timeout time.Duration) (*RequestState, error) {
-	return nh.propose(session, cmd, timeout)
+	return nh.propose(context.Background(), session, cmd, timeout)
+}
+
+// ProposeWithDependency starts an asynchronous proposal with an apply
+// dependency on another Raft cluster. Once committed, the proposed entry is
+// not applied into the state machine of any replica until the Raft cluster
+// specified by the dependency has its applied index reaching the specified
+// index on the NodeHost of that replica, entries committed after it are
+// delayed as well. This allows simple cross cluster causal ordering, e.g. an
+// entry is only applied after the entry it depends on has been applied by
+// another Raft cluster. Replicas of the dependency cluster are thus required
+// to run on all NodeHost instances with replicas of the proposing cluster,
+// otherwise entries will be delayed until such a replica is available.
+//
+// ErrInvalidOperation is returned when the dependency is on the proposing Raft
+// cluster itself.
+func (nh *NodeHost) ProposeWithDependency(session *client.Session,
+	cmd []byte, dep ApplyDependency,
+	timeout time.Duration) (*RequestState, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	if nh.isDraining() {
+		return nil, ErrDraining
+	}
+	v, ok := nh.getCluster(session.ClusterID)
+	if !ok {
+		return nil, ErrClusterNotFound
+	}
+	if !v.supportClientSession() && !session.IsNoOPSession() {
+		plog.Panicf("IOnDiskStateMachine based nodes must use NoOPSession")
+	}
+	req, err := v.proposeWithDependency(context.Background(),
+		session, cmd, &dep, nh.getTimeoutTick(timeout))
+	nh.engine.setStepReady(session.ClusterID)
+	return req, err
 }
 
 // ProposeSession starts an asynchronous proposal on the specified cluster
@@ -834,6 +1412,9 @@ func (nh *NodeHost) Propose(session *client.Session, cmd []byte,
 // completion (RequestResult.Completed() is true) of the operation.
 func (nh *NodeHost) ProposeSession(session *client.Session,
 	timeout time.Duration) (*RequestState, error) {
+	if nh.isDraining() {
+		return nil, ErrDraining
+	}
 	n, ok := nh.getCluster(session.ClusterID)
 	if !ok {
 		return nil, ErrClusterNotFound
@@ -907,6 +1488,12 @@ var staleReadCalled uint32
 // StaleRead queries the specified Raft node directly without any
 // linearizability guarantee.
 //
+// Like all other read methods, StaleRead is always served by the replica of the
+// specified Raft cluster hosted on this NodeHost. The query and its result are
+// not required to be serializable and they are never sent to other NodeHosts.
+// To compare results returned by different replicas of the same Raft cluster,
+// issue the read on each NodeHost hosting those replicas.
+//
 // Users are recommended to use the SyncRead method or a combination of the
 // ReadIndex and ReadLocalNode method to achieve linearizable read.
 func (nh *NodeHost) StaleRead(clusterID uint64,
@@ -934,6 +1521,44 @@ func (nh *NodeHost) StaleRead(clusterID uint64,
 	return data, err
 }
 
+// BoundedStaleRead queries the specified Raft cluster with bounded staleness.
+// The query is served by the local node directly when its applied index is at
+// most maxLag entries behind the committed index reported by the leader and
+// the last message from the leader was received within maxStaleness, it falls
+// back to a linearizable read as in SyncRead otherwise. When the local node is
+// the leader, it must have been in contact with a quorum of voting nodes
+// within maxStaleness. The specified context
+// parameter must have the timeout value set.
+//
+// BoundedStaleRead sits between StaleRead and SyncRead, it is useful when
+// slightly stale results are acceptable but unbounded staleness caused by
+// partitioned or lagging nodes is not.
+func (nh *NodeHost) BoundedStaleRead(ctx context.Context, clusterID uint64,
+	query interface{}, maxLag uint64,
+	maxStaleness time.Duration) (interface{}, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	n, ok := nh.getCluster(clusterID)
+	if !ok {
+		return nil, ErrClusterNotFound
+	}
+	if !n.initialized() {
+		return nil, ErrClusterNotInitialized
+	}
+	if n.isWitness() {
+		return nil, ErrInvalidOperation
+	}
+	if !n.withinStaleness(maxLag, maxStaleness) {
+		return nh.SyncRead(ctx, clusterID, query)
+	}
+	data, err := n.lookup(ctx, query)
+	if err == rsm.ErrClusterClosed {
+		return nil, ErrClusterClosed
+	}
+	return data, err
+}
+
 // SyncRequestSnapshot is the synchronous variant of the RequestSnapshot
 // method. See RequestSnapshot for more details.
 //
@@ -968,7 +1593,10 @@ func (nh *NodeHost) SyncRequestSnapshot(ctx context.Context,
 // field of the SnapshotOption instance. Such an exported snapshot is not
 // managed by the system and it is mainly used to repair the cluster when it
 // permanently loses its majority quorum. See the ImportSnapshot method in the
-// tools package for more details.
+// tools package for more details. When the ExportWriter field is also set, the
+// exported snapshot is streamed to the specified io.Writer instead, this
+// allows snapshots to be sent to remote storage without extra disk IO. Such
+// requests are completed as aborted when the io.Writer fails.
 //
 // When the Exported field of the input SnapshotOption instance is set to false,
 // snapshots created as the result of RequestSnapshot are managed by Dragonboat.
@@ -1044,6 +1672,57 @@ func (nh *NodeHost) RequestCompaction(clusterID uint64,
 	return n.requestCompaction()
 }
 
+// EstimateCompaction reports the number of Raft Log entries and the approximate
+// number of bytes that would be reclaimed by compacting Raft Log entries of the
+// specified node up to the specified index. Nothing is removed or compacted,
+// retention tooling can use the returned estimate to decide whether and up to
+// which index compaction should be requested. Entries are removed in batches
+// by the default LogDB, entries close to the specified index might thus not be
+// included in the estimate.
+//
+// ErrCompactionEstimateNotSupported is returned when the LogDB in use doesn't
+// implement the raftio.ICompactionEstimator interface.
+func (nh *NodeHost) EstimateCompaction(clusterID uint64,
+	nodeID uint64, index uint64) (raftio.CompactionEstimate, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return raftio.CompactionEstimate{}, ErrClosed
+	}
+	nh.mu.RLock()
+	ldb := nh.mu.logdb
+	nh.mu.RUnlock()
+	e, ok := ldb.(raftio.ICompactionEstimator)
+	if !ok {
+		return raftio.CompactionEstimate{}, ErrCompactionEstimateNotSupported
+	}
+	return e.EstimateCompaction(clusterID, nodeID, index)
+}
+
+// GetLogDBEntryCacheStats returns the hit, miss and eviction counters and the
+// current usage of the LogDB entry read cache, operators can use them to size
+// the cache configured by the EntryCacheSize field of config.LogDBConfig. The
+// same counters are also exposed as Prometheus metrics when the EnableMetrics
+// field of config.NodeHostConfig is set.
+//
+// ErrEntryCacheStatsNotSupported is returned when the LogDB in use doesn't
+// implement the raftio.IEntryCacheStatsReporter interface.
+func (nh *NodeHost) GetLogDBEntryCacheStats() (raftio.EntryCacheStats, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return raftio.EntryCacheStats{}, ErrClosed
+	}
+	nh.mu.RLock()
+	ldb := nh.mu.logdb
+	nh.mu.RUnlock()
+	if e, ok := ldb.(*ephemeralLogDB); ok {
+		// in-memory LogDB used by ephemeral witnesses doesn't cache entries
+		ldb = e.ILogDB
+	}
+	r, ok := ldb.(raftio.IEntryCacheStatsReporter)
+	if !ok {
+		return raftio.EntryCacheStats{}, ErrEntryCacheStatsNotSupported
+	}
+	return r.GetEntryCacheStats(), nil
+}
+
 // SyncRequestDeleteNode is the synchronous variant of the RequestDeleteNode
 // method. See RequestDeleteNode for more details.
 //
@@ -1148,6 +1827,9 @@ func (nh *NodeHost) RequestDeleteNode(clusterID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
+	if nh.isDraining() {
+		return nil, ErrDraining
+	}
 	n, ok := nh.getCluster(clusterID)
 	if !ok {
 		return nil, ErrClusterNotFound
@@ -1191,6 +1873,9 @@ func (nh *NodeHost) RequestAddNode(clusterID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
+	if nh.isDraining() {
+		return nil, ErrDraining
+	}
 	n, ok := nh.getCluster(clusterID)
 	if !ok {
 		return nil, ErrClusterNotFound
@@ -1233,6 +1918,9 @@ func (nh *NodeHost) RequestAddObserver(clusterID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
+	if nh.isDraining() {
+		return nil, ErrDraining
+	}
 	n, ok := nh.getCluster(clusterID)
 	if !ok {
 		return nil, ErrClusterNotFound
@@ -1273,6 +1961,9 @@ func (nh *NodeHost) RequestAddWitness(clusterID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
+	if nh.isDraining() {
+		return nil, ErrDraining
+	}
 	n, ok := nh.getCluster(clusterID)
 	if !ok {
 		return nil, ErrClusterNotFound
@@ -1366,7 +2057,7 @@ func (nh *NodeHost) RemoveData(clusterID uint64, nodeID uint64) error {
 	if err := nh.env.RemoveSnapshotDir(did, clusterID, nodeID); err != nil {
 		panic(err)
 	}
-	return nil
+	return nh.history.removed(clusterID, []uint64{nodeID})
 }
 
 // GetNodeUser returns an INodeUser instance ready to be used to directly make
@@ -1388,6 +2079,55 @@ func (nh *NodeHost) GetNodeUser(clusterID uint64) (INodeUser, error) {
 	}, nil
 }
 
+// SetLatencyOptimized enables or disables the latency optimized mode for the
+// specified Raft cluster at runtime. See the LatencyOptimized field of
+// config.Config for details on the latency optimized mode. The change is not
+// persisted, the mode specified in config.Config is used again when the Raft
+// cluster is restarted.
+func (nh *NodeHost) SetLatencyOptimized(clusterID uint64, enabled bool) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	n, ok := nh.getCluster(clusterID)
+	if !ok {
+		return ErrClusterNotFound
+	}
+	n.setLatencyOptimized(enabled)
+	return nil
+}
+
+// GetClusterID returns the ID of the Raft cluster with the specified
+// human-readable name. Cluster names are set using config.Config.ClusterName,
+// ErrClusterNameNotFound is returned when the name is not known to the
+// NodeHost.
+func (nh *NodeHost) GetClusterID(name string) (uint64, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return 0, ErrClosed
+	}
+	clusterID, ok := nh.names.GetClusterID(name)
+	if !ok {
+		return 0, ErrClusterNameNotFound
+	}
+	return clusterID, nil
+}
+
+// GetClusterName returns the human-readable name of the specified Raft
+// cluster. The returned boolean value indicates whether the name is known to
+// the NodeHost.
+func (nh *NodeHost) GetClusterName(clusterID uint64) (string, bool) {
+	return nh.names.GetName(clusterID)
+}
+
+// GetNamedNoOPSession returns a NO-OP client session ready to be used for
+// making proposals to the Raft cluster with the specified name.
+func (nh *NodeHost) GetNamedNoOPSession(name string) (*client.Session, error) {
+	clusterID, err := nh.GetClusterID(name)
+	if err != nil {
+		return nil, err
+	}
+	return nh.GetNoOPSession(clusterID), nil
+}
+
 // HasNodeInfo returns a boolean value indicating whether the specified node
 // has been bootstrapped on the current NodeHost instance.
 func (nh *NodeHost) HasNodeInfo(clusterID uint64, nodeID uint64) bool {
@@ -1430,22 +2170,156 @@ func (nh *NodeHost) GetNodeHostInfo(opt NodeHostInfoOption) *NodeHostInfo {
 	return nhi
 }
 
+// GetUnreleasedRequestStates returns details of RequestState instances that
+// have been returned by asynchronous request methods but not yet released,
+// ordered by their creation time. It requires the
+// config.ExpertConfig.RequestStateLeakDetection option to be enabled, nil is
+// returned otherwise.
+func (nh *NodeHost) GetUnreleasedRequestStates() []UnreleasedRequestState {
+	if nh.requests == nil {
+		return nil
+	}
+	return nh.requests.unreleased()
+}
+
+// EngineWorkers is the number of worker goroutines of the execution engine.
+type EngineWorkers struct {
+	// Step is the number of workers handling the ExecShards execution shards.
+	Step uint64
+	// Commit is the number of workers handling the CommitShards commit shards,
+	// it is always 0 when NotifyCommit is not enabled.
+	Commit uint64
+	// Apply is the number of workers handling the ApplyShards apply shards.
+	Apply uint64
+}
+
+// GetEngineWorkers returns the current number of worker goroutines of the
+// execution engine.
+func (nh *NodeHost) GetEngineWorkers() EngineWorkers {
+	step, commit, apply := nh.engine.workers()
+	return EngineWorkers{Step: step, Commit: commit, Apply: apply}
+}
+
+// SetEngineWorkers changes the number of worker goroutines of the execution
+// engine at runtime, a zero value leaves the corresponding stage unchanged.
+// The number of workers of each stage can not exceed the number of shards of
+// that stage specified in the config.EngineConfig, Raft clusters are always
+// assigned to shards in the same way so the LogDB layout is not affected.
+// When config.EngineConfig.AutoScale is enabled, the number of workers keeps
+// being adjusted by the NodeHost afterwards.
+func (nh *NodeHost) SetEngineWorkers(w EngineWorkers) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	cfg := nh.nhConfig.Expert.Engine
+	if w.Step > cfg.ExecShards || w.Commit > cfg.CommitShards ||
+		w.Apply > cfg.ApplyShards {
+		return ErrInvalidEngineWorkers
+	}
+	if w.Commit > 0 && !nh.nhConfig.NotifyCommit {
+		return ErrInvalidEngineWorkers
+	}
+	nh.engine.resize(w.Step, w.Commit, w.Apply)
+	return nil
+}
+
+// UpdateGossipSeed replaces the seed list of the gossip service with the
+// specified seed addresses and tries to join the gossip group using them. The
+// updated seed list is also used by the gossip service when rejoining the
+// gossip group later, this allows a long running NodeHost to survive the
+// replacement of all seed nodes specified in its NodeHostConfig. See the Seed
+// field of config.GossipConfig for the format of seed addresses.
+//
+// ErrGossipNotEnabled is returned when the NodeHost is not in the
+// AddressByNodeHostID mode. transport.ErrInvalidGossipSeed is returned when
+// seed is empty or contains invalid addresses.
+func (nh *NodeHost) UpdateGossipSeed(seed []string) error {
+	r, err := nh.getGossipRegistry()
+	if err != nil {
+		return err
+	}
+	return r.SetSeed(seed)
+}
+
+// AddGossipEncryptionKey installs the specified key so it can be used by the
+// gossip service for decrypting incoming gossip messages. It is the first step
+// of rotating gossip encryption keys, see the EncryptionKeys field of
+// config.GossipConfig for details. Adding an installed key is a no-op.
+//
+// ErrGossipNotEnabled is returned when the NodeHost is not in the
+// AddressByNodeHostID mode. transport.ErrGossipEncryptionNotEnabled is
+// returned when gossip encryption is not enabled in NodeHostConfig and
+// transport.ErrInvalidGossipEncryptionKey is returned when the key is not 16,
+// 24 or 32 bytes long.
+func (nh *NodeHost) AddGossipEncryptionKey(key []byte) error {
+	r, err := nh.getGossipRegistry()
+	if err != nil {
+		return err
+	}
+	return r.AddEncryptionKey(key)
+}
+
+// UseGossipEncryptionKey makes the specified installed key the primary key
+// used by the gossip service for encrypting outgoing gossip messages. The key
+// should be installed on all NodeHost instances before it is made the primary
+// key, otherwise gossip messages sent to them can not be decrypted.
+//
+// transport.ErrUnknownGossipEncryptionKey is returned when the key has not been
+// installed by AddGossipEncryptionKey or specified in NodeHostConfig.
+func (nh *NodeHost) UseGossipEncryptionKey(key []byte) error {
+	r, err := nh.getGossipRegistry()
+	if err != nil {
+		return err
+	}
+	return r.UseEncryptionKey(key)
+}
+
+// RemoveGossipEncryptionKey removes the specified key from the gossip service.
+// It is the last step of rotating gossip encryption keys and should only be
+// invoked once a new primary key is used by all NodeHost instances.
+//
+// transport.ErrPrimaryGossipEncryptionKey is returned when the key is the
+// current primary key, transport.ErrUnknownGossipEncryptionKey is returned when
+// the key is not installed.
+func (nh *NodeHost) RemoveGossipEncryptionKey(key []byte) error {
+	r, err := nh.getGossipRegistry()
+	if err != nil {
+		return err
+	}
+	return r.RemoveEncryptionKey(key)
+}
+
+func (nh *NodeHost) getGossipRegistry() (*transport.NodeHostIDRegistry, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	r, ok := nh.nodes.(*transport.NodeHostIDRegistry)
+	if !ok {
+		return nil, ErrGossipNotEnabled
+	}
+	return r, nil
+}
+
 func (nh *NodeHost) getGossipInfo() GossipInfo {
 	if r, ok := nh.nodes.(*transport.NodeHostIDRegistry); ok {
 		return GossipInfo{
 			Enabled:             true,
 			AdvertiseAddress:    r.AdvertiseAddress(),
 			NumOfKnownNodeHosts: r.NumMembers(),
+			NumOfEncryptionKeys: r.NumEncryptionKeys(),
 		}
 	}
 	return GossipInfo{}
 }
 
-func (nh *NodeHost) propose(s *client.Session,
+func (nh *NodeHost) propose(ctx context.Context, s *client.Session,
 	cmd []byte, timeout time.Duration) (*RequestState, error) {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
+	if nh.isDraining() {
+		return nil, ErrDraining
+	}
 	v, ok := nh.getCluster(s.ClusterID)
 	if !ok {
 		return nil, ErrClusterNotFound
@@ -1453,7 +2327,7 @@ func (nh *NodeHost) propose(s *client.Session,
 	if !v.supportClientSession() && !s.IsNoOPSession() {
 		plog.Panicf("IOnDiskStateMachine based nodes must use NoOPSession")
 	}
-	req, err := v.propose(s, cmd, nh.getTimeoutTick(timeout))
+	req, err := v.proposeWithContext(ctx, s, cmd, nh.getTimeoutTick(timeout))
 	nh.engine.setStepReady(s.ClusterID)
 	return req, err
 }
@@ -1500,6 +2374,14 @@ func (nh *NodeHost) getCluster(clusterID uint64) (*node, bool) {
 	return n.(*node), true
 }
 
+func (nh *NodeHost) getAppliedIndex(clusterID uint64) (uint64, bool) {
+	n, ok := nh.getCluster(clusterID)
+	if !ok {
+		return 0, false
+	}
+	return n.sm.GetLastApplied(), true
+}
+
 func (nh *NodeHost) forEachCluster(f func(uint64, *node) bool) uint64 {
 	nh.mu.RLock()
 	defer nh.mu.RUnlock()
@@ -1509,6 +2391,34 @@ func (nh *NodeHost) forEachCluster(f func(uint64, *node) bool) uint64 {
 	return nh.mu.cci
 }
 
+func (nh *NodeHost) isDraining() bool {
+	return atomic.LoadInt32(&nh.draining) != 0
+}
+
+func (nh *NodeHost) drained() bool {
+	drained := true
+	toTransfer := make(map[uint64]uint64)
+	nh.forEachCluster(func(cid uint64, n *node) bool {
+		if n.isLeader() {
+			if target, ok := n.getLeaderTransferTarget(); ok {
+				toTransfer[cid] = target
+			}
+		}
+		if n.hasPendingRequest() {
+			drained = false
+		}
+		return true
+	})
+	for cid, target := range toTransfer {
+		drained = false
+		if err := nh.RequestLeaderTransfer(cid, target); err != nil {
+			plog.Debugf("%s failed to transfer leadership to %d, %v",
+				nh.describe(), target, err)
+		}
+	}
+	return drained && nh.transport.GetSnapshotJobCount() == 0
+}
+
 func (nh *NodeHost) getClusterSetIndex() uint64 {
 	nh.mu.RLock()
 	defer nh.mu.RUnlock()
@@ -1584,6 +2494,21 @@ func (nh *NodeHost) startCluster(initialMembers map[uint64]Target,
 	if join && len(initialMembers) > 0 {
 		return ErrInvalidClusterSettings
 	}
+	if !cfg.AllowNodeIDReuse && nh.history.isRemoved(clusterID, nodeID) {
+		plog.Errorf("%s was removed from the cluster, NodeID can not be reused",
+			dn(clusterID, nodeID))
+		return ErrNodeRemoved
+	}
+	if len(cfg.ClusterName) > 0 {
+		if !nh.names.Set(cfg.ClusterName, clusterID) {
+			return ErrClusterNameConflict
+		}
+	}
+	if cfg.EphemeralWitness {
+		if err := nh.registerEphemeralWitness(clusterID, nodeID); err != nil {
+			return err
+		}
+	}
 	peers, im, err := nh.bootstrapCluster(initialMembers, join, cfg, smType)
 	if err == ErrInvalidClusterSettings {
 		return err
@@ -1603,16 +2528,27 @@ func (nh *NodeHost) startCluster(initialMembers map[uint64]Target,
 		}
 		panic(err)
 	}
+	if err := nh.history.used(clusterID, nodeID); err != nil {
+		panic(err)
+	}
 	getSnapshotDir := func(cid uint64, nid uint64) string {
 		return nh.env.GetSnapshotDir(did, cid, nid)
 	}
 	ss := newSnapshotter(clusterID, nodeID, getSnapshotDir, nh.mu.logdb, nh.fs)
+	ss.setRetentionPolicy(cfg.SnapshotRetentionCount, cfg.SnapshotRetentionPeriod)
+	ss.setSaveRateLimit(nh.saveBucket)
+	ss.setEncryptionProvider(nh.nhConfig.SnapshotEncryption)
+	ss.setSnapshotStorage(nh.nhConfig.SnapshotStorage)
 	if err := ss.processOrphans(); err != nil {
 		panic(err)
 	}
 	p := server.NewDoubleFixedPartitioner(nh.nhConfig.Expert.Engine.ExecShards,
 		nh.nhConfig.Expert.LogDB.Shards)
 	shard := p.GetPartitionID(clusterID)
+	if nh.nhConfig.Expert.LogDB.PerClusterInstance {
+		// per cluster LogDB instances report their busy status using cluster ID
+		shard = clusterID
+	}
 	rn, err := newNode(peers,
 		im,
 		cfg,
@@ -1628,10 +2564,14 @@ func (nh *NodeHost) startCluster(initialMembers map[uint64]Target,
 		nh.requestPools[nodeID%requestPoolShards],
 		nh.mu.logdb,
 		nh.getLogDBMetrics(shard),
-		nh.events.sys)
+		nh.events.sys,
+		nh.history,
+		nh.dependencies,
+		nh.nodePanicked)
 	if err != nil {
 		panic(err)
 	}
+	nh.restarts.started(cfg, createStateMachine, smType)
 	rn.loaded()
 	nh.mu.clusters.Store(clusterID, rn)
 	nh.mu.cci++
@@ -1666,14 +2606,34 @@ func (nh *NodeHost) loadNodeHostID() error {
 	return nil
 }
 
+func (nh *NodeHost) reportUnreleasedRequestStates() {
+	if nh.requests == nil {
+		return
+	}
+	states := nh.requests.unreleased()
+	if len(states) == 0 {
+		return
+	}
+	plog.Warningf("%s has %d unreleased RequestState instances",
+		nh.describe(), len(states))
+	for _, state := range states {
+		plog.Warningf("RequestState created at %s not released, stack:\n%s",
+			state.Created.Format(time.RFC3339Nano), state.Stack)
+	}
+}
+
 func (nh *NodeHost) createPools() {
 	nh.requestPools = make([]*sync.Pool, requestPoolShards)
+	if nh.nhConfig.Expert.RequestStateLeakDetection {
+		nh.requests = newRequestStateTracker()
+	}
 	for i := uint64(0); i < requestPoolShards; i++ {
 		p := &sync.Pool{}
 		p.New = func() interface{} {
 			obj := &RequestState{}
 			obj.CompletedC = make(chan RequestResult, 1)
 			obj.pool = p
+			obj.tracker = nh.requests
 			if nh.nhConfig.NotifyCommit {
 				obj.committedC = make(chan RequestResult, 1)
 			}
@@ -1683,6 +2643,16 @@ func (nh *NodeHost) createPools() {
 	}
 }
 
+func (nh *NodeHost) loadReplicaHistory() error {
+	dir, _ := nh.env.GetLogDBDirs(nh.nhConfig.GetDeploymentID())
+	history, err := loadReplicaHistory(dir, nh.fs)
+	if err != nil {
+		return err
+	}
+	nh.history = history
+	return nil
+}
+
 func (nh *NodeHost) createLogDB() error {
 	did := nh.nhConfig.GetDeploymentID()
 	nhDir, walDir, err := nh.env.CreateNodeHostDir(did)
@@ -1712,8 +2682,8 @@ func (nh *NodeHost) createLogDB() error {
 	if err := nh.env.CheckNodeHostDir(nh.nhConfig, ver, name); err != nil {
 		return err
 	}
-	if shardedrdb, ok := ldb.(*logdb.ShardedDB); ok {
-		failed, err := shardedrdb.SelfCheckFailed()
+	if sc, ok := ldb.(selfChecker); ok {
+		failed, err := sc.SelfCheckFailed()
 		if err != nil {
 			return err
 		}
@@ -1721,11 +2691,29 @@ func (nh *NodeHost) createLogDB() error {
 			return server.ErrLogDBBrokenChange
 		}
 	}
+	nh.mu.logdb = newEphemeralLogDB(ldb, nh.nhConfig)
 	plog.Infof("logdb memory limit: %d MBytes",
 		nh.nhConfig.Expert.LogDB.MemorySizeMB())
 	return nil
 }
 
+func (nh *NodeHost) registerEphemeralWitness(clusterID uint64,
+	nodeID uint64) error {
+	ldb, ok := nh.mu.logdb.(*ephemeralLogDB)
+	if !ok {
+		plog.Panicf("unexpected logdb type %T", nh.mu.logdb)
+	}
+	plog.Warningf("%s is an ephemeral witness, its raft state is not persisted",
+		dn(clusterID, nodeID))
+	return ldb.register(clusterID, nodeID)
+}
+
+// selfChecker is implemented by built-in LogDB types that can check whether
+// the stored entry format matches the configured one.
+type selfChecker interface {
+	SelfCheckFailed() (bool, error)
+}
+
 func (nh *NodeHost) handleLogDBInfo(info config.LogDBInfo) {
 	plog.Infof("LogDB info received, shard %d, busy %t", info.Shard, info.Busy)
 	nh.mu.Lock()
@@ -1763,11 +2751,37 @@ func (te *transportEvent) ConnectionFailed(addr string, snapshot bool) {
 	})
 }
 
+func (te *transportEvent) AddressChanged(addr string,
+	previous []string, current []string) {
+	te.nh.events.sys.Publish(server.SystemEvent{
+		Type:        server.AddressChanged,
+		Address:     addr,
+		PreviousIPs: previous,
+		CurrentIPs:  current,
+	})
+}
+
+func (te *transportEvent) PeerHealthChanged(addr string, reachable bool) {
+	te.nh.events.sys.Publish(server.SystemEvent{
+		Type:      server.PeerHealthChanged,
+		Address:   addr,
+		Reachable: reachable,
+	})
+}
+
 func (nh *NodeHost) createNodeRegistry() error {
 	validator := nh.nhConfig.GetTargetValidator()
 	// TODO:
 	// more tests here required
-	if nh.nhConfig.AddressByNodeHostID {
+	if f := nh.nhConfig.Expert.NodeRegistryFactory; f != nil {
+		plog.Infof("using custom node registry")
+		r, err := f.Create(nh.ID(), nh.nhConfig, validator)
+		if err != nil {
+			return err
+		}
+		nh.nodes = r
+		nh.names = transport.NewClusterNames()
+	} else if nh.nhConfig.AddressByNodeHostID {
 		plog.Infof("AddressByNodeHostID: true, use gossip based node registry")
 		r, err := transport.NewNodeHostIDRegistry(nh.ID(),
 			nh.nhConfig, streamConnections, validator)
@@ -1775,9 +2789,11 @@ func (nh *NodeHost) createNodeRegistry() error {
 			return err
 		}
 		nh.nodes = r
+		nh.names = r.(*transport.NodeHostIDRegistry).ClusterNames()
 	} else {
 		plog.Infof("using regular node registry")
 		nh.nodes = transport.NewNodeRegistry(streamConnections, validator)
+		nh.names = transport.NewClusterNames()
 	}
 	return nil
 }
@@ -1878,7 +2894,12 @@ func (nh *NodeHost) handleListenerEvents() {
 				if !ok {
 					break
 				}
-				nh.events.raft.LeaderUpdated(v)
+				if r, ok := nh.nodes.(*transport.NodeHostIDRegistry); ok {
+					r.LeaderUpdated(v.ClusterID, v.NodeID, v.LeaderID, v.Term)
+				}
+				if nh.events.raft != nil {
+					nh.events.raft.LeaderUpdated(v)
+				}
 			}
 		case e := <-nh.events.sys.events:
 			nh.events.sys.handle(e)
@@ -1901,7 +2922,7 @@ func (nh *NodeHost) sendMessage(msg pb.Message) {
 			if witness || !n.OnDiskStateMachine() {
 				nh.transport.SendSnapshot(msg)
 			} else {
-				n.pushStreamSnapshotRequest(msg.ClusterId, msg.To)
+				n.pushStreamSnapshotRequest(msg.ClusterId, msg.To, msg.Hint)
 			}
 		}
 		nh.events.sys.Publish(server.SystemEvent{
@@ -1979,25 +3000,42 @@ func (nh *NodeHost) logNodeHostDetails() {
 }
 
 func getRequestState(ctx context.Context, rs *RequestState) (sm.Result, error) {
+	r, err := getRequestResult(ctx, rs)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	return r.GetResult(), nil
+}
+
+func getRequestResult(ctx context.Context,
+	rs *RequestState) (RequestResult, error) {
 	select {
 	case r := <-rs.AppliedC():
 		if r.Completed() {
-			return r.GetResult(), nil
+			return r, nil
 		} else if r.Rejected() {
-			return sm.Result{}, ErrRejected
+			if r.Reason() == ReasonPayloadTooBig {
+				return RequestResult{}, ErrPayloadTooBig
+			}
+			return RequestResult{}, ErrRejected
 		} else if r.Timeout() {
-			return sm.Result{}, ErrTimeout
+			return RequestResult{}, ErrTimeout
 		} else if r.Terminated() {
-			return sm.Result{}, ErrClusterClosed
+			return RequestResult{}, ErrClusterClosed
 		} else if r.Dropped() {
-			return sm.Result{}, ErrClusterNotReady
+			if r.Reason() == ReasonQuotaExceeded {
+				return RequestResult{}, ErrSystemBusy
+			}
+			return RequestResult{}, ErrClusterNotReady
+		} else if r.Aborted() {
+			return RequestResult{}, ErrAborted
 		}
 		plog.Panicf("unknown v code %v", r)
 	case <-ctx.Done():
 		if ctx.Err() == context.Canceled {
-			return sm.Result{}, ErrCanceled
+			return RequestResult{}, ErrCanceled
 		} else if ctx.Err() == context.DeadlineExceeded {
-			return sm.Result{}, ErrTimeout
+			return RequestResult{}, ErrTimeout
 		}
 	}
 	panic("should never reach here")
@@ -2041,6 +3079,9 @@ func (nu *nodeUser) NodeID() uint64 {
 
 func (nu *nodeUser) Propose(s *client.Session,
 	cmd []byte, timeout time.Duration) (*RequestState, error) {
+	if nu.nh.isDraining() {
+		return nil, ErrDraining
+	}
 	req, err := nu.node.propose(s, cmd, nu.nh.getTimeoutTick(timeout))
 	nu.setStepReady(s.ClusterID)
 	return req, err
@@ -0,0 +1,143 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/lni/dragonboat/v3/internal/server"
+)
+
+// OrphanedData is the on-disk data of a Raft node that is not managed by the
+// NodeHost, it is returned by the CleanupOrphanedData method.
+type OrphanedData struct {
+	// ClusterID and NodeID identify the Raft node that owns the data.
+	ClusterID uint64
+	NodeID    uint64
+	// LogDB indicates whether the bootstrap record, Raft state, snapshot
+	// records and Raft Log entries of the node can be found in the LogDB.
+	LogDB bool
+	// SnapshotDir is the path of the snapshot directory of the node that still
+	// contains snapshot data, it is empty when there is no such directory.
+	SnapshotDir string
+}
+
+// CleanupOrphanedData removes on-disk data of Raft nodes not currently managed
+// by the NodeHost. This includes LogDB records and snapshot directories left
+// behind by removed nodes and by nodes that are no longer started on the
+// NodeHost, e.g. after their Raft clusters have been deleted. Such data is
+// removed in the same way as the RemoveData method, snapshot directories of
+// removed nodes are kept with all snapshot data deleted so the same node can
+// not be accidentally restarted. When dryRun is true, data to be removed is
+// listed without being deleted.
+//
+// Note that all Raft nodes that are not running on the NodeHost at the time
+// of the call are considered as orphaned, stopped nodes that are expected to
+// be restarted later must be restarted before invoking CleanupOrphanedData.
+// Use the dryRun mode to review the data to be removed first.
+func (nh *NodeHost) CleanupOrphanedData(dryRun bool) ([]OrphanedData, error) {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	orphans, err := nh.getOrphanedData()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return orphans, nil
+	}
+	did := nh.nhConfig.GetDeploymentID()
+	for _, od := range orphans {
+		plog.Infof("%s removing orphaned data, logdb %t, snapshot dir %s",
+			dn(od.ClusterID, od.NodeID), od.LogDB, od.SnapshotDir)
+		if od.LogDB {
+			if err := nh.mu.logdb.RemoveNodeData(od.ClusterID,
+				od.NodeID); err != nil {
+				return nil, err
+			}
+		}
+		if len(od.SnapshotDir) > 0 {
+			if err := nh.env.RemoveSnapshotDir(did,
+				od.ClusterID, od.NodeID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return orphans, nil
+}
+
+func (nh *NodeHost) getOrphanedData() ([]OrphanedData, error) {
+	type key struct {
+		clusterID uint64
+		nodeID    uint64
+	}
+	orphans := make(map[key]*OrphanedData)
+	get := func(clusterID uint64, nodeID uint64) *OrphanedData {
+		k := key{clusterID: clusterID, nodeID: nodeID}
+		od, ok := orphans[k]
+		if !ok {
+			od = &OrphanedData{ClusterID: clusterID, NodeID: nodeID}
+			orphans[k] = od
+		}
+		return od
+	}
+	nodes, err := nh.mu.logdb.ListNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	for _, ni := range nodes {
+		if !nh.isManagedNode(ni.ClusterID, ni.NodeID) {
+			get(ni.ClusterID, ni.NodeID).LogDB = true
+		}
+	}
+	dirs, err := nh.env.ListSnapshotDirs(nh.nhConfig.GetDeploymentID())
+	if err != nil {
+		return nil, err
+	}
+	for _, sd := range dirs {
+		if isRemovedSnapshotDir(sd) ||
+			nh.isManagedNode(sd.ClusterID, sd.NodeID) {
+			continue
+		}
+		get(sd.ClusterID, sd.NodeID).SnapshotDir = sd.Path
+	}
+	result := make([]OrphanedData, 0, len(orphans))
+	for _, od := range orphans {
+		result = append(result, *od)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ClusterID != result[j].ClusterID {
+			return result[i].ClusterID < result[j].ClusterID
+		}
+		return result[i].NodeID < result[j].NodeID
+	})
+	return result, nil
+}
+
+// isRemovedSnapshotDir returns a boolean value indicating whether the snapshot
+// directory has been fully cleaned up by RemoveData.
+func isRemovedSnapshotDir(sd server.SnapshotDirInfo) bool {
+	return sd.Removed && sd.Empty
+}
+
+func (nh *NodeHost) isManagedNode(clusterID uint64, nodeID uint64) bool {
+	if n, ok := nh.getCluster(clusterID); ok && n.nodeID == nodeID {
+		return true
+	}
+	return nh.engine.nodeLoaded(clusterID, nodeID)
+}
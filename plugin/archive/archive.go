@@ -0,0 +1,405 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package archive provides a LogDB wrapper that archives Raft log entries to
+object storage services such as S3 or GCS before they are removed from the
+local LogDB.
+
+Raft log entries removed after snapshots are no longer required by Raft
+itself, but some applications have to retain them for a long period of time,
+e.g. for auditing or for rebuilding derived data. Keeping all of them in the
+local LogDB makes its size unbounded. The wrapper uploads entries to be
+removed to the object storage and transparently fetches them back when they
+are requested by IterateEntries, the local LogDB size is thus bounded by the
+usual compaction settings while all entries remain readable.
+
+Archived entries are stored as objects named
+
+	<clusterID>/<nodeID>/<firstIndex>-<lastIndex>
+
+with both indexes zero padded to 20 digits, each object contains a protobuf
+encoded pb.EntryBatch.
+*/
+package archive
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lni/goutils/logutil"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/logdb"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/logger"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+var (
+	plog = logger.GetLogger("archive")
+)
+
+var (
+	// maxObjectSize is the approximate max size of each archived object.
+	maxObjectSize uint64 = 4 * 1024 * 1024
+	// operationTimeout is the timeout of each object storage operation.
+	operationTimeout = 30 * time.Second
+)
+
+// IStorage is the interface implemented by object storage services used for
+// storing archived Raft log entries.
+type IStorage interface {
+	// Put stores data as the object with the specified key.
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the content of the object with the specified key.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns keys of all objects with the specified prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes the object with the specified key.
+	Delete(ctx context.Context, key string) error
+}
+
+// Factory is the factory type for creating LogDB instances that archive
+// removed Raft log entries to the specified IStorage.
+type Factory struct {
+	base    config.LogDBFactory
+	storage IStorage
+}
+
+var _ config.LogDBFactory = (*Factory)(nil)
+
+// NewFactory creates a Factory instance. base is the factory used for creating
+// the underlying local LogDB, the default LogDB is used when it is nil.
+func NewFactory(base config.LogDBFactory, storage IStorage) *Factory {
+	return &Factory{base: base, storage: storage}
+}
+
+// Create creates a LogDB instance.
+func (f *Factory) Create(cfg config.NodeHostConfig, cb config.LogDBCallback,
+	dirs []string, lldirs []string) (raftio.ILogDB, error) {
+	ldb, err := f.getBase(cfg).Create(cfg, cb, dirs, lldirs)
+	if err != nil {
+		return nil, err
+	}
+	return NewLogDB(ldb, f.storage), nil
+}
+
+// Name returns the type name of the underlying LogDB. The format of local
+// data is not changed by archiving.
+func (f *Factory) Name() string {
+	if f.base == nil {
+		return logdb.NewDefaultFactory(nil).Name()
+	}
+	return f.base.Name()
+}
+
+func (f *Factory) getBase(cfg config.NodeHostConfig) config.LogDBFactory {
+	if f.base != nil {
+		return f.base
+	}
+	fs := cfg.Expert.FS
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	return logdb.NewDefaultFactory(fs)
+}
+
+type nodeKey struct {
+	clusterID uint64
+	nodeID    uint64
+}
+
+type objectRange struct {
+	key   string
+	first uint64
+	last  uint64
+}
+
+// LogDB is a raftio.ILogDB wrapper that archives entries before they are
+// removed from the wrapped LogDB.
+type LogDB struct {
+	raftio.ILogDB
+	storage IStorage
+	mu      sync.Mutex
+	// archivedTo is the index of the last archived entry of each node, it is
+	// lazily loaded from the object storage
+	archivedTo map[nodeKey]uint64
+}
+
+var _ raftio.ILogDB = (*LogDB)(nil)
+
+// NewLogDB returns a LogDB instance that wraps the specified ILogDB.
+func NewLogDB(ldb raftio.ILogDB, storage IStorage) *LogDB {
+	return &LogDB{
+		ILogDB:     ldb,
+		storage:    storage,
+		archivedTo: make(map[nodeKey]uint64),
+	}
+}
+
+// RemoveEntriesTo archives all entries up to the specified index before
+// removing them from the underlying LogDB.
+func (l *LogDB) RemoveEntriesTo(clusterID uint64,
+	nodeID uint64, index uint64) error {
+	if err := l.archive(clusterID, nodeID, index); err != nil {
+		return err
+	}
+	return l.ILogDB.RemoveEntriesTo(clusterID, nodeID, index)
+}
+
+// RemoveNodeData removes all data of the specified node, including its
+// archived entries.
+func (l *LogDB) RemoveNodeData(clusterID uint64, nodeID uint64) error {
+	if err := l.ILogDB.RemoveNodeData(clusterID, nodeID); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	objects, err := l.list(clusterID, nodeID)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+		err := l.storage.Delete(ctx, o.key)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	delete(l.archivedTo, nodeKey{clusterID, nodeID})
+	return nil
+}
+
+// IterateEntries returns continuous entries in the range of [low, high), up
+// to maxSize bytes. Entries no longer available in the underlying LogDB are
+// fetched from the object storage.
+func (l *LogDB) IterateEntries(ents []pb.Entry, size uint64,
+	clusterID uint64, nodeID uint64, low uint64, high uint64,
+	maxSize uint64) ([]pb.Entry, uint64, error) {
+	count := len(ents)
+	ents, size, err := l.ILogDB.IterateEntries(ents,
+		size, clusterID, nodeID, low, high, maxSize)
+	if err != nil || len(ents) > count || low >= high {
+		return ents, size, err
+	}
+	archived, err := l.readArchived(clusterID, nodeID, low, high)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(archived) == 0 {
+		return ents, size, nil
+	}
+	for _, e := range archived {
+		ents = append(ents, e)
+		size += uint64(e.SizeUpperLimit())
+		if size > maxSize {
+			return ents, size, nil
+		}
+	}
+	next := archived[len(archived)-1].Index + 1
+	if next >= high {
+		return ents, size, nil
+	}
+	return l.ILogDB.IterateEntries(ents,
+		size, clusterID, nodeID, next, high, maxSize)
+}
+
+func (l *LogDB) archive(clusterID uint64, nodeID uint64, index uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rs, err := l.ILogDB.ReadRaftState(clusterID, nodeID, 0)
+	if err == raftio.ErrNoSavedLog {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rs.EntryCount == 0 {
+		return nil
+	}
+	last := rs.FirstIndex + rs.EntryCount - 1
+	if index > last+1 {
+		index = last + 1
+	}
+	archivedTo, err := l.getArchivedTo(clusterID, nodeID)
+	if err != nil {
+		return err
+	}
+	from := rs.FirstIndex
+	if archivedTo >= from {
+		from = archivedTo + 1
+	}
+	for from < index {
+		ents, _, err := l.ILogDB.IterateEntries(nil,
+			0, clusterID, nodeID, from, index, maxObjectSize)
+		if err != nil {
+			return err
+		}
+		if len(ents) == 0 {
+			plog.Panicf("entry %d of %s not found",
+				from, logutil.DescribeNode(clusterID, nodeID))
+		}
+		if err := l.upload(clusterID, nodeID, ents); err != nil {
+			return err
+		}
+		from = ents[len(ents)-1].Index + 1
+		l.archivedTo[nodeKey{clusterID, nodeID}] = from - 1
+	}
+	return nil
+}
+
+func (l *LogDB) upload(clusterID uint64, nodeID uint64, ents []pb.Entry) error {
+	eb := pb.EntryBatch{Entries: ents}
+	data, err := eb.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	key := getObjectKey(clusterID,
+		nodeID, ents[0].Index, ents[len(ents)-1].Index)
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	defer cancel()
+	return l.storage.Put(ctx, key, data)
+}
+
+func (l *LogDB) getArchivedTo(clusterID uint64, nodeID uint64) (uint64, error) {
+	key := nodeKey{clusterID, nodeID}
+	if v, ok := l.archivedTo[key]; ok {
+		return v, nil
+	}
+	objects, err := l.list(clusterID, nodeID)
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(0)
+	if len(objects) > 0 {
+		v = objects[len(objects)-1].last
+	}
+	l.archivedTo[key] = v
+	return v, nil
+}
+
+// readArchived returns continuous archived entries starting from low, it
+// stops at high or at the first missing entry.
+func (l *LogDB) readArchived(clusterID uint64,
+	nodeID uint64, low uint64, high uint64) ([]pb.Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	archivedTo, err := l.getArchivedTo(clusterID, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if low > archivedTo {
+		return nil, nil
+	}
+	objects, err := l.list(clusterID, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]pb.Entry, 0)
+	next := low
+	for _, o := range objects {
+		if o.last < next {
+			continue
+		}
+		if o.first > next || next >= high {
+			break
+		}
+		ents, err := l.get(o.key)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range ents {
+			if e.Index == next && e.Index < high {
+				result = append(result, e)
+				next++
+			}
+		}
+	}
+	return result, nil
+}
+
+func (l *LogDB) get(key string) ([]pb.Entry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	defer cancel()
+	data, err := l.storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var eb pb.EntryBatch
+	if err := eb.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return eb.Entries, nil
+}
+
+// list returns archived objects of the specified node sorted by their first
+// index. Only committed entries are archived, archived entries thus never
+// change.
+func (l *LogDB) list(clusterID uint64, nodeID uint64) ([]objectRange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), operationTimeout)
+	defer cancel()
+	prefix := getObjectPrefix(clusterID, nodeID)
+	keys, err := l.storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]objectRange, 0, len(keys))
+	for _, key := range keys {
+		first, last, ok := parseObjectKey(strings.TrimPrefix(key, prefix))
+		if !ok {
+			plog.Warningf("unexpected object %s", key)
+			continue
+		}
+		result = append(result, objectRange{key: key, first: first, last: last})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].first < result[j].first
+	})
+	return result, nil
+}
+
+func getObjectPrefix(clusterID uint64, nodeID uint64) string {
+	return fmt.Sprintf("%d/%d/", clusterID, nodeID)
+}
+
+func getObjectKey(clusterID uint64,
+	nodeID uint64, first uint64, last uint64) string {
+	return fmt.Sprintf("%s%020d-%020d",
+		getObjectPrefix(clusterID, nodeID), first, last)
+}
+
+func parseObjectKey(name string) (uint64, uint64, bool) {
+	parts := strings.Split(name, "-")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	last, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || last < first || last == math.MaxUint64 {
+		return 0, 0, false
+	}
+	return first, last, true
+}
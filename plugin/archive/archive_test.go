@@ -0,0 +1,227 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/logdb"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+const (
+	testDir = "archive_test_dir_safe_to_delete"
+)
+
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	puts    int
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: make(map[string][]byte)}
+}
+
+func (s *memStorage) Put(ctx context.Context, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = append([]byte{}, data...)
+	s.puts++
+	return nil
+}
+
+func (s *memStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return data, nil
+}
+
+func (s *memStorage) List(ctx context.Context, prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]string, 0)
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+func (s *memStorage) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memStorage) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.objects)
+}
+
+func runArchiveTest(t *testing.T,
+	tf func(t *testing.T, open func() raftio.ILogDB, s *memStorage)) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(testDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(testDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	if err := fs.MkdirAll(testDir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expert := config.GetDefaultExpertConfig()
+	expert.LogDB.Shards = 1
+	cfg := config.NodeHostConfig{Expert: expert}
+	s := newMemStorage()
+	f := NewFactory(logdb.NewDefaultFactory(fs), s)
+	open := func() raftio.ILogDB {
+		ldb, err := f.Create(cfg, nil, []string{testDir}, []string{testDir})
+		if err != nil {
+			t.Fatalf("failed to create logdb %v", err)
+		}
+		return ldb
+	}
+	tf(t, open, s)
+}
+
+func saveEntries(t *testing.T, ldb raftio.ILogDB, low uint64, high uint64) {
+	ents := make([]pb.Entry, 0)
+	for i := low; i < high; i++ {
+		ents = append(ents, pb.Entry{Index: i, Term: 1, Cmd: make([]byte, 1024)})
+	}
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 1, Commit: high - 1},
+		EntriesToSave: ents,
+	}
+	if err := ldb.SaveRaftState([]pb.Update{ud}, 1); err != nil {
+		t.Fatalf("failed to save raft state %v", err)
+	}
+}
+
+func checkEntries(t *testing.T, ldb raftio.ILogDB, low uint64, high uint64) {
+	ents, _, err := ldb.IterateEntries(nil, 0, 1, 2, low, high, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("failed to iterate entries %v", err)
+	}
+	if uint64(len(ents)) != high-low {
+		t.Fatalf("got %d entries, want %d", len(ents), high-low)
+	}
+	for idx, e := range ents {
+		if e.Index != low+uint64(idx) || len(e.Cmd) != 1024 {
+			t.Fatalf("unexpected entry %d", e.Index)
+		}
+	}
+}
+
+func TestObjectKeyCanBeParsed(t *testing.T) {
+	key := getObjectKey(1, 2, 100, 200)
+	if key != "1/2/00000000000000000100-00000000000000000200" {
+		t.Errorf("unexpected key %s", key)
+	}
+	first, last, ok := parseObjectKey(strings.TrimPrefix(key,
+		getObjectPrefix(1, 2)))
+	if !ok || first != 100 || last != 200 {
+		t.Errorf("failed to parse key, %d, %d, %t", first, last, ok)
+	}
+	for _, v := range []string{"", "1", "a-b", "200-100", "1-2-3"} {
+		if _, _, ok := parseObjectKey(v); ok {
+			t.Errorf("unexpectedly parsed %s", v)
+		}
+	}
+}
+
+func TestRemovedEntriesAreArchived(t *testing.T) {
+	tf := func(t *testing.T, open func() raftio.ILogDB, s *memStorage) {
+		ldb := open()
+		saveEntries(t, ldb, 1, 101)
+		if err := ldb.RemoveEntriesTo(1, 2, 60); err != nil {
+			t.Fatalf("failed to remove entries %v", err)
+		}
+		if s.count() == 0 {
+			t.Fatalf("entries not archived")
+		}
+		rs, err := ldb.ReadRaftState(1, 2, 0)
+		if err != nil {
+			t.Fatalf("failed to read raft state %v", err)
+		}
+		if rs.FirstIndex != 60 {
+			t.Errorf("entries not removed locally, first index %d", rs.FirstIndex)
+		}
+		checkEntries(t, ldb, 1, 101)
+		checkEntries(t, ldb, 10, 70)
+		ents, _, err := ldb.IterateEntries(nil, 0, 1, 2, 1, 101, 4096)
+		if err != nil {
+			t.Fatalf("failed to iterate entries %v", err)
+		}
+		if len(ents) != 4 {
+			t.Errorf("max size not respected, got %d entries", len(ents))
+		}
+		ldb.Close()
+		ldb = open()
+		defer ldb.Close()
+		puts := s.puts
+		if err := ldb.RemoveEntriesTo(1, 2, 80); err != nil {
+			t.Fatalf("failed to remove entries %v", err)
+		}
+		if s.puts != puts+1 {
+			t.Errorf("unexpected puts %d, %d", s.puts, puts)
+		}
+		checkEntries(t, ldb, 1, 101)
+	}
+	runArchiveTest(t, tf)
+}
+
+func TestArchivedEntriesAreRemovedWithNodeData(t *testing.T) {
+	tf := func(t *testing.T, open func() raftio.ILogDB, s *memStorage) {
+		ldb := open()
+		defer ldb.Close()
+		saveEntries(t, ldb, 1, 101)
+		if err := ldb.RemoveEntriesTo(1, 2, 60); err != nil {
+			t.Fatalf("failed to remove entries %v", err)
+		}
+		if err := ldb.RemoveNodeData(1, 2); err != nil {
+			t.Fatalf("failed to remove node data %v", err)
+		}
+		if s.count() != 0 {
+			t.Errorf("archived entries not removed")
+		}
+		ents, _, err := ldb.IterateEntries(nil, 0, 1, 2, 1, 101, math.MaxUint64)
+		if err != nil || len(ents) != 0 {
+			t.Errorf("unexpected entries %d, %v", len(ents), err)
+		}
+	}
+	runArchiveTest(t, tf)
+}
@@ -0,0 +1,53 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package badger provides factory functions for creating BadgerDB based Log DB.
+BadgerDB is a pure Go LSM key-value store, it can be used by applications that
+prefer not to depend on pebble or RocksDB.
+
+WARNING: badger support is expermental, DO NOT USE IT IN PRODUCTION.
+*/
+package badger
+
+import (
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/logdb"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+// Factory is the factory type for creating BadgerDB based LogDB.
+type Factory struct{}
+
+// Create creates BadgerDB based LogDB.
+func (bf *Factory) Create(cfg config.NodeHostConfig,
+	cb config.LogDBCallback,
+	dirs []string, lldirs []string) (raftio.ILogDB, error) {
+	return NewLogDB(cfg, cb, dirs, lldirs)
+}
+
+// Name returns the name of the LogDB instance.
+func (bf *Factory) Name() string {
+	return "sharded-badger"
+}
+
+// NewLogDB is the factory function for creating BadgerDB based Log DB
+// instances.
+func NewLogDB(cfg config.NodeHostConfig, cb config.LogDBCallback,
+	dirs []string, lldirs []string) (raftio.ILogDB, error) {
+	fs := vfs.DefaultFS
+	return logdb.NewLogDB(cfg,
+		cb, dirs, lldirs, false, false, fs, NewKVStore)
+}
@@ -0,0 +1,10 @@
+module github.com/lni/dragonboat/v3/plugin/badger
+
+go 1.14
+
+require (
+	github.com/dgraph-io/badger/v2 v2.2007.4
+	github.com/lni/dragonboat/v3 v3.3.0
+)
+
+replace github.com/lni/dragonboat/v3 => ../..
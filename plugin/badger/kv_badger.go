@@ -0,0 +1,317 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package badger
+
+// WARNING: badger support is expermental, DO NOT USE IT IN PRODUCTION.
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/options"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/logdb/kv"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/logger"
+)
+
+var (
+	plog = logger.GetLogger("badgerkv")
+)
+
+var (
+	// ErrUnsupportedFS indicates that the specified vfs.IFS is not supported.
+	// Badger always accesses the underlying file system directly, only the
+	// vfs.DefaultFS is supported.
+	ErrUnsupportedFS = errors.New("badger only supports the default fs")
+)
+
+const (
+	// the discard ratio used when garbage collecting value log files
+	gcDiscardRatio = 0.5
+)
+
+type writeOp struct {
+	key    []byte
+	val    []byte
+	delete bool
+}
+
+type badgerWriteBatch struct {
+	db  *badger.DB
+	ops []writeOp
+}
+
+func (w *badgerWriteBatch) Destroy() {
+	w.ops = nil
+}
+
+func (w *badgerWriteBatch) Put(key []byte, val []byte) {
+	w.ops = append(w.ops, writeOp{key: copyBytes(key), val: copyBytes(val)})
+}
+
+func (w *badgerWriteBatch) Delete(key []byte) {
+	w.ops = append(w.ops, writeOp{key: copyBytes(key), delete: true})
+}
+
+func (w *badgerWriteBatch) Clear() {
+	w.ops = w.ops[:0]
+}
+
+func (w *badgerWriteBatch) Count() int {
+	return len(w.ops)
+}
+
+func copyBytes(v []byte) []byte {
+	result := make([]byte, len(v))
+	copy(result, v)
+	return result
+}
+
+// NewKVStore returns a badger based IKVStore instance. The value log of badger
+// is placed in the specified wal directory when it is not empty.
+func NewKVStore(config config.LogDBConfig, callback kv.LogDBCallback,
+	dir string, wal string, fs vfs.IFS) (kv.IKVStore, error) {
+	return openBadgerDB(config, callback, dir, wal, fs)
+}
+
+// KV is a badger based IKVStore type.
+type KV struct {
+	db       *badger.DB
+	callback kv.LogDBCallback
+	config   config.LogDBConfig
+}
+
+var _ kv.IKVStore = (*KV)(nil)
+
+func openBadgerDB(config config.LogDBConfig, callback kv.LogDBCallback,
+	dir string, walDir string, fs vfs.IFS) (kv.IKVStore, error) {
+	if config.IsEmpty() {
+		panic("invalid LogDBConfig")
+	}
+	if fs != vfs.DefaultFS {
+		return nil, ErrUnsupportedFS
+	}
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		return nil, err
+	}
+	valueDir := dir
+	if len(walDir) > 0 {
+		if err := fileutil.MkdirAll(walDir, fs); err != nil {
+			return nil, err
+		}
+		valueDir = walDir
+	}
+	opts := badger.DefaultOptions(dir).
+		WithValueDir(valueDir).
+		WithSyncWrites(true).
+		WithLogger(plog).
+		WithCompression(options.None).
+		WithDetectConflicts(false).
+		WithBlockSize(int(config.KVBlockSize)).
+		WithBlockCacheSize(int64(config.KVLRUCacheSize)).
+		WithMaxTableSize(int64(config.KVWriteBufferSize)).
+		WithNumMemtables(int(config.KVMaxWriteBufferNumber)).
+		WithNumLevelZeroTables(int(config.KVLevel0FileNumCompactionTrigger)).
+		WithNumLevelZeroTablesStall(int(config.KVLevel0StopWritesTrigger)).
+		WithLevelOneSize(int64(config.KVMaxBytesForLevelBase)).
+		WithLevelSizeMultiplier(int(config.KVMaxBytesForLevelMultiplier)).
+		WithMaxLevels(int(config.KVNumOfLevels))
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &KV{db: db, callback: callback, config: config}, nil
+}
+
+// Name returns the IKVStore type name.
+func (r *KV) Name() string {
+	return "badger"
+}
+
+// Close closes the KV object.
+func (r *KV) Close() error {
+	return r.db.Close()
+}
+
+// IterateValue ...
+func (r *KV) IterateValue(fk []byte, lk []byte, inc bool,
+	op func(key []byte, data []byte) (bool, error)) error {
+	return r.db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Seek(fk); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			key := item.Key()
+			if inc {
+				if bytes.Compare(key, lk) > 0 {
+					return nil
+				}
+			} else {
+				if bytes.Compare(key, lk) >= 0 {
+					return nil
+				}
+			}
+			cont := false
+			if err := item.Value(func(val []byte) error {
+				var err error
+				cont, err = op(key, val)
+				return err
+			}); err != nil {
+				return err
+			}
+			if !cont {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// GetValue ...
+func (r *KV) GetValue(key []byte, op func([]byte) error) error {
+	return r.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return op(nil)
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(op)
+	})
+}
+
+// SaveValue ...
+func (r *KV) SaveValue(key []byte, value []byte) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+}
+
+// DeleteValue ...
+func (r *KV) DeleteValue(key []byte) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+}
+
+// GetWriteBatch ...
+func (r *KV) GetWriteBatch() kv.IWriteBatch {
+	return &badgerWriteBatch{db: r.db}
+}
+
+// CommitWriteBatch atomically writes everything included in the write batch
+// into badger using a single transaction. Badger limits the size of each
+// transaction based on KVWriteBufferSize, badger.ErrTxnTooBig is returned
+// when the write batch is too large to fit into a single transaction.
+func (r *KV) CommitWriteBatch(wb kv.IWriteBatch) error {
+	bwb, ok := wb.(*badgerWriteBatch)
+	if !ok {
+		panic("unknown type")
+	}
+	if bwb.db != r.db {
+		panic("bwb.db != r.db")
+	}
+	return r.commit(bwb.ops, false)
+}
+
+// commit writes the specified ops into badger. When split is true, ops that
+// can't fit into a single transaction are committed using multiple
+// transactions, this is only allowed when it is safe to partially apply ops.
+func (r *KV) commit(ops []writeOp, split bool) error {
+	txn := r.db.NewTransaction(true)
+	defer func() {
+		txn.Discard()
+	}()
+	for _, op := range ops {
+		err := r.apply(txn, op)
+		if err == badger.ErrTxnTooBig && split {
+			if err := txn.Commit(); err != nil {
+				return err
+			}
+			txn = r.db.NewTransaction(true)
+			err = r.apply(txn, op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+func (r *KV) apply(txn *badger.Txn, op writeOp) error {
+	if op.delete {
+		return txn.Delete(op.key)
+	}
+	return txn.Set(op.key, op.val)
+}
+
+// BulkRemoveEntries removes all keys in the range of [fk, lk).
+func (r *KV) BulkRemoveEntries(fk []byte, lk []byte) error {
+	ops := make([]writeOp, 0)
+	if err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Seek(fk); iter.Valid(); iter.Next() {
+			key := iter.Item().KeyCopy(nil)
+			if bytes.Compare(key, lk) >= 0 {
+				break
+			}
+			ops = append(ops, writeOp{key: key, delete: true})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	// removed entries are never read again, it is safe to remove them in
+	// multiple transactions
+	return r.commit(ops, true)
+}
+
+// CompactEntries reclaims disk space used by removed entries. Badger doesn't
+// support compacting a specified key range, its value log files are garbage
+// collected instead.
+func (r *KV) CompactEntries(fk []byte, lk []byte) error {
+	return r.gcValueLog()
+}
+
+// FullCompaction compacts all LSM tree levels into the last level and
+// garbage collects value log files.
+func (r *KV) FullCompaction() error {
+	if err := r.db.Flatten(1); err != nil {
+		return err
+	}
+	return r.gcValueLog()
+}
+
+func (r *KV) gcValueLog() error {
+	for {
+		if err := r.db.RunValueLogGC(gcDiscardRatio); err != nil {
+			if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/logdb"
+	"github.com/lni/dragonboat/v3/internal/logdb/kv"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+const (
+	testDir = "badger_test_dir_safe_to_delete"
+)
+
+func runKVTest(t *testing.T, tf func(t *testing.T, kvs kv.IKVStore)) {
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	cfg := config.GetDefaultLogDBConfig()
+	kvs, err := NewKVStore(cfg, nil, testDir, "", vfs.DefaultFS)
+	if err != nil {
+		t.Fatalf("failed to open kv store %v", err)
+	}
+	defer func() {
+		if err := kvs.Close(); err != nil {
+			t.Fatalf("failed to close kvs %v", err)
+		}
+	}()
+	tf(t, kvs)
+}
+
+func TestBadgerRequiresDefaultFS(t *testing.T) {
+	cfg := config.GetDefaultLogDBConfig()
+	if _, err := NewKVStore(cfg,
+		nil, testDir, "", vfs.MemStrictFS); err != ErrUnsupportedFS {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestKVGetAndSaveValue(t *testing.T) {
+	tf := func(t *testing.T, kvs kv.IKVStore) {
+		if err := kvs.SaveValue([]byte("key"), []byte("value")); err != nil {
+			t.Fatalf("failed to save value %v", err)
+		}
+		var result []byte
+		op := func(v []byte) error {
+			result = append([]byte(nil), v...)
+			return nil
+		}
+		if err := kvs.GetValue([]byte("key"), op); err != nil {
+			t.Fatalf("failed to get value %v", err)
+		}
+		if string(result) != "value" {
+			t.Errorf("unexpected value %s", result)
+		}
+		if err := kvs.DeleteValue([]byte("key")); err != nil {
+			t.Fatalf("failed to delete value %v", err)
+		}
+		result = nil
+		if err := kvs.GetValue([]byte("key"), op); err != nil {
+			t.Fatalf("failed to get value %v", err)
+		}
+		if len(result) != 0 {
+			t.Errorf("value not deleted")
+		}
+	}
+	runKVTest(t, tf)
+}
+
+func TestKVWriteBatchAndIterateValue(t *testing.T) {
+	tf := func(t *testing.T, kvs kv.IKVStore) {
+		wb := kvs.GetWriteBatch()
+		defer wb.Destroy()
+		for i := 0; i < 10; i++ {
+			k := []byte(fmt.Sprintf("key-%d", i))
+			wb.Put(k, k)
+		}
+		if wb.Count() != 10 {
+			t.Fatalf("unexpected count %d", wb.Count())
+		}
+		if err := kvs.CommitWriteBatch(wb); err != nil {
+			t.Fatalf("failed to commit write batch %v", err)
+		}
+		count := func(fk []byte, lk []byte, inc bool) int {
+			c := 0
+			op := func(key []byte, data []byte) (bool, error) {
+				if !bytes.Equal(key, data) {
+					t.Errorf("unexpected value")
+				}
+				c++
+				return true, nil
+			}
+			if err := kvs.IterateValue(fk, lk, inc, op); err != nil {
+				t.Fatalf("failed to iterate %v", err)
+			}
+			return c
+		}
+		if c := count([]byte("key-2"), []byte("key-5"), true); c != 4 {
+			t.Errorf("unexpected count %d, want 4", c)
+		}
+		if c := count([]byte("key-2"), []byte("key-5"), false); c != 3 {
+			t.Errorf("unexpected count %d, want 3", c)
+		}
+		if err := kvs.BulkRemoveEntries([]byte("key-2"),
+			[]byte("key-5")); err != nil {
+			t.Fatalf("failed to remove entries %v", err)
+		}
+		if c := count([]byte("key-0"), []byte("key-9"), true); c != 7 {
+			t.Errorf("unexpected count %d, want 7", c)
+		}
+		if err := kvs.CompactEntries([]byte("key-0"), []byte("key-9")); err != nil {
+			t.Fatalf("compaction failed %v", err)
+		}
+		if err := kvs.FullCompaction(); err != nil {
+			t.Fatalf("full compaction failed %v", err)
+		}
+		if c := count([]byte("key-0"), []byte("key-9"), true); c != 7 {
+			t.Errorf("unexpected count %d, want 7", c)
+		}
+	}
+	runKVTest(t, tf)
+}
+
+func TestTooLargeWriteBatchIsNotPartiallyCommitted(t *testing.T) {
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	cfg := config.GetDefaultLogDBConfig()
+	cfg.KVWriteBufferSize = 1024 * 1024
+	kvs, err := NewKVStore(cfg, nil, testDir, "", vfs.DefaultFS)
+	if err != nil {
+		t.Fatalf("failed to open kv store %v", err)
+	}
+	defer func() {
+		if err := kvs.Close(); err != nil {
+			t.Fatalf("failed to close kvs %v", err)
+		}
+	}()
+	wb := kvs.GetWriteBatch()
+	defer wb.Destroy()
+	for i := 0; i < 4096; i++ {
+		wb.Put([]byte(fmt.Sprintf("key-%04d", i)), make([]byte, 512))
+	}
+	if err := kvs.CommitWriteBatch(wb); err != badger.ErrTxnTooBig {
+		t.Fatalf("unexpected error %v", err)
+	}
+	op := func(key []byte, data []byte) (bool, error) {
+		t.Errorf("unexpected key %s", key)
+		return false, nil
+	}
+	if err := kvs.IterateValue([]byte("key-0000"),
+		[]byte("key-9999"), true, op); err != nil {
+		t.Fatalf("failed to iterate %v", err)
+	}
+}
+
+func TestBadgerLogDB(t *testing.T) {
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	expert := config.GetDefaultExpertConfig()
+	expert.LogDB.Shards = 2
+	cfg := config.NodeHostConfig{Expert: expert}
+	db, err := logdb.NewLogDB(cfg, nil, []string{testDir}, []string{testDir},
+		true, false, vfs.DefaultFS, NewKVStore)
+	if err != nil {
+		t.Fatalf("failed to create logdb %v", err)
+	}
+	defer db.Close()
+	ents := make([]pb.Entry, 0)
+	for i := uint64(1); i <= 100; i++ {
+		ents = append(ents, pb.Entry{Term: 1, Index: i, Cmd: make([]byte, 16)})
+	}
+	ud := pb.Update{
+		ClusterID:     1,
+		NodeID:        2,
+		State:         pb.State{Term: 1, Vote: 2, Commit: 100},
+		EntriesToSave: ents,
+	}
+	if err := db.SaveRaftState([]pb.Update{ud}, 1); err != nil {
+		t.Fatalf("failed to save raft state %v", err)
+	}
+	rs, err := db.ReadRaftState(1, 2, 0)
+	if err != nil {
+		t.Fatalf("failed to read raft state %v", err)
+	}
+	if rs.State.Commit != 100 || rs.EntryCount != 100 {
+		t.Errorf("unexpected raft state %+v", rs)
+	}
+	result, _, err := db.IterateEntries(nil, 0, 1, 2, 1, 101, 1<<30)
+	if err != nil {
+		t.Fatalf("failed to iterate entries %v", err)
+	}
+	if len(result) != 100 {
+		t.Errorf("got %d entries, want 100", len(result))
+	}
+	if err := db.RemoveEntriesTo(1, 2, 50); err != nil {
+		t.Fatalf("failed to remove entries %v", err)
+	}
+	done, err := db.CompactEntriesTo(1, 2, 50)
+	if err != nil {
+		t.Fatalf("failed to compact entries %v", err)
+	}
+	<-done
+	result, _, err = db.IterateEntries(nil, 0, 1, 2, 51, 101, 1<<30)
+	if err != nil {
+		t.Fatalf("failed to iterate entries %v", err)
+	}
+	if len(result) != 50 {
+		t.Errorf("got %d entries, want 50", len(result))
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package bbolt provides factory functions for creating bbolt based Log DB.
+
+The bbolt based Log DB is designed for embedded and edge deployments with
+small Raft logs, it has much lower memory overhead than the default pebble
+based Log DB. bbolt only allows a single writer, the Log DB created by this
+package always uses a single shard regardless of the Shards value in the
+LogDB field of config.ExpertConfig. It is not suitable for deployments with
+high write throughput requirements.
+
+WARNING: bbolt support is expermental, DO NOT USE IT IN PRODUCTION.
+*/
+package bbolt
+
+import (
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/logdb"
+	"github.com/lni/dragonboat/v3/internal/logdb/kv/bbolt"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+// Factory is the factory type for creating bbolt based LogDB.
+type Factory struct{}
+
+// Create creates bbolt based LogDB.
+func (bf *Factory) Create(cfg config.NodeHostConfig,
+	cb config.LogDBCallback,
+	dirs []string, lldirs []string) (raftio.ILogDB, error) {
+	return NewLogDB(cfg, cb, dirs, lldirs)
+}
+
+// Name returns the name of the LogDB instance.
+func (bf *Factory) Name() string {
+	return "bbolt"
+}
+
+// NewLogDB is the factory function for creating bbolt based Log DB instances.
+// The returned Log DB instance has only one shard.
+func NewLogDB(cfg config.NodeHostConfig, cb config.LogDBCallback,
+	dirs []string, lldirs []string) (raftio.ILogDB, error) {
+	cfg.Expert.LogDB.Shards = 1
+	if len(dirs) > 1 {
+		dirs = dirs[:1]
+	}
+	if len(lldirs) > 1 {
+		lldirs = lldirs[:1]
+	}
+	return logdb.NewLogDB(cfg,
+		cb, dirs, lldirs, false, false, vfs.DefaultFS, bbolt.NewKVStore)
+}
@@ -0,0 +1,414 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+/*
+Package etcdregistry implements an etcd based node registry used for resolving
+NodeHostID values into RaftAddress values. It is an alternative to the gossip
+service for deployments that already run etcd, each NodeHost publishes its
+RaftAddress to etcd as a record attached to a lease and watches records
+published by all other NodeHost instances, all NodeHost instances thus share
+a consistent view on addresses of known NodeHost instances.
+
+The etcd based node registry can be selected by enabling the
+NodeHostConfig.AddressByNodeHostID field and setting the
+NodeHostConfig.Expert.NodeRegistryFactory field to a Factory instance, the
+NodeHostConfig.Gossip field is not required in such case. Records of NodeHost
+instances that stopped or lost their connections to etcd are removed once
+their leases expire.
+
+This package is a separate Go module as the etcd client library requires a more
+recent Go release than the dragonboat module.
+*/
+package etcdregistry
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/logger"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+var (
+	plog = logger.GetLogger("etcdregistry")
+)
+
+const (
+	defaultPrefix      = "/dragonboat/nodehosts/"
+	defaultDialTimeout = 5 * time.Second
+	defaultTTL         = 10
+	retryInterval      = time.Second
+)
+
+var (
+	// ErrUnknownTarget is the error returned when the RaftAddress of the target
+	// NodeHost is unknown.
+	ErrUnknownTarget = errors.New("target address unknown")
+	// ErrNoEndpoint is the error returned when no etcd endpoint is specified.
+	ErrNoEndpoint = errors.New("no etcd endpoint specified")
+	// ErrAddressByNodeHostIDRequired is the error returned when the
+	// NodeHostConfig.AddressByNodeHostID field is not enabled.
+	ErrAddressByNodeHostIDRequired = errors.New("AddressByNodeHostID not set")
+)
+
+// Config is the configuration of the etcd based node registry.
+type Config struct {
+	// Endpoints is the list of etcd endpoints.
+	Endpoints []string
+	// Prefix is the key prefix used for records of NodeHost instances, the
+	// default value /dragonboat/nodehosts/ is used when not set. All NodeHost
+	// instances of the same deployment are required to use the same prefix.
+	Prefix string
+	// DialTimeout is the timeout for connecting to etcd, 5 seconds is used when
+	// not set.
+	DialTimeout time.Duration
+	// TTL is the TTL in seconds of the lease attached to the record of the
+	// local NodeHost, 10 seconds is used when not set. The record of a failed
+	// NodeHost is removed once its lease expires.
+	TTL int64
+	// TLS is the optional TLS config used for connecting to etcd.
+	TLS *tls.Config
+	// Username is the optional username used for authenticating with etcd.
+	Username string
+	// Password is the optional password used for authenticating with etcd.
+	Password string
+}
+
+func (c *Config) prepare() error {
+	if len(c.Endpoints) == 0 {
+		return ErrNoEndpoint
+	}
+	if len(c.Prefix) == 0 {
+		c.Prefix = defaultPrefix
+	}
+	if !strings.HasSuffix(c.Prefix, "/") {
+		c.Prefix = c.Prefix + "/"
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = defaultDialTimeout
+	}
+	if c.TTL == 0 {
+		c.TTL = defaultTTL
+	}
+	if c.DialTimeout < 0 || c.TTL < 0 {
+		return errors.New("invalid etcd registry config")
+	}
+	return nil
+}
+
+// Factory is the factory type used for creating etcd based node registries.
+type Factory struct {
+	cfg Config
+}
+
+var _ config.NodeRegistryFactory = (*Factory)(nil)
+
+// NewFactory returns a new Factory instance.
+func NewFactory(cfg Config) *Factory {
+	return &Factory{cfg: cfg}
+}
+
+// Create creates an etcd based node registry.
+func (f *Factory) Create(nhid string, nhConfig config.NodeHostConfig,
+	v config.TargetValidator) (raftio.INodeRegistry, error) {
+	return NewRegistry(nhid, nhConfig, v, f.cfg)
+}
+
+// Registry is an etcd based node registry. It keeps targets of known nodes
+// locally and resolves them into RaftAddress values using records stored in
+// etcd.
+type Registry struct {
+	nhid     string
+	address  string
+	prefix   string
+	ttl      int64
+	client   *clientv3.Client
+	validate config.TargetValidator
+	targets  sync.Map // map of raftio.NodeInfo => string
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	mu       struct {
+		sync.Mutex
+		lease clientv3.LeaseID
+		addrs map[string]string
+	}
+}
+
+var _ raftio.INodeRegistry = (*Registry)(nil)
+
+// NewRegistry creates a new etcd based node registry. It publishes the
+// RaftAddress of the local NodeHost and starts watching records of other
+// NodeHost instances.
+func NewRegistry(nhid string, nhConfig config.NodeHostConfig,
+	v config.TargetValidator, cfg Config) (*Registry, error) {
+	if !nhConfig.AddressByNodeHostID {
+		return nil, ErrAddressByNodeHostIDRequired
+	}
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   cfg.Endpoints,
+		DialTimeout: cfg.DialTimeout,
+		TLS:         cfg.TLS,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := &Registry{
+		nhid:     nhid,
+		address:  nhConfig.RaftAddress,
+		prefix:   cfg.Prefix,
+		ttl:      cfg.TTL,
+		client:   client,
+		validate: v,
+	}
+	r.mu.addrs = make(map[string]string)
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	ch, err := r.register(ctx)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	rev, err := r.load(ctx)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	r.wg.Add(2)
+	go r.keepAlive(ctx, ch)
+	go r.watch(ctx, rev)
+	return r, nil
+}
+
+// Stop stops the registry and removes the record of the local NodeHost.
+func (r *Registry) Stop() {
+	r.cancel()
+	r.wg.Wait()
+	r.mu.Lock()
+	lease := r.mu.lease
+	r.mu.Unlock()
+	if lease != clientv3.NoLease {
+		ctx, cancel := context.WithTimeout(context.Background(), retryInterval)
+		if _, err := r.client.Revoke(ctx, lease); err != nil {
+			plog.Warningf("failed to revoke lease, %v", err)
+		}
+		cancel()
+	}
+	r.close()
+}
+
+// Add adds the specified node and its NodeHostID to the registry.
+func (r *Registry) Add(clusterID uint64, nodeID uint64, target string) {
+	if r.validate != nil && !r.validate(target) {
+		plog.Panicf("invalid target %s", target)
+	}
+	key := raftio.GetNodeInfo(clusterID, nodeID)
+	v, ok := r.targets.LoadOrStore(key, target)
+	if ok && v.(string) != target {
+		plog.Panicf("inconsistent target for cluster %d node %d, %s:%s",
+			clusterID, nodeID, v, target)
+	}
+}
+
+// Remove removes the specified node from the registry.
+func (r *Registry) Remove(clusterID uint64, nodeID uint64) {
+	r.targets.Delete(raftio.GetNodeInfo(clusterID, nodeID))
+}
+
+// RemoveCluster removes all nodes of the specified cluster from the registry.
+func (r *Registry) RemoveCluster(clusterID uint64) {
+	var toRemove []raftio.NodeInfo
+	r.targets.Range(func(k, v interface{}) bool {
+		if ni := k.(raftio.NodeInfo); ni.ClusterID == clusterID {
+			toRemove = append(toRemove, ni)
+		}
+		return true
+	})
+	for _, v := range toRemove {
+		r.targets.Delete(v)
+	}
+}
+
+// Resolve returns the current RaftAddress and connection key of the specified
+// node. It returns ErrUnknownTarget when the RaftAddress is unknown.
+func (r *Registry) Resolve(clusterID uint64,
+	nodeID uint64) (string, string, error) {
+	target, ok := r.targets.Load(raftio.GetNodeInfo(clusterID, nodeID))
+	if !ok {
+		return "", "", ErrUnknownTarget
+	}
+	addr, ok := r.getRaftAddress(target.(string))
+	if !ok {
+		return "", "", ErrUnknownTarget
+	}
+	return addr, addr, nil
+}
+
+// NumMembers returns the number of NodeHost instances with known RaftAddress
+// values, including the local NodeHost.
+func (r *Registry) NumMembers() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.mu.addrs[r.nhid]; ok {
+		return len(r.mu.addrs)
+	}
+	return len(r.mu.addrs) + 1
+}
+
+func (r *Registry) getRaftAddress(nhid string) (string, bool) {
+	if nhid == r.nhid {
+		return r.address, true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addr, ok := r.mu.addrs[nhid]
+	return addr, ok
+}
+
+func (r *Registry) close() {
+	if err := r.client.Close(); err != nil {
+		plog.Warningf("failed to close etcd client, %v", err)
+	}
+}
+
+func (r *Registry) key() string {
+	return r.prefix + r.nhid
+}
+
+// register publishes the record of the local NodeHost using a new lease, it
+// returns the keepalive channel of the lease.
+func (r *Registry) register(
+	ctx context.Context) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	lease, err := r.client.Grant(ctx, r.ttl)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.client.Put(ctx,
+		r.key(), r.address, clientv3.WithLease(lease.ID))
+	if err != nil {
+		return nil, err
+	}
+	ch, err := r.client.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.mu.lease = lease.ID
+	r.mu.Unlock()
+	return ch, nil
+}
+
+// load replaces all known records with those currently stored in etcd, it
+// returns the etcd revision of the loaded records.
+func (r *Registry) load(ctx context.Context) (int64, error) {
+	resp, err := r.client.Get(ctx, r.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	addrs := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		addrs[strings.TrimPrefix(string(kv.Key), r.prefix)] = string(kv.Value)
+	}
+	r.mu.Lock()
+	r.mu.addrs = addrs
+	r.mu.Unlock()
+	return resp.Header.Revision, nil
+}
+
+func (r *Registry) apply(ev *clientv3.Event) {
+	nhid := strings.TrimPrefix(string(ev.Kv.Key), r.prefix)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch ev.Type {
+	case mvccpb.PUT:
+		r.mu.addrs[nhid] = string(ev.Kv.Value)
+	case mvccpb.DELETE:
+		delete(r.mu.addrs, nhid)
+	}
+}
+
+// keepAlive keeps the lease of the local record alive. The record is
+// published again using a new lease when the lease is lost, e.g. after being
+// disconnected from etcd for longer than the TTL.
+func (r *Registry) keepAlive(ctx context.Context,
+	ch <-chan *clientv3.LeaseKeepAliveResponse) {
+	defer r.wg.Done()
+	for {
+		for range ch {
+		}
+		for {
+			if !r.wait(ctx) {
+				return
+			}
+			var err error
+			if ch, err = r.register(ctx); err == nil {
+				break
+			}
+			plog.Warningf("failed to register %s, %v", r.nhid, err)
+		}
+	}
+}
+
+// watch applies changes made to records of NodeHost instances. All records
+// are reloaded when the watch fails, e.g. after the watched revision has been
+// compacted.
+func (r *Registry) watch(ctx context.Context, rev int64) {
+	defer r.wg.Done()
+	for {
+		wctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+		wch := r.client.Watch(wctx, r.prefix,
+			clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+		for resp := range wch {
+			if err := resp.Err(); err != nil {
+				plog.Warningf("watch failed, %v", err)
+				break
+			}
+			for _, ev := range resp.Events {
+				r.apply(ev)
+			}
+			rev = resp.Header.Revision
+		}
+		cancel()
+		for {
+			if !r.wait(ctx) {
+				return
+			}
+			var err error
+			if rev, err = r.load(ctx); err == nil {
+				break
+			}
+			plog.Warningf("failed to load records, %v", err)
+		}
+	}
+}
+
+func (r *Registry) wait(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(retryInterval):
+		return true
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdregistry
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/server/v3/embed"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+const (
+	clientURL = "http://localhost:26401"
+	peerURL   = "http://localhost:26402"
+)
+
+func runEtcd(t *testing.T) *embed.Etcd {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	cu, _ := url.Parse(clientURL)
+	pu, _ := url.Parse(peerURL)
+	cfg.ListenClientUrls = []url.URL{*cu}
+	cfg.AdvertiseClientUrls = []url.URL{*cu}
+	cfg.ListenPeerUrls = []url.URL{*pu}
+	cfg.AdvertisePeerUrls = []url.URL{*pu}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("failed to start etcd, %v", err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		t.Fatalf("etcd not ready")
+	}
+	t.Cleanup(e.Close)
+	return e
+}
+
+func getTestConfig() Config {
+	return Config{
+		Endpoints: []string{clientURL},
+		Prefix:    "/test/nodehosts",
+		TTL:       5,
+	}
+}
+
+func getTestRegistry(t *testing.T, nhid string, addr string) *Registry {
+	nhConfig := config.NodeHostConfig{
+		RaftAddress:         addr,
+		AddressByNodeHostID: true,
+	}
+	r, err := NewRegistry(nhid, nhConfig, nil, getTestConfig())
+	if err != nil {
+		t.Fatalf("failed to create registry, %v", err)
+	}
+	return r
+}
+
+func waitForAddress(t *testing.T, r *Registry,
+	clusterID uint64, nodeID uint64, expected string) {
+	for i := 0; i < 100; i++ {
+		addr, _, err := r.Resolve(clusterID, nodeID)
+		if expected == "" && err == ErrUnknownTarget {
+			return
+		}
+		if err == nil && addr == expected {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("failed to resolve %s", expected)
+}
+
+func TestRegistryRequiresAddressByNodeHostID(t *testing.T) {
+	nhConfig := config.NodeHostConfig{RaftAddress: "localhost:26001"}
+	if _, err := NewRegistry("nh1",
+		nhConfig, nil, getTestConfig()); err != ErrAddressByNodeHostIDRequired {
+		t.Errorf("unexpected err %v", err)
+	}
+	nhConfig.AddressByNodeHostID = true
+	if _, err := NewRegistry("nh1", nhConfig, nil, Config{}); err != ErrNoEndpoint {
+		t.Errorf("unexpected err %v", err)
+	}
+}
+
+func TestConfigDefaultsAreApplied(t *testing.T) {
+	cfg := Config{Endpoints: []string{clientURL}, Prefix: "/p"}
+	if err := cfg.prepare(); err != nil {
+		t.Fatalf("prepare failed, %v", err)
+	}
+	if cfg.Prefix != "/p/" {
+		t.Errorf("unexpected prefix %s", cfg.Prefix)
+	}
+	if cfg.TTL != defaultTTL || cfg.DialTimeout != defaultDialTimeout {
+		t.Errorf("defaults not applied")
+	}
+	cfg.TTL = -1
+	if err := cfg.prepare(); err == nil {
+		t.Errorf("negative TTL not rejected")
+	}
+}
+
+func TestRegistryResolvesNodeHostIDs(t *testing.T) {
+	runEtcd(t)
+	r1 := getTestRegistry(t, "nh1", "localhost:26001")
+	defer r1.Stop()
+	r2 := getTestRegistry(t, "nh2", "localhost:26002")
+	defer r2.Stop()
+	for _, r := range []*Registry{r1, r2} {
+		r.Add(1, 1, "nh1")
+		r.Add(1, 2, "nh2")
+		waitForAddress(t, r, 1, 1, "localhost:26001")
+		waitForAddress(t, r, 1, 2, "localhost:26002")
+		if n := r.NumMembers(); n != 2 {
+			t.Errorf("num of members %d, want 2", n)
+		}
+	}
+	r1.Remove(1, 2)
+	if _, _, err := r1.Resolve(1, 2); err != ErrUnknownTarget {
+		t.Errorf("removed node resolved, %v", err)
+	}
+	r2.RemoveCluster(1)
+	if _, _, err := r2.Resolve(1, 1); err != ErrUnknownTarget {
+		t.Errorf("removed cluster resolved, %v", err)
+	}
+}
+
+func TestStoppedNodeHostIsRemoved(t *testing.T) {
+	runEtcd(t)
+	r1 := getTestRegistry(t, "nh1", "localhost:26001")
+	defer r1.Stop()
+	r2 := getTestRegistry(t, "nh2", "localhost:26002")
+	r1.Add(1, 2, "nh2")
+	waitForAddress(t, r1, 1, 2, "localhost:26002")
+	r2.Stop()
+	waitForAddress(t, r1, 1, 2, "")
+}
+
+func TestAddressChangeIsObserved(t *testing.T) {
+	runEtcd(t)
+	r1 := getTestRegistry(t, "nh1", "localhost:26001")
+	defer r1.Stop()
+	r2 := getTestRegistry(t, "nh2", "localhost:26002")
+	r1.Add(1, 2, "nh2")
+	waitForAddress(t, r1, 1, 2, "localhost:26002")
+	r2.Stop()
+	r2 = getTestRegistry(t, "nh2", "localhost:26003")
+	defer r2.Stop()
+	waitForAddress(t, r1, 1, 2, "localhost:26003")
+}
+
+func TestLostRecordIsPublishedAgain(t *testing.T) {
+	runEtcd(t)
+	r1 := getTestRegistry(t, "nh1", "localhost:26001")
+	defer r1.Stop()
+	r2 := getTestRegistry(t, "nh2", "localhost:26002")
+	defer r2.Stop()
+	r1.Add(1, 2, "nh2")
+	waitForAddress(t, r1, 1, 2, "localhost:26002")
+	r2.mu.Lock()
+	lease := r2.mu.lease
+	r2.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := r2.client.Revoke(ctx, lease); err != nil {
+		t.Fatalf("failed to revoke lease, %v", err)
+	}
+	waitForAddress(t, r1, 1, 2, "")
+	waitForAddress(t, r1, 1, 2, "localhost:26002")
+}
@@ -0,0 +1,24 @@
+module github.com/lni/dragonboat/v3/plugin/fileregistry
+
+go 1.22
+
+require github.com/lni/dragonboat/v3 v3.3.0
+
+require (
+	github.com/cockroachdb/errors v1.7.5 // indirect
+	github.com/cockroachdb/logtags v0.0.0-20190617123548-eb05cc24525f // indirect
+	github.com/cockroachdb/pebble v0.0.0-20201228155439-c3ef93f9a9ed // indirect
+	github.com/cockroachdb/redact v1.0.6 // indirect
+	github.com/cockroachdb/sentry-go v0.6.1-cockroachdb.2 // indirect
+	github.com/gogo/protobuf v1.3.1 // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/kr/pretty v0.1.0 // indirect
+	github.com/kr/text v0.1.0 // indirect
+	github.com/lni/goutils v1.3.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/sys v0.0.0-20200923182605-d9f96fdee20d // indirect
+	google.golang.org/protobuf v1.25.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+replace github.com/lni/dragonboat/v3 => ../..
@@ -0,0 +1,318 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+/*
+Package fileregistry implements a file based node registry used for resolving
+NodeHostID values into RaftAddress values. It is intended for deployments that
+manage addresses using configuration management tools instead of the gossip
+service.
+
+The file maps NodeHostID values to RaftAddress values, it can be in either
+YAML or JSON format, e.g.
+
+	nhid-123: 10.0.0.1:26001
+	nhid-456: 10.0.0.2:26001
+
+or
+
+	{"nhid-123": "10.0.0.1:26001", "nhid-456": "10.0.0.2:26001"}
+
+The file is periodically checked and reloaded once its content is changed, so
+addresses can be updated without restarting NodeHost instances. A file that
+can not be parsed or contains invalid addresses is ignored with the previously
+loaded addresses kept in use. The local NodeHost is always resolved to its own
+RaftAddress, it is not required to be included in the file.
+
+The file based node registry can be selected by enabling the
+NodeHostConfig.AddressByNodeHostID field and setting the
+NodeHostConfig.Expert.NodeRegistryFactory field to a Factory instance, the
+NodeHostConfig.Gossip field is not required in such case.
+
+This package is a separate Go module so the dragonboat module doesn't depend
+on the YAML library.
+*/
+package fileregistry
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/logger"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+var (
+	plog = logger.GetLogger("fileregistry")
+)
+
+const (
+	defaultReloadInterval = time.Second
+)
+
+var (
+	// ErrUnknownTarget is the error returned when the RaftAddress of the target
+	// NodeHost is unknown.
+	ErrUnknownTarget = errors.New("target address unknown")
+	// ErrAddressByNodeHostIDRequired is the error returned when the
+	// NodeHostConfig.AddressByNodeHostID field is not enabled.
+	ErrAddressByNodeHostIDRequired = errors.New("AddressByNodeHostID not set")
+	// ErrNoPath is the error returned when the path of the file is not
+	// specified.
+	ErrNoPath = errors.New("registry file path not specified")
+)
+
+// Config is the configuration of the file based node registry.
+type Config struct {
+	// Path is the path of the YAML or JSON file mapping NodeHostID values to
+	// RaftAddress values.
+	Path string
+	// ReloadInterval is the interval between two checks on whether the file
+	// has been changed, 1 second is used when not set.
+	ReloadInterval time.Duration
+}
+
+func (c *Config) prepare() error {
+	if len(c.Path) == 0 {
+		return ErrNoPath
+	}
+	if c.ReloadInterval == 0 {
+		c.ReloadInterval = defaultReloadInterval
+	}
+	if c.ReloadInterval < 0 {
+		return errors.New("invalid ReloadInterval")
+	}
+	return nil
+}
+
+// Factory is the factory type used for creating file based node registries.
+type Factory struct {
+	cfg Config
+}
+
+var _ config.NodeRegistryFactory = (*Factory)(nil)
+
+// NewFactory returns a new Factory instance.
+func NewFactory(cfg Config) *Factory {
+	return &Factory{cfg: cfg}
+}
+
+// Create creates a file based node registry.
+func (f *Factory) Create(nhid string, nhConfig config.NodeHostConfig,
+	v config.TargetValidator) (raftio.INodeRegistry, error) {
+	return NewRegistry(nhid, nhConfig, v, f.cfg)
+}
+
+// Registry is a file based node registry. It keeps targets of known nodes
+// locally and resolves them into RaftAddress values using the loaded file.
+type Registry struct {
+	nhid        string
+	address     string
+	path        string
+	validate    config.TargetValidator
+	validAddr   config.RaftAddressValidator
+	targets     sync.Map // map of raftio.NodeInfo => string
+	stopc       chan struct{}
+	wg          sync.WaitGroup
+	reloadMu    sync.Mutex
+	lastContent []byte
+	mu          struct {
+		sync.Mutex
+		addrs map[string]string
+	}
+}
+
+var _ raftio.INodeRegistry = (*Registry)(nil)
+
+// NewRegistry creates a new file based node registry. The file is loaded
+// before NewRegistry returns and is then periodically checked for changes.
+func NewRegistry(nhid string, nhConfig config.NodeHostConfig,
+	v config.TargetValidator, cfg Config) (*Registry, error) {
+	if !nhConfig.AddressByNodeHostID {
+		return nil, ErrAddressByNodeHostIDRequired
+	}
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+	r := &Registry{
+		nhid:      nhid,
+		address:   nhConfig.RaftAddress,
+		path:      cfg.Path,
+		validate:  v,
+		validAddr: nhConfig.GetRaftAddressValidator(),
+		stopc:     make(chan struct{}),
+	}
+	r.mu.addrs = make(map[string]string)
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(cfg.ReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Reload(); err != nil {
+					plog.Errorf("failed to reload %s, %v", r.path, err)
+				}
+			case <-r.stopc:
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+// Stop stops checking the file for changes.
+func (r *Registry) Stop() {
+	close(r.stopc)
+	r.wg.Wait()
+}
+
+// Reload loads the file again when its content has been changed since the
+// last successful load. Previously loaded addresses are kept when the file
+// can not be read, parsed or contains invalid addresses.
+func (r *Registry) Reload() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	if r.lastContent != nil && bytes.Equal(data, r.lastContent) {
+		return nil
+	}
+	addrs, err := r.parse(data)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	previous := r.mu.addrs
+	r.mu.addrs = addrs
+	r.mu.Unlock()
+	r.lastContent = data
+	added, removed, changed := diff(previous, addrs)
+	plog.Infof("loaded %d NodeHost addresses from %s, %d added, %d removed, "+
+		"%d changed", len(addrs), r.path, added, removed, changed)
+	return nil
+}
+
+func (r *Registry) parse(data []byte) (map[string]string, error) {
+	addrs := make(map[string]string)
+	if err := yaml.Unmarshal(data, &addrs); err != nil {
+		return nil, err
+	}
+	for nhid, addr := range addrs {
+		if len(nhid) == 0 {
+			return nil, errors.New("empty NodeHostID")
+		}
+		if r.validAddr != nil && !r.validAddr(addr) {
+			return nil, fmt.Errorf("invalid address %s for %s", addr, nhid)
+		}
+	}
+	return addrs, nil
+}
+
+func diff(previous map[string]string,
+	current map[string]string) (int, int, int) {
+	added, removed, changed := 0, 0, 0
+	for nhid, addr := range current {
+		if v, ok := previous[nhid]; !ok {
+			added++
+		} else if v != addr {
+			changed++
+		}
+	}
+	for nhid := range previous {
+		if _, ok := current[nhid]; !ok {
+			removed++
+		}
+	}
+	return added, removed, changed
+}
+
+// Add adds the specified node and its NodeHostID to the registry.
+func (r *Registry) Add(clusterID uint64, nodeID uint64, target string) {
+	if r.validate != nil && !r.validate(target) {
+		plog.Panicf("invalid target %s", target)
+	}
+	key := raftio.GetNodeInfo(clusterID, nodeID)
+	v, ok := r.targets.LoadOrStore(key, target)
+	if ok && v.(string) != target {
+		plog.Panicf("inconsistent target for cluster %d node %d, %s:%s",
+			clusterID, nodeID, v, target)
+	}
+}
+
+// Remove removes the specified node from the registry.
+func (r *Registry) Remove(clusterID uint64, nodeID uint64) {
+	r.targets.Delete(raftio.GetNodeInfo(clusterID, nodeID))
+}
+
+// RemoveCluster removes all nodes of the specified cluster from the registry.
+func (r *Registry) RemoveCluster(clusterID uint64) {
+	var toRemove []raftio.NodeInfo
+	r.targets.Range(func(k, v interface{}) bool {
+		if ni := k.(raftio.NodeInfo); ni.ClusterID == clusterID {
+			toRemove = append(toRemove, ni)
+		}
+		return true
+	})
+	for _, v := range toRemove {
+		r.targets.Delete(v)
+	}
+}
+
+// Resolve returns the current RaftAddress and connection key of the specified
+// node. It returns ErrUnknownTarget when the RaftAddress is unknown.
+func (r *Registry) Resolve(clusterID uint64,
+	nodeID uint64) (string, string, error) {
+	target, ok := r.targets.Load(raftio.GetNodeInfo(clusterID, nodeID))
+	if !ok {
+		return "", "", ErrUnknownTarget
+	}
+	addr, ok := r.getRaftAddress(target.(string))
+	if !ok {
+		return "", "", ErrUnknownTarget
+	}
+	return addr, addr, nil
+}
+
+// NumMembers returns the number of NodeHost instances with known RaftAddress
+// values, including the local NodeHost.
+func (r *Registry) NumMembers() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.mu.addrs[r.nhid]; ok {
+		return len(r.mu.addrs)
+	}
+	return len(r.mu.addrs) + 1
+}
+
+func (r *Registry) getRaftAddress(nhid string) (string, bool) {
+	if nhid == r.nhid {
+		return r.address, true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addr, ok := r.mu.addrs[nhid]
+	return addr, ok
+}
@@ -0,0 +1,154 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileregistry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+func writeFile(t *testing.T, fp string, content string) {
+	tmp := fp + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write file, %v", err)
+	}
+	if err := os.Rename(tmp, fp); err != nil {
+		t.Fatalf("failed to rename file, %v", err)
+	}
+}
+
+func getTestRegistry(t *testing.T, fp string) *Registry {
+	nhConfig := config.NodeHostConfig{
+		RaftAddress:         "localhost:26001",
+		AddressByNodeHostID: true,
+	}
+	cfg := Config{Path: fp, ReloadInterval: 10 * time.Millisecond}
+	r, err := NewRegistry("nh1", nhConfig, nil, cfg)
+	if err != nil {
+		t.Fatalf("failed to create registry, %v", err)
+	}
+	return r
+}
+
+func waitForAddress(t *testing.T, r *Registry,
+	clusterID uint64, nodeID uint64, expected string) {
+	for i := 0; i < 100; i++ {
+		addr, _, err := r.Resolve(clusterID, nodeID)
+		if expected == "" && err == ErrUnknownTarget {
+			return
+		}
+		if err == nil && addr == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("failed to resolve %s", expected)
+}
+
+func TestRegistryRequiresConfig(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "nodehosts.yaml")
+	nhConfig := config.NodeHostConfig{RaftAddress: "localhost:26001"}
+	if _, err := NewRegistry("nh1",
+		nhConfig, nil, Config{Path: fp}); err != ErrAddressByNodeHostIDRequired {
+		t.Errorf("unexpected err %v", err)
+	}
+	nhConfig.AddressByNodeHostID = true
+	if _, err := NewRegistry("nh1", nhConfig, nil, Config{}); err != ErrNoPath {
+		t.Errorf("unexpected err %v", err)
+	}
+	if _, err := NewRegistry("nh1", nhConfig, nil, Config{Path: fp}); err == nil {
+		t.Errorf("missing file not reported")
+	}
+	writeFile(t, fp, "nh2: bad-address\n")
+	if _, err := NewRegistry("nh1", nhConfig, nil, Config{Path: fp}); err == nil {
+		t.Errorf("invalid address not reported")
+	}
+}
+
+func TestRegistryCanLoadYAMLAndJSON(t *testing.T) {
+	tests := []string{
+		"nh2: 10.0.0.2:26001\nnh3: 10.0.0.3:26001\n",
+		`{"nh2": "10.0.0.2:26001", "nh3": "10.0.0.3:26001"}`,
+	}
+	for _, content := range tests {
+		fp := filepath.Join(t.TempDir(), "nodehosts")
+		writeFile(t, fp, content)
+		r := getTestRegistry(t, fp)
+		r.Add(1, 1, "nh1")
+		r.Add(1, 2, "nh2")
+		r.Add(1, 3, "nh3")
+		r.Add(1, 4, "nh4")
+		waitForAddress(t, r, 1, 1, "localhost:26001")
+		waitForAddress(t, r, 1, 2, "10.0.0.2:26001")
+		waitForAddress(t, r, 1, 3, "10.0.0.3:26001")
+		waitForAddress(t, r, 1, 4, "")
+		if n := r.NumMembers(); n != 3 {
+			t.Errorf("num of members %d, want 3", n)
+		}
+		r.RemoveCluster(1)
+		waitForAddress(t, r, 1, 2, "")
+		r.Stop()
+	}
+}
+
+func TestChangedFileIsReloaded(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "nodehosts.yaml")
+	writeFile(t, fp, "nh2: 10.0.0.2:26001\n")
+	r := getTestRegistry(t, fp)
+	defer r.Stop()
+	r.Add(1, 2, "nh2")
+	r.Add(1, 3, "nh3")
+	waitForAddress(t, r, 1, 2, "10.0.0.2:26001")
+	writeFile(t, fp, "nh2: 10.0.0.5:26001\nnh3: 10.0.0.3:26001\n")
+	waitForAddress(t, r, 1, 2, "10.0.0.5:26001")
+	waitForAddress(t, r, 1, 3, "10.0.0.3:26001")
+	writeFile(t, fp, "nh3: 10.0.0.3:26001\n")
+	waitForAddress(t, r, 1, 2, "")
+}
+
+func TestInvalidFileIsIgnored(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "nodehosts.yaml")
+	writeFile(t, fp, "nh2: 10.0.0.2:26001\n")
+	r := getTestRegistry(t, fp)
+	defer r.Stop()
+	r.Add(1, 2, "nh2")
+	for _, content := range []string{"nh2: [", "nh2: 10.0.0.9\n"} {
+		writeFile(t, fp, content)
+		if err := r.Reload(); err == nil {
+			t.Errorf("invalid content %q not reported", content)
+		}
+		waitForAddress(t, r, 1, 2, "10.0.0.2:26001")
+	}
+	if err := os.Remove(fp); err != nil {
+		t.Fatalf("failed to remove file, %v", err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Errorf("missing file not reported")
+	}
+	waitForAddress(t, r, 1, 2, "10.0.0.2:26001")
+}
+
+func TestDiff(t *testing.T) {
+	previous := map[string]string{"a": "1", "b": "2", "c": "3"}
+	current := map[string]string{"b": "2", "c": "4", "d": "5", "e": "6"}
+	added, removed, changed := diff(previous, current)
+	if added != 2 || removed != 1 || changed != 1 {
+		t.Errorf("unexpected diff %d, %d, %d", added, removed, changed)
+	}
+}
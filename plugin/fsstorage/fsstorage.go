@@ -0,0 +1,123 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package fsstorage provides a filesystem based raftio.ISnapshotStorage
+implementation. Objects are stored as regular files under the specified
+directory, it is typically a mounted network filesystem shared by NodeHost
+instances, e.g. NFS or a FUSE mounted object storage bucket.
+*/
+package fsstorage
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+const (
+	tmpSuffix = ".tmp"
+)
+
+type snapshotStorage struct {
+	dir string
+	fs  vfs.IFS
+}
+
+var _ raftio.ISnapshotStorage = (*snapshotStorage)(nil)
+
+// NewSnapshotStorage creates a raftio.ISnapshotStorage instance that stores
+// snapshot files under the specified directory.
+func NewSnapshotStorage(dir string) raftio.ISnapshotStorage {
+	return newSnapshotStorage(dir, vfs.DefaultFS)
+}
+
+func newSnapshotStorage(dir string, fs vfs.IFS) *snapshotStorage {
+	return &snapshotStorage{dir: dir, fs: fs}
+}
+
+func (s *snapshotStorage) Name() string {
+	return "fsstorage"
+}
+
+func (s *snapshotStorage) Put(ctx context.Context,
+	key string, r io.Reader) (err error) {
+	fp := s.path(key)
+	if err := fileutil.MkdirAll(s.fs.PathDir(fp), s.fs); err != nil {
+		return err
+	}
+	tmp := fp + tmpSuffix
+	f, err := s.fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(tmp, fp); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(s.fs.PathDir(fp), s.fs)
+}
+
+func (s *snapshotStorage) Get(ctx context.Context,
+	key string, w io.Writer) (err error) {
+	f, err := s.fs.Open(s.path(key))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (s *snapshotStorage) Delete(ctx context.Context, key string) error {
+	fp := s.path(key)
+	if err := s.fs.RemoveAll(fp); err != nil {
+		return err
+	}
+	dir := s.fs.PathDir(fp)
+	// removes the parent directory once it becomes empty
+	files, err := s.fs.List(dir)
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(files) == 0 {
+		return s.fs.RemoveAll(dir)
+	}
+	return nil
+}
+
+func (s *snapshotStorage) path(key string) string {
+	return s.fs.PathJoin(s.dir, filepath.FromSlash(key))
+}
@@ -0,0 +1,59 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fsstorage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+)
+
+const (
+	testDir = "fsstorage_test_dir_safe_to_delete"
+)
+
+func TestObjectsCanBeStoredAndRemoved(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(testDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	s := newSnapshotStorage(testDir, fs)
+	ctx := context.Background()
+	key := "1/2/snapshot-0000000000000064/snapshot-0000000000000064.gbsnap"
+	data := []byte("snapshot-data")
+	if err := s.Put(ctx, key, bytes.NewReader(data)); err != nil {
+		t.Fatalf("put failed %v", err)
+	}
+	var buf bytes.Buffer
+	if err := s.Get(ctx, key, &buf); err != nil {
+		t.Fatalf("get failed %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("unexpected content %s", buf.Bytes())
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatalf("delete failed %v", err)
+	}
+	if err := s.Get(ctx, key, &buf); err == nil {
+		t.Errorf("object not deleted")
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Errorf("deleting missing object failed %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+module github.com/lni/dragonboat/v3/plugin/grpcsm
+
+go 1.14
+
+require (
+	github.com/golang/protobuf v1.4.3
+	github.com/lni/dragonboat/v3 v3.3.0
+	google.golang.org/grpc v1.35.0
+	google.golang.org/protobuf v1.25.0
+)
+
+replace github.com/lni/dragonboat/v3 => ../..
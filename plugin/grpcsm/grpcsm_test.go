@@ -0,0 +1,166 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcsm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+type testSM struct {
+	count uint64
+}
+
+func (s *testSM) Update(data []byte) (sm.Result, error) {
+	s.count++
+	return sm.Result{Value: s.count, Data: data}, nil
+}
+
+func (s *testSM) Lookup(query interface{}) (interface{}, error) {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, s.count)
+	return append(data, query.([]byte)...), nil
+}
+
+func (s *testSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, s.count)
+	// large enough to be sent in multiple chunks
+	_, err := w.Write(append(data, make([]byte, 3*chunkSize)...))
+	return err
+}
+
+func (s *testSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) != 8+3*chunkSize {
+		return io.ErrUnexpectedEOF
+	}
+	s.count = binary.LittleEndian.Uint64(data)
+	return nil
+}
+
+func (s *testSM) Close() error { return nil }
+
+func runGRPCSMTest(t *testing.T,
+	tf func(t *testing.T, create sm.CreateStateMachineFunc, srv *Server)) {
+	lis := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	srv := NewServer(func(uint64, uint64) sm.IStateMachine {
+		return &testSM{}
+	})
+	RegisterStateMachineServer(gs, srv)
+	go func() {
+		if err := gs.Serve(lis); err != nil {
+			panic(err)
+		}
+	}()
+	defer gs.Stop()
+	dialer := func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}
+	cc, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(dialer), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("failed to dial %v", err)
+	}
+	defer cc.Close()
+	tf(t, NewStateMachineFactory(cc), srv)
+}
+
+func TestUpdateAndLookupAreForwarded(t *testing.T) {
+	tf := func(t *testing.T, create sm.CreateStateMachineFunc, srv *Server) {
+		s := create(1, 1)
+		for i := uint64(1); i <= 3; i++ {
+			result, err := s.Update([]byte("cmd"))
+			if err != nil {
+				t.Fatalf("update failed %v", err)
+			}
+			if result.Value != i || string(result.Data) != "cmd" {
+				t.Errorf("unexpected result %v", result)
+			}
+		}
+		v, err := s.Lookup([]byte("q"))
+		if err != nil {
+			t.Fatalf("lookup failed %v", err)
+		}
+		result := v.([]byte)
+		if binary.LittleEndian.Uint64(result) != 3 || string(result[8:]) != "q" {
+			t.Errorf("unexpected lookup result %v", result)
+		}
+		if _, err := s.Lookup("q"); err != ErrInvalidQuery {
+			t.Errorf("unexpected error %v", err)
+		}
+		// state machines of different nodes are independent
+		result2, err := create(1, 2).Update([]byte("cmd"))
+		if err != nil {
+			t.Fatalf("update failed %v", err)
+		}
+		if result2.Value != 1 {
+			t.Errorf("unexpected result %v", result2)
+		}
+	}
+	runGRPCSMTest(t, tf)
+}
+
+func TestSnapshotCanBeSavedAndRecovered(t *testing.T) {
+	tf := func(t *testing.T, create sm.CreateStateMachineFunc, srv *Server) {
+		s1 := create(1, 1)
+		for i := 0; i < 5; i++ {
+			if _, err := s1.Update([]byte("cmd")); err != nil {
+				t.Fatalf("update failed %v", err)
+			}
+		}
+		var buf bytes.Buffer
+		done := make(chan struct{})
+		if err := s1.SaveSnapshot(&buf, nil, done); err != nil {
+			t.Fatalf("failed to save snapshot %v", err)
+		}
+		s2 := create(1, 2)
+		if err := s2.RecoverFromSnapshot(&buf, nil, done); err != nil {
+			t.Fatalf("failed to recover from snapshot %v", err)
+		}
+		result, err := s2.Update([]byte("cmd"))
+		if err != nil {
+			t.Fatalf("update failed %v", err)
+		}
+		if result.Value != 6 {
+			t.Errorf("recovered count %d, want 5", result.Value-1)
+		}
+		if err := s2.Close(); err != nil {
+			t.Fatalf("close failed %v", err)
+		}
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if len(srv.machines) != 1 {
+			t.Errorf("closed state machine not removed")
+		}
+	}
+	runGRPCSMTest(t, tf)
+}
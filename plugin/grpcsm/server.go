@@ -0,0 +1,164 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcsm
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+type nodeKey struct {
+	clusterID uint64
+	nodeID    uint64
+}
+
+// Server is a StateMachineServer implementation that hosts sm.IStateMachine
+// instances, it is used for implementing external processes hosting state
+// machines written in Go. State machine instances are created on demand using
+// the specified factory function and removed once closed.
+type Server struct {
+	mu       sync.Mutex
+	create   sm.CreateStateMachineFunc
+	machines map[nodeKey]sm.IStateMachine
+}
+
+var _ StateMachineServer = (*Server)(nil)
+
+// NewServer creates a new Server instance.
+func NewServer(create sm.CreateStateMachineFunc) *Server {
+	return &Server{
+		create:   create,
+		machines: make(map[nodeKey]sm.IStateMachine),
+	}
+}
+
+func (s *Server) get(clusterID uint64, nodeID uint64) sm.IStateMachine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := nodeKey{clusterID: clusterID, nodeID: nodeID}
+	m, ok := s.machines[key]
+	if !ok {
+		m = s.create(clusterID, nodeID)
+		s.machines[key] = m
+	}
+	return m
+}
+
+// Update updates the specified state machine.
+func (s *Server) Update(ctx context.Context,
+	req *UpdateRequest) (*UpdateResponse, error) {
+	result, err := s.get(req.ClusterId, req.NodeId).Update(req.Cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &UpdateResponse{Value: result.Value, Data: result.Data}, nil
+}
+
+// Lookup queries the specified state machine.
+func (s *Server) Lookup(ctx context.Context,
+	req *LookupRequest) (*LookupResponse, error) {
+	v, err := s.get(req.ClusterId, req.NodeId).Lookup(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := v.([]byte)
+	if !ok {
+		return nil, status.Error(codes.Internal, "result is not a byte slice")
+	}
+	return &LookupResponse{Result: result}, nil
+}
+
+// SaveSnapshot streams the snapshot of the specified state machine.
+func (s *Server) SaveSnapshot(req *NodeRequest,
+	stream StateMachine_SaveSnapshotServer) error {
+	m := s.get(req.ClusterId, req.NodeId)
+	w := &chunkWriter{stream: stream}
+	return m.SaveSnapshot(w, nil, stream.Context().Done())
+}
+
+// RecoverFromSnapshot recovers the specified state machine from the streamed
+// snapshot.
+func (s *Server) RecoverFromSnapshot(
+	stream StateMachine_RecoverFromSnapshotServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	m := s.get(first.ClusterId, first.NodeId)
+	r := &chunkReader{stream: stream, data: first.Data}
+	if err := m.RecoverFromSnapshot(r, nil, stream.Context().Done()); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&Empty{})
+}
+
+// Close closes the specified state machine.
+func (s *Server) Close(ctx context.Context, req *NodeRequest) (*Empty, error) {
+	s.mu.Lock()
+	key := nodeKey{clusterID: req.ClusterId, nodeID: req.NodeId}
+	m, ok := s.machines[key]
+	delete(s.machines, key)
+	s.mu.Unlock()
+	if ok {
+		if err := m.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return &Empty{}, nil
+}
+
+type chunkWriter struct {
+	stream StateMachine_SaveSnapshotServer
+}
+
+func (w *chunkWriter) Write(data []byte) (int, error) {
+	for sent := 0; sent < len(data); sent += chunkSize {
+		end := sent + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := w.stream.Send(&SnapshotChunk{Data: data[sent:end]}); err != nil {
+			return sent, err
+		}
+	}
+	return len(data), nil
+}
+
+type chunkReader struct {
+	stream StateMachine_RecoverFromSnapshotServer
+	data   []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		chunk, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.data = chunk.Data
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
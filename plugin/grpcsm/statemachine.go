@@ -0,0 +1,198 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package grpcsm provides support for state machines hosted by external
+processes and accessed over gRPC.
+
+State machines can thus be implemented in languages other than Go, or isolated
+from the NodeHost process so a crashed state machine doesn't bring down the
+NodeHost together with all other Raft nodes it manages. The external process
+is required to implement the StateMachine service defined in grpcsm.proto.
+Each request carries the cluster ID and node ID of the Raft node, a single
+external process can host state machines of multiple Raft nodes.
+
+On the NodeHost side, the function returned by NewStateMachineFactory is
+passed to NodeHost.StartCluster, each created sm.IStateMachine instance
+forwards all its requests to the external process. For state machines written
+in Go, the Server type can be used for implementing the external process.
+*/
+package grpcsm
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"google.golang.org/grpc"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+var (
+	// ErrInvalidQuery indicates that the query is not a byte slice.
+	ErrInvalidQuery = errors.New("query is not a byte slice")
+)
+
+const (
+	// chunkSize is the size of each snapshot chunk sent to the external process.
+	chunkSize = 1024 * 1024
+)
+
+// stateMachine is a sm.IStateMachine implementation that forwards all
+// requests to the state machine hosted by an external process.
+type stateMachine struct {
+	clusterID uint64
+	nodeID    uint64
+	client    StateMachineClient
+}
+
+var _ sm.IStateMachine = (*stateMachine)(nil)
+var _ sm.IExtended = (*stateMachine)(nil)
+
+// NewStateMachineFactory returns a function for creating sm.IStateMachine
+// instances backed by state machines hosted by the external process connected
+// via cc. The returned function is expected to be passed to the StartCluster
+// method of NodeHost.
+func NewStateMachineFactory(cc grpc.ClientConnInterface) sm.CreateStateMachineFunc {
+	client := NewStateMachineClient(cc)
+	return func(clusterID uint64, nodeID uint64) sm.IStateMachine {
+		return &stateMachine{
+			clusterID: clusterID,
+			nodeID:    nodeID,
+			client:    client,
+		}
+	}
+}
+
+func (s *stateMachine) Update(data []byte) (sm.Result, error) {
+	resp, err := s.client.Update(context.Background(), &UpdateRequest{
+		ClusterId: s.clusterID,
+		NodeId:    s.nodeID,
+		Cmd:       data,
+	})
+	if err != nil {
+		return sm.Result{}, err
+	}
+	return sm.Result{Value: resp.Value, Data: resp.Data}, nil
+}
+
+func (s *stateMachine) Lookup(query interface{}) (interface{}, error) {
+	q, ok := query.([]byte)
+	if !ok {
+		return nil, ErrInvalidQuery
+	}
+	return s.NALookup(q)
+}
+
+func (s *stateMachine) NALookup(query []byte) ([]byte, error) {
+	resp, err := s.client.Lookup(context.Background(), &LookupRequest{
+		ClusterId: s.clusterID,
+		NodeId:    s.nodeID,
+		Query:     query,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
+}
+
+func (s *stateMachine) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	ctx, cancel := withDone(done)
+	defer cancel()
+	stream, err := s.client.SaveSnapshot(ctx, &NodeRequest{
+		ClusterId: s.clusterID,
+		NodeId:    s.nodeID,
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return stoppedOr(done, err)
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *stateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	ctx, cancel := withDone(done)
+	defer cancel()
+	stream, err := s.client.RecoverFromSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	first := &SnapshotChunk{ClusterId: s.clusterID, NodeId: s.nodeID}
+	if err := stream.Send(first); err != nil {
+		return stoppedOr(done, err)
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			chunk := &SnapshotChunk{Data: buf[:n]}
+			if err := stream.Send(chunk); err != nil {
+				return stoppedOr(done, err)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := stream.CloseAndRecv(); err != nil {
+		return stoppedOr(done, err)
+	}
+	return nil
+}
+
+func (s *stateMachine) Close() error {
+	_, err := s.client.Close(context.Background(), &NodeRequest{
+		ClusterId: s.clusterID,
+		NodeId:    s.nodeID,
+	})
+	return err
+}
+
+// withDone returns a context canceled once the done chan is closed.
+func withDone(done <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func stoppedOr(done <-chan struct{}, err error) error {
+	select {
+	case <-done:
+		return sm.ErrSnapshotStopped
+	default:
+	}
+	return err
+}
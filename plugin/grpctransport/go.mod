@@ -0,0 +1,11 @@
+module github.com/lni/dragonboat/v3/plugin/grpctransport
+
+go 1.14
+
+require (
+	github.com/lni/dragonboat/v3 v3.3.0
+	github.com/lni/goutils v1.3.0
+	google.golang.org/grpc v1.35.0
+)
+
+replace github.com/lni/dragonboat/v3 => ../..
@@ -0,0 +1,262 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpctransport
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+// The gRPC client and server bindings of the Raft service defined in
+// raft.proto.
+
+const (
+	serviceName = "dragonboat.transport.Raft"
+	// codecName is the content subtype of all requests made by the transport
+	// module, it selects the codec below on both sides of the connection.
+	codecName = "dragonboat"
+)
+
+var (
+	errInvalidMessage = errors.New("invalid message")
+)
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type unmarshaler interface {
+	Unmarshal([]byte) error
+}
+
+// codec encodes messages using their own Marshal and Unmarshal methods so the
+// raftpb messages can be sent as is.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(marshaler)
+	if !ok {
+		return nil, errInvalidMessage
+	}
+	return m.Marshal()
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(unmarshaler)
+	if !ok {
+		return errInvalidMessage
+	}
+	return m.Unmarshal(data)
+}
+
+func (codec) Name() string {
+	return codecName
+}
+
+// Empty is the empty response message.
+type Empty struct{}
+
+// Marshal marshals the message.
+func (m *Empty) Marshal() ([]byte, error) {
+	return nil, nil
+}
+
+// Unmarshal unmarshals the message.
+func (m *Empty) Unmarshal(data []byte) error {
+	return nil
+}
+
+// RaftClient is the client API of the Raft service.
+type RaftClient interface {
+	SendMessageBatch(ctx context.Context,
+		opts ...grpc.CallOption) (SendMessageBatchClient, error)
+	SendChunk(ctx context.Context,
+		opts ...grpc.CallOption) (SendChunkClient, error)
+}
+
+// SendMessageBatchClient is the client side stream of the SendMessageBatch
+// method.
+type SendMessageBatchClient interface {
+	Send(*pb.MessageBatch) error
+	CloseAndRecv() (*Empty, error)
+	grpc.ClientStream
+}
+
+// SendChunkClient is the client side stream of the SendChunk method.
+type SendChunkClient interface {
+	Send(*pb.Chunk) error
+	CloseAndRecv() (*Empty, error)
+	grpc.ClientStream
+}
+
+type raftClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewRaftClient creates a RaftClient instance.
+func NewRaftClient(cc grpc.ClientConnInterface) RaftClient {
+	return &raftClient{cc: cc}
+}
+
+func (c *raftClient) SendMessageBatch(ctx context.Context,
+	opts ...grpc.CallOption) (SendMessageBatchClient, error) {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype(codecName)}, opts...)
+	stream, err := c.cc.NewStream(ctx, &serviceDesc.Streams[0],
+		"/"+serviceName+"/SendMessageBatch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &sendMessageBatchClient{stream}, nil
+}
+
+type sendMessageBatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *sendMessageBatchClient) Send(m *pb.MessageBatch) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *sendMessageBatchClient) CloseAndRecv() (*Empty, error) {
+	return closeAndRecv(x.ClientStream)
+}
+
+func (c *raftClient) SendChunk(ctx context.Context,
+	opts ...grpc.CallOption) (SendChunkClient, error) {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype(codecName)}, opts...)
+	stream, err := c.cc.NewStream(ctx, &serviceDesc.Streams[1],
+		"/"+serviceName+"/SendChunk", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &sendChunkClient{stream}, nil
+}
+
+type sendChunkClient struct {
+	grpc.ClientStream
+}
+
+func (x *sendChunkClient) Send(m *pb.Chunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *sendChunkClient) CloseAndRecv() (*Empty, error) {
+	return closeAndRecv(x.ClientStream)
+}
+
+func closeAndRecv(stream grpc.ClientStream) (*Empty, error) {
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := &Empty{}
+	if err := stream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RaftServer is the server API of the Raft service.
+type RaftServer interface {
+	SendMessageBatch(SendMessageBatchServer) error
+	SendChunk(SendChunkServer) error
+}
+
+// SendMessageBatchServer is the server side stream of the SendMessageBatch
+// method.
+type SendMessageBatchServer interface {
+	SendAndClose(*Empty) error
+	Recv() (*pb.MessageBatch, error)
+	grpc.ServerStream
+}
+
+// SendChunkServer is the server side stream of the SendChunk method.
+type SendChunkServer interface {
+	SendAndClose(*Empty) error
+	Recv() (*pb.Chunk, error)
+	grpc.ServerStream
+}
+
+// RegisterRaftServer registers the RaftServer instance to the gRPC server.
+func RegisterRaftServer(s *grpc.Server, srv RaftServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+func sendMessageBatchHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RaftServer).SendMessageBatch(&sendMessageBatchServer{stream})
+}
+
+type sendMessageBatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *sendMessageBatchServer) SendAndClose(m *Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *sendMessageBatchServer) Recv() (*pb.MessageBatch, error) {
+	m := &pb.MessageBatch{}
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func sendChunkHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RaftServer).SendChunk(&sendChunkServer{stream})
+}
+
+type sendChunkServer struct {
+	grpc.ServerStream
+}
+
+func (x *sendChunkServer) SendAndClose(m *Empty) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *sendChunkServer) Recv() (*pb.Chunk, error) {
+	m := &pb.Chunk{}
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*RaftServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "SendMessageBatch",
+			Handler:       sendMessageBatchHandler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "SendChunk",
+			Handler:       sendChunkHandler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "raft.proto",
+}
@@ -0,0 +1,319 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+/*
+Package grpctransport implements a gRPC based transport module for exchanging
+Raft messages and snapshot chunks between NodeHost instances. It is an
+alternative to the built-in TCP based transport module for deployments already
+running gRPC infrastructure, it can be selected by setting the
+NodeHostConfig.Expert.TransportFactory field to a Factory instance. All
+NodeHost instances of the same deployment are required to use the same
+transport module.
+
+Each remote NodeHost is served by a single multiplexed gRPC client connection,
+Raft messages and snapshot chunks are sent as client side streams over it.
+gRPC server and dial options, e.g. interceptors, can be specified using the
+Factory fields.
+*/
+package grpctransport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/lni/goutils/stringutil"
+	"github.com/lni/goutils/syncutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/logger"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+var (
+	plog = logger.GetLogger("grpctransport")
+)
+
+const (
+	// TransportName is the name of the gRPC based transport module.
+	TransportName = "grpc-transport"
+)
+
+var (
+	// ErrStopped indicates that the transport module has been stopped.
+	ErrStopped = errors.New("transport stopped")
+)
+
+// Factory is the factory type for creating gRPC based transport modules.
+type Factory struct {
+	// ServerOptions are the extra options used for creating the gRPC server,
+	// e.g. interceptors.
+	ServerOptions []grpc.ServerOption
+	// DialOptions are the extra options used for dialing remote NodeHost
+	// instances, e.g. interceptors.
+	DialOptions []grpc.DialOption
+}
+
+var _ config.TransportFactory = (*Factory)(nil)
+
+// Create creates a gRPC based transport module.
+func (f *Factory) Create(nhConfig config.NodeHostConfig,
+	handler raftio.MessageHandler,
+	chunkHandler raftio.ChunkHandler) raftio.ITransport {
+	return NewTransport(nhConfig, handler, chunkHandler, f.ServerOptions,
+		f.DialOptions)
+}
+
+// Validate returns a boolean value indicating whether the specified address
+// is valid.
+func (f *Factory) Validate(addr string) bool {
+	return stringutil.IsValidAddress(addr)
+}
+
+// Transport is a gRPC based transport module.
+type Transport struct {
+	mu             sync.Mutex
+	stopped        bool
+	conns          map[string]*grpc.ClientConn
+	server         *grpc.Server
+	stopper        *syncutil.Stopper
+	nhConfig       config.NodeHostConfig
+	requestHandler raftio.MessageHandler
+	chunkHandler   raftio.ChunkHandler
+	serverOptions  []grpc.ServerOption
+	dialOptions    []grpc.DialOption
+}
+
+var _ raftio.ITransport = (*Transport)(nil)
+
+// NewTransport creates a new gRPC based transport module.
+func NewTransport(nhConfig config.NodeHostConfig,
+	requestHandler raftio.MessageHandler, chunkHandler raftio.ChunkHandler,
+	serverOptions []grpc.ServerOption,
+	dialOptions []grpc.DialOption) *Transport {
+	return &Transport{
+		conns:          make(map[string]*grpc.ClientConn),
+		stopper:        syncutil.NewStopper(),
+		nhConfig:       nhConfig,
+		requestHandler: requestHandler,
+		chunkHandler:   chunkHandler,
+		serverOptions:  serverOptions,
+		dialOptions:    dialOptions,
+	}
+}
+
+// Name returns the name of the transport module.
+func (t *Transport) Name() string {
+	return TransportName
+}
+
+// Start starts the gRPC server of the transport module.
+func (t *Transport) Start() error {
+	tlsConfig, err := t.nhConfig.GetServerTLSConfig()
+	if err != nil {
+		return err
+	}
+	opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(math.MaxInt32)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	listener, err := net.Listen("tcp", t.nhConfig.GetListenAddress())
+	if err != nil {
+		return err
+	}
+	t.server = grpc.NewServer(append(opts, t.serverOptions...)...)
+	RegisterRaftServer(t.server, &server{t: t})
+	t.stopper.RunWorker(func() {
+		if err := t.server.Serve(listener); err != nil {
+			plog.Errorf("gRPC server stopped, %v", err)
+		}
+	})
+	return nil
+}
+
+// Stop stops the transport module.
+func (t *Transport) Stop() {
+	t.mu.Lock()
+	t.stopped = true
+	conns := t.conns
+	t.conns = make(map[string]*grpc.ClientConn)
+	t.mu.Unlock()
+	for target, cc := range conns {
+		if err := cc.Close(); err != nil {
+			plog.Errorf("failed to close the connection to %s, %v", target, err)
+		}
+	}
+	if t.server != nil {
+		t.server.Stop()
+	}
+	t.stopper.Stop()
+}
+
+// GetConnection returns a new raftio.IConnection for sending Raft messages to
+// the specified target.
+func (t *Transport) GetConnection(ctx context.Context,
+	target string) (raftio.IConnection, error) {
+	cc, err := t.getClientConn(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	sctx, cancel := context.WithCancel(context.Background())
+	stream, err := NewRaftClient(cc).SendMessageBatch(sctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &connection{stream: stream, cancel: cancel}, nil
+}
+
+// GetSnapshotConnection returns a new raftio.ISnapshotConnection for sending
+// snapshot chunks to the specified target.
+func (t *Transport) GetSnapshotConnection(ctx context.Context,
+	target string) (raftio.ISnapshotConnection, error) {
+	cc, err := t.getClientConn(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	sctx, cancel := context.WithCancel(context.Background())
+	stream, err := NewRaftClient(cc).SendChunk(sctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &snapshotConnection{stream: stream, cancel: cancel}, nil
+}
+
+// getClientConn returns the gRPC client connection to the specified target,
+// it is shared by all connections to the target as gRPC multiplexes streams
+// over it and reconnects when necessary.
+func (t *Transport) getClientConn(ctx context.Context,
+	target string) (*grpc.ClientConn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return nil, ErrStopped
+	}
+	if cc, ok := t.conns[target]; ok {
+		return cc, nil
+	}
+	tlsConfig, err := t.nhConfig.GetClientTLSConfig(target)
+	if err != nil {
+		return nil, err
+	}
+	opts := []grpc.DialOption{
+		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(math.MaxInt32)),
+	}
+	if dial := t.nhConfig.DialContext; dial != nil {
+		opts = append(opts, grpc.WithContextDialer(
+			func(ctx context.Context, addr string) (net.Conn, error) {
+				return dial(ctx, "tcp", addr)
+			}))
+	}
+	if tlsConfig != nil {
+		opts = append(opts,
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	cc, err := grpc.DialContext(ctx, target, append(opts, t.dialOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+	t.conns[target] = cc
+	return cc, nil
+}
+
+type connection struct {
+	stream SendMessageBatchClient
+	cancel context.CancelFunc
+}
+
+var _ raftio.IConnection = (*connection)(nil)
+
+// Close closes the connection.
+func (c *connection) Close() {
+	closeStream(c.stream.CloseAndRecv, c.cancel)
+}
+
+// SendMessageBatch sends the specified message batch to the remote NodeHost.
+func (c *connection) SendMessageBatch(batch pb.MessageBatch) error {
+	return c.stream.Send(&batch)
+}
+
+type snapshotConnection struct {
+	stream SendChunkClient
+	cancel context.CancelFunc
+}
+
+var _ raftio.ISnapshotConnection = (*snapshotConnection)(nil)
+
+// Close closes the snapshot connection.
+func (c *snapshotConnection) Close() {
+	closeStream(c.stream.CloseAndRecv, c.cancel)
+}
+
+// SendChunk sends the specified snapshot chunk to the remote NodeHost.
+func (c *snapshotConnection) SendChunk(chunk pb.Chunk) error {
+	return c.stream.Send(&chunk)
+}
+
+// closeStream waits for the remote NodeHost to acknowledge all sent data
+// before releasing the stream.
+func closeStream(closeAndRecv func() (*Empty, error), cancel func()) {
+	defer cancel()
+	if _, err := closeAndRecv(); err != nil && err != io.EOF {
+		plog.Debugf("failed to close the stream, %v", err)
+	}
+}
+
+type server struct {
+	t *Transport
+}
+
+var _ RaftServer = (*server)(nil)
+
+func (s *server) SendMessageBatch(stream SendMessageBatchServer) error {
+	for {
+		batch, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&Empty{})
+		}
+		if err != nil {
+			return err
+		}
+		s.t.requestHandler(*batch)
+	}
+}
+
+func (s *server) SendChunk(stream SendChunkServer) error {
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&Empty{})
+		}
+		if err != nil {
+			return err
+		}
+		if !s.t.chunkHandler(*chunk) {
+			return status.Error(codes.FailedPrecondition, "chunk rejected")
+		}
+	}
+}
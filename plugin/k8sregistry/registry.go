@@ -0,0 +1,366 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+/*
+Package k8sregistry implements a Kubernetes based node registry used for
+resolving NodeHostID values into RaftAddress values. It removes the need for
+gossip seeds when NodeHost instances are deployed as Kubernetes pods, e.g. as
+a StatefulSet backed by persistent volumes.
+
+On startup, the registry annotates the pod running the local NodeHost with
+its NodeHostID and the port of its RaftAddress. Pods matching the configured
+label selector are then watched using the Kubernetes API, the RaftAddress of
+a NodeHost is the IP address of its annotated pod combined with the annotated
+port. Pods re-scheduled onto other Kubernetes nodes thus become reachable
+again as soon as they are assigned new IP addresses and the NodeHost
+instances running in them are restarted.
+
+The Kubernetes based node registry can be selected by enabling the
+NodeHostConfig.AddressByNodeHostID field and setting the
+NodeHostConfig.Expert.NodeRegistryFactory field to a Factory instance, the
+NodeHostConfig.Gossip field is not required in such case. The service account
+of the pods is required to be allowed to get, list, watch and patch pods in
+the namespace of the pods.
+
+This package is a separate Go module as the Kubernetes client library requires
+a more recent Go release than the dragonboat module.
+*/
+package k8sregistry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/logger"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+var (
+	plog = logger.GetLogger("k8sregistry")
+)
+
+const (
+	// NodeHostIDAnnotation is the pod annotation used for the NodeHostID of the
+	// NodeHost running in the pod.
+	NodeHostIDAnnotation = "dragonboat.io/nodehost-id"
+	// RaftPortAnnotation is the pod annotation used for the port of the
+	// RaftAddress of the NodeHost running in the pod.
+	RaftPortAnnotation = "dragonboat.io/raft-port"
+	namespaceFile      = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+	defaultSyncTimeout = 30 * time.Second
+)
+
+var (
+	// ErrUnknownTarget is the error returned when the RaftAddress of the target
+	// NodeHost is unknown.
+	ErrUnknownTarget = errors.New("target address unknown")
+	// ErrAddressByNodeHostIDRequired is the error returned when the
+	// NodeHostConfig.AddressByNodeHostID field is not enabled.
+	ErrAddressByNodeHostIDRequired = errors.New("AddressByNodeHostID not set")
+	// ErrNoPodName is the error returned when the name of the pod running the
+	// local NodeHost is unknown.
+	ErrNoPodName = errors.New("pod name unknown")
+)
+
+// Config is the configuration of the Kubernetes based node registry.
+type Config struct {
+	// Client is the optional Kubernetes client to use. The in-cluster config
+	// is used for creating a client when not set.
+	Client kubernetes.Interface
+	// Namespace is the namespace of the pods, the namespace of the service
+	// account of the local pod is used when not set.
+	Namespace string
+	// LabelSelector selects pods running NodeHost instances of the same
+	// deployment, e.g. app=dragonboat. All pods in the namespace are watched
+	// when not set.
+	LabelSelector string
+	// PodName is the name of the pod running the local NodeHost, the value of
+	// the POD_NAME environment variable or the hostname is used when not set.
+	PodName string
+	// SyncTimeout is the maximum time to wait for the initial list of pods to
+	// be loaded, 30 seconds is used when not set.
+	SyncTimeout time.Duration
+}
+
+func (c *Config) prepare() error {
+	if c.Client == nil {
+		rc, err := rest.InClusterConfig()
+		if err != nil {
+			return err
+		}
+		if c.Client, err = kubernetes.NewForConfig(rc); err != nil {
+			return err
+		}
+	}
+	if len(c.Namespace) == 0 {
+		data, err := os.ReadFile(namespaceFile)
+		if err != nil {
+			return err
+		}
+		c.Namespace = strings.TrimSpace(string(data))
+	}
+	if len(c.PodName) == 0 {
+		c.PodName = os.Getenv("POD_NAME")
+	}
+	if len(c.PodName) == 0 {
+		name, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		c.PodName = name
+	}
+	if len(c.PodName) == 0 {
+		return ErrNoPodName
+	}
+	if c.SyncTimeout == 0 {
+		c.SyncTimeout = defaultSyncTimeout
+	}
+	return nil
+}
+
+// Factory is the factory type used for creating Kubernetes based node
+// registries.
+type Factory struct {
+	cfg Config
+}
+
+var _ config.NodeRegistryFactory = (*Factory)(nil)
+
+// NewFactory returns a new Factory instance.
+func NewFactory(cfg Config) *Factory {
+	return &Factory{cfg: cfg}
+}
+
+// Create creates a Kubernetes based node registry.
+func (f *Factory) Create(nhid string, nhConfig config.NodeHostConfig,
+	v config.TargetValidator) (raftio.INodeRegistry, error) {
+	return NewRegistry(nhid, nhConfig, v, f.cfg)
+}
+
+// Registry is a Kubernetes based node registry. It keeps targets of known
+// nodes locally and resolves them into RaftAddress values using annotated
+// pods.
+type Registry struct {
+	nhid     string
+	address  string
+	validate config.TargetValidator
+	targets  sync.Map // map of raftio.NodeInfo => string
+	stopc    chan struct{}
+	lister   cache.Indexer
+	mu       struct {
+		sync.Mutex
+		addrs map[string]string
+	}
+}
+
+var _ raftio.INodeRegistry = (*Registry)(nil)
+
+// NewRegistry creates a new Kubernetes based node registry. It annotates the
+// pod running the local NodeHost and starts watching annotated pods.
+func NewRegistry(nhid string, nhConfig config.NodeHostConfig,
+	v config.TargetValidator, cfg Config) (*Registry, error) {
+	if !nhConfig.AddressByNodeHostID {
+		return nil, ErrAddressByNodeHostIDRequired
+	}
+	_, port, err := net.SplitHostPort(nhConfig.RaftAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+	if err := annotate(cfg, nhid, port); err != nil {
+		return nil, err
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(cfg.Client, 0,
+		informers.WithNamespace(cfg.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = cfg.LabelSelector
+		}))
+	informer := factory.Core().V1().Pods().Informer()
+	r := &Registry{
+		nhid:     nhid,
+		address:  nhConfig.RaftAddress,
+		validate: v,
+		stopc:    make(chan struct{}),
+		lister:   informer.GetIndexer(),
+	}
+	r.mu.addrs = make(map[string]string)
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { r.refresh() },
+		UpdateFunc: func(interface{}, interface{}) { r.refresh() },
+		DeleteFunc: func(interface{}) { r.refresh() },
+	}); err != nil {
+		return nil, err
+	}
+	factory.Start(r.stopc)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.SyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		r.Stop()
+		return nil, errors.New("failed to sync pods")
+	}
+	r.refresh()
+	return r, nil
+}
+
+// Stop stops watching pods.
+func (r *Registry) Stop() {
+	close(r.stopc)
+}
+
+// Add adds the specified node and its NodeHostID to the registry.
+func (r *Registry) Add(clusterID uint64, nodeID uint64, target string) {
+	if r.validate != nil && !r.validate(target) {
+		plog.Panicf("invalid target %s", target)
+	}
+	key := raftio.GetNodeInfo(clusterID, nodeID)
+	v, ok := r.targets.LoadOrStore(key, target)
+	if ok && v.(string) != target {
+		plog.Panicf("inconsistent target for cluster %d node %d, %s:%s",
+			clusterID, nodeID, v, target)
+	}
+}
+
+// Remove removes the specified node from the registry.
+func (r *Registry) Remove(clusterID uint64, nodeID uint64) {
+	r.targets.Delete(raftio.GetNodeInfo(clusterID, nodeID))
+}
+
+// RemoveCluster removes all nodes of the specified cluster from the registry.
+func (r *Registry) RemoveCluster(clusterID uint64) {
+	var toRemove []raftio.NodeInfo
+	r.targets.Range(func(k, v interface{}) bool {
+		if ni := k.(raftio.NodeInfo); ni.ClusterID == clusterID {
+			toRemove = append(toRemove, ni)
+		}
+		return true
+	})
+	for _, v := range toRemove {
+		r.targets.Delete(v)
+	}
+}
+
+// Resolve returns the current RaftAddress and connection key of the specified
+// node. It returns ErrUnknownTarget when the RaftAddress is unknown.
+func (r *Registry) Resolve(clusterID uint64,
+	nodeID uint64) (string, string, error) {
+	target, ok := r.targets.Load(raftio.GetNodeInfo(clusterID, nodeID))
+	if !ok {
+		return "", "", ErrUnknownTarget
+	}
+	addr, ok := r.getRaftAddress(target.(string))
+	if !ok {
+		return "", "", ErrUnknownTarget
+	}
+	return addr, addr, nil
+}
+
+// NumMembers returns the number of NodeHost instances with known RaftAddress
+// values, including the local NodeHost.
+func (r *Registry) NumMembers() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.mu.addrs[r.nhid]; ok {
+		return len(r.mu.addrs)
+	}
+	return len(r.mu.addrs) + 1
+}
+
+func (r *Registry) getRaftAddress(nhid string) (string, bool) {
+	if nhid == r.nhid {
+		return r.address, true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addr, ok := r.mu.addrs[nhid]
+	return addr, ok
+}
+
+// refresh rebuilds the NodeHostID to RaftAddress map from all watched pods.
+// Terminating pods are only used when there is no other pod annotated with
+// the same NodeHostID.
+func (r *Registry) refresh() {
+	addrs := make(map[string]string)
+	terminating := make(map[string]string)
+	for _, obj := range r.lister.List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+		nhid, addr, ok := getPodAddress(pod)
+		if !ok {
+			continue
+		}
+		if pod.DeletionTimestamp != nil {
+			terminating[nhid] = addr
+		} else {
+			addrs[nhid] = addr
+		}
+	}
+	for nhid, addr := range terminating {
+		if _, ok := addrs[nhid]; !ok {
+			addrs[nhid] = addr
+		}
+	}
+	r.mu.Lock()
+	r.mu.addrs = addrs
+	r.mu.Unlock()
+}
+
+func getPodAddress(pod *corev1.Pod) (string, string, bool) {
+	nhid := pod.Annotations[NodeHostIDAnnotation]
+	port := pod.Annotations[RaftPortAnnotation]
+	if len(nhid) == 0 || len(port) == 0 || len(pod.Status.PodIP) == 0 {
+		return "", "", false
+	}
+	if pod.Status.Phase == corev1.PodSucceeded ||
+		pod.Status.Phase == corev1.PodFailed {
+		return "", "", false
+	}
+	return nhid, net.JoinHostPort(pod.Status.PodIP, port), true
+}
+
+func annotate(cfg Config, nhid string, port string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				NodeHostIDAnnotation: nhid,
+				RaftPortAnnotation:   port,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.SyncTimeout)
+	defer cancel()
+	_, err = cfg.Client.CoreV1().Pods(cfg.Namespace).Patch(ctx,
+		cfg.PodName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,219 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sregistry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+const (
+	testNamespace = "dragonboat"
+)
+
+func getTestPod(name string, ip string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			Labels:    map[string]string{"app": "dragonboat"},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			PodIP: ip,
+		},
+	}
+}
+
+func getAnnotatedPod(name string, ip string, nhid string) *corev1.Pod {
+	pod := getTestPod(name, ip)
+	pod.Annotations = map[string]string{
+		NodeHostIDAnnotation: nhid,
+		RaftPortAnnotation:   "26001",
+	}
+	return pod
+}
+
+func getTestRegistry(t *testing.T,
+	client kubernetes.Interface, podName string, nhid string) *Registry {
+	nhConfig := config.NodeHostConfig{
+		RaftAddress:         "localhost:26001",
+		AddressByNodeHostID: true,
+	}
+	cfg := Config{
+		Client:        client,
+		Namespace:     testNamespace,
+		LabelSelector: "app=dragonboat",
+		PodName:       podName,
+	}
+	r, err := NewRegistry(nhid, nhConfig, nil, cfg)
+	if err != nil {
+		t.Fatalf("failed to create registry, %v", err)
+	}
+	return r
+}
+
+func waitForAddress(t *testing.T, r *Registry,
+	clusterID uint64, nodeID uint64, expected string) {
+	for i := 0; i < 100; i++ {
+		addr, _, err := r.Resolve(clusterID, nodeID)
+		if expected == "" && err == ErrUnknownTarget {
+			return
+		}
+		if err == nil && addr == expected {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("failed to resolve %s", expected)
+}
+
+func TestRegistryRequiresAddressByNodeHostID(t *testing.T) {
+	client := fake.NewSimpleClientset(getTestPod("p1", "10.0.0.1"))
+	nhConfig := config.NodeHostConfig{RaftAddress: "localhost:26001"}
+	cfg := Config{Client: client, Namespace: testNamespace, PodName: "p1"}
+	if _, err := NewRegistry("nh1",
+		nhConfig, nil, cfg); err != ErrAddressByNodeHostIDRequired {
+		t.Errorf("unexpected err %v", err)
+	}
+	nhConfig.AddressByNodeHostID = true
+	nhConfig.RaftAddress = "localhost"
+	if _, err := NewRegistry("nh1", nhConfig, nil, cfg); err == nil {
+		t.Errorf("RaftAddress without port not rejected")
+	}
+}
+
+func TestLocalPodIsAnnotated(t *testing.T) {
+	client := fake.NewSimpleClientset(getTestPod("p1", "10.0.0.1"))
+	r := getTestRegistry(t, client, "p1", "nh1")
+	defer r.Stop()
+	pod, err := client.CoreV1().Pods(testNamespace).Get(context.Background(),
+		"p1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get pod, %v", err)
+	}
+	if pod.Annotations[NodeHostIDAnnotation] != "nh1" ||
+		pod.Annotations[RaftPortAnnotation] != "26001" {
+		t.Errorf("unexpected annotations %v", pod.Annotations)
+	}
+	r.Add(1, 1, "nh1")
+	waitForAddress(t, r, 1, 1, "localhost:26001")
+}
+
+func TestMissingLocalPodIsReported(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	nhConfig := config.NodeHostConfig{
+		RaftAddress:         "localhost:26001",
+		AddressByNodeHostID: true,
+	}
+	cfg := Config{Client: client, Namespace: testNamespace, PodName: "p1"}
+	if _, err := NewRegistry("nh1", nhConfig, nil, cfg); err == nil {
+		t.Errorf("missing pod not reported")
+	}
+}
+
+func TestRegistryResolvesNodeHostIDs(t *testing.T) {
+	client := fake.NewSimpleClientset(getTestPod("p1", "10.0.0.1"),
+		getAnnotatedPod("p2", "10.0.0.2", "nh2"))
+	r := getTestRegistry(t, client, "p1", "nh1")
+	defer r.Stop()
+	r.Add(1, 2, "nh2")
+	r.Add(1, 3, "nh3")
+	waitForAddress(t, r, 1, 2, "10.0.0.2:26001")
+	waitForAddress(t, r, 1, 3, "")
+	if n := r.NumMembers(); n != 2 {
+		t.Errorf("num of members %d, want 2", n)
+	}
+	pods := client.CoreV1().Pods(testNamespace)
+	_, err := pods.Create(context.Background(),
+		getAnnotatedPod("p3", "10.0.0.3", "nh3"), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create pod, %v", err)
+	}
+	waitForAddress(t, r, 1, 3, "10.0.0.3:26001")
+	r.RemoveCluster(1)
+	if _, _, err := r.Resolve(1, 2); err != ErrUnknownTarget {
+		t.Errorf("removed cluster resolved, %v", err)
+	}
+}
+
+func TestRescheduledPodIsObserved(t *testing.T) {
+	client := fake.NewSimpleClientset(getTestPod("p1", "10.0.0.1"),
+		getAnnotatedPod("p2", "10.0.0.2", "nh2"))
+	r := getTestRegistry(t, client, "p1", "nh1")
+	defer r.Stop()
+	r.Add(1, 2, "nh2")
+	waitForAddress(t, r, 1, 2, "10.0.0.2:26001")
+	pods := client.CoreV1().Pods(testNamespace)
+	err := pods.Delete(context.Background(), "p2", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("failed to delete pod, %v", err)
+	}
+	waitForAddress(t, r, 1, 2, "")
+	_, err = pods.Create(context.Background(),
+		getAnnotatedPod("p2", "10.0.0.5", "nh2"), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create pod, %v", err)
+	}
+	waitForAddress(t, r, 1, 2, "10.0.0.5:26001")
+}
+
+func TestTerminatingPodIsOnlyUsedWhenNoOtherPodIsAvailable(t *testing.T) {
+	old := getAnnotatedPod("p2", "10.0.0.2", "nh2")
+	now := metav1.Now()
+	old.DeletionTimestamp = &now
+	client := fake.NewSimpleClientset(getTestPod("p1", "10.0.0.1"), old)
+	r := getTestRegistry(t, client, "p1", "nh1")
+	defer r.Stop()
+	r.Add(1, 2, "nh2")
+	waitForAddress(t, r, 1, 2, "10.0.0.2:26001")
+	pods := client.CoreV1().Pods(testNamespace)
+	_, err := pods.Create(context.Background(),
+		getAnnotatedPod("p3", "10.0.0.3", "nh2"), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create pod, %v", err)
+	}
+	waitForAddress(t, r, 1, 2, "10.0.0.3:26001")
+}
+
+func TestPodAddress(t *testing.T) {
+	pod := getAnnotatedPod("p1", "10.0.0.1", "nh1")
+	nhid, addr, ok := getPodAddress(pod)
+	if !ok || nhid != "nh1" || addr != "10.0.0.1:26001" {
+		t.Errorf("unexpected address %s:%s", nhid, addr)
+	}
+	pod.Status.PodIP = "fd00::1"
+	if _, addr, _ = getPodAddress(pod); addr != "[fd00::1]:26001" {
+		t.Errorf("unexpected address %s", addr)
+	}
+	pod.Status.Phase = corev1.PodFailed
+	if _, _, ok := getPodAddress(pod); ok {
+		t.Errorf("failed pod used")
+	}
+	if _, _, ok := getPodAddress(getTestPod("p2", "10.0.0.2")); ok {
+		t.Errorf("pod without annotations used")
+	}
+	if _, _, ok := getPodAddress(getAnnotatedPod("p3", "", "nh3")); ok {
+		t.Errorf("pod without IP used")
+	}
+}
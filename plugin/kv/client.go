@@ -0,0 +1,131 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lni/dragonboat/v3/client"
+	"github.com/lni/dragonboat/v3/plugin/txn"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+var (
+	// ErrRejected indicates that the command was rejected by the state machine.
+	ErrRejected = errors.New("command rejected by the state machine")
+	// ErrUnexpectedResult indicates that the result returned by the state
+	// machine is not of the expected type.
+	ErrUnexpectedResult = errors.New("unexpected query result")
+)
+
+// INodeHost is the interface of NodeHost methods used by Client, it is
+// implemented by *dragonboat.NodeHost.
+type INodeHost interface {
+	GetNoOPSession(clusterID uint64) *client.Session
+	SyncPropose(ctx context.Context,
+		session *client.Session, cmd []byte) (sm.Result, error)
+	SyncRead(ctx context.Context,
+		clusterID uint64, query interface{}) (interface{}, error)
+}
+
+// Client provides typed access to a replicated key-value store. All writes are
+// made using the NO-OP client session and all reads are linearizable.
+type Client struct {
+	nh        INodeHost
+	clusterID uint64
+}
+
+// NewClient returns a new Client for the key-value store managed by the
+// specified Raft cluster.
+func NewClient(nh INodeHost, clusterID uint64) *Client {
+	return &Client{nh: nh, clusterID: clusterID}
+}
+
+// Put sets the key to the specified value.
+func (c *Client) Put(ctx context.Context, key []byte, value []byte) error {
+	return c.propose(ctx, EncodePut(key, value))
+}
+
+// Delete removes the key.
+func (c *Client) Delete(ctx context.Context, key []byte) error {
+	return c.propose(ctx, EncodeDelete(key))
+}
+
+// DeleteRange removes all keys in the range of [start, end).
+func (c *Client) DeleteRange(ctx context.Context,
+	start []byte, end []byte) error {
+	return c.propose(ctx, EncodeDeleteRange(start, end))
+}
+
+// Txn applies the mini-transaction. It returns a boolean value indicating
+// whether all conditions held and the transaction was committed.
+func (c *Client) Txn(ctx context.Context, t *txn.Txn) (bool, error) {
+	result, err := c.nh.SyncPropose(ctx,
+		c.nh.GetNoOPSession(c.clusterID), t.Encode())
+	if err != nil {
+		return false, err
+	}
+	switch result.Value {
+	case txn.ResultCommitted:
+		return true, nil
+	case txn.ResultConditionFailed:
+		return false, nil
+	default:
+		return false, ErrRejected
+	}
+}
+
+// Get returns the value of the key and a boolean value indicating whether the
+// key exists.
+func (c *Client) Get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	v, err := c.nh.SyncRead(ctx, c.clusterID, GetQuery{Key: key})
+	if err != nil {
+		return nil, false, err
+	}
+	result, ok := v.(GetResult)
+	if !ok {
+		return nil, false, ErrUnexpectedResult
+	}
+	return result.Value, result.Found, nil
+}
+
+// Scan returns up to limit key-value pairs with keys in the range of
+// [start, end) in ascending key order. A nil end means no upper bound, a zero
+// limit means no limit.
+func (c *Client) Scan(ctx context.Context,
+	start []byte, end []byte, limit int) ([]KV, error) {
+	q := ScanQuery{Start: start, End: end, Limit: limit}
+	v, err := c.nh.SyncRead(ctx, c.clusterID, q)
+	if err != nil {
+		return nil, err
+	}
+	result, ok := v.([]KV)
+	if !ok {
+		return nil, ErrUnexpectedResult
+	}
+	return result, nil
+}
+
+func (c *Client) propose(ctx context.Context, cmd []byte) error {
+	result, err := c.nh.SyncPropose(ctx, c.nh.GetNoOPSession(c.clusterID), cmd)
+	if err != nil {
+		return err
+	}
+	if result.Value != ResultApplied {
+		return ErrRejected
+	}
+	return nil
+}
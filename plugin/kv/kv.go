@@ -0,0 +1,167 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package kv provides a replicated key-value store built on top of a pebble
+backed IOnDiskStateMachine.
+
+It is both a reference implementation of the IOnDiskStateMachine interface and
+a quick way to get a replicated key-value store without writing a state machine
+from scratch. The function returned by NewStateMachineFactory is passed to
+NodeHost.StartOnDiskCluster, each created state machine keeps its state in a
+pebble database located in its own directory. Keys are ordered bytewise, range
+scans are supported, mini-transactions built using the plugin/txn package are
+applied atomically.
+
+Commands and queries have a standard encoding, the Client type can be used for
+accessing the replicated key-value store in a typed manner.
+*/
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/lni/dragonboat/v3/plugin/txn"
+)
+
+var (
+	// ErrInvalidCommand indicates that the command is not a valid encoded
+	// key-value command.
+	ErrInvalidCommand = errors.New("invalid key-value command")
+	// ErrInvalidQuery indicates that the query is not of a supported type.
+	ErrInvalidQuery = errors.New("invalid key-value query")
+)
+
+// magic is the prefix of encoded commands, the last byte is the version of the
+// wire format.
+var magic = []byte{0x00, 'd', 'b', 'k', 'v', 0x01}
+
+const (
+	opPut uint8 = iota
+	opDelete
+	opDeleteRange
+)
+
+const (
+	// ResultApplied is the Value of the sm.Result returned for applied Put,
+	// Delete and DeleteRange commands. It equals to txn.ResultCommitted.
+	ResultApplied = txn.ResultCommitted
+	// ResultInvalid is the Value of the sm.Result returned for commands that are
+	// neither valid key-value commands nor valid transactions. It equals to
+	// txn.ResultInvalid.
+	ResultInvalid = txn.ResultInvalid
+)
+
+// KV is a key-value pair.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// GetQuery is the query for getting the value of a key.
+type GetQuery struct {
+	Key []byte
+}
+
+// GetResult is the result of a GetQuery.
+type GetResult struct {
+	Value []byte
+	Found bool
+}
+
+// ScanQuery is the query for getting key-value pairs with keys in the range of
+// [Start, End) in ascending key order. A nil End means no upper bound, a zero
+// Limit means no limit on the number of returned pairs. The result of a
+// ScanQuery is a []KV.
+type ScanQuery struct {
+	Start []byte
+	End   []byte
+	Limit int
+}
+
+// EncodePut returns the command that sets the key to the specified value.
+func EncodePut(key []byte, value []byte) []byte {
+	return encode(opPut, key, value)
+}
+
+// EncodeDelete returns the command that removes the key.
+func EncodeDelete(key []byte) []byte {
+	return encode(opDelete, key, nil)
+}
+
+// EncodeDeleteRange returns the command that removes all keys in the range of
+// [start, end).
+func EncodeDeleteRange(start []byte, end []byte) []byte {
+	return encode(opDeleteRange, start, end)
+}
+
+// IsCommand returns a boolean value indicating whether the command is an
+// encoded key-value command.
+func IsCommand(cmd []byte) bool {
+	return bytes.HasPrefix(cmd, magic)
+}
+
+func encode(op uint8, key []byte, value []byte) []byte {
+	sz := len(magic) + 1 + 2*binary.MaxVarintLen64 + len(key) + len(value)
+	buf := bytes.NewBuffer(make([]byte, 0, sz))
+	buf.Write(magic)
+	buf.WriteByte(op)
+	writeBytes(buf, key)
+	writeBytes(buf, value)
+	return buf.Bytes()
+}
+
+func decode(cmd []byte) (uint8, []byte, []byte, error) {
+	if !IsCommand(cmd) {
+		return 0, nil, nil, ErrInvalidCommand
+	}
+	r := bytes.NewReader(cmd[len(magic):])
+	op, err := r.ReadByte()
+	if err != nil || op > opDeleteRange {
+		return 0, nil, nil, ErrInvalidCommand
+	}
+	key, err := readBytes(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	value, err := readBytes(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if r.Len() != 0 {
+		return 0, nil, nil, ErrInvalidCommand
+	}
+	return op, key, value, nil
+}
+
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	var v [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(v[:], uint64(len(data)))
+	buf.Write(v[:n])
+	buf.Write(data)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	sz, err := binary.ReadUvarint(r)
+	if err != nil || sz > uint64(r.Len()) {
+		return nil, ErrInvalidCommand
+	}
+	data := make([]byte, sz)
+	if _, err := r.Read(data); err != nil && sz > 0 {
+		return nil, ErrInvalidCommand
+	}
+	return data, nil
+}
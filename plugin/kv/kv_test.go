@@ -0,0 +1,346 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/lni/goutils/random"
+
+	"github.com/lni/dragonboat/v3"
+	"github.com/lni/dragonboat/v3/client"
+	"github.com/lni/dragonboat/v3/plugin/txn"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+const (
+	testDir = "kv_test_dir_safe_to_delete"
+)
+
+func runKVTest(t *testing.T, tf func(t *testing.T, s *StateMachine)) {
+	if err := os.RemoveAll(testDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(testDir)
+	s := NewStateMachineFactory(testDir)(1, 1).(*StateMachine)
+	if index, err := s.Open(nil); err != nil || index != 0 {
+		t.Fatalf("failed to open, index %d, %v", index, err)
+	}
+	defer s.Close()
+	tf(t, s)
+}
+
+func update(t *testing.T, s *StateMachine, index uint64, cmds ...[]byte) []sm.Entry {
+	entries := make([]sm.Entry, 0)
+	for _, cmd := range cmds {
+		index++
+		entries = append(entries, sm.Entry{Index: index, Cmd: cmd})
+	}
+	result, err := s.Update(entries)
+	if err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	return result
+}
+
+func lookup(t *testing.T, s *StateMachine, key string) (string, bool) {
+	v, err := s.Lookup(GetQuery{Key: []byte(key)})
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	r := v.(GetResult)
+	return string(r.Value), r.Found
+}
+
+func TestCommandCanBeEncodedAndDecoded(t *testing.T) {
+	op, key, value, err := decode(EncodePut([]byte("k"), []byte("v")))
+	if err != nil || op != opPut ||
+		!bytes.Equal(key, []byte("k")) || !bytes.Equal(value, []byte("v")) {
+		t.Errorf("unexpected decoded command %d, %s, %s, %v", op, key, value, err)
+	}
+	if !IsCommand(EncodeDelete([]byte("k"))) {
+		t.Errorf("not a command")
+	}
+	cmd := EncodeDeleteRange([]byte("a"), []byte("b"))
+	if _, _, _, err := decode(cmd[:len(cmd)-1]); err != ErrInvalidCommand {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, _, _, err := decode([]byte("put")); err != ErrInvalidCommand {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUpdateAndLookup(t *testing.T) {
+	tf := func(t *testing.T, s *StateMachine) {
+		result := update(t, s, 0,
+			EncodePut([]byte("k1"), []byte("v1")),
+			EncodePut([]byte("k2"), []byte("v2")),
+			EncodePut([]byte("k3"), []byte("v3")),
+			EncodeDelete([]byte("k2")),
+			[]byte("invalid"))
+		for i := 0; i < 4; i++ {
+			if result[i].Result.Value != ResultApplied {
+				t.Errorf("%d, unexpected result %v", i, result[i].Result)
+			}
+		}
+		if result[4].Result.Value != ResultInvalid {
+			t.Errorf("unexpected result %v", result[4].Result)
+		}
+		if v, ok := lookup(t, s, "k1"); !ok || v != "v1" {
+			t.Errorf("unexpected value %s, %t", v, ok)
+		}
+		if _, ok := lookup(t, s, "k2"); ok {
+			t.Errorf("deleted key found")
+		}
+		if _, err := s.Lookup("k1"); err != ErrInvalidQuery {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	runKVTest(t, tf)
+}
+
+func TestScan(t *testing.T) {
+	tf := func(t *testing.T, s *StateMachine) {
+		update(t, s, 0,
+			EncodePut([]byte("a"), []byte("1")),
+			EncodePut([]byte("b"), []byte("2")),
+			EncodePut([]byte("c"), []byte("3")),
+			EncodePut([]byte("d"), []byte("4")))
+		tests := []struct {
+			q    ScanQuery
+			keys string
+		}{
+			{ScanQuery{}, "abcd"},
+			{ScanQuery{Start: []byte("b")}, "bcd"},
+			{ScanQuery{Start: []byte("b"), End: []byte("d")}, "bc"},
+			{ScanQuery{Limit: 3}, "abc"},
+			{ScanQuery{Start: []byte("e")}, ""},
+		}
+		for idx, tt := range tests {
+			v, err := s.Lookup(tt.q)
+			if err != nil {
+				t.Fatalf("scan failed %v", err)
+			}
+			keys := ""
+			for _, kv := range v.([]KV) {
+				keys += string(kv.Key)
+			}
+			if keys != tt.keys {
+				t.Errorf("%d, keys %s, want %s", idx, keys, tt.keys)
+			}
+		}
+	}
+	runKVTest(t, tf)
+}
+
+func TestTxnObservesEarlierWritesInSameBatch(t *testing.T) {
+	tf := func(t *testing.T, s *StateMachine) {
+		update(t, s, 0, EncodePut([]byte("k0"), []byte("v0")))
+		result := update(t, s, 1,
+			EncodePut([]byte("k1"), []byte("v1")),
+			txn.New().IfEqual([]byte("k1"), []byte("v1")).
+				Put([]byte("k2"), []byte("v2")).Encode(),
+			EncodeDeleteRange([]byte("k0"), []byte("k2")),
+			txn.New().IfExists([]byte("k0")).Put([]byte("k3"), []byte("v3")).Encode())
+		if result[1].Result.Value != txn.ResultCommitted {
+			t.Errorf("unexpected result %v", result[1].Result)
+		}
+		if result[3].Result.Value != txn.ResultConditionFailed {
+			t.Errorf("unexpected result %v", result[3].Result)
+		}
+		if v, ok := lookup(t, s, "k2"); !ok || v != "v2" {
+			t.Errorf("unexpected value %s, %t", v, ok)
+		}
+		for _, key := range []string{"k0", "k1", "k3"} {
+			if _, ok := lookup(t, s, key); ok {
+				t.Errorf("unexpected key %s", key)
+			}
+		}
+	}
+	runKVTest(t, tf)
+}
+
+func TestAppliedIndexIsReturnedByOpen(t *testing.T) {
+	tf := func(t *testing.T, s *StateMachine) {
+		update(t, s, 0, EncodePut([]byte("k1"), []byte("v1")),
+			EncodePut([]byte("k2"), []byte("v2")))
+		if err := s.Sync(); err != nil {
+			t.Fatalf("sync failed %v", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("close failed %v", err)
+		}
+		if _, err := s.Lookup(GetQuery{}); err != ErrStateMachineClosed {
+			t.Errorf("unexpected error %v", err)
+		}
+		s2 := NewStateMachineFactory(testDir)(1, 1)
+		index, err := s2.Open(nil)
+		if err != nil {
+			t.Fatalf("failed to open %v", err)
+		}
+		defer s2.Close()
+		if index != 2 {
+			t.Errorf("index %d, want 2", index)
+		}
+	}
+	runKVTest(t, tf)
+}
+
+func TestSnapshotCanBeSavedAndRecovered(t *testing.T) {
+	tf := func(t *testing.T, s *StateMachine) {
+		update(t, s, 0, EncodePut([]byte("k1"), []byte("v1")),
+			EncodePut([]byte("k2"), []byte("")))
+		ctx, err := s.PrepareSnapshot()
+		if err != nil {
+			t.Fatalf("prepare snapshot failed %v", err)
+		}
+		// not included in the snapshot
+		update(t, s, 2, EncodePut([]byte("k3"), []byte("v3")))
+		var buf bytes.Buffer
+		if err := s.SaveSnapshot(ctx, &buf, nil); err != nil {
+			t.Fatalf("save snapshot failed %v", err)
+		}
+		s2 := NewStateMachineFactory(testDir)(1, 2).(*StateMachine)
+		if _, err := s2.Open(nil); err != nil {
+			t.Fatalf("failed to open %v", err)
+		}
+		defer s2.Close()
+		update(t, s2, 0, EncodePut([]byte("k4"), []byte("v4")))
+		if err := s2.RecoverFromSnapshot(&buf, nil); err != nil {
+			t.Fatalf("recover failed %v", err)
+		}
+		if v, ok := lookup(t, s2, "k1"); !ok || v != "v1" {
+			t.Errorf("unexpected value %s, %t", v, ok)
+		}
+		if v, ok := lookup(t, s2, "k2"); !ok || v != "" {
+			t.Errorf("unexpected value %s, %t", v, ok)
+		}
+		for _, key := range []string{"k3", "k4"} {
+			if _, ok := lookup(t, s2, key); ok {
+				t.Errorf("unexpected key %s", key)
+			}
+		}
+		if err := s2.Close(); err != nil {
+			t.Fatalf("close failed %v", err)
+		}
+		s3 := NewStateMachineFactory(testDir)(1, 2)
+		index, err := s3.Open(nil)
+		if err != nil {
+			t.Fatalf("failed to open %v", err)
+		}
+		defer s3.Close()
+		if index != 2 {
+			t.Errorf("index %d, want 2", index)
+		}
+	}
+	runKVTest(t, tf)
+}
+
+func TestInterruptedRecoveryIsDiscardedOnOpen(t *testing.T) {
+	tf := func(t *testing.T, s *StateMachine) {
+		update(t, s, 0, EncodePut([]byte("k1"), []byte("v1")))
+		// truncated snapshot
+		var buf bytes.Buffer
+		buf.WriteByte(1)
+		if err := s.RecoverFromSnapshot(&buf, nil); err == nil {
+			t.Fatalf("truncated snapshot not reported")
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("close failed %v", err)
+		}
+		s2 := NewStateMachineFactory(testDir)(1, 1).(*StateMachine)
+		index, err := s2.Open(nil)
+		if err != nil {
+			t.Fatalf("failed to open %v", err)
+		}
+		defer s2.Close()
+		if index != 0 {
+			t.Errorf("index %d, want 0", index)
+		}
+		if _, ok := lookup(t, s2, "k1"); ok {
+			t.Errorf("unexpected key")
+		}
+	}
+	runKVTest(t, tf)
+}
+
+var _ INodeHost = (*dragonboat.NodeHost)(nil)
+
+type testNodeHost struct {
+	t     *testing.T
+	s     *StateMachine
+	index uint64
+}
+
+func (nh *testNodeHost) GetNoOPSession(clusterID uint64) *client.Session {
+	return client.NewNoOPSession(clusterID, random.LockGuardedRand)
+}
+
+func (nh *testNodeHost) SyncPropose(ctx context.Context,
+	session *client.Session, cmd []byte) (sm.Result, error) {
+	result := update(nh.t, nh.s, nh.index, cmd)
+	nh.index++
+	return result[0].Result, nil
+}
+
+func (nh *testNodeHost) SyncRead(ctx context.Context,
+	clusterID uint64, query interface{}) (interface{}, error) {
+	return nh.s.Lookup(query)
+}
+
+func TestClient(t *testing.T) {
+	tf := func(t *testing.T, s *StateMachine) {
+		c := NewClient(&testNodeHost{t: t, s: s}, 1)
+		ctx := context.Background()
+		if err := c.Put(ctx, []byte("k1"), []byte("v1")); err != nil {
+			t.Fatalf("put failed %v", err)
+		}
+		if err := c.Put(ctx, []byte("k2"), []byte("v2")); err != nil {
+			t.Fatalf("put failed %v", err)
+		}
+		v, ok, err := c.Get(ctx, []byte("k1"))
+		if err != nil || !ok || string(v) != "v1" {
+			t.Errorf("unexpected get result %s, %t, %v", v, ok, err)
+		}
+		ok, err = c.Txn(ctx, txn.New().IfNotExists([]byte("k1")).Delete([]byte("k2")))
+		if err != nil || ok {
+			t.Errorf("unexpected txn result %t, %v", ok, err)
+		}
+		if err := c.Delete(ctx, []byte("k1")); err != nil {
+			t.Fatalf("delete failed %v", err)
+		}
+		ok, err = c.Txn(ctx, txn.New().IfNotExists([]byte("k1")).Delete([]byte("k2")))
+		if err != nil || !ok {
+			t.Errorf("unexpected txn result %t, %v", ok, err)
+		}
+		if err := c.Put(ctx, []byte("k3"), []byte("v3")); err != nil {
+			t.Fatalf("put failed %v", err)
+		}
+		kvs, err := c.Scan(ctx, nil, nil, 0)
+		if err != nil || len(kvs) != 1 || string(kvs[0].Key) != "k3" {
+			t.Errorf("unexpected scan result %v, %v", kvs, err)
+		}
+		if err := c.DeleteRange(ctx, []byte("k"), []byte("l")); err != nil {
+			t.Fatalf("delete range failed %v", err)
+		}
+		if _, ok, _ := c.Get(ctx, []byte("k3")); ok {
+			t.Errorf("unexpected key")
+		}
+	}
+	runKVTest(t, tf)
+}
@@ -0,0 +1,424 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/cockroachdb/pebble"
+
+	"github.com/lni/dragonboat/v3/logger"
+	"github.com/lni/dragonboat/v3/plugin/txn"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+var (
+	plog = logger.GetLogger("kv")
+)
+
+var (
+	// ErrStateMachineClosed indicates that the state machine has been closed.
+	ErrStateMachineClosed = errors.New("state machine closed")
+	errInvalidSnapshot    = errors.New("invalid key-value snapshot")
+)
+
+const (
+	// keys of the metadata maintained by the state machine have the metaPrefix
+	// prefix, application keys have the dataPrefix prefix.
+	metaPrefix byte = 0x00
+	dataPrefix byte = 0x01
+	// recoverBatchSize is the size of each batch written when recovering from
+	// a snapshot.
+	recoverBatchSize = 4 * 1024 * 1024
+)
+
+var (
+	appliedIndexKey = []byte{metaPrefix, 'a'}
+	recoveringKey   = []byte{metaPrefix, 'r'}
+	keySpaceStart   = []byte{metaPrefix}
+	keySpaceEnd     = []byte{dataPrefix + 1}
+	syncWrite       = &pebble.WriteOptions{Sync: true}
+)
+
+// NewStateMachineFactory returns a factory function for creating pebble backed
+// key-value state machines. The state of each state machine is stored in a
+// sub-directory of dir named after its cluster ID and node ID.
+func NewStateMachineFactory(dir string) sm.CreateOnDiskStateMachineFunc {
+	return func(clusterID uint64, nodeID uint64) sm.IOnDiskStateMachine {
+		return NewStateMachine(clusterID, nodeID,
+			filepath.Join(dir, fmt.Sprintf("kv-%d-%d", clusterID, nodeID)))
+	}
+}
+
+// StateMachine is a pebble backed key-value state machine.
+type StateMachine struct {
+	clusterID uint64
+	nodeID    uint64
+	dir       string
+	mu        sync.RWMutex
+	db        *pebble.DB
+	closed    bool
+}
+
+var _ sm.IOnDiskStateMachine = (*StateMachine)(nil)
+
+// NewStateMachine creates a new key-value state machine with its state stored
+// in the specified directory.
+func NewStateMachine(clusterID uint64,
+	nodeID uint64, dir string) *StateMachine {
+	return &StateMachine{clusterID: clusterID, nodeID: nodeID, dir: dir}
+}
+
+// Open opens the pebble database and returns the index of the last applied
+// entry. A snapshot recovery interrupted by a crash is detected here, the
+// partially recovered state is discarded and 0 is returned so the state
+// machine will be recovered again.
+func (s *StateMachine) Open(stopc <-chan struct{}) (uint64, error) {
+	db, err := pebble.Open(s.dir, &pebble.Options{})
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.db = db
+	s.mu.Unlock()
+	_, recovering, err := get(db, recoveringKey)
+	if err != nil {
+		return 0, err
+	}
+	if recovering {
+		plog.Warningf("[%05d:%05d] discarding partially recovered state",
+			s.clusterID, s.nodeID)
+		b := db.NewBatch()
+		defer b.Close()
+		if err := b.DeleteRange(keySpaceStart, keySpaceEnd, nil); err != nil {
+			return 0, err
+		}
+		return 0, b.Commit(syncWrite)
+	}
+	v, ok, err := get(db, appliedIndexKey)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+// Update applies the entries in a single pebble batch together with the index
+// of the last entry. The batch is not synced, see Sync.
+func (s *StateMachine) Update(entries []sm.Entry) ([]sm.Entry, error) {
+	if len(entries) == 0 {
+		return entries, nil
+	}
+	b := s.db.NewIndexedBatch()
+	defer b.Close()
+	store := &batchStore{b: b}
+	for i := range entries {
+		result, err := apply(store, entries[i].Cmd)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Result = result
+	}
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], entries[len(entries)-1].Index)
+	if err := b.Set(appliedIndexKey, index[:], nil); err != nil {
+		return nil, err
+	}
+	if err := b.Commit(pebble.NoSync); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func apply(store *batchStore, cmd []byte) (sm.Result, error) {
+	if txn.IsTxn(cmd) {
+		return txn.Apply(store, cmd)
+	}
+	op, key, value, err := decode(cmd)
+	if err != nil {
+		return sm.Result{Value: ResultInvalid}, nil
+	}
+	switch op {
+	case opPut:
+		err = store.Put(key, value)
+	case opDelete:
+		err = store.Delete(key)
+	case opDeleteRange:
+		err = store.DeleteRange(key, value)
+	default:
+		panic("unknown op")
+	}
+	if err != nil {
+		return sm.Result{}, err
+	}
+	return sm.Result{Value: ResultApplied}, nil
+}
+
+// Lookup handles GetQuery and ScanQuery queries.
+func (s *StateMachine) Lookup(query interface{}) (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrStateMachineClosed
+	}
+	switch q := query.(type) {
+	case GetQuery:
+		v, ok, err := get(s.db, dataKey(q.Key))
+		if err != nil {
+			return nil, err
+		}
+		return GetResult{Value: v, Found: ok}, nil
+	case ScanQuery:
+		return s.scan(q), nil
+	default:
+		return nil, ErrInvalidQuery
+	}
+}
+
+func (s *StateMachine) scan(q ScanQuery) []KV {
+	opts := &pebble.IterOptions{
+		LowerBound: dataKey(q.Start),
+		UpperBound: keySpaceEnd,
+	}
+	if q.End != nil {
+		opts.UpperBound = dataKey(q.End)
+	}
+	iter := s.db.NewIter(opts)
+	defer iter.Close()
+	result := make([]KV, 0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		if q.Limit > 0 && len(result) >= q.Limit {
+			break
+		}
+		result = append(result, KV{
+			Key:   append([]byte(nil), iter.Key()[1:]...),
+			Value: append([]byte(nil), iter.Value()...),
+		})
+	}
+	return result
+}
+
+// Sync syncs the WAL of the pebble database.
+func (s *StateMachine) Sync() error {
+	return s.db.LogData(nil, syncWrite)
+}
+
+// PrepareSnapshot returns a pebble snapshot of the current state.
+func (s *StateMachine) PrepareSnapshot() (interface{}, error) {
+	return s.db.NewSnapshot(), nil
+}
+
+// SaveSnapshot writes all key-value pairs, including the metadata maintained
+// by the state machine, of the prepared pebble snapshot to w. Each pair is
+// prefixed by a non-zero byte, a zero byte marks the end of the snapshot.
+func (s *StateMachine) SaveSnapshot(ctx interface{},
+	w io.Writer, done <-chan struct{}) error {
+	ss := ctx.(*pebble.Snapshot)
+	defer ss.Close()
+	iter := ss.NewIter(&pebble.IterOptions{
+		LowerBound: keySpaceStart,
+		UpperBound: keySpaceEnd,
+	})
+	defer iter.Close()
+	bw := bufio.NewWriter(w)
+	count := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		count++
+		if count%1024 == 0 && isStopped(done) {
+			return sm.ErrSnapshotStopped
+		}
+		if err := bw.WriteByte(1); err != nil {
+			return err
+		}
+		if err := writeRecord(bw, iter.Key(), iter.Value()); err != nil {
+			return err
+		}
+	}
+	if err := bw.WriteByte(0); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// RecoverFromSnapshot replaces the state of the state machine with the one
+// saved by SaveSnapshot. The recovery is marked in the database until it is
+// done, see Open. Lookups made during the recovery might observe partially
+// recovered state.
+func (s *StateMachine) RecoverFromSnapshot(r io.Reader,
+	done <-chan struct{}) error {
+	b := s.db.NewBatch()
+	if err := b.DeleteRange(keySpaceStart, keySpaceEnd, nil); err != nil {
+		b.Close()
+		return err
+	}
+	if err := b.Set(recoveringKey, nil, nil); err != nil {
+		b.Close()
+		return err
+	}
+	if err := b.Commit(syncWrite); err != nil {
+		b.Close()
+		return err
+	}
+	b.Close()
+	br := bufio.NewReader(r)
+	b = s.db.NewBatch()
+	defer func() {
+		b.Close()
+	}()
+	for {
+		more, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if more == 0 {
+			break
+		}
+		key, value, err := readRecord(br)
+		if err != nil {
+			return err
+		}
+		if err := b.Set(key, value, nil); err != nil {
+			return err
+		}
+		if len(b.Repr()) >= recoverBatchSize {
+			if isStopped(done) {
+				return sm.ErrSnapshotStopped
+			}
+			if err := b.Commit(pebble.NoSync); err != nil {
+				return err
+			}
+			b.Close()
+			b = s.db.NewBatch()
+		}
+	}
+	if err := b.Delete(recoveringKey, nil); err != nil {
+		return err
+	}
+	return b.Commit(syncWrite)
+}
+
+// Close closes the pebble database.
+func (s *StateMachine) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.db == nil {
+		s.closed = true
+		return nil
+	}
+	s.closed = true
+	return s.db.Close()
+}
+
+type reader interface {
+	Get(key []byte) ([]byte, io.Closer, error)
+}
+
+func get(r reader, key []byte) ([]byte, bool, error) {
+	v, closer, err := r.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer closer.Close()
+	return append([]byte(nil), v...), true, nil
+}
+
+func dataKey(key []byte) []byte {
+	k := make([]byte, len(key)+1)
+	k[0] = dataPrefix
+	copy(k[1:], key)
+	return k
+}
+
+func isStopped(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+	}
+	return false
+}
+
+func writeRecord(w *bufio.Writer, key []byte, value []byte) error {
+	var v [binary.MaxVarintLen64]byte
+	for _, data := range [][]byte{key, value} {
+		n := binary.PutUvarint(v[:], uint64(len(data)))
+		if _, err := w.Write(v[:n]); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readRecord(r *bufio.Reader) ([]byte, []byte, error) {
+	var record [2][]byte
+	for i := range record {
+		sz, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sz > recoverBatchSize*16 {
+			return nil, nil, errInvalidSnapshot
+		}
+		record[i] = make([]byte, sz)
+		if _, err := io.ReadFull(r, record[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return record[0], record[1], nil
+}
+
+// batchStore is a txn.IStore backed by an indexed pebble batch, reads made
+// through it observe all writes made earlier in the same batch.
+type batchStore struct {
+	b *pebble.Batch
+}
+
+var _ txn.IStore = (*batchStore)(nil)
+
+func (s *batchStore) Get(key []byte) ([]byte, bool, error) {
+	k := dataKey(key)
+	iter := s.b.NewIter(&pebble.IterOptions{
+		LowerBound: k,
+		UpperBound: append(k, 0),
+	})
+	defer iter.Close()
+	if !iter.First() {
+		return nil, false, nil
+	}
+	return append([]byte(nil), iter.Value()...), true, nil
+}
+
+func (s *batchStore) Put(key []byte, value []byte) error {
+	return s.b.Set(dataKey(key), value, nil)
+}
+
+func (s *batchStore) Delete(key []byte) error {
+	return s.b.Delete(dataKey(key), nil)
+}
+
+func (s *batchStore) DeleteRange(start []byte, end []byte) error {
+	return s.b.DeleteRange(dataKey(start), dataKey(end), nil)
+}
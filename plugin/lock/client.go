@@ -0,0 +1,211 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat/v3/client"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+var (
+	// ErrLocked indicates that the lock is held by another owner.
+	ErrLocked = errors.New("lock held by another owner")
+	// ErrNotHeld indicates that the lock is not held using the specified
+	// fencing token, e.g. its lease has expired.
+	ErrNotHeld = errors.New("lock not held")
+	// ErrNoTimestamp indicates that the EntryTimestamp field of config.Config is
+	// not enabled on the leader.
+	ErrNoTimestamp = errors.New("entry timestamp not available")
+	// ErrRejected indicates that the command was rejected by the state machine.
+	ErrRejected = errors.New("command rejected by the state machine")
+	// ErrUnexpectedResult indicates that the result returned by the state
+	// machine is not of the expected type.
+	ErrUnexpectedResult = errors.New("unexpected query result")
+)
+
+// INodeHost is the interface of NodeHost methods used by Client, it is
+// implemented by *dragonboat.NodeHost.
+type INodeHost interface {
+	GetNoOPSession(clusterID uint64) *client.Session
+	SyncPropose(ctx context.Context,
+		session *client.Session, cmd []byte) (sm.Result, error)
+	SyncRead(ctx context.Context,
+		clusterID uint64, query interface{}) (interface{}, error)
+}
+
+// Client provides typed access to the locks managed by a Raft cluster.
+type Client struct {
+	nh        INodeHost
+	clusterID uint64
+}
+
+// NewClient returns a new Client for the locks managed by the specified Raft
+// cluster.
+func NewClient(nh INodeHost, clusterID uint64) *Client {
+	return &Client{nh: nh, clusterID: clusterID}
+}
+
+// Acquire acquires the named lock for the owner with a lease of the specified
+// TTL and returns the fencing token. ErrLocked is returned when the lock is
+// held by another owner.
+func (c *Client) Acquire(ctx context.Context,
+	name string, owner string, ttl time.Duration) (uint64, error) {
+	result, err := c.propose(ctx, EncodeAcquire(name, owner, ttl))
+	if err != nil {
+		if err == ErrNotHeld {
+			return 0, ErrLocked
+		}
+		return 0, err
+	}
+	if len(result.Data) != 8 {
+		return 0, ErrUnexpectedResult
+	}
+	return binary.BigEndian.Uint64(result.Data), nil
+}
+
+// KeepAlive renews the lease of the named lock held using the specified
+// fencing token. ErrNotHeld is returned when the lease has expired.
+func (c *Client) KeepAlive(ctx context.Context,
+	name string, token uint64, ttl time.Duration) error {
+	_, err := c.propose(ctx, EncodeKeepAlive(name, token, ttl))
+	return err
+}
+
+// Release releases the named lock held using the specified fencing token.
+func (c *Client) Release(ctx context.Context, name string, token uint64) error {
+	_, err := c.propose(ctx, EncodeRelease(name, token))
+	return err
+}
+
+// Get returns the lease of the named lock and a boolean value indicating
+// whether the lock is currently held, measured by the local clock.
+func (c *Client) Get(ctx context.Context, name string) (Lease, bool, error) {
+	v, err := c.nh.SyncRead(ctx, c.clusterID, Query{Name: name})
+	if err != nil {
+		return Lease{}, false, err
+	}
+	l, ok := v.(Lease)
+	if !ok {
+		return Lease{}, false, ErrUnexpectedResult
+	}
+	return l, l.Token > 0 && time.Now().Before(l.Expiry), nil
+}
+
+// Lock acquires the named lock for the owner and keeps its lease alive in the
+// background until Unlock is called or the lease is lost.
+func (c *Client) Lock(ctx context.Context,
+	name string, owner string, ttl time.Duration) (*Lock, error) {
+	// the lease is granted by the leader after the acquire request is sent,
+	// taking the sent time as the time of acquisition is thus conservative
+	acquired := time.Now()
+	token, err := c.Acquire(ctx, name, owner, ttl)
+	if err != nil {
+		return nil, err
+	}
+	l := &Lock{
+		c:       c,
+		name:    name,
+		token:   token,
+		ttl:     ttl,
+		stopper: syncutil.NewStopper(),
+		lostc:   make(chan struct{}),
+	}
+	l.stopper.RunWorker(func() {
+		l.keepAlive(acquired)
+	})
+	return l, nil
+}
+
+func (c *Client) propose(ctx context.Context, cmd []byte) (sm.Result, error) {
+	result, err := c.nh.SyncPropose(ctx, c.nh.GetNoOPSession(c.clusterID), cmd)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	switch result.Value {
+	case ResultOK:
+		return result, nil
+	case ResultNotHeld:
+		return sm.Result{}, ErrNotHeld
+	case ResultNoTimestamp:
+		return sm.Result{}, ErrNoTimestamp
+	default:
+		return sm.Result{}, ErrRejected
+	}
+}
+
+// Lock is a held lock with its lease kept alive in the background. The lease
+// is renewed every one third of its TTL.
+type Lock struct {
+	c       *Client
+	name    string
+	token   uint64
+	ttl     time.Duration
+	stopper *syncutil.Stopper
+	lostc   chan struct{}
+}
+
+// Token returns the fencing token of the lock.
+func (l *Lock) Token() uint64 {
+	return l.token
+}
+
+// Lost returns a channel closed once the lease is considered as lost, either
+// because it has been reported as expired or because it could not be renewed
+// for its TTL measured by the local clock.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lostc
+}
+
+// Unlock stops keeping the lease alive and releases the lock.
+func (l *Lock) Unlock(ctx context.Context) error {
+	l.stopper.Stop()
+	return l.c.Release(ctx, l.name, l.token)
+}
+
+// keepAlive renews the lease until the lock is unlocked or the lease is lost.
+// renewed is the time recorded right before the lease was acquired. The lease
+// is renewed by the leader after the keep-alive is sent, taking the sent time
+// as the renewal time is thus conservative.
+func (l *Lock) keepAlive(renewed time.Time) {
+	interval := l.ttl / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stopper.ShouldStop():
+			return
+		case <-ticker.C:
+			sent := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := l.c.KeepAlive(ctx, l.name, l.token, l.ttl)
+			cancel()
+			if err == nil {
+				renewed = sent
+				continue
+			}
+			if err == ErrNotHeld || time.Since(renewed) >= l.ttl {
+				close(l.lostc)
+				return
+			}
+		}
+	}
+}
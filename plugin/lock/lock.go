@@ -0,0 +1,365 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package lock provides replicated locks with leases and fencing tokens.
+
+Locks are maintained by the state machine returned by NewStateMachine, a single
+Raft cluster can manage any number of named locks. Each lock is held by an
+owner for a lease that expires unless it is kept alive. Every time a lock is
+acquired, it is assigned a fencing token, which is the Raft log index of the
+acquiring entry. Fencing tokens of a lock strictly increase, resources guarded
+by the lock can thus reject requests carrying tokens older than the latest one
+observed.
+
+Lease expiry is determined using the wall clock time of the Raft leader
+recorded in each entry, the EntryTimestamp field of config.Config is required
+to be enabled for all nodes of the Raft cluster. Commands applied without
+timestamps are rejected with ResultNoTimestamp.
+
+The Client type provides typed access to the locks, the Lock type returned by
+Client.Lock keeps the lease alive in the background until it is unlocked.
+*/
+package lock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+var (
+	// ErrInvalidQuery indicates that the query is not of a supported type.
+	ErrInvalidQuery = errors.New("invalid lock query")
+	errInvalidData  = errors.New("invalid lock data")
+)
+
+// magic is the prefix of encoded commands, the last byte is the version of the
+// wire format.
+var magic = []byte{0x00, 'd', 'b', 'l', 'c', 'k', 0x01}
+
+const (
+	opAcquire uint8 = iota
+	opKeepAlive
+	opRelease
+)
+
+const (
+	// ResultOK is the Value of the sm.Result returned when the command is
+	// applied. For acquire commands, the Data field contains the fencing token
+	// encoded as a big endian uint64.
+	ResultOK uint64 = iota + 1
+	// ResultNotHeld is the Value of the sm.Result returned when the lock is held
+	// by another owner for acquire commands, or when the lock is not held using
+	// the specified fencing token for keep-alive and release commands.
+	ResultNotHeld
+	// ResultNoTimestamp is the Value of the sm.Result returned when the entry
+	// doesn't have its timestamp recorded by the leader.
+	ResultNoTimestamp
+	// ResultInvalid is the Value of the sm.Result returned when the command is
+	// not a valid encoded lock command.
+	ResultInvalid
+)
+
+const (
+	// sweepInterval is the number of held locks after which expired locks are
+	// removed when a lock is acquired.
+	sweepInterval = 1024
+)
+
+// Lease describes a held lock.
+type Lease struct {
+	// Name is the name of the lock.
+	Name string
+	// Owner is the owner of the lock.
+	Owner string
+	// Token is the fencing token assigned when the lock was acquired.
+	Token uint64
+	// Expiry is the time when the lease expires, measured by the wall clock of
+	// the Raft leader.
+	Expiry time.Time
+}
+
+// Query is the query for getting the lease of the named lock, the result is a
+// Lease. The lease is returned as long as it has not been released or taken
+// over by another owner, use its Expiry to check whether it is still valid.
+type Query struct {
+	Name string
+}
+
+type command struct {
+	op    uint8
+	name  string
+	owner string
+	token uint64
+	ttl   uint64
+}
+
+func (c command) encode() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 64+len(c.name)+len(c.owner)))
+	buf.Write(magic)
+	buf.WriteByte(c.op)
+	writeString(buf, c.name)
+	writeString(buf, c.owner)
+	writeUvarint(buf, c.token)
+	writeUvarint(buf, c.ttl)
+	return buf.Bytes()
+}
+
+func decode(cmd []byte) (command, error) {
+	if !bytes.HasPrefix(cmd, magic) {
+		return command{}, errInvalidData
+	}
+	r := bytes.NewReader(cmd[len(magic):])
+	op, err := r.ReadByte()
+	if err != nil || op > opRelease {
+		return command{}, errInvalidData
+	}
+	c := command{op: op}
+	if c.name, err = readString(r); err != nil {
+		return command{}, err
+	}
+	if c.owner, err = readString(r); err != nil {
+		return command{}, err
+	}
+	if c.token, err = binary.ReadUvarint(r); err != nil {
+		return command{}, errInvalidData
+	}
+	if c.ttl, err = binary.ReadUvarint(r); err != nil {
+		return command{}, errInvalidData
+	}
+	if r.Len() != 0 {
+		return command{}, errInvalidData
+	}
+	return c, nil
+}
+
+// EncodeAcquire returns the command that acquires the named lock for the owner
+// with a lease of the specified TTL. Acquiring a lock already held by the same
+// owner renews its lease and keeps its fencing token.
+func EncodeAcquire(name string, owner string, ttl time.Duration) []byte {
+	return command{
+		op:    opAcquire,
+		name:  name,
+		owner: owner,
+		ttl:   uint64(ttl),
+	}.encode()
+}
+
+// EncodeKeepAlive returns the command that renews the lease of the named lock
+// held using the specified fencing token.
+func EncodeKeepAlive(name string, token uint64, ttl time.Duration) []byte {
+	return command{
+		op:    opKeepAlive,
+		name:  name,
+		token: token,
+		ttl:   uint64(ttl),
+	}.encode()
+}
+
+// EncodeRelease returns the command that releases the named lock held using
+// the specified fencing token.
+func EncodeRelease(name string, token uint64) []byte {
+	return command{op: opRelease, name: name, token: token}.encode()
+}
+
+type lease struct {
+	owner  string
+	token  uint64
+	expiry uint64
+}
+
+// StateMachine is the state machine maintaining replicated locks.
+type StateMachine struct {
+	leases map[string]*lease
+}
+
+var _ sm.IStateMachine = (*StateMachine)(nil)
+var _ sm.IEntryUpdater = (*StateMachine)(nil)
+
+// NewStateMachine creates a new lock state machine, it is a
+// sm.CreateStateMachineFunc.
+func NewStateMachine(clusterID uint64, nodeID uint64) sm.IStateMachine {
+	return &StateMachine{leases: make(map[string]*lease)}
+}
+
+// Update applies the lock command without its entry timestamp, lock commands
+// are thus rejected with ResultNoTimestamp. UpdateEntry is used instead when
+// the state machine is managed by Dragonboat.
+func (s *StateMachine) Update(cmd []byte) (sm.Result, error) {
+	return s.UpdateEntry(sm.Entry{Cmd: cmd})
+}
+
+// UpdateEntry applies the lock command.
+func (s *StateMachine) UpdateEntry(e sm.Entry) (sm.Result, error) {
+	c, err := decode(e.Cmd)
+	if err != nil {
+		return sm.Result{Value: ResultInvalid}, nil
+	}
+	if e.Timestamp == 0 {
+		return sm.Result{Value: ResultNoTimestamp}, nil
+	}
+	now := e.Timestamp
+	l, ok := s.leases[c.name]
+	if ok && l.expiry <= now {
+		delete(s.leases, c.name)
+		l, ok = nil, false
+	}
+	switch c.op {
+	case opAcquire:
+		if ok && l.owner != c.owner {
+			return sm.Result{Value: ResultNotHeld}, nil
+		}
+		if !ok {
+			if len(s.leases) > 0 && len(s.leases)%sweepInterval == 0 {
+				s.sweep(now)
+			}
+			l = &lease{owner: c.owner, token: e.Index}
+			s.leases[c.name] = l
+		}
+		l.expiry = now + c.ttl
+		var token [8]byte
+		binary.BigEndian.PutUint64(token[:], l.token)
+		return sm.Result{Value: ResultOK, Data: token[:]}, nil
+	case opKeepAlive:
+		if !ok || l.token != c.token {
+			return sm.Result{Value: ResultNotHeld}, nil
+		}
+		l.expiry = now + c.ttl
+		return sm.Result{Value: ResultOK}, nil
+	case opRelease:
+		if !ok || l.token != c.token {
+			return sm.Result{Value: ResultNotHeld}, nil
+		}
+		delete(s.leases, c.name)
+		return sm.Result{Value: ResultOK}, nil
+	default:
+		panic("unknown op")
+	}
+}
+
+func (s *StateMachine) sweep(now uint64) {
+	for name, l := range s.leases {
+		if l.expiry <= now {
+			delete(s.leases, name)
+		}
+	}
+}
+
+// Lookup handles Query queries.
+func (s *StateMachine) Lookup(query interface{}) (interface{}, error) {
+	q, ok := query.(Query)
+	if !ok {
+		return nil, ErrInvalidQuery
+	}
+	l, ok := s.leases[q.Name]
+	if !ok {
+		return Lease{}, nil
+	}
+	return Lease{
+		Name:   q.Name,
+		Owner:  l.owner,
+		Token:  l.token,
+		Expiry: time.Unix(0, int64(l.expiry)),
+	}, nil
+}
+
+// SaveSnapshot saves all leases sorted by lock names.
+func (s *StateMachine) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	names := make([]string, 0, len(s.leases))
+	for name := range s.leases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	writeUvarint(&buf, uint64(len(names)))
+	for _, name := range names {
+		l := s.leases[name]
+		writeString(&buf, name)
+		writeString(&buf, l.owner)
+		writeUvarint(&buf, l.token)
+		writeUvarint(&buf, l.expiry)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// RecoverFromSnapshot recovers the leases saved by SaveSnapshot.
+func (s *StateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	br := bytes.NewReader(data)
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	leases := make(map[string]*lease)
+	for i := uint64(0); i < count; i++ {
+		name, err := readString(br)
+		if err != nil {
+			return err
+		}
+		l := &lease{}
+		if l.owner, err = readString(br); err != nil {
+			return err
+		}
+		if l.token, err = binary.ReadUvarint(br); err != nil {
+			return err
+		}
+		if l.expiry, err = binary.ReadUvarint(br); err != nil {
+			return err
+		}
+		leases[name] = l
+	}
+	s.leases = leases
+	return nil
+}
+
+// Close closes the state machine.
+func (s *StateMachine) Close() error {
+	return nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var data [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(data[:], v)
+	buf.Write(data[:n])
+}
+
+func writeString(buf *bytes.Buffer, v string) {
+	writeUvarint(buf, uint64(len(v)))
+	buf.WriteString(v)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	sz, err := binary.ReadUvarint(r)
+	if err != nil || sz > uint64(r.Len()) {
+		return "", errInvalidData
+	}
+	data := make([]byte, sz)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", errInvalidData
+	}
+	return string(data), nil
+}
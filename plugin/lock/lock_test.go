@@ -0,0 +1,299 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lock
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/lni/goutils/random"
+
+	"github.com/lni/dragonboat/v3"
+	"github.com/lni/dragonboat/v3/client"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+func apply(t *testing.T, s sm.IStateMachine,
+	index uint64, ts uint64, cmd []byte) sm.Result {
+	e := sm.Entry{Index: index, Timestamp: ts, Cmd: cmd}
+	result, err := s.(sm.IEntryUpdater).UpdateEntry(e)
+	if err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	return result
+}
+
+func getToken(t *testing.T, result sm.Result) uint64 {
+	if result.Value != ResultOK || len(result.Data) != 8 {
+		t.Fatalf("unexpected result %v", result)
+	}
+	return binary.BigEndian.Uint64(result.Data)
+}
+
+func TestCommandCanBeEncodedAndDecoded(t *testing.T) {
+	c, err := decode(EncodeAcquire("l1", "o1", time.Second))
+	if err != nil || c.op != opAcquire || c.name != "l1" ||
+		c.owner != "o1" || c.ttl != uint64(time.Second) {
+		t.Errorf("unexpected decoded command %+v, %v", c, err)
+	}
+	c, err = decode(EncodeKeepAlive("l1", 10, time.Second))
+	if err != nil || c.op != opKeepAlive || c.token != 10 {
+		t.Errorf("unexpected decoded command %+v, %v", c, err)
+	}
+	cmd := EncodeRelease("l1", 10)
+	if _, err := decode(cmd[:len(cmd)-1]); err != errInvalidData {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestLockCanBeAcquiredAndReleased(t *testing.T) {
+	s := NewStateMachine(1, 1)
+	ttl := uint64(time.Second)
+	token := getToken(t, apply(t, s, 10, 100, EncodeAcquire("l1", "o1", time.Second)))
+	if token != 10 {
+		t.Errorf("token %d, want 10", token)
+	}
+	if r := apply(t, s, 11, 200, EncodeAcquire("l1", "o2", time.Second)); r.Value != ResultNotHeld {
+		t.Errorf("lock acquired by another owner, %v", r)
+	}
+	// re-entrant acquire keeps the token
+	if v := getToken(t, apply(t, s, 12, 300, EncodeAcquire("l1", "o1", time.Second))); v != 10 {
+		t.Errorf("token %d, want 10", v)
+	}
+	if r := apply(t, s, 13, 400, EncodeRelease("l1", 9)); r.Value != ResultNotHeld {
+		t.Errorf("released using stale token, %v", r)
+	}
+	if r := apply(t, s, 14, 500, EncodeRelease("l1", 10)); r.Value != ResultOK {
+		t.Errorf("failed to release, %v", r)
+	}
+	if v := getToken(t, apply(t, s, 15, 600, EncodeAcquire("l1", "o2", time.Second))); v != 15 {
+		t.Errorf("token %d, want 15", v)
+	}
+	v, err := s.Lookup(Query{Name: "l1"})
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	l := v.(Lease)
+	if l.Owner != "o2" || l.Token != 15 || uint64(l.Expiry.UnixNano()) != 600+ttl {
+		t.Errorf("unexpected lease %+v", l)
+	}
+}
+
+func TestLeaseExpiresUnlessKeptAlive(t *testing.T) {
+	s := NewStateMachine(1, 1)
+	ttl := uint64(time.Second)
+	token := getToken(t, apply(t, s, 1, 100, EncodeAcquire("l1", "o1", time.Second)))
+	if r := apply(t, s, 2, 100+ttl-1, EncodeKeepAlive("l1", token, time.Second)); r.Value != ResultOK {
+		t.Errorf("failed to keep alive, %v", r)
+	}
+	if r := apply(t, s, 3, 100+ttl+1, EncodeAcquire("l1", "o2", time.Second)); r.Value != ResultNotHeld {
+		t.Errorf("lock acquired by another owner, %v", r)
+	}
+	if r := apply(t, s, 4, 100+3*ttl, EncodeKeepAlive("l1", token, time.Second)); r.Value != ResultNotHeld {
+		t.Errorf("expired lease kept alive, %v", r)
+	}
+	if v := getToken(t, apply(t, s, 5, 100+3*ttl, EncodeAcquire("l1", "o2", time.Second))); v != 5 {
+		t.Errorf("token %d, want 5", v)
+	}
+}
+
+func TestCommandsWithoutTimestampAreRejected(t *testing.T) {
+	s := NewStateMachine(1, 1)
+	if r := apply(t, s, 1, 0, EncodeAcquire("l1", "o1", time.Second)); r.Value != ResultNoTimestamp {
+		t.Errorf("unexpected result %v", r)
+	}
+	if r, err := s.Update(EncodeAcquire("l1", "o1", time.Second)); err != nil || r.Value != ResultNoTimestamp {
+		t.Errorf("unexpected result %v, %v", r, err)
+	}
+	if r := apply(t, s, 1, 100, []byte("invalid")); r.Value != ResultInvalid {
+		t.Errorf("unexpected result %v", r)
+	}
+}
+
+func TestExpiredLeasesAreSwept(t *testing.T) {
+	s := NewStateMachine(1, 1).(*StateMachine)
+	for i := 0; i < sweepInterval; i++ {
+		name := string(rune('a'+i%26)) + string(rune('a'+i/26))
+		apply(t, s, uint64(i+1), 100, EncodeAcquire(name, "o1", time.Second))
+	}
+	if len(s.leases) != sweepInterval {
+		t.Fatalf("unexpected lease count %d", len(s.leases))
+	}
+	apply(t, s, sweepInterval+1, 100+uint64(time.Second),
+		EncodeAcquire("new", "o1", time.Second))
+	if len(s.leases) != 1 {
+		t.Errorf("expired leases not swept, %d", len(s.leases))
+	}
+}
+
+func TestSnapshotCanBeSavedAndRecovered(t *testing.T) {
+	s := NewStateMachine(1, 1)
+	apply(t, s, 1, 100, EncodeAcquire("l1", "o1", time.Second))
+	apply(t, s, 2, 200, EncodeAcquire("l2", "o2", time.Minute))
+	var buf bytes.Buffer
+	if err := s.SaveSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("save snapshot failed %v", err)
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+	s2 := NewStateMachine(1, 2)
+	if err := s2.RecoverFromSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("recover failed %v", err)
+	}
+	var buf2 bytes.Buffer
+	if err := s2.SaveSnapshot(&buf2, nil, nil); err != nil {
+		t.Fatalf("save snapshot failed %v", err)
+	}
+	if !bytes.Equal(data, buf2.Bytes()) {
+		t.Errorf("snapshot changed after recovery")
+	}
+	v, err := s2.Lookup(Query{Name: "l2"})
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	if l := v.(Lease); l.Owner != "o2" || l.Token != 2 {
+		t.Errorf("unexpected lease %+v", l)
+	}
+}
+
+var _ INodeHost = (*dragonboat.NodeHost)(nil)
+
+type testNodeHost struct {
+	t     *testing.T
+	mu    sync.Mutex
+	s     sm.IStateMachine
+	index uint64
+	// offset is added to the wall clock time when stamping entries
+	offset time.Duration
+	// delay is the time taken by each proposal
+	delay time.Duration
+	// err is returned by proposals when it is not nil
+	err error
+}
+
+func (nh *testNodeHost) GetNoOPSession(clusterID uint64) *client.Session {
+	return client.NewNoOPSession(clusterID, random.LockGuardedRand)
+}
+
+func (nh *testNodeHost) SyncPropose(ctx context.Context,
+	session *client.Session, cmd []byte) (sm.Result, error) {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	time.Sleep(nh.delay)
+	if nh.err != nil {
+		return sm.Result{}, nh.err
+	}
+	nh.index++
+	ts := uint64(time.Now().Add(nh.offset).UnixNano())
+	return apply(nh.t, nh.s, nh.index, ts, cmd), nil
+}
+
+func (nh *testNodeHost) SyncRead(ctx context.Context,
+	clusterID uint64, query interface{}) (interface{}, error) {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	return nh.s.Lookup(query)
+}
+
+func (nh *testNodeHost) setOffset(offset time.Duration) {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	nh.offset = offset
+}
+
+func TestLockIsKeptAlive(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	nh := &testNodeHost{t: t, s: NewStateMachine(1, 1)}
+	c := NewClient(nh, 1)
+	ctx := context.Background()
+	ttl := 150 * time.Millisecond
+	l, err := c.Lock(ctx, "l1", "o1", ttl)
+	if err != nil {
+		t.Fatalf("failed to lock %v", err)
+	}
+	if _, err := c.Lock(ctx, "l1", "o2", ttl); err != ErrLocked {
+		t.Errorf("unexpected error %v", err)
+	}
+	time.Sleep(3 * ttl)
+	lease, held, err := c.Get(ctx, "l1")
+	if err != nil || !held || lease.Token != l.Token() {
+		t.Errorf("lease not kept alive, %+v, %t, %v", lease, held, err)
+	}
+	select {
+	case <-l.Lost():
+		t.Errorf("lease lost")
+	default:
+	}
+	if err := l.Unlock(ctx); err != nil {
+		t.Fatalf("failed to unlock %v", err)
+	}
+	if _, held, _ := c.Get(ctx, "l1"); held {
+		t.Errorf("lock still held")
+	}
+}
+
+func TestLockLossIsReported(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	nh := &testNodeHost{t: t, s: NewStateMachine(1, 1)}
+	c := NewClient(nh, 1)
+	ctx := context.Background()
+	ttl := 150 * time.Millisecond
+	l, err := c.Lock(ctx, "l1", "o1", ttl)
+	if err != nil {
+		t.Fatalf("failed to lock %v", err)
+	}
+	// the lease expires when the leader clock jumps forward
+	nh.setOffset(time.Minute)
+	select {
+	case <-l.Lost():
+	case <-time.After(10 * ttl):
+		t.Errorf("lease loss not reported")
+	}
+	if err := l.Unlock(ctx); err != ErrNotHeld {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestLockLossIsMeasuredFromAcquisition(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	ttl := 300 * time.Millisecond
+	nh := &testNodeHost{t: t, s: NewStateMachine(1, 1), delay: ttl}
+	c := NewClient(nh, 1)
+	ctx := context.Background()
+	start := time.Now()
+	l, err := c.Lock(ctx, "l1", "o1", ttl)
+	if err != nil {
+		t.Fatalf("failed to lock %v", err)
+	}
+	nh.mu.Lock()
+	nh.delay = 0
+	nh.err = dragonboat.ErrTimeout
+	nh.mu.Unlock()
+	select {
+	case <-l.Lost():
+		// the first failed renewal happens ttl/3 after Lock returned, the lease
+		// acquired ttl before that must be considered as lost by then
+		if elapsed := time.Since(start); elapsed >= ttl*5/3 {
+			t.Errorf("lease loss reported too late, %v", elapsed)
+		}
+	case <-time.After(10 * ttl):
+		t.Errorf("lease loss not reported")
+	}
+	l.stopper.Stop()
+}
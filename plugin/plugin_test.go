@@ -21,7 +21,9 @@ import (
 	"github.com/lni/dragonboat/v3"
 	"github.com/lni/dragonboat/v3/config"
 	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/plugin/bbolt"
 	"github.com/lni/dragonboat/v3/plugin/rocksdb"
+	"github.com/lni/dragonboat/v3/plugin/wal"
 )
 
 var (
@@ -46,4 +48,6 @@ func testLogDBPluginCanBeUsed(t *testing.T, f config.LogDBFactory) {
 
 func TestLogDBPluginsCanBeUsed(t *testing.T) {
 	testLogDBPluginCanBeUsed(t, &rocksdb.Factory{})
+	testLogDBPluginCanBeUsed(t, &bbolt.Factory{})
+	testLogDBPluginCanBeUsed(t, &wal.Factory{})
 }
@@ -0,0 +1,520 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+/*
+Package quictransport implements a QUIC based transport module for exchanging
+Raft messages and snapshot chunks between NodeHost instances. It is designed
+for lossy WAN links, each connection returned by the transport module is an
+individual QUIC stream multiplexed over a single QUIC connection per remote
+NodeHost, packet losses on a stream used for snapshot chunks thus never block
+heartbeats and other Raft messages. TLS session resumption with 0-RTT is used
+when reconnecting to remote NodeHost instances to speed up recovery after link
+flaps.
+
+The QUIC based transport module can be selected by setting the
+NodeHostConfig.Expert.TransportFactory field to a Factory instance, all
+NodeHost instances of the same deployment are required to use the same
+transport module. As QUIC always encrypts traffic, a self-signed certificate
+is generated and certificates are not verified when NodeHostConfig.MutualTLS
+is not enabled, users are expected to enable MutualTLS to authenticate
+NodeHost instances.
+
+This package is a separate Go module as the quic-go library requires a more
+recent Go release than the dragonboat module.
+*/
+package quictransport
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/lni/goutils/stringutil"
+	"github.com/lni/goutils/syncutil"
+	"github.com/quic-go/quic-go"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/logger"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+var (
+	plog = logger.GetLogger("quictransport")
+)
+
+const (
+	// TransportName is the name of the QUIC based transport module.
+	TransportName = "quic-transport"
+	// alpn is the application protocol negotiated during TLS handshakes.
+	alpn             = "dragonboat-raft"
+	defaultKeepAlive = 5 * time.Second
+	headerSize       = 8
+	// payloadBufferSize is large enough for holding a snapshot chunk
+	payloadBufferSize = 2*1024*1024 + 1024*128
+)
+
+const (
+	raftStream     byte = 1
+	snapshotStream byte = 2
+)
+
+const (
+	chunkRejectedCode    quic.StreamErrorCode      = 1
+	transportStoppedCode quic.ApplicationErrorCode = 0
+)
+
+var (
+	// ErrStopped indicates that the transport module has been stopped.
+	ErrStopped = errors.New("transport stopped")
+	// ErrBadMessage indicates that an invalid message was received.
+	ErrBadMessage = errors.New("invalid message")
+)
+
+// Factory is the factory type for creating QUIC based transport modules.
+type Factory struct {
+	// Config is the QUIC configuration used for both listening and dialing,
+	// default values are used when it is nil. 0-RTT is always enabled.
+	Config *quic.Config
+}
+
+var _ config.TransportFactory = (*Factory)(nil)
+
+// Create creates a QUIC based transport module.
+func (f *Factory) Create(nhConfig config.NodeHostConfig,
+	handler raftio.MessageHandler,
+	chunkHandler raftio.ChunkHandler) raftio.ITransport {
+	return NewTransport(nhConfig, handler, chunkHandler, f.Config)
+}
+
+// Validate returns a boolean value indicating whether the specified address
+// is valid.
+func (f *Factory) Validate(addr string) bool {
+	return stringutil.IsValidAddress(addr)
+}
+
+// Transport is a QUIC based transport module.
+type Transport struct {
+	mu             sync.Mutex
+	stopped        bool
+	conns          map[string]quic.Connection
+	listener       *quic.EarlyListener
+	stopper        *syncutil.Stopper
+	ctx            context.Context
+	cancel         context.CancelFunc
+	sessionCache   tls.ClientSessionCache
+	quicConfig     *quic.Config
+	nhConfig       config.NodeHostConfig
+	requestHandler raftio.MessageHandler
+	chunkHandler   raftio.ChunkHandler
+}
+
+var _ raftio.ITransport = (*Transport)(nil)
+
+// NewTransport creates a new QUIC based transport module.
+func NewTransport(nhConfig config.NodeHostConfig,
+	requestHandler raftio.MessageHandler, chunkHandler raftio.ChunkHandler,
+	quicConfig *quic.Config) *Transport {
+	qc := &quic.Config{}
+	if quicConfig != nil {
+		qc = quicConfig.Clone()
+	}
+	qc.Allow0RTT = true
+	if qc.KeepAlivePeriod == 0 {
+		qc.KeepAlivePeriod = defaultKeepAlive
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Transport{
+		conns:          make(map[string]quic.Connection),
+		stopper:        syncutil.NewStopper(),
+		ctx:            ctx,
+		cancel:         cancel,
+		sessionCache:   tls.NewLRUClientSessionCache(0),
+		quicConfig:     qc,
+		nhConfig:       nhConfig,
+		requestHandler: requestHandler,
+		chunkHandler:   chunkHandler,
+	}
+}
+
+// Name returns the name of the transport module.
+func (t *Transport) Name() string {
+	return TransportName
+}
+
+// Start starts listening for incoming QUIC connections.
+func (t *Transport) Start() error {
+	tlsConfig, err := t.getServerTLSConfig()
+	if err != nil {
+		return err
+	}
+	listener, err := quic.ListenAddrEarly(t.nhConfig.GetListenAddress(),
+		tlsConfig, t.quicConfig)
+	if err != nil {
+		return err
+	}
+	t.listener = listener
+	t.stopper.RunWorker(func() {
+		for {
+			conn, err := listener.Accept(t.ctx)
+			if err != nil {
+				return
+			}
+			t.stopper.RunWorker(func() {
+				t.serveConn(conn)
+			})
+		}
+	})
+	return nil
+}
+
+// Stop stops the transport module.
+func (t *Transport) Stop() {
+	t.mu.Lock()
+	t.stopped = true
+	conns := t.conns
+	t.conns = make(map[string]quic.Connection)
+	t.mu.Unlock()
+	t.cancel()
+	for _, conn := range conns {
+		closeConn(conn)
+	}
+	// accepted connections are closed by their workers, the listener owning the
+	// underlying UDP socket is only closed after that so remote NodeHosts are
+	// notified
+	t.stopper.Stop()
+	if t.listener != nil {
+		if err := t.listener.Close(); err != nil {
+			plog.Errorf("failed to close the listener, %v", err)
+		}
+	}
+}
+
+// GetConnection returns a new raftio.IConnection for sending Raft messages to
+// the specified target.
+func (t *Transport) GetConnection(ctx context.Context,
+	target string) (raftio.IConnection, error) {
+	stream, err := t.openStream(ctx, target, raftStream)
+	if err != nil {
+		return nil, err
+	}
+	return &connection{stream: stream}, nil
+}
+
+// GetSnapshotConnection returns a new raftio.ISnapshotConnection for sending
+// snapshot chunks to the specified target.
+func (t *Transport) GetSnapshotConnection(ctx context.Context,
+	target string) (raftio.ISnapshotConnection, error) {
+	stream, err := t.openStream(ctx, target, snapshotStream)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotConnection{stream: stream}, nil
+}
+
+// openStream opens a new stream of the specified type to the target. The
+// stream is opened again over the replacement connection when 0-RTT is
+// rejected by the remote NodeHost, e.g. after the remote NodeHost restarted.
+func (t *Transport) openStream(ctx context.Context,
+	target string, kind byte) (quic.Stream, error) {
+	conn, err := t.getConnection(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := openStream(ctx, conn, kind)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		if conn, err = t.nextConnection(ctx, target, conn); err != nil {
+			return nil, err
+		}
+		stream, err = openStream(ctx, conn, kind)
+	}
+	return stream, err
+}
+
+// getConnection returns the QUIC connection to the specified target, it is
+// shared by all connections to the target and replaced once closed.
+func (t *Transport) getConnection(ctx context.Context,
+	target string) (quic.Connection, error) {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return nil, ErrStopped
+	}
+	conn, ok := t.conns[target]
+	t.mu.Unlock()
+	if ok && conn.Context().Err() == nil {
+		return conn, nil
+	}
+	tlsConfig, err := t.getClientTLSConfig(target)
+	if err != nil {
+		return nil, err
+	}
+	conn, err = quic.DialAddrEarly(ctx, target, tlsConfig, t.quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	return t.setConnection(target, nil, conn)
+}
+
+// nextConnection returns the connection replacing the specified connection
+// which had its 0-RTT data rejected.
+func (t *Transport) nextConnection(ctx context.Context,
+	target string, conn quic.Connection) (quic.Connection, error) {
+	ec, ok := conn.(quic.EarlyConnection)
+	if !ok {
+		return nil, quic.Err0RTTRejected
+	}
+	next, err := ec.NextConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t.setConnection(target, conn, next)
+}
+
+// setConnection records the specified connection as the connection to the
+// target unless another usable connection has been recorded since prev.
+func (t *Transport) setConnection(target string,
+	prev quic.Connection, conn quic.Connection) (quic.Connection, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		closeConn(conn)
+		return nil, ErrStopped
+	}
+	existing, ok := t.conns[target]
+	if ok && existing != prev && existing.Context().Err() == nil {
+		closeConn(conn)
+		return existing, nil
+	}
+	t.conns[target] = conn
+	return conn, nil
+}
+
+func (t *Transport) getServerTLSConfig() (*tls.Config, error) {
+	tlsConfig, err := t.nhConfig.GetServerTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		cert, err := newSelfSignedCert()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	tlsConfig.NextProtos = []string{alpn}
+	return tlsConfig, nil
+}
+
+func (t *Transport) getClientTLSConfig(target string) (*tls.Config, error) {
+	tlsConfig, err := t.nhConfig.GetClientTLSConfig(target)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	tlsConfig.NextProtos = []string{alpn}
+	tlsConfig.ClientSessionCache = t.sessionCache
+	return tlsConfig, nil
+}
+
+func (t *Transport) serveConn(conn quic.EarlyConnection) {
+	defer closeConn(conn)
+	for {
+		stream, err := conn.AcceptStream(t.ctx)
+		if err != nil {
+			return
+		}
+		t.stopper.RunWorker(func() {
+			t.serveStream(stream)
+		})
+	}
+}
+
+func (t *Transport) serveStream(stream quic.Stream) {
+	defer stream.CancelRead(0)
+	kind := make([]byte, 1)
+	if _, err := io.ReadFull(stream, kind); err != nil {
+		return
+	}
+	if kind[0] != raftStream && kind[0] != snapshotStream {
+		plog.Errorf("unknown stream type %d", kind[0])
+		return
+	}
+	header := make([]byte, headerSize)
+	tbuf := make([]byte, payloadBufferSize)
+	for {
+		if _, err := io.ReadFull(stream, header); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint64(header)
+		buf := tbuf
+		if size > uint64(len(tbuf)) {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			return
+		}
+		if kind[0] == raftStream {
+			batch := pb.MessageBatch{}
+			// tbuf is reused for the next message, large messages are read into
+			// their own buffers which can be referred by the received entries
+			unmarshal := batch.Unmarshal
+			if size > uint64(len(tbuf)) {
+				unmarshal = batch.UnmarshalNoCopy
+			}
+			if err := unmarshal(buf); err != nil {
+				return
+			}
+			t.requestHandler(batch)
+		} else {
+			chunk := pb.Chunk{}
+			if err := chunk.Unmarshal(buf); err != nil {
+				return
+			}
+			if !t.chunkHandler(chunk) {
+				plog.Errorf("chunk rejected, cluster %d node %d",
+					chunk.ClusterId, chunk.NodeId)
+				stream.CancelRead(chunkRejectedCode)
+				return
+			}
+		}
+	}
+}
+
+type connection struct {
+	stream quic.Stream
+	buf    bytes.Buffer
+}
+
+var _ raftio.IConnection = (*connection)(nil)
+
+// Close closes the connection.
+func (c *connection) Close() {
+	closeStream(c.stream)
+}
+
+// SendMessageBatch sends the specified message batch to the remote NodeHost.
+func (c *connection) SendMessageBatch(batch pb.MessageBatch) error {
+	data, err := batch.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return writeMessage(c.stream, &c.buf, data)
+}
+
+type snapshotConnection struct {
+	stream quic.Stream
+	buf    bytes.Buffer
+}
+
+var _ raftio.ISnapshotConnection = (*snapshotConnection)(nil)
+
+// Close closes the snapshot connection.
+func (c *snapshotConnection) Close() {
+	closeStream(c.stream)
+}
+
+// SendChunk sends the specified snapshot chunk to the remote NodeHost.
+func (c *snapshotConnection) SendChunk(chunk pb.Chunk) error {
+	data, err := chunk.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return writeMessage(c.stream, &c.buf, data)
+}
+
+func openStream(ctx context.Context,
+	conn quic.Connection, kind byte) (quic.Stream, error) {
+	// snapshot chunks are never sent as 0-RTT data as such data can be replayed
+	if ec, ok := conn.(quic.EarlyConnection); ok && kind == snapshotStream {
+		select {
+		case <-ec.HandshakeComplete():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write([]byte{kind}); err != nil {
+		stream.CancelWrite(0)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func writeMessage(stream quic.Stream, buf *bytes.Buffer, data []byte) error {
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint64(header, uint64(len(data)))
+	buf.Reset()
+	buf.Write(header)
+	buf.Write(data)
+	_, err := stream.Write(buf.Bytes())
+	return err
+}
+
+func closeStream(stream quic.Stream) {
+	if err := stream.Close(); err != nil {
+		plog.Debugf("failed to close the stream, %v", err)
+	}
+	stream.CancelRead(0)
+}
+
+func closeConn(conn quic.Connection) {
+	if err := conn.CloseWithError(transportStoppedCode, ""); err != nil {
+		plog.Debugf("failed to close the connection, %v", err)
+	}
+}
+
+// newSelfSignedCert generates a certificate used when MutualTLS is not
+// enabled, it only serves the purpose of encrypting traffic.
+func newSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "dragonboat"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader,
+		template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,333 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quictransport
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3"
+	"github.com/lni/dragonboat/v3/config"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+const (
+	serverAddress = "localhost:26321"
+	remoteAddress = "localhost:26322"
+)
+
+type noopSM struct{}
+
+func (n *noopSM) Update(data []byte) (sm.Result, error) {
+	return sm.Result{Value: uint64(len(data))}, nil
+}
+
+func (n *noopSM) Lookup(query interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (n *noopSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return nil
+}
+
+func (n *noopSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return nil
+}
+
+func (n *noopSM) Close() error { return nil }
+
+type testHandler struct {
+	mu          sync.Mutex
+	batches     []pb.MessageBatch
+	chunks      []pb.Chunk
+	rejectChunk bool
+}
+
+func (h *testHandler) handleMessageBatch(batch pb.MessageBatch) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.batches = append(h.batches, batch)
+}
+
+func (h *testHandler) handleChunk(chunk pb.Chunk) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rejectChunk {
+		return false
+	}
+	h.chunks = append(h.chunks, chunk)
+	return true
+}
+
+func (h *testHandler) counts() (int, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.batches), len(h.chunks)
+}
+
+func runTransportTest(t *testing.T,
+	tf func(t *testing.T, trans *Transport, h *testHandler)) {
+	h := &testHandler{}
+	nhConfig := config.NodeHostConfig{RaftAddress: serverAddress}
+	f := &Factory{}
+	trans := f.Create(nhConfig, h.handleMessageBatch, h.handleChunk)
+	if err := trans.Start(); err != nil {
+		t.Fatalf("failed to start transport %v", err)
+	}
+	defer trans.Stop()
+	tf(t, trans.(*Transport), h)
+}
+
+func waitForCounts(t *testing.T, h *testHandler, batches int, chunks int) {
+	for i := 0; i < 500; i++ {
+		b, c := h.counts()
+		if b == batches && c == chunks {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b, c := h.counts()
+	t.Fatalf("unexpected counts %d, %d, want %d, %d", b, c, batches, chunks)
+}
+
+func TestMessageBatchCanBeSent(t *testing.T) {
+	runTransportTest(t, func(t *testing.T, trans *Transport, h *testHandler) {
+		conn, err := trans.GetConnection(context.Background(), serverAddress)
+		if err != nil {
+			t.Fatalf("failed to get connection %v", err)
+		}
+		for i := uint64(1); i <= 10; i++ {
+			batch := pb.MessageBatch{
+				SourceAddress: serverAddress,
+				Requests: []pb.Message{
+					{
+						Type:      pb.Replicate,
+						ClusterId: 1,
+						To:        2,
+						From:      1,
+						Entries:   []pb.Entry{{Index: i, Cmd: make([]byte, 1024)}},
+					},
+				},
+			}
+			if err := conn.SendMessageBatch(batch); err != nil {
+				t.Fatalf("failed to send message batch %v", err)
+			}
+		}
+		conn.Close()
+		waitForCounts(t, h, 10, 0)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for i, batch := range h.batches {
+			if batch.SourceAddress != serverAddress ||
+				len(batch.Requests) != 1 ||
+				batch.Requests[0].Entries[0].Index != uint64(i+1) ||
+				len(batch.Requests[0].Entries[0].Cmd) != 1024 {
+				t.Errorf("unexpected batch %v", batch)
+			}
+		}
+	})
+}
+
+func TestLargeMessageBatchCanBeSent(t *testing.T) {
+	runTransportTest(t, func(t *testing.T, trans *Transport, h *testHandler) {
+		conn, err := trans.GetConnection(context.Background(), serverAddress)
+		if err != nil {
+			t.Fatalf("failed to get connection %v", err)
+		}
+		batch := pb.MessageBatch{
+			Requests: []pb.Message{
+				{
+					Type:    pb.Replicate,
+					Entries: []pb.Entry{{Index: 1, Cmd: make([]byte, 8*1024*1024)}},
+				},
+			},
+		}
+		if err := conn.SendMessageBatch(batch); err != nil {
+			t.Fatalf("failed to send message batch %v", err)
+		}
+		conn.Close()
+		waitForCounts(t, h, 1, 0)
+	})
+}
+
+func TestSnapshotChunksCanBeSent(t *testing.T) {
+	runTransportTest(t, func(t *testing.T, trans *Transport, h *testHandler) {
+		conn, err := trans.GetSnapshotConnection(context.Background(),
+			serverAddress)
+		if err != nil {
+			t.Fatalf("failed to get snapshot connection %v", err)
+		}
+		for i := uint64(0); i < 3; i++ {
+			chunk := pb.Chunk{
+				ClusterId:  1,
+				NodeId:     2,
+				ChunkId:    i,
+				ChunkCount: 3,
+				Data:       make([]byte, 1024),
+			}
+			if err := conn.SendChunk(chunk); err != nil {
+				t.Fatalf("failed to send chunk %v", err)
+			}
+		}
+		conn.Close()
+		waitForCounts(t, h, 0, 3)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for i, chunk := range h.chunks {
+			if chunk.ChunkId != uint64(i) || len(chunk.Data) != 1024 {
+				t.Errorf("unexpected chunk %v", chunk)
+			}
+		}
+	})
+}
+
+func TestRejectedChunkFailsTheSnapshotConnection(t *testing.T) {
+	runTransportTest(t, func(t *testing.T, trans *Transport, h *testHandler) {
+		h.rejectChunk = true
+		conn, err := trans.GetSnapshotConnection(context.Background(),
+			serverAddress)
+		if err != nil {
+			t.Fatalf("failed to get snapshot connection %v", err)
+		}
+		defer conn.Close()
+		chunk := pb.Chunk{ClusterId: 1, NodeId: 2, Data: make([]byte, 1024)}
+		for i := 0; i < 500; i++ {
+			if err := conn.SendChunk(chunk); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("rejected chunk didn't fail the connection")
+	})
+}
+
+func TestConnectionCanBeReestablishedAfterRemoteRestart(t *testing.T) {
+	h := &testHandler{}
+	nhConfig := config.NodeHostConfig{RaftAddress: remoteAddress}
+	remote := NewTransport(nhConfig, h.handleMessageBatch, h.handleChunk, nil)
+	if err := remote.Start(); err != nil {
+		t.Fatalf("failed to start transport %v", err)
+	}
+	runTransportTest(t, func(t *testing.T, trans *Transport, _ *testHandler) {
+		send := func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			conn, err := trans.GetConnection(ctx, remoteAddress)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			return conn.SendMessageBatch(pb.MessageBatch{})
+		}
+		if err := send(); err != nil {
+			t.Fatalf("failed to send message batch %v", err)
+		}
+		waitForCounts(t, h, 1, 0)
+		remote.Stop()
+		remote = NewTransport(nhConfig, h.handleMessageBatch, h.handleChunk, nil)
+		if err := remote.Start(); err != nil {
+			t.Fatalf("failed to restart transport %v", err)
+		}
+		defer remote.Stop()
+		for i := 0; i < 100; i++ {
+			if err := send(); err == nil {
+				b, _ := h.counts()
+				if b > 1 {
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("failed to reconnect")
+	})
+}
+
+func TestConnectionCanNotBeCreatedAfterStop(t *testing.T) {
+	h := &testHandler{}
+	nhConfig := config.NodeHostConfig{RaftAddress: serverAddress}
+	trans := NewTransport(nhConfig, h.handleMessageBatch, h.handleChunk, nil)
+	if err := trans.Start(); err != nil {
+		t.Fatalf("failed to start transport %v", err)
+	}
+	trans.Stop()
+	if _, err := trans.GetConnection(context.Background(),
+		serverAddress); err != ErrStopped {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestNodeHostsCanUseQUICTransport(t *testing.T) {
+	dir := "quictransport_test_dir_safe_to_delete"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("failed to remove dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+	members := map[uint64]string{
+		1: "localhost:26331",
+		2: "localhost:26332",
+	}
+	var nhs []*dragonboat.NodeHost
+	defer func() {
+		for _, nh := range nhs {
+			nh.Stop()
+		}
+	}()
+	for nodeID, addr := range members {
+		nhc := config.NodeHostConfig{
+			NodeHostDir:    filepath.Join(dir, addr),
+			RTTMillisecond: 20,
+			RaftAddress:    addr,
+			Expert: config.ExpertConfig{
+				TransportFactory: &Factory{},
+			},
+		}
+		nh, err := dragonboat.NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create nodehost %v", err)
+		}
+		nhs = append(nhs, nh)
+		rc := config.Config{
+			NodeID:       nodeID,
+			ClusterID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		create := func(uint64, uint64) sm.IStateMachine {
+			return &noopSM{}
+		}
+		if err := nh.StartCluster(members, false, create, rc); err != nil {
+			t.Fatalf("failed to start cluster %v", err)
+		}
+	}
+	session := nhs[0].GetNoOPSession(1)
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := nhs[0].SyncPropose(ctx, session, []byte("test"))
+		cancel()
+		if err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("failed to make proposal")
+}
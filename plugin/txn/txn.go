@@ -0,0 +1,364 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package txn provides single cluster mini-transactions, i.e. atomic multi-key
+compare-and-set operations, with a standard wire format.
+
+A transaction consists of a list of conditions and a list of operations. It is
+built and encoded on the client side using the Txn type, the encoded command is
+then proposed as a regular proposal. The state machine passes the command to
+Apply, which checks all conditions against the application keys stored in the
+state machine and applies all operations only when every condition holds. As
+both checks and updates are made within a single Update invocation, the
+transaction is atomic and is applied in the same deterministic manner on all
+replicas.
+
+Applications can mix transactions with other commands, IsTxn reports whether a
+command is an encoded transaction.
+*/
+package txn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+var (
+	// ErrInvalidTxn indicates that the command is not a valid encoded
+	// transaction.
+	ErrInvalidTxn = errors.New("invalid transaction")
+)
+
+// magic is the prefix of encoded transactions, the last byte is the version
+// of the wire format.
+var magic = []byte{0x00, 'd', 'b', 't', 'x', 'n', 0x01}
+
+// ConditionType is the type of a condition.
+type ConditionType uint8
+
+const (
+	// Exists requires the key to exist.
+	Exists ConditionType = iota
+	// NotExists requires the key to not exist.
+	NotExists
+	// Equal requires the key to exist with the specified value.
+	Equal
+	// NotEqual requires the key to either not exist or to have a value
+	// different from the specified one.
+	NotEqual
+)
+
+// OpType is the type of an operation.
+type OpType uint8
+
+const (
+	// Put sets the key to the specified value.
+	Put OpType = iota
+	// Delete removes the key.
+	Delete
+)
+
+// Condition is a condition checked before applying the transaction.
+type Condition struct {
+	Type  ConditionType
+	Key   []byte
+	Value []byte
+}
+
+// Op is an operation applied when all conditions hold.
+type Op struct {
+	Type  OpType
+	Key   []byte
+	Value []byte
+}
+
+// Txn is a mini-transaction.
+type Txn struct {
+	Conditions []Condition
+	Ops        []Op
+}
+
+// New returns a new empty transaction.
+func New() *Txn {
+	return &Txn{}
+}
+
+// IfExists adds a condition requiring the key to exist.
+func (t *Txn) IfExists(key []byte) *Txn {
+	t.Conditions = append(t.Conditions, Condition{Type: Exists, Key: key})
+	return t
+}
+
+// IfNotExists adds a condition requiring the key to not exist.
+func (t *Txn) IfNotExists(key []byte) *Txn {
+	t.Conditions = append(t.Conditions, Condition{Type: NotExists, Key: key})
+	return t
+}
+
+// IfEqual adds a condition requiring the key to have the specified value.
+func (t *Txn) IfEqual(key []byte, value []byte) *Txn {
+	t.Conditions = append(t.Conditions,
+		Condition{Type: Equal, Key: key, Value: value})
+	return t
+}
+
+// IfNotEqual adds a condition requiring the key to not have the specified
+// value.
+func (t *Txn) IfNotEqual(key []byte, value []byte) *Txn {
+	t.Conditions = append(t.Conditions,
+		Condition{Type: NotEqual, Key: key, Value: value})
+	return t
+}
+
+// Put adds an operation setting the key to the specified value.
+func (t *Txn) Put(key []byte, value []byte) *Txn {
+	t.Ops = append(t.Ops, Op{Type: Put, Key: key, Value: value})
+	return t
+}
+
+// Delete adds an operation removing the key.
+func (t *Txn) Delete(key []byte) *Txn {
+	t.Ops = append(t.Ops, Op{Type: Delete, Key: key})
+	return t
+}
+
+// Encode returns the encoded transaction that can be proposed.
+func (t *Txn) Encode() []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(magic)
+	writeUvarint(buf, uint64(len(t.Conditions)))
+	for _, c := range t.Conditions {
+		buf.WriteByte(byte(c.Type))
+		writeBytes(buf, c.Key)
+		writeBytes(buf, c.Value)
+	}
+	writeUvarint(buf, uint64(len(t.Ops)))
+	for _, op := range t.Ops {
+		buf.WriteByte(byte(op.Type))
+		writeBytes(buf, op.Key)
+		writeBytes(buf, op.Value)
+	}
+	return buf.Bytes()
+}
+
+// IsTxn returns a boolean value indicating whether the command is an encoded
+// transaction.
+func IsTxn(cmd []byte) bool {
+	return bytes.HasPrefix(cmd, magic)
+}
+
+// Decode decodes the encoded transaction.
+func Decode(cmd []byte) (*Txn, error) {
+	if !IsTxn(cmd) {
+		return nil, ErrInvalidTxn
+	}
+	r := bytes.NewReader(cmd[len(magic):])
+	t := &Txn{}
+	n, err := readCount(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		ct, key, value, err := readItem(r)
+		if err != nil {
+			return nil, err
+		}
+		if ConditionType(ct) > NotEqual {
+			return nil, ErrInvalidTxn
+		}
+		t.Conditions = append(t.Conditions,
+			Condition{Type: ConditionType(ct), Key: key, Value: value})
+	}
+	if n, err = readCount(r); err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		ot, key, value, err := readItem(r)
+		if err != nil {
+			return nil, err
+		}
+		if OpType(ot) > Delete {
+			return nil, ErrInvalidTxn
+		}
+		t.Ops = append(t.Ops, Op{Type: OpType(ot), Key: key, Value: value})
+	}
+	if r.Len() != 0 {
+		return nil, ErrInvalidTxn
+	}
+	return t, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	writeUvarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func readCount(r *bytes.Reader) (uint64, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return 0, ErrInvalidTxn
+	}
+	return n, nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := readCount(r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := r.Read(data); err != nil && n > 0 {
+		return nil, ErrInvalidTxn
+	}
+	return data, nil
+}
+
+func readItem(r *bytes.Reader) (uint8, []byte, []byte, error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, nil, ErrInvalidTxn
+	}
+	key, err := readBytes(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	value, err := readBytes(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return t, key, value, nil
+}
+
+// IStore is the interface of the application key-value data maintained by the
+// state machine. It is only accessed from the Update method of the state
+// machine.
+type IStore interface {
+	// Get returns the value of the key and a boolean value indicating whether
+	// the key exists.
+	Get(key []byte) ([]byte, bool, error)
+	// Put sets the key to the specified value.
+	Put(key []byte, value []byte) error
+	// Delete removes the key.
+	Delete(key []byte) error
+}
+
+// MapStore is an IStore backed by a map.
+type MapStore map[string][]byte
+
+var _ IStore = (MapStore)(nil)
+
+// Get returns the value of the key.
+func (m MapStore) Get(key []byte) ([]byte, bool, error) {
+	v, ok := m[string(key)]
+	return v, ok, nil
+}
+
+// Put sets the key to the specified value.
+func (m MapStore) Put(key []byte, value []byte) error {
+	m[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+// Delete removes the key.
+func (m MapStore) Delete(key []byte) error {
+	delete(m, string(key))
+	return nil
+}
+
+const (
+	// ResultCommitted is the Value of the sm.Result returned by Apply when all
+	// conditions hold and all operations have been applied.
+	ResultCommitted uint64 = iota + 1
+	// ResultConditionFailed is the Value of the sm.Result returned by Apply when
+	// a condition does not hold, the Data field contains the index of the first
+	// failed condition encoded as an uvarint.
+	ResultConditionFailed
+	// ResultInvalid is the Value of the sm.Result returned by Apply when the
+	// command is not a valid encoded transaction.
+	ResultInvalid
+)
+
+// Apply applies the encoded transaction to the specified store. It is expected
+// to be invoked from the Update method of the state machine. Malformed
+// commands are rejected with ResultInvalid, the returned error is the error
+// returned by the store.
+func Apply(store IStore, cmd []byte) (sm.Result, error) {
+	t, err := Decode(cmd)
+	if err != nil {
+		return sm.Result{Value: ResultInvalid}, nil
+	}
+	for i, c := range t.Conditions {
+		ok, err := check(store, c)
+		if err != nil {
+			return sm.Result{}, err
+		}
+		if !ok {
+			var tmp [binary.MaxVarintLen64]byte
+			n := binary.PutUvarint(tmp[:], uint64(i))
+			return sm.Result{Value: ResultConditionFailed, Data: tmp[:n]}, nil
+		}
+	}
+	for _, op := range t.Ops {
+		if op.Type == Put {
+			err = store.Put(op.Key, op.Value)
+		} else {
+			err = store.Delete(op.Key)
+		}
+		if err != nil {
+			return sm.Result{}, err
+		}
+	}
+	return sm.Result{Value: ResultCommitted}, nil
+}
+
+// GetFailedCondition returns the index of the first failed condition when the
+// specified result is a ResultConditionFailed result. The returned boolean
+// value is false for all other results.
+func GetFailedCondition(result sm.Result) (int, bool) {
+	if result.Value != ResultConditionFailed {
+		return 0, false
+	}
+	idx, n := binary.Uvarint(result.Data)
+	if n <= 0 {
+		return 0, false
+	}
+	return int(idx), true
+}
+
+func check(store IStore, c Condition) (bool, error) {
+	v, ok, err := store.Get(c.Key)
+	if err != nil {
+		return false, err
+	}
+	switch c.Type {
+	case Exists:
+		return ok, nil
+	case NotExists:
+		return !ok, nil
+	case Equal:
+		return ok && bytes.Equal(v, c.Value), nil
+	case NotEqual:
+		return !ok || !bytes.Equal(v, c.Value), nil
+	}
+	panic("unknown condition type")
+}
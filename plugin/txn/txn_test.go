@@ -0,0 +1,94 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package txn
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTxnCanBeEncodedAndDecoded(t *testing.T) {
+	txn := New().IfEqual([]byte("k1"), []byte("v1")).IfNotExists([]byte("k2")).
+		Put([]byte("k2"), []byte("v2")).Delete([]byte("k1"))
+	cmd := txn.Encode()
+	if !IsTxn(cmd) {
+		t.Fatalf("not a txn")
+	}
+	decoded, err := Decode(cmd)
+	if err != nil {
+		t.Fatalf("failed to decode %v", err)
+	}
+	if len(decoded.Conditions) != 2 || len(decoded.Ops) != 2 {
+		t.Fatalf("unexpected txn %+v", decoded)
+	}
+	if decoded.Conditions[0].Type != Equal ||
+		!bytes.Equal(decoded.Conditions[0].Value, []byte("v1")) ||
+		decoded.Ops[1].Type != Delete ||
+		!bytes.Equal(decoded.Ops[1].Key, []byte("k1")) {
+		t.Errorf("unexpected txn %+v", decoded)
+	}
+	for i := len(magic); i < len(cmd); i++ {
+		if _, err := Decode(cmd[:i]); err != ErrInvalidTxn {
+			t.Errorf("truncated txn not rejected, %d", i)
+		}
+	}
+	if IsTxn([]byte("k1")) {
+		t.Errorf("regular command considered as txn")
+	}
+}
+
+func TestTxnIsAppliedWhenAllConditionsHold(t *testing.T) {
+	store := MapStore{"k1": []byte("v1")}
+	cmd := New().IfEqual([]byte("k1"), []byte("v1")).IfExists([]byte("k1")).
+		IfNotExists([]byte("k2")).IfNotEqual([]byte("k2"), []byte("v2")).
+		Put([]byte("k2"), []byte("v2")).Delete([]byte("k1")).Encode()
+	result, err := Apply(store, cmd)
+	if err != nil {
+		t.Fatalf("apply failed %v", err)
+	}
+	if result.Value != ResultCommitted {
+		t.Fatalf("unexpected result %d", result.Value)
+	}
+	if _, ok := store["k1"]; ok {
+		t.Errorf("k1 not deleted")
+	}
+	if !bytes.Equal(store["k2"], []byte("v2")) {
+		t.Errorf("k2 not set")
+	}
+}
+
+func TestTxnIsNotAppliedWhenConditionFails(t *testing.T) {
+	store := MapStore{"k1": []byte("v1")}
+	cmd := New().IfExists([]byte("k1")).IfEqual([]byte("k1"), []byte("v2")).
+		Put([]byte("k2"), []byte("v2")).Encode()
+	result, err := Apply(store, cmd)
+	if err != nil {
+		t.Fatalf("apply failed %v", err)
+	}
+	idx, ok := GetFailedCondition(result)
+	if !ok || idx != 1 {
+		t.Errorf("unexpected failed condition %d, %t", idx, ok)
+	}
+	if len(store) != 1 {
+		t.Errorf("store changed")
+	}
+	result, err = Apply(store, []byte("k1"))
+	if err != nil || result.Value != ResultInvalid {
+		t.Errorf("invalid txn not rejected, %d, %v", result.Value, err)
+	}
+	if _, ok := GetFailedCondition(result); ok {
+		t.Errorf("unexpected failed condition")
+	}
+}
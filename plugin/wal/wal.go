@@ -0,0 +1,56 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package wal provides factory functions for creating LogDB instances backed by
+append-only segmented write ahead logs. Compared with the default key-value
+store based LogDB, it avoids the write amplification caused by LSM
+compactions as Raft entries are usually deleted shortly after being
+compacted.
+
+WARNING: the WAL based LogDB is experimental, DO NOT USE IT IN PRODUCTION.
+*/
+package wal
+
+import (
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/logdb/wal"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+// Factory is the factory type for creating WAL based LogDB.
+type Factory struct{}
+
+// Create creates WAL based LogDB.
+func (wf *Factory) Create(cfg config.NodeHostConfig,
+	cb config.LogDBCallback,
+	dirs []string, lldirs []string) (raftio.ILogDB, error) {
+	return NewLogDB(cfg, cb, dirs, lldirs)
+}
+
+// Name returns the name of the LogDB instance.
+func (wf *Factory) Name() string {
+	return "sharded-wal"
+}
+
+// NewLogDB is the factory function for creating WAL based LogDB instances.
+func NewLogDB(cfg config.NodeHostConfig, cb config.LogDBCallback,
+	dirs []string, lldirs []string) (raftio.ILogDB, error) {
+	fs := cfg.Expert.FS
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	return wal.NewLogDB(cfg, cb, dirs, lldirs, fs)
+}
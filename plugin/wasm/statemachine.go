@@ -0,0 +1,237 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+// stateMachine is a sm.IStateMachine implementation that forwards all
+// requests to an instantiated WebAssembly module.
+type stateMachine struct {
+	clusterID uint64
+	nodeID    uint64
+	runtime   IRuntime
+	code      []byte
+	inst      IInstance
+}
+
+var _ sm.IStateMachine = (*stateMachine)(nil)
+
+// NewStateMachineFactory returns a function that can be passed to
+// NodeHost.StartCluster for creating state machines backed by the specified
+// WebAssembly module. An error is returned when the module can not be
+// instantiated by the specified runtime.
+func NewStateMachineFactory(runtime IRuntime,
+	code []byte) (sm.CreateStateMachineFunc, error) {
+	inst, err := runtime.Instantiate(code)
+	if err != nil {
+		return nil, err
+	}
+	if err := inst.Close(); err != nil {
+		return nil, err
+	}
+	return func(clusterID uint64, nodeID uint64) sm.IStateMachine {
+		inst, err := runtime.Instantiate(code)
+		if err != nil {
+			panic(fmt.Sprintf("failed to instantiate module, %v", err))
+		}
+		return &stateMachine{
+			clusterID: clusterID,
+			nodeID:    nodeID,
+			runtime:   runtime,
+			code:      code,
+			inst:      inst,
+		}
+	}, nil
+}
+
+// Update updates the state machine. The Value field of the returned result is
+// the value returned by the update function of the module. For module swap
+// commands, Value is 1 when the module is swapped, or 0 when the new module is
+// rejected, in which case Data contains the reason of the rejection.
+func (s *stateMachine) Update(data []byte) (sm.Result, error) {
+	if isSwapCommand(data) {
+		return s.swap(data[len(swapMagic):])
+	}
+	ptr, sz, err := input(s.inst, data)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	v, err := call(s.inst, UpdateFunc, ptr, sz)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	return sm.Result{Value: v}, nil
+}
+
+// Lookup queries the state machine, the query is required to be a byte slice.
+func (s *stateMachine) Lookup(query interface{}) (interface{}, error) {
+	q, ok := query.([]byte)
+	if !ok {
+		return nil, ErrInvalidQuery
+	}
+	ptr, sz, err := input(s.inst, q)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := call(s.inst, LookupFunc, ptr, sz)
+	if err != nil {
+		return nil, err
+	}
+	return output(s.inst, loc)
+}
+
+// SaveSnapshot saves both the module and the state of the module.
+func (s *stateMachine) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	state, err := snapshot(s.inst)
+	if err != nil {
+		return err
+	}
+	if err := writeBlock(w, s.code); err != nil {
+		return err
+	}
+	return writeBlock(w, state)
+}
+
+// RecoverFromSnapshot recovers the state machine using the module and the
+// state found in the snapshot.
+func (s *stateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	code, err := readBlock(r)
+	if err != nil {
+		return err
+	}
+	state, err := readBlock(r)
+	if err != nil {
+		return err
+	}
+	inst, err := s.runtime.Instantiate(code)
+	if err != nil {
+		return err
+	}
+	if err := restore(inst, state); err != nil {
+		inst.Close()
+		return err
+	}
+	old := s.inst
+	s.inst, s.code = inst, code
+	return old.Close()
+}
+
+// Close closes the instance.
+func (s *stateMachine) Close() error {
+	return s.inst.Close()
+}
+
+func (s *stateMachine) swap(code []byte) (sm.Result, error) {
+	inst, err := s.runtime.Instantiate(code)
+	if err != nil {
+		return sm.Result{Data: []byte(err.Error())}, nil
+	}
+	state, err := snapshot(s.inst)
+	if err != nil {
+		inst.Close()
+		return sm.Result{}, err
+	}
+	if err := restore(inst, state); err != nil {
+		inst.Close()
+		return sm.Result{Data: []byte(err.Error())}, nil
+	}
+	old := s.inst
+	s.inst, s.code = inst, code
+	if err := old.Close(); err != nil {
+		return sm.Result{}, err
+	}
+	return sm.Result{Value: 1}, nil
+}
+
+func snapshot(inst IInstance) ([]byte, error) {
+	loc, err := call(inst, SnapshotFunc)
+	if err != nil {
+		return nil, err
+	}
+	return output(inst, loc)
+}
+
+func restore(inst IInstance, state []byte) error {
+	ptr, sz, err := input(inst, state)
+	if err != nil {
+		return err
+	}
+	_, err = inst.Call(RestoreFunc, ptr, sz)
+	return err
+}
+
+// input copies data into a buffer allocated in the linear memory of the
+// instance, the offset and size of the buffer are returned.
+func input(inst IInstance, data []byte) (uint64, uint64, error) {
+	sz := uint64(len(data))
+	ptr, err := call(inst, AllocFunc, sz)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !inst.Write(uint32(ptr), data) {
+		return 0, 0, ErrOutOfBounds
+	}
+	return ptr, sz, nil
+}
+
+// output returns a copy of the data located by the packed offset and size.
+func output(inst IInstance, loc uint64) ([]byte, error) {
+	data, ok := inst.Read(uint32(loc>>32), uint32(loc))
+	if !ok {
+		return nil, ErrOutOfBounds
+	}
+	return data, nil
+}
+
+func call(inst IInstance, name string, params ...uint64) (uint64, error) {
+	results, err := inst.Call(name, params...)
+	if err != nil {
+		return 0, err
+	}
+	if len(results) != 1 {
+		return 0, ErrUnexpectedResult
+	}
+	return results[0], nil
+}
+
+func writeBlock(w io.Writer, data []byte) error {
+	sz := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sz, uint64(len(data)))
+	if _, err := w.Write(sz); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readBlock(r io.Reader) ([]byte, error) {
+	sz := make([]byte, 8)
+	if _, err := io.ReadFull(r, sz); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint64(sz))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package wasm provides support for state machines implemented as WebAssembly
+modules.
+
+WebAssembly modules are deterministic and sandboxed, a faulty or malicious
+module can not access the host beyond the memory of its own instance. The
+package is not tied to any particular WebAssembly runtime, the runtime is
+plugged in by implementing the IRuntime and IInstance interfaces, e.g. by
+wrapping wazero or wasmer.
+
+The module is required to export the following functions -
+
+	alloc(size i32) i32
+	update(ptr i32, size i32) i64
+	lookup(ptr i32, size i32) i64
+	snapshot() i64
+	restore(ptr i32, size i32)
+
+alloc returns the offset of a newly allocated buffer with the specified size
+in the linear memory of the instance, the host uses it for passing input
+data to other exported functions. update returns the Value field of the
+sm.Result. lookup and snapshot return the location of their output data in the
+linear memory packed into a single i64 value, the offset is stored in the high
+32 bits and the size in the low 32 bits. restore replaces the state of the
+instance with the state previously returned by snapshot.
+
+The module can be hot-swapped by proposing the command returned by
+GetSwapCommand. Once applied, the state of the current module is moved into a
+new instance of the specified module and the current instance is closed. As
+the swap is an ordinary Raft log entry, all replicas swap the module at the
+same log index. The module is included in snapshots, so nodes recovered from
+snapshots always run the module used when the snapshot was taken.
+*/
+package wasm
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	// ErrInvalidQuery indicates that the query is not a byte slice.
+	ErrInvalidQuery = errors.New("query is not a byte slice")
+	// ErrOutOfBounds indicates that the module referenced memory out of the
+	// bounds of its linear memory.
+	ErrOutOfBounds = errors.New("memory access out of bounds")
+	// ErrUnexpectedResult indicates that an exported function returned
+	// unexpected number of results.
+	ErrUnexpectedResult = errors.New("unexpected number of results")
+)
+
+const (
+	// AllocFunc is the name of the exported function used for allocating
+	// buffers in the linear memory of the instance.
+	AllocFunc = "alloc"
+	// UpdateFunc is the name of the exported function used for updating the
+	// state machine.
+	UpdateFunc = "update"
+	// LookupFunc is the name of the exported function used for querying the
+	// state machine.
+	LookupFunc = "lookup"
+	// SnapshotFunc is the name of the exported function used for serializing
+	// the state of the state machine.
+	SnapshotFunc = "snapshot"
+	// RestoreFunc is the name of the exported function used for restoring the
+	// state of the state machine.
+	RestoreFunc = "restore"
+)
+
+// swapMagic is the prefix of module swap commands.
+var swapMagic = []byte{0x00, 'd', 'b', 'w', 'a', 's', 'm', 0x01}
+
+// IRuntime is the interface used for instantiating WebAssembly modules.
+type IRuntime interface {
+	// Instantiate compiles and instantiates the specified WebAssembly module.
+	Instantiate(code []byte) (IInstance, error)
+}
+
+// IInstance is an instantiated WebAssembly module.
+type IInstance interface {
+	// Call invokes the specified exported function.
+	Call(name string, params ...uint64) ([]uint64, error)
+	// Read returns a copy of the specified range of the linear memory. The
+	// returned boolean value is false when the range is out of bounds.
+	Read(offset uint32, size uint32) ([]byte, bool)
+	// Write copies data into the linear memory starting at the specified
+	// offset. The returned boolean value is false when the range is out of
+	// bounds.
+	Write(offset uint32, data []byte) bool
+	// Close releases all resources owned by the instance.
+	Close() error
+}
+
+// GetSwapCommand returns the command that can be proposed to hot-swap the
+// WebAssembly module of the state machine to the specified one.
+func GetSwapCommand(code []byte) []byte {
+	cmd := make([]byte, 0, len(swapMagic)+len(code))
+	cmd = append(cmd, swapMagic...)
+	return append(cmd, code...)
+}
+
+func isSwapCommand(cmd []byte) bool {
+	return bytes.HasPrefix(cmd, swapMagic)
+}
@@ -0,0 +1,207 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+// testRuntime emulates a runtime hosting counter modules, the module code is
+// the step used for incrementing the counter.
+type testRuntime struct{}
+
+func (testRuntime) Instantiate(code []byte) (IInstance, error) {
+	if len(code) != 1 || code[0] == 0 {
+		return nil, errors.New("invalid module")
+	}
+	return &testInstance{step: uint64(code[0]), memory: make([]byte, 1024)}, nil
+}
+
+type testInstance struct {
+	step    uint64
+	counter uint64
+	next    uint64
+	memory  []byte
+	closed  bool
+}
+
+func (i *testInstance) alloc(sz uint64) uint64 {
+	if i.next+sz > uint64(len(i.memory)) {
+		i.next = 0
+	}
+	ptr := i.next
+	i.next += sz
+	return ptr
+}
+
+func (i *testInstance) value() uint64 {
+	ptr := i.alloc(8)
+	binary.LittleEndian.PutUint64(i.memory[ptr:], i.counter)
+	return ptr<<32 | 8
+}
+
+func (i *testInstance) Call(name string, params ...uint64) ([]uint64, error) {
+	switch name {
+	case AllocFunc:
+		return []uint64{i.alloc(params[0])}, nil
+	case UpdateFunc:
+		i.counter += i.step
+		return []uint64{i.counter}, nil
+	case LookupFunc, SnapshotFunc:
+		return []uint64{i.value()}, nil
+	case RestoreFunc:
+		i.counter = binary.LittleEndian.Uint64(i.memory[params[0]:])
+		return nil, nil
+	}
+	return nil, errors.New("unknown function")
+}
+
+func (i *testInstance) Read(offset uint32, size uint32) ([]byte, bool) {
+	if uint64(offset)+uint64(size) > uint64(len(i.memory)) {
+		return nil, false
+	}
+	return append([]byte(nil), i.memory[offset:offset+size]...), true
+}
+
+func (i *testInstance) Write(offset uint32, data []byte) bool {
+	if uint64(offset)+uint64(len(data)) > uint64(len(i.memory)) {
+		return false
+	}
+	copy(i.memory[offset:], data)
+	return true
+}
+
+func (i *testInstance) Close() error {
+	i.closed = true
+	return nil
+}
+
+func getCounter(t *testing.T, s sm.IStateMachine) uint64 {
+	v, err := s.Lookup([]byte("counter"))
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	return binary.LittleEndian.Uint64(v.([]byte))
+}
+
+func TestInvalidModuleIsRejectedByFactory(t *testing.T) {
+	if _, err := NewStateMachineFactory(testRuntime{}, []byte{0}); err == nil {
+		t.Errorf("invalid module not rejected")
+	}
+}
+
+func TestStateMachineCanBeUpdatedAndQueried(t *testing.T) {
+	create, err := NewStateMachineFactory(testRuntime{}, []byte{1})
+	if err != nil {
+		t.Fatalf("failed to create factory %v", err)
+	}
+	s := create(1, 1)
+	defer s.Close()
+	for i := uint64(1); i <= 3; i++ {
+		result, err := s.Update([]byte("inc"))
+		if err != nil {
+			t.Fatalf("update failed %v", err)
+		}
+		if result.Value != i {
+			t.Errorf("result %d, want %d", result.Value, i)
+		}
+	}
+	if v := getCounter(t, s); v != 3 {
+		t.Errorf("counter %d, want 3", v)
+	}
+	if _, err := s.Lookup("counter"); err != ErrInvalidQuery {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestModuleCanBeHotSwapped(t *testing.T) {
+	create, err := NewStateMachineFactory(testRuntime{}, []byte{1})
+	if err != nil {
+		t.Fatalf("failed to create factory %v", err)
+	}
+	s := create(1, 1)
+	defer s.Close()
+	if _, err := s.Update([]byte("inc")); err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	old := s.(*stateMachine).inst.(*testInstance)
+	result, err := s.Update(GetSwapCommand([]byte{10}))
+	if err != nil {
+		t.Fatalf("swap failed %v", err)
+	}
+	if result.Value != 1 {
+		t.Errorf("module not swapped, %s", result.Data)
+	}
+	if !old.closed {
+		t.Errorf("old instance not closed")
+	}
+	result, err = s.Update([]byte("inc"))
+	if err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if result.Value != 11 {
+		t.Errorf("result %d, want 11", result.Value)
+	}
+	result, err = s.Update(GetSwapCommand([]byte{0}))
+	if err != nil {
+		t.Fatalf("swap failed %v", err)
+	}
+	if result.Value != 0 || len(result.Data) == 0 {
+		t.Errorf("invalid module not rejected")
+	}
+	if v := getCounter(t, s); v != 11 {
+		t.Errorf("counter %d, want 11", v)
+	}
+}
+
+func TestSnapshotContainsModule(t *testing.T) {
+	create, err := NewStateMachineFactory(testRuntime{}, []byte{1})
+	if err != nil {
+		t.Fatalf("failed to create factory %v", err)
+	}
+	s1 := create(1, 1)
+	defer s1.Close()
+	for _, cmd := range [][]byte{
+		[]byte("inc"), GetSwapCommand([]byte{5}), []byte("inc"),
+	} {
+		if _, err := s1.Update(cmd); err != nil {
+			t.Fatalf("update failed %v", err)
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := s1.SaveSnapshot(buf, nil, nil); err != nil {
+		t.Fatalf("save snapshot failed %v", err)
+	}
+	s2 := create(1, 2)
+	defer s2.Close()
+	if err := s2.RecoverFromSnapshot(buf, nil, nil); err != nil {
+		t.Fatalf("recover from snapshot failed %v", err)
+	}
+	if v := getCounter(t, s2); v != 6 {
+		t.Errorf("counter %d, want 6", v)
+	}
+	result, err := s2.Update([]byte("inc"))
+	if err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if result.Value != 11 {
+		t.Errorf("module in snapshot not used, result %d", result.Value)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+)
+
+const (
+	stepStage     = "step"
+	commitStage   = "commit"
+	applyStage    = "apply"
+	snapshotStage = "snapshot"
+	lookupStage   = "lookup"
+)
+
+// profilerLabels contains the pprof labels of a Raft node. Contexts carrying
+// the labels of all pipeline stages are created in advance so switching the
+// labels of engine worker goroutines doesn't cause any allocation.
+type profilerLabels struct {
+	step     context.Context
+	commit   context.Context
+	apply    context.Context
+	snapshot context.Context
+	lookup   pprof.LabelSet
+}
+
+func newProfilerLabels(enabled bool,
+	clusterID uint64, nodeID uint64) *profilerLabels {
+	if !enabled {
+		return nil
+	}
+	cid := strconv.FormatUint(clusterID, 10)
+	nid := strconv.FormatUint(nodeID, 10)
+	labels := func(stage string) pprof.LabelSet {
+		return pprof.Labels("clusterid", cid, "nodeid", nid, "stage", stage)
+	}
+	bg := context.Background()
+	return &profilerLabels{
+		step:     pprof.WithLabels(bg, labels(stepStage)),
+		commit:   pprof.WithLabels(bg, labels(commitStage)),
+		apply:    pprof.WithLabels(bg, labels(applyStage)),
+		snapshot: pprof.WithLabels(bg, labels(snapshotStage)),
+		lookup:   labels(lookupStage),
+	}
+}
+
+func (l *profilerLabels) set(stage string) {
+	if l == nil {
+		return
+	}
+	switch stage {
+	case stepStage:
+		pprof.SetGoroutineLabels(l.step)
+	case commitStage:
+		pprof.SetGoroutineLabels(l.commit)
+	case applyStage:
+		pprof.SetGoroutineLabels(l.apply)
+	case snapshotStage:
+		pprof.SetGoroutineLabels(l.snapshot)
+	default:
+		panic("unknown stage")
+	}
+}
+
+func (l *profilerLabels) reset() {
+	if l != nil {
+		pprof.SetGoroutineLabels(context.Background())
+	}
+}
+
+// do invokes f with the lookup labels of the node added to the labels carried
+// by the specified context. Labels of the calling goroutine are restored to
+// those carried by the context when f returns.
+func (l *profilerLabels) do(ctx context.Context, f func()) {
+	if l == nil {
+		f()
+		return
+	}
+	pprof.Do(ctx, l.lookup, func(context.Context) { f() })
+}
+
+// newWorkerLabels returns contexts carrying the pprof labels of the specified
+// number of engine workers of the specified stage. nil is returned when
+// profiler labels are disabled.
+func newWorkerLabels(enabled bool,
+	stage string, count uint64) []context.Context {
+	if !enabled {
+		return nil
+	}
+	result := make([]context.Context, count)
+	for i := uint64(0); i < count; i++ {
+		labels := pprof.Labels("stage", stage,
+			"worker", strconv.FormatUint(i+1, 10))
+		result[i] = pprof.WithLabels(context.Background(), labels)
+	}
+	return result
+}
+
+// setWorkerLabels sets the labels of the calling goroutine to those of the
+// specified worker, workerID starts from 1.
+func setWorkerLabels(labels []context.Context, workerID uint64) {
+	if labels != nil {
+		pprof.SetGoroutineLabels(labels[workerID-1])
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"runtime/pprof"
+	"testing"
+)
+
+func TestProfilerLabelsCanBeDisabled(t *testing.T) {
+	l := newProfilerLabels(false, 1, 2)
+	if l != nil {
+		t.Fatalf("unexpected labels")
+	}
+	l.set(stepStage)
+	l.reset()
+	called := false
+	l.do(context.Background(), func() { called = true })
+	if !called {
+		t.Errorf("f not called")
+	}
+	if newWorkerLabels(false, stepStage, 4) != nil {
+		t.Errorf("unexpected worker labels")
+	}
+	setWorkerLabels(nil, 1)
+}
+
+func TestProfilerLabelsAreSet(t *testing.T) {
+	l := newProfilerLabels(true, 100, 2)
+	tests := []struct {
+		ctx   context.Context
+		stage string
+	}{
+		{l.step, stepStage},
+		{l.commit, commitStage},
+		{l.apply, applyStage},
+		{l.snapshot, snapshotStage},
+	}
+	for idx, tt := range tests {
+		if v, _ := pprof.Label(tt.ctx, "clusterid"); v != "100" {
+			t.Errorf("%d, clusterid %s", idx, v)
+		}
+		if v, _ := pprof.Label(tt.ctx, "nodeid"); v != "2" {
+			t.Errorf("%d, nodeid %s", idx, v)
+		}
+		if v, _ := pprof.Label(tt.ctx, "stage"); v != tt.stage {
+			t.Errorf("%d, stage %s, want %s", idx, v, tt.stage)
+		}
+		l.set(tt.stage)
+	}
+	l.reset()
+	called := false
+	l.do(context.Background(), func() { called = true })
+	if !called {
+		t.Errorf("f not called")
+	}
+	wl := newWorkerLabels(true, applyStage, 3)
+	if len(wl) != 3 {
+		t.Fatalf("unexpected worker label count %d", len(wl))
+	}
+	if v, _ := pprof.Label(wl[2], "worker"); v != "3" {
+		t.Errorf("worker %s, want 3", v)
+	}
+	if v, _ := pprof.Label(wl[0], "stage"); v != applyStage {
+		t.Errorf("stage %s, want %s", v, applyStage)
+	}
+	setWorkerLabels(wl, 1)
+	pprof.SetGoroutineLabels(context.Background())
+}
+
+func TestProfilerLabelsPanicOnUnknownStage(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("panic not triggered")
+		}
+	}()
+	newProfilerLabels(true, 1, 1).set(lookupStage)
+}
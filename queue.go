@@ -72,6 +72,12 @@ func (q *entryQueue) add(ent pb.Entry) (bool, bool) {
 	return true, false
 }
 
+func (q *entryQueue) isPaused() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.paused
+}
+
 func (q *entryQueue) gc() {
 	if q.lazyFreeCycle > 0 {
 		oldq := q.targetQueue()
@@ -184,6 +190,12 @@ func (r *readyCluster) setClusterReady(clusterID uint64) {
 	r.mu.Unlock()
 }
 
+func (r *readyCluster) count() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return uint64(len(r.ready))
+}
+
 func (r *readyCluster) getReadyClusters() map[uint64]struct{} {
 	m := r.maps[(r.index+1)%2]
 	for k := range m {
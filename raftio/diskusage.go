@@ -0,0 +1,79 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftio
+
+// DirUsage is the disk space used by a directory.
+type DirUsage struct {
+	// Path is the path of the directory.
+	Path string
+	// Bytes is the total size of all files found in the directory and its
+	// sub-directories.
+	Bytes uint64
+}
+
+// NodeDiskUsage is the disk space attributable to a Raft node.
+type NodeDiskUsage struct {
+	ClusterID uint64
+	NodeID    uint64
+	// Managed indicates whether the node is currently managed by the NodeHost.
+	// Unmanaged nodes are nodes that have been stopped or removed, their data
+	// can be removed using the CleanupOrphanedData method of the NodeHost.
+	Managed bool
+	// SnapshotDir is the path of the snapshot directory of the node.
+	SnapshotDir string
+	// SnapshotBytes is the size of saved snapshots of the node.
+	SnapshotBytes uint64
+	// TempBytes is the size of snapshots being generated or received, it
+	// includes leftovers of snapshots that were not completed.
+	TempBytes uint64
+	// LogDBBytes is the approximate size of Raft Log entries of the node stored
+	// in the shared LogDB. It is 0 when the LogDB in use doesn't implement the
+	// ICompactionEstimator interface.
+	LogDBBytes uint64
+}
+
+// DiskUsage is the disk space used by a NodeHost, with a breakdown per Raft
+// node for snapshots and Raft Log entries.
+type DiskUsage struct {
+	// LogDB is the disk space used by the LogDB directory, excluding snapshot
+	// directories stored under the same parent directory. It also includes
+	// small metadata files maintained by the NodeHost.
+	LogDB DirUsage
+	// WAL is the disk space used by the dedicated WAL directory, it is empty
+	// when NodeHostConfig.WALDir is not set.
+	WAL DirUsage
+	// SnapshotBytes is the total size of saved snapshots of all Raft nodes.
+	SnapshotBytes uint64
+	// TempBytes is the total size of snapshots being generated or received by
+	// all Raft nodes.
+	TempBytes uint64
+	// Nodes is the disk space attributable to each Raft node with data found on
+	// the NodeHost, sorted by ClusterID and NodeID.
+	Nodes []NodeDiskUsage
+}
+
+// TotalBytes returns the total disk space used by the NodeHost.
+func (u *DiskUsage) TotalBytes() uint64 {
+	return u.LogDB.Bytes + u.WAL.Bytes + u.SnapshotBytes + u.TempBytes
+}
+
+// IDiskUsageListener is the interface used for periodically reporting disk
+// usage of the NodeHost to external disk managers, e.g. kubelet style eviction
+// logic.
+type IDiskUsageListener interface {
+	// DiskUsageUpdated is invoked with the latest disk usage of the NodeHost
+	// from a dedicated goroutine.
+	DiskUsageUpdated(usage DiskUsage)
+}
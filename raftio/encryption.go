@@ -0,0 +1,50 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftio
+
+import (
+	"crypto/cipher"
+)
+
+// IEncryptionProvider is the interface used for providing authenticated
+// encryption ciphers for encrypting snapshot images. Each cipher is identified
+// by a key ID, the ID of the key used for encrypting a snapshot image is
+// recorded in the snapshot header so images encrypted using previous keys can
+// still be decrypted after keys have been rotated.
+type IEncryptionProvider interface {
+	// KeyID returns the ID of the key to be used for encrypting new snapshot
+	// images. The returned key ID must not be empty.
+	KeyID() string
+	// AEAD returns the authenticated encryption cipher associated with the
+	// specified key ID.
+	AEAD(keyID string) (cipher.AEAD, error)
+}
+
+// ITransportEncryptionProvider is the interface used for providing
+// authenticated encryption ciphers for encrypting Raft messages and snapshot
+// chunks exchanged between NodeHost instances. The encryption is applied at
+// the application layer, data thus remains protected when TLS is terminated
+// by proxies between NodeHost instances.
+type ITransportEncryptionProvider interface {
+	// KeyID returns the ID of the key to be used for encrypting data sent to
+	// the NodeHost identified by the specified target address, different keys
+	// can thus be used for different peers. The returned key ID must not be
+	// empty.
+	KeyID(target string) string
+	// AEAD returns the authenticated encryption cipher associated with the
+	// specified key ID. It is used for both encrypting data to be sent and
+	// decrypting received data.
+	AEAD(keyID string) (cipher.AEAD, error)
+}
@@ -14,6 +14,12 @@
 
 package raftio
 
+import (
+	"context"
+
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
 const (
 	// NoLeader is a special leader ID value to indicate that there is currently
 	// no leader or leader ID is unknown.
@@ -22,10 +28,11 @@ const (
 
 // LeaderInfo contains info on Raft leader.
 type LeaderInfo struct {
-	ClusterID uint64
-	NodeID    uint64
-	Term      uint64
-	LeaderID  uint64
+	ClusterID   uint64
+	NodeID      uint64
+	Term        uint64
+	LeaderID    uint64
+	ClusterName string
 }
 
 // IRaftEventListener is the interface to allow users to get notified for
@@ -73,3 +80,132 @@ type ISystemEventListener interface {
 	LogCompacted(info EntryInfo)
 	LogDBCompacted(info EntryInfo)
 }
+
+// NodePanicInfo contains info of a node stopped after its state machine
+// panicked.
+type NodePanicInfo struct {
+	ClusterID uint64
+	NodeID    uint64
+	// Reason is the value recovered from the panic formatted as a string.
+	Reason string
+	// Restart indicates whether the node is going to be automatically
+	// restarted.
+	Restart bool
+}
+
+// INodePanicListener is an optional interface that can be implemented by the
+// ISystemEventListener instance to get notified when a node is stopped after
+// its state machine panicked, see the PanicPolicy field of config.Config for
+// details.
+type INodePanicListener interface {
+	NodePanicked(info NodePanicInfo)
+}
+
+// ChecksumMismatchInfo contains info of a committed entry found to be
+// corrupted by a local Raft node.
+type ChecksumMismatchInfo struct {
+	ClusterID uint64
+	NodeID    uint64
+	// Index is the last applied index of the node, the corrupted entry is
+	// after it.
+	Index uint64
+	// Reason describes the corrupted entry.
+	Reason string
+}
+
+// IChecksumMismatchListener is an optional interface that can be implemented
+// by the ISystemEventListener instance to get notified when a node detects a
+// committed entry that doesn't match its checksum, see the
+// ChecksumMismatchPolicy field of config.Config for details.
+type IChecksumMismatchListener interface {
+	ChecksumMismatch(info ChecksumMismatchInfo)
+}
+
+// AddressChangedInfo contains info of a remote NodeHost address resolved to a
+// different set of IP addresses.
+type AddressChangedInfo struct {
+	// Address is the address of the remote NodeHost in the hostname:port form.
+	Address string
+	// Previous is the list of previously resolved IP addresses.
+	Previous []string
+	// Current is the list of currently resolved IP addresses.
+	Current []string
+}
+
+// IAddressChangedListener is an optional interface that can be implemented by
+// the ISystemEventListener instance to get notified when the hostname of a
+// remote NodeHost is resolved to different IP addresses, see the
+// PeerAddressRefreshInterval field of config.NodeHostConfig for details.
+type IAddressChangedListener interface {
+	AddressChanged(info AddressChangedInfo)
+}
+
+// PeerHealthInfo contains info of a remote NodeHost that transitioned between
+// the reachable and unreachable states.
+type PeerHealthInfo struct {
+	// Address is the address of the remote NodeHost.
+	Address string
+	// Reachable indicates whether the remote NodeHost became reachable.
+	Reachable bool
+}
+
+// IPeerHealthListener is an optional interface that can be implemented by the
+// ISystemEventListener instance to get notified when a remote NodeHost becomes
+// unreachable after a connection failure and when it becomes reachable again,
+// see the PeerBackoff field of config.NodeHostConfig for details.
+type IPeerHealthListener interface {
+	PeerHealthChanged(info PeerHealthInfo)
+}
+
+// SavedSnapshotInfo contains info of a snapshot saved by a local Raft node.
+type SavedSnapshotInfo struct {
+	ClusterID uint64
+	NodeID    uint64
+	Index     uint64
+	Term      uint64
+	// Filepath is the path of the snapshot image file.
+	Filepath string
+	// Files are the paths of the external files included in the snapshot.
+	Files []string
+}
+
+// ISnapshotSaveHook is the interface used for notifying applications of saved
+// snapshots so the snapshot image can be published to external systems or
+// used for deriving other application specific artifacts.
+type ISnapshotSaveHook interface {
+	// SnapshotSaved is invoked after a snapshot is successfully saved and before
+	// any log compaction or removal of older snapshots. Snapshot files
+	// described by info are guaranteed to exist until SnapshotSaved returns or
+	// the specified context is done, implementations are expected to copy
+	// required content before returning. Returned errors are logged and don't
+	// affect the saved snapshot.
+	SnapshotSaved(ctx context.Context, info SavedSnapshotInfo) error
+}
+
+// ConfigChangeRequestInfo contains info of a membership change request
+// received by the leader of a Raft cluster.
+type ConfigChangeRequestInfo struct {
+	ClusterID uint64
+	// LeaderID is the NodeID of the leader node that received the request.
+	LeaderID uint64
+	// From is the NodeID of the node on which the request was made, it is the
+	// same as LeaderID when the request was made on the leader node.
+	From    uint64
+	Type    pb.ConfigChangeType
+	NodeID  uint64
+	Address string
+}
+
+// IConfigChangeHook is the interface used for enforcing centralized policies
+// on membership changes, e.g. change freeze windows.
+type IConfigChangeHook interface {
+	// ConfigChangeRequested is invoked on the leader node for each membership
+	// change request before it is appended to the Raft log and replicated,
+	// including requests made on other nodes of the Raft cluster and forwarded
+	// to the leader. Returning a non-nil error vetoes the request, it is then
+	// completed as rejected on the node on which it was made. The returned
+	// address replaces the Address of the request, allowing requests to be
+	// annotated, e.g. with normalized addresses. ConfigChangeRequested is
+	// invoked from the execution engine, it is expected to return quickly.
+	ConfigChangeRequested(info ConfigChangeRequestInfo) (string, error)
+}
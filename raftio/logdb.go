@@ -109,3 +109,80 @@ type ILogDB interface {
 	// metadata in the logdb.
 	ImportSnapshot(snapshot pb.Snapshot, nodeID uint64) error
 }
+
+// CompactionEstimate is the estimated outcome of compacting Raft log entries
+// of a Raft node up to a specified index.
+type CompactionEstimate struct {
+	// EntryCount is the number of entries that would be removed.
+	EntryCount uint64
+	// Bytes is the approximate number of bytes that would be reclaimed.
+	Bytes uint64
+}
+
+// ICompactionEstimator is an optional interface implemented by ILogDB types
+// that can estimate how much storage space would be reclaimed by compacting
+// Raft log entries without actually compacting them.
+type ICompactionEstimator interface {
+	// EstimateCompaction reports the number of entries and the approximate
+	// number of bytes that would be reclaimed by removing and compacting
+	// entries of the specified Raft node up to the specified index.
+	EstimateCompaction(clusterID uint64,
+		nodeID uint64, index uint64) (CompactionEstimate, error)
+}
+
+// EntryCacheStats contains statistics of the LogDB entry read cache.
+type EntryCacheStats struct {
+	// Hits is the number of entries served from the cache.
+	Hits uint64
+	// Misses is the number of entries read from the underlying storage.
+	Misses uint64
+	// Evictions is the number of entries evicted from the cache.
+	Evictions uint64
+	// Entries is the number of entries currently in the cache.
+	Entries uint64
+	// Bytes is the approximate size of entries currently in the cache.
+	Bytes uint64
+}
+
+// IEntryCacheStatsReporter is an optional interface implemented by ILogDB
+// types that cache Raft log entries read from the underlying storage.
+type IEntryCacheStatsReporter interface {
+	// GetEntryCacheStats returns the statistics of the entry read cache.
+	GetEntryCacheStats() EntryCacheStats
+}
+
+// NodeScanResult is the result of scanning LogDB records of a Raft node.
+type NodeScanResult struct {
+	ClusterID uint64
+	NodeID    uint64
+	// Problems describes all corrupted or inconsistent records found.
+	Problems []string
+	// SnapshotIndex is the index of the latest valid snapshot record.
+	SnapshotIndex uint64
+	// MaxIndex is the index of the last Raft Log entry recorded in the LogDB.
+	MaxIndex uint64
+	// LastIndex is the index of the last Raft Log entry that can be safely
+	// read, entries after LastIndex and up to MaxIndex are corrupted or missing.
+	LastIndex uint64
+	// Repaired indicates whether all found problems have been repaired.
+	Repaired bool
+}
+
+// Corrupted returns a boolean value indicating whether any problem has been
+// found for the node.
+func (r *NodeScanResult) Corrupted() bool {
+	return len(r.Problems) > 0
+}
+
+// ILogDBScanner is an optional interface implemented by ILogDB types that can
+// scan all stored records to detect corruptions. Scan is expected to be invoked
+// when the LogDB is not being used by any NodeHost.
+type ILogDBScanner interface {
+	// Scan walks all bootstrap, state, snapshot and entry records of all Raft
+	// nodes in the LogDB and verifies that they can be decoded and that entries
+	// are continuous. When repair is true, corrupted snapshot records are
+	// removed and the Raft Log is truncated at the first corrupted or missing
+	// entry. The truncation is refused when it would remove committed entries
+	// or when the commit index is unknown, unless force is true.
+	Scan(repair bool, force bool) ([]NodeScanResult, error)
+}
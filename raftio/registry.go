@@ -0,0 +1,35 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftio
+
+// INodeRegistry is the interface to be implemented by custom node registries.
+// A node registry keeps the targets of all known Raft nodes and resolves them
+// into network addresses that can be used by the transport module.
+type INodeRegistry interface {
+	// Stop stops the node registry and releases all resources owned by it.
+	Stop()
+	// Add records the target of the specified node. The target is the value
+	// passed to NodeHost when starting or adding the node, it is either the
+	// RaftAddress or the NodeHostID of the NodeHost that hosts the node.
+	Add(clusterID uint64, nodeID uint64, target string)
+	// Remove removes the specified node from the registry.
+	Remove(clusterID uint64, nodeID uint64)
+	// RemoveCluster removes all nodes of the specified Raft cluster.
+	RemoveCluster(clusterID uint64)
+	// Resolve returns the network address of the specified node and a
+	// connection key. Messages sharing the same connection key are sent over
+	// the same connection, returning the address as the key is always valid.
+	Resolve(clusterID uint64, nodeID uint64) (string, string, error)
+}
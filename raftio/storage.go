@@ -0,0 +1,42 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftio
+
+import (
+	"context"
+	"io"
+)
+
+// ISnapshotStorage is the interface used for placing finalized snapshots in
+// a storage backend such as S3, GCS or Azure Blob Storage. Once a snapshot has
+// been placed, its local copy is released after a more recent snapshot becomes
+// available, only the most recent snapshot and small working files thus remain
+// in the local snapshot directory. Released snapshots are transparently
+// fetched back from the storage when they are required for recovery.
+//
+// Each snapshot file is stored as an object identified by a key in the form
+// of <clusterID>/<nodeID>/<snapshot dir name>/<filename>.
+type ISnapshotStorage interface {
+	// Name returns the type name of the ISnapshotStorage instance.
+	Name() string
+	// Put stores the content read from r as the object with the specified key.
+	// An existing object with the same key is overwritten.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get writes the content of the object with the specified key to w.
+	Get(ctx context.Context, key string, w io.Writer) error
+	// Delete removes the object with the specified key. Deleting an object that
+	// does not exist is not considered as an error.
+	Delete(ctx context.Context, key string) error
+}
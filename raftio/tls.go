@@ -0,0 +1,33 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftio
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// ICertificateProvider is the interface used for providing the certificate and
+// the trusted certificate authorities used for mutual TLS between NodeHost
+// instances. Its methods are invoked for each new connection, renewed
+// certificates and certificate authorities thus take effect without restarting
+// the NodeHost. Established connections are not affected.
+type ICertificateProvider interface {
+	// Certificate returns the current certificate of the local NodeHost.
+	Certificate() (*tls.Certificate, error)
+	// CertPool returns the pool of certificate authorities currently trusted
+	// for verifying certificates of remote NodeHost instances.
+	CertPool() (*x509.CertPool, error)
+}
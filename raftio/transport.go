@@ -29,6 +29,7 @@ package raftio
 
 import (
 	"context"
+	"time"
 
 	pb "github.com/lni/dragonboat/v3/raftpb"
 )
@@ -44,6 +45,12 @@ type MessageHandler func(pb.MessageBatch)
 // be passed to dragonboat once all chunks are received.
 type ChunkHandler func(pb.Chunk) bool
 
+// ChunkResumeHandler is the handler function type for handling snapshot resume
+// queries. It returns the ID of the next chunk expected by the local node for
+// the snapshot the specified chunk belongs to, 0 is returned when the snapshot
+// should be sent again from its first chunk.
+type ChunkResumeHandler func(pb.Chunk) uint64
+
 // IConnection is the interface used by the transport module for sending Raft
 // messages. Each IConnection works for a specified target NodeHost instance,
 // it is possible for a target to have multiple concurrent IConnection
@@ -71,6 +78,25 @@ type ISnapshotConnection interface {
 	SendChunk(chunk pb.Chunk) error
 }
 
+// IResumableSnapshotConnection is an optional interface implemented by
+// ISnapshotConnection instances capable of resuming snapshot transfers
+// interrupted by broken connections.
+type IResumableSnapshotConnection interface {
+	ISnapshotConnection
+	// Resume queries the target for the ID of the next chunk it expects for the
+	// snapshot the specified chunk belongs to. The specified chunk is the first
+	// chunk of the snapshot with its Data field omitted. The query is expected
+	// to be handled by the ChunkResumeHandler set on the target's ITransport.
+	Resume(chunk pb.Chunk) (uint64, error)
+}
+
+// IResumableTransport is an optional interface implemented by ITransport
+// instances capable of handling snapshot resume queries. The
+// ChunkResumeHandler is set before the ITransport instance is started.
+type IResumableTransport interface {
+	SetChunkResumeHandler(h ChunkResumeHandler)
+}
+
 // ITransport is the interface to be implemented by a customized transport
 // module. A transport module is responsible for exchanging Raft messages,
 // snapshots and other metadata between NodeHost instances.
@@ -91,3 +117,27 @@ type ITransport interface {
 	GetSnapshotConnection(ctx context.Context,
 		target string) (ISnapshotConnection, error)
 }
+
+// ITransportMetrics is the interface used by the transport module to report
+// per remote NodeHost replication metrics to applications. Remote NodeHost
+// instances are identified by their addresses. Methods are invoked from the
+// worker goroutines of the transport module, implementations are required to
+// be concurrency safe and to return quickly.
+type ITransportMetrics interface {
+	// MessageBatchSent is invoked after a batch of count messages is sent to
+	// the remote NodeHost, latency is the time spent on sending the batch.
+	MessageBatchSent(address string, count uint64, latency time.Duration)
+	// MessageDropped is invoked when count messages to the remote NodeHost are
+	// dropped, e.g. when the send queue is full or when the connection failed.
+	MessageDropped(address string, count uint64)
+	// SendQueueLength is invoked after each message batch is sent to report
+	// the number of messages still pending in the send queue.
+	SendQueueLength(address string, length uint64)
+	// Reconnected is invoked when the connection to the remote NodeHost is
+	// re-established after connection failures.
+	Reconnected(address string)
+	// SnapshotBytesInFlight is invoked to report the number of snapshot bytes
+	// sent to the remote NodeHost by ongoing snapshot transfers. It is invoked
+	// with 0 bytes once all ongoing snapshot transfers are completed.
+	SnapshotBytesInFlight(address string, bytes uint64)
+}
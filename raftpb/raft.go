@@ -53,6 +53,31 @@ type ReadyToRead struct {
 	SystemCtx SystemCtx
 }
 
+// DropReason is the reason why a proposal or a ReadIndex request is dropped
+// by raft.
+type DropReason uint8
+
+const (
+	// DropNoLeader indicates that no leader is known.
+	DropNoLeader DropReason = iota
+	// DropLeaderTransferring indicates that the leadership is being transferred.
+	DropLeaderTransferring
+	// DropPendingConfigChange indicates that there is already a pending config
+	// change.
+	DropPendingConfigChange
+	// DropLeaderNotReady indicates that the leader hasn't committed any entry
+	// in its term yet.
+	DropLeaderNotReady
+)
+
+// DropInfo describes why a proposal or a ReadIndex request is dropped.
+type DropInfo struct {
+	Reason DropReason
+	// LeaderHint is the ID of the node expected to be the leader, it is 0 when
+	// no such node is known.
+	LeaderHint uint64
+}
+
 // UpdateCommit is used to describe how to commit the Update instance to
 // progress the state of raft.
 type UpdateCommit struct {
@@ -79,6 +104,9 @@ type Update struct {
 	// whether CommittedEntries can be applied without waiting for the Update
 	// to be persisted to disk
 	FastApply bool
+	// whether the Update should be persisted immediately without waiting to be
+	// coalesced with updates from other Raft nodes
+	LatencyCritical bool
 	// EntriesToSave are entries waiting to be stored onto persistent storage.
 	EntriesToSave []Entry
 	// CommittedEntries are entries already committed in raft and ready to be
@@ -102,9 +130,17 @@ type Update struct {
 	UpdateCommit UpdateCommit
 	// DroppedEntries is a list of entries dropped when no leader is available
 	DroppedEntries []Entry
+	// DroppedEntryInfo describes why each entry in DroppedEntries is dropped.
+	DroppedEntryInfo []DropInfo
 	// DroppedReadIndexes is a list of read index requests  dropped when no leader
 	// is available.
 	DroppedReadIndexes []SystemCtx
+	// DroppedReadIndexInfo describes why each read index request in
+	// DroppedReadIndexes is dropped.
+	DroppedReadIndexInfo []DropInfo
+	// VetoedConfigChanges is a list of keys of config change requests vetoed by
+	// the config change filter of the leader.
+	VetoedConfigChanges []uint64
 }
 
 // HasUpdate returns a boolean value indicating whether the returned Update
@@ -116,7 +152,8 @@ func (ud *Update) HasUpdate() bool {
 		len(ud.CommittedEntries) > 0 ||
 		len(ud.Messages) > 0 ||
 		len(ud.ReadyToReads) > 0 ||
-		len(ud.DroppedEntries) > 0
+		len(ud.DroppedEntries) > 0 ||
+		len(ud.VetoedConfigChanges) > 0
 }
 
 // IsEmptyState returns a boolean flag indicating whether the given State is
@@ -23,32 +23,33 @@ var _ = math.Inf
 type MessageType int32
 
 const (
-	LocalTick         MessageType = 0
-	Election          MessageType = 1
-	LeaderHeartbeat   MessageType = 2
-	ConfigChangeEvent MessageType = 3
-	NoOP              MessageType = 4
-	Ping              MessageType = 5
-	Pong              MessageType = 6
-	Propose           MessageType = 7
-	SnapshotStatus    MessageType = 8
-	Unreachable       MessageType = 9
-	CheckQuorum       MessageType = 10
-	BatchedReadIndex  MessageType = 11
-	Replicate         MessageType = 12
-	ReplicateResp     MessageType = 13
-	RequestVote       MessageType = 14
-	RequestVoteResp   MessageType = 15
-	InstallSnapshot   MessageType = 16
-	Heartbeat         MessageType = 17
-	HeartbeatResp     MessageType = 18
-	ReadIndex         MessageType = 19
-	ReadIndexResp     MessageType = 20
-	Quiesce           MessageType = 21
-	SnapshotReceived  MessageType = 22
-	LeaderTransfer    MessageType = 23
-	TimeoutNow        MessageType = 24
-	RateLimit         MessageType = 25
+	LocalTick          MessageType = 0
+	Election           MessageType = 1
+	LeaderHeartbeat    MessageType = 2
+	ConfigChangeEvent  MessageType = 3
+	NoOP               MessageType = 4
+	Ping               MessageType = 5
+	Pong               MessageType = 6
+	Propose            MessageType = 7
+	SnapshotStatus     MessageType = 8
+	Unreachable        MessageType = 9
+	CheckQuorum        MessageType = 10
+	BatchedReadIndex   MessageType = 11
+	Replicate          MessageType = 12
+	ReplicateResp      MessageType = 13
+	RequestVote        MessageType = 14
+	RequestVoteResp    MessageType = 15
+	InstallSnapshot    MessageType = 16
+	Heartbeat          MessageType = 17
+	HeartbeatResp      MessageType = 18
+	ReadIndex          MessageType = 19
+	ReadIndexResp      MessageType = 20
+	Quiesce            MessageType = 21
+	SnapshotReceived   MessageType = 22
+	LeaderTransfer     MessageType = 23
+	TimeoutNow         MessageType = 24
+	RateLimit          MessageType = 25
+	ConfigChangeVetoed MessageType = 26
 )
 
 var MessageType_name = map[int32]string{
@@ -78,35 +79,37 @@ var MessageType_name = map[int32]string{
 	23: "LeaderTransfer",
 	24: "TimeoutNow",
 	25: "RateLimit",
+	26: "ConfigChangeVetoed",
 }
 
 var MessageType_value = map[string]int32{
-	"LocalTick":         0,
-	"Election":          1,
-	"LeaderHeartbeat":   2,
-	"ConfigChangeEvent": 3,
-	"NoOP":              4,
-	"Ping":              5,
-	"Pong":              6,
-	"Propose":           7,
-	"SnapshotStatus":    8,
-	"Unreachable":       9,
-	"CheckQuorum":       10,
-	"BatchedReadIndex":  11,
-	"Replicate":         12,
-	"ReplicateResp":     13,
-	"RequestVote":       14,
-	"RequestVoteResp":   15,
-	"InstallSnapshot":   16,
-	"Heartbeat":         17,
-	"HeartbeatResp":     18,
-	"ReadIndex":         19,
-	"ReadIndexResp":     20,
-	"Quiesce":           21,
-	"SnapshotReceived":  22,
-	"LeaderTransfer":    23,
-	"TimeoutNow":        24,
-	"RateLimit":         25,
+	"LocalTick":          0,
+	"Election":           1,
+	"LeaderHeartbeat":    2,
+	"ConfigChangeEvent":  3,
+	"NoOP":               4,
+	"Ping":               5,
+	"Pong":               6,
+	"Propose":            7,
+	"SnapshotStatus":     8,
+	"Unreachable":        9,
+	"CheckQuorum":        10,
+	"BatchedReadIndex":   11,
+	"Replicate":          12,
+	"ReplicateResp":      13,
+	"RequestVote":        14,
+	"RequestVoteResp":    15,
+	"InstallSnapshot":    16,
+	"Heartbeat":          17,
+	"HeartbeatResp":      18,
+	"ReadIndex":          19,
+	"ReadIndexResp":      20,
+	"Quiesce":            21,
+	"SnapshotReceived":   22,
+	"LeaderTransfer":     23,
+	"TimeoutNow":         24,
+	"RateLimit":          25,
+	"ConfigChangeVetoed": 26,
 }
 
 func (x MessageType) Enum() *MessageType {
@@ -275,16 +278,19 @@ type CompressionType int32
 const (
 	NoCompression CompressionType = 0
 	Snappy        CompressionType = 1
+	Zstd          CompressionType = 2
 )
 
 var CompressionType_name = map[int32]string{
 	0: "NoCompression",
 	1: "Snappy",
+	2: "Zstd",
 }
 
 var CompressionType_value = map[string]int32{
 	"NoCompression": 0,
 	"Snappy":        1,
+	"Zstd":          2,
 }
 
 func (x CompressionType) Enum() *CompressionType {
@@ -603,6 +609,7 @@ type Entry struct {
 	SeriesID    uint64    `protobuf:"varint,6,opt,name=SeriesID" json:"SeriesID"`
 	RespondedTo uint64    `protobuf:"varint,7,opt,name=RespondedTo" json:"RespondedTo"`
 	Cmd         []byte    `protobuf:"bytes,8,opt,name=Cmd" json:"Cmd"`
+	Timestamp   uint64    `protobuf:"varint,9,opt,name=Timestamp" json:"Timestamp"`
 }
 
 func (m *Entry) Reset()         { *m = Entry{} }
@@ -694,6 +701,13 @@ func (m *Entry) GetCmd() []byte {
 	return nil
 }
 
+func (m *Entry) GetTimestamp() uint64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
 type EntryBatch struct {
 	Entries []Entry `protobuf:"bytes,1,rep,name=entries" json:"entries"`
 }
@@ -1250,6 +1264,9 @@ type SnapshotHeader struct {
 	ChecksumType    ChecksumType    `protobuf:"varint,7,opt,name=checksum_type,json=checksumType,enum=raftpb.ChecksumType" json:"checksum_type"`
 	Version         uint64          `protobuf:"varint,8,opt,name=version" json:"version"`
 	CompressionType CompressionType `protobuf:"varint,9,opt,name=compression_type,json=compressionType,enum=raftpb.CompressionType" json:"compression_type"`
+	EncryptionKeyId string          `protobuf:"bytes,10,opt,name=encryption_key_id,json=encryptionKeyId" json:"encryption_key_id"`
+	DeltaSince      uint64          `protobuf:"varint,11,opt,name=delta_since,json=deltaSince" json:"delta_since"`
+	SchemaVersion   uint64          `protobuf:"varint,12,opt,name=schema_version,json=schemaVersion" json:"schema_version"`
 }
 
 func (m *SnapshotHeader) Reset()         { *m = SnapshotHeader{} }
@@ -1348,6 +1365,27 @@ func (m *SnapshotHeader) GetCompressionType() CompressionType {
 	return NoCompression
 }
 
+func (m *SnapshotHeader) GetEncryptionKeyId() string {
+	if m != nil {
+		return m.EncryptionKeyId
+	}
+	return ""
+}
+
+func (m *SnapshotHeader) GetDeltaSince() uint64 {
+	if m != nil {
+		return m.DeltaSince
+	}
+	return 0
+}
+
+func (m *SnapshotHeader) GetSchemaVersion() uint64 {
+	if m != nil {
+		return m.SchemaVersion
+	}
+	return 0
+}
+
 // dummy message used by grpc
 type Response struct {
 }
@@ -1386,10 +1424,12 @@ func (m *Response) XXX_DiscardUnknown() {
 var xxx_messageInfo_Response proto.InternalMessageInfo
 
 type MessageBatch struct {
-	Requests      []Message `protobuf:"bytes,1,rep,name=requests" json:"requests"`
-	DeploymentId  uint64    `protobuf:"varint,2,opt,name=deployment_id,json=deploymentId" json:"deployment_id"`
-	SourceAddress string    `protobuf:"bytes,3,opt,name=source_address,json=sourceAddress" json:"source_address"`
-	BinVer        uint32    `protobuf:"varint,4,opt,name=bin_ver,json=binVer" json:"bin_ver"`
+	Requests        []Message `protobuf:"bytes,1,rep,name=requests" json:"requests"`
+	DeploymentId    uint64    `protobuf:"varint,2,opt,name=deployment_id,json=deploymentId" json:"deployment_id"`
+	SourceAddress   string    `protobuf:"bytes,3,opt,name=source_address,json=sourceAddress" json:"source_address"`
+	BinVer          uint32    `protobuf:"varint,4,opt,name=bin_ver,json=binVer" json:"bin_ver"`
+	EncryptionKeyId string    `protobuf:"bytes,5,opt,name=encryption_key_id,json=encryptionKeyId" json:"encryption_key_id"`
+	Sealed          []byte    `protobuf:"bytes,6,opt,name=sealed" json:"sealed,omitempty"`
 }
 
 func (m *MessageBatch) Reset()         { *m = MessageBatch{} }
@@ -1453,28 +1493,45 @@ func (m *MessageBatch) GetBinVer() uint32 {
 	return 0
 }
 
+func (m *MessageBatch) GetEncryptionKeyId() string {
+	if m != nil {
+		return m.EncryptionKeyId
+	}
+	return ""
+}
+
+func (m *MessageBatch) GetSealed() []byte {
+	if m != nil {
+		return m.Sealed
+	}
+	return nil
+}
+
 // field id 11 was used for optional string filename
 type Chunk struct {
-	ClusterId      uint64       `protobuf:"varint,1,opt,name=cluster_id,json=clusterId" json:"cluster_id"`
-	NodeId         uint64       `protobuf:"varint,2,opt,name=node_id,json=nodeId" json:"node_id"`
-	From           uint64       `protobuf:"varint,3,opt,name=from" json:"from"`
-	ChunkId        uint64       `protobuf:"varint,4,opt,name=chunk_id,json=chunkId" json:"chunk_id"`
-	ChunkSize      uint64       `protobuf:"varint,5,opt,name=chunk_size,json=chunkSize" json:"chunk_size"`
-	ChunkCount     uint64       `protobuf:"varint,6,opt,name=chunk_count,json=chunkCount" json:"chunk_count"`
-	Data           []byte       `protobuf:"bytes,7,opt,name=data" json:"data"`
-	Index          uint64       `protobuf:"varint,8,opt,name=index" json:"index"`
-	Term           uint64       `protobuf:"varint,9,opt,name=term" json:"term"`
-	Membership     Membership   `protobuf:"bytes,10,opt,name=membership" json:"membership"`
-	Filepath       string       `protobuf:"bytes,12,opt,name=filepath" json:"filepath"`
-	FileSize       uint64       `protobuf:"varint,13,opt,name=file_size,json=fileSize" json:"file_size"`
-	DeploymentId   uint64       `protobuf:"varint,14,opt,name=deployment_id,json=deploymentId" json:"deployment_id"`
-	FileChunkId    uint64       `protobuf:"varint,15,opt,name=file_chunk_id,json=fileChunkId" json:"file_chunk_id"`
-	FileChunkCount uint64       `protobuf:"varint,16,opt,name=file_chunk_count,json=fileChunkCount" json:"file_chunk_count"`
-	HasFileInfo    bool         `protobuf:"varint,17,opt,name=has_file_info,json=hasFileInfo" json:"has_file_info"`
-	FileInfo       SnapshotFile `protobuf:"bytes,18,opt,name=file_info,json=fileInfo" json:"file_info"`
-	BinVer         uint32       `protobuf:"varint,19,opt,name=bin_ver,json=binVer" json:"bin_ver"`
-	OnDiskIndex    uint64       `protobuf:"varint,20,opt,name=on_disk_index,json=onDiskIndex" json:"on_disk_index"`
-	Witness        bool         `protobuf:"varint,21,opt,name=witness" json:"witness"`
+	ClusterId       uint64       `protobuf:"varint,1,opt,name=cluster_id,json=clusterId" json:"cluster_id"`
+	NodeId          uint64       `protobuf:"varint,2,opt,name=node_id,json=nodeId" json:"node_id"`
+	From            uint64       `protobuf:"varint,3,opt,name=from" json:"from"`
+	ChunkId         uint64       `protobuf:"varint,4,opt,name=chunk_id,json=chunkId" json:"chunk_id"`
+	ChunkSize       uint64       `protobuf:"varint,5,opt,name=chunk_size,json=chunkSize" json:"chunk_size"`
+	ChunkCount      uint64       `protobuf:"varint,6,opt,name=chunk_count,json=chunkCount" json:"chunk_count"`
+	Data            []byte       `protobuf:"bytes,7,opt,name=data" json:"data"`
+	Index           uint64       `protobuf:"varint,8,opt,name=index" json:"index"`
+	Term            uint64       `protobuf:"varint,9,opt,name=term" json:"term"`
+	Membership      Membership   `protobuf:"bytes,10,opt,name=membership" json:"membership"`
+	Filepath        string       `protobuf:"bytes,12,opt,name=filepath" json:"filepath"`
+	FileSize        uint64       `protobuf:"varint,13,opt,name=file_size,json=fileSize" json:"file_size"`
+	DeploymentId    uint64       `protobuf:"varint,14,opt,name=deployment_id,json=deploymentId" json:"deployment_id"`
+	FileChunkId     uint64       `protobuf:"varint,15,opt,name=file_chunk_id,json=fileChunkId" json:"file_chunk_id"`
+	FileChunkCount  uint64       `protobuf:"varint,16,opt,name=file_chunk_count,json=fileChunkCount" json:"file_chunk_count"`
+	HasFileInfo     bool         `protobuf:"varint,17,opt,name=has_file_info,json=hasFileInfo" json:"has_file_info"`
+	FileInfo        SnapshotFile `protobuf:"bytes,18,opt,name=file_info,json=fileInfo" json:"file_info"`
+	BinVer          uint32       `protobuf:"varint,19,opt,name=bin_ver,json=binVer" json:"bin_ver"`
+	OnDiskIndex     uint64       `protobuf:"varint,20,opt,name=on_disk_index,json=onDiskIndex" json:"on_disk_index"`
+	Witness         bool         `protobuf:"varint,21,opt,name=witness" json:"witness"`
+	EncryptionKeyId string       `protobuf:"bytes,22,opt,name=encryption_key_id,json=encryptionKeyId" json:"encryption_key_id"`
+	Checksum        []byte       `protobuf:"bytes,23,opt,name=checksum" json:"checksum,omitempty"`
+	PullUrl         string       `protobuf:"bytes,24,opt,name=pull_url,json=pullUrl" json:"pull_url,omitempty"`
 }
 
 func (m *Chunk) Reset()         { *m = Chunk{} }
@@ -1650,6 +1707,27 @@ func (m *Chunk) GetWitness() bool {
 	return false
 }
 
+func (m *Chunk) GetEncryptionKeyId() string {
+	if m != nil {
+		return m.EncryptionKeyId
+	}
+	return ""
+}
+
+func (m *Chunk) GetChecksum() []byte {
+	if m != nil {
+		return m.Checksum
+	}
+	return nil
+}
+
+func (m *Chunk) GetPullUrl() string {
+	if m != nil {
+		return m.PullUrl
+	}
+	return ""
+}
+
 /*
 func init() {
 	proto.RegisterEnum("raftpb.MessageType", MessageType_name, MessageType_value)
@@ -2399,6 +2477,16 @@ func (m *SnapshotHeader) MarshalTo(dAtA []byte) (int, error) {
 	dAtA[i] = 0x48
 	i++
 	i = encodeVarintRaft(dAtA, i, uint64(m.CompressionType))
+	dAtA[i] = 0x52
+	i++
+	i = encodeVarintRaft(dAtA, i, uint64(len(m.EncryptionKeyId)))
+	i += copy(dAtA[i:], m.EncryptionKeyId)
+	dAtA[i] = 0x58
+	i++
+	i = encodeVarintRaft(dAtA, i, uint64(m.DeltaSince))
+	dAtA[i] = 0x60
+	i++
+	i = encodeVarintRaft(dAtA, i, uint64(m.SchemaVersion))
 	return i, nil
 }
 
@@ -2457,6 +2545,16 @@ func (m *MessageBatch) MarshalTo(dAtA []byte) (int, error) {
 	dAtA[i] = 0x20
 	i++
 	i = encodeVarintRaft(dAtA, i, uint64(m.BinVer))
+	dAtA[i] = 0x2a
+	i++
+	i = encodeVarintRaft(dAtA, i, uint64(len(m.EncryptionKeyId)))
+	i += copy(dAtA[i:], m.EncryptionKeyId)
+	if m.Sealed != nil {
+		dAtA[i] = 0x32
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(len(m.Sealed)))
+		i += copy(dAtA[i:], m.Sealed)
+	}
 	return i, nil
 }
 
@@ -2571,6 +2669,28 @@ func (m *Chunk) MarshalTo(dAtA []byte) (int, error) {
 		dAtA[i] = 0
 	}
 	i++
+	dAtA[i] = 0xb2
+	i++
+	dAtA[i] = 0x1
+	i++
+	i = encodeVarintRaft(dAtA, i, uint64(len(m.EncryptionKeyId)))
+	i += copy(dAtA[i:], m.EncryptionKeyId)
+	if m.Checksum != nil {
+		dAtA[i] = 0xba
+		i++
+		dAtA[i] = 0x1
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(len(m.Checksum)))
+		i += copy(dAtA[i:], m.Checksum)
+	}
+	if len(m.PullUrl) > 0 {
+		dAtA[i] = 0xc2
+		i++
+		dAtA[i] = 0x1
+		i++
+		i = encodeVarintRaft(dAtA, i, uint64(len(m.PullUrl)))
+		i += copy(dAtA[i:], m.PullUrl)
+	}
 	return i, nil
 }
 
@@ -2829,6 +2949,10 @@ func (m *SnapshotHeader) Size() (n int) {
 	n += 1 + sovRaft(uint64(m.ChecksumType))
 	n += 1 + sovRaft(uint64(m.Version))
 	n += 1 + sovRaft(uint64(m.CompressionType))
+	l = len(m.EncryptionKeyId)
+	n += 1 + l + sovRaft(uint64(l))
+	n += 1 + sovRaft(uint64(m.DeltaSince))
+	n += 1 + sovRaft(uint64(m.SchemaVersion))
 	return n
 }
 
@@ -2857,6 +2981,12 @@ func (m *MessageBatch) Size() (n int) {
 	l = len(m.SourceAddress)
 	n += 1 + l + sovRaft(uint64(l))
 	n += 1 + sovRaft(uint64(m.BinVer))
+	l = len(m.EncryptionKeyId)
+	n += 1 + l + sovRaft(uint64(l))
+	if m.Sealed != nil {
+		l = len(m.Sealed)
+		n += 1 + l + sovRaft(uint64(l))
+	}
 	return n
 }
 
@@ -2892,6 +3022,16 @@ func (m *Chunk) Size() (n int) {
 	n += 2 + sovRaft(uint64(m.BinVer))
 	n += 2 + sovRaft(uint64(m.OnDiskIndex))
 	n += 3
+	l = len(m.EncryptionKeyId)
+	n += 2 + l + sovRaft(uint64(l))
+	if m.Checksum != nil {
+		l = len(m.Checksum)
+		n += 2 + l + sovRaft(uint64(l))
+	}
+	if len(m.PullUrl) > 0 {
+		l = len(m.PullUrl)
+		n += 2 + l + sovRaft(uint64(l))
+	}
 	return n
 }
 
@@ -5600,6 +5740,76 @@ func (m *SnapshotHeader) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EncryptionKeyId", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRaft
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRaft
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.EncryptionKeyId = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DeltaSince", wireType)
+			}
+			m.DeltaSince = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.DeltaSince |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SchemaVersion", wireType)
+			}
+			m.SchemaVersion = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.SchemaVersion |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRaft(dAtA[iNdEx:])
@@ -6303,6 +6513,104 @@ func (m *Chunk) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.Witness = bool(v != 0)
+		case 22:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EncryptionKeyId", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRaft
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRaft
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.EncryptionKeyId = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 23:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Checksum", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthRaft
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRaft
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Checksum = append(m.Checksum[:0], dAtA[iNdEx:postIndex]...)
+			if m.Checksum == nil {
+				m.Checksum = []byte{}
+			}
+			iNdEx = postIndex
+		case 24:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PullUrl", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRaft
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRaft
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PullUrl = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRaft(dAtA[iNdEx:])
@@ -146,6 +146,14 @@ func (o *Entry) Size() int {
 		}
 	}
 
+	if x := o.Timestamp; x >= 1<<49 {
+		l += 9
+	} else if x != 0 {
+		for l += 2; x >= 0x80; l++ {
+			x >>= 7
+		}
+	}
+
 	if uint64(l) > ColferSizeMax {
 		panic(fmt.Sprintf("max size reached %d", l))
 	}
@@ -289,6 +297,22 @@ func (o *Entry) marshalTo(buf []byte) int {
 		i += copy(buf[i:], o.Cmd)
 	}
 
+	if x := o.Timestamp; x >= 1<<49 {
+		buf[i] = 8 | 0x80
+		intconv.PutUint64(buf[i+1:], x)
+		i += 9
+	} else if x != 0 {
+		buf[i] = 8
+		i++
+		for x >= 0x80 {
+			buf[i] = byte(x | 0x80)
+			x >>= 7
+			i++
+		}
+		buf[i] = byte(x)
+		i++
+	}
+
 	buf[i] = 0x7f
 	i++
 	return i
@@ -296,11 +320,11 @@ func (o *Entry) marshalTo(buf []byte) int {
 
 // Unmarshal unmarshals the input to the current entry instance.
 func (o *Entry) Unmarshal(data []byte) error {
-	_, err := o.unmarshal(data)
+	_, err := o.unmarshal(data, false)
 	return err
 }
 
-func (o *Entry) unmarshal(data []byte) (int, error) {
+func (o *Entry) unmarshal(data []byte, noCopy bool) (int, error) {
 	if len(data) == 0 {
 		return 0, io.EOF
 	}
@@ -631,12 +655,55 @@ func (o *Entry) unmarshal(data []byte) (int, error) {
 		}
 		// https://github.com/golang/go/wiki/SliceTricks
 		ic := data[start:i]
-		o.Cmd = append(ic[:0:0], ic...)
+		if noCopy {
+			o.Cmd = ic[:len(ic):len(ic)]
+		} else {
+			o.Cmd = append(ic[:0:0], ic...)
+		}
 
 		header = data[i]
 		i++
 	}
 
+	if header == 8 {
+		start := i
+		i++
+		if i >= len(data) {
+			goto eof
+		}
+		x := uint64(data[start])
+
+		if x >= 0x80 {
+			x &= 0x7f
+			for shift := uint(7); ; shift += 7 {
+				b := uint64(data[i])
+				i++
+				if i >= len(data) {
+					goto eof
+				}
+
+				if b < 0x80 || shift == 56 {
+					x |= b << shift
+					break
+				}
+				x |= (b & 0x7f) << shift
+			}
+		}
+		o.Timestamp = x
+
+		header = data[i]
+		i++
+	} else if header == 8|0x80 {
+		start := i
+		i += 8
+		if i >= len(data) {
+			goto eof
+		}
+		o.Timestamp = intconv.Uint64(data[start:])
+		header = data[i]
+		i++
+	}
+
 	if header != 0x7f {
 		return 0, ColferError(i - 1)
 	}
@@ -652,6 +719,10 @@ eof:
 
 // Unmarshal unmarshals the message instance using the input byte slice.
 func (m *Message) Unmarshal(dAtA []byte) error {
+	return m.unmarshal(dAtA, false)
+}
+
+func (m *Message) unmarshal(dAtA []byte, noCopy bool) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -902,7 +973,7 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 				m.Entries = make([]Entry, 0, count)
 			}
 			m.Entries = append(m.Entries, Entry{})
-			if err := m.Entries[len(m.Entries)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+			if _, err := m.Entries[len(m.Entries)-1].unmarshal(dAtA[iNdEx:postIndex], noCopy); err != nil {
 				return err
 			}
 			iNdEx = postIndex
@@ -1049,6 +1120,17 @@ func (m *MessageBatch) messageCount(dAtA []byte) int {
 
 // Unmarshal unmarshals the message batch instance using the input byte slice.
 func (m *MessageBatch) Unmarshal(dAtA []byte) error {
+	return m.unmarshal(dAtA, false)
+}
+
+// UnmarshalNoCopy unmarshals the message batch instance using the input byte
+// slice. Payloads of entries are not copied, they refer to the input byte
+// slice which must not be modified or reused afterwards.
+func (m *MessageBatch) UnmarshalNoCopy(dAtA []byte) error {
+	return m.unmarshal(dAtA, true)
+}
+
+func (m *MessageBatch) unmarshal(dAtA []byte, noCopy bool) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1108,7 +1190,7 @@ func (m *MessageBatch) Unmarshal(dAtA []byte) error {
 				m.Requests = make([]Message, 0, count)
 			}
 			m.Requests = append(m.Requests, Message{})
-			if err := m.Requests[len(m.Requests)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+			if err := m.Requests[len(m.Requests)-1].unmarshal(dAtA[iNdEx:postIndex], noCopy); err != nil {
 				return err
 			}
 			iNdEx = postIndex
@@ -1179,6 +1261,66 @@ func (m *MessageBatch) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EncryptionKeyId", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRaft
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.EncryptionKeyId = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Sealed", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRaft
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthRaft
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Sealed = append(m.Sealed[:0], dAtA[iNdEx:postIndex]...)
+			if m.Sealed == nil {
+				m.Sealed = []byte{}
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRaft(dAtA[iNdEx:])
@@ -1218,7 +1360,7 @@ func (m *Message) SizeUpperLimit() int {
 // SizeUpperLimit returns the upper limit size of the message batch.
 func (m *MessageBatch) SizeUpperLimit() int {
 	l := 0
-	l += (16 * 3) + len(m.SourceAddress)
+	l += (16 * 5) + len(m.SourceAddress) + len(m.EncryptionKeyId) + len(m.Sealed)
 	for _, msg := range m.Requests {
 		l += 16
 		l += msg.SizeUpperLimit()
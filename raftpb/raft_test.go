@@ -15,6 +15,7 @@
 package raftpb
 
 import (
+	"bytes"
 	"math"
 	"math/rand"
 	"reflect"
@@ -262,6 +263,7 @@ func TestEntrySizeUpperLimit(t *testing.T) {
 		SeriesID:    max64,
 		RespondedTo: max64,
 		Cmd:         make([]byte, 1024),
+		Timestamp:   max64,
 	}
 	if e1.SizeUpperLimit() < e1.Size() {
 		t.Errorf("size upper limit < size")
@@ -404,11 +406,11 @@ func TestGetEntrySliceInMemSize(t *testing.T) {
 		size uint64
 	}{
 		{[]Entry{}, 0},
-		{[]Entry{e0}, 80},
-		{[]Entry{e16}, 96},
-		{[]Entry{e64}, 144},
-		{[]Entry{e0, e64}, 224},
-		{[]Entry{e0, e16, e64}, 320},
+		{[]Entry{e0}, 88},
+		{[]Entry{e16}, 104},
+		{[]Entry{e64}, 152},
+		{[]Entry{e0, e64}, 240},
+		{[]Entry{e0, e16, e64}, 344},
 	}
 	for idx, tt := range tests {
 		result := GetEntrySliceInMemSize(tt.ents)
@@ -452,6 +454,7 @@ func TestEntryCanBeMarshalledAndUnmarshalled(t *testing.T) {
 		ClientID:    7654321,
 		RespondedTo: 13579,
 		Cmd:         cmd,
+		Timestamp:   1600000000000000000,
 	}
 	m, err := e.Marshal()
 	if err != nil {
@@ -464,6 +467,18 @@ func TestEntryCanBeMarshalledAndUnmarshalled(t *testing.T) {
 	if !reflect.DeepEqual(&e, &e2) {
 		t.Fatalf("entry changed")
 	}
+	e.Timestamp = 12345
+	m, err = e.Marshal()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	e3 := Entry{}
+	if err := e3.Unmarshal(m); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(&e, &e3) {
+		t.Fatalf("entry changed")
+	}
 	sh1 := (*reflect.SliceHeader)(unsafe.Pointer(&e.Cmd))
 	sh2 := (*reflect.SliceHeader)(unsafe.Pointer(&e2.Cmd))
 	if !(sh2.Data+uintptr(sh2.Len) <= sh1.Data ||
@@ -472,6 +487,50 @@ func TestEntryCanBeMarshalledAndUnmarshalled(t *testing.T) {
 	}
 }
 
+func TestMessageBatchCanBeUnmarshaledWithoutCopy(t *testing.T) {
+	mb := MessageBatch{
+		Requests: []Message{
+			{
+				Type:      Replicate,
+				ClusterId: 1,
+				Entries: []Entry{
+					{Index: 1, Term: 1, Cmd: []byte("test-data-1")},
+					{Index: 2, Term: 1, Cmd: []byte("test-data-2")},
+				},
+			},
+		},
+	}
+	data, err := mb.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal %v", err)
+	}
+	copied := MessageBatch{}
+	if err := copied.Unmarshal(data); err != nil {
+		t.Fatalf("failed to unmarshal %v", err)
+	}
+	borrowed := MessageBatch{}
+	if err := borrowed.UnmarshalNoCopy(data); err != nil {
+		t.Fatalf("failed to unmarshal %v", err)
+	}
+	if !reflect.DeepEqual(&copied, &borrowed) {
+		t.Fatalf("unexpected result %+v", borrowed)
+	}
+	for i := range data {
+		data[i] = 0
+	}
+	for idx, e := range borrowed.Requests[0].Entries {
+		if !bytes.Equal(e.Cmd, make([]byte, len(e.Cmd))) {
+			t.Errorf("%d, cmd copied", idx)
+		}
+		if len(e.Cmd) != cap(e.Cmd) {
+			t.Errorf("%d, cmd can be appended into the input", idx)
+		}
+	}
+	if string(copied.Requests[0].Entries[1].Cmd) != "test-data-2" {
+		t.Errorf("cmd not copied")
+	}
+}
+
 func TestRaftDataStatusCanBeMarshaled(t *testing.T) {
 	r := &RaftDataStatus{
 		Address:             "mydomain.com:12345",
@@ -532,6 +591,7 @@ func TestMessageCanDrop(t *testing.T) {
 		{LeaderTransfer, true},
 		{TimeoutNow, true},
 		{RateLimit, true},
+		{ConfigChangeVetoed, true},
 	}
 	for idx, tt := range tests {
 		m := Message{Type: tt.t}
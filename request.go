@@ -15,6 +15,7 @@
 package dragonboat
 
 import (
+	"context"
 	"crypto/sha512"
 	"encoding/binary"
 	"errors"
@@ -22,6 +23,8 @@ import (
 	"io"
 	"math/rand"
 	"os"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -75,6 +78,12 @@ var (
 	ErrCanceled = errors.New("request canceled")
 	// ErrRejected indicates that the request has been rejected.
 	ErrRejected = errors.New("request rejected")
+	// ErrAborted indicates that the request has been aborted, e.g. a snapshot
+	// export was aborted as the specified io.Writer failed.
+	ErrAborted = errors.New("request aborted")
+	// ErrApplyBacklog indicates that the read request is rejected as the apply
+	// backlog of the local node exceeds the configured threshold.
+	ErrApplyBacklog = errors.New("read rejected due to apply backlog")
 	// ErrClusterNotReady indicates that the request has been dropped as the
 	// specified raft cluster is not ready to handle the request. Unknown leader
 	// is the most common cause of this error, trying to use a cluster not fully
@@ -115,13 +124,109 @@ func IsTempError(err error) bool {
 		err == ErrClusterNotInitialized ||
 		err == ErrClusterNotReady ||
 		err == ErrTimeout ||
-		err == ErrClosed
+		err == ErrClosed ||
+		err == ErrApplyBacklog
 }
 
 // RequestResultCode is the result code returned to the client to indicate the
 // outcome of the request.
 type RequestResultCode int
 
+// RejectReason describes why a request is dropped or rejected.
+type RejectReason int
+
+const (
+	// ReasonNone indicates that the request is neither dropped nor rejected.
+	ReasonNone RejectReason = iota
+	// ReasonNoLeader indicates that the request is dropped as there is no known
+	// leader.
+	ReasonNoLeader
+	// ReasonLeaderTransferring indicates that the request is dropped as the
+	// leadership is being transferred.
+	ReasonLeaderTransferring
+	// ReasonLeaderNotReady indicates that the request is dropped as the leader
+	// hasn't committed any entry in its term yet.
+	ReasonLeaderNotReady
+	// ReasonPendingConfigChange indicates that the membership change request is
+	// dropped as there is already a pending membership change.
+	ReasonPendingConfigChange
+	// ReasonSessionInvalid indicates that the proposal is rejected as the client
+	// session is not valid on the server side.
+	ReasonSessionInvalid
+	// ReasonWitnessTarget indicates that the membership change request is
+	// rejected as it tries to change the role of a witness or to convert an
+	// existing member to witness.
+	ReasonWitnessTarget
+	// ReasonInvalidConfigChange indicates that the membership change request is
+	// rejected as it is out of order or invalid for the current membership.
+	ReasonInvalidConfigChange
+	// ReasonConfigChangeVetoed indicates that the membership change request is
+	// rejected by the config change filter of the leader.
+	ReasonConfigChangeVetoed
+	// ReasonQuotaExceeded indicates that the proposal is dropped as the node is
+	// not accepting new proposals after exceeding its in memory log quota or
+	// while its LogDB is busy.
+	ReasonQuotaExceeded
+	// ReasonPayloadTooBig indicates that the proposal is rejected as its
+	// payload is larger than the allowed limit.
+	ReasonPayloadTooBig
+)
+
+var rejectReasonName = [...]string{
+	"None",
+	"NoLeader",
+	"LeaderTransferring",
+	"LeaderNotReady",
+	"PendingConfigChange",
+	"SessionInvalid",
+	"WitnessTarget",
+	"InvalidConfigChange",
+	"ConfigChangeVetoed",
+	"QuotaExceeded",
+	"PayloadTooBig",
+}
+
+func (r RejectReason) String() string {
+	return rejectReasonName[uint64(r)]
+}
+
+type rejection struct {
+	reason     RejectReason
+	leaderHint uint64
+	limit      uint64
+	detail     string
+}
+
+func getDropRejection(info pb.DropInfo) rejection {
+	var reason RejectReason
+	switch info.Reason {
+	case pb.DropNoLeader:
+		reason = ReasonNoLeader
+	case pb.DropLeaderTransferring:
+		reason = ReasonLeaderTransferring
+	case pb.DropPendingConfigChange:
+		reason = ReasonPendingConfigChange
+	case pb.DropLeaderNotReady:
+		reason = ReasonLeaderNotReady
+	default:
+		plog.Panicf("unknown drop reason %d", info.Reason)
+	}
+	return rejection{reason: reason, leaderHint: info.LeaderHint}
+}
+
+func getSessionRejection(seriesID uint64) rejection {
+	r := rejection{reason: ReasonSessionInvalid}
+	switch seriesID {
+	case client.SeriesIDForRegister:
+		r.detail = "client session already registered"
+	case client.SeriesIDForUnregister:
+		r.detail = "client session not found"
+	default:
+		r.detail = "client session not registered or evicted"
+	}
+	return r
+}
+
 // RequestResult is the result struct returned for the request.
 type RequestResult struct {
 	// code is the result state of the request.
@@ -130,7 +235,10 @@ type RequestResult struct {
 	// instance. Result is only available when making a proposal and the Code
 	// value is RequestCompleted.
 	result         sm.Result
+	index          uint64
 	snapshotResult bool
+	stale          bool
+	rejection      rejection
 }
 
 // Timeout returns a boolean value indicating whether the request timed out.
@@ -182,6 +290,34 @@ func (rr *RequestResult) Dropped() bool {
 	return rr.code == requestDropped
 }
 
+// Reason returns the reason why the request is dropped or rejected. ReasonNone
+// is returned when the request is neither dropped nor rejected.
+func (rr *RequestResult) Reason() RejectReason {
+	return rr.rejection.reason
+}
+
+// LeaderHint returns the ID of the node that is expected to be the leader when
+// the request is dropped. The returned boolean value indicates whether such a
+// hint is available. Dropped requests can be retried once the hinted node is
+// ready to serve as the leader.
+func (rr *RequestResult) LeaderHint() (uint64, bool) {
+	return rr.rejection.leaderHint, rr.rejection.leaderHint != 0
+}
+
+// Limit returns the limit that caused the request to be rejected, e.g. the
+// max allowed payload size when the reason is ReasonPayloadTooBig or the in
+// memory log quota when the reason is ReasonQuotaExceeded. The returned
+// boolean value indicates whether such a limit is available.
+func (rr *RequestResult) Limit() (uint64, bool) {
+	return rr.rejection.limit, rr.rejection.limit != 0
+}
+
+// Detail returns a human readable description of why the request is rejected,
+// an empty string is returned when no such description is available.
+func (rr *RequestResult) Detail() string {
+	return rr.rejection.detail
+}
+
 // SnapshotIndex returns the index of the generated snapshot when the
 // RequestResult is from a snapshot related request. Invoking this method on
 // RequestResult instances not related to snapshots will cause panic.
@@ -192,6 +328,20 @@ func (rr *RequestResult) SnapshotIndex() uint64 {
 	return rr.result.Value
 }
 
+// AppliedIndex returns the index of the Raft log entry of the completed
+// proposal. The returned value is 0 for all other request types.
+func (rr *RequestResult) AppliedIndex() uint64 {
+	return rr.index
+}
+
+// Stale returns a boolean value indicating whether the completed ReadIndex
+// request was served without the linearizability guarantee, this happens when
+// the apply backlog of the local node exceeds the ReadBacklogThreshold value
+// and the StaleReadsOnBacklog policy is used. See config.Config for details.
+func (rr *RequestResult) Stale() bool {
+	return rr.stale
+}
+
 // GetResult returns the result value of the request. When making a proposal,
 // the returned result is the value returned by the Update method of the
 // IStateMachine instance.
@@ -199,6 +349,17 @@ func (rr *RequestResult) GetResult() sm.Result {
 	return rr.result
 }
 
+// ApplicationError returns the error set by the state machine in the Error
+// field of its result when the completed proposal has been applied but
+// rejected by the business logic of the state machine. nil is returned when
+// there is no such error.
+func (rr *RequestResult) ApplicationError() error {
+	if rr.result.Error == nil {
+		return nil
+	}
+	return rr.result.Error
+}
+
 const (
 	requestTimeout RequestResultCode = iota
 	requestCompleted
@@ -298,8 +459,63 @@ type RequestState struct {
 	CompletedC   chan RequestResult
 	node         *node
 	pool         *sync.Pool
+	tracker      *requestStateTracker
 	notifyCommit bool
 	testErr      chan struct{}
+	ctx          context.Context
+}
+
+// UnreleasedRequestState describes a RequestState instance obtained from the
+// internal pool that has not been released back to the pool yet.
+type UnreleasedRequestState struct {
+	// Created is the time when the RequestState instance was handed out.
+	Created time.Time
+	// Stack is the stack trace of the goroutine that requested the
+	// RequestState instance.
+	Stack string
+}
+
+// requestStateTracker keeps track of all pooled RequestState instances that
+// have been handed out to users but not yet released. It is only used when
+// leak detection is enabled as capturing stack traces is expensive.
+type requestStateTracker struct {
+	mu     sync.Mutex
+	states map[*RequestState]UnreleasedRequestState
+}
+
+func newRequestStateTracker() *requestStateTracker {
+	return &requestStateTracker{
+		states: make(map[*RequestState]UnreleasedRequestState),
+	}
+}
+
+func (t *requestStateTracker) track(r *RequestState) {
+	state := UnreleasedRequestState{
+		Created: time.Now(),
+		Stack:   string(debug.Stack()),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.states[r] = state
+}
+
+func (t *requestStateTracker) untrack(r *RequestState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.states, r)
+}
+
+func (t *requestStateTracker) unreleased() []UnreleasedRequestState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make([]UnreleasedRequestState, 0, len(t.states))
+	for _, state := range t.states {
+		result = append(result, state)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.Before(result[j].Created)
+	})
+	return result
 }
 
 // AppliedC returns a channel of RequestResult for delivering request result.
@@ -404,8 +620,11 @@ func (r *RequestState) terminated() {
 	r.notify(RequestResult{code: requestTerminated})
 }
 
-func (r *RequestState) dropped() {
-	r.notify(RequestResult{code: requestDropped})
+func (r *RequestState) dropped(info pb.DropInfo) {
+	r.notify(RequestResult{
+		code:      requestDropped,
+		rejection: getDropRejection(info),
+	})
 }
 
 func (r *RequestState) notify(result RequestResult) {
@@ -417,14 +636,29 @@ func (r *RequestState) notify(result RequestResult) {
 	}
 }
 
+// Wait blocks until the final outcome of the request is available or the
+// specified context is done. The outcome is returned in the same way as the
+// synchronous variants of the request, e.g. ErrRejected is returned when the
+// request is rejected. Once the outcome is received, the RequestState instance
+// is automatically released and it must not be accessed again by the caller.
+func (r *RequestState) Wait(ctx context.Context) (RequestResult, error) {
+	result, err := getRequestResult(ctx, r)
+	r.Release()
+	return result, err
+}
+
 // Release puts the RequestState instance back to an internal pool so it can be
 // reused. Release is normally called after all RequestResult values have been
-// received from the ResultC() channel.
+// received from the ResultC() channel. Release is a no-op when the request is
+// still in progress.
 func (r *RequestState) Release() {
 	if r.pool != nil {
 		if !r.readyToRelease.ready() {
 			return
 		}
+		if r.tracker != nil {
+			r.tracker.untrack(r)
+		}
 		r.notifyCommit = false
 		r.deadline = 0
 		r.key = 0
@@ -432,6 +666,7 @@ func (r *RequestState) Release() {
 		r.clientID = 0
 		r.respondedTo = 0
 		r.node = nil
+		r.ctx = nil
 		r.readyToRead.clear()
 		r.readyToRelease.clear()
 		r.aggrC = nil
@@ -439,6 +674,12 @@ func (r *RequestState) Release() {
 	}
 }
 
+func (r *RequestState) track() {
+	if r.tracker != nil {
+		r.tracker.track(r)
+	}
+}
+
 func (r *RequestState) reuse(notifyCommit bool) {
 	if r.aggrC != nil {
 		plog.Panicf("aggrC not nil")
@@ -500,6 +741,7 @@ type pendingProposal struct {
 type readBatch struct {
 	index    uint64
 	requests []*RequestState
+	stale    bool
 }
 
 type pendingReadIndex struct {
@@ -584,8 +826,29 @@ func (p *pendingSnapshot) close() {
 	}
 }
 
+func (p *pendingSnapshot) hasPending() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending != nil
+}
+
 func (p *pendingSnapshot) request(st rsm.SSReqType,
 	path string, override bool, overhead uint64,
+	timeoutTick uint64) (*RequestState, error) {
+	return p.send(rsm.SSRequest{
+		Type:               st,
+		Path:               path,
+		OverrideCompaction: override,
+		CompactionOverhead: overhead,
+	}, timeoutTick)
+}
+
+func (p *pendingSnapshot) requestExport(w io.Writer,
+	timeoutTick uint64) (*RequestState, error) {
+	return p.send(rsm.SSRequest{Type: rsm.Exported, Writer: w}, timeoutTick)
+}
+
+func (p *pendingSnapshot) send(ssreq rsm.SSRequest,
 	timeoutTick uint64) (*RequestState, error) {
 	if timeoutTick == 0 {
 		return nil, ErrTimeoutTooSmall
@@ -598,13 +861,7 @@ func (p *pendingSnapshot) request(st rsm.SSReqType,
 	if p.snapshotC == nil {
 		return nil, ErrClusterClosed
 	}
-	ssreq := rsm.SSRequest{
-		Type:               st,
-		Path:               path,
-		Key:                random.LockGuardedRand.Uint64(),
-		OverrideCompaction: override,
-		CompactionOverhead: overhead,
-	}
+	ssreq.Key = random.LockGuardedRand.Uint64()
 	req := &RequestState{
 		key:          ssreq.Key,
 		deadline:     p.getTick() + timeoutTick,
@@ -688,6 +945,12 @@ func (p *pendingConfigChange) close() {
 	}
 }
 
+func (p *pendingConfigChange) hasPending() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending != nil
+}
+
 func (p *pendingConfigChange) request(cc pb.ConfigChange,
 	timeoutTick uint64) (*RequestState, error) {
 	if timeoutTick == 0 {
@@ -755,19 +1018,20 @@ func (p *pendingConfigChange) committed(key uint64) {
 	}
 }
 
-func (p *pendingConfigChange) dropped(key uint64) {
+func (p *pendingConfigChange) dropped(key uint64, info pb.DropInfo) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if p.pending == nil {
 		return
 	}
 	if p.pending.key == key {
-		p.pending.dropped()
+		p.pending.dropped(info)
 		p.pending = nil
 	}
 }
 
-func (p *pendingConfigChange) apply(key uint64, rejected bool) {
+func (p *pendingConfigChange) apply(key uint64,
+	rejected bool, r rejection) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if p.pending == nil {
@@ -776,6 +1040,7 @@ func (p *pendingConfigChange) apply(key uint64, rejected bool) {
 	var v RequestResult
 	if rejected {
 		v.code = requestRejected
+		v.rejection = r
 	} else {
 		v.code = requestCompleted
 	}
@@ -816,6 +1081,15 @@ func (p *pendingReadIndex) close() {
 	}
 }
 
+func (p *pendingReadIndex) hasPending() bool {
+	if p.requests != nil && p.requests.pendingSize() > 0 {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.batches) > 0
+}
+
 func (p *pendingReadIndex) read(timeoutTick uint64) (*RequestState, error) {
 	if timeoutTick == 0 {
 		return nil, ErrTimeoutTooSmall
@@ -832,6 +1106,44 @@ func (p *pendingReadIndex) read(timeoutTick uint64) (*RequestState, error) {
 	if !ok {
 		return nil, ErrSystemBusy
 	}
+	req.track()
+	return req, nil
+}
+
+// readAt returns a RequestState instance that completes once the entry at the
+// specified index has been applied. It is not backed by a ReadIndex request.
+func (p *pendingReadIndex) readAt(index uint64,
+	timeoutTick uint64) (*RequestState, error) {
+	return p.readAtIndex(index, timeoutTick, false)
+}
+
+// readStale is similar to readAt, the completed RequestState is flagged as a
+// stale read.
+func (p *pendingReadIndex) readStale(index uint64,
+	timeoutTick uint64) (*RequestState, error) {
+	return p.readAtIndex(index, timeoutTick, true)
+}
+
+func (p *pendingReadIndex) readAtIndex(index uint64,
+	timeoutTick uint64, stale bool) (*RequestState, error) {
+	if timeoutTick == 0 {
+		return nil, ErrTimeoutTooSmall
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return nil, ErrClusterClosed
+	}
+	req := p.pool.Get().(*RequestState)
+	req.reuse(false)
+	req.notifyCommit = false
+	req.deadline = p.getTick() + timeoutTick
+	p.batches[p.genCtx()] = readBatch{
+		index:    index,
+		requests: []*RequestState{req},
+		stale:    stale,
+	}
+	req.track()
 	return req, nil
 }
 
@@ -885,7 +1197,7 @@ func (p *pendingReadIndex) add(sys pb.SystemCtx, reqs []*RequestState) {
 	}
 }
 
-func (p *pendingReadIndex) dropped(system pb.SystemCtx) {
+func (p *pendingReadIndex) dropped(system pb.SystemCtx, info pb.DropInfo) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if p.stopped {
@@ -894,7 +1206,7 @@ func (p *pendingReadIndex) dropped(system pb.SystemCtx) {
 	if rb, ok := p.batches[system]; ok {
 		for _, req := range rb.requests {
 			if req != nil {
-				req.dropped()
+				req.dropped(info)
 			}
 		}
 		delete(p.batches, system)
@@ -916,6 +1228,7 @@ func (p *pendingReadIndex) applied(applied uint64) {
 					if req.deadline > now {
 						req.readyToRead.set()
 						v.code = requestCompleted
+						v.stale = rb.stale
 					} else {
 						v.code = requestTimeout
 					}
@@ -991,9 +1304,21 @@ func newPendingProposal(cfg config.Config,
 
 func (p *pendingProposal) propose(session *client.Session,
 	cmd []byte, timeoutTick uint64) (*RequestState, error) {
+	return p.proposeWithDependency(context.Background(),
+		session, cmd, nil, timeoutTick)
+}
+
+func (p *pendingProposal) proposeWithDependency(ctx context.Context,
+	session *client.Session, cmd []byte, dep *ApplyDependency,
+	timeoutTick uint64) (*RequestState, error) {
 	key := p.nextKey(session.ClientID)
 	pp := p.shards[key%p.ps]
-	return pp.propose(session, cmd, key, timeoutTick)
+	return pp.propose(ctx, session, cmd, dep, key, timeoutTick)
+}
+
+func (p *pendingProposal) rejected(code RequestResultCode,
+	r rejection) *RequestState {
+	return p.shards[0].rejected(code, r)
 }
 
 func (p *pendingProposal) close() {
@@ -1002,6 +1327,18 @@ func (p *pendingProposal) close() {
 	}
 }
 
+func (p *pendingProposal) hasPending() bool {
+	return p.count() > 0
+}
+
+func (p *pendingProposal) count() uint64 {
+	count := uint64(0)
+	for _, pp := range p.shards {
+		count += pp.count()
+	}
+	return count
+}
+
 func (p *pendingProposal) committed(clientID uint64,
 	seriesID uint64, key uint64) {
 	pp := p.shards[key%p.ps]
@@ -1009,15 +1346,24 @@ func (p *pendingProposal) committed(clientID uint64,
 }
 
 func (p *pendingProposal) dropped(clientID uint64,
-	seriesID uint64, key uint64) {
+	seriesID uint64, key uint64, info pb.DropInfo) {
+	pp := p.shards[key%p.ps]
+	pp.dropped(clientID, seriesID, key, info)
+}
+
+func (p *pendingProposal) applied(clientID uint64, seriesID uint64,
+	key uint64, index uint64, result sm.Result, rejected bool) {
 	pp := p.shards[key%p.ps]
-	pp.dropped(clientID, seriesID, key)
+	pp.applied(clientID, seriesID, key, index, result, rejected)
 }
 
-func (p *pendingProposal) applied(clientID uint64,
-	seriesID uint64, key uint64, result sm.Result, rejected bool) {
+// context returns the context of the specified pending proposal, the
+// background context is returned when the proposal is not pending on this
+// node, e.g. it was proposed on another replica.
+func (p *pendingProposal) context(clientID uint64,
+	seriesID uint64, key uint64) context.Context {
 	pp := p.shards[key%p.ps]
-	pp.applied(clientID, seriesID, key, result, rejected)
+	return pp.context(clientID, seriesID, key)
 }
 
 func (p *pendingProposal) nextKey(clientID uint64) uint64 {
@@ -1050,13 +1396,15 @@ func newPendingProposalShard(cfg config.Config,
 	return p
 }
 
-func (p *proposalShard) propose(session *client.Session,
-	cmd []byte, key uint64, timeoutTick uint64) (*RequestState, error) {
+func (p *proposalShard) propose(ctx context.Context,
+	session *client.Session, cmd []byte, dep *ApplyDependency,
+	key uint64, timeoutTick uint64) (*RequestState, error) {
 	if timeoutTick == 0 {
 		return nil, ErrTimeoutTooSmall
 	}
-	if rsm.GetMaxBlockSize(p.cfg.EntryCompressionType) < uint64(len(cmd)) {
-		return nil, ErrPayloadTooBig
+	if limit := rsm.GetMaxBlockSize(p.cfg.EntryCompressionType); limit < uint64(len(cmd)) {
+		return p.rejected(requestRejected,
+			rejection{reason: ReasonPayloadTooBig, limit: limit}), nil
 	}
 	entry := pb.Entry{
 		Key:         key,
@@ -1068,7 +1416,12 @@ func (p *proposalShard) propose(session *client.Session,
 		entry.Type = pb.ApplicationEntry
 	} else {
 		entry.Type = pb.EncodedEntry
-		entry.Cmd = preparePayload(p.cfg.EntryCompressionType, cmd)
+		entry.Cmd = preparePayload(p.cfg.EntryCompressionType,
+			p.cfg.EntryChecksum, cmd)
+	}
+	if dep != nil {
+		entry.Type = pb.EncodedEntry
+		entry.Cmd = rsm.GetDependencyEncoded(entry.Cmd, dep.ClusterID, dep.Index)
 	}
 	req := p.pool.Get().(*RequestState)
 	req.reuse(p.notifyCommit)
@@ -1077,6 +1430,7 @@ func (p *proposalShard) propose(session *client.Session,
 	req.key = entry.Key
 	req.deadline = p.getTick() + timeoutTick
 	req.notifyCommit = p.notifyCommit
+	req.ctx = ctx
 
 	p.mu.Lock()
 	p.pending[entry.Key] = req
@@ -1095,13 +1449,37 @@ func (p *proposalShard) propose(session *client.Session,
 		p.mu.Lock()
 		delete(p.pending, entry.Key)
 		p.mu.Unlock()
+		if p.proposals.isPaused() {
+			plog.Debugf("%s dropped proposal, quota exceeded",
+				dn(p.cfg.ClusterID, p.cfg.NodeID))
+			req.notify(RequestResult{
+				code: requestDropped,
+				rejection: rejection{
+					reason: ReasonQuotaExceeded,
+					limit:  p.cfg.MaxInMemLogSize,
+				},
+			})
+			return req, nil
+		}
 		plog.Debugf("%s dropped proposal, overloaded",
 			dn(p.cfg.ClusterID, p.cfg.NodeID))
 		return nil, ErrSystemBusy
 	}
+	req.track()
 	return req, nil
 }
 
+// rejected returns a RequestState that has already been completed with the
+// specified result code and rejection.
+func (p *proposalShard) rejected(code RequestResultCode,
+	r rejection) *RequestState {
+	req := p.pool.Get().(*RequestState)
+	req.reuse(p.notifyCommit)
+	req.notifyCommit = p.notifyCommit
+	req.notify(RequestResult{code: code, rejection: r})
+	return req
+}
+
 func (p *proposalShard) close() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -1114,6 +1492,12 @@ func (p *proposalShard) close() {
 	}
 }
 
+func (p *proposalShard) count() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return uint64(len(p.pending))
+}
+
 func (p *proposalShard) getProposal(clientID uint64,
 	seriesID uint64, key uint64, now uint64) *RequestState {
 	return p.takeProposal(clientID, seriesID, key, now, true)
@@ -1143,29 +1527,49 @@ func (p *proposalShard) takeProposal(clientID uint64,
 	return nil
 }
 
+func (p *proposalShard) context(clientID uint64,
+	seriesID uint64, key uint64) context.Context {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps, ok := p.pending[key]
+	if !p.stopped && ok && ps.ctx != nil &&
+		ps.clientID == clientID && ps.seriesID == seriesID {
+		return ps.ctx
+	}
+	return context.Background()
+}
+
 func (p *proposalShard) committed(clientID uint64, seriesID uint64, key uint64) {
 	if ps := p.borrowProposal(clientID, seriesID, key, p.getTick()); ps != nil {
 		ps.committed()
 	}
 }
 
-func (p *proposalShard) dropped(clientID uint64, seriesID uint64, key uint64) {
+func (p *proposalShard) dropped(clientID uint64,
+	seriesID uint64, key uint64, info pb.DropInfo) {
 	if ps := p.getProposal(clientID, seriesID, key, p.getTick()); ps != nil {
-		ps.dropped()
+		ps.dropped(info)
 	}
 }
 
-func (p *proposalShard) applied(clientID uint64,
-	seriesID uint64, key uint64, result sm.Result, rejected bool) {
+func (p *proposalShard) applied(clientID uint64, seriesID uint64,
+	key uint64, index uint64, result sm.Result, rejected bool) {
 	now := p.getTick()
 	var code RequestResultCode
+	var r rejection
 	if rejected {
 		code = requestRejected
+		r = getSessionRejection(seriesID)
 	} else {
 		code = requestCompleted
 	}
 	if ps := p.getProposal(clientID, seriesID, key, now); ps != nil {
-		ps.notify(RequestResult{code: code, result: result})
+		ps.notify(RequestResult{
+			code:      code,
+			result:    result,
+			index:     index,
+			rejection: r,
+		})
 	}
 	if now != p.expireNotified {
 		p.gcAt(now)
@@ -1195,6 +1599,10 @@ func (p *proposalShard) gcAt(now uint64) {
 	}
 }
 
-func preparePayload(ct config.CompressionType, cmd []byte) []byte {
+func preparePayload(ct config.CompressionType,
+	checksum bool, cmd []byte) []byte {
+	if checksum {
+		return rsm.GetChecksumEncoded(rsm.ToDioType(ct), cmd)
+	}
 	return rsm.GetEncoded(rsm.ToDioType(ct), cmd, nil)
 }
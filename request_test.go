@@ -15,11 +15,14 @@
 package dragonboat
 
 import (
+	"context"
 	"math/rand"
 	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/lni/dragonboat/v3/client"
 	"github.com/lni/dragonboat/v3/config"
@@ -659,6 +662,24 @@ func TestPendingConfigChangeCanReturnBusy(t *testing.T) {
 	}
 }
 
+func TestPendingConfigChangeHasPendingRequest(t *testing.T) {
+	pcc, _ := getPendingConfigChange(false)
+	if pcc.hasPending() {
+		t.Errorf("unexpected pending request")
+	}
+	var cc pb.ConfigChange
+	if _, err := pcc.request(cc, 100); err != nil {
+		t.Fatalf("RequestConfigChange failed: %v", err)
+	}
+	if !pcc.hasPending() {
+		t.Errorf("pending request not reported")
+	}
+	pcc.close()
+	if pcc.hasPending() {
+		t.Errorf("unexpected pending request after close")
+	}
+}
+
 func TestConfigChangeCanExpire(t *testing.T) {
 	pcc, _ := getPendingConfigChange(false)
 	var cc pb.ConfigChange
@@ -719,7 +740,7 @@ func TestCompletedConfigChangeRequestCanBeNotified(t *testing.T) {
 		t.Errorf("not suppose to return anything yet")
 	default:
 	}
-	pcc.apply(rs.key, false)
+	pcc.apply(rs.key, false, rejection{})
 	select {
 	case v := <-rs.ResultC():
 		if !v.Completed() {
@@ -745,7 +766,7 @@ func TestConfigChangeRequestCanNotBeNotifiedWithDifferentKey(t *testing.T) {
 		t.Errorf("not suppose to return anything yet")
 	default:
 	}
-	pcc.apply(rs.key+1, false)
+	pcc.apply(rs.key+1, false, rejection{})
 	select {
 	case <-rs.ResultC():
 		t.Errorf("unexpectedly notified")
@@ -768,7 +789,7 @@ func TestConfigChangeCanBeDropped(t *testing.T) {
 		t.Errorf("not suppose to return anything yet")
 	default:
 	}
-	pcc.dropped(rs.key)
+	pcc.dropped(rs.key, pb.DropInfo{})
 	select {
 	case v := <-rs.ResultC():
 		if !v.Dropped() {
@@ -794,7 +815,7 @@ func TestConfigChangeWithDifferentKeyWillNotBeDropped(t *testing.T) {
 		t.Errorf("not suppose to return anything yet")
 	default:
 	}
-	pcc.dropped(rs.key + 1)
+	pcc.dropped(rs.key+1, pb.DropInfo{})
 	select {
 	case <-rs.ResultC():
 		t.Errorf("CompletedC unexpectedly set")
@@ -920,7 +941,7 @@ func TestProposalCanBeCompleted(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
-	pp.applied(rs.clientID, rs.seriesID, rs.key+1, sm.Result{}, false)
+	pp.applied(rs.clientID, rs.seriesID, rs.key+1, 0, sm.Result{}, false)
 	select {
 	case <-rs.ResultC():
 		t.Errorf("unexpected applied proposal with invalid client ID")
@@ -929,7 +950,7 @@ func TestProposalCanBeCompleted(t *testing.T) {
 	if countPendingProposal(pp) == 0 {
 		t.Errorf("pending is empty")
 	}
-	pp.applied(rs.clientID, rs.seriesID, rs.key, sm.Result{}, false)
+	pp.applied(rs.clientID, rs.seriesID, rs.key, 0, sm.Result{}, false)
 	select {
 	case v := <-rs.ResultC():
 		if !v.Completed() {
@@ -949,7 +970,7 @@ func TestProposalCanBeDropped(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
-	pp.dropped(rs.clientID, rs.seriesID, rs.key)
+	pp.dropped(rs.clientID, rs.seriesID, rs.key, pb.DropInfo{})
 	select {
 	case v := <-rs.ResultC():
 		if !v.Dropped() {
@@ -965,6 +986,133 @@ func TestProposalCanBeDropped(t *testing.T) {
 	}
 }
 
+func TestDroppedProposalCarriesReasonAndLeaderHint(t *testing.T) {
+	pp, _ := getPendingProposal(false)
+	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	if err != nil {
+		t.Errorf("failed to make proposal, %v", err)
+	}
+	info := pb.DropInfo{Reason: pb.DropLeaderTransferring, LeaderHint: 3}
+	pp.dropped(rs.clientID, rs.seriesID, rs.key, info)
+	select {
+	case v := <-rs.ResultC():
+		if v.Reason() != ReasonLeaderTransferring {
+			t.Errorf("unexpected reason %s", v.Reason())
+		}
+		if hint, ok := v.LeaderHint(); !ok || hint != 3 {
+			t.Errorf("unexpected leader hint %d, %t", hint, ok)
+		}
+	default:
+		t.Errorf("not notified")
+	}
+}
+
+func TestRejectedProposalCarriesReason(t *testing.T) {
+	pp, _ := getPendingProposal(false)
+	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	if err != nil {
+		t.Errorf("failed to make proposal, %v", err)
+	}
+	pp.applied(rs.clientID, rs.seriesID, rs.key, 1, sm.Result{}, true)
+	select {
+	case v := <-rs.ResultC():
+		if !v.Rejected() {
+			t.Errorf("not rejected")
+		}
+		if v.Reason() != ReasonSessionInvalid {
+			t.Errorf("unexpected reason %s", v.Reason())
+		}
+		if _, ok := v.LeaderHint(); ok {
+			t.Errorf("unexpected leader hint")
+		}
+		if len(v.Detail()) == 0 {
+			t.Errorf("detail not set")
+		}
+	default:
+		t.Errorf("not notified")
+	}
+}
+
+func TestTooBigPayloadIsRejectedWithLimit(t *testing.T) {
+	pp, _ := getPendingProposal(false)
+	limit := uint64(1024)
+	rs := pp.rejected(requestRejected,
+		rejection{reason: ReasonPayloadTooBig, limit: limit})
+	select {
+	case v := <-rs.ResultC():
+		if !v.Rejected() {
+			t.Errorf("not rejected")
+		}
+		if v.Reason() != ReasonPayloadTooBig {
+			t.Errorf("unexpected reason %s", v.Reason())
+		}
+		if l, ok := v.Limit(); !ok || l != limit {
+			t.Errorf("unexpected limit %d, want %d", l, limit)
+		}
+	default:
+		t.Errorf("not notified")
+	}
+	if pp.hasPending() {
+		t.Errorf("rejected proposal is pending")
+	}
+}
+
+func TestProposalIsDroppedWhenQuotaExceeded(t *testing.T) {
+	pp, c := getPendingProposal(false)
+	for idx := range pp.shards {
+		pp.shards[idx].cfg.MaxInMemLogSize = 1024
+	}
+	c.get(true)
+	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
+	if err != nil {
+		t.Fatalf("failed to make proposal, %v", err)
+	}
+	select {
+	case v := <-rs.ResultC():
+		if !v.Dropped() {
+			t.Errorf("not dropped")
+		}
+		if v.Reason() != ReasonQuotaExceeded {
+			t.Errorf("unexpected reason %s", v.Reason())
+		}
+		if l, ok := v.Limit(); !ok || l != 1024 {
+			t.Errorf("unexpected limit %d", l)
+		}
+	default:
+		t.Errorf("not notified")
+	}
+	if pp.hasPending() {
+		t.Errorf("dropped proposal is pending")
+	}
+	c.get(false)
+	if _, err := pp.propose(getBlankTestSession(),
+		[]byte("test data"), 100); err != nil {
+		t.Errorf("failed to make proposal, %v", err)
+	}
+}
+
+func TestRejectedConfigChangeCarriesReason(t *testing.T) {
+	pcc, _ := getPendingConfigChange(false)
+	var cc pb.ConfigChange
+	rs, err := pcc.request(cc, 100)
+	if err != nil {
+		t.Errorf("RequestConfigChange failed: %v", err)
+	}
+	r := rejection{reason: ReasonWitnessTarget, detail: "witness"}
+	pcc.apply(rs.key, true, r)
+	select {
+	case v := <-rs.ResultC():
+		if !v.Rejected() {
+			t.Errorf("not rejected")
+		}
+		if v.Reason() != ReasonWitnessTarget || v.Detail() != "witness" {
+			t.Errorf("unexpected reason %s, %s", v.Reason(), v.Detail())
+		}
+	default:
+		t.Errorf("not notified")
+	}
+}
+
 func TestProposalResultCanBeObtainedByCaller(t *testing.T) {
 	pp, _ := getPendingProposal(false)
 	rs, err := pp.propose(getBlankTestSession(), []byte("test data"), 100)
@@ -976,12 +1124,15 @@ func TestProposalResultCanBeObtainedByCaller(t *testing.T) {
 		Data:  make([]byte, 128),
 	}
 	rand.Read(result.Data)
-	pp.applied(rs.clientID, rs.seriesID, rs.key, result, false)
+	pp.applied(rs.clientID, rs.seriesID, rs.key, 100, result, false)
 	select {
 	case v := <-rs.ResultC():
 		if !v.Completed() {
 			t.Errorf("get %v, want %d", v, requestCompleted)
 		}
+		if v.AppliedIndex() != 100 {
+			t.Errorf("applied index %d, want 100", v.AppliedIndex())
+		}
 		r := v.GetResult()
 		if !reflect.DeepEqual(&r, &result) {
 			t.Errorf("result changed")
@@ -997,7 +1148,7 @@ func TestClientIDIsCheckedWhenApplyingProposal(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
-	pp.applied(rs.clientID+1, rs.seriesID, rs.key, sm.Result{}, false)
+	pp.applied(rs.clientID+1, rs.seriesID, rs.key, 0, sm.Result{}, false)
 	select {
 	case <-rs.ResultC():
 		t.Errorf("unexpected applied proposal with invalid client ID")
@@ -1006,7 +1157,7 @@ func TestClientIDIsCheckedWhenApplyingProposal(t *testing.T) {
 	if countPendingProposal(pp) == 0 {
 		t.Errorf("pending is empty")
 	}
-	pp.applied(rs.clientID, rs.seriesID, rs.key, sm.Result{}, false)
+	pp.applied(rs.clientID, rs.seriesID, rs.key, 0, sm.Result{}, false)
 	select {
 	case v := <-rs.ResultC():
 		if !v.Completed() {
@@ -1026,7 +1177,7 @@ func TestSeriesIDIsCheckedWhenApplyingProposal(t *testing.T) {
 	if err != nil {
 		t.Errorf("failed to make proposal, %v", err)
 	}
-	pp.applied(rs.clientID, rs.seriesID+1, rs.key, sm.Result{}, false)
+	pp.applied(rs.clientID, rs.seriesID+1, rs.key, 0, sm.Result{}, false)
 	select {
 	case <-rs.ResultC():
 		t.Errorf("unexpected applied proposal with invalid client ID")
@@ -1035,7 +1186,7 @@ func TestSeriesIDIsCheckedWhenApplyingProposal(t *testing.T) {
 	if countPendingProposal(pp) == 0 {
 		t.Errorf("pending is empty")
 	}
-	pp.applied(rs.clientID, rs.seriesID, rs.key, sm.Result{}, false)
+	pp.applied(rs.clientID, rs.seriesID, rs.key, 0, sm.Result{}, false)
 	select {
 	case v := <-rs.ResultC():
 		if !v.Completed() {
@@ -1064,7 +1215,7 @@ func TestProposalCanBeCommitted(t *testing.T) {
 	if countPendingProposal(pp) == 0 {
 		t.Errorf("pending is empty")
 	}
-	pp.applied(rs.clientID, rs.seriesID, rs.key, sm.Result{}, false)
+	pp.applied(rs.clientID, rs.seriesID, rs.key, 0, sm.Result{}, false)
 	select {
 	case v := <-rs.AppliedC():
 		if !v.Completed() {
@@ -1155,7 +1306,7 @@ func TestClosePendingProposalIgnoresStepEngineActivities(t *testing.T) {
 	for i := uint64(0); i < pp.ps; i++ {
 		pp.shards[i].stopped = true
 	}
-	pp.applied(rs.clientID, rs.seriesID, rs.key, sm.Result{Value: 1}, false)
+	pp.applied(rs.clientID, rs.seriesID, rs.key, 0, sm.Result{Value: 1}, false)
 	select {
 	case <-rs.ResultC():
 		t.Fatalf("completedC unexpectedly signaled")
@@ -1244,6 +1395,65 @@ func TestPendingReadIndexCanReturnBusy(t *testing.T) {
 	}
 }
 
+func TestPendingReadIndexReadStaleIsFlagged(t *testing.T) {
+	pp, _ := getPendingReadIndex()
+	rs, err := pp.readStale(500, 100)
+	if err != nil {
+		t.Fatalf("failed to do read %v", err)
+	}
+	pp.applied(500)
+	select {
+	case v := <-rs.ResultC():
+		if !v.Completed() || !v.Stale() {
+			t.Errorf("unexpected result %v", v)
+		}
+	default:
+		t.Errorf("expect to complete")
+	}
+	rs, err = pp.readAt(500, 100)
+	if err != nil {
+		t.Fatalf("failed to do read %v", err)
+	}
+	pp.applied(500)
+	v := <-rs.ResultC()
+	if !v.Completed() || v.Stale() {
+		t.Errorf("unexpected result %v", v)
+	}
+}
+
+func TestPendingReadIndexReadAtCanComplete(t *testing.T) {
+	pp, _ := getPendingReadIndex()
+	rs, err := pp.readAt(500, 100)
+	if err != nil {
+		t.Fatalf("failed to do read %v", err)
+	}
+	pp.applied(499)
+	select {
+	case <-rs.ResultC():
+		t.Errorf("not expected to be signaled")
+	default:
+	}
+	pp.applied(501)
+	if !rs.readyToRead.ready() {
+		t.Errorf("ready not set")
+	}
+	select {
+	case v := <-rs.ResultC():
+		if !v.Completed() {
+			t.Errorf("got %v, want %d", v, requestCompleted)
+		}
+	default:
+		t.Errorf("expect to complete")
+	}
+	if len(pp.batches) != 0 {
+		t.Errorf("leaking records")
+	}
+	pp.close()
+	if _, err := pp.readAt(500, 100); err != ErrClusterClosed {
+		t.Errorf("failed to return ErrClusterClosed, got %v", err)
+	}
+}
+
 func TestPendingReadIndexCanComplete(t *testing.T) {
 	pp, _ := getPendingReadIndex()
 	rs, err := pp.read(100)
@@ -1288,7 +1498,7 @@ func TestPendingReadIndexCanBeDropped(t *testing.T) {
 	}
 	s := pp.nextCtx()
 	pp.add(s, []*RequestState{rs})
-	pp.dropped(s)
+	pp.dropped(s, pb.DropInfo{})
 	select {
 	case v := <-rs.ResultC():
 		if !v.Dropped() {
@@ -1386,7 +1596,7 @@ func TestProposalAllocationCount(t *testing.T) {
 			atomic.StoreUint32(&total, 0)
 			q.get(false)
 		}
-		pp.applied(rs.key, rs.clientID, rs.seriesID, sm.Result{Value: 1}, false)
+		pp.applied(rs.key, rs.clientID, rs.seriesID, 0, sm.Result{Value: 1}, false)
 		rs.readyToRelease.set()
 		rs.Release()
 	})
@@ -1423,3 +1633,76 @@ func TestReadIndexAllocationCount(t *testing.T) {
 		t.Fatalf("ac %f, want 0", ac)
 	}
 }
+
+func getTrackedPendingProposal() (*pendingProposal,
+	*entryQueue, *requestStateTracker) {
+	c := newEntryQueue(5, 0)
+	tracker := newRequestStateTracker()
+	p := &sync.Pool{}
+	p.New = func() interface{} {
+		obj := &RequestState{}
+		obj.pool = p
+		obj.tracker = tracker
+		obj.CompletedC = make(chan RequestResult, 1)
+		return obj
+	}
+	cfg := config.Config{ClusterID: 100, NodeID: 120}
+	return newPendingProposal(cfg, false, p, c), c, tracker
+}
+
+func TestUnreleasedRequestStatesAreTracked(t *testing.T) {
+	pp, _, tracker := getTrackedPendingProposal()
+	session := client.NewNoOPSession(1, random.LockGuardedRand)
+	rs1, err := pp.propose(session, []byte("test-data"), 100)
+	if err != nil {
+		t.Fatalf("propose failed %v", err)
+	}
+	if _, err := pp.propose(session, []byte("test-data"), 100); err != nil {
+		t.Fatalf("propose failed %v", err)
+	}
+	if v := len(tracker.unreleased()); v != 2 {
+		t.Fatalf("unreleased count %d, want 2", v)
+	}
+	rs1.Release()
+	if v := len(tracker.unreleased()); v != 2 {
+		t.Fatalf("in progress request released")
+	}
+	pp.applied(rs1.clientID, rs1.seriesID, rs1.key, 1, sm.Result{}, false)
+	<-rs1.AppliedC()
+	rs1.Release()
+	states := tracker.unreleased()
+	if len(states) != 1 {
+		t.Fatalf("unreleased count %d, want 1", len(states))
+	}
+	if !strings.Contains(states[0].Stack, "TestUnreleasedRequestStatesAreTracked") {
+		t.Errorf("creation stack not recorded, %s", states[0].Stack)
+	}
+}
+
+func TestRequestStateIsReleasedByWait(t *testing.T) {
+	pp, _, tracker := getTrackedPendingProposal()
+	session := client.NewNoOPSession(1, random.LockGuardedRand)
+	rs, err := pp.propose(session, []byte("test-data"), 100)
+	if err != nil {
+		t.Fatalf("propose failed %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := rs.Wait(ctx); err != ErrTimeout {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if v := len(tracker.unreleased()); v != 1 {
+		t.Fatalf("in progress request released")
+	}
+	pp.applied(rs.clientID, rs.seriesID, rs.key, 1, sm.Result{Value: 100}, false)
+	result, err := rs.Wait(context.Background())
+	if err != nil {
+		t.Fatalf("wait failed %v", err)
+	}
+	if result.GetResult().Value != 100 {
+		t.Errorf("unexpected result %v", result)
+	}
+	if v := len(tracker.unreleased()); v != 0 {
+		t.Errorf("request not released by Wait")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/rsm"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+const (
+	defaultPanicRestartBackoff    = time.Second
+	defaultMaxPanicRestartBackoff = time.Minute
+	// interval between attempts to restart a node that is still being unloaded
+	// from the execution engine
+	restartRetryInterval = 100 * time.Millisecond
+)
+
+// restartState is the state required for restarting a node stopped after its
+// state machine panicked.
+type restartState struct {
+	create  rsm.ManagedStateMachineFactory
+	cfg     config.Config
+	smType  pb.StateMachineType
+	started time.Time
+	backoff time.Duration
+}
+
+// panicRestarter tracks nodes with the RestartOnPanic policy and the backoff
+// delays used for restarting them.
+type panicRestarter struct {
+	mu     sync.Mutex
+	shards map[uint64]*restartState
+}
+
+func newPanicRestarter() *panicRestarter {
+	return &panicRestarter{shards: make(map[uint64]*restartState)}
+}
+
+func getPanicRestartBackoff(cfg config.Config) (time.Duration, time.Duration) {
+	backoff := cfg.PanicRestartBackoff
+	if backoff == 0 {
+		backoff = defaultPanicRestartBackoff
+	}
+	max := cfg.MaxPanicRestartBackoff
+	if max == 0 {
+		max = defaultMaxPanicRestartBackoff
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff, max
+}
+
+// started records that the specified node has been started. The backoff delay
+// of a node restarted after a panic is kept so consecutive panics are handled
+// with increasing delays.
+func (r *panicRestarter) started(cfg config.Config,
+	create rsm.ManagedStateMachineFactory, smType pb.StateMachineType) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cfg.PanicPolicy != config.RestartOnPanic {
+		delete(r.shards, cfg.ClusterID)
+		return
+	}
+	s, ok := r.shards[cfg.ClusterID]
+	if !ok || s.cfg.NodeID != cfg.NodeID {
+		s = &restartState{}
+		r.shards[cfg.ClusterID] = s
+	}
+	s.create = create
+	s.cfg = cfg
+	s.smType = smType
+	s.started = time.Now()
+}
+
+// stopped records that the specified node has been stopped by the user, it
+// is thus not going to be restarted.
+func (r *panicRestarter) stopped(clusterID uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.shards, clusterID)
+}
+
+func (r *panicRestarter) has(clusterID uint64, nodeID uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.shards[clusterID]
+	return ok && s.cfg.NodeID == nodeID
+}
+
+// next returns the state required for restarting the specified node after a
+// panic. The backoff delay is doubled for consecutive panics and it is reset
+// once the node has been running for the maximum backoff delay.
+func (r *panicRestarter) next(clusterID uint64,
+	nodeID uint64, now time.Time) (restartState, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.shards[clusterID]
+	if !ok || s.cfg.NodeID != nodeID {
+		return restartState{}, false
+	}
+	backoff, max := getPanicRestartBackoff(s.cfg)
+	if s.backoff == 0 || now.Sub(s.started) >= max {
+		s.backoff = backoff
+	} else {
+		s.backoff *= 2
+		if s.backoff > max {
+			s.backoff = max
+		}
+	}
+	return *s, true
+}
+
+// nodePanicked is invoked from the execution engine after the state machine of
+// the specified node panicked. The node is stopped and it is restarted after
+// the backoff delay when it has the RestartOnPanic policy.
+func (nh *NodeHost) nodePanicked(n *node) {
+	var rs restartState
+	restart := false
+	if n.config.PanicPolicy == config.RestartOnPanic {
+		rs, restart = nh.restarts.next(n.clusterID, n.nodeID, time.Now())
+	}
+	nh.stopper.RunWorker(func() {
+		v, ok := nh.mu.clusters.Load(n.clusterID)
+		if !ok || v.(*node) != n {
+			return
+		}
+		if err := nh.stopNode(n.clusterID, n.nodeID, true); err != nil {
+			plog.Errorf("failed to stop panicked %s, %v", n.id(), err)
+			return
+		}
+		if restart {
+			nh.restartNode(rs)
+		}
+	})
+}
+
+func (nh *NodeHost) restartNode(rs restartState) {
+	clusterID := rs.cfg.ClusterID
+	nodeID := rs.cfg.NodeID
+	plog.Warningf("%s is going to be restarted in %s",
+		dn(clusterID, nodeID), rs.backoff)
+	delay := rs.backoff
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-nh.stopper.ShouldStop():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if !nh.restarts.has(clusterID, nodeID) {
+			// stopped by the user in the meantime
+			return
+		}
+		err := nh.startCluster(nil, false, rs.create, rs.cfg, rs.smType)
+		if err == nil {
+			plog.Infof("%s restarted after panic", dn(clusterID, nodeID))
+			return
+		}
+		if err == ErrClusterAlreadyExist {
+			if _, ok := nh.mu.clusters.Load(clusterID); ok {
+				// restarted by the user in the meantime
+				return
+			}
+			// still being unloaded from the execution engine
+			delay = restartRetryInterval
+			continue
+		}
+		if err != ErrClosed {
+			plog.Errorf("failed to restart %s, %v", dn(clusterID, nodeID), err)
+		}
+		return
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3/config"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+func TestPanicRestarterBackoff(t *testing.T) {
+	r := newPanicRestarter()
+	cfg := config.Config{
+		ClusterID:              1,
+		NodeID:                 2,
+		PanicPolicy:            config.RestartOnPanic,
+		PanicRestartBackoff:    time.Second,
+		MaxPanicRestartBackoff: 3 * time.Second,
+	}
+	r.started(cfg, nil, pb.RegularStateMachine)
+	if _, ok := r.next(1, 3, time.Now()); ok {
+		t.Fatalf("unexpected restart state for unknown node")
+	}
+	tests := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	for idx, backoff := range tests {
+		rs, ok := r.next(1, 2, time.Now())
+		if !ok {
+			t.Fatalf("%d, no restart state", idx)
+		}
+		if rs.backoff != backoff {
+			t.Errorf("%d, backoff %s, want %s", idx, rs.backoff, backoff)
+		}
+		r.started(cfg, nil, pb.RegularStateMachine)
+	}
+	rs, ok := r.next(1, 2, time.Now().Add(4*time.Second))
+	if !ok || rs.backoff != time.Second {
+		t.Errorf("backoff not reset, %s", rs.backoff)
+	}
+}
+
+func TestPanicRestarterOnlyTracksRestartPolicy(t *testing.T) {
+	r := newPanicRestarter()
+	cfg := config.Config{ClusterID: 1, NodeID: 2}
+	r.started(cfg, nil, pb.RegularStateMachine)
+	if r.has(1, 2) {
+		t.Errorf("node without restart policy tracked")
+	}
+	cfg.PanicPolicy = config.RestartOnPanic
+	r.started(cfg, nil, pb.RegularStateMachine)
+	if !r.has(1, 2) {
+		t.Errorf("node not tracked")
+	}
+	r.stopped(1)
+	if r.has(1, 2) {
+		t.Errorf("stopped node still tracked")
+	}
+}
+
+func TestDefaultPanicRestartBackoff(t *testing.T) {
+	backoff, max := getPanicRestartBackoff(config.Config{})
+	if backoff != defaultPanicRestartBackoff ||
+		max != defaultMaxPanicRestartBackoff {
+		t.Errorf("unexpected defaults %s, %s", backoff, max)
+	}
+	cfg := config.Config{PanicRestartBackoff: 2 * time.Minute}
+	if backoff, _ := getPanicRestartBackoff(cfg); backoff != max {
+		t.Errorf("backoff not capped, %s", backoff)
+	}
+}
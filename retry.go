@@ -0,0 +1,198 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+// RetryAttempt describes how a single attempt of an internally retried request
+// spent its time budget.
+type RetryAttempt struct {
+	// Budget is the time budget assigned to the attempt.
+	Budget time.Duration
+	// Elapsed is the time actually spent on the attempt.
+	Elapsed time.Duration
+	// Backoff is the time waited after the attempt.
+	Backoff time.Duration
+	// Err is the error returned by the attempt.
+	Err error
+}
+
+// RetryError is the error returned when an internally retried request failed
+// after all its attempts. It describes how the deadline of the caller was
+// spent to help diagnosing timeout errors.
+type RetryError struct {
+	// Attempts contains details of each failed attempt.
+	Attempts []RetryAttempt
+	// Elapsed is the total time spent on all attempts and backoffs.
+	Elapsed time.Duration
+	// Err is the reason why no further attempt was made, it is the error of
+	// the last attempt or the error of the caller's context.
+	Err error
+}
+
+// Error returns the description of the RetryError.
+func (e *RetryError) Error() string {
+	attempts := make([]string, 0, len(e.Attempts))
+	for idx, a := range e.Attempts {
+		attempts = append(attempts,
+			fmt.Sprintf("#%d budget %s spent %s backoff %s: %v",
+				idx+1, a.Budget, a.Elapsed, a.Backoff, a.Err))
+	}
+	return fmt.Sprintf("%v after %d attempts in %s [%s]",
+		e.Err, len(e.Attempts), e.Elapsed, strings.Join(attempts, "; "))
+}
+
+// Unwrap returns the underlying error.
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+type retrier struct {
+	cfg      config.RetryConfig
+	stopc    <-chan struct{}
+	attempts []RetryAttempt
+	start    time.Time
+}
+
+func newRetrier(cfg config.RetryConfig, stopc <-chan struct{}) *retrier {
+	return &retrier{cfg: cfg, stopc: stopc}
+}
+
+// run invokes op until it succeeds, returns a non-temporary error, the max
+// number of attempts is reached or the deadline of ctx is reached. Each
+// invocation of op is given a context with its own time budget. A *RetryError
+// is returned when op failed with temporary errors.
+func (r *retrier) run(ctx context.Context,
+	op func(ctx context.Context) error) error {
+	r.start = time.Now()
+	r.attempts = r.attempts[:0]
+	for {
+		budget, ok := r.budget(ctx)
+		if !ok {
+			return r.fail(getContextError(ctx, ErrTimeout))
+		}
+		actx, cancel := context.WithTimeout(ctx, budget)
+		st := time.Now()
+		err := op(actx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		r.attempts = append(r.attempts, RetryAttempt{
+			Budget:  budget,
+			Elapsed: time.Since(st),
+			Err:     err,
+		})
+		if !IsTempError(err) || err == ErrClosed {
+			return err
+		}
+		if r.cfg.MaxAttempts > 0 &&
+			uint64(len(r.attempts)) >= r.cfg.MaxAttempts {
+			return r.fail(err)
+		}
+		backoff := r.backoff(ctx)
+		r.attempts[len(r.attempts)-1].Backoff = backoff
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return r.fail(getContextError(ctx, err))
+		case <-r.stopc:
+			timer.Stop()
+			return ErrClosed
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *retrier) fail(err error) error {
+	return &RetryError{
+		Attempts: append([]RetryAttempt{}, r.attempts...),
+		Elapsed:  time.Since(r.start),
+		Err:      err,
+	}
+}
+
+// budget returns the time budget of the next attempt. The remaining time is
+// evenly split among the remaining attempts, the result is then bounded by
+// the MinAttemptTimeout and MaxAttemptTimeout settings and the remaining time.
+func (r *retrier) budget(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return r.cfg.MaxAttemptTimeout, ctx.Err() == nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 || ctx.Err() != nil {
+		return 0, false
+	}
+	budget := remaining
+	if r.cfg.MaxAttempts > 0 {
+		left := r.cfg.MaxAttempts - uint64(len(r.attempts))
+		budget = remaining / time.Duration(left)
+	}
+	if budget < r.cfg.MinAttemptTimeout {
+		budget = r.cfg.MinAttemptTimeout
+	}
+	if budget > r.cfg.MaxAttemptTimeout {
+		budget = r.cfg.MaxAttemptTimeout
+	}
+	if budget > remaining {
+		budget = remaining
+	}
+	return budget, true
+}
+
+// backoff returns the jittered exponential backoff to be applied after the
+// latest failed attempt.
+func (r *retrier) backoff(ctx context.Context) time.Duration {
+	backoff := r.cfg.InitialBackoff
+	for i := 1; i < len(r.attempts) && backoff < r.cfg.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.cfg.MaxBackoff {
+		backoff = r.cfg.MaxBackoff
+	}
+	if r.cfg.BackoffJitter > 0 {
+		jitter := float64(backoff) * r.cfg.BackoffJitter * (2*rand.Float64() - 1)
+		backoff += time.Duration(jitter)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); backoff > remaining {
+			backoff = remaining
+		}
+	}
+	if backoff < 0 {
+		backoff = 0
+	}
+	return backoff
+}
+
+func getContextError(ctx context.Context, err error) error {
+	if ctx.Err() == context.Canceled {
+		return ErrCanceled
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return err
+}
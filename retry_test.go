@@ -0,0 +1,148 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v3/config"
+)
+
+func getTestRetryConfig() config.RetryConfig {
+	return config.RetryConfig{
+		MaxAttempts:       4,
+		MinAttemptTimeout: 10 * time.Millisecond,
+		MaxAttemptTimeout: time.Second,
+		InitialBackoff:    time.Millisecond,
+		MaxBackoff:        4 * time.Millisecond,
+	}
+}
+
+func TestRetrierSplitsDeadline(t *testing.T) {
+	r := newRetrier(getTestRetryConfig(), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	budget, ok := r.budget(ctx)
+	if !ok {
+		t.Fatalf("no budget")
+	}
+	if budget > 100*time.Millisecond || budget < 90*time.Millisecond {
+		t.Errorf("unexpected budget %s", budget)
+	}
+	r.cfg.MaxAttempts = 0
+	budget, ok = r.budget(ctx)
+	if !ok || budget < 300*time.Millisecond {
+		t.Errorf("unexpected budget %s", budget)
+	}
+	r.cfg.MaxAttemptTimeout = 20 * time.Millisecond
+	if budget, _ := r.budget(ctx); budget != 20*time.Millisecond {
+		t.Errorf("unexpected budget %s", budget)
+	}
+	budget, ok = r.budget(context.Background())
+	if !ok || budget != 20*time.Millisecond {
+		t.Errorf("unexpected budget %s", budget)
+	}
+}
+
+func TestRetrierBackoff(t *testing.T) {
+	r := newRetrier(getTestRetryConfig(), nil)
+	expected := []time.Duration{
+		time.Millisecond,
+		2 * time.Millisecond,
+		4 * time.Millisecond,
+		4 * time.Millisecond,
+	}
+	for _, v := range expected {
+		r.attempts = append(r.attempts, RetryAttempt{})
+		if backoff := r.backoff(context.Background()); backoff != v {
+			t.Errorf("backoff %s, want %s", backoff, v)
+		}
+	}
+	r.cfg.BackoffJitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := r.backoff(context.Background())
+		if backoff < 2*time.Millisecond || backoff > 6*time.Millisecond {
+			t.Fatalf("unexpected backoff %s", backoff)
+		}
+	}
+}
+
+func TestRetrierReturnsRetryError(t *testing.T) {
+	r := newRetrier(getTestRetryConfig(), nil)
+	count := 0
+	err := r.run(context.Background(), func(ctx context.Context) error {
+		count++
+		return ErrSystemBusy
+	})
+	if count != 4 {
+		t.Errorf("attempted %d times, want 4", count)
+	}
+	var re *RetryError
+	if !errors.As(err, &re) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(re.Attempts) != 4 || !errors.Is(err, ErrSystemBusy) {
+		t.Errorf("unexpected retry error %v", re)
+	}
+	for _, a := range re.Attempts {
+		if a.Budget == 0 || a.Err != ErrSystemBusy {
+			t.Errorf("unexpected attempt %+v", a)
+		}
+	}
+}
+
+func TestRetrierStopsOnDeadline(t *testing.T) {
+	cfg := getTestRetryConfig()
+	cfg.MaxAttempts = 0
+	r := newRetrier(cfg, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := r.run(ctx, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ErrTimeout
+	})
+	var re *RetryError
+	if !errors.As(err, &re) || re.Err != ErrTimeout || len(re.Attempts) == 0 {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestRetrierDoesNotRetryPermanentError(t *testing.T) {
+	r := newRetrier(getTestRetryConfig(), nil)
+	count := 0
+	err := r.run(context.Background(), func(ctx context.Context) error {
+		count++
+		if count == 2 {
+			return ErrRejected
+		}
+		return ErrSystemBusy
+	})
+	if err != ErrRejected || count != 2 {
+		t.Errorf("unexpected result %v, %d", err, count)
+	}
+	count = 0
+	if err := r.run(context.Background(), func(ctx context.Context) error {
+		count++
+		if count == 3 {
+			return nil
+		}
+		return ErrClusterNotReady
+	}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/rsm"
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+// BootstrapClusterFromSnapshot bootstraps a brand new Raft node identified by
+// the ClusterID and NodeID fields of cfg using the exported snapshot found in
+// the srcDir directory, srcDir is the snapshot directory created by the
+// RequestSnapshot method with the Exported field of its SnapshotOption set to
+// true. The state captured in the exported snapshot becomes the initial state
+// of the node and initialMembers becomes its initial membership. The ClusterID
+// and membership of the Raft cluster from which the snapshot was exported are
+// ignored, allowing the state of an existing Raft cluster to be cloned into a
+// different Raft cluster, e.g. for testing or blue/green migrations.
+//
+// BootstrapClusterFromSnapshot only prepares the on-disk state of the node, it
+// should be invoked on all NodeHosts hosting the initial members of the new
+// Raft cluster with the same srcDir content and initialMembers. The node is
+// then started by calling StartCluster, StartConcurrentCluster or
+// StartOnDiskCluster with the same initialMembers and the join flag set to
+// false, the type of the state machine must match the one that exported the
+// snapshot. ErrClusterAlreadyExist is returned when the specified node is
+// already running or has already been bootstrapped on the NodeHost.
+func (nh *NodeHost) BootstrapClusterFromSnapshot(srcDir string,
+	initialMembers map[uint64]Target, cfg config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if _, ok := initialMembers[cfg.NodeID]; !ok ||
+		cfg.IsObserver || cfg.IsWitness {
+		return ErrInvalidClusterSettings
+	}
+	validator := nh.nhConfig.GetTargetValidator()
+	for _, target := range initialMembers {
+		if !validator(target) {
+			return ErrInvalidTarget
+		}
+	}
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	clusterID := cfg.ClusterID
+	nodeID := cfg.NodeID
+	if _, ok := nh.mu.clusters.Load(clusterID); ok {
+		return ErrClusterAlreadyExist
+	}
+	if nh.engine.nodeLoaded(clusterID, nodeID) {
+		return ErrClusterAlreadyExist
+	}
+	_, err := nh.mu.logdb.GetBootstrapInfo(clusterID, nodeID)
+	if err == nil {
+		return ErrClusterAlreadyExist
+	} else if err != raftio.ErrNoBootstrapInfo {
+		return err
+	}
+	fs := nh.fs
+	old, err := getExportedSnapshot(srcDir, fs)
+	if err != nil {
+		return err
+	}
+	did := nh.nhConfig.GetDeploymentID()
+	if err := nh.env.CreateSnapshotDir(did, clusterID, nodeID); err != nil {
+		if err == server.ErrDirMarkedAsDeleted {
+			return ErrNodeRemoved
+		}
+		return err
+	}
+	getSnapshotDir := func(cid uint64, nid uint64) string {
+		return nh.env.GetSnapshotDir(did, cid, nid)
+	}
+	env := server.NewSSEnv(getSnapshotDir,
+		clusterID, nodeID, old.Index, nodeID, server.SnapshotMode, fs)
+	if err := env.CreateTempDir(); err != nil {
+		return err
+	}
+	ss := getBootstrapSnapshot(env.GetFinalDir(), old, clusterID, initialMembers, fs)
+	if err := copyExportedSnapshot(old, srcDir, env.GetTempDir(), fs); err != nil {
+		env.MustRemoveTempDir()
+		return err
+	}
+	if err := env.SaveSSMetadata(&ss); err != nil {
+		env.MustRemoveTempDir()
+		return err
+	}
+	if err := env.FinalizeSnapshot(&ss); err != nil {
+		env.MustRemoveTempDir()
+		return err
+	}
+	if err := nh.mu.logdb.ImportSnapshot(ss, nodeID); err != nil {
+		return err
+	}
+	bi := pb.NewBootstrapInfo(false, ss.Type, initialMembers)
+	if err := nh.mu.logdb.SaveBootstrapInfo(clusterID, nodeID, bi); err != nil {
+		return err
+	}
+	plog.Infof("%s bootstrapped from exported snapshot %s, index %d",
+		dn(clusterID, nodeID), srcDir, ss.Index)
+	return env.RemoveFlagFile()
+}
+
+func getExportedSnapshot(srcDir string, fs vfs.IFS) (pb.Snapshot, error) {
+	exist, err := fileutil.Exist(srcDir, fs)
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	if !exist {
+		return pb.Snapshot{}, ErrDirNotExist
+	}
+	var ss pb.Snapshot
+	if err := fileutil.GetFlagFileContent(srcDir,
+		server.MetadataFilename, &ss, fs); err != nil {
+		return pb.Snapshot{}, err
+	}
+	if ss.Dummy || ss.Witness || ss.Type == pb.UnknownStateMachine {
+		return pb.Snapshot{}, ErrInvalidExportedSnapshot
+	}
+	fp := fs.PathJoin(srcDir, fs.PathBase(ss.Filepath))
+	checksum, err := rsm.GetV2PayloadChecksum(fp, fs)
+	if err != nil {
+		return pb.Snapshot{}, err
+	}
+	if !bytes.Equal(checksum, ss.Checksum) {
+		return pb.Snapshot{}, ErrInvalidExportedSnapshot
+	}
+	return ss, nil
+}
+
+func getBootstrapSnapshot(dir string, old pb.Snapshot,
+	clusterID uint64, members map[uint64]Target, fs vfs.IFS) pb.Snapshot {
+	files := make([]*pb.SnapshotFile, 0, len(old.Files))
+	for _, f := range old.Files {
+		file := *f
+		file.Filepath = fs.PathJoin(dir, fs.PathBase(f.Filepath))
+		files = append(files, &file)
+	}
+	ss := pb.Snapshot{
+		Filepath: fs.PathJoin(dir, fs.PathBase(old.Filepath)),
+		FileSize: old.FileSize,
+		Index:    old.Index,
+		Term:     old.Term,
+		Checksum: old.Checksum,
+		Membership: pb.Membership{
+			ConfigChangeId: old.Index,
+			Addresses:      make(map[uint64]string),
+			Observers:      make(map[uint64]string),
+			Witnesses:      make(map[uint64]string),
+			Removed:        make(map[uint64]bool),
+		},
+		Files:     files,
+		Type:      old.Type,
+		ClusterId: clusterID,
+		Imported:  true,
+	}
+	for nid, addr := range members {
+		ss.Membership.Addresses[nid] = addr
+	}
+	return ss
+}
+
+func copyExportedSnapshot(ss pb.Snapshot,
+	srcDir string, dstDir string, fs vfs.IFS) error {
+	names := []string{fs.PathBase(ss.Filepath)}
+	for _, f := range ss.Files {
+		names = append(names, fs.PathBase(f.Filepath))
+	}
+	for _, name := range names {
+		if err := fileutil.CopyFile(fs.PathJoin(srcDir, name),
+			fs.PathJoin(dstDir, name), fs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
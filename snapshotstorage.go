@@ -0,0 +1,193 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+const (
+	// placedFlagFilename is the name of the flag file created in the final
+	// snapshot directory once the snapshot has been placed in the snapshot
+	// storage, only snapshots with such flag file can be released.
+	placedFlagFilename = "dragonboat.snapshot.placed"
+	downloadSuffix     = ".download"
+)
+
+// storageKey returns the key of the object used for storing the specified
+// snapshot file in the snapshot storage.
+func (s *snapshotter) storageKey(index uint64, fp string) string {
+	env := s.getEnv(index)
+	return fmt.Sprintf("%d/%d/%s/%s", s.clusterID, s.nodeID,
+		s.fs.PathBase(env.GetFinalDir()), s.fs.PathBase(fp))
+}
+
+// snapshotFiles returns paths of the snapshot image and all external files
+// of the specified snapshot.
+func (s *snapshotter) snapshotFiles(ss pb.Snapshot) []string {
+	files := []string{s.getFilePath(ss.Index)}
+	for _, f := range ss.Files {
+		files = append(files, f.Filepath)
+	}
+	return files
+}
+
+func (s *snapshotter) useStorage(ss pb.Snapshot) bool {
+	return s.storage != nil && !ss.Dummy && !ss.Witness
+}
+
+// place uploads the specified snapshot to the snapshot storage and then
+// releases local copies of older snapshots that have already been placed.
+func (s *snapshotter) place(ss pb.Snapshot) error {
+	if !s.useStorage(ss) {
+		return nil
+	}
+	for _, fp := range s.snapshotFiles(ss) {
+		if err := s.upload(s.storageKey(ss.Index, fp), fp); err != nil {
+			return err
+		}
+	}
+	env := s.getEnv(ss.Index)
+	if err := fileutil.CreateFlagFile(env.GetFinalDir(),
+		placedFlagFilename, &ss, s.fs); err != nil {
+		return err
+	}
+	plog.Infof("%s placed %s in %s",
+		s.id(), s.ssid(ss.Index), s.storage.Name())
+	snapshots, err := s.logdb.ListSnapshots(s.clusterID, s.nodeID, ss.Index-1)
+	if err != nil {
+		return err
+	}
+	for _, old := range snapshots {
+		if old.Index < ss.Index {
+			if err := s.release(old); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// release removes the local copy of the specified snapshot when it has been
+// placed in the snapshot storage. The final snapshot directory and its flag
+// files are kept.
+func (s *snapshotter) release(ss pb.Snapshot) error {
+	if !s.useStorage(ss) {
+		return nil
+	}
+	env := s.getEnv(ss.Index)
+	dir := env.GetFinalDir()
+	if !fileutil.HasFlagFile(dir, placedFlagFilename, s.fs) {
+		return nil
+	}
+	released := false
+	for _, fp := range s.snapshotFiles(ss) {
+		exist, err := fileutil.Exist(fp, s.fs)
+		if err != nil {
+			return err
+		}
+		if exist {
+			if err := s.fs.RemoveAll(fp); err != nil {
+				return err
+			}
+			released = true
+		}
+	}
+	if released {
+		plog.Debugf("%s released local copy of %s", s.id(), s.ssid(ss.Index))
+		return fileutil.SyncDir(dir, s.fs)
+	}
+	return nil
+}
+
+// fetch restores the local copy of the specified snapshot from the snapshot
+// storage when it has been released.
+func (s *snapshotter) fetch(ss pb.Snapshot) error {
+	if !s.useStorage(ss) {
+		return nil
+	}
+	for _, fp := range s.snapshotFiles(ss) {
+		exist, err := fileutil.Exist(fp, s.fs)
+		if err != nil {
+			return err
+		}
+		if exist {
+			continue
+		}
+		if err := fileutil.MkdirAll(s.fs.PathDir(fp), s.fs); err != nil {
+			return err
+		}
+		plog.Infof("%s fetching %s of %s from %s",
+			s.id(), s.fs.PathBase(fp), s.ssid(ss.Index), s.storage.Name())
+		if err := s.download(s.storageKey(ss.Index, fp), fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unplace removes the specified snapshot from the snapshot storage.
+func (s *snapshotter) unplace(ss pb.Snapshot) error {
+	if !s.useStorage(ss) {
+		return nil
+	}
+	for _, fp := range s.snapshotFiles(ss) {
+		key := s.storageKey(ss.Index, fp)
+		if err := s.storage.Delete(context.Background(), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *snapshotter) upload(key string, fp string) (err error) {
+	f, err := s.fs.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return s.storage.Put(context.Background(), key, f)
+}
+
+func (s *snapshotter) download(key string, fp string) error {
+	tmp := fp + downloadSuffix
+	f, err := s.fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.Get(context.Background(), key, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(tmp, fp); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(s.fs.PathDir(fp), s.fs)
+}
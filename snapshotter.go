@@ -15,9 +15,13 @@
 package dragonboat
 
 import (
+	"encoding/binary"
 	"errors"
+	"io"
 	"math"
+	"time"
 
+	"github.com/juju/ratelimit"
 	"github.com/lni/goutils/logutil"
 
 	"github.com/lni/dragonboat/v3/internal/fileutil"
@@ -31,7 +35,9 @@ import (
 )
 
 const (
-	snapshotsToKeep = 3
+	snapshotsToKeep       = 3
+	checkpointFilename    = "dragonboat.checkpoint"
+	checkpointTmpFilename = "dragonboat.checkpoint.tmp"
 )
 
 func compressionType(ct pb.CompressionType) dio.CompressionType {
@@ -39,6 +45,8 @@ func compressionType(ct pb.CompressionType) dio.CompressionType {
 		return dio.NoCompression
 	} else if ct == pb.Snappy {
 		return dio.Snappy
+	} else if ct == pb.Zstd {
+		return dio.Zstd
 	} else {
 		plog.Panicf("unknown compression type: %d", ct)
 	}
@@ -50,15 +58,23 @@ var (
 	// available.
 	ErrNoSnapshot        = errors.New("no snapshot available")
 	errSnapshotOutOfDate = errors.New("snapshot being generated is out of date")
+	// ErrUnknownSnapshotCompression indicates that the snapshot is compressed
+	// using a compression type not supported by this NodeHost.
+	ErrUnknownSnapshotCompression = errors.New("unknown snapshot compression type")
 )
 
 type snapshotter struct {
-	root      server.SnapshotDirFunc
-	dir       string
-	clusterID uint64
-	nodeID    uint64
-	logdb     raftio.ILogDB
-	fs        vfs.IFS
+	root            server.SnapshotDirFunc
+	dir             string
+	clusterID       uint64
+	nodeID          uint64
+	logdb           raftio.ILogDB
+	fs              vfs.IFS
+	retentionCount  uint64
+	retentionPeriod time.Duration
+	saveBucket      *ratelimit.Bucket
+	encryption      raftio.IEncryptionProvider
+	storage         raftio.ISnapshotStorage
 }
 
 var _ rsm.ISnapshotter = (*snapshotter)(nil)
@@ -75,6 +91,31 @@ func newSnapshotter(clusterID uint64, nodeID uint64,
 	}
 }
 
+// setRetentionPolicy sets the policy used by compact to decide which old
+// snapshots to keep. At least snapshotsToKeep snapshots are always retained.
+func (s *snapshotter) setRetentionPolicy(count uint64, period time.Duration) {
+	s.retentionCount = count
+	s.retentionPeriod = period
+}
+
+// setSaveRateLimit sets the bucket used for limiting the disk bandwidth used
+// for saving snapshots.
+func (s *snapshotter) setSaveRateLimit(bucket *ratelimit.Bucket) {
+	s.saveBucket = bucket
+}
+
+// setEncryptionProvider sets the encryption provider used for encrypting and
+// decrypting snapshot images.
+func (s *snapshotter) setEncryptionProvider(ep raftio.IEncryptionProvider) {
+	s.encryption = ep
+}
+
+// setSnapshotStorage sets the storage backend used for placing finalized
+// snapshots.
+func (s *snapshotter) setSnapshotStorage(storage raftio.ISnapshotStorage) {
+	s.storage = storage
+}
+
 func (s *snapshotter) id() string {
 	return dn(s.clusterID, s.nodeID)
 }
@@ -87,10 +128,27 @@ func (s *snapshotter) Shrunk(ss pb.Snapshot) (bool, error) {
 	return rsm.IsShrunkSnapshotFile(s.getFilePath(ss.Index), s.fs)
 }
 
+// Stream pipes the snapshot data generated by the streamable chunk by chunk
+// into the specified sink, nothing is staged in the local snapshot directory.
 func (s *snapshotter) Stream(streamable rsm.IStreamable,
 	meta rsm.SSMeta, sink pb.IChunkSink) error {
+	if meta.Request.DeltaSince > 0 {
+		if ds, ok := streamable.(rsm.IDeltaStreamable); ok {
+			if done, err := s.streamDelta(ds, meta, sink); done {
+				return err
+			}
+		}
+		plog.Infof("delta snapshot since %d not available, streaming full snapshot",
+			meta.Request.DeltaSince)
+		meta.Request.DeltaSince = 0
+	}
 	ct := compressionType(meta.CompressionType)
-	cw := dio.NewCompressor(ct, rsm.NewChunkWriter(sink, meta))
+	w, err := rsm.NewEncryptedChunkWriter(sink, meta, s.encryption)
+	if err != nil {
+		sink.Stop()
+		return err
+	}
+	cw := dio.NewLeveledCompressor(ct, meta.CompressionLevel, w)
 	if err := streamable.Stream(meta.Ctx, cw); err != nil {
 		sink.Stop()
 		return err
@@ -98,8 +156,33 @@ func (s *snapshotter) Stream(streamable rsm.IStreamable,
 	return cw.Close()
 }
 
+// streamDelta tries to stream a delta snapshot, the returned boolean value
+// is false when the delta snapshot is not available and nothing has been sent
+// to the remote node, a full snapshot is expected to be streamed instead.
+func (s *snapshotter) streamDelta(ds rsm.IDeltaStreamable,
+	meta rsm.SSMeta, sink pb.IChunkSink) (bool, error) {
+	ct := compressionType(meta.CompressionType)
+	w, err := rsm.NewEncryptedChunkWriter(sink, meta, s.encryption)
+	if err != nil {
+		sink.Stop()
+		return true, err
+	}
+	cw := dio.NewLeveledCompressor(ct, meta.CompressionLevel, w)
+	if err := ds.StreamDelta(meta.Ctx, meta.Request.DeltaSince, cw); err != nil {
+		if err == sm.ErrDeltaSnapshotNotAvailable && !w.Sent() {
+			return false, nil
+		}
+		sink.Stop()
+		return true, err
+	}
+	return true, cw.Close()
+}
+
 func (s *snapshotter) Save(savable rsm.ISavable,
 	meta rsm.SSMeta) (ss pb.Snapshot, env server.SSEnv, err error) {
+	if meta.Request.ExportedToWriter() {
+		return s.export(savable, meta)
+	}
 	env = s.getCustomEnv(meta)
 	if err := env.CreateTempDir(); err != nil {
 		return pb.Snapshot{}, env, err
@@ -107,12 +190,18 @@ func (s *snapshotter) Save(savable rsm.ISavable,
 	files := rsm.NewFileCollection()
 	fp := env.GetTempFilepath()
 	ct := compressionType(meta.CompressionType)
-	w, err := rsm.NewSnapshotWriter(fp, meta.CompressionType, s.fs)
+	w, err := rsm.NewEncryptedSnapshotWriter(fp,
+		meta.CompressionType, s.encryption, s.fs)
 	if err != nil {
 		return pb.Snapshot{}, env, err
 	}
-	cw := dio.NewCountedWriter(w)
-	sw := dio.NewCompressor(ct, cw)
+	w.SetSchemaVersion(meta.SchemaVersion)
+	var wc io.WriteCloser = w
+	if s.saveBucket != nil {
+		wc = &throttledWriter{WriteCloser: w, bucket: s.saveBucket}
+	}
+	cw := dio.NewCountedWriter(wc)
+	sw := dio.NewLeveledCompressor(ct, meta.CompressionLevel, cw)
 	defer func() {
 		if cerr := sw.Close(); err == nil {
 			err = cerr
@@ -145,8 +234,102 @@ func (s *snapshotter) Save(savable rsm.ISavable,
 	}, env, nil
 }
 
+// throttledWriter is an io.WriteCloser with its write bandwidth limited by the
+// specified bucket.
+type throttledWriter struct {
+	io.WriteCloser
+	bucket *ratelimit.Bucket
+}
+
+func (w *throttledWriter) Write(data []byte) (int, error) {
+	w.bucket.Wait(int64(len(data)))
+	return w.WriteCloser.Write(data)
+}
+
+// export streams the snapshot to the io.Writer specified in the request as
+// snapshot chunks, the concatenated chunk payloads form a regular snapshot
+// file. No snapshot file is written to the local disk.
+func (s *snapshotter) export(savable rsm.ISavable,
+	meta rsm.SSMeta) (pb.Snapshot, server.SSEnv, error) {
+	env := s.getEnv(meta.Index)
+	sink := &writerSink{
+		w:         meta.Request.Writer,
+		clusterID: s.clusterID,
+		nodeID:    s.nodeID,
+	}
+	ct := compressionType(meta.CompressionType)
+	w, err := rsm.NewEncryptedChunkWriter(sink, meta, s.encryption)
+	if err != nil {
+		return pb.Snapshot{}, env, err
+	}
+	cw := dio.NewLeveledCompressor(ct, meta.CompressionLevel, w)
+	files := rsm.NewFileCollection()
+	dummy, err := savable.Save(meta, cw, meta.Session.Bytes(), files)
+	if err == nil && files.Size() > 0 {
+		plog.Errorf("%s external files can not be exported to writer", s.id())
+		err = sm.ErrSnapshotAborted
+	}
+	if err == nil {
+		err = cw.Close()
+	}
+	if sink.err != nil {
+		plog.Errorf("%s failed to export snapshot to writer, %v",
+			s.id(), sink.err)
+		return pb.Snapshot{}, env, sm.ErrSnapshotAborted
+	}
+	if err != nil {
+		return pb.Snapshot{}, env, err
+	}
+	return pb.Snapshot{
+		ClusterId:   s.clusterID,
+		Membership:  meta.Membership,
+		Index:       meta.Index,
+		Term:        meta.Term,
+		OnDiskIndex: meta.OnDiskIndex,
+		Dummy:       dummy,
+		Type:        meta.Type,
+	}, env, nil
+}
+
+// writerSink is a pb.IChunkSink that writes the payload of received snapshot
+// chunks to an io.Writer.
+type writerSink struct {
+	w         io.Writer
+	err       error
+	clusterID uint64
+	nodeID    uint64
+}
+
+var _ pb.IChunkSink = (*writerSink)(nil)
+
+func (s *writerSink) Receive(chunk pb.Chunk) (bool, bool) {
+	if s.err != nil {
+		return false, false
+	}
+	if len(chunk.Data) > 0 {
+		if _, err := s.w.Write(chunk.Data); err != nil {
+			s.err = err
+			return false, false
+		}
+	}
+	return true, false
+}
+
+func (s *writerSink) Stop() {}
+
+func (s *writerSink) ClusterID() uint64 {
+	return s.clusterID
+}
+
+func (s *writerSink) ToNodeID() uint64 {
+	return s.nodeID
+}
+
 func (s *snapshotter) Load(ss pb.Snapshot,
 	sessions rsm.ILoadable, asm rsm.IRecoverable) (err error) {
+	if err := s.fetch(ss); err != nil {
+		return err
+	}
 	fp := s.getFilePath(ss.Index)
 	fs := make([]sm.SnapshotFile, 0)
 	for _, f := range ss.Files {
@@ -156,7 +339,7 @@ func (s *snapshotter) Load(ss pb.Snapshot,
 			Metadata: f.Metadata,
 		})
 	}
-	reader, err := rsm.NewSnapshotReader(fp, s.fs)
+	reader, err := rsm.NewEncryptedSnapshotReader(fp, s.encryption, s.fs)
 	if err != nil {
 		return err
 	}
@@ -165,6 +348,10 @@ func (s *snapshotter) Load(ss pb.Snapshot,
 		reader.Close()
 		return err
 	}
+	if !dio.IsKnownCompressionType(header.CompressionType) {
+		reader.Close()
+		return ErrUnknownSnapshotCompression
+	}
 	ct := compressionType(header.CompressionType)
 	cr := dio.NewDecompressor(ct, reader)
 	defer func() {
@@ -176,7 +363,20 @@ func (s *snapshotter) Load(ss pb.Snapshot,
 	if err := sessions.LoadSessions(cr, v); err != nil {
 		return err
 	}
-	if err := asm.Recover(cr, fs); err != nil {
+	if sv, ok := asm.(rsm.ISchemaVersioned); ok {
+		if err := sv.PrepareRecovery(header.SchemaVersion); err != nil {
+			return err
+		}
+	}
+	if header.DeltaSince > 0 {
+		dr, ok := asm.(rsm.IDeltaRecoverable)
+		if !ok {
+			return sm.ErrNotImplemented
+		}
+		if err := dr.RecoverFromDelta(cr, header.DeltaSince); err != nil {
+			return err
+		}
+	} else if err := asm.Recover(cr, fs); err != nil {
 		return err
 	}
 	reader.ValidatePayload(header)
@@ -212,6 +412,9 @@ func (s *snapshotter) IsNoSnapshotError(e error) bool {
 }
 
 func (s *snapshotter) commit(ss pb.Snapshot, req rsm.SSRequest) error {
+	if req.ExportedToWriter() {
+		return nil
+	}
 	env := s.getCustomEnv(rsm.SSMeta{
 		Index:   ss.Index,
 		Request: req,
@@ -229,6 +432,9 @@ func (s *snapshotter) commit(ss pb.Snapshot, req rsm.SSRequest) error {
 		if err := s.saveSnapshot(ss); err != nil {
 			return err
 		}
+		if err := s.place(ss); err != nil {
+			return err
+		}
 	}
 	return env.RemoveFlagFile()
 }
@@ -252,6 +458,14 @@ func (s *snapshotter) shrink(shrinkTo uint64) error {
 			env := s.getEnv(ss.Index)
 			fp := env.GetFilepath()
 			shrunk := env.GetShrinkedFilepath()
+			exist, err := fileutil.Exist(fp, s.fs)
+			if err != nil {
+				return err
+			}
+			if !exist {
+				// released after being placed in the snapshot storage
+				continue
+			}
 			plog.Debugf("%s shrinking %s, %d", s.id(), s.ssid(ss.Index), idx)
 			if err := rsm.ShrinkSnapshot(fp, shrunk, s.fs); err != nil {
 				return err
@@ -269,20 +483,48 @@ func (s *snapshotter) compact(removeUpTo uint64) error {
 	if err != nil {
 		return err
 	}
-	if len(snapshots) <= snapshotsToKeep {
+	keep := uint64(snapshotsToKeep)
+	if s.retentionCount > keep {
+		keep = s.retentionCount
+	}
+	if uint64(len(snapshots)) <= keep {
 		return nil
 	}
-	selected := snapshots[:len(snapshots)-snapshotsToKeep]
+	selected := snapshots[:uint64(len(snapshots))-keep]
 	plog.Debugf("%s has %d snapshots to compact", s.id(), len(selected))
 	for _, ss := range selected {
+		if s.retentionPeriod > 0 {
+			retained, err := s.withinRetentionPeriod(ss.Index)
+			if err != nil {
+				return err
+			}
+			if retained {
+				continue
+			}
+		}
 		plog.Debugf("%s compacting %s", s.id(), s.ssid(ss.Index))
-		if err := s.remove(ss.Index); err != nil {
+		if err := s.remove(ss); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// withinRetentionPeriod returns a boolean value indicating whether the
+// specified snapshot was created within the retention period. Snapshots with
+// no recorded creation time are considered as expired.
+func (s *snapshotter) withinRetentionPeriod(index uint64) (bool, error) {
+	env := s.getEnv(index)
+	created, err := env.GetCreatedTime()
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return time.Since(created) < s.retentionPeriod, nil
+}
+
 func (s *snapshotter) processOrphans() error {
 	files, err := s.fs.List(s.dir)
 	if err != nil {
@@ -324,7 +566,7 @@ func (s *snapshotter) processOrphans() error {
 				}
 			}
 			if remove {
-				if err := s.remove(ss.Index); err != nil {
+				if err := s.remove(ss); err != nil {
 					return err
 				}
 			} else {
@@ -345,11 +587,14 @@ func (s *snapshotter) processOrphans() error {
 	return nil
 }
 
-func (s *snapshotter) remove(index uint64) error {
-	if err := s.logdb.DeleteSnapshot(s.clusterID, s.nodeID, index); err != nil {
+func (s *snapshotter) remove(ss pb.Snapshot) error {
+	if err := s.logdb.DeleteSnapshot(s.clusterID, s.nodeID, ss.Index); err != nil {
 		return err
 	}
-	env := s.getEnv(index)
+	if err := s.unplace(ss); err != nil {
+		return err
+	}
+	env := s.getEnv(ss.Index)
 	return env.RemoveFinalDir()
 }
 
@@ -401,3 +646,46 @@ func (s *snapshotter) isOrphan(dir string) bool {
 	fdir := s.fs.PathJoin(s.dir, dir)
 	return fileutil.HasFlagFile(fdir, fileutil.SnapshotFlagFilename, s.fs)
 }
+
+type checkpoint rsm.Checkpoint
+
+func (c *checkpoint) Marshal() ([]byte, error) {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, c.Index)
+	binary.BigEndian.PutUint64(data[8:], c.Hash)
+	return data, nil
+}
+
+func (c *checkpoint) Unmarshal(data []byte) error {
+	if len(data) != 16 {
+		return errors.New("invalid checkpoint data")
+	}
+	c.Index = binary.BigEndian.Uint64(data)
+	c.Hash = binary.BigEndian.Uint64(data[8:])
+	return nil
+}
+
+func (s *snapshotter) saveCheckpoint(cp rsm.Checkpoint) error {
+	c := checkpoint(cp)
+	if err := fileutil.CreateFlagFile(s.dir,
+		checkpointTmpFilename, &c, s.fs); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(s.fs.PathJoin(s.dir, checkpointTmpFilename),
+		s.fs.PathJoin(s.dir, checkpointFilename)); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(s.dir, s.fs)
+}
+
+func (s *snapshotter) getCheckpoint() (rsm.Checkpoint, error) {
+	if !fileutil.HasFlagFile(s.dir, checkpointFilename, s.fs) {
+		return rsm.Checkpoint{}, nil
+	}
+	var c checkpoint
+	if err := fileutil.GetFlagFileContent(s.dir,
+		checkpointFilename, &c, s.fs); err != nil {
+		return rsm.Checkpoint{}, err
+	}
+	return rsm.Checkpoint(c), nil
+}
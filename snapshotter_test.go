@@ -15,21 +15,28 @@
 package dragonboat
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/juju/ratelimit"
 	"github.com/lni/goutils/leaktest"
 
 	"github.com/lni/dragonboat/v3/config"
 	"github.com/lni/dragonboat/v3/internal/fileutil"
 	"github.com/lni/dragonboat/v3/internal/logdb"
 	"github.com/lni/dragonboat/v3/internal/rsm"
+	"github.com/lni/dragonboat/v3/internal/settings"
 	"github.com/lni/dragonboat/v3/internal/vfs"
 	"github.com/lni/dragonboat/v3/raftio"
 	pb "github.com/lni/dragonboat/v3/raftpb"
+	sm "github.com/lni/dragonboat/v3/statemachine"
 )
 
 const (
@@ -613,3 +620,425 @@ func TestZombieSnapshotDirNameMatchWorks(t *testing.T) {
 	fs := vfs.GetTestFS()
 	runSnapshotterTest(t, fn, fs)
 }
+
+func TestCheckpointCanBeSavedAndLoaded(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+		cp, err := s.getCheckpoint()
+		if err != nil {
+			t.Fatalf("failed to get checkpoint %v", err)
+		}
+		if cp.Index != 0 {
+			t.Errorf("unexpected checkpoint %+v", cp)
+		}
+		for _, v := range []rsm.Checkpoint{{Index: 100, Hash: 1234},
+			{Index: 200, Hash: 5678}} {
+			if err := s.saveCheckpoint(v); err != nil {
+				t.Fatalf("failed to save checkpoint %v", err)
+			}
+			cp, err := s.getCheckpoint()
+			if err != nil {
+				t.Fatalf("failed to get checkpoint %v", err)
+			}
+			if cp != v {
+				t.Errorf("checkpoint %+v, want %+v", cp, v)
+			}
+		}
+	}
+	runSnapshotterTest(t, fn, fs)
+}
+
+func TestSnapshotRetentionPolicyIsRespected(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	// default policy
+	testSnapshotRetentionPolicy(t, 0, 0, 3, fs)
+	// smaller than the default is ignored
+	testSnapshotRetentionPolicy(t, 1, 0, 3, fs)
+	// keep last N snapshots
+	testSnapshotRetentionPolicy(t, 5, 0, 5, fs)
+	// keep snapshots newer than the retention period
+	testSnapshotRetentionPolicy(t, 0, time.Hour, 10, fs)
+	// expired snapshots are removed
+	testSnapshotRetentionPolicy(t, 4, time.Nanosecond, 4, fs)
+}
+
+func testSnapshotRetentionPolicy(t *testing.T,
+	count uint64, period time.Duration, kept int, fs vfs.IFS) {
+	total := uint64(10)
+	fn := func(t *testing.T, ldb raftio.ILogDB, snapshotter *snapshotter) {
+		snapshotter.setRetentionPolicy(count, period)
+		for i := uint64(1); i <= total; i++ {
+			s := pb.Snapshot{
+				FileSize: 1234,
+				Filepath: fmt.Sprintf("f%d.data", i),
+				Index:    i,
+				Term:     2,
+			}
+			env := snapshotter.getEnv(s.Index)
+			if err := env.CreateTempDir(); err != nil {
+				t.Fatalf("failed to create snapshot dir")
+			}
+			if err := snapshotter.commit(s, rsm.SSRequest{}); err != nil {
+				t.Fatalf("failed to save snapshot record")
+			}
+		}
+		if period == time.Nanosecond {
+			time.Sleep(time.Millisecond)
+		}
+		if err := snapshotter.compact(total); err != nil {
+			t.Fatalf("failed to compact snapshots, %v", err)
+		}
+		snapshots, err := ldb.ListSnapshots(1, 1, math.MaxUint64)
+		if err != nil {
+			t.Fatalf("failed to list snapshot")
+		}
+		if len(snapshots) != kept {
+			t.Fatalf("got %d snapshots, want %d", len(snapshots), kept)
+		}
+		for idx, ss := range snapshots {
+			if ss.Index != total-uint64(kept)+uint64(idx)+1 {
+				t.Errorf("unexpected snapshot %d retained", ss.Index)
+			}
+			env := snapshotter.getEnv(ss.Index)
+			if _, err := fs.Stat(env.GetFinalDir()); err != nil {
+				t.Errorf("snapshot dir of %d missing, %v", ss.Index, err)
+			}
+		}
+		for i := uint64(1); i <= total-uint64(kept); i++ {
+			env := snapshotter.getEnv(i)
+			if _, err := fs.Stat(env.GetFinalDir()); !vfs.IsNotExist(err) {
+				t.Errorf("snapshot dir of %d not removed", i)
+			}
+		}
+	}
+	runSnapshotterTest(t, fn, fs)
+}
+
+type nopWriteCloser struct {
+	written int
+}
+
+func (w *nopWriteCloser) Write(data []byte) (int, error) {
+	w.written += len(data)
+	return len(data), nil
+}
+
+func (w *nopWriteCloser) Close() error { return nil }
+
+func TestThrottledWriterConsumesTokens(t *testing.T) {
+	capacity := int64(1024 * 1024)
+	w := &nopWriteCloser{}
+	tw := &throttledWriter{
+		WriteCloser: w,
+		bucket:      ratelimit.NewBucketWithRate(1, capacity),
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := tw.Write(make([]byte, 1024)); err != nil {
+			t.Fatalf("write failed %v", err)
+		}
+	}
+	if w.written != 10*1024 {
+		t.Errorf("written %d, want %d", w.written, 10*1024)
+	}
+	if v := tw.bucket.Available(); v != capacity-10*1024 {
+		t.Errorf("available %d, want %d", v, capacity-10*1024)
+	}
+}
+
+type testDeltaStreamable struct {
+	available bool
+	since     uint64
+}
+
+func (s *testDeltaStreamable) Stream(ctx interface{}, w io.Writer) error {
+	_, err := w.Write([]byte("full"))
+	return err
+}
+
+func (s *testDeltaStreamable) StreamDelta(ctx interface{},
+	since uint64, w io.Writer) error {
+	if !s.available {
+		return sm.ErrDeltaSnapshotNotAvailable
+	}
+	s.since = since
+	_, err := w.Write([]byte("delta"))
+	return err
+}
+
+type testCollectingSink struct {
+	chunks []pb.Chunk
+}
+
+func (s *testCollectingSink) Receive(chunk pb.Chunk) (bool, bool) {
+	s.chunks = append(s.chunks, chunk)
+	return true, false
+}
+
+func (s *testCollectingSink) Stop() {
+	s.Receive(pb.Chunk{ChunkCount: pb.PoisonChunkCount})
+}
+
+func (s *testCollectingSink) ClusterID() uint64 {
+	return 1
+}
+
+func (s *testCollectingSink) ToNodeID() uint64 {
+	return 2
+}
+
+func TestSnapshotterCanStreamDeltaSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tests := []struct {
+		available  bool
+		since      uint64
+		deltaSince uint64
+	}{
+		{true, 100, 100},
+		{false, 100, 0},
+		{true, 0, 0},
+	}
+	for idx, tt := range tests {
+		fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+			sink := &testCollectingSink{}
+			streamable := &testDeltaStreamable{available: tt.available}
+			meta := rsm.SSMeta{
+				Index:   200,
+				Request: rsm.SSRequest{Type: rsm.Streaming, DeltaSince: tt.since},
+			}
+			if err := s.Stream(streamable, meta, sink); err != nil {
+				t.Fatalf("%d, stream failed %v", idx, err)
+			}
+			if len(sink.chunks) == 0 {
+				t.Fatalf("%d, no chunk sent", idx)
+			}
+			data := sink.chunks[0].Data
+			sz := binary.LittleEndian.Uint64(data)
+			var header pb.SnapshotHeader
+			if err := header.Unmarshal(data[8 : 8+sz]); err != nil {
+				t.Fatalf("%d, failed to unmarshal header %v", idx, err)
+			}
+			if header.DeltaSince != tt.deltaSince {
+				t.Errorf("%d, delta since %d, want %d",
+					idx, header.DeltaSince, tt.deltaSince)
+			}
+			if streamable.since != tt.deltaSince {
+				t.Errorf("%d, delta streamed since %d, want %d",
+					idx, streamable.since, tt.deltaSince)
+			}
+		}
+		runSnapshotterTest(t, fn, fs)
+	}
+}
+
+func TestSnapshotterRecordsCompressionTypeInHeader(t *testing.T) {
+	fs := vfs.GetTestFS()
+	for _, ct := range []config.CompressionType{
+		config.NoCompression, config.Snappy, config.Zstd} {
+		fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+			sink := &testCollectingSink{}
+			meta := rsm.SSMeta{
+				Index:            200,
+				Request:          rsm.SSRequest{Type: rsm.Streaming},
+				CompressionType:  ct,
+				CompressionLevel: 3,
+			}
+			if err := s.Stream(&testDeltaStreamable{}, meta, sink); err != nil {
+				t.Fatalf("stream failed %v", err)
+			}
+			if len(sink.chunks) == 0 {
+				t.Fatalf("no chunk sent")
+			}
+			data := sink.chunks[0].Data
+			sz := binary.LittleEndian.Uint64(data)
+			var header pb.SnapshotHeader
+			if err := header.Unmarshal(data[8 : 8+sz]); err != nil {
+				t.Fatalf("failed to unmarshal header %v", err)
+			}
+			if header.CompressionType != ct {
+				t.Errorf("compression type %s, want %s", header.CompressionType, ct)
+			}
+		}
+		runSnapshotterTest(t, fn, fs)
+	}
+}
+
+func TestSnapshotterRecordsSchemaVersionInStreamedHeader(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+		sink := &testCollectingSink{}
+		meta := rsm.SSMeta{
+			Index:         200,
+			Request:       rsm.SSRequest{Type: rsm.Streaming},
+			SchemaVersion: 5,
+		}
+		if err := s.Stream(&testDeltaStreamable{}, meta, sink); err != nil {
+			t.Fatalf("stream failed %v", err)
+		}
+		if len(sink.chunks) == 0 {
+			t.Fatalf("no chunk sent")
+		}
+		data := sink.chunks[0].Data
+		sz := binary.LittleEndian.Uint64(data)
+		var header pb.SnapshotHeader
+		if err := header.Unmarshal(data[8 : 8+sz]); err != nil {
+			t.Fatalf("failed to unmarshal header %v", err)
+		}
+		if header.SchemaVersion != 5 {
+			t.Errorf("schema version %d, want 5", header.SchemaVersion)
+		}
+	}
+	runSnapshotterTest(t, fn, fs)
+}
+
+type testPassThroughStreamable struct {
+	sink     *testCollectingSink
+	received int
+}
+
+func (s *testPassThroughStreamable) Stream(ctx interface{}, w io.Writer) error {
+	data := make([]byte, settings.SnapshotChunkSize)
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	s.received = len(s.sink.chunks)
+	_, err := w.Write(data)
+	return err
+}
+
+func TestStreamedSnapshotIsNotStagedLocally(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+		sink := &testCollectingSink{}
+		streamable := &testPassThroughStreamable{sink: sink}
+		meta := rsm.SSMeta{
+			Index:   200,
+			Request: rsm.SSRequest{Type: rsm.Streaming},
+		}
+		if err := s.Stream(streamable, meta, sink); err != nil {
+			t.Fatalf("stream failed %v", err)
+		}
+		if streamable.received == 0 {
+			t.Errorf("chunks not passed to the sink while streaming")
+		}
+		if streamable.received >= len(sink.chunks) {
+			t.Errorf("all chunks received before streaming completed")
+		}
+		files, err := fs.List(s.dir)
+		if err != nil && !vfs.IsNotExist(err) {
+			t.Fatalf("failed to list %s, %v", s.dir, err)
+		}
+		if len(files) != 0 {
+			t.Errorf("streamed snapshot staged locally, %v", files)
+		}
+	}
+	runSnapshotterTest(t, fn, fs)
+}
+
+type testSnapshotStorage struct {
+	objects map[string][]byte
+}
+
+func (s *testSnapshotStorage) Name() string {
+	return "test-storage"
+}
+
+func (s *testSnapshotStorage) Put(ctx context.Context,
+	key string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.objects[key] = data
+	return nil
+}
+
+func (s *testSnapshotStorage) Get(ctx context.Context,
+	key string, w io.Writer) error {
+	data, ok := s.objects[key]
+	if !ok {
+		return fmt.Errorf("object %s not found", key)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (s *testSnapshotStorage) Delete(ctx context.Context, key string) error {
+	delete(s.objects, key)
+	return nil
+}
+
+func TestSnapshotsArePlacedInSnapshotStorage(t *testing.T) {
+	fs := vfs.GetTestFS()
+	fn := func(t *testing.T, ldb raftio.ILogDB, snapshotter *snapshotter) {
+		storage := &testSnapshotStorage{objects: make(map[string][]byte)}
+		snapshotter.setSnapshotStorage(storage)
+		var snapshots []pb.Snapshot
+		for i := uint64(1); i <= 3; i++ {
+			index := i * 10
+			env := snapshotter.getEnv(index)
+			if err := env.CreateTempDir(); err != nil {
+				t.Fatalf("failed to create snapshot dir %v", err)
+			}
+			f, err := fs.Create(env.GetTempFilepath())
+			if err != nil {
+				t.Fatalf("failed to create snapshot file %v", err)
+			}
+			if _, err := f.Write([]byte(fmt.Sprintf("snapshot-%d", index))); err != nil {
+				t.Fatalf("failed to write %v", err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("failed to close %v", err)
+			}
+			ss := pb.Snapshot{
+				Index:    index,
+				Term:     2,
+				Filepath: env.GetFilepath(),
+			}
+			if err := snapshotter.commit(ss, rsm.SSRequest{}); err != nil {
+				t.Fatalf("failed to commit snapshot %v", err)
+			}
+			snapshots = append(snapshots, ss)
+		}
+		if len(storage.objects) != 3 {
+			t.Fatalf("%d objects placed, want 3", len(storage.objects))
+		}
+		for idx, ss := range snapshots {
+			exist, err := fileutil.Exist(snapshotter.getFilePath(ss.Index), fs)
+			if err != nil {
+				t.Fatalf("failed to check file %v", err)
+			}
+			if released := idx < len(snapshots)-1; exist == released {
+				t.Errorf("snapshot %d, exist %t, released %t", ss.Index, exist, released)
+			}
+		}
+		if err := snapshotter.fetch(snapshots[0]); err != nil {
+			t.Fatalf("failed to fetch snapshot %v", err)
+		}
+		f, err := fs.Open(snapshotter.getFilePath(10))
+		if err != nil {
+			t.Fatalf("failed to open fetched snapshot %v", err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		if string(data) != "snapshot-10" {
+			t.Errorf("unexpected content %s", data)
+		}
+		if err := snapshotter.remove(snapshots[0]); err != nil {
+			t.Fatalf("failed to remove snapshot %v", err)
+		}
+		if len(storage.objects) != 2 {
+			t.Errorf("%d objects, want 2", len(storage.objects))
+		}
+		if err := snapshotter.shrink(20); err != nil {
+			t.Errorf("failed to shrink released snapshots %v", err)
+		}
+	}
+	runSnapshotterTest(t, fn, fs)
+}
@@ -15,13 +15,22 @@
 package statemachine
 
 import (
+	"context"
 	"errors"
+	"io"
 )
 
 var (
 	// ErrNotImplemented indicates that the requested optional feature is not
 	// implemented by the state machine.
 	ErrNotImplemented = errors.New("requested feature not implemented")
+	// ErrDeltaSnapshotNotAvailable indicates that the state machine can not
+	// produce a delta snapshot for the requested index, a full snapshot is
+	// streamed instead.
+	ErrDeltaSnapshotNotAvailable = errors.New("delta snapshot not available")
+	// ErrIncompatibleSchemaVersion indicates that the state machine can not be
+	// recovered from a snapshot saved with an incompatible schema version.
+	ErrIncompatibleSchemaVersion = errors.New("incompatible schema version")
 )
 
 // IHash is an optional interface to be implemented by a user state machine type
@@ -49,3 +58,230 @@ type IExtended interface {
 	// state.
 	NALookup([]byte) ([]byte, error)
 }
+
+// IEntryUpdater is an optional interface to be implemented by an IStateMachine
+// type when the Term and Timestamp of applied entries are required.
+type IEntryUpdater interface {
+	// UpdateEntry is used in place of the Update method of IStateMachine, the
+	// Index, Term, Timestamp and Cmd fields of the specified entry are set.
+	// The same determinism requirements of Update apply.
+	UpdateEntry(e Entry) (Result, error)
+}
+
+// IContextLookup is an optional interface to be implemented by a user state
+// machine type when its queries can take long to complete and can be
+// cancelled.
+type IContextLookup interface {
+	// LookupWithContext is similar to the Lookup method of the user state
+	// machine, it is used in place of Lookup for reads made with a context, e.g.
+	// NodeHost.SyncRead. The query is expected to be abandoned with the error
+	// returned by ctx.Err() once the specified context is done.
+	//
+	// LookupWithContext is a read-only method, it should never change state
+	// machine's state.
+	LookupWithContext(ctx context.Context, query interface{}) (interface{}, error)
+}
+
+// IUpdateContext is an optional interface to be implemented by a user state
+// machine type when it wants to trace or bound the work done for individual
+// proposals using the context they were proposed with.
+type IUpdateContext interface {
+	// BeforeUpdate is invoked for each entry right before the entry is passed
+	// to the Update or BatchedUpdate method of the user state machine. The ctx
+	// is the context used for proposing the entry, e.g. the one passed to
+	// NodeHost.SyncPropose, when the entry was proposed on the local NodeHost
+	// and the proposal is still pending. context.Background() is used for
+	// entries proposed elsewhere, proposed without a context or being replayed
+	// during restarts.
+	//
+	// The ctx is only valid until Update or BatchedUpdate returns, entries must
+	// always be applied regardless of whether ctx is done as all replicas are
+	// required to reach the same state.
+	BeforeUpdate(ctx context.Context, e Entry)
+}
+
+// IBatchedLookup is an optional interface to be implemented by a user state
+// machine type when multiple queries can be handled more efficiently together,
+// e.g. by using a single iterator or a single read transaction of the
+// underlying storage.
+type IBatchedLookup interface {
+	// BatchedLookup is similar to the Lookup method of the user state machine,
+	// it is used in place of Lookup for reads made using NodeHost.SyncReadBatch.
+	// It returns the query results in the same order as the specified queries,
+	// the number of returned results must equal to the number of queries.
+	//
+	// BatchedLookup is a read-only method, it should never change state
+	// machine's state.
+	BatchedLookup(queries []interface{}) ([]interface{}, error)
+}
+
+// IIdempotencyTokens is a small Key-Value area managed by dragonboat on behalf
+// of the state machine. It is used for recording idempotency tokens of
+// external side effects, e.g. IDs of emails already sent or payments already
+// made, so such side effects can be performed exactly once.
+//
+// Recorded tokens are saved into snapshots together with client sessions and
+// restored when recovering from snapshots. Each token is associated with the
+// index of the Raft Log entry being applied when the token is set, tokens are
+// thus updated in the same deterministic manner on all replicas as long as
+// Set, Delete and RemoveBefore are only invoked from the Update method of the
+// state machine. Get can also be invoked from the Lookup method.
+//
+// Tokens recorded by IOnDiskStateMachine instances are not included in
+// snapshots streamed to other nodes, same as client sessions.
+type IIdempotencyTokens interface {
+	// Set records the token identified by key with the specified value. The
+	// token is associated with the index of the Raft Log entry being applied,
+	// the index of the last entry in the batch is used when entries are
+	// applied in batches.
+	Set(key string, value []byte)
+	// Get returns the value of the specified token and a boolean flag
+	// indicating whether the token has been recorded.
+	Get(key string) ([]byte, bool)
+	// Delete removes the specified token.
+	Delete(key string)
+	// RemoveBefore removes all tokens associated with Raft Log indexes lower
+	// than the specified index. It returns the number of removed tokens.
+	RemoveBefore(index uint64) int
+	// Len returns the number of recorded tokens.
+	Len() int
+}
+
+// IIdempotencyTokenUser is an optional interface to be implemented by a user
+// state machine type when it requires the idempotency tokens area managed by
+// dragonboat.
+type IIdempotencyTokenUser interface {
+	// SetIdempotencyTokens is invoked once when the state machine is created,
+	// it is invoked before any other method of the state machine.
+	SetIdempotencyTokens(tokens IIdempotencyTokens)
+}
+
+// WarmUpInfo contains details of the snapshot the state machine has just been
+// recovered from.
+type WarmUpInfo struct {
+	// Index is the Raft Log index of the snapshot.
+	Index uint64
+	// Term is the Raft term of the snapshot.
+	Term uint64
+	// Filepath is the full path of the snapshot file.
+	Filepath string
+	// FileSize is the size of the snapshot file in bytes.
+	FileSize uint64
+	// Files is the list of external files included in the snapshot.
+	Files []SnapshotFile
+}
+
+// IWarmUp is an optional interface to be implemented by a user state machine
+// type when it wants to prefetch or pin hot structures after being recovered
+// from a snapshot.
+type IWarmUp interface {
+	// WarmUp is invoked after the state machine has been recovered from a
+	// snapshot and before the replica starts serving reads. The done channel is
+	// closed when the warm-up budget specified by the SnapshotWarmUpBudget field
+	// of config.Config is exhausted or when the replica is being stopped, WarmUp
+	// is expected to return promptly once done is closed. Errors returned by
+	// WarmUp are logged and otherwise ignored.
+	WarmUp(info WarmUpInfo, done <-chan struct{}) error
+}
+
+// SnapshotCompletedInfo contains details of a completed Raft snapshot.
+type SnapshotCompletedInfo struct {
+	// Index is the Raft Log index of the snapshot, the state machine state up to
+	// Index is durable and is never required to be rebuilt by re-applying Raft
+	// Log entries.
+	Index uint64
+	// Term is the Raft term of the snapshot.
+	Term uint64
+	// OnDiskIndex is the index of the last entry persisted by the
+	// IOnDiskStateMachine when the snapshot was taken. It is 0 for other state
+	// machine types.
+	OnDiskIndex uint64
+	// CompactLogTo is the index up to which Raft Log entries are going to be
+	// removed from the LogDB, it is 0 when no entry is going to be removed.
+	CompactLogTo uint64
+}
+
+// ICompactionCoordinator is an optional interface to be implemented by a user
+// state machine type, usually an IOnDiskStateMachine, when it wants to
+// coordinate the compaction of its own storage with Raft snapshots and Raft
+// Log compactions, e.g. to avoid compacting its storage at the same time as the
+// LogDB is being compacted.
+type ICompactionCoordinator interface {
+	// SnapshotCompleted is invoked after a Raft snapshot has been saved and
+	// recorded, right before obsolete Raft Log entries are removed. It is
+	// invoked from a snapshot worker, concurrent calls to the Update and Lookup
+	// methods are possible, it is expected to return quickly, e.g. by scheduling
+	// the actual compaction to be performed in the background.
+	SnapshotCompleted(info SnapshotCompletedInfo)
+}
+
+// IBorrowedCommands is an optional interface to be implemented by user state
+// machines that never retain the Cmd slices of entries passed to their Update
+// or BatchedUpdate methods after those methods return. Such state machines can
+// opt into the borrowed command contract by returning true from
+// BorrowsCommands, the Cmd slices are then only valid until Update or
+// BatchedUpdate returns and they may refer to buffers reused for later entries.
+// In exchange, compressed proposal payloads are decompressed into reused
+// buffers instead of newly allocated ones, reducing allocations and GC pressure
+// for workloads with large values. State machines must copy any Cmd slice they
+// need to retain, e.g. in an in-memory map.
+type IBorrowedCommands interface {
+	// BorrowsCommands returns a boolean value indicating whether the state
+	// machine accepts borrowed Cmd slices.
+	BorrowsCommands() bool
+}
+
+// IDeltaSnapshot is an optional interface to be implemented by an
+// IOnDiskStateMachine type when it can produce delta snapshots. When a remote
+// node is lagging behind, it advertises the index of its last applied entry,
+// the leader then streams a delta snapshot containing only data changed after
+// that index rather than the full state machine state.
+//
+// A delta snapshot is state based, it contains the latest state of all data
+// changed, including removed data, after the since index. It can thus be
+// applied on top of any state machine state that has all entries up to the
+// since index applied.
+type IDeltaSnapshot interface {
+	// SaveDeltaSnapshot writes the delta of the state machine state identified
+	// by the ctx value returned by PrepareSnapshot to the specified io.Writer.
+	// The delta must include all changes made by entries with index greater
+	// than since. ErrDeltaSnapshotNotAvailable should be returned, before
+	// anything is written to the io.Writer, when such changes are no longer
+	// tracked by the state machine, a full snapshot is streamed in that case.
+	SaveDeltaSnapshot(ctx interface{},
+		since uint64, w io.Writer, done <-chan struct{}) error
+	// RecoverFromDeltaSnapshot applies the delta snapshot read from the
+	// specified io.Reader on top of the current state of the state machine.
+	// Entries up to the since index are guaranteed to have been applied.
+	RecoverFromDeltaSnapshot(r io.Reader, since uint64, done <-chan struct{}) error
+}
+
+// ISchemaVersion is an optional interface to be implemented by user state
+// machines that version the format of their snapshots, it makes rolling
+// upgrades of such formats safe.
+//
+// The schema version returned by SchemaVersion is recorded in each snapshot
+// saved or streamed by the state machine. Before the state machine is
+// recovered from a snapshot, the recorded version is checked. A snapshot with
+// a version newer than the current version of the state machine is refused
+// with the ErrIncompatibleSchemaVersion error, e.g. when a replica running the
+// previous release of the state machine joins the Raft cluster or falls behind
+// and receives a snapshot from an upgraded leader. Otherwise, PrepareRecovery
+// is invoked with the recorded version, allowing the state machine to select
+// the matching decoder or to migrate its state in the following
+// RecoverFromSnapshot call. Refused recoveries fail the replica in the same way
+// as other recovery failures, see the PanicPolicy field of config.Config for
+// confining such failures to the replica.
+//
+// Version 0 means unversioned, it is recorded in snapshots saved by state
+// machines not implementing ISchemaVersion and state machines reporting
+// version 0 are never refused.
+type ISchemaVersion interface {
+	// SchemaVersion returns the current schema version of the state machine.
+	SchemaVersion() uint64
+	// PrepareRecovery is invoked before RecoverFromSnapshot or
+	// RecoverFromDeltaSnapshot with the schema version recorded in the snapshot.
+	// Returning an error, e.g. ErrIncompatibleSchemaVersion, refuses the
+	// snapshot.
+	PrepareRecovery(version uint64) error
+}
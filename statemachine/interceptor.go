@@ -0,0 +1,226 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statemachine
+
+import (
+	"context"
+	"io"
+)
+
+// UpdateHandler is the func type used for updating a state machine.
+type UpdateHandler func(data []byte) (Result, error)
+
+// LookupHandler is the func type used for querying a state machine. The
+// context is context.Background() for queries not made with a context.
+type LookupHandler func(ctx context.Context,
+	query interface{}) (interface{}, error)
+
+// SaveSnapshotHandler is the func type used for saving snapshots.
+type SaveSnapshotHandler func(w io.Writer,
+	fc ISnapshotFileCollection, done <-chan struct{}) error
+
+// RecoverFromSnapshotHandler is the func type used for recovering from
+// snapshots.
+type RecoverFromSnapshotHandler func(r io.Reader,
+	files []SnapshotFile, done <-chan struct{}) error
+
+// Interceptor intercepts requests made to an IStateMachine instance. Each
+// non-nil field wraps the corresponding method, it is expected to invoke the
+// provided next handler to pass the request on to the next interceptor in the
+// chain and eventually to the state machine. Interceptors can be used for
+// collecting metrics, validating or auditing requests, or transforming data,
+// e.g. encrypting snapshots.
+//
+// Interceptors of Update are invoked as a part of the Update method of the
+// state machine, they are required to be deterministic in the same way.
+type Interceptor struct {
+	Update func(data []byte, next UpdateHandler) (Result, error)
+	Lookup func(ctx context.Context,
+		query interface{}, next LookupHandler) (interface{}, error)
+	SaveSnapshot func(w io.Writer, fc ISnapshotFileCollection,
+		done <-chan struct{}, next SaveSnapshotHandler) error
+	RecoverFromSnapshot func(r io.Reader, files []SnapshotFile,
+		done <-chan struct{}, next RecoverFromSnapshotHandler) error
+}
+
+// WithInterceptors returns a CreateStateMachineFunc that creates state
+// machines using the specified create function, all requests made to the
+// created state machines are passed through the specified interceptors. The
+// first interceptor is the outermost one.
+//
+// The created state machines keep implementing the IHash, IEntryUpdater,
+// IContextLookup, IWarmUp, ISchemaVersion and IIdempotencyTokenUser interfaces
+// when they are implemented by the state machines returned by create. IExtended
+// is not implemented, as all queries are required to go through the Lookup
+// interceptors.
+func WithInterceptors(create CreateStateMachineFunc,
+	interceptors ...Interceptor) CreateStateMachineFunc {
+	return func(clusterID uint64, nodeID uint64) IStateMachine {
+		s := create(clusterID, nodeID)
+		w := newIntercepted(s, interceptors)
+		if _, ok := s.(IContextLookup); ok {
+			return &interceptedContextLookup{w}
+		}
+		return w
+	}
+}
+
+type intercepted struct {
+	sm      IStateMachine
+	entry   Entry
+	update  UpdateHandler
+	lookup  LookupHandler
+	save    SaveSnapshotHandler
+	recover RecoverFromSnapshotHandler
+}
+
+var _ IStateMachine = (*intercepted)(nil)
+var _ IEntryUpdater = (*intercepted)(nil)
+var _ IContextLookup = (*interceptedContextLookup)(nil)
+
+func newIntercepted(s IStateMachine, interceptors []Interceptor) *intercepted {
+	w := &intercepted{
+		sm:      s,
+		update:  s.Update,
+		save:    s.SaveSnapshot,
+		recover: s.RecoverFromSnapshot,
+	}
+	if eu, ok := s.(IEntryUpdater); ok {
+		w.update = func(data []byte) (Result, error) {
+			e := w.entry
+			e.Cmd = data
+			return eu.UpdateEntry(e)
+		}
+	}
+	if cl, ok := s.(IContextLookup); ok {
+		w.lookup = cl.LookupWithContext
+	} else {
+		w.lookup = func(ctx context.Context,
+			query interface{}) (interface{}, error) {
+			return s.Lookup(query)
+		}
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		w.wrap(interceptors[i])
+	}
+	return w
+}
+
+func (w *intercepted) wrap(ic Interceptor) {
+	if f := ic.Update; f != nil {
+		next := w.update
+		w.update = func(data []byte) (Result, error) {
+			return f(data, next)
+		}
+	}
+	if f := ic.Lookup; f != nil {
+		next := w.lookup
+		w.lookup = func(ctx context.Context,
+			query interface{}) (interface{}, error) {
+			return f(ctx, query, next)
+		}
+	}
+	if f := ic.SaveSnapshot; f != nil {
+		next := w.save
+		w.save = func(wr io.Writer,
+			fc ISnapshotFileCollection, done <-chan struct{}) error {
+			return f(wr, fc, done, next)
+		}
+	}
+	if f := ic.RecoverFromSnapshot; f != nil {
+		next := w.recover
+		w.recover = func(r io.Reader,
+			files []SnapshotFile, done <-chan struct{}) error {
+			return f(r, files, done, next)
+		}
+	}
+}
+
+func (w *intercepted) Update(data []byte) (Result, error) {
+	return w.update(data)
+}
+
+// UpdateEntry makes the details of the entry available to the intercepted
+// state machine when it implements the IEntryUpdater interface.
+func (w *intercepted) UpdateEntry(e Entry) (Result, error) {
+	w.entry = e
+	defer func() {
+		w.entry = Entry{}
+	}()
+	return w.update(e.Cmd)
+}
+
+func (w *intercepted) Lookup(query interface{}) (interface{}, error) {
+	return w.lookup(context.Background(), query)
+}
+
+func (w *intercepted) SaveSnapshot(wr io.Writer,
+	fc ISnapshotFileCollection, done <-chan struct{}) error {
+	return w.save(wr, fc, done)
+}
+
+func (w *intercepted) RecoverFromSnapshot(r io.Reader,
+	files []SnapshotFile, done <-chan struct{}) error {
+	return w.recover(r, files, done)
+}
+
+func (w *intercepted) Close() error {
+	return w.sm.Close()
+}
+
+func (w *intercepted) GetHash() (uint64, error) {
+	if h, ok := w.sm.(IHash); ok {
+		return h.GetHash()
+	}
+	return 0, ErrNotImplemented
+}
+
+func (w *intercepted) WarmUp(info WarmUpInfo, done <-chan struct{}) error {
+	if u, ok := w.sm.(IWarmUp); ok {
+		return u.WarmUp(info, done)
+	}
+	return nil
+}
+
+func (w *intercepted) SchemaVersion() uint64 {
+	if v, ok := w.sm.(ISchemaVersion); ok {
+		return v.SchemaVersion()
+	}
+	return 0
+}
+
+func (w *intercepted) PrepareRecovery(version uint64) error {
+	if v, ok := w.sm.(ISchemaVersion); ok {
+		return v.PrepareRecovery(version)
+	}
+	return nil
+}
+
+func (w *intercepted) SetIdempotencyTokens(tokens IIdempotencyTokens) {
+	if u, ok := w.sm.(IIdempotencyTokenUser); ok {
+		u.SetIdempotencyTokens(tokens)
+	}
+}
+
+// interceptedContextLookup is used when the intercepted state machine
+// implements the IContextLookup interface.
+type interceptedContextLookup struct {
+	*intercepted
+}
+
+func (w *interceptedContextLookup) LookupWithContext(ctx context.Context,
+	query interface{}) (interface{}, error) {
+	return w.lookup(ctx, query)
+}
@@ -0,0 +1,189 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statemachine
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type testCounterSM struct {
+	count uint64
+}
+
+func (s *testCounterSM) Update(data []byte) (Result, error) {
+	s.count++
+	return Result{Value: s.count}, nil
+}
+
+func (s *testCounterSM) Lookup(query interface{}) (interface{}, error) {
+	return s.count, nil
+}
+
+func (s *testCounterSM) SaveSnapshot(w io.Writer,
+	fc ISnapshotFileCollection, done <-chan struct{}) error {
+	_, err := w.Write([]byte{byte(s.count)})
+	return err
+}
+
+func (s *testCounterSM) RecoverFromSnapshot(r io.Reader,
+	files []SnapshotFile, done <-chan struct{}) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.count = uint64(data[0])
+	return nil
+}
+
+func (s *testCounterSM) Close() error { return nil }
+
+func (s *testCounterSM) GetHash() (uint64, error) { return s.count, nil }
+
+type testContextCounterSM struct {
+	testCounterSM
+}
+
+func (s *testContextCounterSM) LookupWithContext(ctx context.Context,
+	query interface{}) (interface{}, error) {
+	return ctx.Err(), nil
+}
+
+func xor(data []byte) []byte {
+	result := make([]byte, len(data))
+	for i, v := range data {
+		result[i] = v ^ 0xFF
+	}
+	return result
+}
+
+func TestInterceptorsAreInvokedInOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) Interceptor {
+		return Interceptor{
+			Update: func(data []byte, next UpdateHandler) (Result, error) {
+				calls = append(calls, name)
+				return next(data)
+			},
+			Lookup: func(ctx context.Context,
+				query interface{}, next LookupHandler) (interface{}, error) {
+				calls = append(calls, name)
+				return next(ctx, query)
+			},
+		}
+	}
+	create := WithInterceptors(func(uint64, uint64) IStateMachine {
+		return &testCounterSM{}
+	}, record("first"), Interceptor{}, record("second"))
+	s := create(1, 1)
+	result, err := s.Update(nil)
+	if err != nil || result.Value != 1 {
+		t.Fatalf("unexpected result %v, %v", result, err)
+	}
+	v, err := s.Lookup(nil)
+	if err != nil || v.(uint64) != 1 {
+		t.Fatalf("unexpected lookup result %v, %v", v, err)
+	}
+	expected := []string{"first", "second", "first", "second"}
+	if len(calls) != len(expected) {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+	for i := range expected {
+		if calls[i] != expected[i] {
+			t.Errorf("unexpected calls %v", calls)
+		}
+	}
+	if h, err := s.(IHash).GetHash(); err != nil || h != 1 {
+		t.Errorf("hash not passed through, %d, %v", h, err)
+	}
+	if _, ok := s.(IContextLookup); ok {
+		t.Errorf("unexpectedly implements IContextLookup")
+	}
+}
+
+func TestInterceptorsCanTransformSnapshots(t *testing.T) {
+	encryption := Interceptor{
+		SaveSnapshot: func(w io.Writer, fc ISnapshotFileCollection,
+			done <-chan struct{}, next SaveSnapshotHandler) error {
+			buf := bytes.NewBuffer(nil)
+			if err := next(buf, fc, done); err != nil {
+				return err
+			}
+			_, err := w.Write(xor(buf.Bytes()))
+			return err
+		},
+		RecoverFromSnapshot: func(r io.Reader, files []SnapshotFile,
+			done <-chan struct{}, next RecoverFromSnapshotHandler) error {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			return next(bytes.NewReader(xor(data)), files, done)
+		},
+	}
+	create := WithInterceptors(func(uint64, uint64) IStateMachine {
+		return &testCounterSM{}
+	}, encryption)
+	s1 := create(1, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := s1.Update(nil); err != nil {
+			t.Fatalf("update failed %v", err)
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := s1.SaveSnapshot(buf, nil, nil); err != nil {
+		t.Fatalf("save snapshot failed %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{3 ^ 0xFF}) {
+		t.Errorf("snapshot not transformed")
+	}
+	s2 := create(1, 2)
+	if err := s2.RecoverFromSnapshot(buf, nil, nil); err != nil {
+		t.Fatalf("recover failed %v", err)
+	}
+	if v, err := s2.Lookup(nil); err != nil || v.(uint64) != 3 {
+		t.Errorf("unexpected lookup result %v, %v", v, err)
+	}
+}
+
+func TestContextLookupIsIntercepted(t *testing.T) {
+	intercepted := false
+	create := WithInterceptors(func(uint64, uint64) IStateMachine {
+		return &testContextCounterSM{}
+	}, Interceptor{
+		Lookup: func(ctx context.Context,
+			query interface{}, next LookupHandler) (interface{}, error) {
+			intercepted = true
+			return next(ctx, query)
+		},
+	})
+	s := create(1, 1)
+	cl, ok := s.(IContextLookup)
+	if !ok {
+		t.Fatalf("IContextLookup not implemented")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	v, err := cl.LookupWithContext(ctx, nil)
+	if err != nil || v != context.Canceled {
+		t.Errorf("context not passed, %v, %v", v, err)
+	}
+	if !intercepted {
+		t.Errorf("lookup not intercepted")
+	}
+}
@@ -69,6 +69,7 @@ package statemachine
 
 import (
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -146,6 +147,32 @@ type Result struct {
 	// NodeHost to query the state of their IStateMachine and IOnDiskStateMachine
 	// types, proposal based queries are known to work but are not recommended.
 	Data []byte
+	// Error is an optional error indicating that the entry has been applied but
+	// rejected by the business logic of the state machine, e.g. a transfer
+	// rejected because of insufficient balance. Unlike errors returned by the
+	// Update method, which are considered as fatal, Error is returned to the
+	// proposer via the Error field of the Result returned by SyncPropose and
+	// the ApplicationError method of RequestResult. Error is recorded in client
+	// sessions and included in snapshots, it must be deterministic. nil means
+	// no such error.
+	Error *ApplicationError `json:",omitempty"`
+}
+
+// ApplicationError is the error set in Result when an entry has been applied
+// but rejected by the business logic of the state machine.
+type ApplicationError struct {
+	// Code is an application defined code identifying the error.
+	Code uint64
+	// Message is an optional human readable description of the error.
+	Message string `json:",omitempty"`
+}
+
+// Error returns the description of the application error.
+func (e *ApplicationError) Error() string {
+	if len(e.Message) == 0 {
+		return fmt.Sprintf("application error %d", e.Code)
+	}
+	return fmt.Sprintf("application error %d: %s", e.Code, e.Message)
 }
 
 // Entry represents a Raft log entry that is going to be provided to the Update
@@ -154,6 +181,16 @@ type Entry struct {
 	// Index is the Raft log index of the entry. The field is set by the
 	// Dragonboat library and it is strictly read-only.
 	Index uint64
+	// Term is the Raft term of the entry. The field is set by the Dragonboat
+	// library and it is strictly read-only.
+	Term uint64
+	// Timestamp is the wall clock time of the leader in nanoseconds since the
+	// Unix epoch when the entry was appended to its log. It is 0 unless the
+	// EntryTimestamp field of config.Config is enabled on the leader. As it is
+	// recorded in the Raft log, all replicas see the same Timestamp value, it can
+	// thus be used for implementing features such as TTLs in a deterministic
+	// manner. This field is strictly read-only.
+	Timestamp uint64
 	// Cmd is the proposed command. This field is strictly read-only.
 	Cmd []byte
 	// Result is the result value obtained from the Update method of an
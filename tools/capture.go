@@ -0,0 +1,65 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"github.com/lni/dragonboat/v3/internal/rsm"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	sm "github.com/lni/dragonboat/v3/statemachine"
+)
+
+var (
+	// ErrNonDeterministic indicates that replaying captured commands against a
+	// fresh state machine instance produced different results or a different
+	// final state.
+	ErrNonDeterministic = rsm.ErrNonDeterministic
+	// ErrCaptureNotReplayable indicates that the command capture can not be
+	// replayed against a fresh state machine instance.
+	ErrCaptureNotReplayable = rsm.ErrCaptureNotReplayable
+)
+
+// ReplayCommandCapture replays commands recorded in the specified command
+// capture file against a fresh IStateMachine instance returned by the create
+// function. The capture file is generated by a Raft node started with the
+// CommandCaptureFile field of config.Config set. An error wrapping
+// ErrNonDeterministic is returned when any replayed command returns a
+// different result or when the final state machine hash is different.
+func ReplayCommandCapture(fp string, create sm.CreateStateMachineFunc) error {
+	return rsm.ReplayCommandCapture(fp, vfs.DefaultFS,
+		func(clusterID uint64, nodeID uint64) rsm.IStateMachine {
+			return rsm.NewInMemStateMachine(create(clusterID, nodeID))
+		})
+}
+
+// ReplayConcurrentCommandCapture is similar to ReplayCommandCapture but it
+// replays commands against an IConcurrentStateMachine instance.
+func ReplayConcurrentCommandCapture(fp string,
+	create sm.CreateConcurrentStateMachineFunc) error {
+	return rsm.ReplayCommandCapture(fp, vfs.DefaultFS,
+		func(clusterID uint64, nodeID uint64) rsm.IStateMachine {
+			return rsm.NewConcurrentStateMachine(create(clusterID, nodeID))
+		})
+}
+
+// ReplayOnDiskCommandCapture is similar to ReplayCommandCapture but it replays
+// commands against an IOnDiskStateMachine instance. The create function is
+// expected to return an IOnDiskStateMachine instance with empty state.
+func ReplayOnDiskCommandCapture(fp string,
+	create sm.CreateOnDiskStateMachineFunc) error {
+	return rsm.ReplayCommandCapture(fp, vfs.DefaultFS,
+		func(clusterID uint64, nodeID uint64) rsm.IStateMachine {
+			return rsm.NewOnDiskStateMachine(create(clusterID, nodeID))
+		})
+}
@@ -0,0 +1,40 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/lni/dragonboat/v3/internal/transport"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+)
+
+// GetSnapshotFileURL returns the URL of the specified snapshot file served by
+// the http.Handler returned by NodeHost.SnapshotFileHandler mounted at
+// baseURL. The file parameter is the path of the snapshot file relative to the
+// snapshot directory of the specified node.
+func GetSnapshotFileURL(baseURL string,
+	clusterID uint64, nodeID uint64, file string) string {
+	return transport.GetSnapshotFileURL(baseURL, clusterID, nodeID, file)
+}
+
+// DownloadSnapshotFile downloads the snapshot file at the specified URL to the
+// target path using HTTP range requests. Interrupted downloads are resumed
+// when DownloadSnapshotFile is called again with the same target path.
+func DownloadSnapshotFile(ctx context.Context,
+	client *http.Client, url string, target string) error {
+	return transport.DownloadSnapshotFile(ctx, client, url, target, vfs.DefaultFS)
+}
@@ -22,9 +22,6 @@ tools for managing Dragonboat based applications.
 import (
 	"bytes"
 	"errors"
-	"io"
-	"os"
-	"runtime"
 	"strings"
 
 	"github.com/lni/dragonboat/v3/config"
@@ -412,12 +409,12 @@ func copySnapshot(ss pb.Snapshot,
 		return err
 	}
 	dstfp := fs.PathJoin(dstDir, fs.PathBase(fp))
-	if err := copyFile(fp, dstfp, fs); err != nil {
+	if err := fileutil.CopyFile(fp, dstfp, fs); err != nil {
 		return err
 	}
 	for _, file := range ss.Files {
 		fname := fs.PathBase(file.Filepath)
-		if err := copyFile(fs.PathJoin(srcDir, fname),
+		if err := fileutil.CopyFile(fs.PathJoin(srcDir, fname),
 			fs.PathJoin(dstDir, fname), fs); err != nil {
 			return err
 		}
@@ -425,46 +422,6 @@ func copySnapshot(ss pb.Snapshot,
 	return nil
 }
 
-func copyFile(src string, dst string, fs vfs.IFS) (err error) {
-	in, err := fs.Open(src)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if cerr := in.Close(); err == nil {
-			err = cerr
-		}
-	}()
-	fi, err := in.Stat()
-	if err != nil {
-		return err
-	}
-	out, err := fs.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if cerr := out.Close(); err == nil {
-			err = cerr
-		}
-	}()
-	if runtime.GOOS != "windows" {
-		of, ok := out.(*os.File)
-		if ok {
-			if err := of.Chmod(fi.Mode()); err != nil {
-				return err
-			}
-		}
-	}
-	if _, err = io.Copy(out, in); err != nil {
-		return err
-	}
-	if err := out.Sync(); err != nil {
-		return err
-	}
-	return fileutil.SyncDir(fs.PathDir(dst), fs)
-}
-
 func getLogDB(env server.Env,
 	nhConfig config.NodeHostConfig, fs vfs.IFS) (raftio.ILogDB, error) {
 	nhDir, walDir := env.GetLogDBDirs(nhConfig.DeploymentID)
@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
 	"github.com/lni/dragonboat/v3/internal/server"
 	"github.com/lni/dragonboat/v3/internal/vfs"
 	pb "github.com/lni/dragonboat/v3/raftpb"
@@ -247,7 +248,7 @@ func TestCopySnapshotFile(t *testing.T) {
 	if err := f.Close(); err != nil {
 		t.Fatalf("failed to close file %v", err)
 	}
-	if err := copyFile(src, dst, fs); err != nil {
+	if err := fileutil.CopyFile(src, dst, fs); err != nil {
 		t.Fatalf("failed to copy file %v", err)
 	}
 	buf := &bytes.Buffer{}
@@ -0,0 +1,349 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+var (
+	// ErrLogRangeNotAvailable indicates that the requested Raft Log range is
+	// not fully available in the LogDB.
+	ErrLogRangeNotAvailable = errors.New("log range not available")
+	// ErrInvalidLogExport indicates that the data to be imported is not a
+	// valid Raft Log export.
+	ErrInvalidLogExport = errors.New("invalid log export")
+	// ErrTargetNodeNotEmpty indicates that the target node of a Raft Log
+	// import already has Raft Log entries in the LogDB.
+	ErrTargetNodeNotEmpty = errors.New("target node is not empty")
+	// ErrLogNotContinuous indicates that the imported Raft Log range doesn't
+	// continue from the most recent snapshot of the target node.
+	ErrLogNotContinuous = errors.New("log not continuous")
+)
+
+const (
+	logExportVersion uint64 = 1
+	// magic(8) + 8 uint64 fields + crc32(4)
+	logExportHeaderSize = 8 + 8*8 + 4
+	// size(8) + crc32(4)
+	logExportRecordHeaderSize = 8 + 4
+)
+
+var (
+	logExportMagic = []byte("DBRFTLOG")
+)
+
+// logExportHeader is the header of a Raft Log export.
+type logExportHeader struct {
+	clusterID  uint64
+	nodeID     uint64
+	firstIndex uint64
+	lastIndex  uint64
+	term       uint64
+	vote       uint64
+	commit     uint64
+}
+
+func (h *logExportHeader) marshal() []byte {
+	data := make([]byte, logExportHeaderSize)
+	copy(data, logExportMagic)
+	fields := []uint64{logExportVersion, h.clusterID, h.nodeID,
+		h.firstIndex, h.lastIndex, h.term, h.vote, h.commit}
+	for i, v := range fields {
+		binary.LittleEndian.PutUint64(data[8+i*8:], v)
+	}
+	sz := logExportHeaderSize - 4
+	binary.LittleEndian.PutUint32(data[sz:], crc32.ChecksumIEEE(data[:sz]))
+	return data
+}
+
+func (h *logExportHeader) unmarshal(data []byte) error {
+	sz := logExportHeaderSize - 4
+	if len(data) != logExportHeaderSize ||
+		!bytes.Equal(data[:8], logExportMagic) ||
+		crc32.ChecksumIEEE(data[:sz]) != binary.LittleEndian.Uint32(data[sz:]) {
+		return ErrInvalidLogExport
+	}
+	fields := make([]uint64, 8)
+	for i := range fields {
+		fields[i] = binary.LittleEndian.Uint64(data[8+i*8:])
+	}
+	if fields[0] != logExportVersion {
+		return ErrInvalidLogExport
+	}
+	h.clusterID, h.nodeID = fields[1], fields[2]
+	h.firstIndex, h.lastIndex = fields[3], fields[4]
+	h.term, h.vote, h.commit = fields[5], fields[6], fields[7]
+	if h.firstIndex == 0 || h.firstIndex > h.lastIndex {
+		return ErrInvalidLogExport
+	}
+	return nil
+}
+
+// ExportLog writes Raft Log entries in the range of [firstIndex, lastIndex]
+// of the specified Raft node to w. Specifying 0 as lastIndex exports all
+// entries starting from firstIndex. ErrLogRangeNotAvailable is returned when
+// the requested range is not fully available in the LogDB, e.g. when some
+// entries have already been compacted.
+//
+// The export uses the following binary format, all integers are little
+// endian encoded -
+//
+// The export starts with a header, it contains 8 bytes magic "DBRFTLOG",
+// uint64 values of the format version (currently 1), ClusterID, NodeID, first
+// index, last index, term, vote and commit of the exported node, followed by
+// the uint32 CRC32 (IEEE) checksum of all preceding header bytes. For each
+// index in [first index, last index] in ascending order, the header is then
+// followed by an uint64 size of the marshaled raftpb.Entry record, the uint32
+// CRC32 (IEEE) checksum of the marshaled record and the marshaled record.
+//
+// ExportLog is typically invoked by a DevOps tool when the NodeHost is not
+// running, the exported data can be analyzed offline or imported to another
+// host using ImportLog.
+func ExportLog(nhConfig config.NodeHostConfig, clusterID uint64,
+	nodeID uint64, firstIndex uint64, lastIndex uint64, w io.Writer) error {
+	return withLogDB(nhConfig, func(ldb raftio.ILogDB) error {
+		ni := raftio.NodeInfo{ClusterID: clusterID, NodeID: nodeID}
+		ssIndex, err := getLatestSnapshotIndex(ldb, ni)
+		if err != nil {
+			return err
+		}
+		rs, err := ldb.ReadRaftState(clusterID, nodeID, ssIndex)
+		if err == raftio.ErrNoSavedLog {
+			return ErrLogRangeNotAvailable
+		}
+		if err != nil {
+			return err
+		}
+		maxIndex := rs.FirstIndex + rs.EntryCount - 1
+		if lastIndex == 0 {
+			lastIndex = maxIndex
+		}
+		if rs.EntryCount == 0 || firstIndex == 0 ||
+			firstIndex < rs.FirstIndex || lastIndex > maxIndex ||
+			firstIndex > lastIndex {
+			return ErrLogRangeNotAvailable
+		}
+		h := logExportHeader{
+			clusterID:  clusterID,
+			nodeID:     nodeID,
+			firstIndex: firstIndex,
+			lastIndex:  lastIndex,
+			term:       rs.State.Term,
+			vote:       rs.State.Vote,
+			commit:     rs.State.Commit,
+		}
+		if _, err := w.Write(h.marshal()); err != nil {
+			return err
+		}
+		rs.FirstIndex = firstIndex
+		rs.EntryCount = lastIndex - firstIndex + 1
+		return iterateNodeEntries(ldb, ni, rs, func(ents []pb.Entry) error {
+			for _, e := range ents {
+				if err := writeLogExportRecord(w, e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// ImportLog reads Raft Log entries exported by ExportLog from r and saves them
+// into the LogDB as the Raft Log of node nodeID of the exported Raft cluster,
+// e.g. to seed a replacement node. The target node is required to have no
+// Raft Log entry in the LogDB, ErrTargetNodeNotEmpty is returned otherwise.
+// Entries already covered by the most recent snapshot of the target node are
+// skipped, ErrLogNotContinuous is returned when the imported entries don't
+// continue from that snapshot. Such snapshot can be imported beforehand using
+// ImportSnapshot.
+//
+// The term and commit values of the exported node are imported together with
+// the entries, the commit value is capped at the last imported index. The vote
+// value is only imported when nodeID is the NodeID of the exported node.
+//
+// ImportLog is typically invoked by a DevOps tool. The NodeHost instance must
+// be stopped on that host when invoking the function ImportLog.
+func ImportLog(nhConfig config.NodeHostConfig,
+	r io.Reader, nodeID uint64) error {
+	hd := make([]byte, logExportHeaderSize)
+	if _, err := io.ReadFull(r, hd); err != nil {
+		return ErrInvalidLogExport
+	}
+	var h logExportHeader
+	if err := h.unmarshal(hd); err != nil {
+		return err
+	}
+	return withLogDB(nhConfig, func(ldb raftio.ILogDB) error {
+		ni := raftio.NodeInfo{ClusterID: h.clusterID, NodeID: nodeID}
+		ssIndex, err := getLatestSnapshotIndex(ldb, ni)
+		if err != nil {
+			return err
+		}
+		state := pb.State{Term: h.term, Commit: h.commit}
+		if nodeID == h.nodeID {
+			state.Vote = h.vote
+		}
+		if state.Commit > h.lastIndex {
+			state.Commit = h.lastIndex
+		}
+		rs, err := ldb.ReadRaftState(h.clusterID, nodeID, ssIndex)
+		if err != nil && err != raftio.ErrNoSavedLog {
+			return err
+		}
+		if err == nil {
+			if rs.EntryCount > 0 {
+				return ErrTargetNodeNotEmpty
+			}
+			if rs.State.Term > state.Term {
+				state.Term, state.Vote = rs.State.Term, rs.State.Vote
+			}
+			if rs.State.Commit > state.Commit {
+				state.Commit = rs.State.Commit
+			}
+		}
+		if h.firstIndex > ssIndex+1 || h.lastIndex <= ssIndex {
+			return ErrLogNotContinuous
+		}
+		return importLogEntries(nhConfig, ldb, h, ni, state, ssIndex, r)
+	})
+}
+
+func importLogEntries(nhConfig config.NodeHostConfig, ldb raftio.ILogDB,
+	h logExportHeader, ni raftio.NodeInfo, state pb.State,
+	ssIndex uint64, r io.Reader) error {
+	shards := nhConfig.Expert.Engine.ExecShards
+	if shards == 0 {
+		shards = config.GetDefaultEngineConfig().ExecShards
+	}
+	// Raft state is saved using the same shard ID as the execution engine
+	shardID := server.NewFixedPartitioner(shards).GetPartitionID(ni.ClusterID) + 1
+	ud := pb.Update{ClusterID: ni.ClusterID, NodeID: ni.NodeID, State: state}
+	size := uint64(0)
+	for index := h.firstIndex; index <= h.lastIndex; index++ {
+		e, err := readLogExportRecord(r)
+		if err != nil {
+			return err
+		}
+		if e.Index != index {
+			return ErrInvalidLogExport
+		}
+		if e.Index <= ssIndex {
+			continue
+		}
+		ud.EntriesToSave = append(ud.EntriesToSave, e)
+		size += uint64(e.SizeUpperLimit())
+		if size >= migrationBatchSize || index == h.lastIndex {
+			if err := ldb.SaveRaftState([]pb.Update{ud}, shardID); err != nil {
+				return err
+			}
+			ud.EntriesToSave = nil
+			size = 0
+		}
+	}
+	return nil
+}
+
+func writeLogExportRecord(w io.Writer, e pb.Entry) error {
+	data, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+	hd := make([]byte, logExportRecordHeaderSize)
+	binary.LittleEndian.PutUint64(hd, uint64(len(data)))
+	binary.LittleEndian.PutUint32(hd[8:], crc32.ChecksumIEEE(data))
+	if _, err := w.Write(hd); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func readLogExportRecord(r io.Reader) (pb.Entry, error) {
+	hd := make([]byte, logExportRecordHeaderSize)
+	if _, err := io.ReadFull(r, hd); err != nil {
+		return pb.Entry{}, ErrInvalidLogExport
+	}
+	sz := binary.LittleEndian.Uint64(hd)
+	if sz > math.MaxInt32 {
+		return pb.Entry{}, ErrInvalidLogExport
+	}
+	data := make([]byte, sz)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return pb.Entry{}, ErrInvalidLogExport
+	}
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(hd[8:]) {
+		return pb.Entry{}, ErrInvalidLogExport
+	}
+	var e pb.Entry
+	if err := e.Unmarshal(data); err != nil {
+		return pb.Entry{}, ErrInvalidLogExport
+	}
+	return e, nil
+}
+
+func getLatestSnapshotIndex(ldb raftio.ILogDB, ni raftio.NodeInfo) (uint64, error) {
+	snapshots, err := ldb.ListSnapshots(ni.ClusterID, ni.NodeID, math.MaxUint64)
+	if err != nil {
+		return 0, err
+	}
+	if len(snapshots) == 0 {
+		return 0, nil
+	}
+	return snapshots[len(snapshots)-1].Index, nil
+}
+
+func withLogDB(nhConfig config.NodeHostConfig,
+	f func(ldb raftio.ILogDB) error) error {
+	if nhConfig.DeploymentID == 0 {
+		nhConfig.DeploymentID = unmanagedDeploymentID
+	}
+	if nhConfig.Expert.FS == nil {
+		nhConfig.Expert.FS = vfs.DefaultFS
+	}
+	if err := nhConfig.Prepare(); err != nil {
+		return err
+	}
+	fs := nhConfig.Expert.FS
+	env, err := server.NewEnv(nhConfig, fs)
+	if err != nil {
+		return err
+	}
+	defer env.Stop()
+	if _, _, err := env.CreateNodeHostDir(nhConfig.DeploymentID); err != nil {
+		return err
+	}
+	ldb, err := getLogDB(*env, nhConfig, fs)
+	if err != nil {
+		return err
+	}
+	defer ldb.Close()
+	if err := env.CheckNodeHostDir(nhConfig,
+		ldb.BinaryFormat(), ldb.Name()); err != nil {
+		return err
+	}
+	return f(ldb)
+}
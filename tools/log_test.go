@@ -0,0 +1,123 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+func getLogExportTestNodeHostConfig(dir string,
+	fs vfs.IFS) config.NodeHostConfig {
+	expert := config.GetDefaultExpertConfig()
+	expert.LogDB = config.GetTinyMemLogDBConfig()
+	expert.FS = fs
+	return config.NodeHostConfig{
+		NodeHostDir:    dir,
+		RTTMillisecond: 20,
+		RaftAddress:    "localhost:26000",
+		Expert:         expert,
+	}
+}
+
+func TestLogCanBeExportedAndImported(t *testing.T) {
+	fs := vfs.GetTestFS()
+	srcDir := "log_export_src_safe_to_delete"
+	dstDir := "log_export_dst_safe_to_delete"
+	defer func() {
+		for _, dir := range []string{srcDir, dstDir} {
+			if err := fs.RemoveAll(dir); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}()
+	srcConfig := getLogExportTestNodeHostConfig(srcDir, fs)
+	if err := withLogDB(srcConfig, func(ldb raftio.ILogDB) error {
+		saveMigrationTestData(t, ldb, 1)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to save test data %v", err)
+	}
+	var buf bytes.Buffer
+	if err := ExportLog(srcConfig, 1, 1, 30, 60, &buf); err != ErrLogRangeNotAvailable {
+		t.Errorf("compacted range not reported, %v", err)
+	}
+	if err := ExportLog(srcConfig, 1, 1, 90, 101, &buf); err != ErrLogRangeNotAvailable {
+		t.Errorf("unavailable range not reported, %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected data written")
+	}
+	if err := ExportLog(srcConfig, 1, 1, 51, 0, &buf); err != nil {
+		t.Fatalf("failed to export log %v", err)
+	}
+	data := buf.Bytes()
+	dstConfig := getLogExportTestNodeHostConfig(dstDir, fs)
+	if err := ImportLog(dstConfig,
+		bytes.NewReader(data), 2); err != ErrLogNotContinuous {
+		t.Fatalf("log gap not reported, %v", err)
+	}
+	if err := withLogDB(dstConfig, func(ldb raftio.ILogDB) error {
+		ss := pb.Snapshot{Index: 50, Term: 2, Type: pb.RegularStateMachine}
+		su := pb.Update{ClusterID: 1, NodeID: 2, Snapshot: ss}
+		return ldb.SaveSnapshots([]pb.Update{su})
+	}); err != nil {
+		t.Fatalf("failed to save snapshot %v", err)
+	}
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1]++
+	if err := ImportLog(dstConfig,
+		bytes.NewReader(corrupted), 2); err != ErrInvalidLogExport {
+		t.Fatalf("corrupted export not reported, %v", err)
+	}
+	if err := ImportLog(dstConfig, bytes.NewReader(data), 2); err != nil {
+		t.Fatalf("failed to import log %v", err)
+	}
+	if err := ImportLog(dstConfig,
+		bytes.NewReader(data), 2); err != ErrTargetNodeNotEmpty {
+		t.Fatalf("non-empty target not reported, %v", err)
+	}
+	if err := withLogDB(dstConfig, func(ldb raftio.ILogDB) error {
+		rs, err := ldb.ReadRaftState(1, 2, 50)
+		if err != nil {
+			return err
+		}
+		if rs.FirstIndex != 51 || rs.EntryCount != 50 {
+			t.Errorf("unexpected range %d, %d", rs.FirstIndex, rs.EntryCount)
+		}
+		expected := pb.State{Term: 2, Commit: 100}
+		if !reflect.DeepEqual(&rs.State, &expected) {
+			t.Errorf("unexpected state %+v", rs.State)
+		}
+		ents, _, err := ldb.IterateEntries(nil, 0, 1, 2, 51, 101, math.MaxUint64)
+		if err != nil {
+			return err
+		}
+		if len(ents) != 50 || ents[0].Index != 51 || ents[49].Index != 100 ||
+			string(ents[49].Cmd) != "test-data" {
+			t.Errorf("unexpected entries")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to read imported log %v", err)
+	}
+}
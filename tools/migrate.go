@@ -0,0 +1,222 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"errors"
+	"math"
+	"reflect"
+
+	"github.com/lni/goutils/logutil"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+var (
+	// ErrTargetLogDBNotEmpty indicates that the target LogDB of a migration
+	// already contains Raft node data.
+	ErrTargetLogDBNotEmpty = errors.New("target LogDB is not empty")
+	// ErrMigrationVerificationFailed indicates that Raft node data read back
+	// from the target LogDB doesn't match the data in the source LogDB.
+	ErrMigrationVerificationFailed = errors.New("migration verification failed")
+)
+
+const (
+	// maximum total size in bytes of entries read and written in each step of
+	// the migration
+	migrationBatchSize uint64 = 64 * 1024 * 1024
+)
+
+// MigrateLogDB reads the Raft state, log entries, snapshot metadata and
+// bootstrap info of all Raft nodes found in the src LogDB and writes them into
+// the dst LogDB, e.g. to move data stored by a RocksDB based LogDB into a
+// Pebble based one. Data written into the dst LogDB is read back and compared
+// with the src LogDB, ErrMigrationVerificationFailed is returned on any
+// mismatch. The dst LogDB is required to be empty. The nhConfig parameter is
+// the NodeHostConfig used for creating the dst LogDB.
+//
+// MigrateLogDB is typically invoked by a DevOps tool. Both ILogDB instances
+// are expected to be created by the caller, e.g. using the Create method of
+// the relevant config.LogDBFactory, and the NodeHost instance that owns the
+// src LogDB must be stopped. Snapshot files are not touched, they stay in the
+// snapshot directories referenced by the migrated snapshot metadata.
+func MigrateLogDB(nhConfig config.NodeHostConfig,
+	src raftio.ILogDB, dst raftio.ILogDB) error {
+	shards := nhConfig.Expert.Engine.ExecShards
+	if shards == 0 {
+		shards = config.GetDefaultEngineConfig().ExecShards
+	}
+	// Raft state is saved using the same shard ID as the execution engine
+	p := server.NewFixedPartitioner(shards)
+	existing, err := dst.ListNodeInfo()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return ErrTargetLogDBNotEmpty
+	}
+	nodes, err := src.ListNodeInfo()
+	if err != nil {
+		return err
+	}
+	for _, ni := range nodes {
+		plog.Infof("migrating LogDB data of %s", dn(ni))
+		shardID := p.GetPartitionID(ni.ClusterID) + 1
+		if err := migrateNode(src, dst, ni, shardID); err != nil {
+			return err
+		}
+		if err := verifyNode(src, dst, ni); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dn(ni raftio.NodeInfo) string {
+	return logutil.DescribeNode(ni.ClusterID, ni.NodeID)
+}
+
+func migrateNode(src raftio.ILogDB,
+	dst raftio.ILogDB, ni raftio.NodeInfo, shardID uint64) error {
+	bs, err := src.GetBootstrapInfo(ni.ClusterID, ni.NodeID)
+	if err != nil {
+		return err
+	}
+	if err := dst.SaveBootstrapInfo(ni.ClusterID, ni.NodeID, bs); err != nil {
+		return err
+	}
+	snapshots, err := src.ListSnapshots(ni.ClusterID, ni.NodeID, math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	ud := pb.Update{ClusterID: ni.ClusterID, NodeID: ni.NodeID}
+	for idx, ss := range snapshots {
+		ud.Snapshot = ss
+		if idx < len(snapshots)-1 {
+			if err := dst.SaveSnapshots([]pb.Update{ud}); err != nil {
+				return err
+			}
+		}
+	}
+	rs, err := src.ReadRaftState(ni.ClusterID, ni.NodeID, ud.Snapshot.Index)
+	if err == raftio.ErrNoSavedLog {
+		if pb.IsEmptySnapshot(ud.Snapshot) {
+			return nil
+		}
+		return dst.SaveRaftState([]pb.Update{ud}, shardID)
+	}
+	if err != nil {
+		return err
+	}
+	// the most recent snapshot and the state are saved first so the max index
+	// is properly set before entries are saved
+	ud.State = rs.State
+	if err := dst.SaveRaftState([]pb.Update{ud}, shardID); err != nil {
+		return err
+	}
+	return iterateNodeEntries(src, ni, rs, func(ents []pb.Entry) error {
+		ud := pb.Update{
+			ClusterID:     ni.ClusterID,
+			NodeID:        ni.NodeID,
+			State:         rs.State,
+			EntriesToSave: ents,
+		}
+		return dst.SaveRaftState([]pb.Update{ud}, shardID)
+	})
+}
+
+func verifyNode(src raftio.ILogDB, dst raftio.ILogDB, ni raftio.NodeInfo) error {
+	srcBS, err := src.GetBootstrapInfo(ni.ClusterID, ni.NodeID)
+	if err != nil {
+		return err
+	}
+	dstBS, err := dst.GetBootstrapInfo(ni.ClusterID, ni.NodeID)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(srcBS, dstBS) {
+		plog.Errorf("%s bootstrap info mismatch", dn(ni))
+		return ErrMigrationVerificationFailed
+	}
+	srcSS, err := src.ListSnapshots(ni.ClusterID, ni.NodeID, math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	dstSS, err := dst.ListSnapshots(ni.ClusterID, ni.NodeID, math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(srcSS, dstSS) {
+		plog.Errorf("%s snapshot metadata mismatch", dn(ni))
+		return ErrMigrationVerificationFailed
+	}
+	index := uint64(0)
+	if len(srcSS) > 0 {
+		index = srcSS[len(srcSS)-1].Index
+	}
+	srcRS, srcErr := src.ReadRaftState(ni.ClusterID, ni.NodeID, index)
+	dstRS, dstErr := dst.ReadRaftState(ni.ClusterID, ni.NodeID, index)
+	if srcErr == raftio.ErrNoSavedLog && dstErr == srcErr {
+		return nil
+	}
+	if srcErr != nil {
+		return srcErr
+	}
+	if dstErr != nil {
+		return dstErr
+	}
+	if !reflect.DeepEqual(srcRS, dstRS) {
+		plog.Errorf("%s raft state mismatch, %+v vs %+v", dn(ni), srcRS, dstRS)
+		return ErrMigrationVerificationFailed
+	}
+	return iterateNodeEntries(src, ni, srcRS, func(ents []pb.Entry) error {
+		low, high := ents[0].Index, ents[len(ents)-1].Index+1
+		dstEnts, _, err := dst.IterateEntries(nil,
+			0, ni.ClusterID, ni.NodeID, low, high, math.MaxUint64)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(ents, dstEnts) {
+			plog.Errorf("%s entries mismatch in [%d, %d)", dn(ni), low, high)
+			return ErrMigrationVerificationFailed
+		}
+		return nil
+	})
+}
+
+func iterateNodeEntries(db raftio.ILogDB, ni raftio.NodeInfo,
+	rs raftio.RaftState, f func([]pb.Entry) error) error {
+	low := rs.FirstIndex
+	high := rs.FirstIndex + rs.EntryCount
+	for low < high {
+		ents, _, err := db.IterateEntries(nil,
+			0, ni.ClusterID, ni.NodeID, low, high, migrationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(ents) == 0 || ents[0].Index != low {
+			plog.Errorf("%s missing entry %d", dn(ni), low)
+			return ErrMigrationVerificationFailed
+		}
+		if err := f(ents); err != nil {
+			return err
+		}
+		low = ents[len(ents)-1].Index + 1
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"testing"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/logdb"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+func getMigrationTestLogDB(t *testing.T, dir string,
+	batched bool, fs vfs.IFS) raftio.ILogDB {
+	if err := fileutil.MkdirAll(dir, fs); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expert := config.GetDefaultExpertConfig()
+	expert.LogDB = config.GetTinyMemLogDBConfig()
+	expert.LogDB.Shards = 2
+	cfg := config.NodeHostConfig{Expert: expert}
+	f := logdb.NewDefaultLogDB
+	if batched {
+		f = logdb.NewDefaultBatchedLogDB
+	}
+	db, err := f(cfg, nil, []string{dir}, []string{dir}, fs)
+	if err != nil {
+		t.Fatalf("failed to open logdb %v", err)
+	}
+	return db
+}
+
+func saveMigrationTestData(t *testing.T, db raftio.ILogDB, clusterID uint64) {
+	bs := pb.NewBootstrapInfo(false,
+		pb.RegularStateMachine, map[uint64]string{1: "a1", 2: "a2"})
+	if err := db.SaveBootstrapInfo(clusterID, 1, bs); err != nil {
+		t.Fatalf("failed to save bootstrap info %v", err)
+	}
+	ud := pb.Update{
+		ClusterID: clusterID,
+		NodeID:    1,
+		State:     pb.State{Term: 2, Vote: 1, Commit: 100},
+	}
+	for i := uint64(1); i <= 100; i++ {
+		ud.EntriesToSave = append(ud.EntriesToSave,
+			pb.Entry{Index: i, Term: 2, Cmd: []byte("test-data")})
+	}
+	if err := db.SaveRaftState([]pb.Update{ud}, clusterID+1); err != nil {
+		t.Fatalf("failed to save raft state %v", err)
+	}
+	for _, index := range []uint64{20, 50} {
+		ss := pb.Snapshot{
+			Index:    index,
+			Term:     2,
+			Filepath: "snapshot-file",
+			Type:     pb.RegularStateMachine,
+		}
+		su := pb.Update{ClusterID: clusterID, NodeID: 1, Snapshot: ss}
+		if err := db.SaveSnapshots([]pb.Update{su}); err != nil {
+			t.Fatalf("failed to save snapshot %v", err)
+		}
+	}
+	if err := db.RemoveEntriesTo(clusterID, 1, 40); err != nil {
+		t.Fatalf("failed to remove entries %v", err)
+	}
+}
+
+func TestMigrateLogDB(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(testDataDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	src := getMigrationTestLogDB(t, fs.PathJoin(testDataDir, "src"), false, fs)
+	defer src.Close()
+	dst := getMigrationTestLogDB(t, fs.PathJoin(testDataDir, "dst"), true, fs)
+	defer dst.Close()
+	for i := uint64(1); i <= 3; i++ {
+		saveMigrationTestData(t, src, i)
+	}
+	if err := MigrateLogDB(config.NodeHostConfig{}, src, dst); err != nil {
+		t.Fatalf("failed to migrate %v", err)
+	}
+	nodes, err := dst.ListNodeInfo()
+	if err != nil {
+		t.Fatalf("failed to list node info %v", err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("unexpected node count %d", len(nodes))
+	}
+	for i := uint64(1); i <= 3; i++ {
+		snapshots, err := dst.ListSnapshots(i, 1, 100)
+		if err != nil {
+			t.Fatalf("failed to list snapshots %v", err)
+		}
+		if len(snapshots) != 2 || snapshots[1].Index != 50 {
+			t.Fatalf("unexpected snapshots %v", snapshots)
+		}
+		rs, err := dst.ReadRaftState(i, 1, 50)
+		if err != nil {
+			t.Fatalf("failed to read raft state %v", err)
+		}
+		if rs.State.Commit != 100 || rs.FirstIndex+rs.EntryCount != 101 {
+			t.Errorf("unexpected raft state %+v", rs)
+		}
+	}
+}
+
+func TestMigrateLogDBRequiresEmptyTarget(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(testDataDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	src := getMigrationTestLogDB(t, fs.PathJoin(testDataDir, "src"), false, fs)
+	defer src.Close()
+	dst := getMigrationTestLogDB(t, fs.PathJoin(testDataDir, "dst"), false, fs)
+	defer dst.Close()
+	saveMigrationTestData(t, src, 1)
+	saveMigrationTestData(t, dst, 2)
+	if err := MigrateLogDB(config.NodeHostConfig{}, src, dst); err != ErrTargetLogDBNotEmpty {
+		t.Errorf("failed to return ErrTargetLogDBNotEmpty, %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"errors"
+
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/rsm"
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+var (
+	// ErrLogDBScanNotSupported indicates that the LogDB in use doesn't
+	// implement the raftio.ILogDBScanner interface.
+	ErrLogDBScanNotSupported = errors.New("LogDB scan not supported")
+)
+
+// ScanLogDB scans the LogDB and snapshot files of the NodeHost specified by
+// nhConfig to detect corrupted records. Bootstrap records, Raft states,
+// snapshot records and Raft Log entries are checked to make sure that they
+// can be decoded and that Raft Log entries are continuous, snapshot files
+// referenced by valid snapshot records are checked against their checksums.
+// A raftio.NodeScanResult is returned for each Raft node found in the LogDB.
+//
+// When repair is true, corrupted snapshot records are removed and the Raft Log
+// of each node is truncated at its first corrupted or missing entry so the
+// node can be restarted rather than panicking at startup. Truncated entries
+// need to be replicated again from the leader. The truncation is refused when
+// it would remove committed entries or when the commit index of the node is
+// unknown, such problem is reported with the Repaired flag set to false. Set
+// force to true to truncate anyway, note that removing committed entries can
+// break Raft's safety guarantees when a majority of the nodes are repaired in
+// such way. Problems such as corrupted bootstrap records, Raft states and
+// snapshot files can not be repaired, they are reported with the Repaired flag
+// of the returned raftio.NodeScanResult set to false.
+//
+// ScanLogDB is typically invoked by a DevOps tool when the NodeHost is not
+// running. ErrLogDBScanNotSupported is returned when the LogDB doesn't support
+// scanning.
+func ScanLogDB(nhConfig config.NodeHostConfig,
+	repair bool, force bool) ([]raftio.NodeScanResult, error) {
+	if nhConfig.DeploymentID == 0 {
+		nhConfig.DeploymentID = unmanagedDeploymentID
+	}
+	if nhConfig.Expert.FS == nil {
+		nhConfig.Expert.FS = vfs.DefaultFS
+	}
+	if err := nhConfig.Prepare(); err != nil {
+		return nil, err
+	}
+	fs := nhConfig.Expert.FS
+	env, err := server.NewEnv(nhConfig, fs)
+	if err != nil {
+		return nil, err
+	}
+	defer env.Stop()
+	if _, _, err := env.CreateNodeHostDir(nhConfig.DeploymentID); err != nil {
+		return nil, err
+	}
+	ldb, err := getLogDB(*env, nhConfig, fs)
+	if err != nil {
+		return nil, err
+	}
+	defer ldb.Close()
+	if err := env.CheckNodeHostDir(nhConfig,
+		ldb.BinaryFormat(), ldb.Name()); err != nil {
+		return nil, err
+	}
+	scanner, ok := ldb.(raftio.ILogDBScanner)
+	if !ok {
+		return nil, ErrLogDBScanNotSupported
+	}
+	results, err := scanner.Scan(repair, force)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		if err := scanSnapshotFiles(ldb, &results[i], fs); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func scanSnapshotFiles(ldb raftio.ILogDB,
+	result *raftio.NodeScanResult, fs vfs.IFS) error {
+	snapshots, err := ldb.ListSnapshots(result.ClusterID,
+		result.NodeID, result.SnapshotIndex)
+	if err != nil {
+		return err
+	}
+	for _, ss := range snapshots {
+		if ss.Dummy || ss.Witness {
+			continue
+		}
+		valid, err := rsm.ValidateSnapshotFile(ss.Filepath, fs)
+		if err != nil && !vfs.IsNotExist(err) {
+			return err
+		}
+		if !valid {
+			result.Problems = append(result.Problems,
+				"corrupted or missing snapshot file "+ss.Filepath)
+			result.Repaired = false
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"testing"
+
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+)
+
+func TestScanSnapshotFilesReportsMissingFiles(t *testing.T) {
+	fs := vfs.GetTestFS()
+	dir := "scan_test_safe_to_delete"
+	defer func() {
+		if err := fs.RemoveAll(dir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	db := getMigrationTestLogDB(t, dir, false, fs)
+	defer db.Close()
+	saveMigrationTestData(t, db, 1)
+	results, err := db.(raftio.ILogDBScanner).Scan(false, false)
+	if err != nil {
+		t.Fatalf("scan failed %v", err)
+	}
+	if len(results) != 1 || results[0].Corrupted() {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if err := scanSnapshotFiles(db, &results[0], fs); err != nil {
+		t.Fatalf("failed to scan snapshot files %v", err)
+	}
+	if len(results[0].Problems) != 2 {
+		t.Errorf("missing snapshot files not reported, %v", results[0].Problems)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"github.com/lni/dragonboat/v3/internal/rsm"
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+)
+
+var (
+	// ErrSnapshotTruncated indicates that the snapshot file is shorter than
+	// expected.
+	ErrSnapshotTruncated = rsm.ErrSnapshotTruncated
+	// ErrSnapshotHeaderCorrupted indicates that the snapshot header doesn't
+	// match its checksum or can not be decoded.
+	ErrSnapshotHeaderCorrupted = rsm.ErrSnapshotHeaderCorrupted
+	// ErrSnapshotChunkCorrupted indicates that a block of the snapshot payload
+	// doesn't match its checksum.
+	ErrSnapshotChunkCorrupted = rsm.ErrSnapshotChunkCorrupted
+	// ErrSnapshotPayloadCorrupted indicates that the snapshot payload doesn't
+	// match the checksum recorded in the snapshot header or the snapshot
+	// metadata.
+	ErrSnapshotPayloadCorrupted = rsm.ErrSnapshotPayloadCorrupted
+	// ErrSnapshotFileMissing indicates that an external file of the snapshot is
+	// missing or its size doesn't match the snapshot metadata.
+	ErrSnapshotFileMissing = rsm.ErrSnapshotFileMissing
+)
+
+// VerifySnapshot re-reads the exported snapshot in the srcDir directory and
+// validates the header checksum, the checksum of each payload chunk and the
+// overall payload checksum of the snapshot image, it also checks that all
+// external files recorded in the snapshot metadata are present. It is
+// typically used to verify a backup before older backups are pruned.
+//
+// nil is returned when the exported snapshot is valid. Otherwise the returned
+// error describes the detected problem, use errors.Is to check whether it is
+// caused by one of the ErrSnapshot* errors defined in this package.
+func VerifySnapshot(srcDir string) error {
+	return verifySnapshot(srcDir, vfs.DefaultFS)
+}
+
+func verifySnapshot(srcDir string, fs vfs.IFS) error {
+	fp, err := getSnapshotFilepath(srcDir, fs)
+	if err != nil {
+		return err
+	}
+	ss, err := getSnapshotRecord(srcDir, server.MetadataFilename, fs)
+	if err != nil {
+		return err
+	}
+	ss.Filepath = fp
+	for _, f := range ss.Files {
+		f.Filepath = fs.PathJoin(srcDir, fs.PathBase(f.Filepath))
+	}
+	return rsm.VerifySnapshot(ss, fs)
+}
@@ -0,0 +1,82 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/lni/dragonboat/v3/internal/fileutil"
+	"github.com/lni/dragonboat/v3/internal/rsm"
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+func TestExportedSnapshotCanBeVerified(t *testing.T) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(testDataDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := verifySnapshot(testDataDir, fs); err != ErrPathNotExist {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := fs.MkdirAll(testDataDir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(testDataDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	fp := fs.PathJoin(testDataDir, "snapshot-0000000000000064.gbsnap")
+	w, err := rsm.NewSnapshotWriter(fp, pb.NoCompression, fs)
+	if err != nil {
+		t.Fatalf("failed to get writer %v", err)
+	}
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed %v", err)
+	}
+	extfp := fs.PathJoin(testDataDir, "external-1")
+	if err := createTestDataFile(extfp, 2048, fs); err != nil {
+		t.Fatalf("failed to create external test file %v", err)
+	}
+	ss := pb.Snapshot{
+		Filepath: "/original_dir/snapshot-0000000000000064.gbsnap",
+		Checksum: w.GetPayloadChecksum(),
+		Files: []*pb.SnapshotFile{
+			{Filepath: "/original_dir/external-1", FileSize: 2048},
+		},
+	}
+	if err := fileutil.CreateFlagFile(testDataDir,
+		server.MetadataFilename, &ss, fs); err != nil {
+		t.Fatalf("failed to create metadata file %v", err)
+	}
+	if err := verifySnapshot(testDataDir, fs); err != nil {
+		t.Fatalf("valid snapshot not accepted, %v", err)
+	}
+	if err := fs.RemoveAll(extfp); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := verifySnapshot(testDataDir, fs); !errors.Is(err, ErrSnapshotFileMissing) {
+		t.Errorf("missing external file not reported, %v", err)
+	}
+}
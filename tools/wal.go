@@ -0,0 +1,241 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/lni/goutils/logutil"
+	"github.com/lni/goutils/random"
+
+	"github.com/lni/dragonboat/v3/client"
+	"github.com/lni/dragonboat/v3/config"
+	"github.com/lni/dragonboat/v3/internal/server"
+	"github.com/lni/dragonboat/v3/internal/vfs"
+	"github.com/lni/dragonboat/v3/raftio"
+	pb "github.com/lni/dragonboat/v3/raftpb"
+)
+
+var (
+	// ErrNodeAlreadyExist indicates that the node to import the external WAL
+	// into already exists in the LogDB.
+	ErrNodeAlreadyExist = errors.New("node already exist")
+	// ErrEmptyWAL indicates that the external WAL does not contain any command.
+	ErrEmptyWAL = errors.New("no command in external WAL")
+)
+
+// ICommandIterator is the interface implemented by user provided iterators
+// over commands recorded in an external write ahead log, e.g. the WAL of a
+// legacy single node system.
+type ICommandIterator interface {
+	// Next returns the next command in the external WAL. Commands must be
+	// returned in the order in which they were originally applied. The returned
+	// boolean value is false when there is no more command.
+	Next() ([]byte, bool, error)
+}
+
+// ImportWAL bootstraps the specified node of a new Raft cluster using
+// commands read from an external write ahead log. It allows existing single
+// node systems to be migrated onto Dragonboat without replaying their history
+// through live proposals.
+//
+// The initial membership of the Raft cluster, as specified by memberNodes, is
+// written into the LogDB as the first len(memberNodes) log entries, each
+// command returned by the iterator is then written into the LogDB as a
+// committed log entry proposed using a NO-OP client session. ImportWAL returns
+// the index of the last written log entry. Once the NodeHost is restarted, the
+// node should be started with an empty initial members map and the join flag
+// set to false, all imported commands are applied by the state machine in
+// their original order.
+//
+// Similar to ImportSnapshot, ImportWAL is typically invoked by a DevOps tool
+// when the NodeHost instance is stopped. It must be called on each host of the
+// new Raft cluster using the same memberNodes map and the same command
+// sequence. ErrNodeAlreadyExist is returned when the specified node already
+// exists in the LogDB.
+func ImportWAL(nhConfig config.NodeHostConfig, clusterID uint64,
+	iter ICommandIterator, memberNodes map[uint64]string,
+	nodeID uint64) (uint64, error) {
+	if nhConfig.DeploymentID == 0 {
+		plog.Infof("NodeHostConfig.DeploymentID not set, default to %d",
+			unmanagedDeploymentID)
+		nhConfig.DeploymentID = unmanagedDeploymentID
+	}
+	if nhConfig.Expert.FS == nil {
+		nhConfig.Expert.FS = vfs.DefaultFS
+	}
+	if err := nhConfig.Prepare(); err != nil {
+		return 0, err
+	}
+	fs := nhConfig.Expert.FS
+	if err := checkImportSettings(nhConfig, memberNodes, nodeID); err != nil {
+		return 0, err
+	}
+	env, err := server.NewEnv(nhConfig, fs)
+	if err != nil {
+		return 0, err
+	}
+	defer env.Stop()
+	if _, _, err := env.CreateNodeHostDir(nhConfig.DeploymentID); err != nil {
+		return 0, err
+	}
+	logdb, err := getLogDB(*env, nhConfig, fs)
+	if err != nil {
+		return 0, err
+	}
+	defer logdb.Close()
+	if err := env.CheckNodeHostDir(nhConfig,
+		logdb.BinaryFormat(), logdb.Name()); err != nil {
+		return 0, err
+	}
+	_, err = logdb.GetBootstrapInfo(clusterID, nodeID)
+	if err == nil {
+		return 0, ErrNodeAlreadyExist
+	} else if err != raftio.ErrNoBootstrapInfo {
+		return 0, err
+	}
+	if err := env.CreateSnapshotDir(nhConfig.DeploymentID,
+		clusterID, nodeID); err != nil {
+		return 0, err
+	}
+	shards := nhConfig.Expert.Engine.ExecShards
+	if shards == 0 {
+		shards = config.GetDefaultEngineConfig().ExecShards
+	}
+	p := server.NewFixedPartitioner(shards)
+	shardID := p.GetPartitionID(clusterID) + 1
+	w := &walWriter{
+		logdb:     logdb,
+		clusterID: clusterID,
+		nodeID:    nodeID,
+		shardID:   shardID,
+		session:   client.NewNoOPSession(clusterID, random.LockGuardedRand),
+	}
+	if err := w.writeMembers(memberNodes); err != nil {
+		return 0, err
+	}
+	if err := w.writeCommands(iter); err != nil {
+		return 0, err
+	}
+	// the bootstrap info is saved last so a partially imported node is not
+	// considered as a bootstrapped one
+	bi := pb.NewBootstrapInfo(false, pb.UnknownStateMachine, memberNodes)
+	if err := logdb.SaveBootstrapInfo(clusterID, nodeID, bi); err != nil {
+		return 0, err
+	}
+	plog.Infof("%s imported external WAL, last index %d",
+		logutil.DescribeNode(clusterID, nodeID), w.index)
+	return w.index, nil
+}
+
+type walWriter struct {
+	logdb     raftio.ILogDB
+	clusterID uint64
+	nodeID    uint64
+	shardID   uint64
+	session   *client.Session
+	index     uint64
+	size      uint64
+	entries   []pb.Entry
+}
+
+func (w *walWriter) writeMembers(members map[uint64]string) error {
+	// the same as the bootstrap entries appended by raft for initial members
+	addresses := make([]uint64, 0, len(members))
+	for nid := range members {
+		addresses = append(addresses, nid)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i] < addresses[j]
+	})
+	for _, nid := range addresses {
+		cc := pb.ConfigChange{
+			Type:       pb.AddNode,
+			NodeID:     nid,
+			Initialize: true,
+			Address:    members[nid],
+		}
+		data, err := cc.Marshal()
+		if err != nil {
+			panic(err)
+		}
+		e := pb.Entry{Type: pb.ConfigChangeEntry, Cmd: data}
+		if err := w.append(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *walWriter) writeCommands(iter ICommandIterator) error {
+	count := 0
+	for {
+		cmd, ok, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		// no client is waiting for imported entries, their keys are only
+		// required to be non-zero
+		e := pb.Entry{
+			Type:     pb.ApplicationEntry,
+			ClientID: w.session.ClientID,
+			SeriesID: w.session.SeriesID,
+			Key:      w.index + 1,
+			Cmd:      cmd,
+		}
+		if err := w.append(e); err != nil {
+			return err
+		}
+		count++
+	}
+	if count == 0 {
+		return ErrEmptyWAL
+	}
+	return w.flush()
+}
+
+func (w *walWriter) append(e pb.Entry) error {
+	w.index++
+	e.Index = w.index
+	e.Term = 1
+	w.entries = append(w.entries, e)
+	w.size += uint64(e.SizeUpperLimit())
+	if w.size >= migrationBatchSize {
+		return w.flush()
+	}
+	return nil
+}
+
+func (w *walWriter) flush() error {
+	if len(w.entries) == 0 {
+		return nil
+	}
+	ud := pb.Update{
+		ClusterID:     w.clusterID,
+		NodeID:        w.nodeID,
+		EntriesToSave: w.entries,
+		State:         pb.State{Term: 1, Commit: w.index},
+	}
+	if err := w.logdb.SaveRaftState([]pb.Update{ud}, w.shardID); err != nil {
+		return err
+	}
+	w.entries = nil
+	w.size = 0
+	return nil
+}
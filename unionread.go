@@ -0,0 +1,134 @@
+// Copyright 2017-2021 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/lni/dragonboat/v3/internal/rsm"
+)
+
+// UnionReducer is the function used by SyncUnionRead for merging the Lookup
+// result of the specified Raft cluster into the accumulated value. The
+// returned value becomes the accumulated value passed to the next invocation.
+type UnionReducer func(acc interface{},
+	clusterID uint64, result interface{}) (interface{}, error)
+
+// SyncUnionRead performs a linearizable read on each specified Raft cluster
+// and merges all query results using the specified reducer. It is designed
+// for applications that partition one logical dataset across multiple Raft
+// clusters hosted on the same NodeHost, all specified Raft clusters must have
+// a local node on this NodeHost or ErrClusterNotFound is returned.
+//
+// ReadIndex requests are issued to all specified Raft clusters at once so
+// their read barriers are confirmed in parallel by the execution engine, once
+// all of them completed, the query is passed to the Lookup method of each
+// local state machine by the apply workers of the execution engine. The
+// reducer is invoked one by one in the order of the specified cluster IDs
+// starting with the initial value as the accumulated value, it is thus not
+// required to be goroutine safe. The specified context must have the timeout
+// value set.
+func (nh *NodeHost) SyncUnionRead(ctx context.Context, clusterIDs []uint64,
+	query interface{}, initial interface{},
+	reducer UnionReducer) (interface{}, error) {
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	for _, clusterID := range clusterIDs {
+		if _, ok := nh.getCluster(clusterID); !ok {
+			return nil, ErrClusterNotFound
+		}
+	}
+	requests := make([]*RequestState, 0, len(clusterIDs))
+	// requests not yet completed when returning with an error can not be reused
+	// and are left to the garbage collector, see RequestState.Release.
+	defer func() {
+		for _, rs := range requests {
+			if rs != nil {
+				rs.Release()
+			}
+		}
+	}()
+	nodes := make([]*node, 0, len(clusterIDs))
+	for _, clusterID := range clusterIDs {
+		rs, n, err := nh.readIndex(clusterID, timeout)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, rs)
+		nodes = append(nodes, n)
+	}
+	for idx, rs := range requests {
+		if _, err := getRequestState(ctx, rs); err != nil {
+			return nil, err
+		}
+		rs.Release()
+		requests[idx] = nil
+	}
+	results, err := nh.unionLookup(ctx, nodes, query)
+	if err != nil {
+		return nil, err
+	}
+	acc := initial
+	for idx, result := range results {
+		acc, err = reducer(acc, clusterIDs[idx], result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+type lookupResult struct {
+	result interface{}
+	err    error
+	idx    int
+}
+
+func (nh *NodeHost) unionLookup(ctx context.Context,
+	nodes []*node, query interface{}) ([]interface{}, error) {
+	results := make([]interface{}, len(nodes))
+	resultC := make(chan lookupResult, len(nodes))
+	for idx, n := range nodes {
+		idx, n := idx, n
+		nh.engine.runOnApplyWorker(n.clusterID, func() {
+			result, err := n.sm.Lookup(query)
+			resultC <- lookupResult{result: result, err: err, idx: idx}
+		})
+	}
+	for range nodes {
+		select {
+		case r := <-resultC:
+			if r.err == rsm.ErrClusterClosed {
+				return nil, ErrClusterClosed
+			}
+			if r.err != nil {
+				return nil, r.err
+			}
+			results[r.idx] = r.result
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled {
+				return nil, ErrCanceled
+			}
+			return nil, ErrTimeout
+		}
+	}
+	return results, nil
+}